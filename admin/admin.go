@@ -0,0 +1,307 @@
+// Package admin provides a local control socket to inspect and operate a running onion router.
+//
+// The protocol is line based: each line sent by the client is a command with its arguments separated by spaces. The
+// output of the command is terminated by a line containing either "OK" or "ERR <reason>".
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bawang/errcode"
+	"bawang/onion"
+)
+
+var (
+	errUnknownCommand   = errors.New("unknown command, see help")
+	errInvalidArguments = errors.New("invalid arguments, see help")
+)
+
+// Router is the part of the onion.Router operated via the admin socket.
+type Router interface {
+	Stats() onion.Stats
+	Tunnels() []onion.TunnelInfo
+	Links() []onion.LinkInfo
+	HopLatencies() []onion.HopLatency
+	CloseTunnel(tunnelID uint32) error
+	TriggerRound()
+	SetLogging(enabled bool)
+	InjectFault(fault onion.Fault) error
+}
+
+// command is a command of the admin protocol, writing its output to w.
+type command struct {
+	args  string // synopsis of the arguments
+	short string // one line description
+	run   func(router Router, args []string, w io.Writer) error
+}
+
+// commands are all commands of the admin protocol by their name, except for help and quit.
+var commands = map[string]command{
+	"stats":   {"", "show the metrics of the router", statsCommand},
+	"tunnels": {"", "list the tunnels known to the clients", tunnelsCommand},
+	"links":   {"", "list the open links to other peers", linksCommand},
+	"hops":    {"", "list the latencies of the hops of our tunnel builds, the slowest first", hopsCommand},
+	"close":   {"<tunnel ID>", "tear down a tunnel, regardless of its clients", closeCommand},
+	"round":   {"", "start the next round right away", roundCommand},
+	"log":     {"on|off", "enable or disable the log output of the router", logCommand},
+	"fault": {"drop|delay|corrupt <n> [<address:port>|<ms>]", "inject a fault for testing, needs the build tag chaos",
+		faultCommand},
+}
+
+// execute runs the command given by a line of the admin protocol.
+func execute(router Router, line string, w io.Writer) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return errUnknownCommand
+	}
+
+	if fields[0] == "help" {
+		return helpCommand(w)
+	}
+	cmd, ok := commands[fields[0]]
+	if !ok {
+		return errUnknownCommand
+	}
+	return cmd.run(router, fields[1:], w)
+}
+
+// helpCommand lists all commands.
+func helpCommand(w io.Writer) (err error) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cmd := commands[name]
+		if _, err = fmt.Fprintf(w, "%-20s %s\n", strings.TrimSpace(name+" "+cmd.args), cmd.short); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "%-20s %s\n%-20s %s\n", "help", "list all commands", "quit", "close the connection")
+	return err
+}
+
+// statsCommand writes the metrics of the router as name value pairs, see onion.Stats.
+func statsCommand(router Router, args []string, w io.Writer) (err error) {
+	if len(args) != 0 {
+		return errInvalidArguments
+	}
+
+	stats := router.Stats()
+	_, err = fmt.Fprintf(w,
+		"outgoing_tunnels %d\ncover_tunnels %d\nincoming_tunnels %d\nlinks %d\nbanned_peers %d\ncover_cells %d\n"+
+			"build_retries %d\n",
+		stats.OutgoingTunnels, stats.CoverTunnels, stats.IncomingTunnels, stats.Links, stats.BannedPeers, stats.CoverCells,
+		stats.BuildRetries)
+	if err != nil {
+		return err
+	}
+
+	positions := make([]int, 0, len(stats.HopFailures))
+	for position := range stats.HopFailures {
+		positions = append(positions, position)
+	}
+	sort.Ints(positions)
+	for _, position := range positions {
+		_, err = fmt.Fprintf(w, "hop_failures_%d %d\n", position, stats.HopFailures[position])
+		if err != nil {
+			return err
+		}
+	}
+
+	positions = make([]int, 0, len(stats.HopLatencies))
+	for position := range stats.HopLatencies {
+		positions = append(positions, position)
+	}
+	sort.Ints(positions)
+	for _, position := range positions {
+		_, err = fmt.Fprintf(w, "hop_latency_%d_us %d\n", position, stats.HopLatencies[position].Microseconds())
+		if err != nil {
+			return err
+		}
+	}
+
+	codes := make([]errcode.Code, 0, len(stats.Errors))
+	for code := range stats.Errors {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		return codes[i] < codes[j]
+	})
+	for _, code := range codes {
+		_, err = fmt.Fprintf(w, "errors_%v %d\n", code, stats.Errors[code])
+		if err != nil {
+			return err
+		}
+	}
+
+	if !stats.NetworkSizeKnown {
+		return nil
+	}
+	_, err = fmt.Fprintf(w, "network_size %d\nnetwork_size_deviation %d\n",
+		stats.NetworkSize.Peers, stats.NetworkSize.StdDeviation)
+	return err
+}
+
+// tunnelsCommand lists the tunnels known to the clients, one per line.
+func tunnelsCommand(router Router, args []string, w io.Writer) (err error) {
+	if len(args) != 0 {
+		return errInvalidArguments
+	}
+
+	for _, tunnel := range router.Tunnels() {
+		direction := "incoming"
+		if tunnel.Outgoing {
+			direction = fmt.Sprintf("outgoing hops=%d", tunnel.Hops)
+		}
+		if tunnel.Cover {
+			direction += " cover"
+		}
+		latencies := ""
+		if len(tunnel.Latencies) > 0 {
+			rounded := make([]string, len(tunnel.Latencies))
+			for i, latency := range tunnel.Latencies {
+				rounded[i] = latency.Round(time.Microsecond).String()
+			}
+			latencies = " latencies=" + strings.Join(rounded, ",")
+		}
+		_, err = fmt.Fprintf(w, "%d %s clients=%d idle=%v%s\n", tunnel.ID, direction, tunnel.Clients,
+			tunnel.Idle.Round(time.Second), latencies)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linksCommand lists the open links to other peers, one per line.
+func linksCommand(router Router, args []string, w io.Writer) (err error) {
+	if len(args) != 0 {
+		return errInvalidArguments
+	}
+
+	for _, link := range router.Links() {
+		state := ""
+		if link.Idle {
+			state = " idle"
+		}
+		if link.Queued > 0 {
+			state += fmt.Sprintf(" queued=%d", link.Queued)
+		}
+		if len(link.ContendedTurns) > 0 {
+			// the spread of the turns shared between the circuits tells whether a circuit monopolizes the link
+			var min, max uint64
+			for _, turns := range link.ContendedTurns {
+				if min == 0 || turns < min {
+					min = turns
+				}
+				if turns > max {
+					max = turns
+				}
+			}
+			state += fmt.Sprintf(" contended=%d-%d", min, max)
+		}
+		_, err = fmt.Fprintf(w, "%s circuits=%d%s\n",
+			net.JoinHostPort(link.Address.String(), strconv.Itoa(int(link.Port))), link.Circuits, state)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hopsCommand lists the latencies of the hops our tunnels were built through, one per line, see
+// onion.Router.HopLatencies.
+func hopsCommand(router Router, args []string, w io.Writer) (err error) {
+	if len(args) != 0 {
+		return errInvalidArguments
+	}
+
+	for _, hop := range router.HopLatencies() {
+		_, err = fmt.Fprintf(w, "%s steps=%d avg=%v max=%v\n",
+			net.JoinHostPort(hop.Address.String(), strconv.Itoa(int(hop.Port))), hop.Steps,
+			hop.Average.Round(time.Microsecond), hop.Max.Round(time.Microsecond))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeCommand tears down the tunnel with the given ID, see onion.Router.CloseTunnel.
+func closeCommand(router Router, args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return errInvalidArguments
+	}
+	tunnelID, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		return errInvalidArguments
+	}
+	return router.CloseTunnel(uint32(tunnelID))
+}
+
+// roundCommand starts the next round, see onion.Router.TriggerRound.
+func roundCommand(router Router, args []string, w io.Writer) error {
+	if len(args) != 0 {
+		return errInvalidArguments
+	}
+	router.TriggerRound()
+	return nil
+}
+
+// logCommand enables or disables the log output of the router, see onion.Router.SetLogging.
+func logCommand(router Router, args []string, w io.Writer) error {
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		return errInvalidArguments
+	}
+	router.SetLogging(args[0] == "on")
+	return nil
+}
+
+// faultCommand injects a fault into the router, see onion.Router.InjectFault: The next n cells sent on the link to the
+// given peer are dropped, the next n TUNNEL CREATED responses are delayed by the given milliseconds or the digest of
+// the next n relay messages sent is corrupted.
+func faultCommand(router Router, args []string, w io.Writer) error {
+	if len(args) < 2 {
+		return errInvalidArguments
+	}
+	count, err := strconv.ParseUint(args[1], 10, 31)
+	if err != nil {
+		return errInvalidArguments
+	}
+	fault := onion.Fault{Count: int(count)}
+
+	switch {
+	case args[0] == "drop" && len(args) == 3:
+		host, port, err := net.SplitHostPort(args[2])
+		if err != nil {
+			return errInvalidArguments
+		}
+		fault.Address = net.ParseIP(host)
+		parsedPort, err := strconv.ParseUint(port, 10, 16)
+		if fault.Address == nil || err != nil {
+			return errInvalidArguments
+		}
+		fault.Kind, fault.Port = onion.FaultDropCells, uint16(parsedPort)
+	case args[0] == "delay" && len(args) == 3:
+		ms, err := strconv.ParseUint(args[2], 10, 31)
+		if err != nil {
+			return errInvalidArguments
+		}
+		fault.Kind, fault.Delay = onion.FaultDelayCreated, time.Duration(ms)*time.Millisecond
+	case args[0] == "corrupt" && len(args) == 2:
+		fault.Kind = onion.FaultCorruptDigest
+	default:
+		return errInvalidArguments
+	}
+	return router.InjectFault(fault)
+}
@@ -0,0 +1,233 @@
+package admin
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/errcode"
+	"bawang/nse"
+	"bawang/onion"
+)
+
+// fakeRouter records the operations performed via the admin socket.
+type fakeRouter struct {
+	stats   onion.Stats
+	tunnels []onion.TunnelInfo
+	links   []onion.LinkInfo
+	hops    []onion.HopLatency
+	closed  []uint32
+	rounds  int
+	logging []bool
+	faults  []onion.Fault
+}
+
+func (r *fakeRouter) Stats() onion.Stats               { return r.stats }
+func (r *fakeRouter) Tunnels() []onion.TunnelInfo      { return r.tunnels }
+func (r *fakeRouter) Links() []onion.LinkInfo          { return r.links }
+func (r *fakeRouter) HopLatencies() []onion.HopLatency { return r.hops }
+func (r *fakeRouter) TriggerRound()                    { r.rounds++ }
+func (r *fakeRouter) SetLogging(enabled bool)          { r.logging = append(r.logging, enabled) }
+
+func (r *fakeRouter) InjectFault(fault onion.Fault) error {
+	r.faults = append(r.faults, fault)
+	return nil
+}
+
+func (r *fakeRouter) CloseTunnel(tunnelID uint32) error {
+	if tunnelID == 0 {
+		return onion.ErrInvalidTunnel
+	}
+	r.closed = append(r.closed, tunnelID)
+	return nil
+}
+
+func TestExecute(t *testing.T) {
+	router := &fakeRouter{
+		stats: onion.Stats{OutgoingTunnels: 2, CoverTunnels: 1, Links: 3, CoverCells: 5},
+		tunnels: []onion.TunnelInfo{
+			{ID: 1, Outgoing: true, Cover: true, Hops: 3, Idle: 1500 * time.Millisecond},
+			{ID: 2, Clients: 2},
+		},
+		links: []onion.LinkInfo{
+			{Address: net.ParseIP("10.0.0.1"), Port: 6602, Circuits: 2},
+			{Address: net.ParseIP("::1"), Port: 6603, Idle: true},
+		},
+	}
+	run := func(line string) (string, error) {
+		var buf bytes.Buffer
+		err := execute(router, line, &buf)
+		return buf.String(), err
+	}
+
+	t.Run("stats", func(t *testing.T) {
+		out, err := run("stats")
+		require.Nil(t, err)
+		assert.Equal(t,
+			"outgoing_tunnels 2\ncover_tunnels 1\nincoming_tunnels 0\nlinks 3\nbanned_peers 0\ncover_cells 5\n"+
+				"build_retries 0\n", out)
+
+		// failed builds are listed by the hop position
+		router.stats.BuildRetries = 4
+		router.stats.HopFailures = map[int]uint64{2: 1, 0: 3}
+		out, err = run("stats")
+		require.Nil(t, err)
+		assert.Contains(t, out, "build_retries 4\nhop_failures_0 3\nhop_failures_2 1\n")
+
+		// as well as the latencies of the build steps
+		router.stats.HopLatencies = map[int]time.Duration{1: 20 * time.Millisecond, 0: 1500 * time.Microsecond}
+		out, err = run("stats")
+		require.Nil(t, err)
+		assert.Contains(t, out, "hop_failures_2 1\nhop_latency_0_us 1500\nhop_latency_1_us 20000\n")
+		router.stats.HopLatencies = nil
+
+		// errors are listed by their code
+		router.stats.Errors = map[errcode.Code]uint64{errcode.Timeout: 2, errcode.InvalidMessage: 1}
+		out, err = run("stats")
+		require.Nil(t, err)
+		assert.Contains(t, out, "hop_failures_2 1\nerrors_invalid_message 1\nerrors_timeout 2\n")
+
+		router.stats.NetworkSize = nse.Estimate{Peers: 42, StdDeviation: 3}
+		router.stats.NetworkSizeKnown = true
+		out, err = run("stats")
+		require.Nil(t, err)
+		assert.Contains(t, out, "network_size 42\nnetwork_size_deviation 3\n")
+	})
+
+	t.Run("tunnels", func(t *testing.T) {
+		out, err := run("tunnels")
+		require.Nil(t, err)
+		assert.Equal(t, "1 outgoing hops=3 cover clients=0 idle=2s\n2 incoming clients=2 idle=0s\n", out)
+
+		// along with the latency of each hop, if known
+		router.tunnels[0].Latencies = []time.Duration{1500 * time.Microsecond, 20 * time.Millisecond, 30 * time.Millisecond}
+		defer func() { router.tunnels[0].Latencies = nil }()
+		out, err = run("tunnels")
+		require.Nil(t, err)
+		assert.Equal(t, "1 outgoing hops=3 cover clients=0 idle=2s latencies=1.5ms,20ms,30ms\n"+
+			"2 incoming clients=2 idle=0s\n", out)
+	})
+
+	t.Run("hops", func(t *testing.T) {
+		router.hops = []onion.HopLatency{
+			{Address: net.ParseIP("10.0.0.1"), Port: 6602, Steps: 3, Average: 30 * time.Millisecond,
+				Max: 45 * time.Millisecond},
+			{Address: net.ParseIP("::1"), Port: 6603, Steps: 1, Average: 1234567 * time.Nanosecond,
+				Max: 1234567 * time.Nanosecond},
+		}
+		out, err := run("hops")
+		require.Nil(t, err)
+		assert.Equal(t, "10.0.0.1:6602 steps=3 avg=30ms max=45ms\n[::1]:6603 steps=1 avg=1.235ms max=1.235ms\n", out)
+
+		_, err = run("hops 1")
+		assert.Equal(t, errInvalidArguments, err)
+	})
+
+	t.Run("links", func(t *testing.T) {
+		out, err := run("links")
+		require.Nil(t, err)
+		assert.Equal(t, "10.0.0.1:6602 circuits=2\n[::1]:6603 circuits=0 idle\n", out)
+
+		// busy links show their queue and the spread of the turns shared between their circuits
+		router.links[0].Queued = 3
+		router.links[0].ContendedTurns = map[uint32]uint64{1: 40, 2: 42}
+		out, err = run("links")
+		require.Nil(t, err)
+		assert.Equal(t, "10.0.0.1:6602 circuits=2 queued=3 contended=40-42\n[::1]:6603 circuits=0 idle\n", out)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		_, err := run("close 42")
+		require.Nil(t, err)
+		assert.Equal(t, []uint32{42}, router.closed)
+
+		_, err = run("close 0")
+		assert.Equal(t, onion.ErrInvalidTunnel, err)
+		_, err = run("close")
+		assert.Equal(t, errInvalidArguments, err)
+		_, err = run("close -1")
+		assert.Equal(t, errInvalidArguments, err)
+	})
+
+	t.Run("round", func(t *testing.T) {
+		_, err := run("round")
+		require.Nil(t, err)
+		assert.Equal(t, 1, router.rounds)
+	})
+
+	t.Run("log", func(t *testing.T) {
+		_, err := run("log off")
+		require.Nil(t, err)
+		_, err = run("log  on")
+		require.Nil(t, err)
+		assert.Equal(t, []bool{false, true}, router.logging)
+
+		_, err = run("log debug")
+		assert.Equal(t, errInvalidArguments, err)
+	})
+
+	t.Run("fault", func(t *testing.T) {
+		for _, line := range []string{"fault drop 3 10.0.0.1:6602", "fault delay 1 2500", "fault corrupt 2"} {
+			_, err := run(line)
+			require.Nil(t, err)
+		}
+		assert.Equal(t, []onion.Fault{
+			{Kind: onion.FaultDropCells, Count: 3, Address: net.ParseIP("10.0.0.1"), Port: 6602},
+			{Kind: onion.FaultDelayCreated, Count: 1, Delay: 2500 * time.Millisecond},
+			{Kind: onion.FaultCorruptDigest, Count: 2},
+		}, router.faults)
+
+		for _, line := range []string{"fault", "fault drop 3", "fault drop 3 10.0.0.1", "fault drop -1 10.0.0.1:6602",
+			"fault delay 1", "fault corrupt 2 3", "fault crash 1"} {
+			_, err := run(line)
+			assert.Equal(t, errInvalidArguments, err, line)
+		}
+	})
+
+	t.Run("help", func(t *testing.T) {
+		out, err := run("help")
+		require.Nil(t, err)
+		for name := range commands {
+			assert.Contains(t, out, name)
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := run("reboot")
+		assert.Equal(t, errUnknownCommand, err)
+	})
+}
+
+func TestHandleConn(t *testing.T) {
+	router := &fakeRouter{}
+	connLocal, connRemote := net.Pipe()
+	defer connLocal.Close()
+
+	done := make(chan struct{})
+	go func() {
+		handleConn(connRemote, router)
+		close(done)
+	}()
+
+	rd := bufio.NewReader(connLocal)
+	send := func(line string) string {
+		_, err := connLocal.Write([]byte(line + "\n"))
+		require.Nil(t, err)
+		resp, err := rd.ReadString('\n')
+		require.Nil(t, err)
+		return resp
+	}
+
+	assert.Equal(t, "OK\n", send("round"))
+	assert.Equal(t, "ERR "+errUnknownCommand.Error()+"\n", send("reboot"))
+
+	_, err := connLocal.Write([]byte("quit\n"))
+	require.Nil(t, err)
+	<-done
+	assert.Equal(t, 1, router.rounds)
+}
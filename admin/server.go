@@ -0,0 +1,86 @@
+package admin
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"bawang/config"
+)
+
+// ListenAdminSocket opens the admin control socket and accepts incoming connections, which are handled concurrently
+// in goroutines. The socket is not authenticated and must only be reachable by the operator, Unix domain sockets are
+// thus only accessible by the owner. Returns once quit is closed.
+func ListenAdminSocket(cfg *config.Config, router Router, quit chan struct{}) error {
+	network := cfg.AdminNetwork()
+	if network == "unix" {
+		// a socket left behind by a crashed process would prevent listening
+		if info, err := os.Stat(cfg.AdminAddress); err == nil && info.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(cfg.AdminAddress)
+		}
+	}
+
+	ln, err := net.Listen(network, cfg.AdminAddress)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		if err = os.Chmod(cfg.AdminAddress, 0600); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+	log.Printf("Admin Socket Listening at %v\n", cfg.AdminAddress)
+
+	// close the listener once a quit signal is received to stop the loop below when blocking on ln.Accept()
+	go func() {
+		<-quit
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-quit:
+				return nil
+			default:
+			}
+			log.Printf("Error accepting admin connection: %v\n", err)
+			continue
+		}
+
+		// handle connections concurrently in goroutines
+		go handleConn(conn, router)
+	}
+}
+
+// handleConn executes the commands received on an admin connection until the client quits or closes it.
+func handleConn(conn net.Conn, router Router) {
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line == "quit" {
+			return
+		}
+
+		err := execute(router, line, w)
+		if err != nil {
+			fmt.Fprintf(w, "ERR %v\n", err)
+		} else {
+			fmt.Fprintln(w, "OK")
+		}
+		if err = w.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -5,25 +5,46 @@ import (
 	"io"
 	"log"
 	"net"
+	"time"
 
 	"bawang/api"
 	"bawang/config"
+	"bawang/health"
 	"bawang/onion"
 	"bawang/rps"
 )
 
 type Peer = rps.Peer
 
+// apiClient is the onion.Client of an API connection, translating the subscriptions of the router into the ones sent
+// by the client, see api.OnionSubscribe.
+type apiClient struct {
+	*api.Connection
+}
+
+// Subscribed implements onion.SubscribingClient.
+func (client *apiClient) Subscribed(subs onion.Subscriptions) bool {
+	var apiSubs api.Subscriptions
+	if subs&onion.SubscribeIncoming != 0 {
+		apiSubs |= api.SubscribeIncoming
+	}
+	if subs&onion.SubscribeData != 0 {
+		apiSubs |= api.SubscribeData
+	}
+	return client.Connection.Subscribed(apiSubs)
+}
+
 // HandleAPIConnection initializes a given net.Conn as an API Connection and accepts API messages,
 // dispatching to the respective logic.
 func HandleAPIConnection(nc net.Conn, router *onion.Router) {
 	// init net.Conn as an api.Connection and register it with the onion router
 	conn := api.NewConnection(nc)
-	router.RegisterAPIConnection(conn)
+	client := &apiClient{conn}
+	router.RegisterClient(client)
 
 	// ensure proper cleanup
 	defer func() {
-		err := router.RemoveAPIConnection(conn)
+		err := router.RemoveClient(client)
 		if err != nil {
 			log.Printf("Error terminating API conn: %v\n", err)
 		}
@@ -45,6 +66,19 @@ func HandleAPIConnection(nc net.Conn, router *onion.Router) {
 			return
 		}
 
+		// only connections registered on a tunnel may use it, others have to join it first
+		if tunnelID, ok := requestedTunnel(apiMsg); ok {
+			err = router.CheckClient(tunnelID, client)
+			if err != nil {
+				log.Printf("Refusing %v on onion tunnel %v: %v\n", apiMsg.Type(), tunnelID, err)
+				err = conn.SendError(tunnelID, apiMsg.Type(), err)
+				if err != nil {
+					return
+				}
+				continue
+			}
+		}
+
 		// handle message
 		switch msg := apiMsg.(type) {
 		case *api.OnionTunnelBuild:
@@ -62,43 +96,41 @@ func HandleAPIConnection(nc net.Conn, router *onion.Router) {
 			}
 
 			// instruct onion router to build tunnel with given peers
-			tunnelReplyChan := router.BuildTunnel(targetPeer, conn)
-
-			// wait for the reply
-			tunnelReply, ok := <-tunnelReplyChan
-			if !ok { // chan was closed, meaning the router shut down
-				return
+			var tunnelReplyChan chan onion.BuildTunnelReply
+			if msg.Multipath {
+				tunnelReplyChan = router.BuildMultipathTunnel(targetPeer, client)
+			} else {
+				tunnelReplyChan = router.BuildTunnel(targetPeer, client)
 			}
-			if tunnelReply.Err != nil {
-				log.Printf("Error building tunnel: %v\n", err)
-				err = conn.SendError(0, api.TypeOnionTunnelBuild)
-				if err != nil {
-					log.Printf("Error sending error: %v\n", err)
-				}
+			if !awaitTunnel(router, conn, tunnelReplyChan, api.TypeOnionTunnelBuild, msg.DestHostKey) {
+				return
 			}
-			tunnel := tunnelReply.Tunnel
-
-			// start handling messages for this tunnel
-			go router.HandleOutgoingTunnel(tunnel)
 
-			// send confirmation
-			err = conn.Send(&api.OnionTunnelReady{
-				TunnelID:    tunnel.ID(),
-				DestHostKey: msg.DestHostKey,
-			})
+		case *api.OnionTunnelPinned:
+			var targetPeer *Peer
+			var hops []*Peer
+			targetPeer, hops, err = pinnedPeers(msg)
 			if err != nil {
-				err = conn.SendError(tunnel.ID(), api.TypeOnionTunnelBuild)
+				log.Printf("Error parsing host key: %v\n", err)
+				err = conn.SendError(0, api.TypeOnionTunnelPinned, api.ErrInvalidMessage)
 				if err != nil {
 					return
 				}
+				continue
+			}
+
+			// instruct onion router to build tunnel through the given hops
+			tunnelReplyChan := router.BuildPinnedTunnel(targetPeer, hops, client)
+			if !awaitTunnel(router, conn, tunnelReplyChan, api.TypeOnionTunnelPinned, msg.Destination.HostKey) {
+				return
 			}
 
 		case *api.OnionTunnelDestroy:
 			log.Printf("Destroying Onion tunnel with ID: %v\n", msg.TunnelID)
-			err = router.RemoveAPIConnectionFromTunnel(msg.TunnelID, conn)
+			err = router.RemoveClientFromTunnel(msg.TunnelID, client)
 			if err != nil {
 				log.Printf("Error destrying Onion tunnel with ID: %v\n", msg.TunnelID)
-				err = conn.SendError(msg.TunnelID, api.TypeOnionTunnelDestroy)
+				err = conn.SendError(msg.TunnelID, api.TypeOnionTunnelDestroy, err)
 				if err != nil {
 					return
 				}
@@ -109,17 +141,165 @@ func HandleAPIConnection(nc net.Conn, router *onion.Router) {
 			log.Printf("Sending Data on Onion tunnel %v\n", msg.TunnelID)
 			if err != nil {
 				log.Printf("Error sending onion data on tunnel %v\n", msg.TunnelID)
-				err = conn.SendError(msg.TunnelID, api.TypeOnionTunnelData)
+				err = conn.SendError(msg.TunnelID, api.TypeOnionTunnelData, err)
+				if err != nil {
+					return
+				}
+			}
+
+		case *api.OnionTunnelDatagram:
+			err = router.SendDatagram(msg.TunnelID, msg.Data)
+			if err != nil {
+				log.Printf("Error sending onion datagram on tunnel %v\n", msg.TunnelID)
+				err = conn.SendError(msg.TunnelID, api.TypeOnionTunnelDatagram, err)
 				if err != nil {
 					return
 				}
 			}
 
+		case *api.OnionTunnelEOF:
+			err = router.SendEOF(msg.TunnelID)
+			if err != nil {
+				log.Printf("Error sending EOF on onion tunnel %v: %v\n", msg.TunnelID, err)
+				err = conn.SendError(msg.TunnelID, api.TypeOnionTunnelEOF, err)
+				if err != nil {
+					return
+				}
+			}
+
+		case *api.OnionTunnelPriority:
+			err = router.SetTunnelPriority(msg.TunnelID, onion.Priority(msg.Priority))
+			if err != nil {
+				log.Printf("Error setting priority of onion tunnel %v: %v\n", msg.TunnelID, err)
+				err = conn.SendError(msg.TunnelID, api.TypeOnionTunnelPriority, err)
+				if err != nil {
+					return
+				}
+			}
+
+		case *api.OnionTunnelPing:
+			var rtt time.Duration
+			rtt, err = router.PingTunnel(msg.TunnelID)
+			if err != nil {
+				log.Printf("Error pinging onion tunnel %v: %v\n", msg.TunnelID, err)
+				err = conn.SendError(msg.TunnelID, api.TypeOnionTunnelPing, err)
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			err = conn.Send(&api.OnionTunnelPong{
+				TunnelID: msg.TunnelID,
+				RTT:      uint32(rtt / time.Microsecond),
+			})
+			if err != nil {
+				log.Printf("Error sending pong: %v\n", err)
+				return
+			}
+
+		case *api.OnionTrafficQuery:
+			var traffic onion.TunnelTraffic
+			traffic, err = router.TunnelTraffic(msg.TunnelID)
+			if err != nil {
+				log.Printf("Error querying traffic of onion tunnel %v: %v\n", msg.TunnelID, err)
+				err = conn.SendError(msg.TunnelID, api.TypeOnionTrafficQuery, err)
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			err = conn.Send(&api.OnionTunnelTraffic{
+				TunnelID:      msg.TunnelID,
+				BytesSent:     traffic.BytesSent,
+				BytesReceived: traffic.BytesReceived,
+				CellsSent:     traffic.CellsSent,
+				CellsReceived: traffic.CellsReceived,
+				CoverSent:     traffic.CoverSent,
+				CoverReceived: traffic.CoverReceived,
+			})
+			if err != nil {
+				log.Printf("Error sending tunnel traffic: %v\n", err)
+				return
+			}
+
+		case *api.OnionMTUQuery:
+			var data, datagram int
+			data, datagram, err = router.TunnelMTU(msg.TunnelID)
+			if err != nil {
+				log.Printf("Error querying MTU of onion tunnel %v: %v\n", msg.TunnelID, err)
+				err = conn.SendError(msg.TunnelID, api.TypeOnionMTUQuery, err)
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			err = conn.Send(&api.OnionTunnelMTU{
+				TunnelID:     msg.TunnelID,
+				DataSize:     uint16(data),
+				DatagramSize: uint16(datagram),
+			})
+			if err != nil {
+				log.Printf("Error sending tunnel MTU: %v\n", err)
+				return
+			}
+
 		case *api.OnionCover:
 			err = router.SendCover(msg.CoverSize)
 			if err != nil {
 				log.Println("Error when sending cover traffic")
-				_ = conn.SendError(0, api.TypeOnionCover)
+				_ = conn.SendError(0, api.TypeOnionCover, err)
+				return
+			}
+
+		case *api.OnionHello:
+			// capabilities unknown to us are not used
+			err = conn.Send(&api.OnionCapabilities{Capabilities: msg.Capabilities & api.SupportedCapabilities})
+			if err != nil {
+				log.Printf("Error sending capabilities: %v\n", err)
+				return
+			}
+
+		case *api.OnionSubscribe:
+			conn.Subscribe(msg.Subscriptions)
+
+		case *api.OnionTunnelShare:
+			var token uint64
+			token, err = router.ShareTunnel(msg.TunnelID, client)
+			if err != nil {
+				log.Printf("Error sharing onion tunnel %v: %v\n", msg.TunnelID, err)
+				err = conn.SendError(msg.TunnelID, api.TypeOnionTunnelShare, err)
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			err = conn.Send(&api.OnionShareToken{
+				TunnelID: msg.TunnelID,
+				Token:    token,
+			})
+			if err != nil {
+				log.Printf("Error sending share token: %v\n", err)
+				return
+			}
+
+		case *api.OnionTunnelJoin:
+			err = router.JoinTunnel(msg.TunnelID, msg.Token, client)
+			if err != nil {
+				log.Printf("Error joining onion tunnel %v: %v\n", msg.TunnelID, err)
+				err = conn.SendError(msg.TunnelID, api.TypeOnionTunnelJoin, err)
+				if err != nil {
+					return
+				}
+			}
+
+		case *api.OnionPeersQuery:
+			err = conn.Send(bannedPeersMsg(router.BannedPeers()))
+			if err != nil {
+				log.Printf("Error sending banned peers: %v\n", err)
 				return
 			}
 
@@ -129,26 +309,159 @@ func HandleAPIConnection(nc net.Conn, router *onion.Router) {
 	}
 }
 
+// awaitTunnel waits for the tunnel requested by a message of the given type and confirms it to the client.
+// Returns false if the connection must be closed.
+func awaitTunnel(router *onion.Router, conn *api.Connection, tunnelReplyChan chan onion.BuildTunnelReply,
+	requestType api.Type, destHostKey []byte) (ok bool) {
+	// wait for the reply
+	tunnelReply, ok := <-tunnelReplyChan
+	if !ok { // chan was closed, meaning the router shut down
+		return false
+	}
+	if tunnelReply.Err != nil {
+		log.Printf("Error building tunnel: %v\n", tunnelReply.Err)
+		err := conn.SendError(0, requestType, tunnelReply.Err)
+		if err != nil {
+			log.Printf("Error sending error: %v\n", err)
+		}
+		return true
+	}
+	tunnel := tunnelReply.Tunnel
+
+	// let the destination speak first if it wants to
+	err := router.AnnounceTunnel(tunnel.ID())
+	if err != nil {
+		log.Printf("Error announcing tunnel %v: %v\n", tunnel.ID(), err)
+	}
+
+	// send confirmation, along with the path metadata if the client asked for it
+	ready := &api.OnionTunnelReady{
+		TunnelID:    tunnel.ID(),
+		DestHostKey: destHostKey,
+	}
+	if conn.Capabilities()&api.CapTunnelPath != 0 {
+		ready.HasPath = true
+		ready.Hops = uint8(tunnel.Hops())
+		ready.BuildTime = uint32(tunnel.BuildTime() / time.Millisecond)
+	}
+	err = conn.Send(ready)
+	if err != nil {
+		err = conn.SendError(tunnel.ID(), requestType, err)
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// requestedTunnel returns the ID of the tunnel the given request uses, if any. Requests for tunnels are only served
+// for clients registered on them, see Router.CheckClient.
+func requestedTunnel(msg api.Message) (tunnelID uint32, ok bool) {
+	switch msg := msg.(type) {
+	case *api.OnionTunnelDestroy:
+		return msg.TunnelID, true
+	case *api.OnionTunnelData:
+		return msg.TunnelID, true
+	case *api.OnionTunnelDatagram:
+		return msg.TunnelID, true
+	case *api.OnionTunnelEOF:
+		return msg.TunnelID, true
+	case *api.OnionTunnelPriority:
+		return msg.TunnelID, true
+	case *api.OnionTunnelPing:
+		return msg.TunnelID, true
+	case *api.OnionTrafficQuery:
+		return msg.TunnelID, true
+	case *api.OnionMTUQuery:
+		return msg.TunnelID, true
+	default:
+		return 0, false
+	}
+}
+
+// pinnedPeers converts the destination and the intermediate hops listed in an OnionTunnelPinned message.
+func pinnedPeers(msg *api.OnionTunnelPinned) (targetPeer *Peer, hops []*Peer, err error) {
+	toPeer := func(peer *api.OnionPeer) (*Peer, error) {
+		hostKey, err := peer.ParseHostKey()
+		if err != nil {
+			return nil, err
+		}
+		return &Peer{
+			Port:    peer.Port,
+			Address: peer.Address,
+			HostKey: hostKey,
+		}, nil
+	}
+
+	targetPeer, err = toPeer(&msg.Destination)
+	if err != nil {
+		return nil, nil, err
+	}
+	hops = make([]*Peer, 0, len(msg.Hops))
+	for i := range msg.Hops {
+		hop, err := toPeer(&msg.Hops[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		hops = append(hops, hop)
+	}
+	return targetPeer, hops, nil
+}
+
+// bannedPeersMsg converts the banned peers to an OnionPeersBanned message.
+// If there are too many peers to fit into a single message, only the ones with the longest remaining ban are included.
+func bannedPeersMsg(peers []onion.BannedPeer) *api.OnionPeersBanned {
+	if len(peers) > api.MaxBannedPeers {
+		peers = peers[:api.MaxBannedPeers]
+	}
+
+	now := time.Now()
+	msg := &api.OnionPeersBanned{
+		Peers: make([]api.OnionBannedPeer, 0, len(peers)),
+	}
+	for _, peer := range peers {
+		remaining := peer.Until.Sub(now).Round(time.Second)
+		if remaining < 0 {
+			remaining = 0
+		}
+		msg.Peers = append(msg.Peers, api.OnionBannedPeer{
+			IPv6:      peer.Address.To4() == nil,
+			Reason:    uint8(peer.Reason),
+			Port:      peer.Port,
+			Remaining: uint32(remaining / time.Second),
+			Address:   peer.Address,
+		})
+	}
+	return msg
+}
+
 // ListenAPISocket opens the API endpoint socket and accepts incoming connections,
-// which are handled concurrently in goroutines.
-func ListenAPISocket(cfg *config.Config, router *onion.Router, errOut chan error, quit chan struct{}) {
+// which are handled concurrently in goroutines. The listening flag is up while connections are accepted.
+// Returns once quit is closed.
+func ListenAPISocket(cfg *config.Config, router *onion.Router, listening *health.Flag, quit chan struct{}) error {
 	ln, err := net.Listen("tcp", cfg.OnionAPIAddress)
 	if err != nil {
-		errOut <- err
-		return
+		return err
 	}
-	defer ln.Close()
 	log.Printf("API Server Listening at %v\n", cfg.OnionAPIAddress)
 
-	for {
-		select {
-		case <-quit:
-			return
-		default:
-		}
+	listening.Set(true)
+	defer listening.Set(false)
 
+	// close the listener once a quit signal is received to stop the loop below when blocking on ln.Accept()
+	go func() {
+		<-quit
+		ln.Close()
+	}()
+
+	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			select {
+			case <-quit:
+				return nil
+			default:
+			}
 			log.Printf("Error accepting client connection: %v\n", err)
 			continue
 		}
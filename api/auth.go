@@ -0,0 +1,561 @@
+package api
+
+import (
+	"encoding/binary"
+)
+
+const flagCleartext = 1
+
+// AuthSessionStart asks the Onion Auth module to start a session with the peer holding the given host key.
+// The module replies with an AuthSessionHS1 containing the first handshake message for the peer.
+type AuthSessionStart struct {
+	RequestID uint32
+	HostKey   []byte // DER encoded public host key of the peer
+}
+
+// Type returns the type of the message.
+func (msg *AuthSessionStart) Type() Type {
+	return TypeAuthSessionStart
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *AuthSessionStart) Parse(data []byte) (err error) {
+	msg.RequestID, msg.HostKey, err = parseAuthPayload(data)
+	return err
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *AuthSessionStart) PackedSize() (n int) {
+	return 4 + 4 + len(msg.HostKey)
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *AuthSessionStart) Pack(buf []byte) (n int, err error) {
+	return packAuthPayload(buf, msg.RequestID, msg.HostKey)
+}
+
+// AuthSessionHS1 is sent by the Onion Auth module as a response to the AUTH SESSION START message.
+type AuthSessionHS1 struct {
+	SessionID uint16
+	RequestID uint32
+	Payload   []byte // handshake message for the peer
+}
+
+// Type returns the type of the message.
+func (msg *AuthSessionHS1) Type() Type {
+	return TypeAuthSessionHS1
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *AuthSessionHS1) Parse(data []byte) (err error) {
+	msg.SessionID, msg.RequestID, msg.Payload, err = parseAuthSessionPayload(data)
+	return err
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *AuthSessionHS1) PackedSize() (n int) {
+	return 2 + 2 + 4 + len(msg.Payload)
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *AuthSessionHS1) Pack(buf []byte) (n int, err error) {
+	return packAuthSessionPayload(buf, msg.SessionID, msg.RequestID, msg.Payload)
+}
+
+// AuthSessionIncomingHS1 passes the first handshake message received from a peer to the Onion Auth module.
+// The module replies with an AuthSessionHS2 containing the handshake message for the peer.
+type AuthSessionIncomingHS1 struct {
+	RequestID uint32
+	Payload   []byte
+}
+
+// Type returns the type of the message.
+func (msg *AuthSessionIncomingHS1) Type() Type {
+	return TypeAuthSessionIncomingHS1
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *AuthSessionIncomingHS1) Parse(data []byte) (err error) {
+	msg.RequestID, msg.Payload, err = parseAuthPayload(data)
+	return err
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *AuthSessionIncomingHS1) PackedSize() (n int) {
+	return 4 + 4 + len(msg.Payload)
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *AuthSessionIncomingHS1) Pack(buf []byte) (n int, err error) {
+	return packAuthPayload(buf, msg.RequestID, msg.Payload)
+}
+
+// AuthSessionHS2 is sent by the Onion Auth module as a response to the AUTH SESSION INCOMING HS1 message.
+type AuthSessionHS2 struct {
+	SessionID uint16
+	RequestID uint32
+	Payload   []byte // handshake message for the peer
+}
+
+// Type returns the type of the message.
+func (msg *AuthSessionHS2) Type() Type {
+	return TypeAuthSessionHS2
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *AuthSessionHS2) Parse(data []byte) (err error) {
+	msg.SessionID, msg.RequestID, msg.Payload, err = parseAuthSessionPayload(data)
+	return err
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *AuthSessionHS2) PackedSize() (n int) {
+	return 2 + 2 + 4 + len(msg.Payload)
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *AuthSessionHS2) Pack(buf []byte) (n int, err error) {
+	return packAuthSessionPayload(buf, msg.SessionID, msg.RequestID, msg.Payload)
+}
+
+// AuthSessionIncomingHS2 passes the second handshake message received from a peer to the Onion Auth module,
+// completing the session started with AUTH SESSION START. The module does not reply unless an error occurs.
+type AuthSessionIncomingHS2 struct {
+	SessionID uint16
+	RequestID uint32
+	Payload   []byte
+}
+
+// Type returns the type of the message.
+func (msg *AuthSessionIncomingHS2) Type() Type {
+	return TypeAuthSessionIncomingHS2
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *AuthSessionIncomingHS2) Parse(data []byte) (err error) {
+	msg.SessionID, msg.RequestID, msg.Payload, err = parseAuthSessionPayload(data)
+	return err
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *AuthSessionIncomingHS2) PackedSize() (n int) {
+	return 2 + 2 + 4 + len(msg.Payload)
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *AuthSessionIncomingHS2) Pack(buf []byte) (n int, err error) {
+	return packAuthSessionPayload(buf, msg.SessionID, msg.RequestID, msg.Payload)
+}
+
+// AuthLayerEncrypt asks the Onion Auth module to encrypt the payload with the keys of multiple sessions, applying the
+// layers in the given order. The module replies with an AuthLayerEncryptResp.
+type AuthLayerEncrypt struct {
+	RequestID  uint32
+	SessionIDs []uint16
+	Payload    []byte
+}
+
+// Type returns the type of the message.
+func (msg *AuthLayerEncrypt) Type() Type {
+	return TypeAuthLayerEncrypt
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *AuthLayerEncrypt) Parse(data []byte) (err error) {
+	msg.RequestID, msg.SessionIDs, msg.Payload, err = parseAuthLayerPayload(data)
+	return err
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *AuthLayerEncrypt) PackedSize() (n int) {
+	return 4 + 4 + 2*len(msg.SessionIDs) + len(msg.Payload)
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *AuthLayerEncrypt) Pack(buf []byte) (n int, err error) {
+	return packAuthLayerPayload(buf, msg.RequestID, msg.SessionIDs, msg.Payload)
+}
+
+// AuthLayerDecrypt asks the Onion Auth module to remove the layers of encryption of multiple sessions from the payload
+// in the given order. The module replies with an AuthLayerDecryptResp.
+type AuthLayerDecrypt struct {
+	RequestID  uint32
+	SessionIDs []uint16
+	Payload    []byte
+}
+
+// Type returns the type of the message.
+func (msg *AuthLayerDecrypt) Type() Type {
+	return TypeAuthLayerDecrypt
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *AuthLayerDecrypt) Parse(data []byte) (err error) {
+	msg.RequestID, msg.SessionIDs, msg.Payload, err = parseAuthLayerPayload(data)
+	return err
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *AuthLayerDecrypt) PackedSize() (n int) {
+	return 4 + 4 + 2*len(msg.SessionIDs) + len(msg.Payload)
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *AuthLayerDecrypt) Pack(buf []byte) (n int, err error) {
+	return packAuthLayerPayload(buf, msg.RequestID, msg.SessionIDs, msg.Payload)
+}
+
+// AuthLayerEncryptResp is sent by the Onion Auth module as a response to the AUTH LAYER ENCRYPT message.
+type AuthLayerEncryptResp struct {
+	RequestID uint32
+	Payload   []byte
+}
+
+// Type returns the type of the message.
+func (msg *AuthLayerEncryptResp) Type() Type {
+	return TypeAuthLayerEncryptResp
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *AuthLayerEncryptResp) Parse(data []byte) (err error) {
+	msg.RequestID, msg.Payload, err = parseAuthPayload(data)
+	return err
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *AuthLayerEncryptResp) PackedSize() (n int) {
+	return 4 + 4 + len(msg.Payload)
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *AuthLayerEncryptResp) Pack(buf []byte) (n int, err error) {
+	return packAuthPayload(buf, msg.RequestID, msg.Payload)
+}
+
+// AuthLayerDecryptResp is sent by the Onion Auth module as a response to the AUTH LAYER DECRYPT message.
+type AuthLayerDecryptResp struct {
+	RequestID uint32
+	Payload   []byte
+}
+
+// Type returns the type of the message.
+func (msg *AuthLayerDecryptResp) Type() Type {
+	return TypeAuthLayerDecryptResp
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *AuthLayerDecryptResp) Parse(data []byte) (err error) {
+	msg.RequestID, msg.Payload, err = parseAuthPayload(data)
+	return err
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *AuthLayerDecryptResp) PackedSize() (n int) {
+	return 4 + 4 + len(msg.Payload)
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *AuthLayerDecryptResp) Pack(buf []byte) (n int, err error) {
+	return packAuthPayload(buf, msg.RequestID, msg.Payload)
+}
+
+// AuthSessionClose tells the Onion Auth module to forget the keys of a session. The module does not reply.
+type AuthSessionClose struct {
+	SessionID uint16
+}
+
+// Type returns the type of the message.
+func (msg *AuthSessionClose) Type() Type {
+	return TypeAuthSessionClose
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *AuthSessionClose) Parse(data []byte) (err error) {
+	const size = 2 + 2
+	if len(data) < size {
+		return ErrInvalidMessage
+	}
+
+	// 2 bytes reserved
+	msg.SessionID = binary.BigEndian.Uint16(data[2:4])
+	return nil
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *AuthSessionClose) PackedSize() (n int) {
+	return 2 + 2
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *AuthSessionClose) Pack(buf []byte) (n int, err error) {
+	n = msg.PackedSize()
+	if len(buf) < n {
+		return -1, ErrBufferTooSmall
+	}
+
+	binary.BigEndian.PutUint16(buf[0:2], 0) // reserved
+	binary.BigEndian.PutUint16(buf[2:4], msg.SessionID)
+	return n, nil
+}
+
+// AuthError is sent by the Onion Auth module if it could not handle the request with the given ID.
+type AuthError struct {
+	RequestID uint32
+}
+
+// Type returns the type of the message.
+func (msg *AuthError) Type() Type {
+	return TypeAuthError
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *AuthError) Parse(data []byte) (err error) {
+	msg.RequestID, _, err = parseAuthPayload(data)
+	return err
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *AuthError) PackedSize() (n int) {
+	return 4 + 4
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *AuthError) Pack(buf []byte) (n int, err error) {
+	return packAuthPayload(buf, msg.RequestID, nil)
+}
+
+// AuthCipherEncrypt asks the Onion Auth module to encrypt the payload with the key of a single session.
+// The module replies with an AuthCipherEncryptResp.
+type AuthCipherEncrypt struct {
+	SessionID uint16
+	RequestID uint32
+	Payload   []byte
+}
+
+// Type returns the type of the message.
+func (msg *AuthCipherEncrypt) Type() Type {
+	return TypeAuthCipherEncrypt
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *AuthCipherEncrypt) Parse(data []byte) (err error) {
+	msg.SessionID, msg.RequestID, msg.Payload, err = parseAuthSessionPayload(data)
+	return err
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *AuthCipherEncrypt) PackedSize() (n int) {
+	return 2 + 2 + 4 + len(msg.Payload)
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *AuthCipherEncrypt) Pack(buf []byte) (n int, err error) {
+	return packAuthSessionPayload(buf, msg.SessionID, msg.RequestID, msg.Payload)
+}
+
+// AuthCipherEncryptResp is sent by the Onion Auth module as a response to the AUTH CIPHER ENCRYPT message.
+type AuthCipherEncryptResp struct {
+	RequestID uint32
+	Payload   []byte
+}
+
+// Type returns the type of the message.
+func (msg *AuthCipherEncryptResp) Type() Type {
+	return TypeAuthCipherEncryptResp
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *AuthCipherEncryptResp) Parse(data []byte) (err error) {
+	msg.RequestID, msg.Payload, err = parseAuthPayload(data)
+	return err
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *AuthCipherEncryptResp) PackedSize() (n int) {
+	return 4 + 4 + len(msg.Payload)
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *AuthCipherEncryptResp) Pack(buf []byte) (n int, err error) {
+	return packAuthPayload(buf, msg.RequestID, msg.Payload)
+}
+
+// AuthCipherDecrypt asks the Onion Auth module to remove the layer of encryption of a single session from the payload.
+// The module replies with an AuthCipherDecryptResp.
+type AuthCipherDecrypt struct {
+	SessionID uint16
+	RequestID uint32
+	Payload   []byte
+}
+
+// Type returns the type of the message.
+func (msg *AuthCipherDecrypt) Type() Type {
+	return TypeAuthCipherDecrypt
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *AuthCipherDecrypt) Parse(data []byte) (err error) {
+	msg.SessionID, msg.RequestID, msg.Payload, err = parseAuthSessionPayload(data)
+	return err
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *AuthCipherDecrypt) PackedSize() (n int) {
+	return 2 + 2 + 4 + len(msg.Payload)
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *AuthCipherDecrypt) Pack(buf []byte) (n int, err error) {
+	return packAuthSessionPayload(buf, msg.SessionID, msg.RequestID, msg.Payload)
+}
+
+// AuthCipherDecryptResp is sent by the Onion Auth module as a response to the AUTH CIPHER DECRYPT message.
+type AuthCipherDecryptResp struct {
+	Cleartext bool // whether the payload carries no other layers of encryption
+	RequestID uint32
+	Payload   []byte
+}
+
+// Type returns the type of the message.
+func (msg *AuthCipherDecryptResp) Type() Type {
+	return TypeAuthCipherDecryptResp
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *AuthCipherDecryptResp) Parse(data []byte) (err error) {
+	msg.RequestID, msg.Payload, err = parseAuthPayload(data)
+	if err != nil {
+		return err
+	}
+
+	msg.Cleartext = data[3]&flagCleartext > 0
+	return nil
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *AuthCipherDecryptResp) PackedSize() (n int) {
+	return 4 + 4 + len(msg.Payload)
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *AuthCipherDecryptResp) Pack(buf []byte) (n int, err error) {
+	n, err = packAuthPayload(buf, msg.RequestID, msg.Payload)
+	if err != nil {
+		return n, err
+	}
+
+	if msg.Cleartext {
+		buf[3] = flagCleartext
+	}
+	return n, nil
+}
+
+// parseAuthPayload parses the common layout of Onion Auth messages not referring to a session: 4 bytes reserved
+// (or flags), the request ID and the payload.
+func parseAuthPayload(data []byte) (requestID uint32, payload []byte, err error) {
+	const minSize = 4 + 4
+	if len(data) < minSize {
+		return 0, nil, ErrInvalidMessage
+	}
+
+	requestID = binary.BigEndian.Uint32(data[4:8])
+
+	// must make a copy!
+	payload = make([]byte, len(data)-minSize)
+	copy(payload, data[minSize:])
+	return requestID, payload, nil
+}
+
+// packAuthPayload serializes the values into a bytes slice, the counterpart of parseAuthPayload.
+func packAuthPayload(buf []byte, requestID uint32, payload []byte) (n int, err error) {
+	n = 4 + 4 + len(payload)
+	if len(buf) < n {
+		return -1, ErrBufferTooSmall
+	}
+
+	binary.BigEndian.PutUint32(buf[0:4], 0) // reserved
+	binary.BigEndian.PutUint32(buf[4:8], requestID)
+	copy(buf[8:n], payload)
+	return n, nil
+}
+
+// parseAuthSessionPayload parses the common layout of Onion Auth messages referring to a session: 2 bytes reserved,
+// the session ID, the request ID and the payload.
+func parseAuthSessionPayload(data []byte) (sessionID uint16, requestID uint32, payload []byte, err error) {
+	const minSize = 2 + 2 + 4
+	if len(data) < minSize {
+		return 0, 0, nil, ErrInvalidMessage
+	}
+
+	sessionID = binary.BigEndian.Uint16(data[2:4])
+	requestID = binary.BigEndian.Uint32(data[4:8])
+
+	// must make a copy!
+	payload = make([]byte, len(data)-minSize)
+	copy(payload, data[minSize:])
+	return sessionID, requestID, payload, nil
+}
+
+// packAuthSessionPayload serializes the values into a bytes slice, the counterpart of parseAuthSessionPayload.
+func packAuthSessionPayload(buf []byte, sessionID uint16, requestID uint32, payload []byte) (n int, err error) {
+	n = 2 + 2 + 4 + len(payload)
+	if len(buf) < n {
+		return -1, ErrBufferTooSmall
+	}
+
+	binary.BigEndian.PutUint16(buf[0:2], 0) // reserved
+	binary.BigEndian.PutUint16(buf[2:4], sessionID)
+	binary.BigEndian.PutUint32(buf[4:8], requestID)
+	copy(buf[8:n], payload)
+	return n, nil
+}
+
+// parseAuthLayerPayload parses the layout of the Onion Auth messages encrypting multiple layers: 3 bytes reserved,
+// the number of layers, the request ID, the session IDs of all layers and the payload.
+func parseAuthLayerPayload(data []byte) (requestID uint32, sessionIDs []uint16, payload []byte, err error) {
+	const minSize = 3 + 1 + 4
+	if len(data) < minSize {
+		return 0, nil, nil, ErrInvalidMessage
+	}
+
+	numLayers := int(data[3])
+	requestID = binary.BigEndian.Uint32(data[4:8])
+	if len(data) < minSize+2*numLayers {
+		return 0, nil, nil, ErrInvalidMessage
+	}
+
+	sessionIDs = make([]uint16, numLayers)
+	for i := range sessionIDs {
+		sessionIDs[i] = binary.BigEndian.Uint16(data[minSize+2*i:])
+	}
+
+	// must make a copy!
+	offset := minSize + 2*numLayers
+	payload = make([]byte, len(data)-offset)
+	copy(payload, data[offset:])
+	return requestID, sessionIDs, payload, nil
+}
+
+// packAuthLayerPayload serializes the values into a bytes slice, the counterpart of parseAuthLayerPayload.
+func packAuthLayerPayload(buf []byte, requestID uint32, sessionIDs []uint16, payload []byte) (n int, err error) {
+	if len(sessionIDs) > 0xff {
+		return -1, ErrInvalidMessage
+	}
+
+	n = 4 + 4 + 2*len(sessionIDs) + len(payload)
+	if len(buf) < n {
+		return -1, ErrBufferTooSmall
+	}
+
+	copy(buf[0:3], []byte{0x00, 0x00, 0x00}) // reserved
+	buf[3] = uint8(len(sessionIDs))
+	binary.BigEndian.PutUint32(buf[4:8], requestID)
+
+	offset := 8
+	for _, sessionID := range sessionIDs {
+		binary.BigEndian.PutUint16(buf[offset:], sessionID)
+		offset += 2
+	}
+	copy(buf[offset:n], payload)
+	return n, nil
+}
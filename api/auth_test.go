@@ -0,0 +1,170 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ensure that the implementations match the interface
+var (
+	_ Message = &AuthSessionStart{}
+	_ Message = &AuthSessionHS1{}
+	_ Message = &AuthSessionIncomingHS1{}
+	_ Message = &AuthSessionHS2{}
+	_ Message = &AuthSessionIncomingHS2{}
+	_ Message = &AuthLayerEncrypt{}
+	_ Message = &AuthLayerDecrypt{}
+	_ Message = &AuthLayerEncryptResp{}
+	_ Message = &AuthLayerDecryptResp{}
+	_ Message = &AuthSessionClose{}
+	_ Message = &AuthError{}
+	_ Message = &AuthCipherEncrypt{}
+	_ Message = &AuthCipherEncryptResp{}
+	_ Message = &AuthCipherDecrypt{}
+	_ Message = &AuthCipherDecryptResp{}
+)
+
+func TestAuthMessageTypes(t *testing.T) {
+	msgs := map[Type]Message{
+		TypeAuthSessionStart:       &AuthSessionStart{},
+		TypeAuthSessionHS1:         &AuthSessionHS1{},
+		TypeAuthSessionIncomingHS1: &AuthSessionIncomingHS1{},
+		TypeAuthSessionHS2:         &AuthSessionHS2{},
+		TypeAuthSessionIncomingHS2: &AuthSessionIncomingHS2{},
+		TypeAuthLayerEncrypt:       &AuthLayerEncrypt{},
+		TypeAuthLayerDecrypt:       &AuthLayerDecrypt{},
+		TypeAuthLayerEncryptResp:   &AuthLayerEncryptResp{},
+		TypeAuthLayerDecryptResp:   &AuthLayerDecryptResp{},
+		TypeAuthSessionClose:       &AuthSessionClose{},
+		TypeAuthError:              &AuthError{},
+		TypeAuthCipherEncrypt:      &AuthCipherEncrypt{},
+		TypeAuthCipherEncryptResp:  &AuthCipherEncryptResp{},
+		TypeAuthCipherDecrypt:      &AuthCipherDecrypt{},
+		TypeAuthCipherDecryptResp:  &AuthCipherDecryptResp{},
+	}
+	for msgType, msg := range msgs {
+		assert.Equal(t, msgType, msg.Type())
+
+		// empty data
+		assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}), "type %d", msgType)
+
+		// too small buf for packing
+		_, packErr := msg.Pack([]byte{})
+		assert.Equal(t, ErrBufferTooSmall, packErr, "type %d", msgType)
+	}
+}
+
+func TestAuthSessionStart(t *testing.T) {
+	msg := new(AuthSessionStart)
+
+	data := []byte{0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, AuthSessionStart{
+		RequestID: 0x01020304,
+		HostKey:   []byte{5, 6, 7},
+	}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestAuthSessionHS1(t *testing.T) {
+	msg := new(AuthSessionHS1)
+
+	data := []byte{0, 0, 1, 2, 3, 4, 5, 6, 7, 8}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, AuthSessionHS1{
+		SessionID: 0x0102,
+		RequestID: 0x03040506,
+		Payload:   []byte{7, 8},
+	}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+
+	// the payload must be copied
+	data[9] = 0xff
+	assert.Equal(t, []byte{7, 8}, msg.Payload)
+}
+
+func TestAuthLayerEncrypt(t *testing.T) {
+	msg := new(AuthLayerEncrypt)
+
+	t.Run("valid", func(t *testing.T) {
+		data := []byte{0, 0, 0, 2, 1, 2, 3, 4, 0, 5, 0, 6, 7, 8}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, AuthLayerEncrypt{
+			RequestID:  0x01020304,
+			SessionIDs: []uint16{5, 6},
+			Payload:    []byte{7, 8},
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+	})
+
+	t.Run("missing session IDs", func(t *testing.T) {
+		data := []byte{0, 0, 0, 3, 1, 2, 3, 4, 0, 5, 0, 6}
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(data))
+	})
+
+	t.Run("too many layers", func(t *testing.T) {
+		msg := AuthLayerEncrypt{SessionIDs: make([]uint16, 256)}
+		_, err := msg.Pack(make([]byte, 4096))
+		assert.Equal(t, ErrInvalidMessage, err)
+	})
+}
+
+func TestAuthSessionClose(t *testing.T) {
+	msg := new(AuthSessionClose)
+
+	data := []byte{0, 0, 1, 2}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, AuthSessionClose{SessionID: 0x0102}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestAuthCipherDecryptResp(t *testing.T) {
+	msg := new(AuthCipherDecryptResp)
+
+	for _, cleartext := range []bool{false, true} {
+		flags := byte(0)
+		if cleartext {
+			flags = flagCleartext
+		}
+		data := []byte{0, 0, 0, flags, 1, 2, 3, 4, 5, 6}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, AuthCipherDecryptResp{
+			Cleartext: cleartext,
+			RequestID: 0x01020304,
+			Payload:   []byte{5, 6},
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+	}
+}
@@ -4,20 +4,25 @@ import (
 	"bufio"
 	"io"
 	"net"
+	"sync/atomic"
+	"time"
 )
 
 // Connection abstracts a network connection on the API socket.
 type Connection struct {
 	nc     net.Conn
 	rd     *bufio.Reader
+	caps   uint32 // Capabilities negotiated by the last OnionCapabilities sent or received, accessed atomically
+	subs   uint32 // Subscriptions of the client, accessed atomically
 	msgBuf [MaxSize]byte
 }
 
 // NewConnection initializes a new API Connection from a given network connection.
 func NewConnection(nc net.Conn) *Connection {
 	return &Connection{
-		nc: nc,
-		rd: bufio.NewReader(nc),
+		nc:   nc,
+		rd:   bufio.NewReader(nc),
+		subs: uint32(SubscribeAll),
 	}
 }
 
@@ -29,8 +34,11 @@ func (conn *Connection) ReadMsg() (msg Message, err error) {
 		return nil, err
 	}
 
-	// ready message body
-	body := conn.msgBuf[:hdr.Size]
+	// read message body, the size includes the header
+	if hdr.Size < HeaderSize {
+		return nil, ErrInvalidMessage
+	}
+	body := conn.msgBuf[:hdr.Size-HeaderSize]
 	_, err = io.ReadFull(conn.rd, body)
 	if err != nil {
 		if err == io.EOF {
@@ -39,7 +47,27 @@ func (conn *Connection) ReadMsg() (msg Message, err error) {
 		return nil, err
 	}
 
-	return parseMessage(hdr.Type, body)
+	msg, err = parseMessage(hdr.Type, body, conn.Capabilities())
+	if capsMsg, ok := msg.(*OnionCapabilities); ok && err == nil {
+		atomic.StoreUint32(&conn.caps, uint32(capsMsg.Capabilities))
+	}
+	return msg, err
+}
+
+// Capabilities returns the capabilities negotiated on the connection, i.e. those of the last OnionCapabilities sent
+// or received on it.
+func (conn *Connection) Capabilities() Capabilities {
+	return Capabilities(atomic.LoadUint32(&conn.caps))
+}
+
+// Subscribe replaces the notifications the client receives on the connection, see OnionSubscribe.
+func (conn *Connection) Subscribe(subs Subscriptions) {
+	atomic.StoreUint32(&conn.subs, uint32(subs))
+}
+
+// Subscribed checks whether the client subscribed to all of the given notifications.
+func (conn *Connection) Subscribed(subs Subscriptions) bool {
+	return Subscriptions(atomic.LoadUint32(&conn.subs))&subs == subs
 }
 
 // Send packs and sends a given message on the API connection.
@@ -51,14 +79,81 @@ func (conn *Connection) Send(msg Message) (err error) {
 
 	data := conn.msgBuf[:n]
 	_, err = conn.nc.Write(data)
+	if capsMsg, ok := msg.(*OnionCapabilities); ok && err == nil {
+		atomic.StoreUint32(&conn.caps, uint32(capsMsg.Capabilities))
+	}
 	return err
 }
 
 // SendError is a convenience helper to send an OnionError message with a given tunnel ID and message type.
-func (conn *Connection) SendError(tunnelID uint32, msgType Type) (err error) {
+// The error code is derived from the error the request failed with, see ErrorCodeOf. Clients which unsubscribed from
+// errors are not sent anything.
+func (conn *Connection) SendError(tunnelID uint32, msgType Type, cause error) (err error) {
+	if !conn.Subscribed(SubscribeErrors) {
+		return nil
+	}
 	return conn.Send(&OnionError{
 		TunnelID:    tunnelID,
 		RequestType: msgType,
+		Code:        ErrorCodeOf(cause),
+	})
+}
+
+// SendTunnelIncoming is a convenience helper to send an OnionTunnelIncoming message for a given tunnel ID.
+func (conn *Connection) SendTunnelIncoming(tunnelID uint32) (err error) {
+	return conn.Send(&OnionTunnelIncoming{
+		TunnelID: tunnelID,
+	})
+}
+
+// SendTunnelData is a convenience helper to send an OnionTunnelData message for a given tunnel ID.
+func (conn *Connection) SendTunnelData(tunnelID uint32, data []byte) (err error) {
+	return conn.Send(&OnionTunnelData{
+		TunnelID: tunnelID,
+		Data:     data,
+	})
+}
+
+// SendTunnelDatagram is a convenience helper to send an OnionTunnelDatagram message for a given tunnel ID.
+func (conn *Connection) SendTunnelDatagram(tunnelID uint32, data []byte) (err error) {
+	return conn.Send(&OnionTunnelDatagram{
+		TunnelID: tunnelID,
+		Data:     data,
+	})
+}
+
+// SendTunnelEOF is a convenience helper to send an OnionTunnelEOF message for a given tunnel ID.
+func (conn *Connection) SendTunnelEOF(tunnelID uint32) (err error) {
+	return conn.Send(&OnionTunnelEOF{
+		TunnelID: tunnelID,
+	})
+}
+
+// SendTunnelDestroy is a convenience helper to send an OnionTunnelDestroy message for a given tunnel ID.
+func (conn *Connection) SendTunnelDestroy(tunnelID uint32) (err error) {
+	return conn.Send(&OnionTunnelDestroy{
+		TunnelID: tunnelID,
+	})
+}
+
+// SendRound is a convenience helper to send an OnionRound message announcing the given round and the rotated tunnels.
+// If there are too many tunnels to fit into a single message, the remaining ones are left out.
+func (conn *Connection) SendRound(round uint64, rotated []uint32) (err error) {
+	if len(rotated) > MaxRoundTunnels {
+		rotated = rotated[:MaxRoundTunnels]
+	}
+	return conn.Send(&OnionRound{
+		Round:     uint32(round),
+		TunnelIDs: rotated,
+	})
+}
+
+// SendTunnelAlive is a convenience helper to send an OnionTunnelAlive message for a given tunnel ID, which was idle for
+// the given time.
+func (conn *Connection) SendTunnelAlive(tunnelID uint32, idle time.Duration) (err error) {
+	return conn.Send(&OnionTunnelAlive{
+		TunnelID: tunnelID,
+		Idle:     uint32(idle / time.Second),
 	})
 }
 
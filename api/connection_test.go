@@ -6,6 +6,7 @@ import (
 	"net"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -54,7 +55,7 @@ func TestConnectionReadMsg(t *testing.T) {
 
 			var msg OnionCover
 			hdr := Header{
-				Size: uint16(msg.PackedSize()),
+				Size: uint16(HeaderSize + msg.PackedSize()),
 				Type: TypeOnionCover,
 			}
 			hdr.Pack(buf[:])
@@ -69,6 +70,49 @@ func TestConnectionReadMsg(t *testing.T) {
 		require.Nil(t, err)
 		require.Equal(t, TypeOnionCover, msg.Type())
 	})
+
+	t.Run("size smaller than header", func(t *testing.T) {
+		connRecv, connSend := net.Pipe()
+		defer connSend.Close()
+		defer connRecv.Close()
+
+		go func() {
+			var buf [HeaderSize]byte
+			hdr := Header{
+				Size: HeaderSize - 1,
+				Type: TypeOnionCover,
+			}
+			hdr.Pack(buf[:])
+			connSend.Write(buf[:])
+		}()
+
+		conn := NewConnection(connRecv)
+		msg, err := conn.ReadMsg()
+		require.Equal(t, ErrInvalidMessage, err)
+		require.Nil(t, msg)
+	})
+
+	t.Run("sent messages", func(t *testing.T) {
+		connRecv, connSend := net.Pipe()
+		defer connRecv.Close()
+
+		go func() {
+			conn := NewConnection(connSend)
+			_ = conn.Send(&OnionTunnelIncoming{TunnelID: 1})
+			_ = conn.Send(&OnionTunnelIncoming{TunnelID: 2})
+			connSend.Close()
+		}()
+
+		// the messages are read back to back
+		conn := NewConnection(connRecv)
+		for _, tunnelID := range []uint32{1, 2} {
+			msg, err := conn.ReadMsg()
+			require.Nil(t, err)
+			require.Equal(t, &OnionTunnelIncoming{TunnelID: tunnelID}, msg)
+		}
+		_, err := conn.ReadMsg()
+		require.Equal(t, io.EOF, err)
+	})
 }
 
 func TestConnectionSend(t *testing.T) {
@@ -129,7 +173,7 @@ func TestConnectionSendError(t *testing.T) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
-		sendErr = conn.SendError(42, TypeOnionCover)
+		sendErr = conn.SendError(42, TypeOnionCover, ErrInvalidMessage)
 		connSend.Close()
 		wg.Done()
 	}()
@@ -149,6 +193,60 @@ func TestConnectionSendError(t *testing.T) {
 	require.Nil(t, parseErr)
 	require.Equal(t, uint32(42), onionError.TunnelID)
 	require.Equal(t, TypeOnionCover, onionError.RequestType)
+	require.Equal(t, ErrorInvalidMessage, onionError.Code)
+
+	extraData, _ := ioutil.ReadAll(connRecv)
+	require.Equal(t, []byte{}, extraData)
+
+	wg.Wait()
+	require.Nil(t, sendErr)
+
+	t.Run("unsubscribed", func(t *testing.T) {
+		// nothing is written to the closed connection
+		conn.Subscribe(SubscribeIncoming | SubscribeData)
+		require.Nil(t, conn.SendError(42, TypeOnionCover, ErrInvalidMessage))
+	})
+}
+
+func TestConnectionSubscribe(t *testing.T) {
+	conn := NewConnection(nil)
+	require.True(t, conn.Subscribed(SubscribeAll))
+
+	conn.Subscribe(SubscribeData)
+	require.True(t, conn.Subscribed(SubscribeData))
+	require.False(t, conn.Subscribed(SubscribeIncoming))
+	require.False(t, conn.Subscribed(SubscribeData|SubscribeErrors))
+}
+
+func TestConnectionSendTunnelData(t *testing.T) {
+	connSend, connRecv := net.Pipe()
+	conn := NewConnection(connSend)
+
+	testData := []byte("test")
+	var n int
+	var sendErr, recvErr error
+	var buf [64]byte
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		sendErr = conn.SendTunnelData(42, testData)
+		connSend.Close()
+		wg.Done()
+	}()
+
+	var hdr Header
+	recvErr = hdr.Read(connRecv)
+	require.Nil(t, recvErr)
+	require.Equal(t, TypeOnionTunnelData, hdr.Type)
+
+	n, recvErr = connRecv.Read(buf[:])
+	require.Nil(t, recvErr)
+	require.Equal(t, int(hdr.Size)-HeaderSize, n)
+	var dataMsg OnionTunnelData
+	parseErr := dataMsg.Parse(buf[:n])
+	require.Nil(t, parseErr)
+	require.Equal(t, uint32(42), dataMsg.TunnelID)
+	require.Equal(t, testData, dataMsg.Data)
 
 	extraData, _ := ioutil.ReadAll(connRecv)
 	require.Equal(t, []byte{}, extraData)
@@ -178,3 +276,98 @@ func TestConnectionTerminate(t *testing.T) {
 		require.EqualError(t, recvErr, io.EOF.Error()) // EOF signals that the conn is closed
 	})
 }
+
+func TestConnectionSendRound(t *testing.T) {
+	connSend, connRecv := net.Pipe()
+	conn := NewConnection(connSend)
+	defer connRecv.Close()
+
+	rotated := make([]uint32, MaxRoundTunnels+1)
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- conn.SendRound(1<<32+7, rotated)
+	}()
+
+	var hdr Header
+	err := hdr.Read(connRecv)
+	require.Nil(t, err)
+	require.Equal(t, TypeOnionRound, hdr.Type)
+
+	body := make([]byte, int(hdr.Size)-HeaderSize)
+	_, err = io.ReadFull(connRecv, body)
+	require.Nil(t, err)
+	require.Nil(t, <-sendErr)
+
+	// tunnels which do not fit into the message are left out
+	var msg OnionRound
+	err = msg.Parse(body)
+	require.Nil(t, err)
+	require.Equal(t, uint32(7), msg.Round)
+	require.Len(t, msg.TunnelIDs, MaxRoundTunnels)
+}
+
+func TestConnectionSendTunnelAlive(t *testing.T) {
+	connSend, connRecv := net.Pipe()
+	conn := NewConnection(connSend)
+	defer connRecv.Close()
+
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- conn.SendTunnelAlive(42, 90*time.Second+500*time.Millisecond)
+	}()
+
+	var hdr Header
+	err := hdr.Read(connRecv)
+	require.Nil(t, err)
+	require.Equal(t, TypeOnionTunnelAlive, hdr.Type)
+
+	body := make([]byte, int(hdr.Size)-HeaderSize)
+	_, err = io.ReadFull(connRecv, body)
+	require.Nil(t, err)
+	require.Nil(t, <-sendErr)
+
+	// the idle time is truncated to full seconds
+	msg, err := parseMessage(hdr.Type, body, 0)
+	require.Nil(t, err)
+	require.Equal(t, &OnionTunnelAlive{TunnelID: 42, Idle: 90}, msg)
+}
+
+func TestConnectionCapabilities(t *testing.T) {
+	ncModule, ncClient := net.Pipe()
+	module, client := NewConnection(ncModule), NewConnection(ncClient)
+	defer ncModule.Close()
+	defer ncClient.Close()
+
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- client.Send(&OnionHello{Capabilities: CapTunnelPath | 1<<31})
+	}()
+	msg, err := module.ReadMsg()
+	require.Nil(t, err)
+	require.Nil(t, <-sendErr)
+	hello, ok := msg.(*OnionHello)
+	require.True(t, ok)
+	require.Equal(t, Capabilities(0), module.Capabilities(), "not negotiated before the answer")
+
+	ready := &OnionTunnelReady{TunnelID: 42, DestHostKey: []byte{1, 2, 3}, Hops: 3, BuildTime: 250}
+	go func() {
+		err := module.Send(&OnionCapabilities{Capabilities: hello.Capabilities & SupportedCapabilities})
+		if err == nil {
+			ready.HasPath = module.Capabilities()&CapTunnelPath != 0
+			err = module.Send(ready)
+		}
+		sendErr <- err
+	}()
+
+	msg, err = client.ReadMsg()
+	require.Nil(t, err)
+	require.Equal(t, &OnionCapabilities{Capabilities: CapTunnelPath}, msg)
+	require.Equal(t, CapTunnelPath, client.Capabilities())
+
+	// the path metadata is parsed on connections which negotiated it
+	msg, err = client.ReadMsg()
+	require.Nil(t, err)
+	require.Nil(t, <-sendErr)
+	require.Equal(t, ready, msg)
+	require.True(t, ready.HasPath)
+}
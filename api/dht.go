@@ -0,0 +1,184 @@
+package api
+
+import (
+	"encoding/binary"
+)
+
+// DHTKeySize is the size of the keys of the values stored in the DHT.
+const DHTKeySize = 32
+
+// DHTPut is used to ask the DHT module to store the given value under the given key.
+type DHTPut struct {
+	TTL         uint16 // time in seconds the value is stored
+	Replication uint8  // number of peers the value should be replicated to, 0 = chosen by the DHT module
+	Key         [DHTKeySize]byte
+	Value       []byte
+}
+
+// Type returns the type of the message.
+func (msg *DHTPut) Type() Type {
+	return TypeDHTPut
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *DHTPut) Parse(data []byte) (err error) {
+	const minSize = 2 + 1 + 1 + DHTKeySize
+	if len(data) < minSize {
+		return ErrInvalidMessage
+	}
+
+	msg.TTL = binary.BigEndian.Uint16(data[0:2])
+	msg.Replication = data[2]
+	// 1 byte reserved
+	copy(msg.Key[:], data[4:minSize])
+
+	// must make a copy!
+	msg.Value = append(msg.Value[0:0], data[minSize:]...)
+
+	return nil
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *DHTPut) PackedSize() (n int) {
+	n = 2 + 1 + 1 + DHTKeySize + len(msg.Value)
+	return
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *DHTPut) Pack(buf []byte) (n int, err error) {
+	n = msg.PackedSize()
+	if cap(buf) < n {
+		return -1, ErrBufferTooSmall
+	}
+	buf = buf[0:n]
+
+	binary.BigEndian.PutUint16(buf[0:2], msg.TTL)
+	buf[2] = msg.Replication
+	buf[3] = 0x00 // reserved
+	copy(buf[4:4+DHTKeySize], msg.Key[:])
+	copy(buf[4+DHTKeySize:], msg.Value)
+
+	return n, nil
+}
+
+// DHTGet is used to ask the DHT module for the value stored under the given key.
+// It is answered with either a DHT SUCCESS or a DHT FAILURE message.
+type DHTGet struct {
+	Key [DHTKeySize]byte
+}
+
+// Type returns the type of the message.
+func (msg *DHTGet) Type() Type {
+	return TypeDHTGet
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *DHTGet) Parse(data []byte) (err error) {
+	if len(data) < DHTKeySize {
+		return ErrInvalidMessage
+	}
+
+	copy(msg.Key[:], data[:DHTKeySize])
+	return nil
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *DHTGet) PackedSize() (n int) {
+	n = DHTKeySize
+	return
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *DHTGet) Pack(buf []byte) (n int, err error) {
+	n = msg.PackedSize()
+	if cap(buf) < n {
+		return -1, ErrBufferTooSmall
+	}
+	buf = buf[0:n]
+
+	copy(buf, msg.Key[:])
+	return n, nil
+}
+
+// DHTSuccess is sent by the DHT module as a response to a DHT GET message if a value is stored under the key.
+type DHTSuccess struct {
+	Key   [DHTKeySize]byte
+	Value []byte
+}
+
+// Type returns the type of the message.
+func (msg *DHTSuccess) Type() Type {
+	return TypeDHTSuccess
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *DHTSuccess) Parse(data []byte) (err error) {
+	if len(data) < DHTKeySize {
+		return ErrInvalidMessage
+	}
+
+	copy(msg.Key[:], data[:DHTKeySize])
+
+	// must make a copy!
+	msg.Value = append(msg.Value[0:0], data[DHTKeySize:]...)
+
+	return nil
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *DHTSuccess) PackedSize() (n int) {
+	n = DHTKeySize + len(msg.Value)
+	return
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *DHTSuccess) Pack(buf []byte) (n int, err error) {
+	n = msg.PackedSize()
+	if cap(buf) < n {
+		return -1, ErrBufferTooSmall
+	}
+	buf = buf[0:n]
+
+	copy(buf[:DHTKeySize], msg.Key[:])
+	copy(buf[DHTKeySize:], msg.Value)
+
+	return n, nil
+}
+
+// DHTFailure is sent by the DHT module as a response to a DHT GET message if no value is stored under the key.
+type DHTFailure struct {
+	Key [DHTKeySize]byte
+}
+
+// Type returns the type of the message.
+func (msg *DHTFailure) Type() Type {
+	return TypeDHTFailure
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *DHTFailure) Parse(data []byte) (err error) {
+	if len(data) < DHTKeySize {
+		return ErrInvalidMessage
+	}
+
+	copy(msg.Key[:], data[:DHTKeySize])
+	return nil
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *DHTFailure) PackedSize() (n int) {
+	n = DHTKeySize
+	return
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *DHTFailure) Pack(buf []byte) (n int, err error) {
+	n = msg.PackedSize()
+	if cap(buf) < n {
+		return -1, ErrBufferTooSmall
+	}
+	buf = buf[0:n]
+
+	copy(buf, msg.Key[:])
+	return n, nil
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ensure that the implementations match the interface
+var (
+	_ Message = &DHTPut{}
+	_ Message = &DHTGet{}
+	_ Message = &DHTSuccess{}
+	_ Message = &DHTFailure{}
+)
+
+func dhtTestKey() (key [DHTKeySize]byte) {
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key
+}
+
+func TestDHTMessageTypes(t *testing.T) {
+	msgs := map[Type]Message{
+		TypeDHTPut:     &DHTPut{},
+		TypeDHTGet:     &DHTGet{},
+		TypeDHTSuccess: &DHTSuccess{},
+		TypeDHTFailure: &DHTFailure{},
+	}
+	for msgType, msg := range msgs {
+		assert.Equal(t, msgType, msg.Type())
+
+		// empty data
+		assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}), "type %d", msgType)
+
+		// too small buf for packing
+		_, packErr := msg.Pack([]byte{})
+		assert.Equal(t, ErrBufferTooSmall, packErr, "type %d", msgType)
+	}
+}
+
+func TestDHTPut(t *testing.T) {
+	msg := new(DHTPut)
+	key := dhtTestKey()
+
+	data := append([]byte{0x01, 0x2c, 3, 0}, key[:]...)
+	data = append(data, 5, 6, 7)
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, DHTPut{
+		TTL:         300,
+		Replication: 3,
+		Key:         key,
+		Value:       []byte{5, 6, 7},
+	}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+
+	// the value must be copied
+	data[len(data)-1] = 0xff
+	assert.Equal(t, []byte{5, 6, 7}, msg.Value)
+
+	// missing key
+	assert.Equal(t, ErrInvalidMessage, msg.Parse(data[:4+DHTKeySize-1]))
+}
+
+func TestDHTGet(t *testing.T) {
+	msg := new(DHTGet)
+	key := dhtTestKey()
+
+	err := msg.Parse(key[:])
+	require.Nil(t, err)
+	require.Equal(t, DHTGet{Key: key}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, DHTKeySize, n)
+	assert.Equal(t, key[:], buf[:n])
+}
+
+func TestDHTSuccess(t *testing.T) {
+	msg := new(DHTSuccess)
+	key := dhtTestKey()
+
+	data := append(key[:], 5, 6, 7)
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, DHTSuccess{
+		Key:   key,
+		Value: []byte{5, 6, 7},
+	}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestDHTFailure(t *testing.T) {
+	msg := new(DHTFailure)
+	key := dhtTestKey()
+
+	err := msg.Parse(key[:])
+	require.Nil(t, err)
+	require.Equal(t, DHTFailure{Key: key}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, DHTKeySize, n)
+	assert.Equal(t, key[:], buf[:n])
+}
@@ -0,0 +1,31 @@
+package api
+
+import (
+	"bawang/errcode"
+)
+
+// ErrorCode is the error code reported to API clients in the OnionError message. The codes are the ones of the error
+// taxonomy shared by all packages, see errcode.Code.
+type ErrorCode uint16
+
+const (
+	ErrorUnknown         = ErrorCode(errcode.Unknown)
+	ErrorInvalidMessage  = ErrorCode(errcode.InvalidMessage)
+	ErrorInvalidTunnel   = ErrorCode(errcode.InvalidTunnel)
+	ErrorTimeout         = ErrorCode(errcode.Timeout)
+	ErrorNoPeers         = ErrorCode(errcode.NoPeers)
+	ErrorLimit           = ErrorCode(errcode.Limit)
+	ErrorMisbehavingPeer = ErrorCode(errcode.MisbehavingPeer)
+	ErrorConnClosed      = ErrorCode(errcode.ConnClosed)
+	ErrorNotAllowed      = ErrorCode(errcode.NotAllowed)
+	ErrorUnavailable     = ErrorCode(errcode.Unavailable)
+)
+
+func (code ErrorCode) String() string {
+	return errcode.Code(code).String()
+}
+
+// ErrorCodeOf returns the code reported to API clients for the given error, see errcode.Of.
+func ErrorCodeOf(err error) ErrorCode {
+	return ErrorCode(errcode.Of(err))
+}
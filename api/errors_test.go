@@ -0,0 +1,22 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"bawang/errcode"
+)
+
+func TestErrorCodeOf(t *testing.T) {
+	assert.Equal(t, ErrorInvalidMessage, ErrorCodeOf(ErrInvalidMessage))
+	assert.False(t, errcode.IsRetryable(ErrInvalidMessage))
+
+	errTest := errcode.New(errcode.ModuleOnion, errcode.NoPeers, true, "no peers")
+	assert.Equal(t, ErrorNoPeers, ErrorCodeOf(fmt.Errorf("error sampling peers: %w", errTest)))
+	assert.Equal(t, ErrorUnknown, ErrorCodeOf(errors.New("other")))
+
+	assert.Equal(t, "conn_closed", ErrorConnClosed.String())
+}
@@ -0,0 +1,324 @@
+package api
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	flagValid       = 1
+	flagHibernating = 2
+)
+
+// GossipAnnounce is used to ask the Gossip module to spread the given data to other peers.
+type GossipAnnounce struct {
+	TTL      uint8 // max. number of hops the data is spread, 0 = unlimited
+	DataType uint16
+	Data     []byte
+}
+
+// Type returns the type of the message.
+func (msg *GossipAnnounce) Type() Type {
+	return TypeGossipAnnounce
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *GossipAnnounce) Parse(data []byte) (err error) {
+	const minSize = 1 + 1 + 2
+	if len(data) < minSize {
+		return ErrInvalidMessage
+	}
+
+	msg.TTL = data[0]
+	// 1 byte reserved
+	msg.DataType = binary.BigEndian.Uint16(data[2:4])
+
+	// must make a copy!
+	msg.Data = append(msg.Data[0:0], data[4:]...)
+
+	return nil
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *GossipAnnounce) PackedSize() (n int) {
+	n = 1 + 1 + 2 + len(msg.Data)
+	return
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *GossipAnnounce) Pack(buf []byte) (n int, err error) {
+	n = msg.PackedSize()
+	if cap(buf) < n {
+		return -1, ErrBufferTooSmall
+	}
+	buf = buf[0:n]
+
+	buf[0] = msg.TTL
+	buf[1] = 0x00 // reserved
+	binary.BigEndian.PutUint16(buf[2:4], msg.DataType)
+	copy(buf[4:], msg.Data)
+
+	return n, nil
+}
+
+// GossipNotify is used to ask the Gossip module to pass on all data of the given type received from other peers.
+type GossipNotify struct {
+	DataType uint16
+}
+
+// Type returns the type of the message.
+func (msg *GossipNotify) Type() Type {
+	return TypeGossipNotify
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *GossipNotify) Parse(data []byte) (err error) {
+	const size = 2 + 2
+	if len(data) < size {
+		return ErrInvalidMessage
+	}
+
+	// 2 bytes reserved
+	msg.DataType = binary.BigEndian.Uint16(data[2:4])
+
+	return nil
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *GossipNotify) PackedSize() (n int) {
+	n = 2 + 2
+	return
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *GossipNotify) Pack(buf []byte) (n int, err error) {
+	n = msg.PackedSize()
+	if cap(buf) < n {
+		return -1, ErrBufferTooSmall
+	}
+	buf = buf[0:n]
+
+	buf[0] = 0x00 // reserved
+	buf[1] = 0x00 // reserved
+	binary.BigEndian.PutUint16(buf[2:4], msg.DataType)
+
+	return n, nil
+}
+
+// GossipNotification is sent by the Gossip module for data received from other peers, which was subscribed to with
+// a GOSSIP NOTIFY message. It must be answered with a GOSSIP VALIDATION message.
+type GossipNotification struct {
+	MessageID uint16
+	DataType  uint16
+	Data      []byte
+}
+
+// Type returns the type of the message.
+func (msg *GossipNotification) Type() Type {
+	return TypeGossipNotification
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *GossipNotification) Parse(data []byte) (err error) {
+	const minSize = 2 + 2
+	if len(data) < minSize {
+		return ErrInvalidMessage
+	}
+
+	msg.MessageID = binary.BigEndian.Uint16(data[0:2])
+	msg.DataType = binary.BigEndian.Uint16(data[2:4])
+
+	// must make a copy!
+	msg.Data = append(msg.Data[0:0], data[4:]...)
+
+	return nil
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *GossipNotification) PackedSize() (n int) {
+	n = 2 + 2 + len(msg.Data)
+	return
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *GossipNotification) Pack(buf []byte) (n int, err error) {
+	n = msg.PackedSize()
+	if cap(buf) < n {
+		return -1, ErrBufferTooSmall
+	}
+	buf = buf[0:n]
+
+	binary.BigEndian.PutUint16(buf[0:2], msg.MessageID)
+	binary.BigEndian.PutUint16(buf[2:4], msg.DataType)
+	copy(buf[4:], msg.Data)
+
+	return n, nil
+}
+
+// GossipValidation tells the Gossip module whether the data of a GOSSIP NOTIFICATION is valid. Only valid data is
+// spread further.
+type GossipValidation struct {
+	MessageID uint16
+	Valid     bool
+}
+
+// Type returns the type of the message.
+func (msg *GossipValidation) Type() Type {
+	return TypeGossipValidation
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *GossipValidation) Parse(data []byte) (err error) {
+	const size = 2 + 2
+	if len(data) < size {
+		return ErrInvalidMessage
+	}
+
+	msg.MessageID = binary.BigEndian.Uint16(data[0:2])
+	msg.Valid = data[3]&flagValid > 0
+
+	return nil
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *GossipValidation) PackedSize() (n int) {
+	n = 2 + 2
+	return
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *GossipValidation) Pack(buf []byte) (n int, err error) {
+	n = msg.PackedSize()
+	if cap(buf) < n {
+		return -1, ErrBufferTooSmall
+	}
+	buf = buf[0:n]
+
+	binary.BigEndian.PutUint16(buf[0:2], msg.MessageID)
+	buf[2] = 0x00 // reserved
+	flags := byte(0x00)
+	if msg.Valid {
+		flags |= flagValid
+	}
+	buf[3] = flags
+
+	return n, nil
+}
+
+// Versions of the OnionDescriptor layout.
+const (
+	// DescriptorVersionLegacy descriptors end with the host key, which takes all remaining bytes.
+	DescriptorVersionLegacy = 0
+	// DescriptorVersionSized descriptors prefix the host key by its size, further bytes are invalid.
+	DescriptorVersionSized = 1
+)
+
+// OnionDescriptor is the data the Onion module announces via the Gossip module with the data type AppTypeOnion,
+// such that other peers learn that it is alive.
+type OnionDescriptor struct {
+	Version     uint8 // layout of the descriptor, see DescriptorVersionSized
+	IPv6        bool
+	Hibernating bool // the peer used up its relay quota and should not be used as a hop for now
+	OnionPort   uint16
+	Address     net.IP
+	HostKey     []byte
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (desc *OnionDescriptor) Parse(data []byte) (err error) {
+	const minSize = 2 + 2 + 4
+	if len(data) < minSize {
+		return ErrInvalidMessage
+	}
+
+	desc.Version = data[0]
+	if desc.Version > DescriptorVersionSized {
+		return ErrInvalidMessage
+	}
+	desc.IPv6 = data[1]&flagIPv6 > 0
+	desc.Hibernating = data[1]&flagHibernating > 0
+	desc.OnionPort = binary.BigEndian.Uint16(data[2:4])
+
+	// read IP address (either 4 bytes if IPv4 or 16 bytes if IPv6)
+	keyOffset := 8
+	if desc.IPv6 {
+		keyOffset = 20
+		if len(data) < keyOffset {
+			return ErrInvalidMessage
+		}
+	}
+	desc.Address = ReadIP(desc.IPv6, data[4:keyOffset])
+
+	if desc.Version == DescriptorVersionSized {
+		if len(data) < keyOffset+2 {
+			return ErrInvalidMessage
+		}
+		keySize := int(binary.BigEndian.Uint16(data[keyOffset:]))
+		keyOffset += 2
+		if keySize == 0 || len(data) != keyOffset+keySize {
+			return ErrInvalidMessage
+		}
+	}
+
+	// must make a copy!
+	desc.HostKey = append(desc.HostKey[0:0], data[keyOffset:]...)
+
+	return nil
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (desc *OnionDescriptor) PackedSize() (n int) {
+	n = 2 + 2 + 4 + len(desc.HostKey)
+	if desc.IPv6 {
+		n += 12
+	}
+	if desc.Version == DescriptorVersionSized {
+		n += 2
+	}
+	return
+}
+
+// Pack serializes the values into a bytes slice.
+func (desc *OnionDescriptor) Pack(buf []byte) (n int, err error) {
+	if desc.Version > DescriptorVersionSized || len(desc.HostKey) > 0xffff {
+		return -1, ErrInvalidMessage
+	}
+	n = desc.PackedSize()
+	if cap(buf) < n {
+		return -1, ErrBufferTooSmall
+	}
+	buf = buf[0:n]
+
+	buf[0] = desc.Version
+	flags := byte(0x00)
+	keyOffset := 8
+	if desc.IPv6 {
+		flags |= flagIPv6
+		keyOffset = 20
+	}
+	if desc.Hibernating {
+		flags |= flagHibernating
+	}
+	buf[1] = flags
+	binary.BigEndian.PutUint16(buf[2:4], desc.OnionPort)
+	putIP(buf[4:keyOffset], desc.IPv6, desc.Address)
+	if desc.Version == DescriptorVersionSized {
+		binary.BigEndian.PutUint16(buf[keyOffset:], uint16(len(desc.HostKey)))
+		keyOffset += 2
+	}
+	copy(buf[keyOffset:], desc.HostKey)
+
+	return n, nil
+}
+
+// ParseHostKey parses the host key contained in the descriptor as a RSA public key.
+func (desc *OnionDescriptor) ParseHostKey() (key *rsa.PublicKey, err error) {
+	key, err = x509.ParsePKCS1PublicKey(desc.HostKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hostkey: %v", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,229 @@
+package api
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ensure that the implementations match the interface
+var (
+	_ Message = &GossipAnnounce{}
+	_ Message = &GossipNotify{}
+	_ Message = &GossipNotification{}
+	_ Message = &GossipValidation{}
+)
+
+func TestGossipAnnounce(t *testing.T) {
+	msg := new(GossipAnnounce)
+
+	// check message type
+	require.Equal(t, TypeGossipAnnounce, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	data := []byte{5, 0, 0x02, 0x30, 1, 2, 3}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, GossipAnnounce{
+		TTL:      5,
+		DataType: 560,
+		Data:     []byte{1, 2, 3},
+	}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestGossipNotify(t *testing.T) {
+	msg := new(GossipNotify)
+
+	// check message type
+	require.Equal(t, TypeGossipNotify, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	data := []byte{0, 0, 0x02, 0x30}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, GossipNotify{DataType: 560}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestGossipNotification(t *testing.T) {
+	msg := new(GossipNotification)
+
+	// check message type
+	require.Equal(t, TypeGossipNotification, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	data := []byte{0, 42, 0x02, 0x30, 1, 2, 3}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, GossipNotification{
+		MessageID: 42,
+		DataType:  560,
+		Data:      []byte{1, 2, 3},
+	}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestGossipValidation(t *testing.T) {
+	msg := new(GossipValidation)
+
+	// check message type
+	require.Equal(t, TypeGossipValidation, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	for _, valid := range []bool{false, true} {
+		flags := byte(0)
+		if valid {
+			flags = flagValid
+		}
+		data := []byte{0, 42, 0, flags}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, GossipValidation{MessageID: 42, Valid: valid}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+	}
+}
+
+func TestOnionDescriptor(t *testing.T) {
+	desc := new(OnionDescriptor)
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, desc.Parse([]byte{}))
+
+	// too small buf for packing
+	_, packErr := desc.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	t.Run("IPv4", func(t *testing.T) {
+		data := []byte{0, 0, 0x19, 0xcc, 4, 3, 2, 1, 5, 6}
+		err := desc.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, OnionDescriptor{
+			OnionPort: 6604,
+			Address:   net.IP{1, 2, 3, 4},
+			HostKey:   []byte{5, 6},
+		}, *desc)
+
+		buf := make([]byte, 4096)
+		n, err := desc.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+	})
+
+	t.Run("IPv6", func(t *testing.T) {
+		data := []byte{0, flagIPv6, 0x19, 0xcc, 16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 5, 6}
+		assert.Equal(t, ErrInvalidMessage, desc.Parse(data[:19]))
+
+		err := desc.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, OnionDescriptor{
+			IPv6:      true,
+			OnionPort: 6604,
+			Address:   net.IP{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			HostKey:   []byte{5, 6},
+		}, *desc)
+
+		buf := make([]byte, 4096)
+		n, err := desc.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+	})
+
+	t.Run("hibernating", func(t *testing.T) {
+		data := []byte{0, flagHibernating, 0x19, 0xcc, 4, 3, 2, 1, 5, 6}
+		err := desc.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, OnionDescriptor{
+			Hibernating: true,
+			OnionPort:   6604,
+			Address:     net.IP{1, 2, 3, 4},
+			HostKey:     []byte{5, 6},
+		}, *desc)
+
+		buf := make([]byte, 4096)
+		n, err := desc.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+	})
+
+	t.Run("sized", func(t *testing.T) {
+		data := []byte{DescriptorVersionSized, 0, 0x19, 0xcc, 4, 3, 2, 1, 0, 2, 5, 6}
+		err := desc.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, OnionDescriptor{
+			Version:   DescriptorVersionSized,
+			OnionPort: 6604,
+			Address:   net.IP{1, 2, 3, 4},
+			HostKey:   []byte{5, 6},
+		}, *desc)
+
+		buf := make([]byte, 4096)
+		n, err := desc.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+
+		// the host key must have exactly the announced size
+		assert.Equal(t, ErrInvalidMessage, desc.Parse(data[:9]))
+		assert.Equal(t, ErrInvalidMessage, desc.Parse(data[:11]))
+		assert.Equal(t, ErrInvalidMessage, desc.Parse(append(data, 7)))
+		assert.Equal(t, ErrInvalidMessage, desc.Parse([]byte{DescriptorVersionSized, 0, 0x19, 0xcc, 4, 3, 2, 1, 0, 0}))
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		assert.Equal(t, ErrInvalidMessage, desc.Parse([]byte{DescriptorVersionSized + 1, 0, 0x19, 0xcc, 4, 3, 2, 1, 5, 6}))
+
+		desc.Version = DescriptorVersionSized + 1
+		_, err := desc.Pack(make([]byte, 4096))
+		assert.Equal(t, ErrInvalidMessage, err)
+	})
+}
@@ -2,9 +2,10 @@ package api
 
 import (
 	"encoding/binary"
-	"errors"
 	"io"
 	"net"
+
+	"bawang/errcode"
 )
 
 const (
@@ -23,9 +24,9 @@ type Message interface {
 }
 
 var (
-	ErrInvalidAppType = errors.New("invalid appType")
-	ErrInvalidMessage = errors.New("invalid message")
-	ErrBufferTooSmall = errors.New("buffer is too small for message")
+	ErrInvalidAppType = errcode.New(errcode.ModuleAPI, errcode.InvalidMessage, false, "invalid appType")
+	ErrInvalidMessage = errcode.New(errcode.ModuleAPI, errcode.InvalidMessage, false, "invalid message")
+	ErrBufferTooSmall = errcode.New(errcode.ModuleAPI, errcode.InvalidMessage, false, "buffer is too small for message")
 )
 
 // Header is the message header of an API message.
@@ -85,8 +86,9 @@ func PackMessage(buf []byte, msg Message) (n int, err error) {
 	return n, nil
 }
 
-// parseMessage allocates the respective message type and parses the given body data into it.
-func parseMessage(msgType Type, body []byte) (Message, error) {
+// parseMessage allocates the respective message type and parses the given body data into it. Messages extended by
+// the given capabilities negotiated on the connection are parsed accordingly.
+func parseMessage(msgType Type, body []byte, caps Capabilities) (Message, error) {
 	switch msgType {
 	case TypeOnionTunnelBuild:
 		msg := new(OnionTunnelBuild)
@@ -94,7 +96,7 @@ func parseMessage(msgType Type, body []byte) (Message, error) {
 		return msg, err
 
 	case TypeOnionTunnelReady:
-		msg := new(OnionTunnelReady)
+		msg := &OnionTunnelReady{HasPath: caps&CapTunnelPath != 0}
 		err := msg.Parse(body)
 		return msg, err
 
@@ -113,6 +115,31 @@ func parseMessage(msgType Type, body []byte) (Message, error) {
 		err := msg.Parse(body)
 		return msg, err
 
+	case TypeOnionTunnelDatagram:
+		msg := new(OnionTunnelDatagram)
+		err := msg.Parse(body)
+		return msg, err
+
+	case TypeOnionTunnelEOF:
+		msg := new(OnionTunnelEOF)
+		err := msg.Parse(body)
+		return msg, err
+
+	case TypeOnionTunnelPing:
+		msg := new(OnionTunnelPing)
+		err := msg.Parse(body)
+		return msg, err
+
+	case TypeOnionTunnelPong:
+		msg := new(OnionTunnelPong)
+		err := msg.Parse(body)
+		return msg, err
+
+	case TypeOnionTunnelPriority:
+		msg := new(OnionTunnelPriority)
+		err := msg.Parse(body)
+		return msg, err
+
 	case TypeOnionError:
 		msg := new(OnionError)
 		err := msg.Parse(body)
@@ -123,6 +150,81 @@ func parseMessage(msgType Type, body []byte) (Message, error) {
 		err := msg.Parse(body)
 		return msg, err
 
+	case TypeOnionPeersQuery:
+		msg := new(OnionPeersQuery)
+		err := msg.Parse(body)
+		return msg, err
+
+	case TypeOnionPeersBanned:
+		msg := new(OnionPeersBanned)
+		err := msg.Parse(body)
+		return msg, err
+
+	case TypeOnionRound:
+		msg := new(OnionRound)
+		err := msg.Parse(body)
+		return msg, err
+
+	case TypeOnionTunnelPinned:
+		msg := new(OnionTunnelPinned)
+		err := msg.Parse(body)
+		return msg, err
+
+	case TypeOnionTrafficQuery:
+		msg := new(OnionTrafficQuery)
+		err := msg.Parse(body)
+		return msg, err
+
+	case TypeOnionTunnelTraffic:
+		msg := new(OnionTunnelTraffic)
+		err := msg.Parse(body)
+		return msg, err
+
+	case TypeOnionMTUQuery:
+		msg := new(OnionMTUQuery)
+		err := msg.Parse(body)
+		return msg, err
+
+	case TypeOnionTunnelMTU:
+		msg := new(OnionTunnelMTU)
+		err := msg.Parse(body)
+		return msg, err
+
+	case TypeOnionTunnelAlive:
+		msg := new(OnionTunnelAlive)
+		err := msg.Parse(body)
+		return msg, err
+
+	case TypeOnionHello:
+		msg := new(OnionHello)
+		err := msg.Parse(body)
+		return msg, err
+
+	case TypeOnionCapabilities:
+		msg := new(OnionCapabilities)
+		err := msg.Parse(body)
+		return msg, err
+
+	case TypeOnionSubscribe:
+		msg := new(OnionSubscribe)
+		err := msg.Parse(body)
+		return msg, err
+
+	case TypeOnionTunnelShare:
+		msg := new(OnionTunnelShare)
+		err := msg.Parse(body)
+		return msg, err
+
+	case TypeOnionShareToken:
+		msg := new(OnionShareToken)
+		err := msg.Parse(body)
+		return msg, err
+
+	case TypeOnionTunnelJoin:
+		msg := new(OnionTunnelJoin)
+		err := msg.Parse(body)
+		return msg, err
+
 	default:
 		return nil, ErrInvalidMessage
 	}
@@ -141,6 +243,22 @@ func ReadIP(ipv6 bool, data []byte) net.IP {
 	return net.IP{data[3], data[2], data[1], data[0]}
 }
 
+// putIP writes a net.IP address in network byte order into the given bytes buffer, the counterpart of ReadIP.
+func putIP(buf []byte, ipv6 bool, ip net.IP) {
+	if ipv6 {
+		ip = ip.To16()
+		for i := 0; i < 16; i++ {
+			buf[i] = ip[15-i]
+		}
+		return
+	}
+
+	ip = ip.To4()
+	for i := 0; i < 4; i++ {
+		buf[i] = ip[3-i]
+	}
+}
+
 type portMapping struct {
 	app  AppType
 	port uint16
@@ -145,6 +145,7 @@ func TestParseMessage(t *testing.T) {
 			&OnionTunnelIncoming{},
 			&OnionTunnelDestroy{},
 			&OnionTunnelData{},
+			&OnionTunnelDatagram{},
 			&OnionError{},
 			&OnionCover{},
 		}
@@ -153,14 +154,14 @@ func TestParseMessage(t *testing.T) {
 			n, err := input.Pack(buf[:])
 			require.Nil(t, err)
 
-			msg, err := parseMessage(input.Type(), buf[:n])
+			msg, err := parseMessage(input.Type(), buf[:n], 0)
 			require.Nil(t, err)
 			require.Equal(t, input.Type(), msg.Type())
 		}
 	})
 
 	t.Run("invalid", func(t *testing.T) {
-		msg, err := parseMessage(0, nil)
+		msg, err := parseMessage(0, nil, 0)
 		require.EqualError(t, err, ErrInvalidMessage.Error())
 		require.Nil(t, msg)
 	})
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"encoding/binary"
+)
+
+// NSEQuery is used to ask the NSE module for the current estimate of the network size.
+type NSEQuery struct {
+}
+
+// Type returns the type of the message.
+func (msg *NSEQuery) Type() Type {
+	return TypeNSEQuery
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *NSEQuery) Parse(data []byte) (err error) {
+	return
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *NSEQuery) PackedSize() (n int) {
+	n = 0
+	return
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *NSEQuery) Pack(buf []byte) (n int, err error) {
+	n = msg.PackedSize()
+	return n, nil
+}
+
+// NSEEstimate is sent by the NSE module as a response to the NSE QUERY message.
+type NSEEstimate struct {
+	EstimatePeers        uint32 // estimated number of peers in the network
+	EstimateStdDeviation uint32 // standard deviation of the estimate
+}
+
+// Type returns the type of the message.
+func (msg *NSEEstimate) Type() Type {
+	return TypeNSEEstimate
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *NSEEstimate) Parse(data []byte) (err error) {
+	const size = 4 + 4
+	if len(data) < size {
+		return ErrInvalidMessage
+	}
+
+	msg.EstimatePeers = binary.BigEndian.Uint32(data[0:4])
+	msg.EstimateStdDeviation = binary.BigEndian.Uint32(data[4:8])
+	return nil
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *NSEEstimate) PackedSize() (n int) {
+	n = 4 + 4
+	return
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *NSEEstimate) Pack(buf []byte) (n int, err error) {
+	n = msg.PackedSize()
+	if cap(buf) < n {
+		return -1, ErrBufferTooSmall
+	}
+	buf = buf[0:n]
+
+	binary.BigEndian.PutUint32(buf[0:4], msg.EstimatePeers)
+	binary.BigEndian.PutUint32(buf[4:8], msg.EstimateStdDeviation)
+	return n, nil
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ensure that the implementations match the interface
+var (
+	_ Message = &NSEQuery{}
+	_ Message = &NSEEstimate{}
+)
+
+func TestNSEQuery(t *testing.T) {
+	msg := new(NSEQuery)
+
+	// check message type
+	require.Equal(t, TypeNSEQuery, msg.Type())
+
+	data := []byte{}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, NSEQuery{}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestNSEEstimate(t *testing.T) {
+	msg := new(NSEEstimate)
+
+	// check message type
+	require.Equal(t, TypeNSEEstimate, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	data := []byte{0, 0, 1, 2, 0, 0, 0, 3}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, NSEEstimate{
+		EstimatePeers:        0x0102,
+		EstimateStdDeviation: 3,
+	}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
@@ -8,9 +8,41 @@ import (
 	"net"
 )
 
+//go:generate go run bawang/internal/wiregen
+
+const flagMultipath = 2
+
+// tunnelPathSize is the size of the path metadata of an OnionTunnelReady, see CapTunnelPath.
+const tunnelPathSize = 1 + 3 + 4
+
+// Capabilities are optional extensions of the onion API, which are only used on API connections negotiating them with
+// an OnionHello, such that clients not aware of them are not confused.
+type Capabilities uint32
+
+const (
+	// CapTunnelPath extends OnionTunnelReady by the number of hops and the build time of the tunnel.
+	CapTunnelPath Capabilities = 1 << iota
+)
+
+// SupportedCapabilities are the capabilities implemented by this package.
+const SupportedCapabilities = CapTunnelPath
+
+// Subscriptions are the notifications an API connection receives, see OnionSubscribe.
+type Subscriptions uint32
+
+const (
+	SubscribeIncoming Subscriptions = 1 << iota // OnionTunnelIncoming announcements of new incoming tunnels
+	SubscribeData                               // OnionTunnelData and OnionTunnelDatagram received on the tunnels
+	SubscribeErrors                             // OnionError replies to failed requests
+
+	// SubscribeAll are the notifications API connections receive until they send an OnionSubscribe.
+	SubscribeAll = SubscribeIncoming | SubscribeData | SubscribeErrors
+)
+
 // OnionTunnelBuild is used to request the Onion module to build a tunnel to the given destination in the next period.
 type OnionTunnelBuild struct {
 	IPv6        bool
+	Multipath   bool // stripe the data across two circuits through disjoint intermediate hops
 	OnionPort   uint16
 	Address     net.IP
 	DestHostKey []byte
@@ -29,6 +61,7 @@ func (msg *OnionTunnelBuild) Parse(data []byte) (err error) {
 	}
 
 	msg.IPv6 = data[1]&flagIPv6 > 0
+	msg.Multipath = data[1]&flagMultipath > 0
 	msg.OnionPort = binary.BigEndian.Uint16(data[2:])
 
 	// read IP address (either 4 bytes if IPv4 or 16 bytes if IPv6)
@@ -71,6 +104,9 @@ func (msg *OnionTunnelBuild) Pack(buf []byte) (n int, err error) {
 	binary.BigEndian.PutUint16(buf[2:4], msg.OnionPort)
 
 	flags := byte(0x00)
+	if msg.Multipath {
+		flags |= flagMultipath
+	}
 	addr := msg.Address
 	keyOffset := 8
 	if msg.IPv6 {
@@ -101,10 +137,15 @@ func (msg *OnionTunnelBuild) ParseHostKey() (key *rsa.PublicKey, err error) {
 	return key, nil
 }
 
-// OnionTunnelReady is sent by the Onion module when a requested tunnel is built.
+// OnionTunnelReady is sent by the Onion module when a requested tunnel is built. On API connections which negotiated
+// CapTunnelPath, the host key is followed by the metadata of the path, such that clients can verify the anonymity
+// parameters of the tunnel they got.
 type OnionTunnelReady struct {
+	HasPath     bool // whether the path metadata is included, must be set before parsing, see Connection.ReadMsg
 	TunnelID    uint32
 	DestHostKey []byte
+	Hops        uint8  // number of hops of the tunnel, including the destination
+	BuildTime   uint32 // time in milliseconds it took to establish the circuit through all hops
 }
 
 // Type returns the type of the message.
@@ -114,21 +155,33 @@ func (msg *OnionTunnelReady) Type() Type {
 
 // Parse fills the struct with values parsed from the given bytes slice.
 func (msg *OnionTunnelReady) Parse(data []byte) (err error) {
-	if len(data) < 4 {
+	keyEnd := len(data)
+	if msg.HasPath {
+		keyEnd -= tunnelPathSize
+	}
+	if keyEnd < 4 {
 		return ErrInvalidMessage
 	}
 	msg.TunnelID = binary.BigEndian.Uint32(data)
 
 	// must make a copy!
-	msg.DestHostKey = append(msg.DestHostKey[0:0], data[4:]...)
+	msg.DestHostKey = append(msg.DestHostKey[0:0], data[4:keyEnd]...)
 
-	return
+	if msg.HasPath {
+		msg.Hops = data[keyEnd]
+		// 3 bytes reserved
+		msg.BuildTime = binary.BigEndian.Uint32(data[keyEnd+4:])
+	}
+	return nil
 }
 
 // PackedSize returns the number of bytes required if serialized to bytes.
 func (msg *OnionTunnelReady) PackedSize() (n int) {
 	n = 4 + len(msg.DestHostKey)
-	return
+	if msg.HasPath {
+		n += tunnelPathSize
+	}
+	return n
 }
 
 // Pack serializes the values into a bytes slice.
@@ -137,14 +190,24 @@ func (msg *OnionTunnelReady) Pack(buf []byte) (n int, err error) {
 	if cap(buf) < n {
 		return -1, ErrBufferTooSmall
 	}
+	buf = buf[0:n]
+
 	binary.BigEndian.PutUint32(buf, msg.TunnelID)
-	copy(buf[4:], msg.DestHostKey)
-	return
+	keyEnd := 4 + copy(buf[4:], msg.DestHostKey)
+
+	if msg.HasPath {
+		buf[keyEnd] = msg.Hops
+		buf[keyEnd+1] = 0x00 // reserved
+		buf[keyEnd+2] = 0x00
+		buf[keyEnd+3] = 0x00
+		binary.BigEndian.PutUint32(buf[keyEnd+4:], msg.BuildTime)
+	}
+	return n, nil
 }
 
 // OnionTunnelIncoming is sent by the Onion module on all of its API connections to signal a new incoming tunnel connection.
 type OnionTunnelIncoming struct {
-	TunnelID uint32
+	TunnelID uint32 `wire:"uint32"`
 }
 
 // Type returns the type of the message.
@@ -152,180 +215,533 @@ func (msg *OnionTunnelIncoming) Type() Type {
 	return TypeOnionTunnelIncoming
 }
 
+// OnionTunnelDestroy is used to instruct the Onion module that a tunnel it created is no longer in use and can now be destroyed.
+type OnionTunnelDestroy struct {
+	TunnelID uint32 `wire:"uint32"`
+}
+
+// Type returns the type of the message.
+func (msg *OnionTunnelDestroy) Type() Type {
+	return TypeOnionTunnelDestroy
+}
+
+// OnionTunnelData is used to ask the Onion module to forward data through a tunnel.
+type OnionTunnelData struct {
+	TunnelID uint32 `wire:"uint32"`
+	Data     []byte `wire:"bytes"`
+}
+
+// Type returns the type of the message.
+func (msg *OnionTunnelData) Type() Type {
+	return TypeOnionTunnelData
+}
+
+// OnionTunnelDatagram is used to ask the Onion module to forward data through a tunnel with datagram semantics,
+// and by the Onion module to pass datagrams received on a tunnel.
+// Datagrams are not retransmitted and may be dropped if the tunnel can not keep up, but are never delayed behind
+// stream data sent with OnionTunnelData.
+type OnionTunnelDatagram struct {
+	TunnelID uint32 `wire:"uint32"`
+	Data     []byte `wire:"bytes"`
+}
+
+// Type returns the type of the message.
+func (msg *OnionTunnelDatagram) Type() Type {
+	return TypeOnionTunnelDatagram
+}
+
+// OnionTunnelEOF is used to signal the Onion module that the client finished sending data through a tunnel, while it
+// still receives data, and by the Onion module to signal that the remote end of a tunnel finished sending.
+type OnionTunnelEOF struct {
+	TunnelID uint32 `wire:"uint32"`
+}
+
+// Type returns the type of the message.
+func (msg *OnionTunnelEOF) Type() Type {
+	return TypeOnionTunnelEOF
+}
+
+// OnionTunnelPing is used to ask the Onion module to measure the round-trip time through an outgoing tunnel.
+type OnionTunnelPing struct {
+	TunnelID uint32 `wire:"uint32"`
+}
+
+// Type returns the type of the message.
+func (msg *OnionTunnelPing) Type() Type {
+	return TypeOnionTunnelPing
+}
+
+// OnionTunnelPong is sent by the Onion module in reply to an OnionTunnelPing with the measured round-trip time
+// in microseconds.
+type OnionTunnelPong struct {
+	TunnelID uint32 `wire:"uint32"`
+	RTT      uint32 `wire:"uint32"`
+}
+
+// Type returns the type of the message.
+func (msg *OnionTunnelPong) Type() Type {
+	return TypeOnionTunnelPong
+}
+
+// OnionTunnelPriority is used to ask the Onion module to send the data of a tunnel with the given priority class,
+// see the Priority constants.
+type OnionTunnelPriority struct {
+	TunnelID uint32 `wire:"uint32"`
+	Priority uint8  `wire:"uint8,reserved=3"`
+}
+
+// Priority classes of the data sent on a tunnel.
+const (
+	PriorityInteractive = 0 // default of all tunnels
+	PriorityBulk        = 1
+	PriorityControl     = 2
+)
+
+// Type returns the type of the message.
+func (msg *OnionTunnelPriority) Type() Type {
+	return TypeOnionTunnelPriority
+}
+
+// OnionError is sent by the Onion module to signal an error condition
+// which stems from servicing an earlier request.
+type OnionError struct {
+	RequestType Type `wire:"uint16"`
+	// classifies the error, sent in the formerly reserved field. ErrorUnknown for legacy peers
+	Code     ErrorCode `wire:"uint16"`
+	TunnelID uint32    `wire:"uint32"`
+}
+
+// Type returns the type of the message.
+func (msg *OnionError) Type() Type {
+	return TypeOnionError
+}
+
+// OnionCover instructs the onion module to send cover traffic to a random destination.
+type OnionCover struct {
+	CoverSize uint16 `wire:"uint16,reserved=2"`
+}
+
+// Type returns the type of the message.
+func (msg *OnionCover) Type() Type {
+	return TypeOnionCover
+}
+
+// OnionPeersQuery asks the Onion module for the peers it currently excludes from path selection due to misbehavior.
+// The Onion module replies with an OnionPeersBanned message.
+type OnionPeersQuery struct {
+}
+
+// Type returns the type of the message.
+func (msg *OnionPeersQuery) Type() Type {
+	return TypeOnionPeersQuery
+}
+
 // Parse fills the struct with values parsed from the given bytes slice.
-func (msg *OnionTunnelIncoming) Parse(data []byte) (err error) {
-	if len(data) != 4 {
+func (msg *OnionPeersQuery) Parse(data []byte) (err error) {
+	if len(data) != 0 {
 		return ErrInvalidMessage
 	}
-	msg.TunnelID = binary.BigEndian.Uint32(data)
 	return
 }
 
 // PackedSize returns the number of bytes required if serialized to bytes.
-func (msg *OnionTunnelIncoming) PackedSize() (n int) {
-	n = 4
+func (msg *OnionPeersQuery) PackedSize() (n int) {
+	n = 0
 	return
 }
 
 // Pack serializes the values into a bytes slice.
-func (msg *OnionTunnelIncoming) Pack(buf []byte) (n int, err error) {
+func (msg *OnionPeersQuery) Pack(buf []byte) (n int, err error) {
 	n = msg.PackedSize()
-	if cap(buf) < n {
-		return -1, ErrBufferTooSmall
-	}
-	binary.BigEndian.PutUint32(buf, msg.TunnelID)
 	return n, nil
 }
 
-// OnionTunnelDestroy is used to instruct the Onion module that a tunnel it created is no longer in use and can now be destroyed.
-type OnionTunnelDestroy struct {
-	TunnelID uint32
+// OnionBannedPeer is a single peer listed in an OnionPeersBanned message.
+type OnionBannedPeer struct {
+	IPv6      bool
+	Reason    uint8  // kind of the last recorded misbehavior
+	Port      uint16 // P2P port of the peer
+	Remaining uint32 // time in seconds until the ban expires
+	Address   net.IP
+}
+
+// packedSize returns the number of bytes required if serialized to bytes.
+func (peer *OnionBannedPeer) packedSize() (n int) {
+	n = 1 + 1 + 2 + 4 + 4
+	if peer.IPv6 {
+		n += 12
+	}
+	return
+}
+
+// MaxBannedPeers is the max. number of peers fitting into a single OnionPeersBanned message.
+const MaxBannedPeers = (MaxSize - HeaderSize) / (1 + 1 + 2 + 4 + 16)
+
+// OnionPeersBanned is sent by the Onion module as a response to the OnionPeersQuery message.
+type OnionPeersBanned struct {
+	Peers []OnionBannedPeer
 }
 
 // Type returns the type of the message.
-func (msg *OnionTunnelDestroy) Type() Type {
-	return TypeOnionTunnelDestroy
+func (msg *OnionPeersBanned) Type() Type {
+	return TypeOnionPeersBanned
 }
 
 // Parse fills the struct with values parsed from the given bytes slice.
-func (msg *OnionTunnelDestroy) Parse(data []byte) (err error) {
-	if len(data) != 4 {
-		return ErrInvalidMessage
+func (msg *OnionPeersBanned) Parse(data []byte) (err error) {
+	msg.Peers = msg.Peers[0:0]
+	for len(data) > 0 {
+		if len(data) < 12 {
+			return ErrInvalidMessage
+		}
+
+		peer := OnionBannedPeer{
+			IPv6:      data[0]&flagIPv6 > 0,
+			Reason:    data[1],
+			Port:      binary.BigEndian.Uint16(data[2:]),
+			Remaining: binary.BigEndian.Uint32(data[4:]),
+		}
+		if peer.IPv6 && len(data) < 24 {
+			return ErrInvalidMessage
+		}
+		peer.Address = ReadIP(peer.IPv6, data[8:])
+
+		msg.Peers = append(msg.Peers, peer)
+		data = data[peer.packedSize():]
 	}
-	msg.TunnelID = binary.BigEndian.Uint32(data)
-	return
+	return nil
 }
 
 // PackedSize returns the number of bytes required if serialized to bytes.
-func (msg *OnionTunnelDestroy) PackedSize() (n int) {
-	n = 4
+func (msg *OnionPeersBanned) PackedSize() (n int) {
+	for i := range msg.Peers {
+		n += msg.Peers[i].packedSize()
+	}
 	return
 }
 
 // Pack serializes the values into a bytes slice.
-func (msg *OnionTunnelDestroy) Pack(buf []byte) (n int, err error) {
+func (msg *OnionPeersBanned) Pack(buf []byte) (n int, err error) {
 	n = msg.PackedSize()
 	if cap(buf) < n {
 		return -1, ErrBufferTooSmall
 	}
-	binary.BigEndian.PutUint32(buf, msg.TunnelID)
+	buf = buf[0:n]
+
+	offset := 0
+	for i := range msg.Peers {
+		peer := &msg.Peers[i]
+		flags := byte(0x00)
+		if peer.IPv6 {
+			flags |= flagIPv6
+		}
+		buf[offset] = flags
+		buf[offset+1] = peer.Reason
+		binary.BigEndian.PutUint16(buf[offset+2:], peer.Port)
+		binary.BigEndian.PutUint32(buf[offset+4:], peer.Remaining)
+		putIP(buf[offset+8:], peer.IPv6, peer.Address)
+		offset += peer.packedSize()
+	}
 	return n, nil
 }
 
-// OnionTunnelData is used to ask the Onion module to forward data through a tunnel.
-type OnionTunnelData struct {
-	TunnelID uint32
-	Data     []byte
+// MaxRoundTunnels is the max. number of tunnel IDs fitting into a single OnionRound message.
+const MaxRoundTunnels = (MaxSize - HeaderSize - 4) / 4
+
+// OnionRound is sent by the Onion module at the beginning of each round if enabled in the config. It lists the
+// outgoing tunnels of the client which are rebuilt in the round, such that the client can expect a short disruption.
+type OnionRound struct {
+	Round     uint32 // number of the round, wraps around
+	TunnelIDs []uint32
 }
 
 // Type returns the type of the message.
-func (msg *OnionTunnelData) Type() Type {
-	return TypeOnionTunnelData
+func (msg *OnionRound) Type() Type {
+	return TypeOnionRound
 }
 
 // Parse fills the struct with values parsed from the given bytes slice.
-func (msg *OnionTunnelData) Parse(data []byte) (err error) {
-	if len(data) < 4 {
+func (msg *OnionRound) Parse(data []byte) (err error) {
+	if len(data) < 4 || len(data)%4 != 0 {
 		return ErrInvalidMessage
 	}
-	msg.TunnelID = binary.BigEndian.Uint32(data)
-
-	// must make a copy!
-	msg.Data = append(msg.Data[0:0], data[4:]...)
-	return
+	msg.Round = binary.BigEndian.Uint32(data)
+	msg.TunnelIDs = msg.TunnelIDs[0:0]
+	for offset := 4; offset < len(data); offset += 4 {
+		msg.TunnelIDs = append(msg.TunnelIDs, binary.BigEndian.Uint32(data[offset:]))
+	}
+	return nil
 }
 
 // PackedSize returns the number of bytes required if serialized to bytes.
-func (msg *OnionTunnelData) PackedSize() (n int) {
-	n = 4 + len(msg.Data)
+func (msg *OnionRound) PackedSize() (n int) {
+	n = 4 + 4*len(msg.TunnelIDs)
 	return
 }
 
 // Pack serializes the values into a bytes slice.
-func (msg *OnionTunnelData) Pack(buf []byte) (n int, err error) {
+func (msg *OnionRound) Pack(buf []byte) (n int, err error) {
 	n = msg.PackedSize()
+	if len(msg.TunnelIDs) > MaxRoundTunnels {
+		return -1, ErrInvalidMessage
+	}
 	if cap(buf) < n {
 		return -1, ErrBufferTooSmall
 	}
-	binary.BigEndian.PutUint32(buf, msg.TunnelID)
-	copy(buf[4:], msg.Data)
+	buf = buf[:n]
+	binary.BigEndian.PutUint32(buf, msg.Round)
+	for i, tunnelID := range msg.TunnelIDs {
+		binary.BigEndian.PutUint32(buf[4+4*i:], tunnelID)
+	}
+	return n, nil
+}
+
+// OnionPeer is a peer listed in an OnionTunnelPinned message.
+type OnionPeer struct {
+	IPv6    bool
+	Port    uint16 // P2P port of the peer
+	Address net.IP
+	HostKey []byte // DER encoded in PKCS#1 format
+}
+
+// packedSize returns the number of bytes required if serialized to bytes.
+func (peer *OnionPeer) packedSize() (n int) {
+	n = 1 + 1 + 2 + 2 + 2 + 4 + len(peer.HostKey)
+	if peer.IPv6 {
+		n += 12
+	}
 	return
 }
 
-// OnionError is sent by the Onion module to signal an error condition
-// which stems from servicing an earlier request.
-type OnionError struct {
-	RequestType Type
-	TunnelID    uint32
+// ParseHostKey parses the host key of the peer as a RSA public key.
+func (peer *OnionPeer) ParseHostKey() (key *rsa.PublicKey, err error) {
+	key, err = x509.ParsePKCS1PublicKey(peer.HostKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hostkey: %v", err)
+	}
+	return key, nil
+}
+
+// OnionTunnelPinned is used to request the Onion module to build a tunnel to the given destination like
+// OnionTunnelBuild, but through the given intermediate hops instead of ones sampled from the RPS module.
+type OnionTunnelPinned struct {
+	Hops        []OnionPeer // intermediate hops in order, starting with the first hop
+	Destination OnionPeer
 }
 
 // Type returns the type of the message.
-func (msg *OnionError) Type() Type {
-	return TypeOnionError
+func (msg *OnionTunnelPinned) Type() Type {
+	return TypeOnionTunnelPinned
 }
 
 // Parse fills the struct with values parsed from the given bytes slice.
-func (msg *OnionError) Parse(data []byte) (err error) {
-	if len(data) != 8 {
+// The peers are listed in order, the last one being the destination.
+func (msg *OnionTunnelPinned) Parse(data []byte) (err error) {
+	msg.Hops = msg.Hops[0:0]
+	for len(data) > 0 {
+		if len(data) < 12 {
+			return ErrInvalidMessage
+		}
+
+		peer := OnionPeer{
+			IPv6: data[0]&flagIPv6 > 0,
+			Port: binary.BigEndian.Uint16(data[2:]),
+		}
+		keySize := int(binary.BigEndian.Uint16(data[4:]))
+		keyOffset := 8 + 4
+		if peer.IPv6 {
+			keyOffset += 12
+		}
+		if len(data) < keyOffset+keySize {
+			return ErrInvalidMessage
+		}
+		peer.Address = ReadIP(peer.IPv6, data[8:])
+
+		// must make a copy!
+		peer.HostKey = append([]byte(nil), data[keyOffset:keyOffset+keySize]...)
+
+		msg.Hops = append(msg.Hops, peer)
+		data = data[keyOffset+keySize:]
+	}
+
+	if len(msg.Hops) == 0 {
 		return ErrInvalidMessage
 	}
-	msg.RequestType = Type(binary.BigEndian.Uint16(data))
-	msg.TunnelID = binary.BigEndian.Uint32(data[4:])
-	return
+	msg.Destination = msg.Hops[len(msg.Hops)-1]
+	msg.Hops = msg.Hops[:len(msg.Hops)-1]
+	return nil
 }
 
 // PackedSize returns the number of bytes required if serialized to bytes.
-func (msg *OnionError) PackedSize() (n int) {
-	n = 8
+func (msg *OnionTunnelPinned) PackedSize() (n int) {
+	for i := range msg.Hops {
+		n += msg.Hops[i].packedSize()
+	}
+	n += msg.Destination.packedSize()
 	return
 }
 
 // Pack serializes the values into a bytes slice.
-func (msg *OnionError) Pack(buf []byte) (n int, err error) {
+func (msg *OnionTunnelPinned) Pack(buf []byte) (n int, err error) {
 	n = msg.PackedSize()
 	if cap(buf) < n {
 		return -1, ErrBufferTooSmall
 	}
-	binary.BigEndian.PutUint16(buf, uint16(msg.RequestType))
-	buf[2] = 0x00
-	buf[3] = 0x00
-	binary.BigEndian.PutUint32(buf[4:], msg.TunnelID)
+	buf = buf[0:n]
+
+	offset := 0
+	for i := 0; i <= len(msg.Hops); i++ {
+		peer := &msg.Destination
+		if i < len(msg.Hops) {
+			peer = &msg.Hops[i]
+		}
+
+		flags := byte(0x00)
+		if peer.IPv6 {
+			flags |= flagIPv6
+		}
+		buf[offset] = flags
+		buf[offset+1] = 0x00 // reserved
+		binary.BigEndian.PutUint16(buf[offset+2:], peer.Port)
+		binary.BigEndian.PutUint16(buf[offset+4:], uint16(len(peer.HostKey)))
+		buf[offset+6], buf[offset+7] = 0x00, 0x00 // reserved
+		putIP(buf[offset+8:], peer.IPv6, peer.Address)
+		copy(buf[offset+peer.packedSize()-len(peer.HostKey):], peer.HostKey)
+		offset += peer.packedSize()
+	}
 	return n, nil
 }
 
-// OnionCover instructs the onion module to send cover traffic to a random destination.
-type OnionCover struct {
-	CoverSize uint16
+// OnionTrafficQuery is used to ask the Onion module for the traffic counted on a tunnel, which is answered with an
+// OnionTunnelTraffic.
+type OnionTrafficQuery struct {
+	TunnelID uint32 `wire:"uint32"`
 }
 
 // Type returns the type of the message.
-func (msg *OnionCover) Type() Type {
-	return TypeOnionCover
+func (msg *OnionTrafficQuery) Type() Type {
+	return TypeOnionTrafficQuery
 }
 
-// Parse fills the struct with values parsed from the given bytes slice.
-func (msg *OnionCover) Parse(data []byte) (err error) {
-	if len(data) != 4 {
-		return ErrInvalidMessage
-	}
-	msg.CoverSize = binary.BigEndian.Uint16(data)
-	return
+// OnionTunnelTraffic is sent by the Onion module in reply to an OnionTrafficQuery with the traffic counted on the
+// tunnel since it was built. The cell counts include the cover cells, the byte counts only the application payload.
+type OnionTunnelTraffic struct {
+	TunnelID      uint32 `wire:"uint32"`
+	BytesSent     uint64 `wire:"uint64"`
+	BytesReceived uint64 `wire:"uint64"`
+	CellsSent     uint64 `wire:"uint64"`
+	CellsReceived uint64 `wire:"uint64"`
+	CoverSent     uint64 `wire:"uint64"`
+	CoverReceived uint64 `wire:"uint64"`
 }
 
-// PackedSize returns the number of bytes required if serialized to bytes.
-func (msg *OnionCover) PackedSize() (n int) {
-	n = 4
-	return
+// Type returns the type of the message.
+func (msg *OnionTunnelTraffic) Type() Type {
+	return TypeOnionTunnelTraffic
 }
 
-// Pack serializes the values into a bytes slice.
-func (msg *OnionCover) Pack(buf []byte) (n int, err error) {
-	n = msg.PackedSize()
-	if cap(buf) < n {
-		return -1, ErrBufferTooSmall
-	}
-	binary.BigEndian.PutUint16(buf, msg.CoverSize)
-	buf[2] = 0x00
-	buf[3] = 0x00
-	return n, nil
+// OnionMTUQuery is used to ask the Onion module for the max. size of the payloads fitting into a single cell of a
+// tunnel, which is answered with an OnionTunnelMTU.
+type OnionMTUQuery struct {
+	TunnelID uint32 `wire:"uint32"`
+}
+
+// Type returns the type of the message.
+func (msg *OnionMTUQuery) Type() Type {
+	return TypeOnionMTUQuery
+}
+
+// OnionTunnelMTU is sent by the Onion module in reply to an OnionMTUQuery with the max. size of the payload of an
+// OnionTunnelData and of an OnionTunnelDatagram sent in a single cell of the tunnel. Larger payloads are rejected,
+// unless the data of the tunnel is sent reliably, which splits it across several cells.
+type OnionTunnelMTU struct {
+	TunnelID     uint32 `wire:"uint32"`
+	DataSize     uint16 `wire:"uint16"`
+	DatagramSize uint16 `wire:"uint16"`
+}
+
+// Type returns the type of the message.
+func (msg *OnionTunnelMTU) Type() Type {
+	return TypeOnionTunnelMTU
+}
+
+// OnionTunnelAlive is sent by the Onion module for tunnels without any traffic for a while if enabled in the config,
+// once it verified that the tunnel still works. Clients can thus tell idle tunnels from silently broken ones. Idle is
+// the time in seconds since the last data was received on the tunnel.
+type OnionTunnelAlive struct {
+	TunnelID uint32 `wire:"uint32"`
+	Idle     uint32 `wire:"uint32"`
+}
+
+// Type returns the type of the message.
+func (msg *OnionTunnelAlive) Type() Type {
+	return TypeOnionTunnelAlive
+}
+
+// OnionHello is sent by clients to negotiate the Capabilities of the API connection, listing the ones they want to
+// use. It is answered with an OnionCapabilities.
+type OnionHello struct {
+	Capabilities Capabilities `wire:"uint32"`
+}
+
+// Type returns the type of the message.
+func (msg *OnionHello) Type() Type {
+	return TypeOnionHello
+}
+
+// OnionCapabilities is sent by the Onion module in reply to an OnionHello with the Capabilities used on the API
+// connection from then on, i.e. those wanted by the client which the module supports.
+type OnionCapabilities struct {
+	Capabilities Capabilities `wire:"uint32"`
+}
+
+// Type returns the type of the message.
+func (msg *OnionCapabilities) Type() Type {
+	return TypeOnionCapabilities
+}
+
+// OnionSubscribe is sent by clients to choose the notifications they receive on the API connection from then on,
+// replacing the previous Subscriptions. Incoming tunnels announced before are not affected.
+type OnionSubscribe struct {
+	Subscriptions Subscriptions `wire:"uint32"`
+}
+
+// Type returns the type of the message.
+func (msg *OnionSubscribe) Type() Type {
+	return TypeOnionSubscribe
+}
+
+// OnionTunnelShare is used to grant another API connection access to a tunnel the sending connection is registered
+// on. It is answered with an OnionShareToken, which the other connection presents in an OnionTunnelJoin.
+type OnionTunnelShare struct {
+	TunnelID uint32 `wire:"uint32"`
+}
+
+// Type returns the type of the message.
+func (msg *OnionTunnelShare) Type() Type {
+	return TypeOnionTunnelShare
+}
+
+// OnionShareToken is sent by the Onion module in reply to an OnionTunnelShare with a token granting access to the
+// tunnel. It is only valid for a single OnionTunnelJoin within a few minutes.
+type OnionShareToken struct {
+	TunnelID uint32 `wire:"uint32"`
+	Token    uint64 `wire:"uint64"`
+}
+
+// Type returns the type of the message.
+func (msg *OnionShareToken) Type() Type {
+	return TypeOnionShareToken
+}
+
+// OnionTunnelJoin is used to register the sending API connection on a tunnel shared by another connection, presenting
+// the token of its OnionShareToken. The connection then receives the data of the tunnel and may use it.
+type OnionTunnelJoin struct {
+	TunnelID uint32 `wire:"uint32"`
+	Token    uint64 `wire:"uint64"`
+}
+
+// Type returns the type of the message.
+func (msg *OnionTunnelJoin) Type() Type {
+	return TypeOnionTunnelJoin
 }
@@ -21,6 +21,25 @@ var (
 	_ Message = &OnionTunnelData{}
 	_ Message = &OnionError{}
 	_ Message = &OnionCover{}
+	_ Message = &OnionTunnelEOF{}
+	_ Message = &OnionTunnelPing{}
+	_ Message = &OnionTunnelPong{}
+	_ Message = &OnionTunnelPriority{}
+	_ Message = &OnionPeersQuery{}
+	_ Message = &OnionPeersBanned{}
+	_ Message = &OnionRound{}
+	_ Message = &OnionTunnelPinned{}
+	_ Message = &OnionTrafficQuery{}
+	_ Message = &OnionTunnelTraffic{}
+	_ Message = &OnionMTUQuery{}
+	_ Message = &OnionTunnelMTU{}
+	_ Message = &OnionTunnelAlive{}
+	_ Message = &OnionHello{}
+	_ Message = &OnionCapabilities{}
+	_ Message = &OnionSubscribe{}
+	_ Message = &OnionTunnelShare{}
+	_ Message = &OnionShareToken{}
+	_ Message = &OnionTunnelJoin{}
 )
 
 func TestOnionTunnelBuild(t *testing.T) {
@@ -73,6 +92,24 @@ func TestOnionTunnelBuild(t *testing.T) {
 		assert.Equal(t, data, buf[:n])
 	})
 
+	t.Run("Multipath", func(t *testing.T) {
+		data := []byte{0, flagMultipath, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, OnionTunnelBuild{
+			Multipath:   true,
+			OnionPort:   0x102,
+			Address:     net.IP{6, 5, 4, 3},
+			DestHostKey: []byte{7, 8, 9},
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+	})
+
 	t.Run("IPv6Short", func(t *testing.T) {
 		data := []byte{0, flagIPv6, 1, 2, 3, 4, 5, 6, 7, 8, 9}
 		err := msg.Parse(data)
@@ -132,6 +169,32 @@ func TestOnionTunnelReady(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, len(data), n)
 	assert.Equal(t, data, buf[:n])
+
+	t.Run("path", func(t *testing.T) {
+		msg := &OnionTunnelReady{HasPath: true}
+		assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}))
+
+		data := []byte{1, 2, 3, 4, 5, 6, 7, 3, 0, 0, 0, 0, 0, 1, 0}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, OnionTunnelReady{
+			HasPath:     true,
+			TunnelID:    0x1020304,
+			DestHostKey: []byte{5, 6, 7},
+			Hops:        3,
+			BuildTime:   256,
+		}, *msg)
+
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+
+		// clients not negotiating the path take it for part of the host key
+		plain := new(OnionTunnelReady)
+		require.Nil(t, plain.Parse(data))
+		assert.Equal(t, data[4:], plain.DestHostKey)
+	})
 }
 
 func TestOnionTunnelIncoming(t *testing.T) {
@@ -216,6 +279,147 @@ func TestOnionTunnelData(t *testing.T) {
 	assert.Equal(t, data, buf[:n])
 }
 
+func TestOnionTunnelDatagram(t *testing.T) {
+	msg := new(OnionTunnelDatagram)
+
+	// check message type
+	require.Equal(t, TypeOnionTunnelDatagram, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, OnionTunnelDatagram{
+		TunnelID: 0x1020304,
+		Data:     []byte{5, 6, 7, 8, 9},
+	}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestOnionTunnelEOF(t *testing.T) {
+	msg := new(OnionTunnelEOF)
+
+	// check message type
+	require.Equal(t, TypeOnionTunnelEOF, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	data := []byte{1, 2, 3, 4}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, OnionTunnelEOF{
+		TunnelID: 0x1020304,
+	}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestOnionTunnelPing(t *testing.T) {
+	msg := new(OnionTunnelPing)
+
+	// check message type
+	require.Equal(t, TypeOnionTunnelPing, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	data := []byte{1, 2, 3, 4}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, OnionTunnelPing{
+		TunnelID: 0x1020304,
+	}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestOnionTunnelPong(t *testing.T) {
+	msg := new(OnionTunnelPong)
+
+	// check message type
+	require.Equal(t, TypeOnionTunnelPong, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	data := []byte{1, 2, 3, 4, 0, 0, 0x30, 0x39}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, OnionTunnelPong{
+		TunnelID: 0x1020304,
+		RTT:      12345,
+	}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestOnionTunnelPriority(t *testing.T) {
+	msg := new(OnionTunnelPriority)
+
+	// check message type
+	require.Equal(t, TypeOnionTunnelPriority, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	data := []byte{1, 2, 3, 4, PriorityBulk, 0, 0, 0}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, OnionTunnelPriority{
+		TunnelID: 0x1020304,
+		Priority: PriorityBulk,
+	}, *msg)
+
+	buf := make([]byte, 4096)
+	for i := range buf {
+		buf[i] = 0xff
+	}
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
 func TestOnionError(t *testing.T) {
 	msg := new(OnionError)
 
@@ -242,6 +446,15 @@ func TestOnionError(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, len(data), n)
 	assert.Equal(t, data, buf[:n])
+
+	// error code
+	data = []byte{1, 2, 0, 4, 3, 4, 5, 6}
+	err = msg.Parse(data)
+	require.Nil(t, err)
+	assert.Equal(t, ErrorNoPeers, msg.Code)
+	n, err = msg.Pack(buf)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf[:n])
 }
 
 func TestOnionCover(t *testing.T) {
@@ -270,3 +483,469 @@ func TestOnionCover(t *testing.T) {
 	require.Equal(t, len(data), n)
 	assert.Equal(t, data, buf[:n])
 }
+
+func TestOnionPeersQuery(t *testing.T) {
+	msg := new(OnionPeersQuery)
+
+	// check message type
+	require.Equal(t, TypeOnionPeersQuery, msg.Type())
+
+	// unexpected data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{1}))
+
+	err := msg.Parse([]byte{})
+	require.Nil(t, err)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestOnionPeersBanned(t *testing.T) {
+	msg := new(OnionPeersBanned)
+
+	// check message type
+	require.Equal(t, TypeOnionPeersBanned, msg.Type())
+
+	// truncated data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{0, 1, 2, 3}))
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{flagIPv6, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}))
+
+	// too small buf for packing
+	msg.Peers = []OnionBannedPeer{{Address: net.IPv4(1, 2, 3, 4)}}
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	t.Run("empty", func(t *testing.T) {
+		err := msg.Parse([]byte{})
+		require.Nil(t, err)
+		assert.Empty(t, msg.Peers)
+	})
+
+	t.Run("IPv4 and IPv6", func(t *testing.T) {
+		data := []byte{
+			0, 1, 2, 3, 0, 0, 1, 0, 4, 3, 2, 1,
+			flagIPv6, 2, 4, 5, 0, 0, 0, 10, 16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1,
+		}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Len(t, msg.Peers, 2)
+		assert.Equal(t, OnionBannedPeer{
+			Reason:    1,
+			Port:      0x203,
+			Remaining: 256,
+			Address:   net.IP{1, 2, 3, 4},
+		}, msg.Peers[0])
+		assert.Equal(t, OnionBannedPeer{
+			IPv6:      true,
+			Reason:    2,
+			Port:      0x405,
+			Remaining: 10,
+			Address:   net.IP{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		}, msg.Peers[1])
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+	})
+
+	t.Run("max peers", func(t *testing.T) {
+		msg := &OnionPeersBanned{Peers: make([]OnionBannedPeer, MaxBannedPeers)}
+		for i := range msg.Peers {
+			msg.Peers[i] = OnionBannedPeer{IPv6: true, Address: net.IPv6loopback}
+		}
+		buf := make([]byte, MaxSize)
+		_, err := PackMessage(buf, msg)
+		require.Nil(t, err)
+	})
+}
+
+func TestOnionRound(t *testing.T) {
+	msg := new(OnionRound)
+
+	// check message type
+	require.Equal(t, TypeOnionRound, msg.Type())
+
+	// truncated data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{0, 1, 2}))
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{0, 1, 2, 3, 4, 5}))
+
+	// too small buf for packing
+	msg.TunnelIDs = []uint32{1}
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	t.Run("empty", func(t *testing.T) {
+		err := msg.Parse([]byte{0, 0, 1, 0})
+		require.Nil(t, err)
+		assert.Equal(t, uint32(256), msg.Round)
+		assert.Empty(t, msg.TunnelIDs)
+	})
+
+	t.Run("tunnels", func(t *testing.T) {
+		data := []byte{0, 0, 0, 7, 1, 2, 3, 4, 0, 0, 0, 1}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		assert.Equal(t, OnionRound{
+			Round:     7,
+			TunnelIDs: []uint32{0x01020304, 1},
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+	})
+
+	t.Run("max tunnels", func(t *testing.T) {
+		msg := &OnionRound{TunnelIDs: make([]uint32, MaxRoundTunnels)}
+		buf := make([]byte, MaxSize)
+		_, err := PackMessage(buf, msg)
+		require.Nil(t, err)
+
+		msg.TunnelIDs = append(msg.TunnelIDs, 1)
+		_, err = PackMessage(make([]byte, 2*MaxSize), msg)
+		assert.Equal(t, ErrInvalidMessage, err)
+	})
+}
+
+func TestOnionTunnelPinned(t *testing.T) {
+	msg := new(OnionTunnelPinned)
+
+	// check message type
+	require.Equal(t, TypeOnionTunnelPinned, msg.Type())
+
+	// no destination
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	// truncated data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{0, 0, 1, 2, 0, 1, 0, 0, 4, 3, 2}))
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{0, 0, 1, 2, 0, 2, 0, 0, 4, 3, 2, 1, 7}))
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{flagIPv6, 0, 1, 2, 0, 0, 0, 0, 4, 3, 2, 1}))
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	t.Run("destination only", func(t *testing.T) {
+		data := []byte{0, 0, 1, 2, 0, 2, 0, 0, 4, 3, 2, 1, 7, 8}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		assert.Empty(t, msg.Hops)
+		assert.Equal(t, OnionPeer{
+			Port:    0x102,
+			Address: net.IP{1, 2, 3, 4},
+			HostKey: []byte{7, 8},
+		}, msg.Destination)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+	})
+
+	t.Run("hops", func(t *testing.T) {
+		data := []byte{
+			0, 0, 0, 1, 0, 1, 0, 0, 4, 3, 2, 1, 5,
+			flagIPv6, 0, 0, 2, 0, 0, 0, 0, 16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1,
+			0, 0, 0, 3, 0, 2, 0, 0, 8, 7, 6, 5, 7, 8,
+		}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Len(t, msg.Hops, 2)
+		assert.Equal(t, OnionPeer{
+			Port:    1,
+			Address: net.IP{1, 2, 3, 4},
+			HostKey: []byte{5},
+		}, msg.Hops[0])
+		assert.Equal(t, OnionPeer{
+			IPv6:    true,
+			Port:    2,
+			Address: net.IP{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		}, msg.Hops[1])
+		assert.Equal(t, OnionPeer{
+			Port:    3,
+			Address: net.IP{5, 6, 7, 8},
+			HostKey: []byte{7, 8},
+		}, msg.Destination)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+	})
+}
+
+func TestOnionTrafficQuery(t *testing.T) {
+	msg := new(OnionTrafficQuery)
+
+	// check message type
+	require.Equal(t, TypeOnionTrafficQuery, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	data := []byte{1, 2, 3, 4}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, OnionTrafficQuery{TunnelID: 0x1020304}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestOnionTunnelTraffic(t *testing.T) {
+	msg := new(OnionTunnelTraffic)
+
+	// check message type
+	require.Equal(t, TypeOnionTunnelTraffic, msg.Type())
+
+	// empty and truncated data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+	assert.Equal(t, ErrInvalidMessage, msg.Parse(make([]byte, 51)))
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	data := []byte{
+		1, 2, 3, 4,
+		0, 0, 0, 0, 0, 0, 0x30, 0x39,
+		0, 0, 0, 0, 0, 1, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 7,
+		0, 0, 0, 0, 0, 0, 0, 9,
+		0, 0, 0, 0, 0, 0, 0, 2,
+		1, 0, 0, 0, 0, 0, 0, 3,
+	}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, OnionTunnelTraffic{
+		TunnelID:      0x1020304,
+		BytesSent:     12345,
+		BytesReceived: 65536,
+		CellsSent:     7,
+		CellsReceived: 9,
+		CoverSent:     2,
+		CoverReceived: 1<<56 + 3,
+	}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestOnionMTUQuery(t *testing.T) {
+	msg := new(OnionMTUQuery)
+
+	// check message type
+	require.Equal(t, TypeOnionMTUQuery, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	data := []byte{1, 2, 3, 4}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, OnionMTUQuery{TunnelID: 0x1020304}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestOnionTunnelMTU(t *testing.T) {
+	msg := new(OnionTunnelMTU)
+
+	// check message type
+	require.Equal(t, TypeOnionTunnelMTU, msg.Type())
+
+	// empty and truncated data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+	assert.Equal(t, ErrInvalidMessage, msg.Parse(make([]byte, 7)))
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	data := []byte{1, 2, 3, 4, 0x03, 0xc3, 0x03, 0xd3}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, OnionTunnelMTU{TunnelID: 0x1020304, DataSize: 963, DatagramSize: 979}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestOnionTunnelAlive(t *testing.T) {
+	msg := new(OnionTunnelAlive)
+
+	// check message type
+	require.Equal(t, TypeOnionTunnelAlive, msg.Type())
+
+	// empty and truncated data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+	assert.Equal(t, ErrInvalidMessage, msg.Parse(make([]byte, 7)))
+
+	data := []byte{1, 2, 3, 4, 0, 0, 0, 30}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, OnionTunnelAlive{TunnelID: 0x1020304, Idle: 30}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestOnionHello(t *testing.T) {
+	msg := new(OnionHello)
+
+	// check message type
+	require.Equal(t, TypeOnionHello, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	data := []byte{0, 0, 0, 1}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, OnionHello{Capabilities: CapTunnelPath}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestOnionCapabilities(t *testing.T) {
+	msg := new(OnionCapabilities)
+
+	// check message type
+	require.Equal(t, TypeOnionCapabilities, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	data := []byte{0, 0, 0, 1}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, OnionCapabilities{Capabilities: CapTunnelPath}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestOnionSubscribe(t *testing.T) {
+	msg := new(OnionSubscribe)
+
+	// check message type
+	require.Equal(t, TypeOnionSubscribe, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	data := []byte{0, 0, 0, 5}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, OnionSubscribe{Subscriptions: SubscribeIncoming | SubscribeErrors}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestOnionTunnelShare(t *testing.T) {
+	msg := new(OnionTunnelShare)
+
+	// check message type
+	require.Equal(t, TypeOnionTunnelShare, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	data := []byte{1, 2, 3, 4}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, OnionTunnelShare{TunnelID: 0x1020304}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestOnionShareToken(t *testing.T) {
+	msg := new(OnionShareToken)
+
+	// check message type
+	require.Equal(t, TypeOnionShareToken, msg.Type())
+
+	// empty and truncated data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+	assert.Equal(t, ErrInvalidMessage, msg.Parse(make([]byte, 11)))
+
+	data := []byte{1, 2, 3, 4, 0, 0, 0, 0, 0, 0, 0, 42}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, OnionShareToken{TunnelID: 0x1020304, Token: 42}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestOnionTunnelJoin(t *testing.T) {
+	msg := new(OnionTunnelJoin)
+
+	// check message type
+	require.Equal(t, TypeOnionTunnelJoin, msg.Type())
+
+	// empty and truncated data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+	assert.Equal(t, ErrInvalidMessage, msg.Parse(make([]byte, 11)))
+
+	data := []byte{1, 2, 3, 4, 0, 0, 0, 0, 0, 0, 0, 42}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, OnionTunnelJoin{TunnelID: 0x1020304, Token: 42}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
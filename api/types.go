@@ -25,6 +25,26 @@ const (
 	TypeOnionTunnelData     Type = 564
 	TypeOnionError          Type = 565
 	TypeOnionCover          Type = 566
+	TypeOnionTunnelDatagram Type = 567
+	TypeOnionPeersQuery     Type = 568
+	TypeOnionPeersBanned    Type = 569
+	TypeOnionTunnelEOF      Type = 570
+	TypeOnionTunnelPing     Type = 571
+	TypeOnionTunnelPong     Type = 572
+	TypeOnionTunnelPriority Type = 573
+	TypeOnionRound          Type = 574
+	TypeOnionTunnelPinned   Type = 575
+	TypeOnionTrafficQuery   Type = 576
+	TypeOnionTunnelTraffic  Type = 577
+	TypeOnionMTUQuery       Type = 578
+	TypeOnionTunnelMTU      Type = 579
+	TypeOnionTunnelAlive    Type = 580
+	TypeOnionHello          Type = 581
+	TypeOnionCapabilities   Type = 582
+	TypeOnionSubscribe      Type = 583
+	TypeOnionTunnelShare    Type = 584
+	TypeOnionShareToken     Type = 585
+	TypeOnionTunnelJoin     Type = 586
 	// Onion reserved until 599
 
 	TypeAuthSessionStart       Type = 600
@@ -44,10 +64,10 @@ const (
 	TypeAuthCipherDecryptResp  Type = 614
 	// Onion Auth reserved until 649
 
-	DHTPut     Type = 650
-	DHTGet     Type = 651
-	DHTSuccess Type = 652
-	DHTFailure Type = 653
+	TypeDHTPut     Type = 650
+	TypeDHTGet     Type = 651
+	TypeDHTSuccess Type = 652
+	TypeDHTFailure Type = 653
 	// DHT reserved until 679
 
 	TypeEnrollInit    Type = 680
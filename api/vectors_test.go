@@ -0,0 +1,196 @@
+package api
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// updateVectors rewrites the test vectors from the messages below instead of verifying them.
+var updateVectors = flag.Bool("update", false, "update the test vectors in testdata")
+
+// vectorsFile holds the test vectors other implementations can interop-test against. Each line consists of the name of
+// the vector and the hex encoding of the complete API message, including its header.
+var vectorsFile = filepath.Join("testdata", "vectors.txt")
+
+// vectorMessages are the API messages the test vectors are generated from.
+func vectorMessages() map[string]Message {
+	var dhtKey [DHTKeySize]byte
+	for i := range dhtKey {
+		dhtKey[i] = byte(i)
+	}
+	ipv4 := net.IPv4(192, 0, 2, 1).To4()
+	ipv6 := net.ParseIP("2001:db8::1")
+	hostKey := []byte("hostkey")
+
+	return map[string]Message{
+		"GossipAnnounce":     &GossipAnnounce{TTL: 3, DataType: uint16(AppTypeOnion), Data: []byte("data")},
+		"GossipNotify":       &GossipNotify{DataType: uint16(AppTypeOnion)},
+		"GossipNotification": &GossipNotification{MessageID: 1, DataType: uint16(AppTypeOnion), Data: []byte("data")},
+		"GossipValidation":   &GossipValidation{MessageID: 1, Valid: true},
+
+		"NSEQuery":    &NSEQuery{},
+		"NSEEstimate": &NSEEstimate{EstimatePeers: 250, EstimateStdDeviation: 20},
+
+		"RPSQuery": &RPSQuery{},
+		"RPSPeer": &RPSPeer{Port: 6602, PortMap: portMap{{AppTypeOnion, 6603}, {AppTypeDHT, 6604}}, Address: ipv4,
+			DestHostKey: hostKey},
+
+		"OnionTunnelBuild/ipv4": &OnionTunnelBuild{OnionPort: 6602, Address: ipv4, DestHostKey: hostKey},
+		"OnionTunnelBuild/ipv6": &OnionTunnelBuild{IPv6: true, OnionPort: 6602, Address: ipv6, DestHostKey: hostKey},
+		"OnionTunnelReady":      &OnionTunnelReady{TunnelID: 0x01020304, DestHostKey: hostKey},
+		"OnionTunnelIncoming":   &OnionTunnelIncoming{TunnelID: 0x01020304},
+		"OnionTunnelDestroy":    &OnionTunnelDestroy{TunnelID: 0x01020304},
+		"OnionTunnelData":       &OnionTunnelData{TunnelID: 0x01020304, Data: []byte("data")},
+		"OnionTunnelDatagram":   &OnionTunnelDatagram{TunnelID: 0x01020304, Data: []byte("datagram")},
+		"OnionTunnelEOF":        &OnionTunnelEOF{TunnelID: 0x01020304},
+		"OnionTunnelPing":       &OnionTunnelPing{TunnelID: 0x01020304},
+		"OnionTunnelPong":       &OnionTunnelPong{TunnelID: 0x01020304, RTT: 12345},
+		"OnionTunnelPriority":   &OnionTunnelPriority{TunnelID: 0x01020304, Priority: PriorityControl},
+		"OnionError":            &OnionError{RequestType: TypeOnionTunnelBuild, TunnelID: 0x01020304},
+		"OnionCover":            &OnionCover{CoverSize: 4096},
+		"OnionPeersQuery":       &OnionPeersQuery{},
+		"OnionPeersBanned": &OnionPeersBanned{Peers: []OnionBannedPeer{
+			{Reason: 1, Port: 6602, Remaining: 600, Address: ipv4},
+			{IPv6: true, Reason: 3, Port: 6602, Remaining: 60, Address: ipv6},
+		}},
+		"OnionPeersBanned/empty": &OnionPeersBanned{},
+		"OnionTunnelBuild/multipath": &OnionTunnelBuild{Multipath: true, OnionPort: 6602, Address: ipv4,
+			DestHostKey: hostKey},
+		"OnionError/code":  &OnionError{RequestType: TypeOnionTunnelBuild, Code: ErrorNoPeers, TunnelID: 0x01020304},
+		"OnionRound":       &OnionRound{Round: 42, TunnelIDs: []uint32{0x01020304, 0x05060708}},
+		"OnionRound/empty": &OnionRound{Round: 43},
+		"OnionTunnelPinned": &OnionTunnelPinned{
+			Hops: []OnionPeer{
+				{Port: 6602, Address: ipv4, HostKey: []byte("hop1")},
+				{IPv6: true, Port: 6603, Address: ipv6, HostKey: []byte("hop2")},
+			},
+			Destination: OnionPeer{Port: 6604, Address: ipv4, HostKey: hostKey},
+		},
+		"OnionTrafficQuery": &OnionTrafficQuery{TunnelID: 0x01020304},
+		"OnionTunnelTraffic": &OnionTunnelTraffic{TunnelID: 0x01020304, BytesSent: 4096, BytesReceived: 8192,
+			CellsSent: 5, CellsReceived: 7, CoverSent: 1, CoverReceived: 2},
+		"OnionMTUQuery":    &OnionMTUQuery{TunnelID: 0x01020304},
+		"OnionTunnelMTU":   &OnionTunnelMTU{TunnelID: 0x01020304, DataSize: 963, DatagramSize: 979},
+		"OnionTunnelAlive": &OnionTunnelAlive{TunnelID: 0x01020304, Idle: 30},
+		"OnionTunnelReady/path": &OnionTunnelReady{HasPath: true, TunnelID: 0x01020304, DestHostKey: hostKey, Hops: 3,
+			BuildTime: 250},
+		"OnionHello":        &OnionHello{Capabilities: CapTunnelPath},
+		"OnionCapabilities": &OnionCapabilities{Capabilities: CapTunnelPath},
+		"OnionSubscribe":    &OnionSubscribe{Subscriptions: SubscribeIncoming | SubscribeErrors},
+		"OnionTunnelShare":  &OnionTunnelShare{TunnelID: 0x01020304},
+		"OnionShareToken":   &OnionShareToken{TunnelID: 0x01020304, Token: 0x0102030405060708},
+		"OnionTunnelJoin":   &OnionTunnelJoin{TunnelID: 0x01020304, Token: 0x0102030405060708},
+
+		"AuthSessionStart":       &AuthSessionStart{RequestID: 1, HostKey: hostKey},
+		"AuthSessionHS1":         &AuthSessionHS1{SessionID: 2, RequestID: 1, Payload: []byte("hs1")},
+		"AuthSessionIncomingHS1": &AuthSessionIncomingHS1{RequestID: 1, Payload: []byte("hs1")},
+		"AuthSessionHS2":         &AuthSessionHS2{SessionID: 2, RequestID: 1, Payload: []byte("hs2")},
+		"AuthSessionIncomingHS2": &AuthSessionIncomingHS2{SessionID: 2, RequestID: 1, Payload: []byte("hs2")},
+		"AuthLayerEncrypt":       &AuthLayerEncrypt{RequestID: 1, SessionIDs: []uint16{3, 2}, Payload: []byte("payload")},
+		"AuthLayerDecrypt":       &AuthLayerDecrypt{RequestID: 1, SessionIDs: []uint16{3, 2}, Payload: []byte("payload")},
+		"AuthLayerEncryptResp":   &AuthLayerEncryptResp{RequestID: 1, Payload: []byte("payload")},
+		"AuthLayerDecryptResp":   &AuthLayerDecryptResp{RequestID: 1, Payload: []byte("payload")},
+		"AuthSessionClose":       &AuthSessionClose{SessionID: 2},
+		"AuthError":              &AuthError{RequestID: 1},
+		"AuthCipherEncrypt":      &AuthCipherEncrypt{SessionID: 2, RequestID: 1, Payload: []byte("payload")},
+		"AuthCipherEncryptResp":  &AuthCipherEncryptResp{RequestID: 1, Payload: []byte("payload")},
+		"AuthCipherDecrypt":      &AuthCipherDecrypt{SessionID: 2, RequestID: 1, Payload: []byte("payload")},
+		"AuthCipherDecryptResp":  &AuthCipherDecryptResp{Cleartext: true, RequestID: 1, Payload: []byte("payload")},
+
+		"DHTPut":     &DHTPut{TTL: 300, Replication: 3, Key: dhtKey, Value: []byte("value")},
+		"DHTGet":     &DHTGet{Key: dhtKey},
+		"DHTSuccess": &DHTSuccess{Key: dhtKey, Value: []byte("value")},
+		"DHTFailure": &DHTFailure{Key: dhtKey},
+	}
+}
+
+// encodeVectors returns the hex encodings of all test vectors by name.
+func encodeVectors(t *testing.T) map[string]string {
+	vectors := make(map[string]string)
+	buf := make([]byte, MaxSize)
+	for name, msg := range vectorMessages() {
+		n, err := PackMessage(buf, msg)
+		require.Nil(t, err, name)
+		vectors[name] = hex.EncodeToString(buf[:n])
+	}
+	return vectors
+}
+
+func readVectors(t *testing.T) map[string][]byte {
+	f, err := os.Open(vectorsFile)
+	require.Nil(t, err)
+	defer f.Close()
+
+	vectors := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		require.Len(t, fields, 2, line)
+		data, err := hex.DecodeString(fields[1])
+		require.Nil(t, err, fields[0])
+		vectors[fields[0]] = data
+	}
+	require.Nil(t, scanner.Err())
+	return vectors
+}
+
+func writeVectors(t *testing.T, vectors map[string]string) {
+	names := make([]string, 0, len(vectors))
+	for name := range vectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString("# bawang API test vectors: <name> <hex>\n")
+	sb.WriteString("# Each vector is a complete API message including its header.\n")
+	for _, name := range names {
+		fmt.Fprintf(&sb, "%s %s\n", name, vectors[name])
+	}
+	require.Nil(t, ioutil.WriteFile(vectorsFile, []byte(sb.String()), 0644))
+}
+
+func TestVectors(t *testing.T) {
+	encoded := encodeVectors(t)
+	if *updateVectors {
+		writeVectors(t, encoded)
+	}
+	vectors := readVectors(t)
+	require.Len(t, vectors, len(encoded), "test vectors are outdated, run the tests with -update")
+
+	for name, msg := range vectorMessages() {
+		data := vectors[name]
+		require.NotNil(t, data, name)
+		assert.Equal(t, encoded[name], hex.EncodeToString(data), name)
+
+		// the vectors are parsed into the same encoding
+		hdr := Header{}
+		require.Nil(t, hdr.Parse(data), name)
+		assert.Equal(t, msg.Type(), hdr.Type, name)
+		assert.Equal(t, len(data), int(hdr.Size), name)
+
+		parsed := reflect.New(reflect.TypeOf(msg).Elem()).Interface().(Message)
+		require.Nil(t, parsed.Parse(data[HeaderSize:]), name)
+		buf := make([]byte, MaxSize)
+		n, err := PackMessage(buf, parsed)
+		require.Nil(t, err, name)
+		assert.Equal(t, data, buf[:n], name)
+	}
+}
@@ -0,0 +1,395 @@
+// Package auth provides a client for the Onion Auth module, which establishes the session keys with the hops of a tunnel
+// and performs the layered encryption of relay messages on behalf of the onion router.
+package auth
+
+import (
+	"bufio"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"bawang/api"
+	"bawang/config"
+)
+
+var (
+	// ErrRequestFailed is returned if the Onion Auth module replied to a request with an AUTH ERROR.
+	ErrRequestFailed = errors.New("onion auth module could not handle the request")
+
+	// ErrTimedOut is returned if the Onion Auth module did not reply to a request in time.
+	ErrTimedOut = errors.New("onion auth module did not reply in time")
+
+	// ErrClosed is returned for requests after the connection to the Onion Auth module was closed.
+	ErrClosed = errors.New("connection to onion auth module closed")
+)
+
+// Client delegates session key establishment and the layered encryption of relay messages to the Onion Auth module.
+// A session is started by the tunnel initiator with SessionStart, passing the returned handshake message to the hop,
+// which answers it with SessionIncomingHS1. The initiator completes the session by passing the hop's reply to
+// SessionIncomingHS2.
+type Client interface {
+	SessionStart(peerHostKey *rsa.PublicKey) (sessionID uint16, hs1 []byte, err error)
+	SessionIncomingHS1(hs1 []byte) (sessionID uint16, hs2 []byte, err error)
+	SessionIncomingHS2(sessionID uint16, hs2 []byte) (err error)
+	SessionClose(sessionID uint16) (err error)
+	LayerEncrypt(sessionIDs []uint16, payload []byte) (encPayload []byte, err error)
+	LayerDecrypt(sessionIDs []uint16, encPayload []byte) (payload []byte, err error)
+	CipherEncrypt(sessionID uint16, payload []byte) (encPayload []byte, err error)
+	CipherDecrypt(sessionID uint16, encPayload []byte) (payload []byte, cleartext bool, err error)
+	Close()
+}
+
+// client implements Client for the Onion Auth module's API socket. Requests may be sent from multiple goroutines
+// concurrently, the replies are matched with the requests by their request ID.
+type client struct {
+	nc      net.Conn
+	timeout time.Duration
+
+	writeLock sync.Mutex // guards msgBuf and writes to nc
+	msgBuf    [api.MaxSize]byte
+
+	lock          sync.Mutex // guards fields below
+	nextRequestID uint32
+	pending       map[uint32]chan api.Message // replies of the pending requests by request ID
+	closed        bool
+}
+
+// New connects to the Onion Auth module configured in the config.Config.
+func New(cfg *config.Config) (Client, error) {
+	if cfg == nil {
+		return nil, errors.New("invalid config")
+	}
+
+	nc, err := net.Dial("tcp", cfg.AuthAPIAddress)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(nc, time.Duration(cfg.APITimeout)*time.Second), nil
+}
+
+// newClient creates a client sending requests on the given connection and waiting for the replies until the timeout.
+func newClient(nc net.Conn, timeout time.Duration) *client {
+	c := &client{
+		nc:      nc,
+		timeout: timeout,
+		pending: make(map[uint32]chan api.Message),
+	}
+	go c.readReplies()
+	return c
+}
+
+// Close closes the connection to the Onion Auth module. Pending requests fail with ErrClosed.
+func (c *client) Close() {
+	err := c.nc.Close()
+	if err != nil {
+		log.Printf("error closing Onion Auth API connection %s", err)
+	}
+}
+
+// readReplies passes the replies received from the Onion Auth module to the pending requests, until the connection
+// is closed.
+func (c *client) readReplies() {
+	defer c.fail()
+
+	rd := bufio.NewReader(c.nc)
+	buf := make([]byte, api.MaxSize)
+	for {
+		var hdr api.Header
+		err := hdr.Read(rd)
+		if err != nil {
+			return
+		}
+		if hdr.Size < api.HeaderSize {
+			log.Print("invalid message received from onion auth module")
+			return
+		}
+
+		data := buf[:hdr.Size-api.HeaderSize]
+		_, err = io.ReadFull(rd, data)
+		if err != nil {
+			log.Printf("Error reading message body: %v", err)
+			return
+		}
+
+		requestID, reply, err := parseReply(hdr.Type, data)
+		if err != nil {
+			log.Printf("Error parsing message from onion auth module: %v", err)
+			continue
+		}
+
+		c.lock.Lock()
+		replyChan, ok := c.pending[requestID]
+		delete(c.pending, requestID)
+		c.lock.Unlock()
+		if !ok {
+			if _, isErr := reply.(*api.AuthError); isErr {
+				// requests without a reply, e.g. AUTH SESSION INCOMING HS2, fail silently otherwise
+				log.Printf("Onion auth module could not handle request %v", requestID)
+			}
+			continue
+		}
+		replyChan <- reply
+	}
+}
+
+// fail marks the client as closed and fails all pending requests.
+func (c *client) fail() {
+	c.lock.Lock()
+	c.closed = true
+	for requestID, replyChan := range c.pending {
+		close(replyChan)
+		delete(c.pending, requestID)
+	}
+	c.lock.Unlock()
+}
+
+// parseReply allocates the respective reply type and parses the given body data into it.
+func parseReply(msgType api.Type, body []byte) (requestID uint32, reply api.Message, err error) {
+	switch msgType {
+	case api.TypeAuthSessionHS1:
+		msg := new(api.AuthSessionHS1)
+		err = msg.Parse(body)
+		return msg.RequestID, msg, err
+
+	case api.TypeAuthSessionHS2:
+		msg := new(api.AuthSessionHS2)
+		err = msg.Parse(body)
+		return msg.RequestID, msg, err
+
+	case api.TypeAuthLayerEncryptResp:
+		msg := new(api.AuthLayerEncryptResp)
+		err = msg.Parse(body)
+		return msg.RequestID, msg, err
+
+	case api.TypeAuthLayerDecryptResp:
+		msg := new(api.AuthLayerDecryptResp)
+		err = msg.Parse(body)
+		return msg.RequestID, msg, err
+
+	case api.TypeAuthCipherEncryptResp:
+		msg := new(api.AuthCipherEncryptResp)
+		err = msg.Parse(body)
+		return msg.RequestID, msg, err
+
+	case api.TypeAuthCipherDecryptResp:
+		msg := new(api.AuthCipherDecryptResp)
+		err = msg.Parse(body)
+		return msg.RequestID, msg, err
+
+	case api.TypeAuthError:
+		msg := new(api.AuthError)
+		err = msg.Parse(body)
+		return msg.RequestID, msg, err
+
+	default:
+		return 0, nil, api.ErrInvalidMessage
+	}
+}
+
+// send packs and sends a message to the Onion Auth module.
+func (c *client) send(msg api.Message) (err error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	n, err := api.PackMessage(c.msgBuf[:], msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.nc.Write(c.msgBuf[:n])
+	return err
+}
+
+// newRequest allocates a request ID and registers the channel the reply to the request is passed on.
+func (c *client) newRequest() (requestID uint32, replyChan chan api.Message, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return 0, nil, ErrClosed
+	}
+
+	requestID = c.nextRequestID
+	c.nextRequestID++
+	replyChan = make(chan api.Message, 1)
+	c.pending[requestID] = replyChan
+	return requestID, replyChan, nil
+}
+
+// request sends the message created for a new request ID and waits for the reply.
+func (c *client) request(newMsg func(requestID uint32) api.Message) (reply api.Message, err error) {
+	requestID, replyChan, err := c.newRequest()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, requestID)
+		c.lock.Unlock()
+	}()
+
+	err = c.send(newMsg(requestID))
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply, ok := <-replyChan:
+		if !ok {
+			return nil, ErrClosed
+		}
+		if _, isErr := reply.(*api.AuthError); isErr {
+			return nil, ErrRequestFailed
+		}
+		return reply, nil
+	case <-time.After(c.timeout):
+		return nil, ErrTimedOut
+	}
+}
+
+// SessionStart starts a session with the peer holding the given host key, returning the handshake message for it.
+func (c *client) SessionStart(peerHostKey *rsa.PublicKey) (sessionID uint16, hs1 []byte, err error) {
+	reply, err := c.request(func(requestID uint32) api.Message {
+		return &api.AuthSessionStart{
+			RequestID: requestID,
+			HostKey:   x509.MarshalPKCS1PublicKey(peerHostKey),
+		}
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	msg, ok := reply.(*api.AuthSessionHS1)
+	if !ok {
+		return 0, nil, api.ErrInvalidMessage
+	}
+	return msg.SessionID, msg.Payload, nil
+}
+
+// SessionIncomingHS1 starts a session initiated by another peer with the given handshake message, returning the
+// handshake message answering it.
+func (c *client) SessionIncomingHS1(hs1 []byte) (sessionID uint16, hs2 []byte, err error) {
+	reply, err := c.request(func(requestID uint32) api.Message {
+		return &api.AuthSessionIncomingHS1{
+			RequestID: requestID,
+			Payload:   hs1,
+		}
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	msg, ok := reply.(*api.AuthSessionHS2)
+	if !ok {
+		return 0, nil, api.ErrInvalidMessage
+	}
+	return msg.SessionID, msg.Payload, nil
+}
+
+// SessionIncomingHS2 completes a session started with SessionStart with the handshake message of the other peer.
+// The Onion Auth module does not confirm the session, errors are only logged once they are received.
+func (c *client) SessionIncomingHS2(sessionID uint16, hs2 []byte) (err error) {
+	c.lock.Lock()
+	requestID := c.nextRequestID
+	c.nextRequestID++
+	c.lock.Unlock()
+
+	return c.send(&api.AuthSessionIncomingHS2{
+		SessionID: sessionID,
+		RequestID: requestID,
+		Payload:   hs2,
+	})
+}
+
+// SessionClose tells the Onion Auth module to forget the keys of the given session.
+func (c *client) SessionClose(sessionID uint16) (err error) {
+	return c.send(&api.AuthSessionClose{
+		SessionID: sessionID,
+	})
+}
+
+// LayerEncrypt encrypts the payload with the keys of the given sessions, applying the layers in the given order.
+func (c *client) LayerEncrypt(sessionIDs []uint16, payload []byte) (encPayload []byte, err error) {
+	reply, err := c.request(func(requestID uint32) api.Message {
+		return &api.AuthLayerEncrypt{
+			RequestID:  requestID,
+			SessionIDs: sessionIDs,
+			Payload:    payload,
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	msg, ok := reply.(*api.AuthLayerEncryptResp)
+	if !ok {
+		return nil, api.ErrInvalidMessage
+	}
+	return msg.Payload, nil
+}
+
+// LayerDecrypt removes the layers of encryption of the given sessions from the payload in the given order.
+func (c *client) LayerDecrypt(sessionIDs []uint16, encPayload []byte) (payload []byte, err error) {
+	reply, err := c.request(func(requestID uint32) api.Message {
+		return &api.AuthLayerDecrypt{
+			RequestID:  requestID,
+			SessionIDs: sessionIDs,
+			Payload:    encPayload,
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	msg, ok := reply.(*api.AuthLayerDecryptResp)
+	if !ok {
+		return nil, api.ErrInvalidMessage
+	}
+	return msg.Payload, nil
+}
+
+// CipherEncrypt adds the layer of encryption of a single session to the payload.
+func (c *client) CipherEncrypt(sessionID uint16, payload []byte) (encPayload []byte, err error) {
+	reply, err := c.request(func(requestID uint32) api.Message {
+		return &api.AuthCipherEncrypt{
+			SessionID: sessionID,
+			RequestID: requestID,
+			Payload:   payload,
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	msg, ok := reply.(*api.AuthCipherEncryptResp)
+	if !ok {
+		return nil, api.ErrInvalidMessage
+	}
+	return msg.Payload, nil
+}
+
+// CipherDecrypt removes the layer of encryption of a single session from the payload. cleartext reports whether the
+// Onion Auth module found no other layers of encryption.
+func (c *client) CipherDecrypt(sessionID uint16, encPayload []byte) (payload []byte, cleartext bool, err error) {
+	reply, err := c.request(func(requestID uint32) api.Message {
+		return &api.AuthCipherDecrypt{
+			SessionID: sessionID,
+			RequestID: requestID,
+			Payload:   encPayload,
+		}
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	msg, ok := reply.(*api.AuthCipherDecryptResp)
+	if !ok {
+		return nil, false, api.ErrInvalidMessage
+	}
+	return msg.Payload, msg.Cleartext, nil
+}
@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/api"
+)
+
+// mockModule is the Onion Auth module's end of the API connection in tests.
+type mockModule struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+func newTestClient(timeout time.Duration) (*client, *mockModule) {
+	connClient, connModule := net.Pipe()
+	return newClient(connClient, timeout), &mockModule{Conn: connModule, rd: bufio.NewReader(connModule)}
+}
+
+// readRequest reads the next request sent by the client and parses it into msg, which must be of the expected type.
+func (m *mockModule) readRequest(t *testing.T, msg api.Message) {
+	var hdr api.Header
+	require.Nil(t, hdr.Read(m.rd))
+	require.Equal(t, msg.Type(), hdr.Type)
+
+	body := make([]byte, hdr.Size-api.HeaderSize)
+	_, err := io.ReadFull(m.rd, body)
+	require.Nil(t, err)
+	require.Nil(t, msg.Parse(body))
+}
+
+// reply sends a reply to the client.
+func (m *mockModule) reply(t *testing.T, msg api.Message) {
+	buf := make([]byte, api.MaxSize)
+	n, err := api.PackMessage(buf, msg)
+	require.Nil(t, err)
+	_, err = m.Write(buf[:n])
+	require.Nil(t, err)
+}
+
+func TestClientSession(t *testing.T) {
+	c, module := newTestClient(time.Second)
+	defer c.Close()
+
+	hostKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+
+	type result struct {
+		sessionID uint16
+		payload   []byte
+		err       error
+	}
+
+	// the initiator starts the session
+	results := make(chan result, 1)
+	go func() {
+		sessionID, hs1, err := c.SessionStart(&hostKey.PublicKey)
+		results <- result{sessionID, hs1, err}
+	}()
+	start := api.AuthSessionStart{}
+	module.readRequest(t, &start)
+	assert.Equal(t, x509.MarshalPKCS1PublicKey(&hostKey.PublicKey), start.HostKey)
+	module.reply(t, &api.AuthSessionHS1{SessionID: 7, RequestID: start.RequestID, Payload: []byte("hs1")})
+
+	res := <-results
+	require.Nil(t, res.err)
+	assert.Equal(t, uint16(7), res.sessionID)
+	assert.Equal(t, []byte("hs1"), res.payload)
+
+	// the hop answers it
+	go func() {
+		sessionID, hs2, err := c.SessionIncomingHS1([]byte("hs1"))
+		results <- result{sessionID, hs2, err}
+	}()
+	incomingHS1 := api.AuthSessionIncomingHS1{}
+	module.readRequest(t, &incomingHS1)
+	assert.Equal(t, []byte("hs1"), incomingHS1.Payload)
+	module.reply(t, &api.AuthSessionHS2{SessionID: 8, RequestID: incomingHS1.RequestID, Payload: []byte("hs2")})
+
+	res = <-results
+	require.Nil(t, res.err)
+	assert.Equal(t, uint16(8), res.sessionID)
+	assert.Equal(t, []byte("hs2"), res.payload)
+
+	// the initiator completes the session without waiting for a reply
+	go func() {
+		results <- result{err: c.SessionIncomingHS2(7, []byte("hs2"))}
+	}()
+	incomingHS2 := api.AuthSessionIncomingHS2{}
+	module.readRequest(t, &incomingHS2)
+	assert.Equal(t, uint16(7), incomingHS2.SessionID)
+	assert.Equal(t, []byte("hs2"), incomingHS2.Payload)
+	require.Nil(t, (<-results).err)
+
+	go func() {
+		results <- result{err: c.SessionClose(7)}
+	}()
+	closeMsg := api.AuthSessionClose{}
+	module.readRequest(t, &closeMsg)
+	assert.Equal(t, api.AuthSessionClose{SessionID: 7}, closeMsg)
+	require.Nil(t, (<-results).err)
+}
+
+func TestClientCipher(t *testing.T) {
+	c, module := newTestClient(time.Second)
+	defer c.Close()
+
+	t.Run("replies out of order", func(t *testing.T) {
+		encrypted := make(chan []byte, 1)
+		go func() {
+			encPayload, err := c.CipherEncrypt(1, []byte("payload"))
+			assert.Nil(t, err)
+			encrypted <- encPayload
+		}()
+		encryptMsg := api.AuthCipherEncrypt{}
+		module.readRequest(t, &encryptMsg)
+		assert.Equal(t, uint16(1), encryptMsg.SessionID)
+
+		decrypted := make(chan []byte, 1)
+		go func() {
+			payload, cleartext, err := c.CipherDecrypt(2, []byte("encrypted"))
+			assert.Nil(t, err)
+			assert.True(t, cleartext)
+			decrypted <- payload
+		}()
+		decryptMsg := api.AuthCipherDecrypt{}
+		module.readRequest(t, &decryptMsg)
+		assert.Equal(t, uint16(2), decryptMsg.SessionID)
+
+		module.reply(t, &api.AuthCipherDecryptResp{Cleartext: true, RequestID: decryptMsg.RequestID, Payload: []byte("decrypted")})
+		module.reply(t, &api.AuthCipherEncryptResp{RequestID: encryptMsg.RequestID, Payload: []byte("encrypted")})
+		assert.Equal(t, []byte("decrypted"), <-decrypted)
+		assert.Equal(t, []byte("encrypted"), <-encrypted)
+	})
+
+	t.Run("layers", func(t *testing.T) {
+		encrypted := make(chan []byte, 1)
+		go func() {
+			encPayload, err := c.LayerEncrypt([]uint16{3, 2, 1}, []byte("payload"))
+			assert.Nil(t, err)
+			encrypted <- encPayload
+		}()
+		layerMsg := api.AuthLayerEncrypt{}
+		module.readRequest(t, &layerMsg)
+		assert.Equal(t, []uint16{3, 2, 1}, layerMsg.SessionIDs)
+		module.reply(t, &api.AuthLayerEncryptResp{RequestID: layerMsg.RequestID, Payload: []byte("encrypted")})
+		assert.Equal(t, []byte("encrypted"), <-encrypted)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		errs := make(chan error, 1)
+		go func() {
+			_, err := c.CipherEncrypt(1, []byte("payload"))
+			errs <- err
+		}()
+		encryptMsg := api.AuthCipherEncrypt{}
+		module.readRequest(t, &encryptMsg)
+		module.reply(t, &api.AuthError{RequestID: encryptMsg.RequestID})
+		assert.Equal(t, ErrRequestFailed, <-errs)
+	})
+
+	t.Run("unexpected reply", func(t *testing.T) {
+		errs := make(chan error, 1)
+		go func() {
+			_, err := c.CipherEncrypt(1, []byte("payload"))
+			errs <- err
+		}()
+		encryptMsg := api.AuthCipherEncrypt{}
+		module.readRequest(t, &encryptMsg)
+		module.reply(t, &api.AuthCipherDecryptResp{RequestID: encryptMsg.RequestID})
+		assert.Equal(t, api.ErrInvalidMessage, <-errs)
+	})
+}
+
+func TestClientTimeout(t *testing.T) {
+	c, module := newTestClient(10 * time.Millisecond)
+	defer c.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.CipherEncrypt(1, []byte("payload"))
+		errs <- err
+	}()
+	encryptMsg := api.AuthCipherEncrypt{}
+	module.readRequest(t, &encryptMsg)
+	assert.Equal(t, ErrTimedOut, <-errs)
+
+	// a late reply is dropped
+	module.reply(t, &api.AuthCipherEncryptResp{RequestID: encryptMsg.RequestID})
+	c.lock.Lock()
+	assert.Empty(t, c.pending)
+	c.lock.Unlock()
+}
+
+func TestClientClosed(t *testing.T) {
+	c, module := newTestClient(time.Second)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.CipherEncrypt(1, []byte("payload"))
+		errs <- err
+	}()
+	module.readRequest(t, &api.AuthCipherEncrypt{})
+
+	// pending requests fail once the connection is closed
+	require.Nil(t, module.Close())
+	assert.Equal(t, ErrClosed, <-errs)
+
+	require.Eventually(t, func() bool {
+		_, err := c.CipherEncrypt(1, []byte("payload"))
+		return err == ErrClosed
+	}, time.Second, time.Millisecond)
+	c.Close()
+}
@@ -3,63 +3,254 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
+	"bawang/admin"
 	"bawang/config"
+	"bawang/health"
 	"bawang/onion"
+	"bawang/rps"
+	"bawang/socks"
+	"bawang/supervisor"
 )
 
+// command is a subcommand of bawang, given as the first argument.
+type command struct {
+	name  string
+	args  string // synopsis of the arguments
+	short string // one line description
+	run   func(flags *flag.FlagSet, args []string) error
+}
+
+// commands are all subcommands of bawang, see commands.go.
+var commands = []command{
+	{"run", "[-config path] [-set section.key=value]... [-pprof address]", "run the onion router", runCommand},
+	{"genkey", "[-out path] [-bits n]", "generate a host key", genkeyCommand},
+	{"checkconfig", "[-config path] [-set section.key=value]...", "check a config file", checkconfigCommand},
+	{"ping", "[-config path] [-timeout seconds] address:port", "connect to another peer", pingCommand},
+	{"loadgen", "[-config path] [-source address] [-tunnels n] [-pattern cbr|bursty|bidi] [-rate n] [-duration seconds]",
+		"soak test a network", loadgenCommand},
+}
+
 func main() {
-	var configFilePath string
-	flag.StringVar(&configFilePath, "config", "config.conf", "Path to config file, default is config.conf")
+	// without a subcommand the router is run, e.g. bawang -config config.conf
+	name, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		usage()
+		return
+	}
+	for i := range commands {
+		if commands[i].name != name {
+			continue
+		}
+		err := commands[i].run(newFlagSet(&commands[i]), args)
+		if err == flag.ErrHelp {
+			os.Exit(2)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bawang %s: %v\n", name, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "bawang: unknown command %q\n", name)
+	usage()
+	os.Exit(2)
+}
+
+// usage prints the available commands.
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: bawang <command> [arguments]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.name, cmd.short)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'bawang <command> -h' for the arguments of a command.\n")
+}
+
+// newFlagSet creates the flag set of the given command, printing its synopsis as usage.
+func newFlagSet(cmd *command) *flag.FlagSet {
+	flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: bawang %s %s\n\n", cmd.name, cmd.args)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// configFlags adds the flags selecting the config file and overriding its entries to the given flag set.
+func configFlags(flags *flag.FlagSet) (configFilePath *string, overrides config.Overrides) {
+	configFilePath = flags.String("config", "config.conf", "Path to config file")
+	overrides = config.Overrides{}
+	flags.Var(overrides, "set", "Override a config file entry, given as section.key=value. May be repeated")
+	return configFilePath, overrides
+}
+
+// runCommand runs the onion router until it fails or is shut down by a signal.
+func runCommand(flags *flag.FlagSet, args []string) error {
+	configFilePath, overrides := configFlags(flags)
+	pprofAddress := flags.String("pprof", "",
+		"Address to serve runtime profiling data on, e.g. localhost:6060. Disabled if empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	if *pprofAddress != "" {
+		go servePprof(*pprofAddress)
+	}
 
 	// init config
 	var cfg config.Config
-	err := cfg.FromFile(configFilePath)
+	err := cfg.FromFileWithOverrides(*configFilePath, overrides)
 	if err != nil {
-		log.Fatalf("Error loading config file: %v", err)
+		return fmt.Errorf("error loading config file: %w", err)
 	}
 
+	// all long-lived goroutines are supervised, the first fatal error shuts down the process
+	group := supervisor.New(nil)
+
 	// handle shutdown signals
-	quitChan := make(chan struct{})
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		sig := <-sigChan
-		log.Printf("Received signal %v, shutting down\n", sig)
-		close(quitChan)
+		select {
+		case sig := <-sigChan:
+			log.Printf("Received signal %v, shutting down\n", sig)
+			group.Stop()
+		case <-group.Quit():
+		}
 	}()
 
+	// the connection to the RPS module is shared by all identities
+	peerSampler, err := rps.New(&cfg)
+	if err != nil {
+		return fmt.Errorf("error initializing RPS: %w", err)
+	}
+	defer peerSampler.Close()
+
+	// the health endpoint reports on all identities
+	healthHandler := &health.Handler{}
+	if checker, ok := peerSampler.(rps.Checker); ok {
+		healthHandler.AddLiveness("rps", checker.Check)
+	}
+
+	// run an independent Onion router for each identity
+	identities := append([]*config.Config{&cfg}, cfg.Identities...)
+	for _, identity := range identities {
+		err = runIdentity(identity, peerSampler, healthHandler, group)
+		if err != nil {
+			group.Stop()
+			_ = group.Wait()
+			return fmt.Errorf("error initializing Onion router: %w", err)
+		}
+	}
+
+	// wait until shut down by a signal or a fatal error of a child goroutine
+	return group.Wait()
+}
+
+// servePprof serves the runtime profiling data via HTTP on the given address, see net/http/pprof.
+// The handlers are registered on their own mux, such that they are never exposed by any other HTTP server.
+func servePprof(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	log.Printf("Serving profiling data on http://%s/debug/pprof/\n", address)
+	err := http.ListenAndServe(address, mux) //nolint:gosec // only meant for local debugging
+	log.Printf("Error serving profiling data: %v\n", err)
+}
+
+// runIdentity starts an Onion router with its P2P and API sockets for the given identity in child goroutines.
+// The health of the router and its sockets is reported by healthHandler.
+// The child goroutines are supervised by group.
+func runIdentity(cfg *config.Config, peerSampler rps.RPS, healthHandler *health.Handler,
+	group *supervisor.Group) error {
+	name := cfg.Name
+	if name == "" {
+		name = "default"
+	}
+
 	// initialize Onion router
-	router, err := onion.NewRouter(&cfg)
+	router, err := onion.NewRouter(cfg, onion.WithRPS(peerSampler),
+		onion.WithLogger(log.New(os.Stderr, "["+name+"] ", log.LstdFlags)))
 	if err != nil {
-		log.Fatalf("Error initializing Onion router: %v", err)
+		return err
 	}
 
-	// start the router's round logic
-	errChanRounds := make(chan error)
-	go router.HandleRounds(errChanRounds, quitChan)
+	// start the router's round logic, which is restarted if a round failed
+	group.GoRestart("identity "+name+": Onion rounds", router.HandleRounds)
 
-	// start listening on sockets in child goroutines
-	errChanOnion := make(chan error)
-	go onion.ListenOnionSocket(&cfg, router, errChanOnion, quitChan)
+	// the handlers of the outgoing tunnels are started by the router, they are stopped once the group is
+	group.Go("identity "+name+": tunnel handlers", func(quit chan struct{}) error {
+		<-quit
+		router.Shutdown()
+		return nil
+	})
 
-	errChanAPI := make(chan error)
-	go ListenAPISocket(&cfg, router, errChanAPI, quitChan)
+	// start listening on sockets in child goroutines, client-only peers are not reachable for other peers at all
+	if !cfg.ClientOnly {
+		group.GoRestart("identity "+name+": Onion socket", func(quit chan struct{}) error {
+			return onion.ListenOnionSocket(cfg, router, quit)
+		})
+	}
 
-	// handle errors from child goroutines
-	select {
-	case err = <-errChanRounds:
-		close(quitChan)
-		log.Fatalf("Error handling Onion rounds: %v", err)
-	case err = <-errChanOnion:
-		close(quitChan)
-		log.Fatalf("Error listening on Onion socket: %v", err)
-	case err = <-errChanAPI:
-		close(quitChan)
-		log.Fatalf("Error listening on API socket: %v", err)
+	// relay-only peers are headless, without any API clients
+	apiListening := &health.Flag{}
+	if !cfg.RelayOnly {
+		group.GoRestart("identity "+name+": API socket", func(quit chan struct{}) error {
+			return ListenAPISocket(cfg, router, apiListening, quit)
+		})
 	}
+
+	// check whether other peers can connect back to us once the P2P listener is up
+	if cfg.ReachabilityCheck {
+		group.Go("identity "+name+": reachability check", router.CheckReachabilityOnStart)
+	}
+
+	if !cfg.ClientOnly {
+		healthHandler.AddLiveness(name+" p2p", router.CheckListener)
+	}
+	if !cfg.RelayOnly {
+		healthHandler.AddLiveness(name+" api", apiListening.Check)
+	}
+	healthHandler.AddReadiness(name+" round", router.CheckRounds)
+
+	if cfg.SOCKSAddress != "" {
+		group.GoRestart("identity "+name+": SOCKS socket", func(quit chan struct{}) error {
+			return socks.ListenSOCKSSocket(cfg, router, quit)
+		})
+	}
+
+	if cfg.AdminAddress != "" {
+		group.GoRestart("identity "+name+": admin socket", func(quit chan struct{}) error {
+			return admin.ListenAdminSocket(cfg, router, quit)
+		})
+	}
+
+	if cfg.HealthAddress != "" {
+		group.GoRestart("identity "+name+": health endpoint", func(quit chan struct{}) error {
+			return health.ListenHealthSocket(cfg, healthHandler, quit)
+		})
+	}
+
+	return nil
 }
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"bawang/config"
+	"bawang/loadgen"
+	"bawang/onion"
+)
+
+// hostKeyBits is the default size of the host keys, the only one peers predating handshakes of other sizes support.
+const hostKeyBits = 4096
+
+// genkeyCommand generates a new host key and writes it PEM encoded in PKCS#8 to a file, as expected by the hostkey
+// config entry. Only RSA keys are generated, since the P2P handshake encrypts with the host key.
+func genkeyCommand(flags *flag.FlagSet, args []string) error {
+	out := flags.String("out", "hostkey.pem", "Path to write the host key to, - for stdout. Existing files are kept")
+	bits := flags.Int("bits", hostKeyBits, "Size of the host key in bits")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	hostKey, err := rsa.GenerateKey(rand.Reader, *bits)
+	if err != nil {
+		return fmt.Errorf("error generating host key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(hostKey)
+	if err != nil {
+		return fmt.Errorf("error encoding host key: %w", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		// never overwrite an existing host key, the identity of the peer would be lost
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	err = pem.Encode(w, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err != nil {
+		return fmt.Errorf("error writing host key: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Generated host key %s\n", hostKeyFingerprint(&hostKey.PublicKey))
+	return nil
+}
+
+// checkconfigCommand loads and validates a config file like the run command, without starting anything.
+func checkconfigCommand(flags *flag.FlagSet, args []string) error {
+	configFilePath, overrides := configFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	var cfg config.Config
+	err := cfg.FromFileWithOverrides(*configFilePath, overrides)
+	if err != nil {
+		return err
+	}
+
+	for _, identity := range append([]*config.Config{&cfg}, cfg.Identities...) {
+		name := identity.Name
+		if name == "" {
+			name = "default"
+		}
+		fmt.Printf("identity %s: P2P %s, API %s, host key %s\n", name,
+			net.JoinHostPort(identity.P2PHostname, strconv.Itoa(identity.P2PPort)), identity.OnionAPIAddress,
+			hostKeyFingerprint(&identity.HostKey.PublicKey))
+	}
+	fmt.Printf("%s: ok\n", *configFilePath)
+	return nil
+}
+
+// pingCommand opens a connection to another peer using the transport of the config, if given, and reports the
+// host key it presented.
+func pingCommand(flags *flag.FlagSet, args []string) error {
+	configFilePath := flags.String("config", "", "Path to config file selecting the transport. Default transport if empty")
+	timeout := flags.Int("timeout", 5, "Max. time in seconds to wait for the connection")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	var cfg config.Config
+	if *configFilePath != "" {
+		err := cfg.FromFile(*configFilePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if addr.Port <= 0 || addr.Port > 65535 {
+		return errors.New("missing port")
+	}
+
+	result, err := onion.Ping(&cfg, addr.IP, uint16(addr.Port), time.Duration(*timeout)*time.Second)
+	if err != nil {
+		return err
+	}
+
+	hostKey := "unknown"
+	if result.HostKey != nil {
+		hostKey = hostKeyFingerprint(result.HostKey)
+	}
+	fmt.Printf("connected to %s in %v, host key %s\n", addr, result.RTT.Round(time.Microsecond), hostKey)
+	return nil
+}
+
+// loadgenCommand soak tests a network by building tunnels from a source peer to the destination peer of the config via
+// their Onion API and sending traffic through them, see package loadgen.
+func loadgenCommand(flags *flag.FlagSet, args []string) error {
+	configFilePath := flags.String("config", "config.conf", "Path to config file of the destination peer")
+	source := flags.String("source", "", "Onion API address of the source peer. The destination peer if empty")
+	tunnels := flags.Int("tunnels", 4, "Number of tunnels to build")
+	pattern := flags.String("pattern", string(loadgen.PatternCBR), "Traffic pattern: cbr, bursty or bidi")
+	rate := flags.Int("rate", 10, "Messages per second sent on each tunnel")
+	burst := flags.Int("burst", 10, "Messages per burst of the bursty pattern")
+	size := flags.Int("size", 256, "Size of each message in bytes")
+	duration := flags.Int("duration", 60, "Time in seconds to send traffic for")
+	drain := flags.Int("drain", 5, "Time in seconds to wait for messages in flight")
+	buildTimeout := flags.Int("build-timeout", 0, "Max. time in seconds to wait for each tunnel. No limit if 0")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	var cfg config.Config
+	err := cfg.FromFile(*configFilePath)
+	if err != nil {
+		return err
+	}
+	if *source == "" {
+		*source = cfg.OnionAPIAddress
+	}
+
+	// peers listening on all addresses are reached via the loopback address
+	addr, err := net.ResolveIPAddr("ip", cfg.P2PHostname)
+	if err != nil {
+		return err
+	}
+	if addr.IP.IsUnspecified() {
+		addr.IP = net.IPv4(127, 0, 0, 1)
+	}
+
+	report, err := loadgen.Run(loadgen.Load{
+		Tunnels:      *tunnels,
+		Pattern:      loadgen.Pattern(*pattern),
+		Rate:         *rate,
+		Burst:        *burst,
+		Size:         *size,
+		Duration:     time.Duration(*duration) * time.Second,
+		Drain:        time.Duration(*drain) * time.Second,
+		BuildTimeout: time.Duration(*buildTimeout) * time.Second,
+		Address:      addr.IP,
+		Port:         uint16(cfg.P2PPort),
+		HostKey:      &cfg.HostKey.PublicKey,
+	}, func() (net.Conn, error) {
+		return net.Dial("tcp", *source)
+	}, func() (net.Conn, error) {
+		return net.Dial("tcp", cfg.OnionAPIAddress)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("tunnels: %d built, %d failed\n", report.Built, report.Failed)
+	for _, direction := range []struct {
+		name  string
+		stats *loadgen.Stats
+	}{{"forward", &report.Forward}, {"backward", &report.Backward}} {
+		stats := direction.stats
+		if stats.Sent == 0 {
+			continue
+		}
+		fmt.Printf("%s: %d sent, %d received, %.2f%% loss, latency p50 %v p90 %v p99 %v, max gap %v\n",
+			direction.name, stats.Sent, stats.Received, 100*stats.Loss(), stats.Percentile(0.5).Round(time.Microsecond),
+			stats.Percentile(0.9).Round(time.Microsecond), stats.Percentile(0.99).Round(time.Microsecond),
+			stats.MaxGap.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// hostKeyFingerprint returns the hex encoded SHA-256 hash of the PKCS#1 encoded public host key, to tell host keys
+// apart at a glance.
+func hostKeyFingerprint(hostKey *rsa.PublicKey) string {
+	hash := sha256.Sum256(x509.MarshalPKCS1PublicKey(hostKey))
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
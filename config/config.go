@@ -3,11 +3,17 @@ package config
 
 import (
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/go-ini/ini"
 )
@@ -15,14 +21,251 @@ import (
 type Config struct {
 	P2PHostname     string
 	P2PPort         int
+	ClientOnly      bool   // whether only tunnels of our own are built, without a P2P listener or relaying for others
+	RelayOnly       bool   // whether only tunnels of others are relayed, without an API listener or tunnels of our own
 	RPSAPIAddress   string // API socket address of the RPS module
+	RPSCacheSize    int    // number of peers prefetched from the RPS module, 0 = no prefetching
+	RPSCacheTTL     int    // time in seconds after which prefetched peers expire
+	MinHostKeyBits  int    // min. size in bits of the host keys of sampled peers
+	MaxHostKeyBits  int    // max. size in bits of the host keys of sampled peers, 0 = unlimited
 	OnionAPIAddress string
 	TunnelLength    int
 	RoundDuration   int
 	BuildTimeout    int
 	APITimeout      int
+	IdleTimeout     int // time in seconds after which tunnels without any traffic are torn down, 0 = never
+	BanDuration     int // time in seconds misbehaving peers are excluded from path selection, 0 = never
+	ReplayWindow    int // time in seconds tunnel creations are checked for replays, 0 = disabled
+	ResumeLifetime  int // time in seconds sessions with hops may be resumed after their handshake, 0 = disabled
+	BuildRetries    int // further attempts to build a tunnel requested by a client through other paths, 0 = none
+	BuildBackoff    int // time in milliseconds before the first retry of a failed build, doubled for each further one
 	Verbosity       int
+	MaxTunnels      int    // max. number of concurrent outgoing tunnels built on behalf of clients, 0 = unlimited
+	MaxSegments     int    // max. number of concurrent incoming tunnel segments, 0 = unlimited
+	MaxLinks        int    // max. number of concurrent links to other peers, 0 = unlimited
+	MaxIdleLinks    int    // max. number of links without any tunnels kept open for reuse, 0 = unlimited
+	LinkIdleTimeout int    // time in seconds links without any tunnels are kept open for reuse, 0 = close immediately
+	MaxLinkTunnels  int    // max. number of tunnels we build over a single link, 0 = unlimited
+	LinkPadding     int    // mean time in milliseconds between padding messages on links, 0 = disabled
+	DedupLinks      bool   // whether duplicate links opened by both peers at the same time are detected and merged
+	BatchDelay      int    // max. time in milliseconds small payloads wait to be packed into a single cell, 0 = disabled
+	CoalesceDelay   int    // max. time in milliseconds data of bulk tunnels is held back to fill cells, 0 = disabled
+	Transport       string // name of the transport used for links to other peers
+	WebSocketPath   string // HTTP path of the WebSocket endpoint if the websocket transport is used
+	SourceAddress   string // local IP address outgoing links are bound to, e.g. on multi-homed hosts, empty = any
+	Proxy           string // URL of the SOCKS5 or HTTP proxy outgoing links are opened through, see ProxySOCKS5
+	StateFile       string // path of the file the tunnels requested by clients are persisted in, empty = disabled
+	ReplayFile      string // path of the file recent tunnel creations are persisted in, see ReplayWindow, empty = disabled
+	ReportFile      string // path of the JSON file the report of the last round is written to, empty = disabled
+	ReliableData    bool   // whether data on outgoing tunnels is retransmitted end-to-end after rebuilds
+	AnnounceRounds  bool   // whether API clients are notified about round boundaries, see api.OnionRound
+	TunnelKeepalive int    // seconds after which idle outgoing tunnels are announced if alive, 0 = disabled
+	AllowPinnedHops bool   // whether API clients may choose the intermediate hops of their tunnels
+	LoopbackTunnels bool   // whether tunnels to ourselves are terminated locally without going through the network
+	ProbeFirstHops  bool   // whether two candidates for the first hop are raced when building tunnels
+	MaxCoverLength  int    // max. number of hops of cover tunnels, drawn at random from TunnelLength on, 0 = TunnelLength
+	CoverMidRound   bool   // whether the cover tunnels are rotated once more at a random time within each round
+	Crypto          string // performs the handshakes and the layered encryption, see CryptoBuiltin and CryptoAuth
+	AuthAPIAddress  string // API socket address of the Onion Auth module, only used with CryptoAuth
+	UseNSE          bool   // whether the network size estimated by the NSE module is used to tune cover traffic and path selection
+	NSEAPIAddress   string // API socket address of the NSE module, only used with UseNSE
 	HostKey         *rsa.PrivateKey
+
+	// Incoming links from other peers, whose connections are set up concurrently, see onion.ListenOnionSocket
+	ListenBacklog    int // max. number of incoming connections set up concurrently, 0 = unlimited
+	MaxIncomingLinks int // max. number of concurrent incoming links, also counted towards MaxLinks, 0 = unlimited
+
+	// Bandwidth used to relay cells for other peers as an intermediate hop, see onion.Router
+	RelayBandwidth  int // max. bytes per second relayed, 0 = unlimited
+	RelayQuota      int // max. MiB relayed per day (UTC), new tunnels are refused once it is used up, 0 = unlimited
+	SegmentCellRate int // max. cells per second relayed for a single tunnel, 0 = unlimited
+	SegmentQuota    int // max. MiB relayed for a single tunnel in total, 0 = unlimited
+
+	// Cipher suites of the built-in layered encryption in order of preference, see CipherSuiteAESCTR
+	CipherSuites []string
+	// Whether the built-in handshakes only encrypt with RSA-OAEP, refusing handshakes of peers only supporting
+	// RSA PKCS #1 v1.5
+	OAEPOnly bool
+
+	// TLS settings of the links to other peers, see TLSConfig
+	TLSMinVersion   string   // min. TLS version, TLSVersion12 or TLSVersion13
+	TLSCipherSuites []string // names of the allowed TLS 1.2 cipher suites, see tls.CipherSuiteName, empty = defaults
+	TLSCurves       []string // key exchange curves in order of preference, see TLSCurveX25519, empty = defaults
+	TLSCertSubject  string   // host name the self-signed certificate is issued for, empty = random
+	TLSCertValidity int      // validity period in days of the self-signed certificate, 0 = random
+
+	// Source of time of the onion.Router, whose rounds, timeouts and replay windows rely on a sane clock
+	TimeSource   string // TimeSourceSystem or TimeSourceNTP
+	NTPServer    string // host[:port] of the NTP server the local clock is checked against at startup, empty = no check
+	MaxClockSkew int    // max. tolerated deviation in seconds of the local clock from the NTP server
+
+	// Reachability self-test at startup, in which another peer is asked to connect back to our P2P port
+	ReachabilityCheck      bool
+	ReachabilityHelper     string // host:port of the peer asked to connect back, empty = a random peer of the RPS module
+	ReachabilityClientOnly bool   // whether we stop announcing ourselves via the Gossip module if unreachable
+
+	// Load indicators piggybacked on tunnel creations, see p2p.Load. They leak the traffic of relays and the fact that
+	// initiators are interested in it, thus both are disabled by default.
+	AnnounceLoad   bool // whether we announce our load to the initiators of the tunnels we relay
+	LoadAwarePaths bool // whether we ask the hops of our tunnels for their load and prefer lightly loaded peers
+
+	// Gossip module, via which the liveness of peers is announced and learned, see onion.Router
+	UseGossip        bool
+	GossipAPIAddress string // API socket address of the Gossip module, only used with UseGossip
+
+	// OpenTelemetry tracing of the tunnel lifecycles, see trace.Tracer
+	TraceEndpoint string // URL the spans are exported to via OTLP over HTTP, empty = disabled
+
+	// Exit mode, in which the last hop opens TCP connections on behalf of the tunnel initiator
+	Exit       bool
+	ExitPolicy ExitPolicy
+
+	// Incoming tunnel policy, applied before any onion.Policy given to the onion.Router
+	ExtendDenyNetworks  []*net.IPNet // networks of the peers we refuse to extend tunnels to
+	MaxExtendsPerSource int          // max. number of extends requested by a single previous hop per minute, 0 = unlimited
+
+	// SOCKS5 ingress proxy, disabled if no address is set. Only supported for the primary identity.
+	SOCKSAddress      string
+	SOCKSDestinations map[string]*SOCKSDestination // destination hosts and the onion peers they are mapped to
+
+	// Admin control socket, disabled if no address is set. Only supported for the primary identity.
+	// Either host:port or the path of a Unix domain socket, see AdminNetwork.
+	AdminAddress string
+
+	// HTTP health endpoint for orchestrators, disabled if no address is set. Only supported for the primary identity.
+	HealthAddress string
+
+	// Name of the identity, empty for the primary identity configured in the [onion] section.
+	Name string
+	// Identities are additional onion endpoints with their own host key, P2P port and API address,
+	// configured in [onion.<name>] sections. Only set for the primary identity.
+	Identities []*Config
+}
+
+// PortRange is an inclusive range of TCP ports.
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+// ExitPolicy restricts the destinations an exit opens connections to.
+type ExitPolicy struct {
+	Ports    []PortRange  // allowed destination ports
+	Networks []*net.IPNet // allowed destination networks
+}
+
+// Allows checks whether the exit policy allows connections to the given destination.
+func (policy *ExitPolicy) Allows(ip net.IP, port uint16) bool {
+	portAllowed := false
+	for _, portRange := range policy.Ports {
+		if port >= portRange.From && port <= portRange.To {
+			portAllowed = true
+			break
+		}
+	}
+	if !portAllowed {
+		return false
+	}
+
+	for _, network := range policy.Networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExitPolicy parses an exit policy given as comma separated lists of ports or port ranges (e.g. "80,8000-8080")
+// and networks in CIDR notation.
+func parseExitPolicy(ports, networks []string) (policy ExitPolicy, err error) {
+	for _, port := range ports {
+		bounds := strings.SplitN(port, "-", 2)
+		from, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 16)
+		if err != nil {
+			return policy, fmt.Errorf("invalid port %q", port)
+		}
+		to := from
+		if len(bounds) == 2 {
+			to, err = strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 16)
+			if err != nil || to < from {
+				return policy, fmt.Errorf("invalid port range %q", port)
+			}
+		}
+		policy.Ports = append(policy.Ports, PortRange{From: uint16(from), To: uint16(to)})
+	}
+
+	policy.Networks, err = parseNetworks(networks)
+	return policy, err
+}
+
+// parseNetworks parses a list of networks in CIDR notation.
+func parseNetworks(networks []string) (ipNets []*net.IPNet, err error) {
+	for _, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+const (
+	CryptoBuiltin = "builtin" // Diffie-Hellman handshakes and AES encryption implemented by bawang itself
+	CryptoAuth    = "auth"    // handshakes and encryption delegated to the Onion Auth module
+)
+
+const (
+	CipherSuiteAESCTR           = "aes-ctr"           // AES-256-CTR with running digests, used by legacy peers
+	CipherSuiteAESGCM           = "aes-gcm"           // AES-256-GCM
+	CipherSuiteChaCha20Poly1305 = "chacha20-poly1305" // ChaCha20-Poly1305
+)
+
+const (
+	ProxySOCKS5 = "socks5" // SOCKS5 proxy, optionally with username and password
+	ProxyHTTP   = "http"   // HTTP proxy supporting the CONNECT method, optionally with basic authentication
+)
+
+const (
+	TimeSourceSystem = "system" // the local clock
+	TimeSourceNTP    = "ntp"    // the local clock corrected by its offset from the NTP server measured at startup
+)
+
+const (
+	TLSVersion12 = "1.2" // TLS 1.2 and 1.3, e.g. for peers built with older TLS libraries
+	TLSVersion13 = "1.3" // TLS 1.3 only
+)
+
+const (
+	TLSCurveX25519 = "x25519"
+	TLSCurveP256   = "p256"
+	TLSCurveP384   = "p384"
+	TLSCurveP521   = "p521"
+)
+
+// tlsCurves maps the names of the key exchange curves to their IDs, see TLSCurves.
+var tlsCurves = map[string]tls.CurveID{
+	TLSCurveX25519: tls.X25519,
+	TLSCurveP256:   tls.CurveP256,
+	TLSCurveP384:   tls.CurveP384,
+	TLSCurveP521:   tls.CurveP521,
+}
+
+// tlsCipherSuite looks up a cipher suite considered secure by the TLS library by its name.
+func tlsCipherSuite(name string) (id uint16, ok bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// SOCKSDestination is an onion peer which SOCKS5 proxy connections to a given destination are tunneled to.
+type SOCKSDestination struct {
+	Address net.IP
+	Port    uint16
+	HostKey *rsa.PublicKey
 }
 
 var (
@@ -34,25 +277,351 @@ var (
 
 	errInvalidHostKeyPem = errors.New("invalid PEM entry in host key file")
 	errUnknownKeyType    = errors.New("unknown key type")
+
+	errInvalidConfig = errors.New("invalid config")
 )
 
+// EnvPrefix is the prefix of environment variables overriding config file entries.
+// The entry api_address in the section [onion] is for example overridden by BAWANG_ONION_API_ADDRESS.
+const EnvPrefix = "BAWANG"
+
+// overridableSections are the config file sections whose entries can be overridden.
+var overridableSections = []string{"onion", "rps", "auth", "nse", "admin", "health", "trace"}
+
+// Overrides maps config file entries in the form "section.key" to values taking precedence over the config file.
+// It implements flag.Value and can thus be used to collect overrides given as repeated command-line flags
+// in the form section.key=value.
+type Overrides map[string]string
+
+// String returns the overrides in the form of comma separated section.key=value pairs.
+func (overrides Overrides) String() string {
+	pairs := make([]string, 0, len(overrides))
+	for key, value := range overrides {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Set parses and adds an override given in the form section.key=value.
+func (overrides Overrides) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid override %q, expected section.key=value", s)
+	}
+
+	entry := strings.SplitN(parts[0], ".", 2)
+	if len(entry) != 2 || !isOverridableSection(entry[0]) || entry[1] == "" {
+		return fmt.Errorf("invalid override %q, expected section.key=value with section one of %v",
+			s, overridableSections)
+	}
+
+	overrides[parts[0]] = parts[1]
+	return nil
+}
+
+func isOverridableSection(section string) bool {
+	for _, s := range overridableSections {
+		if s == section {
+			return true
+		}
+	}
+	return false
+}
+
+// envOverrides collects all overrides set via environment variables.
+func envOverrides() Overrides {
+	overrides := Overrides{}
+	for _, env := range os.Environ() {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		for _, section := range overridableSections {
+			prefix := EnvPrefix + "_" + strings.ToUpper(section) + "_"
+			if strings.HasPrefix(parts[0], prefix) && len(parts[0]) > len(prefix) {
+				key := strings.ToLower(strings.TrimPrefix(parts[0], prefix))
+				overrides[section+"."+key] = parts[1]
+			}
+		}
+	}
+	return overrides
+}
+
+// apply sets the overridden entries in the loaded config file.
+func (overrides Overrides) apply(cfg *ini.File) {
+	for entry, value := range overrides {
+		parts := strings.SplitN(entry, ".", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		cfg.Section(parts[0]).Key(parts[1]).SetValue(value)
+	}
+}
+
+// FromFile reads the config from the given config file.
+// Entries can be overridden by environment variables, see EnvPrefix.
 func (config *Config) FromFile(path string) error {
+	return config.FromFileWithOverrides(path, nil)
+}
+
+// FromFileWithOverrides reads the config from the given config file, with entries being overridden by environment
+// variables (see EnvPrefix) and the given Overrides, e.g. from command-line flags.
+// The precedence is: overrides > environment variables > config file > defaults.
+func (config *Config) FromFileWithOverrides(path string, overrides Overrides) error {
 	cfg, err := ini.Load(path)
 	if err != nil {
 		return fmt.Errorf("failed to read config file: %v", err)
 	}
 
+	envOverrides().apply(cfg)
+	overrides.apply(cfg)
+
+	err = config.fromSection(cfg, "onion")
+	if err != nil {
+		return err
+	}
+
+	err = config.socksFromFile(cfg)
+	if err != nil {
+		return err
+	}
+
+	err = config.adminFromFile(cfg)
+	if err != nil {
+		return err
+	}
+
+	config.HealthAddress = cfg.Section("health").Key("listen_address").String()
+	if config.HealthAddress != "" {
+		config.HealthAddress, err = normalizeAddress(config.HealthAddress)
+		if err != nil {
+			return fmt.Errorf("%w: [health] listen_address: %v", errInvalidConfig, err)
+		}
+	}
+
+	// additional identities are given as child sections [onion.<name>] inheriting all entries from [onion]
+	config.Identities = nil
+	for _, section := range cfg.Section("onion").ChildSections() {
+		identity := &Config{
+			Name: strings.TrimPrefix(section.Name(), "onion."),
+		}
+		err = identity.fromSection(cfg, section.Name())
+		if err != nil {
+			return fmt.Errorf("identity %s: %w", identity.Name, err)
+		}
+		config.Identities = append(config.Identities, identity)
+	}
+
+	return config.validateIdentities()
+}
+
+// adminFromFile reads the address of the admin control socket from the [admin] section.
+func (config *Config) adminFromFile(cfg *ini.File) (err error) {
+	config.AdminAddress = cfg.Section("admin").Key("listen_address").String()
+	if config.AdminAddress == "" || config.AdminNetwork() == "unix" {
+		return nil
+	}
+
+	config.AdminAddress, err = normalizeAddress(config.AdminAddress)
+	if err != nil {
+		return fmt.Errorf("%w: [admin] listen_address: %v", errInvalidConfig, err)
+	}
+	return nil
+}
+
+// AdminNetwork returns the network of the admin control socket for net.Listen, "unix" if the address is a path.
+func (config *Config) AdminNetwork() string {
+	if strings.Contains(config.AdminAddress, "/") {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// TLSConfig returns a tls.Config with the TLS settings of the links to other peers, on which the transport sets up the
+// certificates. Without a configured min. version, only TLS 1.3 is allowed. Unknown names are skipped, since they are
+// rejected by Validate.
+func (config *Config) TLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS13,
+	}
+	if config.TLSMinVersion == TLSVersion12 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+	for _, name := range config.TLSCipherSuites {
+		if id, ok := tlsCipherSuite(name); ok {
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+	for _, name := range config.TLSCurves {
+		if curve, ok := tlsCurves[name]; ok {
+			tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, curve)
+		}
+	}
+	return tlsConfig
+}
+
+// socksFromFile reads the config of the SOCKS5 ingress proxy from the [socks] and [socks.destinations] sections.
+// Destinations are given as entries of the form "<destination host> = <P2P address>:<port>, <public host key file>".
+// Requests for a destination host are mapped regardless of the requested port.
+func (config *Config) socksFromFile(cfg *ini.File) error {
+	config.SOCKSAddress = cfg.Section("socks").Key("listen_address").String()
+	config.SOCKSDestinations = make(map[string]*SOCKSDestination)
+	if config.SOCKSAddress == "" {
+		return nil
+	}
+	if config.RelayOnly {
+		return fmt.Errorf("%w: [socks] listen_address can not be used with relay_only, which builds no tunnels",
+			errInvalidConfig)
+	}
+
+	var err error
+	config.SOCKSAddress, err = normalizeAddress(config.SOCKSAddress)
+	if err != nil {
+		return fmt.Errorf("%w: [socks] listen_address: %v", errInvalidConfig, err)
+	}
+
+	for _, key := range cfg.Section("socks.destinations").Keys() {
+		destination, err := parseSOCKSDestination(key.String())
+		if err != nil {
+			return fmt.Errorf("%w: [socks.destinations] %s: %v", errInvalidConfig, key.Name(), err)
+		}
+		config.SOCKSDestinations[strings.ToLower(key.Name())] = destination
+	}
+
+	return nil
+}
+
+func parseSOCKSDestination(value string) (*SOCKSDestination, error) {
+	parts := strings.SplitN(value, ",", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("expected <address>:<port>, <hostkey>")
+	}
+
+	host, port, err := net.SplitHostPort(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", host)
+	}
+	portParsed, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || portParsed == 0 {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+
+	data, err := ioutil.ReadFile(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return nil, fmt.Errorf("could not read host key file: %v", err)
+	}
+	hostKey, err := parsePublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SOCKSDestination{
+		Address: ip,
+		Port:    uint16(portParsed),
+		HostKey: hostKey,
+	}, nil
+}
+
+// fromSection reads the onion config entries from the given config file section.
+func (config *Config) fromSection(cfg *ini.File, section string) (err error) {
+	onion := cfg.Section(section)
 	config.RPSAPIAddress = cfg.Section("rps").Key("api_address").String()
-	config.OnionAPIAddress = cfg.Section("onion").Key("api_address").String()
-	config.P2PHostname = cfg.Section("onion").Key("p2p_hostname").String()
-	config.P2PPort = cfg.Section("onion").Key("p2p_port").MustInt()
-	config.BuildTimeout = cfg.Section("onion").Key("build_timeout").MustInt(10)
-	config.APITimeout = cfg.Section("onion").Key("api_timeout").MustInt(5)
-	config.Verbosity = cfg.Section("onion").Key("verbose").MustInt(0)
-	config.TunnelLength = cfg.Section("onion").Key("tunnel_length").MustInt(3)
-	config.RoundDuration = cfg.Section("onion").Key("round_duration").MustInt(60)
-
-	hostKeyFile := cfg.Section("onion").Key("hostkey").String()
+	config.RPSCacheSize = cfg.Section("rps").Key("cache_size").MustInt(10)
+	config.RPSCacheTTL = cfg.Section("rps").Key("cache_ttl").MustInt(60)
+	config.MinHostKeyBits = cfg.Section("rps").Key("min_host_key_bits").MustInt(2048)
+	config.MaxHostKeyBits = cfg.Section("rps").Key("max_host_key_bits").MustInt(4096)
+	config.OnionAPIAddress = onion.Key("api_address").String()
+	config.P2PHostname = onion.Key("p2p_hostname").String()
+	config.P2PPort = onion.Key("p2p_port").MustInt()
+	config.ClientOnly = onion.Key("client_only").MustBool(false)
+	config.RelayOnly = onion.Key("relay_only").MustBool(false)
+	config.BuildTimeout = onion.Key("build_timeout").MustInt(10)
+	config.BuildRetries = onion.Key("build_retries").MustInt(2)
+	config.BuildBackoff = onion.Key("build_backoff").MustInt(500)
+	config.ProbeFirstHops = onion.Key("probe_first_hops").MustBool(false)
+	config.APITimeout = onion.Key("api_timeout").MustInt(5)
+	config.IdleTimeout = onion.Key("idle_timeout").MustInt(0)
+	config.BanDuration = onion.Key("ban_duration").MustInt(600)
+	config.ReplayWindow = onion.Key("replay_window").MustInt(60)
+	config.ReplayFile = onion.Key("replay_file").String()
+	config.ResumeLifetime = onion.Key("resume_lifetime").MustInt(120)
+	config.Verbosity = onion.Key("verbose").MustInt(0)
+	config.TunnelLength = onion.Key("tunnel_length").MustInt(3)
+	config.RoundDuration = onion.Key("round_duration").MustInt(60)
+	config.MaxTunnels = onion.Key("max_tunnels").MustInt(32)
+	config.MaxSegments = onion.Key("max_incoming_tunnels").MustInt(256)
+	config.MaxLinks = onion.Key("max_links").MustInt(128)
+	config.MaxIdleLinks = onion.Key("max_idle_links").MustInt(16)
+	config.LinkIdleTimeout = onion.Key("link_idle_timeout").MustInt(120)
+	config.ListenBacklog = onion.Key("listen_backlog").MustInt(16)
+	config.MaxIncomingLinks = onion.Key("max_incoming_links").MustInt(64)
+	config.RelayBandwidth = onion.Key("relay_bandwidth").MustInt(0)
+	config.RelayQuota = onion.Key("relay_daily_quota").MustInt(0)
+	config.SegmentCellRate = onion.Key("segment_cell_rate").MustInt(0)
+	config.SegmentQuota = onion.Key("segment_quota").MustInt(0)
+	config.MaxLinkTunnels = onion.Key("max_tunnels_per_link").MustInt(0)
+	config.LinkPadding = onion.Key("link_padding").MustInt(0)
+	config.DedupLinks = onion.Key("dedup_links").MustBool(false)
+	config.BatchDelay = onion.Key("batch_delay").MustInt(0)
+	config.CoalesceDelay = onion.Key("coalesce_delay").MustInt(0)
+	config.Transport = onion.Key("transport").MustString("tls")
+	config.WebSocketPath = onion.Key("websocket_path").MustString("/")
+	config.SourceAddress = onion.Key("source_address").String()
+	config.Proxy = onion.Key("proxy").String()
+	config.StateFile = onion.Key("state_file").String()
+	config.ReportFile = onion.Key("round_report_file").String()
+	config.ReliableData = onion.Key("reliable_data").MustBool(false)
+	config.AnnounceRounds = onion.Key("announce_rounds").MustBool(false)
+	config.TunnelKeepalive = onion.Key("tunnel_keepalive").MustInt(0)
+	config.AllowPinnedHops = onion.Key("allow_pinned_hops").MustBool(false)
+	config.LoopbackTunnels = onion.Key("loopback_tunnels").MustBool(false)
+	config.MaxCoverLength = onion.Key("max_cover_tunnel_length").MustInt(0)
+	config.CoverMidRound = onion.Key("rotate_cover_mid_round").MustBool(false)
+	config.Crypto = onion.Key("crypto").MustString(CryptoBuiltin)
+	config.CipherSuites = onion.Key("cipher_suites").Strings(",")
+	if len(config.CipherSuites) == 0 {
+		config.CipherSuites = []string{CipherSuiteChaCha20Poly1305, CipherSuiteAESGCM, CipherSuiteAESCTR}
+	}
+	config.OAEPOnly = onion.Key("oaep_only").MustBool(false)
+	config.TLSMinVersion = onion.Key("tls_min_version").MustString(TLSVersion13)
+	config.TLSCipherSuites = onion.Key("tls_cipher_suites").Strings(",")
+	config.TLSCurves = onion.Key("tls_curves").Strings(",")
+	config.TLSCertSubject = onion.Key("tls_cert_subject").String()
+	config.TLSCertValidity = onion.Key("tls_cert_validity").MustInt(0)
+	config.TimeSource = onion.Key("time_source").MustString(TimeSourceSystem)
+	config.NTPServer = onion.Key("ntp_server").String()
+	config.MaxClockSkew = onion.Key("max_clock_skew").MustInt(5)
+	config.AuthAPIAddress = cfg.Section("auth").Key("api_address").String()
+	config.UseNSE = onion.Key("use_nse").MustBool(false)
+	config.NSEAPIAddress = cfg.Section("nse").Key("api_address").String()
+	config.ReachabilityCheck = onion.Key("reachability_check").MustBool(false)
+	config.ReachabilityHelper = onion.Key("reachability_helper").String()
+	config.ReachabilityClientOnly = onion.Key("reachability_client_only").MustBool(false)
+	config.AnnounceLoad = onion.Key("announce_load").MustBool(false)
+	config.LoadAwarePaths = onion.Key("load_aware_paths").MustBool(false)
+	config.UseGossip = onion.Key("use_gossip").MustBool(false)
+	config.GossipAPIAddress = cfg.Section("gossip").Key("api_address").String()
+	config.TraceEndpoint = cfg.Section("trace").Key("otlp_endpoint").String()
+
+	config.Exit = onion.Key("exit").MustBool(false)
+	config.ExitPolicy, err = parseExitPolicy(
+		onion.Key("exit_ports").Strings(","),
+		onion.Key("exit_networks").Strings(","))
+	if err != nil {
+		return fmt.Errorf("%w: [onion] exit policy: %v", errInvalidConfig, err)
+	}
+
+	config.ExtendDenyNetworks, err = parseNetworks(onion.Key("extend_deny_networks").Strings(","))
+	if err != nil {
+		return fmt.Errorf("%w: [onion] extend_deny_networks: %v", errInvalidConfig, err)
+	}
+	config.MaxExtendsPerSource = onion.Key("max_extends_per_source").MustInt(0)
+
+	hostKeyFile := onion.Key("hostkey").String()
 	if hostKeyFile == "" {
 		return errMissingHostKey
 	}
@@ -71,21 +640,373 @@ func (config *Config) FromFile(path string) error {
 		return errMissingRPSAPIAddress
 	}
 
-	if config.OnionAPIAddress == "" {
+	if config.OnionAPIAddress == "" && !config.RelayOnly {
 		return errMissingOnionAPIAddress
 	}
 
-	if config.P2PHostname == "" {
+	// without a P2P listener, the P2P endpoint is only needed to recognize ourselves, e.g. in paths
+	if config.P2PHostname == "" && !config.ClientOnly {
 		return errMissingHostname
 	}
 
-	if config.P2PPort == 0 {
+	if config.P2PPort == 0 && !config.ClientOnly {
 		return errMissingPort
 	}
 
+	return config.Validate()
+}
+
+// validateIdentities ensures that the additional identities do not share the host key or any endpoint address
+// with each other or the primary identity. Each of them would otherwise fail at startup or be indistinguishable.
+func (config *Config) validateIdentities() error {
+	all := append([]*Config{config}, config.Identities...)
+	for i, a := range all {
+		for _, b := range all[i+1:] {
+			name := b.Name
+			switch {
+			case a.HostKey.N.Cmp(b.HostKey.N) == 0:
+				return fmt.Errorf("%w: identity %s: hostkey is already used by another identity", errInvalidConfig, name)
+			case a.P2PHostname == b.P2PHostname && a.P2PPort == b.P2PPort && a.P2PPort != 0:
+				return fmt.Errorf("%w: identity %s: p2p_port is already used by another identity", errInvalidConfig, name)
+			case a.OnionAPIAddress == b.OnionAPIAddress && a.OnionAPIAddress != "":
+				return fmt.Errorf("%w: identity %s: api_address is already used by another identity", errInvalidConfig, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks the config for invalid values and inconsistencies between fields, which would otherwise only
+// surface at runtime. Addresses are normalized to their canonical form.
+// All returned errors wrap errInvalidConfig and name the offending config file entries.
+func (config *Config) Validate() error {
+	if config.HostKey == nil {
+		return errMissingHostKey
+	}
+
+	if config.P2PHostname == "" && !config.ClientOnly {
+		return errMissingHostname
+	}
+	if ip := net.ParseIP(config.P2PHostname); ip != nil {
+		config.P2PHostname = ip.String()
+	}
+
+	if (config.P2PPort < 1 && !config.ClientOnly) || config.P2PPort < 0 || config.P2PPort > 65535 {
+		return fmt.Errorf("%w: [onion] p2p_port must be in the range 1-65535, got %d", errInvalidConfig, config.P2PPort)
+	}
+
+	if config.ClientOnly && (config.ReachabilityCheck || config.DedupLinks) {
+		return fmt.Errorf("%w: [onion] reachability_check and dedup_links require the P2P listener disabled by client_only",
+			errInvalidConfig)
+	}
+
+	if config.ClientOnly && config.AnnounceLoad {
+		return fmt.Errorf("%w: [onion] announce_load requires relaying tunnels, which client_only disables",
+			errInvalidConfig)
+	}
+
+	if config.ClientOnly && config.RelayOnly {
+		return fmt.Errorf("%w: [onion] client_only and relay_only are mutually exclusive", errInvalidConfig)
+	}
+
+	var err error
+	if config.OnionAPIAddress != "" || !config.RelayOnly {
+		config.OnionAPIAddress, err = normalizeAddress(config.OnionAPIAddress)
+		if err != nil {
+			return fmt.Errorf("%w: [onion] api_address: %v", errInvalidConfig, err)
+		}
+	}
+
+	config.RPSAPIAddress, err = normalizeAddress(config.RPSAPIAddress)
+	if err != nil {
+		return fmt.Errorf("%w: [rps] api_address: %v", errInvalidConfig, err)
+	}
+
+	switch config.Crypto {
+	case "", CryptoBuiltin:
+	case CryptoAuth:
+		config.AuthAPIAddress, err = normalizeAddress(config.AuthAPIAddress)
+		if err != nil {
+			return fmt.Errorf("%w: [auth] api_address: %v", errInvalidConfig, err)
+		}
+	default:
+		return fmt.Errorf("%w: [onion] crypto must be %s or %s, got %q",
+			errInvalidConfig, CryptoBuiltin, CryptoAuth, config.Crypto)
+	}
+
+	switch config.TimeSource {
+	case "", TimeSourceSystem:
+	case TimeSourceNTP:
+		if config.NTPServer == "" {
+			return fmt.Errorf("%w: [onion] time_source %s requires an ntp_server", errInvalidConfig, TimeSourceNTP)
+		}
+	default:
+		return fmt.Errorf("%w: [onion] time_source must be %s or %s, got %q",
+			errInvalidConfig, TimeSourceSystem, TimeSourceNTP, config.TimeSource)
+	}
+
+	if config.NTPServer != "" && config.MaxClockSkew <= 0 {
+		return fmt.Errorf("%w: [onion] max_clock_skew must be positive, got %d", errInvalidConfig, config.MaxClockSkew)
+	}
+
+	for _, suite := range config.CipherSuites {
+		switch suite {
+		case CipherSuiteAESCTR, CipherSuiteAESGCM, CipherSuiteChaCha20Poly1305:
+		default:
+			return fmt.Errorf("%w: [onion] cipher_suites must only contain %s, %s or %s, got %q",
+				errInvalidConfig, CipherSuiteAESCTR, CipherSuiteAESGCM, CipherSuiteChaCha20Poly1305, suite)
+		}
+	}
+
+	err = config.validateTLS()
+	if err != nil {
+		return err
+	}
+
+	if config.SourceAddress != "" {
+		ip := net.ParseIP(config.SourceAddress)
+		if ip == nil {
+			return fmt.Errorf("%w: [onion] source_address must be an IP address, got %q", errInvalidConfig,
+				config.SourceAddress)
+		}
+		config.SourceAddress = ip.String()
+	}
+
+	if config.Proxy != "" {
+		proxy, err := url.Parse(config.Proxy)
+		if err != nil || (proxy.Scheme != ProxySOCKS5 && proxy.Scheme != ProxyHTTP) || proxy.Port() == "" {
+			return fmt.Errorf("%w: [onion] proxy must be a %s:// or %s:// URL with host and port, got %q",
+				errInvalidConfig, ProxySOCKS5, ProxyHTTP, config.Proxy)
+		}
+	}
+
+	if config.UseNSE {
+		config.NSEAPIAddress, err = normalizeAddress(config.NSEAPIAddress)
+		if err != nil {
+			return fmt.Errorf("%w: [nse] api_address: %v", errInvalidConfig, err)
+		}
+	}
+
+	if config.ReachabilityHelper != "" {
+		config.ReachabilityHelper, err = normalizeAddress(config.ReachabilityHelper)
+		if err != nil {
+			return fmt.Errorf("%w: [onion] reachability_helper: %v", errInvalidConfig, err)
+		}
+	}
+
+	if config.UseGossip {
+		config.GossipAPIAddress, err = normalizeAddress(config.GossipAPIAddress)
+		if err != nil {
+			return fmt.Errorf("%w: [gossip] api_address: %v", errInvalidConfig, err)
+		}
+	}
+
+	if config.TraceEndpoint != "" {
+		endpoint, err := url.Parse(config.TraceEndpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return fmt.Errorf("%w: [trace] otlp_endpoint must be an HTTP or HTTPS URL, got %q", errInvalidConfig,
+				config.TraceEndpoint)
+		}
+	}
+
+	if config.TunnelLength < 3 {
+		return fmt.Errorf("%w: [onion] tunnel_length must be at least 3, got %d", errInvalidConfig, config.TunnelLength)
+	}
+
+	if config.MaxCoverLength != 0 && config.MaxCoverLength < config.TunnelLength {
+		return fmt.Errorf("%w: [onion] max_cover_tunnel_length must not be less than tunnel_length (%d), got %d",
+			errInvalidConfig, config.TunnelLength, config.MaxCoverLength)
+	}
+
+	if config.BuildTimeout <= 0 {
+		return fmt.Errorf("%w: [onion] build_timeout must be positive, got %d", errInvalidConfig, config.BuildTimeout)
+	}
+
+	if config.APITimeout <= 0 {
+		return fmt.Errorf("%w: [onion] api_timeout must be positive, got %d", errInvalidConfig, config.APITimeout)
+	}
+
+	if config.BuildRetries < 0 || config.BuildBackoff < 0 {
+		return fmt.Errorf("%w: [onion] build_retries and build_backoff must not be negative", errInvalidConfig)
+	}
+
+	// tunnels are (re-)built at the beginning of each round, which must be completed within the round
+	if config.RoundDuration <= config.BuildTimeout {
+		return fmt.Errorf("%w: [onion] round_duration (%d) must be greater than build_timeout (%d)",
+			errInvalidConfig, config.RoundDuration, config.BuildTimeout)
+	}
+
+	if config.IdleTimeout < 0 {
+		return fmt.Errorf("%w: [onion] idle_timeout must not be negative, got %d", errInvalidConfig, config.IdleTimeout)
+	}
+
+	if config.BanDuration < 0 {
+		return fmt.Errorf("%w: [onion] ban_duration must not be negative, got %d", errInvalidConfig, config.BanDuration)
+	}
+
+	if config.ReplayWindow < 0 {
+		return fmt.Errorf("%w: [onion] replay_window must not be negative, got %d", errInvalidConfig, config.ReplayWindow)
+	}
+
+	if config.ResumeLifetime < 0 {
+		return fmt.Errorf("%w: [onion] resume_lifetime must not be negative, got %d", errInvalidConfig,
+			config.ResumeLifetime)
+	}
+
+	if config.MaxTunnels < 0 || config.MaxSegments < 0 || config.MaxLinks < 0 {
+		return fmt.Errorf("%w: [onion] max_tunnels, max_incoming_tunnels and max_links must not be negative", errInvalidConfig)
+	}
+
+	if config.ListenBacklog < 0 || config.MaxIncomingLinks < 0 {
+		return fmt.Errorf("%w: [onion] listen_backlog and max_incoming_links must not be negative", errInvalidConfig)
+	}
+
+	if config.RelayBandwidth < 0 || config.RelayQuota < 0 {
+		return fmt.Errorf("%w: [onion] relay_bandwidth and relay_daily_quota must not be negative", errInvalidConfig)
+	}
+
+	if config.SegmentCellRate < 0 || config.SegmentQuota < 0 {
+		return fmt.Errorf("%w: [onion] segment_cell_rate and segment_quota must not be negative", errInvalidConfig)
+	}
+
+	if config.MaxExtendsPerSource < 0 {
+		return fmt.Errorf("%w: [onion] max_extends_per_source must not be negative, got %d", errInvalidConfig,
+			config.MaxExtendsPerSource)
+	}
+
+	if config.MaxIdleLinks < 0 || config.LinkIdleTimeout < 0 || config.MaxLinkTunnels < 0 {
+		return fmt.Errorf("%w: [onion] max_idle_links, link_idle_timeout and max_tunnels_per_link must not be negative",
+			errInvalidConfig)
+	}
+
+	if config.LinkPadding < 0 {
+		return fmt.Errorf("%w: [onion] link_padding must not be negative, got %d", errInvalidConfig, config.LinkPadding)
+	}
+
+	if config.BatchDelay < 0 || config.CoalesceDelay < 0 {
+		return fmt.Errorf("%w: [onion] batch_delay and coalesce_delay must not be negative", errInvalidConfig)
+	}
+
+	if config.TunnelKeepalive < 0 {
+		return fmt.Errorf("%w: [onion] tunnel_keepalive must not be negative, got %d", errInvalidConfig,
+			config.TunnelKeepalive)
+	}
+
+	if config.RPSCacheSize < 0 {
+		return fmt.Errorf("%w: [rps] cache_size must not be negative, got %d", errInvalidConfig, config.RPSCacheSize)
+	}
+	if config.RPSCacheSize > 0 && config.RPSCacheTTL <= 0 {
+		return fmt.Errorf("%w: [rps] cache_ttl must be positive, got %d", errInvalidConfig, config.RPSCacheTTL)
+	}
+	if config.MinHostKeyBits < 0 {
+		return fmt.Errorf("%w: [rps] min_host_key_bits must not be negative, got %d", errInvalidConfig,
+			config.MinHostKeyBits)
+	}
+	if config.MaxHostKeyBits < 0 || config.MaxHostKeyBits > 0 && config.MaxHostKeyBits < config.MinHostKeyBits {
+		return fmt.Errorf("%w: [rps] max_host_key_bits must be 0 or at least min_host_key_bits, got %d",
+			errInvalidConfig, config.MaxHostKeyBits)
+	}
+
+	// our own host key must meet the policy we demand from other peers
+	if config.MinHostKeyBits > 0 || config.MaxHostKeyBits > 0 {
+		bits := config.HostKey.N.BitLen()
+		if bits < config.MinHostKeyBits || config.MaxHostKeyBits > 0 && bits > config.MaxHostKeyBits {
+			return fmt.Errorf("%w: [onion] hostkey has %d bits, outside of the sizes allowed by [rps] "+
+				"min_host_key_bits and max_host_key_bits", errInvalidConfig, bits)
+		}
+	}
+
 	return nil
 }
 
+// validateTLS checks the TLS settings of the links to other peers. An empty min. version defaults to TLS 1.3.
+func (config *Config) validateTLS() error {
+	switch config.TLSMinVersion {
+	case "", TLSVersion12, TLSVersion13:
+	default:
+		return fmt.Errorf("%w: [onion] tls_min_version must be %s or %s, got %q",
+			errInvalidConfig, TLSVersion12, TLSVersion13, config.TLSMinVersion)
+	}
+
+	// the cipher suites of TLS 1.3 are not configurable
+	if len(config.TLSCipherSuites) != 0 && config.TLSMinVersion != TLSVersion12 {
+		return fmt.Errorf("%w: [onion] tls_cipher_suites require tls_min_version = %s", errInvalidConfig, TLSVersion12)
+	}
+	for _, name := range config.TLSCipherSuites {
+		if _, ok := tlsCipherSuite(name); !ok {
+			return fmt.Errorf("%w: [onion] tls_cipher_suites contains unknown or insecure cipher suite %q",
+				errInvalidConfig, name)
+		}
+	}
+
+	for _, name := range config.TLSCurves {
+		if _, ok := tlsCurves[name]; !ok {
+			return fmt.Errorf("%w: [onion] tls_curves must only contain %s, %s, %s or %s, got %q",
+				errInvalidConfig, TLSCurveX25519, TLSCurveP256, TLSCurveP384, TLSCurveP521, name)
+		}
+	}
+
+	if config.TLSCertValidity < 0 {
+		return fmt.Errorf("%w: [onion] tls_cert_validity must not be negative, got %d",
+			errInvalidConfig, config.TLSCertValidity)
+	}
+	return nil
+}
+
+// normalizeAddress checks that the given address is of the form host:port with a valid port
+// and returns it in canonical form.
+func normalizeAddress(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+
+	portParsed, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || portParsed == 0 {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+
+	return net.JoinHostPort(host, strconv.FormatUint(portParsed, 10)), nil
+}
+
+// parsePublicKey parses the PEM encoded public host key of another peer.
+// For convenience, private keys are accepted as well.
+func parsePublicKey(data []byte) (key *rsa.PublicKey, err error) {
+	pemBlock, rest := pem.Decode(data)
+	if pemBlock == nil || len(rest) != 0 {
+		return nil, errInvalidHostKeyPem
+	}
+
+	switch pemBlock.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(pemBlock.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hostkey: %v", err)
+		}
+		return key, nil
+	case "PUBLIC KEY":
+		var pubKey interface{}
+		pubKey, err = x509.ParsePKIXPublicKey(pemBlock.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hostkey: %v", err)
+		}
+		if rsaKey, ok := pubKey.(*rsa.PublicKey); ok {
+			return rsaKey, nil
+		}
+		return nil, errors.New("invalid hostkey: hostkey is not an RSA key")
+	default:
+		privKey, err := parseHostKey(data)
+		if err != nil {
+			return nil, err
+		}
+		return &privKey.PublicKey, nil
+	}
+}
+
 func parseHostKey(data []byte) (key *rsa.PrivateKey, err error) {
 	pemBlock, rest := pem.Decode(data)
 	if pemBlock == nil || len(rest) != 0 {
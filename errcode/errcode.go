@@ -0,0 +1,134 @@
+// Package errcode provides the error taxonomy shared by all packages: errors annotated with a Code classifying them
+// and the Module they stem from.
+package errcode
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Code classifies errors independent of the package they stem from. The code of the error a request failed with is
+// reported to API clients in the OnionError message.
+type Code uint16
+
+const (
+	Unknown         Code = iota // the cause of the error is not known
+	InvalidMessage              // a message is malformed or not allowed in the current state
+	InvalidTunnel               // the tunnel does not exist (anymore)
+	Timeout                     // a peer or module did not answer in time
+	NoPeers                     // not enough suitable peers are available to build a tunnel
+	Limit                       // a configured limit was reached
+	MisbehavingPeer             // a peer violated the protocol
+	ConnClosed                  // the connection was closed
+	NotAllowed                  // the request is not allowed, e.g. due to the configuration
+	Unavailable                 // a peer or another module could not be reached
+)
+
+func (code Code) String() string {
+	switch code {
+	case Unknown:
+		return "unknown"
+	case InvalidMessage:
+		return "invalid_message"
+	case InvalidTunnel:
+		return "invalid_tunnel"
+	case Timeout:
+		return "timeout"
+	case NoPeers:
+		return "no_peers"
+	case Limit:
+		return "limit"
+	case MisbehavingPeer:
+		return "misbehaving_peer"
+	case ConnClosed:
+		return "conn_closed"
+	case NotAllowed:
+		return "not_allowed"
+	case Unavailable:
+		return "unavailable"
+	default:
+		return fmt.Sprintf("code_%d", uint16(code))
+	}
+}
+
+// Module is the name of the package an Error stems from.
+type Module string
+
+const (
+	ModuleAPI   Module = "api"
+	ModuleP2P   Module = "p2p"
+	ModuleRPS   Module = "rps"
+	ModuleOnion Module = "onion"
+)
+
+// Error is an error annotated with its Code and the Module it stems from.
+// The errors of the packages are created with New once and compared with errors.Is, errors.As gives access to the
+// annotations of wrapped errors.
+type Error struct {
+	Code      Code
+	Module    Module
+	TunnelID  uint32 // ID of the tunnel the error concerns, 0 if none
+	Retryable bool   // whether the failed operation may succeed when repeated
+	Err       error  // underlying error
+}
+
+// New creates an Error with the given text.
+func New(module Module, code Code, retryable bool, text string) *Error {
+	return &Error{
+		Code:      code,
+		Module:    module,
+		Retryable: retryable,
+		Err:       errors.New(text),
+	}
+}
+
+func (e *Error) Error() string {
+	if e.TunnelID != 0 {
+		return fmt.Sprintf("%v (tunnel %d)", e.Err, e.TunnelID)
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ForTunnel returns a copy of the error concerning the tunnel with the given ID, which still matches e with errors.Is.
+func (e *Error) ForTunnel(tunnelID uint32) *Error {
+	return &Error{
+		Code:      e.Code,
+		Module:    e.Module,
+		TunnelID:  tunnelID,
+		Retryable: e.Retryable,
+		Err:       e,
+	}
+}
+
+// Of returns the code of the given error. Network timeouts are reported as Timeout, other errors which are not
+// annotated with a code as Unknown.
+func Of(err error) Code {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return Timeout
+	}
+	return Unknown
+}
+
+// IsRetryable checks whether the operation failing with the given error may succeed when repeated.
+// Network timeouts are assumed to be temporary.
+func IsRetryable(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Retryable
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
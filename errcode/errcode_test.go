@@ -0,0 +1,64 @@
+package errcode
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestError(t *testing.T) {
+	errTest := New(ModuleAPI, NoPeers, true, "no peers")
+
+	t.Run("annotations", func(t *testing.T) {
+		assert.Equal(t, "no peers", errTest.Error())
+		assert.Equal(t, NoPeers, Of(errTest))
+		assert.True(t, IsRetryable(errTest))
+
+		// wrapped errors keep their annotations
+		wrapped := fmt.Errorf("error sampling peers: %w", errTest)
+		assert.Equal(t, NoPeers, Of(wrapped))
+		assert.True(t, IsRetryable(wrapped))
+		assert.True(t, errors.Is(wrapped, errTest))
+
+		var e *Error
+		require.True(t, errors.As(wrapped, &e))
+		assert.Equal(t, ModuleAPI, e.Module)
+	})
+
+	t.Run("tunnel", func(t *testing.T) {
+		err := errTest.ForTunnel(42)
+		assert.Equal(t, "no peers (tunnel 42)", err.Error())
+		assert.Equal(t, uint32(42), err.TunnelID)
+		assert.Equal(t, NoPeers, Of(err))
+		assert.True(t, errors.Is(err, errTest))
+		assert.Equal(t, uint32(0), errTest.TunnelID)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		err := errors.New("other")
+		assert.Equal(t, Unknown, Of(err))
+		assert.False(t, IsRetryable(err))
+		assert.Equal(t, Unknown, Of(nil))
+	})
+
+	t.Run("network timeout", func(t *testing.T) {
+		conn, _ := net.Pipe()
+		defer conn.Close()
+		require.Nil(t, conn.SetReadDeadline(time.Now()))
+		_, err := conn.Read(make([]byte, 1))
+		require.NotNil(t, err)
+		assert.Equal(t, Timeout, Of(err))
+		assert.True(t, IsRetryable(err))
+	})
+
+	t.Run("names", func(t *testing.T) {
+		assert.Equal(t, "timeout", Timeout.String())
+		assert.Equal(t, "conn_closed", ConnClosed.String())
+		assert.Equal(t, "code_1000", Code(1000).String())
+	})
+}
@@ -0,0 +1,149 @@
+// Package gossip provides a client for the Gossip module, which spreads announcements of the peers in the network.
+package gossip
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"bawang/api"
+	"bawang/config"
+)
+
+// Handler is called for data of a subscribed type received from other peers. Only data deemed valid is spread further
+// by the Gossip module.
+type Handler func(data []byte) (valid bool)
+
+// Gossip announces data to the other peers in the network and passes on the data announced by them.
+type Gossip interface {
+	// Announce spreads the given data of the given type to other peers, at most ttl hops far, 0 = unlimited.
+	Announce(ttl uint8, dataType uint16, data []byte) (err error)
+	// Notify subscribes to data of the given type announced by other peers, which is passed to the handler.
+	Notify(dataType uint16, handler Handler) (err error)
+	Close()
+}
+
+// gossip implements Gossip for the Gossip module's API socket. Notifications are handled by a single goroutine reading
+// from the connection, which answers each of them with the validity returned by the handler.
+type gossip struct {
+	nc net.Conn
+
+	writeLock sync.Mutex // guards msgBuf and writes to nc
+	msgBuf    [api.MaxSize]byte
+
+	lock     sync.Mutex // guards handlers
+	handlers map[uint16]Handler
+}
+
+// New connects to the Gossip module configured in the config.Config.
+func New(cfg *config.Config) (Gossip, error) {
+	if cfg == nil {
+		return nil, errors.New("invalid config")
+	}
+
+	nc, err := net.Dial("tcp", cfg.GossipAPIAddress)
+	if err != nil {
+		return nil, err
+	}
+	return newGossip(nc), nil
+}
+
+// newGossip creates a Gossip client on the given connection and starts handling notifications.
+func newGossip(nc net.Conn) *gossip {
+	g := &gossip{
+		nc:       nc,
+		handlers: make(map[uint16]Handler),
+	}
+	go g.readNotifications()
+	return g
+}
+
+func (g *gossip) Close() {
+	err := g.nc.Close()
+	if err != nil {
+		log.Printf("error closing Gossip API connection %s", err)
+	}
+}
+
+func (g *gossip) Announce(ttl uint8, dataType uint16, data []byte) (err error) {
+	return g.send(&api.GossipAnnounce{
+		TTL:      ttl,
+		DataType: dataType,
+		Data:     data,
+	})
+}
+
+func (g *gossip) Notify(dataType uint16, handler Handler) (err error) {
+	// register the handler first, the module may notify us right after the subscription
+	g.lock.Lock()
+	g.handlers[dataType] = handler
+	g.lock.Unlock()
+
+	return g.send(&api.GossipNotify{DataType: dataType})
+}
+
+// send packs the given message and writes it to the connection.
+func (g *gossip) send(msg api.Message) (err error) {
+	g.writeLock.Lock()
+	defer g.writeLock.Unlock()
+
+	n, err := api.PackMessage(g.msgBuf[:], msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = g.nc.Write(g.msgBuf[:n])
+	return err
+}
+
+// readNotifications passes the notifications received from the Gossip module to the registered handlers and replies
+// with their validity, until the connection is closed.
+func (g *gossip) readNotifications() {
+	rd := bufio.NewReader(g.nc)
+	buf := make([]byte, api.MaxSize)
+	for {
+		var hdr api.Header
+		err := hdr.Read(rd)
+		if err != nil {
+			return
+		}
+		if hdr.Size < api.HeaderSize {
+			log.Print("invalid message received from gossip module")
+			return
+		}
+
+		data := buf[:hdr.Size-api.HeaderSize]
+		_, err = io.ReadFull(rd, data)
+		if err != nil {
+			log.Printf("Error reading message body: %v", err)
+			return
+		}
+
+		if hdr.Type != api.TypeGossipNotification {
+			log.Printf("Unexpected message of type %d received from gossip module", hdr.Type)
+			continue
+		}
+
+		var msg api.GossipNotification
+		err = msg.Parse(data)
+		if err != nil {
+			log.Printf("Error parsing message body: %v", err)
+			continue
+		}
+
+		g.lock.Lock()
+		handler, ok := g.handlers[msg.DataType]
+		g.lock.Unlock()
+
+		// data nobody subscribed to is not spread further
+		valid := ok && handler(msg.Data)
+		err = g.send(&api.GossipValidation{MessageID: msg.MessageID, Valid: valid})
+		if err != nil {
+			log.Printf("Error sending gossip validation: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package gossip
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/api"
+)
+
+// mockModule is the Gossip module's end of the API connection in tests.
+type mockModule struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+func newTestGossip() (*gossip, *mockModule) {
+	connClient, connModule := net.Pipe()
+	return newGossip(connClient), &mockModule{Conn: connModule, rd: bufio.NewReader(connModule)}
+}
+
+// read reads the next message sent by the client and parses it into msg, which must be of the expected type.
+func (m *mockModule) read(t *testing.T, msg api.Message) {
+	var hdr api.Header
+	require.Nil(t, hdr.Read(m.rd))
+	require.Equal(t, msg.Type(), hdr.Type)
+
+	body := make([]byte, hdr.Size-api.HeaderSize)
+	_, err := io.ReadFull(m.rd, body)
+	require.Nil(t, err)
+	require.Nil(t, msg.Parse(body))
+}
+
+// send sends a message to the client.
+func (m *mockModule) send(t *testing.T, msg api.Message) {
+	buf := make([]byte, api.MaxSize)
+	n, err := api.PackMessage(buf, msg)
+	require.Nil(t, err)
+	_, err = m.Write(buf[:n])
+	require.Nil(t, err)
+}
+
+func TestGossipAnnounce(t *testing.T) {
+	g, module := newTestGossip()
+	defer g.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- g.Announce(3, 560, []byte("data"))
+	}()
+
+	msg := api.GossipAnnounce{}
+	module.read(t, &msg)
+	assert.Equal(t, api.GossipAnnounce{TTL: 3, DataType: 560, Data: []byte("data")}, msg)
+	require.Nil(t, <-errs)
+}
+
+func TestGossipNotify(t *testing.T) {
+	g, module := newTestGossip()
+	defer g.Close()
+
+	received := make(chan []byte, 1)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- g.Notify(560, func(data []byte) bool {
+			received <- append([]byte(nil), data...)
+			return string(data) == "valid"
+		})
+	}()
+
+	notifyMsg := api.GossipNotify{}
+	module.read(t, &notifyMsg)
+	assert.Equal(t, uint16(560), notifyMsg.DataType)
+	require.Nil(t, <-errs)
+
+	t.Run("valid", func(t *testing.T) {
+		module.send(t, &api.GossipNotification{MessageID: 1, DataType: 560, Data: []byte("valid")})
+		validation := api.GossipValidation{}
+		module.read(t, &validation)
+		assert.Equal(t, api.GossipValidation{MessageID: 1, Valid: true}, validation)
+		assert.Equal(t, []byte("valid"), <-received)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		module.send(t, &api.GossipNotification{MessageID: 2, DataType: 560, Data: []byte("invalid")})
+		validation := api.GossipValidation{}
+		module.read(t, &validation)
+		assert.Equal(t, api.GossipValidation{MessageID: 2, Valid: false}, validation)
+		assert.Equal(t, []byte("invalid"), <-received)
+	})
+
+	t.Run("not subscribed", func(t *testing.T) {
+		module.send(t, &api.GossipNotification{MessageID: 3, DataType: 650, Data: []byte("valid")})
+		validation := api.GossipValidation{}
+		module.read(t, &validation)
+		assert.Equal(t, api.GossipValidation{MessageID: 3, Valid: false}, validation)
+		assert.Empty(t, received)
+	})
+}
@@ -0,0 +1,133 @@
+// Package health provides an HTTP endpoint reporting the health of the components of the process, such that
+// orchestrators like systemd or Kubernetes can restart unhealthy instances.
+package health
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bawang/config"
+)
+
+// readHeaderTimeout is the max. time to wait for the request of a probe.
+const readHeaderTimeout = 5 * time.Second
+
+// ErrDown is returned by the Check of a Flag which is down.
+var ErrDown = errors.New("down")
+
+// Check returns nil if the checked component is healthy, and the reason why it is not otherwise.
+type Check func() error
+
+// Flag is the state of a component which is either up or down, e.g. a listener. The zero value is down.
+type Flag struct {
+	up int32 // accessed atomically
+}
+
+// Set marks the component as up or down.
+func (f *Flag) Set(up bool) {
+	var v int32
+	if up {
+		v = 1
+	}
+	atomic.StoreInt32(&f.up, v)
+}
+
+// Check returns ErrDown unless the component is up.
+func (f *Flag) Check() error {
+	if atomic.LoadInt32(&f.up) == 0 {
+		return ErrDown
+	}
+	return nil
+}
+
+// namedCheck is a Check with the name it is reported by.
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Handler serves the health endpoint with the registered checks, the liveness probe at /live and the readiness probe
+// at /ready. Both respond with 200 OK if all their checks pass and with 503 Service Unavailable otherwise, listing the
+// result of each check in the order they were added as "<name>: ok" or "<name>: <reason>".
+type Handler struct {
+	lock  sync.RWMutex // guards live and ready
+	live  []namedCheck
+	ready []namedCheck
+}
+
+// AddLiveness adds a check of the liveness probe, which restarts the process if it fails. The checks of the liveness
+// probe are part of the readiness probe as well.
+func (h *Handler) AddLiveness(name string, check Check) {
+	h.lock.Lock()
+	h.live = append(h.live, namedCheck{name: name, check: check})
+	h.lock.Unlock()
+}
+
+// AddReadiness adds a check of the readiness probe only, which is expected to fail while the process starts up.
+func (h *Handler) AddReadiness(name string, check Check) {
+	h.lock.Lock()
+	h.ready = append(h.ready, namedCheck{name: name, check: check})
+	h.lock.Unlock()
+}
+
+// ServeHTTP runs the checks of the requested probe.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.lock.RLock()
+	checks := append([]namedCheck(nil), h.live...)
+	switch req.URL.Path {
+	case "/live":
+	case "/ready":
+		checks = append(checks, h.ready...)
+	default:
+		h.lock.RUnlock()
+		http.NotFound(w, req)
+		return
+	}
+	h.lock.RUnlock()
+
+	status := http.StatusOK
+	results := make([]string, len(checks))
+	for i, c := range checks {
+		results[i] = c.name + ": ok"
+		if err := c.check(); err != nil {
+			results[i] = c.name + ": " + err.Error()
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	for _, result := range results {
+		_, _ = fmt.Fprintln(w, result)
+	}
+}
+
+// ListenHealthSocket serves the health endpoint on the address configured in cfg until quit is closed.
+func ListenHealthSocket(cfg *config.Config, handler *Handler, quit chan struct{}) error {
+	ln, err := net.Listen("tcp", cfg.HealthAddress)
+	if err != nil {
+		return err
+	}
+	log.Printf("Health Endpoint Listening at %v\n", cfg.HealthAddress)
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+	go func() {
+		<-quit
+		server.Close()
+	}()
+
+	err = server.Serve(ln)
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
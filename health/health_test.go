@@ -0,0 +1,63 @@
+package health
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlag(t *testing.T) {
+	var f Flag
+	assert.Equal(t, ErrDown, f.Check())
+	f.Set(true)
+	assert.Nil(t, f.Check())
+	f.Set(false)
+	assert.Equal(t, ErrDown, f.Check())
+}
+
+func TestHandler(t *testing.T) {
+	var listener, round Flag
+	handler := &Handler{}
+	handler.AddLiveness("p2p", listener.Check)
+	handler.AddReadiness("round", round.Check)
+	handler.AddLiveness("rps", func() error { return nil })
+
+	probe := func(path string) (status int, body string) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		data, err := ioutil.ReadAll(rec.Result().Body)
+		require.Nil(t, err)
+		return rec.Code, string(data)
+	}
+
+	status, body := probe("/live")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "p2p: down\nrps: ok\n", body)
+
+	listener.Set(true)
+	status, body = probe("/live")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "p2p: ok\nrps: ok\n", body)
+
+	// the readiness probe fails until the first round completed
+	status, body = probe("/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "p2p: ok\nrps: ok\nround: down\n", body)
+
+	round.Set(true)
+	status, _ = probe("/ready")
+	assert.Equal(t, http.StatusOK, status)
+
+	handler.AddLiveness("api", func() error { return errors.New("closed") })
+	status, body = probe("/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "p2p: ok\nrps: ok\napi: closed\nround: ok\n", body)
+
+	status, _ = probe("/")
+	assert.Equal(t, http.StatusNotFound, status)
+}
@@ -0,0 +1,375 @@
+// Command wiregen generates the wire marshaling of the messages declared in a Go file, i.e. their Parse, PackedSize
+// and Pack methods, along with a round-trip test of every generated message. It is run via go:generate:
+//
+//	//go:generate go run bawang/internal/wiregen
+//
+// The code is written to <file>_wire.go and the tests to <file>_wire_test.go. Every struct of the file with wire tags
+// is generated. The fields are packed in the order of their declaration, the tag of each field gives its encoding:
+//
+//	uint8, uint16, uint32, uint64  integer in network byte order, the field may be of a named integer type
+//	bytes                          all remaining bytes, only allowed for the last field
+//	-                              not packed
+//
+// The option reserved=N, e.g. `wire:"uint8,reserved=3"`, appends N zero bytes to the field, which are ignored when
+// parsing. Messages without a trailing bytes field must have their exact size, unless -lenient is given, which ignores
+// any further bytes. The methods return the ErrInvalidMessage and ErrBufferTooSmall errors of the package.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// sizes are the packed sizes of the field encodings, bytes fields take all remaining bytes.
+var sizes = map[string]int{
+	"uint8":  1,
+	"uint16": 2,
+	"uint32": 4,
+	"uint64": 8,
+	"bytes":  0,
+}
+
+// field is a packed field of a message.
+type field struct {
+	name     string
+	typ      string // Go type of the field
+	kind     string // encoding of the field, see sizes
+	reserved int    // number of zero bytes following the field
+}
+
+// converted returns expr converted from the Go type of the field to its encoding, or the other way round with
+// toField.
+func (f *field) converted(expr string, toField bool) string {
+	if f.typ == f.kind || f.kind == "uint8" && f.typ == "byte" {
+		return expr
+	}
+	if toField {
+		return f.typ + "(" + expr + ")"
+	}
+	return f.kind + "(" + expr + ")"
+}
+
+// message is a struct with wire tags.
+type message struct {
+	name   string
+	fields []field
+}
+
+// minSize returns the packed size of the message without the trailing bytes.
+func (m *message) minSize() (n int) {
+	for _, f := range m.fields {
+		n += sizes[f.kind] + f.reserved
+	}
+	return n
+}
+
+// trailing returns the trailing bytes field of the message, nil if it has a fixed size.
+func (m *message) trailing() *field {
+	if len(m.fields) == 0 || m.fields[len(m.fields)-1].kind != "bytes" {
+		return nil
+	}
+	return &m.fields[len(m.fields)-1]
+}
+
+// usesBinary returns whether the message has any field requiring encoding/binary.
+func (m *message) usesBinary() bool {
+	for _, f := range m.fields {
+		if sizes[f.kind] > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("wiregen: ")
+	lenient := flag.Bool("lenient", false, "ignore the bytes following fixed size messages when parsing")
+	flag.Parse()
+
+	filename := os.Getenv("GOFILE")
+	if flag.NArg() > 0 {
+		filename = flag.Arg(0)
+	}
+	if filename == "" {
+		log.Fatal("no input file, run via go:generate or pass the file as argument")
+	}
+
+	code, test, err := generate(filename, nil, *lenient)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out := strings.TrimSuffix(filename, ".go") + "_wire.go"
+	if err = ioutil.WriteFile(out, code, 0644); err != nil {
+		log.Fatal(err)
+	}
+	if err = ioutil.WriteFile(strings.TrimSuffix(out, ".go")+"_test.go", test, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// generate returns the formatted marshaling code and tests of the messages declared in the given file. The source is
+// read from the file if src is nil, see parser.ParseFile.
+func generate(filename string, src interface{}, lenient bool) (code, test []byte, err error) {
+	file, err := parser.ParseFile(token.NewFileSet(), filename, src, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var messages []*message
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			typeSpec := spec.(*ast.TypeSpec)
+			structType, ok := typeSpec.Type.(*ast.StructType)
+			if !ok {
+				continue
+			}
+			msg, err := parseMessage(typeSpec.Name.Name, structType)
+			if err != nil {
+				return nil, nil, err
+			}
+			if msg != nil {
+				messages = append(messages, msg)
+			}
+		}
+	}
+	if len(messages) == 0 {
+		return nil, nil, fmt.Errorf("no struct with wire tags in %s", filename)
+	}
+
+	header := fmt.Sprintf("// Code generated by wiregen from %s. DO NOT EDIT.\n\npackage %s\n\n",
+		filepath.Base(filename), file.Name.Name)
+
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	writeCode(&buf, messages, lenient)
+	code, err = format.Source(buf.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buf.Reset()
+	buf.WriteString(header)
+	writeTests(&buf, messages)
+	test, err = format.Source(buf.Bytes())
+	return code, test, err
+}
+
+// parseMessage returns the message of a struct, nil if it has no wire tags.
+func parseMessage(name string, structType *ast.StructType) (*message, error) {
+	msg := &message{name: name}
+	tagged := false
+	untagged := ""
+	for _, f := range structType.Fields.List {
+		tag, ok := "", false
+		if f.Tag != nil {
+			value, err := strconv.Unquote(f.Tag.Value)
+			if err != nil {
+				return nil, err
+			}
+			tag, ok = reflect.StructTag(value).Lookup("wire")
+		}
+		if !ok {
+			untagged = types.ExprString(f.Type)
+			if len(f.Names) > 0 {
+				untagged = f.Names[0].Name
+			}
+			continue
+		}
+
+		tagged = true
+		if tag == "-" {
+			continue
+		}
+		if len(f.Names) == 0 {
+			return nil, fmt.Errorf("%s: embedded field %s can not be packed", name, types.ExprString(f.Type))
+		}
+
+		options := strings.Split(tag, ",")
+		packed := field{typ: types.ExprString(f.Type), kind: options[0]}
+		if _, ok := sizes[packed.kind]; !ok {
+			return nil, fmt.Errorf("%s: unknown encoding %q", name, packed.kind)
+		}
+		if packed.kind == "bytes" && packed.typ != "[]byte" {
+			return nil, fmt.Errorf("%s: bytes field %s must be of type []byte", name, f.Names[0].Name)
+		}
+		for _, option := range options[1:] {
+			if !strings.HasPrefix(option, "reserved=") {
+				return nil, fmt.Errorf("%s: unknown option %q", name, option)
+			}
+			n, err := strconv.Atoi(strings.TrimPrefix(option, "reserved="))
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("%s: invalid option %q", name, option)
+			}
+			packed.reserved = n
+		}
+
+		for _, ident := range f.Names {
+			packed.name = ident.Name
+			msg.fields = append(msg.fields, packed)
+		}
+	}
+
+	if !tagged {
+		return nil, nil
+	}
+	if untagged != "" {
+		return nil, fmt.Errorf("%s: field %s has no wire tag", name, untagged)
+	}
+	if len(msg.fields) == 0 {
+		return nil, errors.New(name + ": no field is packed")
+	}
+	for i, f := range msg.fields {
+		if f.kind == "bytes" && (i != len(msg.fields)-1 || f.reserved > 0) {
+			return nil, errors.New(name + ": bytes field must be the last one, without reserved bytes")
+		}
+	}
+	return msg, nil
+}
+
+// slice returns the expression of the given byte slice from the given offset on.
+func slice(name string, offset int) string {
+	if offset == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s[%d:]", name, offset)
+}
+
+// writeCode writes the Parse, PackedSize and Pack methods of the messages.
+func writeCode(buf *bytes.Buffer, messages []*message, lenient bool) {
+	for _, msg := range messages {
+		if msg.usesBinary() {
+			buf.WriteString("import \"encoding/binary\"\n\n")
+			break
+		}
+	}
+
+	for _, msg := range messages {
+		minSize, trailing := msg.minSize(), msg.trailing()
+
+		fmt.Fprintf(buf, "// Parse fills the struct with values parsed from the given bytes slice.\n")
+		fmt.Fprintf(buf, "func (msg *%s) Parse(data []byte) (err error) {\n", msg.name)
+		switch {
+		case trailing == nil && !lenient:
+			fmt.Fprintf(buf, "if len(data) != %d {\nreturn ErrInvalidMessage\n}\n", minSize)
+		case minSize > 0:
+			fmt.Fprintf(buf, "if len(data) < %d {\nreturn ErrInvalidMessage\n}\n", minSize)
+		}
+		offset := 0
+		for i := range msg.fields {
+			f := &msg.fields[i]
+			switch f.kind {
+			case "uint8":
+				fmt.Fprintf(buf, "msg.%s = %s\n", f.name, f.converted(fmt.Sprintf("data[%d]", offset), true))
+			case "bytes":
+				fmt.Fprintf(buf, "msg.%s = make([]byte, len(%s))\n", f.name, slice("data", offset))
+				fmt.Fprintf(buf, "copy(msg.%s, %s)\n", f.name, slice("data", offset))
+			default:
+				parse := fmt.Sprintf("binary.BigEndian.Uint%d(%s)", sizes[f.kind]*8, slice("data", offset))
+				fmt.Fprintf(buf, "msg.%s = %s\n", f.name, f.converted(parse, true))
+			}
+			offset += sizes[f.kind] + f.reserved
+		}
+		fmt.Fprintf(buf, "return nil\n}\n\n")
+
+		fmt.Fprintf(buf, "// PackedSize returns the number of bytes required if serialized to bytes.\n")
+		fmt.Fprintf(buf, "func (msg *%s) PackedSize() (n int) {\n", msg.name)
+		switch {
+		case trailing == nil:
+			fmt.Fprintf(buf, "return %d\n", minSize)
+		case minSize == 0:
+			fmt.Fprintf(buf, "return len(msg.%s)\n", trailing.name)
+		default:
+			fmt.Fprintf(buf, "return %d + len(msg.%s)\n", minSize, trailing.name)
+		}
+		fmt.Fprintf(buf, "}\n\n")
+
+		fmt.Fprintf(buf, "// Pack serializes the values into a bytes slice.\n")
+		fmt.Fprintf(buf, "func (msg *%s) Pack(buf []byte) (n int, err error) {\n", msg.name)
+		fmt.Fprintf(buf, "n = msg.PackedSize()\nif cap(buf) < n {\nreturn -1, ErrBufferTooSmall\n}\nbuf = buf[:n]\n")
+		offset = 0
+		for i := range msg.fields {
+			f := &msg.fields[i]
+			switch f.kind {
+			case "uint8":
+				fmt.Fprintf(buf, "buf[%d] = %s\n", offset, f.converted("msg."+f.name, false))
+			case "bytes":
+				fmt.Fprintf(buf, "copy(%s, msg.%s)\n", slice("buf", offset), f.name)
+			default:
+				fmt.Fprintf(buf, "binary.BigEndian.PutUint%d(%s, %s)\n", sizes[f.kind]*8, slice("buf", offset),
+					f.converted("msg."+f.name, false))
+			}
+			offset += sizes[f.kind]
+
+			if f.reserved > 0 {
+				indices := make([]string, f.reserved)
+				zeros := make([]string, f.reserved)
+				for j := range indices {
+					indices[j] = fmt.Sprintf("buf[%d]", offset+j)
+					zeros[j] = "0"
+				}
+				fmt.Fprintf(buf, "%s = %s // reserved\n", strings.Join(indices, ", "), strings.Join(zeros, ", "))
+				offset += f.reserved
+			}
+		}
+		fmt.Fprintf(buf, "return n, nil\n}\n\n")
+	}
+}
+
+// writeTests writes a test of every message, which packs a message with distinct values of all fields, parses it
+// again and checks that too small messages and buffers are rejected.
+func writeTests(buf *bytes.Buffer, messages []*message) {
+	buf.WriteString("import (\n\"testing\"\n\n\"github.com/stretchr/testify/assert\"\n" +
+		"\"github.com/stretchr/testify/require\"\n)\n\n")
+
+	for _, msg := range messages {
+		fmt.Fprintf(buf, "func Test%sWire(t *testing.T) {\n", msg.name)
+		fmt.Fprintf(buf, "msg := &%s{\n", msg.name)
+		next := 1
+		for i := range msg.fields {
+			f := &msg.fields[i]
+			n := sizes[f.kind]
+			if f.kind == "bytes" {
+				n = 3
+			}
+			values := make([]string, n)
+			for j := range values {
+				values[j] = fmt.Sprintf("%02x", next%256)
+				next++
+			}
+			if f.kind == "bytes" {
+				fmt.Fprintf(buf, "%s: []byte{0x%s},\n", f.name, strings.Join(values, ", 0x"))
+			} else {
+				fmt.Fprintf(buf, "%s: %s,\n", f.name, f.converted("0x"+strings.Join(values, ""), true))
+			}
+		}
+		fmt.Fprintf(buf, "}\n")
+		fmt.Fprintf(buf, "buf := make([]byte, msg.PackedSize())\n")
+		fmt.Fprintf(buf, "n, err := msg.Pack(buf)\nrequire.Nil(t, err)\nrequire.Equal(t, len(buf), n)\n\n")
+		fmt.Fprintf(buf, "parsed := &%s{}\nrequire.Nil(t, parsed.Parse(buf))\nassert.Equal(t, msg, parsed)\n\n",
+			msg.name)
+		if minSize := msg.minSize(); minSize > 0 {
+			fmt.Fprintf(buf, "assert.Equal(t, ErrInvalidMessage, parsed.Parse(buf[:%d]))\n", minSize-1)
+		}
+		fmt.Fprintf(buf, "_, err = msg.Pack(make([]byte, n-1))\nassert.Equal(t, ErrBufferTooSmall, err)\n}\n\n")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// updateGolden rewrites the golden files from the generated code instead of verifying it.
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+func TestGenerate(t *testing.T) {
+	code, test, err := generate("testdata/message.go", nil, false)
+	require.Nil(t, err)
+
+	golden := map[string][]byte{
+		"testdata/message_wire.go.golden":      code,
+		"testdata/message_wire_test.go.golden": test,
+	}
+	for path, generated := range golden {
+		if *updateGolden {
+			require.Nil(t, ioutil.WriteFile(path, generated, 0644))
+			continue
+		}
+		expected, err := ioutil.ReadFile(path)
+		require.Nil(t, err)
+		assert.Equal(t, string(expected), string(generated), "%s is outdated, run the tests with -update", path)
+	}
+}
+
+func TestGenerateLenient(t *testing.T) {
+	code, _, err := generate("testdata/message.go", nil, true)
+	require.Nil(t, err)
+
+	// fixed size messages are parsed from longer data, messages with trailing bytes do not change
+	assert.Contains(t, string(code), "if len(data) < 18 {")
+	assert.NotContains(t, string(code), "if len(data) != 18 {")
+	assert.Contains(t, string(code), "if len(data) < 2 {")
+}
+
+func TestGenerateInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		src  string
+		err  string
+	}{
+		{"no tags", "type A struct{ ID uint32 }", "no struct with wire tags"},
+		{"untagged field", "type A struct{ ID uint32 `wire:\"uint32\"`; Flags uint8 }", "field Flags has no wire tag"},
+		{"unknown encoding", "type A struct{ ID uint32 `wire:\"int32\"` }", "unknown encoding"},
+		{"unknown option", "type A struct{ ID uint32 `wire:\"uint32,padding=2\"` }", "unknown option"},
+		{"invalid reserved", "type A struct{ ID uint32 `wire:\"uint32,reserved=0\"` }", "invalid option"},
+		{"bytes type", "type A struct{ Data string `wire:\"bytes\"` }", "must be of type []byte"},
+		{"bytes not last", "type A struct{ Data []byte `wire:\"bytes\"`; ID uint32 `wire:\"uint32\"` }",
+			"must be the last one"},
+		{"embedded", "type A struct{ B `wire:\"uint32\"` }", "embedded field B"},
+		{"nothing packed", "type A struct{ ID uint32 `wire:\"-\"` }", "no field is packed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := generate("invalid.go", []byte("package invalid\n"+tc.src), false)
+			require.NotNil(t, err)
+			assert.Contains(t, err.Error(), tc.err)
+		})
+	}
+}
+
+// TestGenerated checks that the code generated in the repository is up to date with the messages.
+func TestGenerated(t *testing.T) {
+	const directive = "//go:generate go run bawang/internal/wiregen"
+
+	files, err := filepath.Glob("../../*/*.go")
+	require.Nil(t, err)
+	found := 0
+	for _, path := range files {
+		lenient, ok := readDirective(t, path, directive)
+		if !ok {
+			continue
+		}
+		found++
+
+		code, test, err := generate(path, nil, lenient)
+		require.Nil(t, err)
+		out := strings.TrimSuffix(path, ".go") + "_wire.go"
+		for path, generated := range map[string][]byte{out: code, strings.TrimSuffix(out, ".go") + "_test.go": test} {
+			existing, err := ioutil.ReadFile(path)
+			require.Nil(t, err)
+			assert.True(t, bytes.Equal(existing, generated), "%s is outdated, run go generate", path)
+		}
+	}
+	assert.NotZero(t, found)
+}
+
+// readDirective returns whether the file contains the go:generate directive and whether it is given -lenient.
+func readDirective(t *testing.T, path, directive string) (lenient, ok bool) {
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, directive) {
+			return strings.Contains(line, "-lenient"), true
+		}
+	}
+	require.Nil(t, scanner.Err())
+	return false, false
+}
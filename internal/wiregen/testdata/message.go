@@ -0,0 +1,24 @@
+package testdata
+
+// Kind is a named integer type.
+type Kind uint16
+
+// Fixed is a message of a fixed size.
+type Fixed struct {
+	ID       uint32 `wire:"uint32"`
+	Kind     Kind   `wire:"uint16"`
+	Flags    byte   `wire:"uint8,reserved=3"`
+	Counter  uint64 `wire:"uint64"`
+	internal bool   `wire:"-"`
+}
+
+// Payload is a message with trailing bytes.
+type Payload struct {
+	A, B uint8  `wire:"uint8"`
+	Data []byte `wire:"bytes"`
+}
+
+// Untagged is not generated.
+type Untagged struct {
+	ID uint32
+}
@@ -0,0 +1,301 @@
+// Package loadgen soak tests onion routers via their Onion API: It builds tunnels from a source router to a
+// destination router and pushes synthetic traffic through them, reporting the loss, the latency percentiles and the
+// gaps in the received traffic, e.g. while the tunnels are rebuilt at round boundaries, see Run.
+package loadgen
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"bawang/api"
+)
+
+// MinSize is the min. size of the messages, which carry the index of the tunnel they were sent on, their sequence
+// number and the time they were sent.
+const MinSize = 20
+
+var ErrInvalidLoad = errors.New("invalid load")
+
+// Pattern is the pattern of the traffic sent on each tunnel.
+type Pattern string
+
+const (
+	PatternCBR           Pattern = "cbr"    // constant bit rate, the messages are evenly spaced
+	PatternBursty        Pattern = "bursty" // bursts of messages sent back to back, at the same mean rate
+	PatternBidirectional Pattern = "bidi"   // constant bit rate in both directions
+)
+
+// Dialer opens a connection to the Onion API of a router.
+type Dialer func() (net.Conn, error)
+
+// Load describes the traffic generated by Run.
+type Load struct {
+	Tunnels      int           // number of tunnels built from the source to the destination, one per API connection
+	Pattern      Pattern       // pattern of the traffic sent on each tunnel
+	Rate         int           // mean number of messages per second sent on each tunnel in each direction
+	Burst        int           // number of messages sent back to back with PatternBursty
+	Size         int           // size of each message in bytes, at least MinSize
+	Duration     time.Duration // time the traffic is sent once all tunnels are built
+	Drain        time.Duration // time to wait for the messages in flight once the traffic stopped
+	BuildTimeout time.Duration // max. time to wait for each tunnel, which are built at the beginning of the next round
+
+	// P2P endpoint and host key of the destination router
+	Address net.IP
+	Port    uint16
+	HostKey *rsa.PublicKey
+}
+
+// validate checks the load for values Run can not generate traffic for.
+func (load *Load) validate() error {
+	switch {
+	case load.Tunnels < 1:
+		return fmt.Errorf("%w: at least one tunnel is required, got %d", ErrInvalidLoad, load.Tunnels)
+	case load.Pattern != PatternCBR && load.Pattern != PatternBursty && load.Pattern != PatternBidirectional:
+		return fmt.Errorf("%w: unknown pattern %q", ErrInvalidLoad, load.Pattern)
+	case load.Rate < 1:
+		return fmt.Errorf("%w: the rate must be positive, got %d", ErrInvalidLoad, load.Rate)
+	case load.Pattern == PatternBursty && load.Burst < 1:
+		return fmt.Errorf("%w: the burst must be positive, got %d", ErrInvalidLoad, load.Burst)
+	case load.Size < MinSize || load.Size > api.MaxSize-api.HeaderSize-4:
+		return fmt.Errorf("%w: the size must be in the range %d-%d, got %d", ErrInvalidLoad, MinSize,
+			api.MaxSize-api.HeaderSize-4, load.Size)
+	case load.HostKey == nil || load.Address == nil:
+		return fmt.Errorf("%w: missing destination", ErrInvalidLoad)
+	}
+	return nil
+}
+
+// Report of a Run.
+type Report struct {
+	Built    int   // number of tunnels built
+	Failed   int   // number of tunnels which could not be built
+	Forward  Stats // traffic from the source to the destination
+	Backward Stats // traffic from the destination back to the source, only sent with PatternBidirectional
+}
+
+// Run builds the tunnels of the given load through the source router to the destination router and sends the traffic
+// once all of them are built. Each tunnel is requested on its own connection to the source, since each connection
+// waits for its tunnel to be built before handling further requests. The destination is connected to once to receive
+// the incoming tunnels.
+// An error is returned if the load is invalid or the routers can not be connected to. Tunnels failing to build are
+// merely counted in the Report.
+func Run(load Load, source, destination Dialer) (report Report, err error) {
+	if err = load.validate(); err != nil {
+		return report, err
+	}
+
+	nc, err := destination()
+	if err != nil {
+		return report, fmt.Errorf("error connecting to the destination: %w", err)
+	}
+	defer nc.Close()
+	dst := api.NewConnection(nc)
+
+	var forward, backward recorder
+	stop := make(chan struct{})
+	go receiveIncoming(&load, dst, newLockedConn(nc), &forward, &backward, stop)
+
+	// build all tunnels before sending any traffic
+	tunnels := make([]*tunnel, load.Tunnels)
+	var wg sync.WaitGroup
+	for i := range tunnels {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			t, err := buildTunnel(&load, source, uint32(i))
+			if err == nil {
+				tunnels[i] = t
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, t := range tunnels {
+		if t == nil {
+			report.Failed++
+			continue
+		}
+		report.Built++
+		defer t.conn.Terminate() //nolint:errcheck // the load is over
+
+		wg.Add(1)
+		go func(t *tunnel) {
+			defer wg.Done()
+			send(&load, newLockedConn(t.nc), t.id, t.index, load.Pattern == PatternBursty, &forward, stop)
+		}(t)
+		go receive(t.conn, t.id, &backward)
+	}
+
+	time.Sleep(load.Duration)
+	close(stop)
+	wg.Wait()
+	time.Sleep(load.Drain)
+
+	report.Forward = forward.stats()
+	report.Backward = backward.stats()
+	return report, nil
+}
+
+// lockedConn serializes the messages sent on an API connection by multiple goroutines. It packs the messages into its
+// own buffer, such that they can be sent while another api.Connection reads from the same network connection.
+type lockedConn struct {
+	lock sync.Mutex
+	conn *api.Connection
+}
+
+func newLockedConn(nc net.Conn) *lockedConn {
+	return &lockedConn{conn: api.NewConnection(nc)}
+}
+
+func (c *lockedConn) Send(msg api.Message) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.conn.Send(msg)
+}
+
+// tunnel is a tunnel built through the source router.
+type tunnel struct {
+	nc    net.Conn
+	conn  *api.Connection // for reading only
+	id    uint32          // ID of the tunnel known to the source
+	index uint32          // index of the tunnel within the load, sent along with the traffic
+}
+
+// buildTunnel requests a tunnel to the destination on a new connection to the source and waits until it is built.
+func buildTunnel(load *Load, source Dialer, index uint32) (t *tunnel, err error) {
+	nc, err := source()
+	if err != nil {
+		return nil, err
+	}
+	conn := api.NewConnection(nc)
+	defer func() {
+		if err != nil {
+			_ = conn.Terminate()
+		}
+	}()
+
+	address, ipv6 := load.Address.To4(), false
+	if address == nil {
+		address, ipv6 = load.Address.To16(), true
+	}
+	err = conn.Send(&api.OnionTunnelBuild{
+		IPv6:        ipv6,
+		OnionPort:   load.Port,
+		Address:     address,
+		DestHostKey: x509.MarshalPKCS1PublicKey(load.HostKey),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if load.BuildTimeout > 0 {
+		_ = nc.SetReadDeadline(time.Now().Add(load.BuildTimeout))
+	}
+	for {
+		msg, err := conn.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		switch msg := msg.(type) {
+		case *api.OnionTunnelReady:
+			_ = nc.SetReadDeadline(time.Time{})
+			return &tunnel{nc: nc, conn: conn, id: msg.TunnelID, index: index}, nil
+		case *api.OnionError:
+			if msg.RequestType == api.TypeOnionTunnelBuild {
+				return nil, fmt.Errorf("error building tunnel: %v", msg.Code)
+			}
+		default: // e.g. incoming tunnels announced to all clients
+		}
+	}
+}
+
+// sender sends data on a tunnel.
+type sender interface {
+	Send(msg api.Message) error
+}
+
+// send sends messages on the tunnel with the given ID at the rate of the load until stop is closed, either evenly
+// spaced or in bursts. The messages are recorded as sent before sending them, such that messages in flight while the
+// tunnel breaks count as lost.
+func send(load *Load, conn sender, tunnelID, index uint32, bursty bool, rec *recorder, stop chan struct{}) {
+	n := 1
+	interval := time.Second / time.Duration(load.Rate)
+	if bursty {
+		n = load.Burst
+		interval *= time.Duration(load.Burst)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var seq uint64
+	for {
+		for i := 0; i < n; i++ {
+			data := make([]byte, load.Size)
+			binary.BigEndian.PutUint32(data[:4], index)
+			binary.BigEndian.PutUint64(data[4:12], seq)
+			binary.BigEndian.PutUint64(data[12:20], uint64(time.Now().UnixNano()))
+			seq++
+
+			rec.sent()
+			err := conn.Send(&api.OnionTunnelData{TunnelID: tunnelID, Data: data})
+			if err != nil {
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// receive records the data received on the tunnel with the given ID until the connection is closed.
+func receive(conn *api.Connection, tunnelID uint32, rec *recorder) {
+	for {
+		msg, err := conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		if msg, ok := msg.(*api.OnionTunnelData); ok && msg.TunnelID == tunnelID && len(msg.Data) >= MinSize {
+			rec.received(msg.Data, time.Now())
+		}
+	}
+}
+
+// receiveIncoming records the data received on the incoming tunnels at the destination until the connection is
+// closed. With PatternBidirectional, traffic is sent back on each incoming tunnel once the first message told which
+// tunnel of the load it belongs to.
+func receiveIncoming(load *Load, dst *api.Connection, out *lockedConn, forward, backward *recorder,
+	stop chan struct{}) {
+	incoming := make(map[uint32]bool) // whether traffic is sent back yet, by the ID of the incoming tunnels
+	for {
+		msg, err := dst.ReadMsg()
+		if err != nil {
+			return
+		}
+		switch msg := msg.(type) {
+		case *api.OnionTunnelIncoming:
+			incoming[msg.TunnelID] = false
+		case *api.OnionTunnelData:
+			sending, ok := incoming[msg.TunnelID]
+			if !ok || len(msg.Data) < MinSize {
+				continue
+			}
+			forward.received(msg.Data, time.Now())
+			if load.Pattern == PatternBidirectional && !sending {
+				incoming[msg.TunnelID] = true
+				index := binary.BigEndian.Uint32(msg.Data[:4])
+				go send(load, out, msg.TunnelID, index, false, backward, stop)
+			}
+		default: // other tunnels are not part of the load
+		}
+	}
+}
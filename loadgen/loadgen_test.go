@@ -0,0 +1,218 @@
+package loadgen
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/api"
+)
+
+// fakeRouters pass the data of the tunnels built on the source connections to the destination connection and back
+// over in-memory connections, like two routers connected by a perfect network.
+type fakeRouters struct {
+	lock       sync.Mutex
+	dst        net.Conn
+	dstOut     *lockedConn
+	sources    map[uint32]*lockedConn // by the ID of the incoming tunnel at the destination
+	nextID     uint32
+	drop       func(data []byte) bool // drops the data sent by the sources
+	failBuilds bool
+}
+
+func newFakeRouters() *fakeRouters {
+	return &fakeRouters{sources: make(map[uint32]*lockedConn)}
+}
+
+func (r *fakeRouters) dialSource() (net.Conn, error) {
+	local, remote := net.Pipe()
+	go r.serveSource(remote)
+	return local, nil
+}
+
+func (r *fakeRouters) dialDestination() (net.Conn, error) {
+	local, remote := net.Pipe()
+	r.dst, r.dstOut = remote, newLockedConn(remote)
+	go r.serveDestination()
+	return local, nil
+}
+
+// serveSource handles a connection to the source, which builds a single tunnel.
+func (r *fakeRouters) serveSource(nc net.Conn) {
+	conn, out := api.NewConnection(nc), newLockedConn(nc)
+	var tunnelID, incomingID uint32
+	for {
+		msg, err := conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		switch msg := msg.(type) {
+		case *api.OnionTunnelBuild:
+			if r.failBuilds {
+				_ = out.Send(&api.OnionError{RequestType: api.TypeOnionTunnelBuild, Code: api.ErrorNoPeers})
+				continue
+			}
+			r.lock.Lock()
+			r.nextID++
+			tunnelID, incomingID = r.nextID, r.nextID+1000
+			r.sources[incomingID] = out
+			r.lock.Unlock()
+			_ = r.dstOut.Send(&api.OnionTunnelIncoming{TunnelID: incomingID})
+			_ = out.Send(&api.OnionTunnelReady{TunnelID: tunnelID, DestHostKey: msg.DestHostKey})
+		case *api.OnionTunnelData:
+			if msg.TunnelID != tunnelID || r.drop != nil && r.drop(msg.Data) {
+				continue
+			}
+			_ = r.dstOut.Send(&api.OnionTunnelData{TunnelID: incomingID, Data: msg.Data})
+		}
+	}
+}
+
+// serveDestination handles the connection to the destination, passing the data sent back to the sources.
+func (r *fakeRouters) serveDestination() {
+	conn := api.NewConnection(r.dst)
+	for {
+		msg, err := conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		if msg, ok := msg.(*api.OnionTunnelData); ok {
+			r.lock.Lock()
+			conn := r.sources[msg.TunnelID]
+			r.lock.Unlock()
+			_ = conn.Send(&api.OnionTunnelData{TunnelID: msg.TunnelID - 1000, Data: msg.Data})
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	load := Load{
+		Tunnels:  3,
+		Pattern:  PatternCBR,
+		Rate:     100,
+		Burst:    5,
+		Size:     64,
+		Duration: 200 * time.Millisecond,
+		Drain:    50 * time.Millisecond,
+		Address:  net.IPv4(127, 0, 0, 1),
+		Port:     4242,
+		HostKey:  &hostKey.PublicKey,
+	}
+
+	t.Run("cbr", func(t *testing.T) {
+		routers := newFakeRouters()
+		report, err := Run(load, routers.dialSource, routers.dialDestination)
+		require.Nil(t, err)
+		assert.Equal(t, 3, report.Built)
+		assert.Zero(t, report.Failed)
+		assert.GreaterOrEqual(t, report.Forward.Sent, 3*10)
+		assert.Equal(t, report.Forward.Sent, report.Forward.Received)
+		assert.Zero(t, report.Forward.Loss())
+		assert.Len(t, report.Forward.Latencies, report.Forward.Received)
+		assert.True(t, report.Forward.MaxGap < 100*time.Millisecond, report.Forward.MaxGap)
+		assert.Zero(t, report.Backward.Sent)
+	})
+
+	t.Run("bursty", func(t *testing.T) {
+		load := load
+		load.Pattern = PatternBursty
+		routers := newFakeRouters()
+		report, err := Run(load, routers.dialSource, routers.dialDestination)
+		require.Nil(t, err)
+
+		// the bursts are sent at the same mean rate
+		assert.Zero(t, report.Forward.Sent%5)
+		assert.GreaterOrEqual(t, report.Forward.Sent, 3*10)
+		assert.Equal(t, report.Forward.Sent, report.Forward.Received)
+	})
+
+	t.Run("bidirectional", func(t *testing.T) {
+		load := load
+		load.Pattern = PatternBidirectional
+		routers := newFakeRouters()
+		report, err := Run(load, routers.dialSource, routers.dialDestination)
+		require.Nil(t, err)
+		assert.Equal(t, report.Forward.Sent, report.Forward.Received)
+		assert.NotZero(t, report.Backward.Sent)
+		assert.Equal(t, report.Backward.Sent, report.Backward.Received)
+	})
+
+	t.Run("loss", func(t *testing.T) {
+		routers := newFakeRouters()
+		routers.drop = func(data []byte) bool {
+			return binary.BigEndian.Uint64(data[4:12])%2 == 1
+		}
+		report, err := Run(load, routers.dialSource, routers.dialDestination)
+		require.Nil(t, err)
+		assert.InDelta(t, 0.5, report.Forward.Loss(), 0.1)
+	})
+
+	t.Run("failed builds", func(t *testing.T) {
+		routers := newFakeRouters()
+		routers.failBuilds = true
+		report, err := Run(load, routers.dialSource, routers.dialDestination)
+		require.Nil(t, err)
+		assert.Zero(t, report.Built)
+		assert.Equal(t, 3, report.Failed)
+		assert.Zero(t, report.Forward.Sent)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, modify := range []func(load *Load){
+			func(load *Load) { load.Tunnels = 0 },
+			func(load *Load) { load.Pattern = "poisson" },
+			func(load *Load) { load.Rate = 0 },
+			func(load *Load) { load.Pattern, load.Burst = PatternBursty, 0 },
+			func(load *Load) { load.Size = MinSize - 1 },
+			func(load *Load) { load.HostKey = nil },
+		} {
+			load := load
+			modify(&load)
+			_, err := Run(load, nil, nil)
+			assert.True(t, errors.Is(err, ErrInvalidLoad), err)
+		}
+	})
+}
+
+func TestStats(t *testing.T) {
+	var rec recorder
+	start := time.Unix(1000000, 0)
+	message := func(index uint32, sentAt time.Time) []byte {
+		data := make([]byte, MinSize)
+		binary.BigEndian.PutUint32(data[:4], index)
+		binary.BigEndian.PutUint64(data[12:20], uint64(sentAt.UnixNano()))
+		return data
+	}
+	for i := 0; i < 4; i++ {
+		rec.sent()
+	}
+	rec.received(message(0, start), start.Add(30*time.Millisecond))
+	rec.received(message(1, start), start.Add(10*time.Millisecond))
+	rec.received(message(0, start.Add(time.Second)), start.Add(time.Second+20*time.Millisecond))
+
+	stats := rec.stats()
+	assert.Equal(t, 4, stats.Sent)
+	assert.Equal(t, 3, stats.Received)
+	assert.Equal(t, 0.25, stats.Loss())
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond},
+		stats.Latencies)
+	assert.Equal(t, 20*time.Millisecond, stats.Percentile(0.5))
+	assert.Equal(t, 30*time.Millisecond, stats.Percentile(0.99))
+	assert.Equal(t, 10*time.Millisecond, stats.Percentile(0))
+
+	// the gaps are measured per tunnel
+	assert.Equal(t, 990*time.Millisecond, stats.MaxGap)
+
+	assert.Zero(t, (&Stats{}).Percentile(0.5))
+	assert.Zero(t, (&Stats{}).Loss())
+}
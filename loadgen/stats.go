@@ -0,0 +1,94 @@
+package loadgen
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Stats of the traffic sent in one direction.
+type Stats struct {
+	Sent      int
+	Received  int
+	Latencies []time.Duration // one-way latency of each received message in ascending order
+	MaxGap    time.Duration   // longest time between two messages received on the same tunnel, e.g. while rebuilt
+}
+
+// Loss returns the share of the sent messages which were not received, between 0 and 1.
+func (s *Stats) Loss() float64 {
+	if s.Sent == 0 || s.Received >= s.Sent {
+		return 0
+	}
+	return float64(s.Sent-s.Received) / float64(s.Sent)
+}
+
+// Percentile returns the latency not exceeded by the given share of the received messages, e.g. 0.99 for the 99th
+// percentile, or 0 if no message was received.
+func (s *Stats) Percentile(p float64) time.Duration {
+	if len(s.Latencies) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(s.Latencies)))) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(s.Latencies) {
+		i = len(s.Latencies) - 1
+	}
+	return s.Latencies[i]
+}
+
+// recorder records the traffic sent in one direction. The zero value is ready to use.
+// It is safe for concurrent use.
+type recorder struct {
+	lock         sync.Mutex
+	numSent      int
+	numReceived  int
+	latencies    []time.Duration
+	lastReceived map[uint32]time.Time // by the index of the tunnel
+	maxGap       time.Duration
+}
+
+// sent records a message as sent.
+func (r *recorder) sent() {
+	r.lock.Lock()
+	r.numSent++
+	r.lock.Unlock()
+}
+
+// received records a message received at the given time, see send for its format.
+func (r *recorder) received(data []byte, now time.Time) {
+	index := binary.BigEndian.Uint32(data[:4])
+	sentAt := time.Unix(0, int64(binary.BigEndian.Uint64(data[12:20])))
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.numReceived++
+	r.latencies = append(r.latencies, now.Sub(sentAt))
+	if r.lastReceived == nil {
+		r.lastReceived = make(map[uint32]time.Time)
+	}
+	if last, ok := r.lastReceived[index]; ok && now.Sub(last) > r.maxGap {
+		r.maxGap = now.Sub(last)
+	}
+	r.lastReceived[index] = now
+}
+
+// stats returns the stats of the traffic recorded so far.
+func (r *recorder) stats() Stats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	latencies := append([]time.Duration(nil), r.latencies...)
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	return Stats{
+		Sent:      r.numSent,
+		Received:  r.numReceived,
+		Latencies: latencies,
+		MaxGap:    r.maxGap,
+	}
+}
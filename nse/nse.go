@@ -0,0 +1,119 @@
+// Package nse provides a client for the NSE module, which estimates the number of peers in the network.
+package nse
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"bawang/api"
+	"bawang/config"
+)
+
+// Estimate is the NSE module's estimate of the number of peers in the network.
+type Estimate struct {
+	Peers        uint32 // estimated number of peers
+	StdDeviation uint32 // standard deviation of the estimate
+}
+
+// NSE queries the current estimate of the network size.
+type NSE interface {
+	Estimate() (estimate Estimate, err error)
+	Close()
+}
+
+type nse struct {
+	timeout time.Duration
+
+	l      sync.Mutex // guards fields below
+	msgBuf [api.MaxSize]byte
+	nc     net.Conn
+	rd     *bufio.Reader
+}
+
+// New connects to the NSE module configured in the config.Config.
+func New(cfg *config.Config) (NSE, error) {
+	if cfg == nil {
+		return nil, errors.New("invalid config")
+	}
+
+	nc, err := net.Dial("tcp", cfg.NSEAPIAddress)
+	if err != nil {
+		return nil, err
+	}
+	return newNSE(nc, time.Duration(cfg.APITimeout)*time.Second), nil
+}
+
+// newNSE creates an NSE client sending queries on the given connection and waiting for the replies until the timeout.
+func newNSE(nc net.Conn, timeout time.Duration) *nse {
+	return &nse{
+		timeout: timeout,
+		nc:      nc,
+		rd:      bufio.NewReader(nc),
+	}
+}
+
+func (n *nse) Close() {
+	err := n.nc.Close()
+	if err != nil {
+		log.Printf("error closing NSE API connection %s", err)
+	}
+}
+
+func (n *nse) Estimate() (estimate Estimate, err error) {
+	// concurrent IO not such a great idea
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	// send query
+	var query api.NSEQuery
+	data := n.msgBuf[:]
+	size, err := api.PackMessage(data, &query)
+	if err != nil {
+		return estimate, err
+	}
+
+	_, err = n.nc.Write(data[:size])
+	if err != nil {
+		return estimate, err
+	}
+
+	// read reply
+	err = n.nc.SetReadDeadline(time.Now().Add(n.timeout))
+	if err != nil {
+		return estimate, err
+	}
+
+	var hdr api.Header
+	err = hdr.Read(n.rd)
+	if err != nil {
+		return estimate, err
+	}
+	if hdr.Type != api.TypeNSEEstimate || hdr.Size < api.HeaderSize {
+		log.Print("invalid message received from nse module")
+		return estimate, api.ErrInvalidMessage
+	}
+
+	data = n.msgBuf[:hdr.Size-api.HeaderSize]
+	_, err = io.ReadFull(n.rd, data)
+	if err != nil {
+		log.Printf("Error reading message body: %v", err)
+		return estimate, err
+	}
+
+	var reply api.NSEEstimate
+	err = reply.Parse(data)
+	if err != nil {
+		log.Printf("Error parsing message body: %v", err)
+		return estimate, err
+	}
+
+	return Estimate{
+		Peers:        reply.EstimatePeers,
+		StdDeviation: reply.EstimateStdDeviation,
+	}, nil
+}
@@ -0,0 +1,71 @@
+package nse
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/api"
+)
+
+// mockModule is the NSE module's end of the API connection in tests, answering each query with the given reply.
+func mockModule(t *testing.T, conn net.Conn, reply api.Message) {
+	rd := bufio.NewReader(conn)
+	var hdr api.Header
+	if err := hdr.Read(rd); err != nil {
+		return
+	}
+	assert.Equal(t, api.TypeNSEQuery, hdr.Type)
+	assert.Equal(t, uint16(api.HeaderSize), hdr.Size)
+
+	buf := make([]byte, api.MaxSize)
+	n, err := api.PackMessage(buf, reply)
+	require.Nil(t, err)
+	_, _ = conn.Write(buf[:n])
+}
+
+func TestEstimate(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		connClient, connModule := net.Pipe()
+		defer connModule.Close()
+		n := newNSE(connClient, time.Second)
+		defer n.Close()
+
+		go mockModule(t, connModule, &api.NSEEstimate{EstimatePeers: 42, EstimateStdDeviation: 3})
+		estimate, err := n.Estimate()
+		require.Nil(t, err)
+		assert.Equal(t, Estimate{Peers: 42, StdDeviation: 3}, estimate)
+	})
+
+	t.Run("unexpected reply", func(t *testing.T) {
+		connClient, connModule := net.Pipe()
+		defer connModule.Close()
+		n := newNSE(connClient, time.Second)
+		defer n.Close()
+
+		go mockModule(t, connModule, &api.RPSQuery{})
+		_, err := n.Estimate()
+		assert.Equal(t, api.ErrInvalidMessage, err)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		connClient, connModule := net.Pipe()
+		defer connModule.Close()
+		n := newNSE(connClient, 10*time.Millisecond)
+		defer n.Close()
+
+		go func() {
+			var hdr api.Header
+			_ = hdr.Read(connModule)
+		}()
+		_, err := n.Estimate()
+		require.NotNil(t, err)
+		netErr, ok := err.(net.Error)
+		require.True(t, ok)
+		assert.True(t, netErr.Timeout())
+	})
+}
@@ -0,0 +1,170 @@
+package onion
+
+import (
+	"sync"
+	"time"
+
+	"bawang/errcode"
+	"bawang/p2p"
+)
+
+var (
+	ErrRelayQuotaExhausted = errcode.New(errcode.ModuleOnion, errcode.Limit, true, "relay quota exhausted")
+	// ErrSegmentQuotaExceeded is returned if an incoming tunnel exceeded the cells relayed per tunnel, see
+	// Config.SegmentCellRate and Config.SegmentQuota.
+	ErrSegmentQuotaExceeded = errcode.New(errcode.ModuleOnion, errcode.Limit, false, "tunnel exceeded its relay quota")
+)
+
+// quotaPeriod is the period the relay quota applies to, starting at midnight UTC.
+const quotaPeriod = 24 * time.Hour
+
+// relayBudget limits the bandwidth used to relay cells for other peers by a token bucket holding up to one second of
+// the configured rate. Cells exceeding it are delayed rather than dropped, such that the tunnels slow down smoothly.
+// Independently, the bytes relayed per quota period are counted. It is safe for concurrent use.
+type relayBudget struct {
+	lock     sync.Mutex
+	tokens   float64   // bytes which may be relayed right away, negative while cells wait for their turn
+	refilled time.Time // time the tokens were last refilled
+	period   time.Time // start of the current quota period
+	used     uint64    // bytes relayed in the current quota period
+}
+
+// reserve accounts n relayed bytes at the given time and returns how long the caller must wait before sending them
+// to keep within rate bytes per second. A rate of 0 means unlimited.
+func (b *relayBudget) reserve(n int, rate int, now time.Time) (delay time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.startPeriod(now)
+	b.used += uint64(n)
+
+	if rate <= 0 {
+		return 0
+	}
+
+	// the first cells may be sent right away, as if the bucket was full
+	if b.refilled.IsZero() {
+		b.tokens = float64(rate)
+	} else if elapsed := now.Sub(b.refilled); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * float64(rate)
+	}
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.refilled = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+}
+
+// exhausted checks whether at least quota bytes were relayed in the quota period containing the given time.
+// A quota of 0 means unlimited.
+func (b *relayBudget) exhausted(quota uint64, now time.Time) bool {
+	if quota == 0 {
+		return false
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.startPeriod(now)
+	return b.used >= quota
+}
+
+// startPeriod resets the relayed bytes once a new quota period started at the given time.
+// Must be called with b.lock hold.
+func (b *relayBudget) startPeriod(now time.Time) {
+	period := now.UTC().Truncate(quotaPeriod)
+	if !period.Equal(b.period) {
+		b.period = period
+		b.used = 0
+	}
+}
+
+// relayQuota returns the configured relay quota in bytes, 0 if unlimited.
+func (r *Router) relayQuota() uint64 {
+	if r.cfg == nil || r.cfg.RelayQuota <= 0 {
+		return 0
+	}
+	return uint64(r.cfg.RelayQuota) << 20
+}
+
+// throttleRelay waits until another cell may be relayed for other peers without exceeding the configured bandwidth.
+// The cell waits before it queues for the link, such that the link's other traffic is not held up meanwhile.
+// Returns false if quit was closed while waiting.
+func (r *Router) throttleRelay(quit chan struct{}) bool {
+	rate := 0
+	if r.cfg != nil {
+		rate = r.cfg.RelayBandwidth
+	}
+
+	delay := r.relay.reserve(p2p.MessageSize, rate, r.clock.Now())
+	if delay <= 0 {
+		return true
+	}
+
+	select {
+	case <-quit:
+		return false
+	case <-r.clock.After(delay):
+		return true
+	}
+}
+
+// hibernating checks whether the relay quota of the current period is used up. Meanwhile, no new tunnel segments are
+// accepted and other peers are asked to avoid us as a hop, see announceLiveness.
+func (r *Router) hibernating() bool {
+	return r.relay.exhausted(r.relayQuota(), r.clock.Now())
+}
+
+// segmentQuota counts the cells relayed for a single incoming tunnel segment in both directions. Unlike relayBudget,
+// cells exceeding it are not delayed, the tunnel segment is torn down instead, such that a peer can not be used to
+// amplify the traffic of a single tunnel initiator. It is only used by the segment's handler and thus not safe for
+// concurrent use.
+type segmentQuota struct {
+	second time.Time // start of the current second
+	cells  int       // cells relayed in the current second
+	bytes  uint64    // bytes relayed in total
+}
+
+// add accounts a relayed cell of n bytes at the given time and checks whether it keeps within rate cells per second
+// and quota bytes in total. A rate or quota of 0 means unlimited.
+func (q *segmentQuota) add(n int, rate int, quota uint64, now time.Time) bool {
+	if now.Sub(q.second) >= time.Second {
+		q.second = now
+		q.cells = 0
+	}
+	q.cells++
+	q.bytes += uint64(n)
+
+	if rate > 0 && q.cells > rate {
+		return false
+	}
+	return quota == 0 || q.bytes <= quota
+}
+
+// chargeSegment accounts a cell relayed for the given incoming tunnel segment. If the tunnel exceeds the configured
+// quota, the tunnel initiator is told with a p2p.RelayTunnelError and ErrSegmentQuotaExceeded is returned, after
+// which the caller must tear down the tunnel segment.
+func (r *Router) chargeSegment(tunnel *tunnelSegment) error {
+	if r.cfg == nil || (r.cfg.SegmentCellRate <= 0 && r.cfg.SegmentQuota <= 0) {
+		return nil
+	}
+
+	var quota uint64
+	if r.cfg.SegmentQuota > 0 {
+		quota = uint64(r.cfg.SegmentQuota) << 20
+	}
+	if tunnel.quota.add(p2p.MessageSize, r.cfg.SegmentCellRate, quota, r.clock.Now()) {
+		return nil
+	}
+
+	err := tunnel.sendRelayToPrevHop(&p2p.RelayTunnelError{Reason: p2p.ErrorReasonQuota})
+	if err != nil {
+		return err
+	}
+	return ErrSegmentQuotaExceeded
+}
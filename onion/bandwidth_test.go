@@ -0,0 +1,149 @@
+package onion
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+)
+
+func TestRelayBudget(t *testing.T) {
+	now := time.Date(2020, 7, 1, 23, 59, 0, 0, time.UTC)
+
+	t.Run("rate", func(t *testing.T) {
+		var b relayBudget
+
+		// a full second of the rate may be sent right away
+		assert.Equal(t, time.Duration(0), b.reserve(500, 1000, now))
+		assert.Equal(t, time.Duration(0), b.reserve(500, 1000, now))
+
+		// further bytes wait for their share of the rate, queueing behind each other
+		assert.Equal(t, 500*time.Millisecond, b.reserve(500, 1000, now))
+		assert.Equal(t, time.Second, b.reserve(500, 1000, now))
+
+		// the bucket refills over time, but never beyond one second of the rate
+		assert.Equal(t, time.Duration(0), b.reserve(1000, 1000, now.Add(3*time.Second)))
+		assert.Equal(t, 250*time.Millisecond, b.reserve(250, 1000, now.Add(3*time.Second)))
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		var b relayBudget
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, time.Duration(0), b.reserve(p2p.MessageSize, 0, now))
+		}
+		assert.False(t, b.exhausted(0, now))
+	})
+
+	t.Run("quota", func(t *testing.T) {
+		var b relayBudget
+		assert.False(t, b.exhausted(1000, now))
+		b.reserve(600, 0, now)
+		assert.False(t, b.exhausted(1000, now))
+		b.reserve(600, 0, now.Add(time.Second))
+		assert.True(t, b.exhausted(1000, now.Add(time.Second)))
+
+		// the quota is reset at midnight UTC
+		assert.True(t, b.exhausted(1000, now.Add(59*time.Second)))
+		assert.False(t, b.exhausted(1000, now.Add(time.Minute)))
+	})
+}
+
+func TestRouterThrottleRelay(t *testing.T) {
+	clock := &instantClock{fakeClock: fakeClock{now: time.Now()}}
+	cfg := &config.Config{RelayBandwidth: 2 * p2p.MessageSize}
+	router := newRouter(cfg, WithRPS(&mockRPS{}), WithClock(clock))
+
+	quit := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		require.True(t, router.throttleRelay(quit))
+	}
+	assert.Equal(t, []time.Duration{500 * time.Millisecond, time.Second}, clock.waited)
+
+	// cells waiting for their turn give up once the tunnel is torn down
+	close(quit)
+	router = newRouter(cfg, WithRPS(&mockRPS{}), WithClock(&fakeClock{now: time.Now()}))
+	require.True(t, router.throttleRelay(quit))
+	require.True(t, router.throttleRelay(quit))
+	assert.False(t, router.throttleRelay(quit))
+}
+
+func TestRouterHibernating(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	router := newRouter(&config.Config{RelayQuota: 1}, WithRPS(&mockRPS{}), WithClock(clock))
+	require.False(t, router.hibernating())
+	require.Nil(t, router.admitSegment())
+	router.releaseSegment()
+
+	for i := 0; i < (1<<20)/p2p.MessageSize; i++ {
+		router.throttleRelay(nil)
+	}
+	require.True(t, router.hibernating())
+	assert.Equal(t, ErrRelayQuotaExhausted, router.admitSegment())
+
+	clock.advance(quotaPeriod)
+	assert.False(t, router.hibernating())
+}
+
+func TestSegmentQuota(t *testing.T) {
+	now := time.Now()
+
+	t.Run("rate", func(t *testing.T) {
+		var q segmentQuota
+		for i := 0; i < 3; i++ {
+			require.True(t, q.add(p2p.MessageSize, 3, 0, now))
+		}
+		assert.False(t, q.add(p2p.MessageSize, 3, 0, now.Add(time.Second/2)))
+
+		// the cells are counted per second
+		assert.True(t, q.add(p2p.MessageSize, 3, 0, now.Add(time.Second)))
+	})
+
+	t.Run("quota", func(t *testing.T) {
+		var q segmentQuota
+		require.True(t, q.add(p2p.MessageSize, 0, 2*p2p.MessageSize, now))
+		require.True(t, q.add(p2p.MessageSize, 0, 2*p2p.MessageSize, now.Add(time.Hour)))
+		assert.False(t, q.add(p2p.MessageSize, 0, 2*p2p.MessageSize, now.Add(2*time.Hour)))
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		var q segmentQuota
+		for i := 0; i < 100; i++ {
+			require.True(t, q.add(p2p.MessageSize, 0, 0, now))
+		}
+	})
+}
+
+func TestRouterChargeSegment(t *testing.T) {
+	router := newRouter(&config.Config{SegmentCellRate: 2}, WithRPS(&mockRPS{}), WithClock(&fakeClock{now: time.Now()}))
+
+	link, connRemote := newPipeLink()
+	tunnel := &tunnelSegment{
+		prevHopTunnelID: 42,
+		prevHopLink:     link,
+		dhShared:        &[32]byte{1, 2, 3},
+	}
+	remote := newInitiatorEnd(connRemote, tunnel)
+	defer remote.Close()
+
+	require.Nil(t, router.chargeSegment(tunnel))
+	require.Nil(t, router.chargeSegment(tunnel))
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- router.chargeSegment(tunnel)
+	}()
+
+	// the initiator is told why the tunnel is dropped
+	hdr, msg := readRelayFromPrevHop(t, remote)
+	require.Equal(t, p2p.RelayTypeTunnelError, hdr.RelayType)
+	errorMsg := p2p.RelayTunnelError{}
+	require.Nil(t, errorMsg.Parse(msg))
+	assert.Equal(t, p2p.ErrorReasonQuota, errorMsg.Reason)
+
+	assert.True(t, errors.Is(<-errChan, ErrSegmentQuotaExceeded))
+}
@@ -0,0 +1,147 @@
+package onion
+
+import (
+	"sync"
+	"time"
+
+	"bawang/p2p"
+)
+
+// maxBatchedSize is the max. size of payloads packed with others into a single cell, larger payloads are sent in a
+// cell of their own right away. Coalesced payloads may fill the whole cell, see batchPolicy.
+const maxBatchedSize = p2p.MaxRelayDataSize / 4
+
+// batchPolicy decides which payloads sent on a tunnel are held back to be packed into a single cell, see
+// Router.sendBatched.
+type batchPolicy struct {
+	delay   time.Duration // max. time payloads are held back, 0 if they are sent right away
+	maxSize int           // max. size of the payloads held back, larger ones are sent right away
+	nagle   bool          // whether a payload is only held back if another cell was sent on the tunnel within delay
+}
+
+// dataBatch collects the payloads sent on a tunnel until they are packed into a single p2p.RelayTunnelBatch, see
+// Router.sendBatched. The zero value is an empty batch ready to use.
+type dataBatch struct {
+	lock      sync.Mutex // held while sending on the tunnel, such that the payloads are sent in order
+	pending   [][]byte
+	size      int       // packed size of the pending payloads
+	scheduled bool      // whether a flush of the pending payloads is scheduled
+	lastSent  time.Time // time the last data was sent on the tunnel
+}
+
+// add appends a payload to the batch. b.lock must be held.
+func (b *dataBatch) add(payload []byte) {
+	data := make([]byte, len(payload))
+	copy(data, payload)
+	b.pending = append(b.pending, data)
+	b.size += 2 + len(data)
+}
+
+// flush sends the pending payloads at the given time with the given send function, a single one as plain
+// p2p.RelayTunnelData. b.lock must be held.
+func (b *dataBatch) flush(send func(msg p2p.RelayMessage) error, now time.Time) (err error) {
+	switch len(b.pending) {
+	case 0:
+		return nil
+	case 1:
+		err = send(&p2p.RelayTunnelData{Data: b.pending[0]})
+	default:
+		err = send(&p2p.RelayTunnelBatch{Payloads: b.pending})
+	}
+	b.pending = nil
+	b.size = 0
+	b.lastSent = now
+	return err
+}
+
+// batchPolicy returns which payloads are held back on a tunnel of the given priority class. Data of bulk tunnels is
+// coalesced, see Config.CoalesceDelay, while only small payloads of the other tunnels are batched, see
+// Config.BatchDelay.
+func (r *Router) batchPolicy(priority Priority) (policy batchPolicy) {
+	if r.cfg == nil {
+		return policy
+	}
+	if priority == PriorityBulk && r.cfg.CoalesceDelay > 0 {
+		return batchPolicy{
+			delay:   time.Duration(r.cfg.CoalesceDelay) * time.Millisecond,
+			maxSize: p2p.MaxRelayDataSize - 2,
+			nagle:   true,
+		}
+	}
+	if r.cfg.BatchDelay > 0 {
+		return batchPolicy{delay: time.Duration(r.cfg.BatchDelay) * time.Millisecond, maxSize: maxBatchedSize}
+	}
+	return policy
+}
+
+// sendBatched sends a payload on a tunnel with the given send function. Payloads are held back for up to the delay of
+// the policy and packed with the further ones sent meanwhile into a single cell, while payloads exceeding the max. size
+// of the policy are sent right away after the pending ones. With a Nagle-style policy, a payload is only held back if
+// data was sent on the tunnel within the delay, such that sporadic payloads are not delayed at all.
+// A scheduled flush is abandoned once quit is closed.
+func (r *Router) sendBatched(b *dataBatch, policy batchPolicy, payload []byte, send func(msg p2p.RelayMessage) error,
+	quit <-chan struct{}) (err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := r.clock.Now()
+	if len(payload) > policy.maxSize || policy.nagle && len(b.pending) == 0 && now.Sub(b.lastSent) >= policy.delay {
+		err = b.flush(send, now)
+		if err != nil {
+			return err
+		}
+		b.lastSent = now
+		return send(&p2p.RelayTunnelData{Data: payload})
+	}
+
+	// the cell is full, the pending payloads are sent without waiting any longer
+	if b.size+2+len(payload) > p2p.MaxRelayDataSize {
+		err = b.flush(send, now)
+		if err != nil {
+			return err
+		}
+	}
+	b.add(payload)
+
+	if !b.scheduled {
+		b.scheduled = true
+		delay := policy.delay
+		if policy.nagle {
+			// the deadline is counted from the data sent last, which is held back for the same time at most
+			delay = b.lastSent.Add(policy.delay).Sub(now)
+		}
+		go func(after <-chan time.Time) {
+			select {
+			case <-after:
+			case <-quit:
+				return
+			}
+			r.flushBatch(b, send)
+		}(r.clock.After(delay))
+	}
+	return nil
+}
+
+// flushBatch sends the payloads pending in the batch right away, e.g. before the tunnel is handed over to another
+// circuit.
+func (r *Router) flushBatch(b *dataBatch, send func(msg p2p.RelayMessage) error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.scheduled = false
+	err := b.flush(send, r.clock.Now())
+	if err != nil {
+		r.logger.Printf("Error sending batched data: %v\n", err)
+	}
+}
+
+// deliverBatch passes the payloads of a batch received on the tunnel with the given ID to the clients, one by one.
+func (r *Router) deliverBatch(tunnelID uint32, msg *p2p.RelayTunnelBatch) (err error) {
+	for _, payload := range msg.Payloads {
+		err = r.sendDataToClients(tunnelID, payload)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package onion
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+)
+
+// sentMessages records the relay messages sent on a tunnel.
+type sentMessages struct {
+	lock sync.Mutex
+	msgs []p2p.RelayMessage
+}
+
+func (s *sentMessages) send(msg p2p.RelayMessage) error {
+	s.lock.Lock()
+	s.msgs = append(s.msgs, msg)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *sentMessages) get() []p2p.RelayMessage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.msgs
+}
+
+func TestRouterSendBatched(t *testing.T) {
+	// the fake clock never fires, thus the batches are only sent once full or flushed
+	router := newRouter(&config.Config{BatchDelay: 20}, WithRPS(&mockRPS{}), WithClock(&fakeClock{}))
+	quit := make(chan struct{})
+	defer close(quit)
+	policy := router.batchPolicy(PriorityInteractive)
+	require.Equal(t, batchPolicy{delay: 20 * time.Millisecond, maxSize: maxBatchedSize}, policy)
+
+	t.Run("small payloads", func(t *testing.T) {
+		var b dataBatch
+		var sent sentMessages
+		payload := []byte("voice")
+		require.Nil(t, router.sendBatched(&b, policy, payload, sent.send, quit))
+		payload[0] = 'V' // the payload must have been copied
+		require.Nil(t, router.sendBatched(&b, policy, []byte("frame"), sent.send, quit))
+		assert.Empty(t, sent.get())
+
+		router.flushBatch(&b, sent.send)
+		assert.Equal(t, []p2p.RelayMessage{
+			&p2p.RelayTunnelBatch{Payloads: [][]byte{[]byte("voice"), []byte("frame")}},
+		}, sent.get())
+
+		// nothing is left to flush
+		router.flushBatch(&b, sent.send)
+		assert.Len(t, sent.get(), 1)
+	})
+
+	t.Run("single payload", func(t *testing.T) {
+		var b dataBatch
+		var sent sentMessages
+		require.Nil(t, router.sendBatched(&b, policy, []byte("voice"), sent.send, quit))
+
+		router.flushBatch(&b, sent.send)
+		assert.Equal(t, []p2p.RelayMessage{&p2p.RelayTunnelData{Data: []byte("voice")}}, sent.get())
+	})
+
+	t.Run("large payload", func(t *testing.T) {
+		var b dataBatch
+		var sent sentMessages
+		large := make([]byte, maxBatchedSize+1)
+		require.Nil(t, router.sendBatched(&b, policy, []byte("voice"), sent.send, quit))
+		require.Nil(t, router.sendBatched(&b, policy, large, sent.send, quit))
+
+		// the pending payload is sent first
+		assert.Equal(t, []p2p.RelayMessage{
+			&p2p.RelayTunnelData{Data: []byte("voice")},
+			&p2p.RelayTunnelData{Data: large},
+		}, sent.get())
+	})
+
+	t.Run("full cell", func(t *testing.T) {
+		var b dataBatch
+		var sent sentMessages
+		payload := make([]byte, maxBatchedSize)
+		for i := 0; i < 4; i++ {
+			require.Nil(t, router.sendBatched(&b, policy, payload, sent.send, quit))
+		}
+
+		// a cell fits three payloads of the max. size including their lengths
+		require.Len(t, sent.get(), 1)
+		batch := sent.get()[0].(*p2p.RelayTunnelBatch)
+		assert.Len(t, batch.Payloads, 3)
+		assert.LessOrEqual(t, batch.PackedSize(), p2p.MaxRelayDataSize)
+	})
+}
+
+func TestRouterSendCoalesced(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)}
+	router := newRouter(&config.Config{BatchDelay: 20, CoalesceDelay: 10}, WithRPS(&mockRPS{}), WithClock(clock))
+	quit := make(chan struct{})
+	defer close(quit)
+
+	// only the data of bulk tunnels is coalesced
+	policy := router.batchPolicy(PriorityBulk)
+	require.Equal(t, batchPolicy{delay: 10 * time.Millisecond, maxSize: p2p.MaxRelayDataSize - 2, nagle: true}, policy)
+
+	var b dataBatch
+	var sent sentMessages
+	payload := make([]byte, p2p.MaxRelayDataSize/2)
+
+	// the first payload is sent right away, the next ones are held back regardless of their size
+	require.Nil(t, router.sendBatched(&b, policy, payload, sent.send, quit))
+	require.Len(t, sent.get(), 1)
+	require.Nil(t, router.sendBatched(&b, policy, payload, sent.send, quit))
+	require.Nil(t, router.sendBatched(&b, policy, []byte("data"), sent.send, quit))
+	require.Len(t, sent.get(), 1)
+
+	// the next payload exceeds the cell
+	require.Nil(t, router.sendBatched(&b, policy, payload, sent.send, quit))
+	require.Len(t, sent.get(), 2)
+	assert.Equal(t, &p2p.RelayTunnelBatch{Payloads: [][]byte{payload, []byte("data")}}, sent.get()[1])
+
+	router.flushBatch(&b, sent.send)
+	require.Len(t, sent.get(), 3)
+
+	// after a quiet period, the payload is sent right away again
+	clock.advance(10 * time.Millisecond)
+	require.Nil(t, router.sendBatched(&b, policy, []byte("data"), sent.send, quit))
+	require.Len(t, sent.get(), 4)
+	assert.Equal(t, &p2p.RelayTunnelData{Data: []byte("data")}, sent.get()[3])
+}
+
+func TestRouterSendBatchedDelay(t *testing.T) {
+	router := newRouter(&config.Config{BatchDelay: 1}, WithRPS(&mockRPS{}))
+	quit := make(chan struct{})
+	defer close(quit)
+	policy := router.batchPolicy(PriorityInteractive)
+
+	var b dataBatch
+	sent := make(chan p2p.RelayMessage, 2)
+	send := func(msg p2p.RelayMessage) error {
+		sent <- msg
+		return nil
+	}
+	require.Nil(t, router.sendBatched(&b, policy, []byte("voice"), send, quit))
+	require.Nil(t, router.sendBatched(&b, policy, []byte("frame"), send, quit))
+
+	select {
+	case msg := <-sent:
+		assert.Equal(t, &p2p.RelayTunnelBatch{Payloads: [][]byte{[]byte("voice"), []byte("frame")}}, msg)
+	case <-time.After(time.Second):
+		t.Fatal("batch was not sent")
+	}
+}
+
+func TestRouterSendDataBatched(t *testing.T) {
+	router := newRouter(&config.Config{BatchDelay: 1}, WithRPS(&mockRPS{}))
+
+	link, connRemote := newPipeLink()
+	defer connRemote.Close()
+	tunnel := &tunnelSegment{
+		prevHopTunnelID: 42,
+		tunnelID:        42,
+		prevHopLink:     link,
+		dhShared:        &[32]byte{1, 2, 3},
+		initiatorCaps:   p2p.CapabilityBatch,
+		quit:            make(chan struct{}),
+	}
+	defer close(tunnel.quit)
+	initiator := newInitiatorEnd(connRemote, tunnel)
+	router.tunnelsLock.Lock()
+	router.incomingTunnels[tunnel.tunnelID] = tunnel
+	router.tunnelsLock.Unlock()
+
+	require.Nil(t, router.SendData(tunnel.tunnelID, []byte("voice")))
+	require.Nil(t, router.SendData(tunnel.tunnelID, []byte("frame")))
+
+	received := make(chan p2p.RelayTunnelBatch)
+	go func() {
+		hdr, body := readRelayFromPrevHop(t, initiator)
+		assert.Equal(t, p2p.RelayTypeTunnelBatch, hdr.RelayType)
+		msg := p2p.RelayTunnelBatch{}
+		assert.Nil(t, msg.Parse(body))
+		received <- msg
+	}()
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, [][]byte{[]byte("voice"), []byte("frame")}, msg.Payloads)
+	case <-time.After(time.Second):
+		t.Fatal("batch was not sent")
+	}
+}
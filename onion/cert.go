@@ -0,0 +1,154 @@
+package onion
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	"bawang/config"
+)
+
+// Bounds of the random validity period in days of the self-signed certificates if none is configured, as common for
+// certificates of public CAs.
+const (
+	minCertValidity = 90
+	maxCertValidity = 398
+)
+
+// Bounds of the random length in bytes of the serial numbers of the self-signed certificates.
+const (
+	minSerialLength = 8
+	maxSerialLength = 20 // max. length allowed by RFC 5280
+)
+
+// certDomains are the top-level domains of the random host names the self-signed certificates are issued for.
+var certDomains = []string{"com", "net", "org", "io", "de"}
+
+// tlsCertFromHostKey creates a self-signed tls.Certificate from the host key usable in tls.Listen. The certificate is
+// created anew whenever a listener is opened. Unless configured, its subject and validity period are drawn at random,
+// as is its serial number, such that peers can not be recognized by fixed certificate parameters.
+func tlsCertFromHostKey(cfg *config.Config) (cert tls.Certificate, err error) {
+	serialNumber, err := randomSerialNumber()
+	if err != nil {
+		return cert, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	subject := cfg.TLSCertSubject
+	if subject == "" {
+		subject, err = randomHostName()
+		if err != nil {
+			return cert, fmt.Errorf("failed to generate subject: %w", err)
+		}
+	}
+
+	// clients discard cached TLS sessions of expired certificates, thus the certificate needs a validity period
+	validityDays := int64(cfg.TLSCertValidity)
+	if validityDays == 0 {
+		validityDays, err = randomInt(maxCertValidity - minCertValidity + 1)
+		if err != nil {
+			return cert, fmt.Errorf("failed to generate validity period: %w", err)
+		}
+		validityDays += minCertValidity
+	}
+	validity := time.Duration(validityDays) * 24 * time.Hour
+
+	// the certificate appears to be issued up to half of its validity period ago, which tolerates clock skew between
+	// peers as well
+	issued, err := randomInt(int64(validity / 2 / time.Second))
+	if err != nil {
+		return cert, fmt.Errorf("failed to generate validity period: %w", err)
+	}
+	notBefore := time.Now().Add(-time.Duration(issued) * time.Second)
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName: subject,
+		},
+		DNSNames:  []string{subject},
+		NotBefore: notBefore,
+		NotAfter:  notBefore.Add(validity),
+
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	hostKey := cfg.HostKey
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, hostKey.Public(), hostKey)
+	if err != nil {
+		return cert, fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	privBytes, err := x509.MarshalPKCS8PrivateKey(hostKey)
+	if err != nil {
+		return cert, fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: derBytes,
+	})
+
+	privPem := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: privBytes,
+	})
+
+	cert, err = tls.X509KeyPair(certPem, privPem)
+	if err != nil {
+		return cert, fmt.Errorf("failed to create server key pair: %w", err)
+	}
+	return cert, nil
+}
+
+// randomSerialNumber draws a positive serial number of random length between minSerialLength and maxSerialLength bytes.
+func randomSerialNumber() (*big.Int, error) {
+	length, err := randomInt(maxSerialLength - minSerialLength + 1)
+	if err != nil {
+		return nil, err
+	}
+	// the most significant bit is cleared, since serial numbers are encoded as signed integers, and zero is skipped
+	limit := new(big.Int).Lsh(big.NewInt(1), uint(8*(minSerialLength+length)-1))
+	serialNumber, err := rand.Int(rand.Reader, limit.Sub(limit, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+	return serialNumber.Add(serialNumber, big.NewInt(1)), nil
+}
+
+// randomHostName draws a random host name like www.abcdefgh.com.
+func randomHostName() (string, error) {
+	length, err := randomInt(8)
+	if err != nil {
+		return "", err
+	}
+	label := make([]byte, 5+length)
+	for i := range label {
+		c, err := randomInt(26)
+		if err != nil {
+			return "", err
+		}
+		label[i] = byte('a' + c)
+	}
+
+	domain, err := randomInt(int64(len(certDomains)))
+	if err != nil {
+		return "", err
+	}
+	return "www." + string(label) + "." + certDomains[domain], nil
+}
+
+// randomInt draws a random number in [0, n) from crypto/rand.
+func randomInt(n int64) (int64, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(n))
+	if err != nil {
+		return 0, err
+	}
+	return i.Int64(), nil
+}
@@ -0,0 +1,65 @@
+package onion
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+)
+
+func TestTLSCertFromHostKey(t *testing.T) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+
+	parse := func(cfg *config.Config) *x509.Certificate {
+		cert, err := tlsCertFromHostKey(cfg)
+		require.Nil(t, err)
+		x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+		require.Nil(t, err)
+		return x509Cert
+	}
+
+	t.Run("random", func(t *testing.T) {
+		cfg := &config.Config{HostKey: hostKey}
+		cert1, cert2 := parse(cfg), parse(cfg)
+		assert.NotEqual(t, cert1.Subject.CommonName, cert2.Subject.CommonName)
+		assert.NotEqual(t, cert1.SerialNumber, cert2.SerialNumber)
+		assert.False(t, cert1.IsCA)
+		assert.True(t, strings.HasPrefix(cert1.Subject.CommonName, "www."))
+		assert.Equal(t, []string{cert1.Subject.CommonName}, cert1.DNSNames)
+		assert.Empty(t, cert1.Subject.Organization)
+
+		for _, cert := range []*x509.Certificate{cert1, cert2} {
+			validity := cert.NotAfter.Sub(cert.NotBefore)
+			assert.True(t, validity >= minCertValidity*24*time.Hour && validity <= maxCertValidity*24*time.Hour)
+			assert.True(t, cert.NotBefore.Before(time.Now()))
+			assert.True(t, cert.NotAfter.After(time.Now().Add(minCertValidity/2*24*time.Hour)))
+		}
+	})
+
+	t.Run("configured", func(t *testing.T) {
+		cert := parse(&config.Config{HostKey: hostKey, TLSCertSubject: "example.com", TLSCertValidity: 30})
+		assert.Equal(t, "example.com", cert.Subject.CommonName)
+		assert.Equal(t, 30*24*time.Hour, cert.NotAfter.Sub(cert.NotBefore))
+	})
+}
+
+func TestRandomSerialNumber(t *testing.T) {
+	lengths := make(map[int]bool)
+	for i := 0; i < 200; i++ {
+		serialNumber, err := randomSerialNumber()
+		require.Nil(t, err)
+		require.Equal(t, 1, serialNumber.Sign())
+		length := (serialNumber.BitLen() + 7) / 8
+		require.True(t, length <= maxSerialLength, "serial number of %d bytes", length)
+		lengths[length] = true
+	}
+	assert.True(t, len(lengths) > 1)
+}
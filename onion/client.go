@@ -0,0 +1,119 @@
+package onion
+
+import (
+	"time"
+)
+
+// Client is a consumer of onion tunnels, e.g. a connection on the onion API socket or an application embedding
+// the Router. Clients registered with the Router are notified about new incoming tunnels, receive the payload of the
+// tunnels they are registered on and are informed when these tunnels are destroyed.
+// If any of the methods returns an error, the Router terminates the Client and unregisters it.
+type Client interface {
+	SendTunnelIncoming(tunnelID uint32) error              // SendTunnelIncoming announces a new incoming tunnel.
+	SendTunnelData(tunnelID uint32, data []byte) error     // SendTunnelData passes payload received on a tunnel.
+	SendTunnelDatagram(tunnelID uint32, data []byte) error // SendTunnelDatagram passes a datagram received on a tunnel.
+	SendTunnelEOF(tunnelID uint32) error                   // SendTunnelEOF announces that the remote end finished sending.
+	SendTunnelDestroy(tunnelID uint32) error               // SendTunnelDestroy announces that a tunnel was destroyed.
+	Terminate() error                                      // Terminate closes the client.
+}
+
+// ClientFuncs is an adapter to allow the use of ordinary functions as a Client.
+// Callbacks which are nil are ignored.
+type ClientFuncs struct {
+	Incoming func(tunnelID uint32) error
+	Data     func(tunnelID uint32, data []byte) error
+	Datagram func(tunnelID uint32, data []byte) error
+	EOF      func(tunnelID uint32) error
+	Destroy  func(tunnelID uint32) error
+	Close    func() error
+}
+
+// SendTunnelIncoming calls cf.Incoming(tunnelID).
+func (cf *ClientFuncs) SendTunnelIncoming(tunnelID uint32) error {
+	if cf.Incoming == nil {
+		return nil
+	}
+	return cf.Incoming(tunnelID)
+}
+
+// SendTunnelData calls cf.Data(tunnelID, data).
+func (cf *ClientFuncs) SendTunnelData(tunnelID uint32, data []byte) error {
+	if cf.Data == nil {
+		return nil
+	}
+	return cf.Data(tunnelID, data)
+}
+
+// SendTunnelDatagram calls cf.Datagram(tunnelID, data).
+func (cf *ClientFuncs) SendTunnelDatagram(tunnelID uint32, data []byte) error {
+	if cf.Datagram == nil {
+		return nil
+	}
+	return cf.Datagram(tunnelID, data)
+}
+
+// SendTunnelEOF calls cf.EOF(tunnelID).
+func (cf *ClientFuncs) SendTunnelEOF(tunnelID uint32) error {
+	if cf.EOF == nil {
+		return nil
+	}
+	return cf.EOF(tunnelID)
+}
+
+// SendTunnelDestroy calls cf.Destroy(tunnelID).
+func (cf *ClientFuncs) SendTunnelDestroy(tunnelID uint32) error {
+	if cf.Destroy == nil {
+		return nil
+	}
+	return cf.Destroy(tunnelID)
+}
+
+// Terminate calls cf.Close().
+func (cf *ClientFuncs) Terminate() error {
+	if cf.Close == nil {
+		return nil
+	}
+	return cf.Close()
+}
+
+// RoundClient is a Client which is notified about round boundaries if enabled in the config, e.g. to align its own
+// buffering with the short disruption while tunnels are rebuilt.
+type RoundClient interface {
+	Client
+
+	// SendRound announces a new round and lists the outgoing tunnels of the client which are rebuilt in it.
+	SendRound(round uint64, rotated []uint32) error
+}
+
+// KeepaliveClient is a Client which is told about its outgoing tunnels staying idle for a while but still working if
+// enabled in the config, such that it can tell them from tunnels broken without being torn down.
+type KeepaliveClient interface {
+	Client
+
+	// SendTunnelAlive announces that the tunnel with the given ID answered although idle for the given time.
+	SendTunnelAlive(tunnelID uint32, idle time.Duration) error
+}
+
+// Subscriptions are the notifications a SubscribingClient wants to receive.
+type Subscriptions uint8
+
+const (
+	SubscribeIncoming Subscriptions = 1 << iota // announcements of new incoming tunnels
+	SubscribeData                               // data and datagrams received on the tunnels
+)
+
+// SubscribingClient is a Client which opts out of some of the notifications, e.g. an API connection only using its
+// own tunnels, which does not want the incoming tunnels of others announced. Clients not subscribed to incoming
+// tunnels are not registered on them either. Clients not implementing it receive all notifications.
+type SubscribingClient interface {
+	Client
+
+	// Subscribed checks whether the client wants all of the given notifications.
+	Subscribed(subs Subscriptions) bool
+}
+
+// subscribed checks whether the given client wants all of the given notifications, see SubscribingClient.
+func subscribed(client Client, subs Subscriptions) bool {
+	subscribingClient, ok := client.(SubscribingClient)
+	return !ok || subscribingClient.Subscribed(subs)
+}
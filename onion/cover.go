@@ -0,0 +1,116 @@
+package onion
+
+import (
+	"time"
+
+	"bawang/errcode"
+	"bawang/p2p"
+)
+
+// maxCoverSchedules is the maximum number of SendCover requests whose cover traffic is sent concurrently.
+const maxCoverSchedules = 16
+
+// ErrTooMuchCover is returned by SendCover if too much cover traffic is being sent already.
+var ErrTooMuchCover = errcode.New(errcode.ModuleOnion, errcode.Limit, true, "too much cover traffic scheduled")
+
+// coverCells returns the number of fixed size cells needed to send at least coverSize bytes of cover traffic.
+func coverCells(coverSize uint16) int {
+	return (int(coverSize) + p2p.MessageSize - 1) / p2p.MessageSize
+}
+
+// SendCover sends at least coverSize bytes of cover traffic over the cover tunnels, if any exist. The cells are spread
+// over all cover tunnels and, with a random jitter, over the current round, such that they do not stand out as a burst.
+// SendCover returns once the cells are scheduled, the number of cells actually sent is reported in Stats.CoverCells.
+// At most maxCoverSchedules requests are sent concurrently, further ones fail with ErrTooMuchCover.
+func (r *Router) SendCover(coverSize uint16) (err error) {
+	// first we check if there is a manually created tunnel, i.e. a tunnel on which clients are listening
+	r.tunnelsLock.RLock()
+	for _, tunnel := range r.outgoingTunnels {
+		if clients, ok := r.tunnels[tunnel.ID()]; ok && len(clients) != 0 {
+			r.tunnelsLock.RUnlock()
+			return ErrSendCoverNotAllowed
+		}
+	}
+	coverTunnels := r.liveCoverTunnels()
+	r.tunnelsLock.RUnlock()
+
+	if len(coverTunnels) == 0 {
+		return ErrInvalidTunnel
+	}
+
+	cells := coverCells(coverSize)
+	if cells == 0 {
+		return nil
+	}
+
+	select {
+	case r.coverSchedules <- struct{}{}:
+	default:
+		return ErrTooMuchCover
+	}
+	go func() {
+		r.sendCover(cells)
+		<-r.coverSchedules
+	}()
+	return nil
+}
+
+// sendCover sends the given number of cover cells over the current round. The round is split into one slot per cell
+// and each cell is sent at a random time within its slot. The cover tunnels are looked up again for every cell, since
+// they may be rotated meanwhile. Sending stops early once no cover tunnel is left, sending fails or the Router shuts
+// down.
+func (r *Router) sendCover(cells int) {
+	slot := time.Duration(r.cfg.RoundDuration) * time.Second / time.Duration(cells)
+
+	var elapsed time.Duration
+	for i := 0; i < cells; i++ {
+		at := time.Duration(i)*slot + r.randomDuration(slot)
+		select {
+		case <-r.clock.After(at - elapsed):
+		case <-r.handlers.quit:
+			return
+		}
+		elapsed = at
+
+		r.tunnelsLock.RLock()
+		coverTunnels := r.liveCoverTunnels()
+		r.tunnelsLock.RUnlock()
+		if len(coverTunnels) == 0 {
+			r.logger.Printf("Stopped sending cover traffic after %d of %d cells, no cover tunnel left\n", i, cells)
+			return
+		}
+
+		err := coverTunnels[i%len(coverTunnels)].sendRelayToLastHop(&p2p.RelayTunnelCover{Ping: true})
+		if err != nil {
+			r.logError(err, "Stopped sending cover traffic after %d of %d cells", i, cells)
+			return
+		}
+
+		r.coverLock.Lock()
+		r.coverCells++
+		r.coverLock.Unlock()
+		r.rounds.count(func(report *RoundReport) { report.CoverCells++ })
+	}
+}
+
+// handleCoverEvent drops destroyed tunnels from the cover tunnels, regardless of how they were torn down.
+func (r *Router) handleCoverEvent(ev Event) {
+	if ev.Type != EventTunnelDestroyed {
+		return
+	}
+
+	r.tunnelsLock.Lock()
+	defer r.tunnelsLock.Unlock()
+
+	for i, tunnelID := range r.coverTunnels {
+		if tunnelID == ev.TunnelID {
+			r.coverTunnels = append(r.coverTunnels[:i], r.coverTunnels[i+1:]...)
+			return
+		}
+	}
+}
+
+// randomDuration draws a random duration in [0, max) from the Router's source of randomness.
+func (r *Router) randomDuration(max time.Duration) time.Duration {
+	return time.Duration(float64(max) * float64(r.randomUint32()) / (1 << 32))
+}
@@ -0,0 +1,140 @@
+package onion
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+)
+
+// instantClock is a Clock whose timers fire right away, recording the durations waited for.
+type instantClock struct {
+	fakeClock
+	waitLock sync.Mutex // guards waited
+	waited   []time.Duration
+}
+
+func (c *instantClock) After(d time.Duration) <-chan time.Time {
+	c.waitLock.Lock()
+	c.waited = append(c.waited, d)
+	c.waitLock.Unlock()
+
+	ch := make(chan time.Time, 1)
+	ch <- c.Now()
+	return ch
+}
+
+func TestCoverCells(t *testing.T) {
+	assert.Equal(t, 0, coverCells(0))
+	assert.Equal(t, 1, coverCells(1))
+	assert.Equal(t, 1, coverCells(p2p.MessageSize))
+	assert.Equal(t, 2, coverCells(p2p.MessageSize+1))
+	// formerly underflowed and sent cover traffic endlessly
+	assert.Equal(t, 64, coverCells(65535))
+}
+
+func TestRouterSendCover(t *testing.T) {
+	clock := &instantClock{}
+	router := newRouter(&config.Config{RoundDuration: 60}, WithRPS(&mockRPS{}), WithClock(clock))
+
+	t.Run("no cover tunnel", func(t *testing.T) {
+		assert.Equal(t, ErrInvalidTunnel, router.SendCover(p2p.MessageSize))
+	})
+
+	link, connRemote := newPipeLink()
+	defer connRemote.Close()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, connRemote)
+	}()
+	tunnel, _, _ := newBenchmarkTunnel(3)
+	tunnel.link = link
+	router.tunnelsLock.Lock()
+	router.outgoingTunnels[tunnel.ID()] = tunnel
+	router.coverTunnels = []uint32{tunnel.ID()}
+	router.tunnelsLock.Unlock()
+
+	t.Run("nothing to send", func(t *testing.T) {
+		require.Nil(t, router.SendCover(0))
+		assert.Equal(t, uint64(0), router.Stats().CoverCells)
+	})
+
+	t.Run("spread over round", func(t *testing.T) {
+		require.Nil(t, router.SendCover(3*p2p.MessageSize-1))
+		require.Eventually(t, func() bool {
+			return router.Stats().CoverCells == 3
+		}, time.Second, time.Millisecond)
+
+		clock.waitLock.Lock()
+		defer clock.waitLock.Unlock()
+		require.Len(t, clock.waited, 3)
+		var at time.Duration
+		for i, d := range clock.waited {
+			at += d
+			assert.True(t, at >= time.Duration(i)*20*time.Second, "cell %d sent before its slot", i)
+			assert.True(t, at < time.Duration(i+1)*20*time.Second, "cell %d sent after its slot", i)
+		}
+	})
+}
+
+func TestRouterCoverSchedules(t *testing.T) {
+	// the cells never become due with the fake clock, thus the schedules keep running until the Router shuts down
+	router := newRouter(&config.Config{RoundDuration: 60}, WithRPS(&mockRPS{}), WithClock(&fakeClock{}))
+	tunnel, _, _ := newBenchmarkTunnel(3)
+	router.outgoingTunnels[tunnel.ID()] = tunnel
+	router.coverTunnels = []uint32{tunnel.ID()}
+
+	for i := 0; i < maxCoverSchedules; i++ {
+		require.Nil(t, router.SendCover(p2p.MessageSize))
+	}
+	assert.Equal(t, ErrTooMuchCover, router.SendCover(p2p.MessageSize))
+
+	router.Shutdown()
+	require.Eventually(t, func() bool {
+		return len(router.coverSchedules) == 0
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, uint64(0), router.Stats().CoverCells)
+}
+
+func TestRouterCoverTunnelLength(t *testing.T) {
+	cfg := &config.Config{TunnelLength: 3}
+	router := newRouter(cfg, WithRPS(&mockRPS{}))
+	assert.Equal(t, 3, router.coverTunnelLength())
+
+	cfg.MaxCoverLength = 5
+	lengths := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		length := router.coverTunnelLength()
+		require.True(t, length >= 3 && length <= 5, "length %d out of range", length)
+		lengths[length] = true
+	}
+	assert.Len(t, lengths, 3)
+}
+
+func TestRouterAwaitRound(t *testing.T) {
+	clock := &instantClock{}
+	cfg := &config.Config{RoundDuration: 60, CoverMidRound: true}
+	router := newRouter(cfg, WithRPS(&mockRPS{}), WithClock(clock))
+	roundTimer := clock.NewTicker(time.Minute)
+
+	// the mid-round rotation is scheduled once per round, there are no cover tunnels to rotate though
+	router.TriggerRound()
+	stop, err := router.awaitRound(time.Minute, roundTimer, nil)
+	require.Nil(t, err)
+	assert.False(t, stop)
+	clock.waitLock.Lock()
+	assert.Len(t, clock.waited, 1)
+	clock.waitLock.Unlock()
+
+	quit := make(chan struct{})
+	close(quit)
+	stop, err = router.awaitRound(time.Minute, roundTimer, quit)
+	require.Nil(t, err)
+	assert.True(t, stop)
+}
@@ -0,0 +1,659 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/nacl/box"
+
+	"bawang/auth"
+	"bawang/config"
+	"bawang/errcode"
+	"bawang/p2p"
+	"bawang/rps"
+)
+
+var (
+	errAuthCipherSize = errcode.New(errcode.ModuleOnion, errcode.InvalidMessage, false,
+		"onion auth module changed the size of a relay message")
+	errAuthHandshakeSize = errcode.New(errcode.ModuleOnion, errcode.InvalidMessage, false,
+		"onion auth module returned a handshake message of invalid size")
+	errSessionClosed = errcode.New(errcode.ModuleOnion, errcode.ConnClosed, false, "session closed")
+)
+
+// legacyCapabilities are assumed for hops not negotiating the handshake version. Since such hops predate the
+// negotiation, they are expected to support every optional feature, as was the case before it was introduced.
+const legacyCapabilities = ^p2p.Capabilities(0)
+
+// session is the state shared by the tunnel initiator and a single hop after a successful handshake.
+type session struct {
+	key          [32]byte         // seeds the running digests of the relay messages, see p2p.NewRelayDigests
+	cipher       layerCipher      // adds and removes the hop's layer of encryption
+	capabilities p2p.Capabilities // announced by the hop, only known to the initiator
+	// whether the hop issued a ticket to resume the session, only known to the initiator. Such hops also extend
+	// tunnels with resumed handshakes.
+	resumable bool
+}
+
+// supportedVersions returns the handshake versions we answer, handshakes by the Onion Auth module are only supported if
+// a client for it is given. Built-in handshakes encrypting with RSA PKCS #1 v1.5 are refused with Config.OAEPOnly.
+// Resumed handshakes are only answered for the sessions remembered, see ticketCache.
+func supportedVersions(cfg *config.Config, authClient auth.Client) (versions p2p.VersionSet) {
+	versions = p2p.NewVersionSet(p2p.HandshakeVersionDHOAEP)
+	if cfg == nil || !cfg.OAEPOnly {
+		versions |= p2p.NewVersionSet(p2p.HandshakeVersionDH, p2p.HandshakeVersionDHSized)
+	}
+	if authClient != nil {
+		versions |= p2p.NewVersionSet(p2p.HandshakeVersionAuth)
+	}
+	return versions
+}
+
+// offeredVersions returns the handshake versions offered to a hop holding the given host key. Besides
+// p2p.HandshakeVersionDHOAEP, only the legacy version of the built-in handshake fitting the key is offered, see
+// dhVersion, unless Config.OAEPOnly is set.
+func offeredVersions(cfg *config.Config, authClient auth.Client, peerHostKey *rsa.PublicKey) (
+	versions p2p.VersionSet) {
+	versions = p2p.NewVersionSet(p2p.HandshakeVersionDHOAEP)
+	if cfg == nil || !cfg.OAEPOnly {
+		versions |= p2p.NewVersionSet(dhVersion(peerHostKey))
+	}
+	if authClient != nil {
+		versions |= p2p.NewVersionSet(p2p.HandshakeVersionAuth)
+	}
+	return versions
+}
+
+// capabilities returns the optional protocol features we announce to the peers we perform handshakes with.
+func capabilities(cfg *config.Config) (caps p2p.Capabilities) {
+	caps = p2p.CapabilityTimestamp | p2p.CapabilityCipherSuites | p2p.CapabilityOpened | p2p.CapabilityMultipath |
+		p2p.CapabilityBatch | p2p.CapabilitySizedKeys | p2p.CapabilityOAEP
+	if cfg != nil && cfg.Exit {
+		caps |= p2p.CapabilityExit
+	}
+	return caps
+}
+
+// initiatorCapabilities returns the capabilities the tunnel initiator announced in its tunnel creation. Initiators not
+// negotiating the handshake version are assumed to support all of them, see legacyCapabilities.
+func initiatorCapabilities(msg *p2p.TunnelCreate) p2p.Capabilities {
+	if msg.Versions == 0 {
+		return legacyCapabilities
+	}
+	return msg.Capabilities
+}
+
+// defaultCipherSuites are the cipher suites of the built-in layered encryption in order of preference, unless
+// configured otherwise.
+var defaultCipherSuites = []p2p.CipherSuite{
+	p2p.CipherSuiteChaCha20Poly1305,
+	p2p.CipherSuiteAESGCM,
+	p2p.CipherSuiteAESCTR,
+}
+
+// cipherSuiteNames maps the names of the configured cipher suites to their identifiers.
+var cipherSuiteNames = map[string]p2p.CipherSuite{
+	config.CipherSuiteAESCTR:           p2p.CipherSuiteAESCTR,
+	config.CipherSuiteAESGCM:           p2p.CipherSuiteAESGCM,
+	config.CipherSuiteChaCha20Poly1305: p2p.CipherSuiteChaCha20Poly1305,
+}
+
+// cipherSuites returns the cipher suites we accept for the built-in layered encryption in order of preference.
+func cipherSuites(cfg *config.Config) (suites []p2p.CipherSuite) {
+	if cfg == nil || len(cfg.CipherSuites) == 0 {
+		return defaultCipherSuites
+	}
+	for _, name := range cfg.CipherSuites {
+		if suite, ok := cipherSuiteNames[name]; ok {
+			suites = append(suites, suite)
+		}
+	}
+	return suites
+}
+
+// selectCipherSuite picks our most preferred cipher suite offered by the initiator of the given creation. Initiators
+// not offering any only support p2p.CipherSuiteAESCTR.
+func selectCipherSuite(msg *p2p.TunnelCreate, cfg *config.Config) (suite p2p.CipherSuite, err error) {
+	offered := p2p.NewCipherSuiteSet(p2p.CipherSuiteAESCTR)
+	if msg.HasCipherSuites() {
+		offered = msg.CipherSuites
+	}
+	for _, suite = range cipherSuites(cfg) {
+		if offered.Contains(suite) {
+			return suite, nil
+		}
+	}
+	return 0, ErrNoCipherSuite
+}
+
+// layerCipher adds and removes the layer of encryption of the relay messages exchanged by the tunnel initiator and a
+// single hop, see keyCipher and authCipher. The counter at the start of a relay message is never encrypted.
+// Messages exchanged with the hop itself are sealed and opened, while the layer of messages exchanged with hops behind
+// it is encrypted and decrypted.
+type layerCipher interface {
+	encrypt(packedMsg []byte) (encMsg []byte, err error)
+	decrypt(encMsg []byte) (msg []byte, err error)
+	seal(packedMsg []byte) (encMsg []byte, err error)
+	// open removes the layer of encryption and checks whether the message is meant for us, see p2p.RelayCipher.Open
+	open(encMsg []byte, digest *p2p.RelayDigest) (ok bool, msg []byte, err error)
+	close() // releases the session, the cipher must not be used afterwards
+}
+
+// decryptRelay removes a layer of encryption from a relay message and checks whether the message is meant for us by
+// its running digest, see p2p.DecryptRelay.
+func decryptRelay(cipher layerCipher, encMsg []byte, digest *p2p.RelayDigest) (ok bool, msg []byte, err error) {
+	msg, err = cipher.decrypt(encMsg)
+	if err != nil {
+		return false, nil, err
+	}
+
+	ok, err = p2p.RecognizeRelay(msg, digest)
+	if err != nil {
+		return false, nil, err
+	}
+	return ok, msg, nil
+}
+
+// wipe overwrites key material and decrypted messages with zeros once they are no longer needed, such that they do not
+// linger in memory.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// keyCipher is the built-in layerCipher, encrypting with the negotiated cipher suite and the Diffie-Hellman key shared
+// with the hop. The keys are wiped once the cipher is closed.
+type keyCipher struct {
+	lock   sync.RWMutex // guards the keys against being wiped while in use
+	key    *[32]byte
+	relay  *p2p.RelayCipher
+	closed bool
+}
+
+// newKeyCipher returns the keyCipher of p2p.CipherSuiteAESCTR, which is the same for both ends.
+func newKeyCipher(key *[32]byte) layerCipher {
+	relay, _ := p2p.NewRelayCipher(p2p.CipherSuiteAESCTR, key, true) // never fails for this suite
+	return &keyCipher{key: key, relay: relay}
+}
+
+// newSuiteCipher returns the keyCipher of the given cipher suite for the tunnel initiator's or the hop's end.
+func newSuiteCipher(suite p2p.CipherSuite, key *[32]byte, initiator bool) (c layerCipher, err error) {
+	relay, err := p2p.NewRelayCipher(suite, key, initiator)
+	if err != nil {
+		return nil, err
+	}
+	return &keyCipher{key: key, relay: relay}, nil
+}
+
+func (c *keyCipher) encrypt(packedMsg []byte) (encMsg []byte, err error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.closed {
+		return nil, errSessionClosed
+	}
+	return c.relay.Encrypt(packedMsg)
+}
+
+func (c *keyCipher) decrypt(encMsg []byte) (msg []byte, err error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.closed {
+		return nil, errSessionClosed
+	}
+	return c.relay.Decrypt(encMsg)
+}
+
+func (c *keyCipher) seal(packedMsg []byte) (encMsg []byte, err error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.closed {
+		return nil, errSessionClosed
+	}
+	return c.relay.Seal(packedMsg)
+}
+
+func (c *keyCipher) open(encMsg []byte, digest *p2p.RelayDigest) (ok bool, msg []byte, err error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.closed {
+		return false, nil, errSessionClosed
+	}
+	return c.relay.Open(encMsg, digest)
+}
+
+func (c *keyCipher) close() {
+	c.lock.Lock()
+	wipe(c.key[:])
+	c.relay.Wipe()
+	c.closed = true
+	c.lock.Unlock()
+}
+
+// authCipher is the layerCipher of a session established by the Onion Auth module, which encrypts and decrypts the relay
+// messages on our behalf. Since relay messages have a fixed size, the module must not change the size of the payload.
+type authCipher struct {
+	client    auth.Client
+	sessionID uint16
+}
+
+func (c *authCipher) encrypt(packedMsg []byte) (encMsg []byte, err error) {
+	payload, err := c.client.CipherEncrypt(c.sessionID, packedMsg[p2p.RelayCounterSize:])
+	if err != nil {
+		return nil, err
+	}
+	return withCounter(packedMsg, payload)
+}
+
+func (c *authCipher) decrypt(encMsg []byte) (msg []byte, err error) {
+	payload, _, err := c.client.CipherDecrypt(c.sessionID, encMsg[p2p.RelayCounterSize:])
+	if err != nil {
+		return nil, err
+	}
+	return withCounter(encMsg, payload)
+}
+
+func (c *authCipher) seal(packedMsg []byte) (encMsg []byte, err error) {
+	return c.encrypt(packedMsg)
+}
+
+func (c *authCipher) open(encMsg []byte, digest *p2p.RelayDigest) (ok bool, msg []byte, err error) {
+	return decryptRelay(c, encMsg, digest)
+}
+
+func (c *authCipher) close() {
+	_ = c.client.SessionClose(c.sessionID)
+}
+
+// withCounter prepends the counter of the given relay message to the payload returned by the Onion Auth module.
+func withCounter(relayMsg []byte, payload []byte) (msg []byte, err error) {
+	if len(payload) != len(relayMsg)-p2p.RelayCounterSize {
+		return nil, errAuthCipherSize
+	}
+
+	msg = make([]byte, len(relayMsg))
+	copy(msg[:p2p.RelayCounterSize], relayMsg[:p2p.RelayCounterSize])
+	copy(msg[p2p.RelayCounterSize:], payload)
+	return msg, nil
+}
+
+// initiatedHandshake is the tunnel initiator's end of a handshake with a single hop, see Router.startHandshake.
+type initiatedHandshake interface {
+	// createMsg returns the message starting the handshake, which is sent to the hop directly or within a
+	// p2p.RelayTunnelExtend.
+	createMsg() *p2p.TunnelCreate
+	// finish completes the handshake with the hop's reply. ErrMisbehavingPeer is returned for invalid replies.
+	finish(createdMsg *p2p.TunnelCreated) (s *session, err error)
+	// abort releases the handshake if it is not completed.
+	abort()
+}
+
+// startHandshake starts a handshake of the given version with the hop holding the given host key. The built-in
+// handshakes bind the given timestamp of the creation to the handshake, see generateDHKeys.
+func (r *Router) startHandshake(peerHostKey *rsa.PublicKey, version uint8, timestamp uint32) (h initiatedHandshake,
+	err error) {
+	switch {
+	case version == p2p.HandshakeVersionDH || version == p2p.HandshakeVersionDHSized ||
+		version == p2p.HandshakeVersionDHOAEP:
+		return startDHHandshake(r.rand, peerHostKey, version, timestamp)
+	case version == p2p.HandshakeVersionAuth && r.auth != nil:
+		return startAuthHandshake(r.auth, peerHostKey)
+	default:
+		return nil, ErrInvalidProtocolVersion
+	}
+}
+
+// handshake performs a handshake with the given hop of the tunnel with the given ID, passing the p2p.TunnelCreate to
+// it and returning its reply via exchange. The handshake is delegated to the Onion Auth module if configured, while
+// offering all supported versions. If the hop asks to retry with another of the offered versions, the handshake is
+// retried once. The built-in handshake encrypts with RSA-OAEP, hops not supporting it are asked to retry with the
+// legacy version, see offeredVersions.
+// If resume is set and the hop issued a ticket when the tunnel was built before, the session is resumed instead, see
+// p2p.HandshakeVersionResume. Hops which forgot the ticket ask to retry with a full handshake.
+// With Config.LoadAwarePaths, the load announced by the hop is recorded for the path selection, see samplePath.
+func (r *Router) handshake(hop *rps.Peer, tunnelID uint32, resume bool,
+	exchange func(createMsg *p2p.TunnelCreate) (*p2p.TunnelCreated, error)) (s *session, err error) {
+	version := uint8(p2p.HandshakeVersionDHOAEP)
+	if r.auth != nil {
+		version = p2p.HandshakeVersionAuth
+	}
+	offered := offeredVersions(r.cfg, r.auth, hop.HostKey)
+	offeredSuites := p2p.NewCipherSuiteSet(cipherSuites(r.cfg)...)
+
+	var res *resumption
+	if resume && r.auth == nil {
+		res = r.takeResumption(tunnelID, hop)
+	}
+	if res != nil {
+		defer wipe(res.secret[:])
+		version = p2p.HandshakeVersionResume
+		offered |= p2p.NewVersionSet(p2p.HandshakeVersionResume)
+	}
+
+	for retried := false; ; retried = true {
+		var h initiatedHandshake
+		timestamp := uint32(r.clock.Now().Unix())
+		if version == p2p.HandshakeVersionResume {
+			h, err = startResumeHandshake(r.rand, res)
+		} else {
+			h, err = r.startHandshake(hop.HostKey, version, timestamp)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		createMsg := h.createMsg()
+		createMsg.Versions = offered
+		createMsg.Capabilities = capabilities(r.cfg)
+		createMsg.Timestamp = timestamp
+		createMsg.CipherSuites = offeredSuites
+
+		createdMsg, err := exchange(createMsg)
+		if err != nil {
+			h.abort()
+			return nil, err
+		}
+
+		if createdMsg.Retry {
+			h.abort()
+
+			// the hop must pick another one of the offered versions, and it must not do so twice. Resumptions are only
+			// initiated by us.
+			if retried || createdMsg.Version == version || !offered.Contains(createdMsg.Version) ||
+				createdMsg.Version == p2p.HandshakeVersionResume {
+				r.recordMisbehavior(hop, MisbehaviorProtocol)
+				return nil, ErrMisbehavingPeer
+			}
+			version = createdMsg.Version
+			continue
+		}
+
+		// the hop must pick one of the offered suites, hops not negotiating them only support the legacy one.
+		// The suite only applies to the built-in handshake.
+		if !createdMsg.HasCipherSuite() {
+			createdMsg.CipherSuite = p2p.CipherSuiteAESCTR
+		}
+		if version != p2p.HandshakeVersionAuth && !offeredSuites.Contains(createdMsg.CipherSuite) {
+			h.abort()
+			if createdMsg.HasCipherSuite() {
+				r.recordMisbehavior(hop, MisbehaviorProtocol)
+				return nil, ErrMisbehavingPeer
+			}
+			return nil, ErrNoCipherSuite
+		}
+
+		s, err = h.finish(createdMsg)
+		if err == ErrMisbehavingPeer {
+			r.recordMisbehavior(hop, MisbehaviorDigest)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		s.capabilities = legacyCapabilities
+		if createdMsg.Version != 0 {
+			s.capabilities = createdMsg.Capabilities
+		}
+		if createdMsg.Ticket && version != p2p.HandshakeVersionAuth {
+			s.resumable = true
+			r.storeResumption(tunnelID, hop, &s.key)
+		}
+		if createdMsg.HasLoad && r.cfg.LoadAwarePaths {
+			r.loads.record(hop, createdMsg.Load, r.clock.Now())
+		}
+		return s, nil
+	}
+}
+
+// dhHandshake is the built-in Diffie-Hellman handshake. Our public key is encrypted with the hop's host key, such that
+// only the hop can derive the shared key, which it proves by returning the key's hash.
+type dhHandshake struct {
+	privDH *[32]byte
+	msg    *p2p.TunnelCreate
+}
+
+func startDHHandshake(random io.Reader, peerHostKey *rsa.PublicKey, version uint8, timestamp uint32) (h *dhHandshake,
+	err error) {
+	privDH, msg, err := tunnelCreateMsg(random, peerHostKey, version, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return &dhHandshake{privDH: privDH, msg: msg}, nil
+}
+
+func (h *dhHandshake) createMsg() *p2p.TunnelCreate {
+	return h.msg
+}
+
+func (h *dhHandshake) finish(createdMsg *p2p.TunnelCreated) (s *session, err error) {
+	if len(createdMsg.Handshake) > 0 {
+		h.abort()
+		return nil, ErrMisbehavingPeer
+	}
+
+	s = &session{}
+	box.Precompute(&s.key, &createdMsg.DHPubKey, h.privDH)
+	wipe(h.privDH[:])
+
+	// validate the shared key hash
+	sharedHash := sha256.Sum256(s.key[:32])
+	if !bytes.Equal(sharedHash[:], createdMsg.SharedKeyHash[:]) {
+		wipe(s.key[:])
+		return nil, ErrMisbehavingPeer
+	}
+
+	s.cipher, err = newSuiteCipher(createdMsg.CipherSuite, &s.key, true)
+	if err != nil {
+		wipe(s.key[:])
+		return nil, err
+	}
+	return s, nil
+}
+
+func (h *dhHandshake) abort() {
+	wipe(h.privDH[:])
+}
+
+// resumeHandshake resumes a session established by the built-in handshake before. Our public key is sent as is, while
+// the shared key is derived from the secret of the resumed session as well, such that only the hop which issued the
+// ticket can derive it, which it proves by returning the key's hash.
+type resumeHandshake struct {
+	privDH *[32]byte
+	secret [32]byte
+	msg    *p2p.TunnelCreate
+}
+
+func startResumeHandshake(random io.Reader, res *resumption) (h *resumeHandshake, err error) {
+	pubDH, privDH, err := box.GenerateKey(random)
+	if err != nil {
+		return nil, err
+	}
+	msg := &p2p.TunnelCreate{
+		Version:  p2p.HandshakeVersionResume,
+		Ticket:   res.ticket,
+		DHPubKey: *pubDH,
+	}
+	return &resumeHandshake{privDH: privDH, secret: res.secret, msg: msg}, nil
+}
+
+func (h *resumeHandshake) createMsg() *p2p.TunnelCreate {
+	return h.msg
+}
+
+func (h *resumeHandshake) finish(createdMsg *p2p.TunnelCreated) (s *session, err error) {
+	if len(createdMsg.Handshake) > 0 {
+		h.abort()
+		return nil, ErrMisbehavingPeer
+	}
+
+	var shared [32]byte
+	box.Precompute(&shared, &createdMsg.DHPubKey, h.privDH)
+	s = &session{key: resumedKey(&h.secret, &shared)}
+	wipe(shared[:])
+	h.abort()
+
+	// validate the shared key hash
+	sharedHash := sha256.Sum256(s.key[:32])
+	if !bytes.Equal(sharedHash[:], createdMsg.SharedKeyHash[:]) {
+		wipe(s.key[:])
+		return nil, ErrMisbehavingPeer
+	}
+
+	s.cipher, err = newSuiteCipher(createdMsg.CipherSuite, &s.key, true)
+	if err != nil {
+		wipe(s.key[:])
+		return nil, err
+	}
+	return s, nil
+}
+
+func (h *resumeHandshake) abort() {
+	wipe(h.privDH[:])
+	wipe(h.secret[:])
+}
+
+// authHandshake is a handshake performed by the Onion Auth modules of the tunnel initiator and the hop.
+type authHandshake struct {
+	client    auth.Client
+	sessionID uint16
+	hs1       []byte
+}
+
+func startAuthHandshake(client auth.Client, peerHostKey *rsa.PublicKey) (h *authHandshake, err error) {
+	sessionID, hs1, err := client.SessionStart(peerHostKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(hs1) == 0 || len(hs1) > p2p.MaxHandshakeSize {
+		_ = client.SessionClose(sessionID)
+		return nil, errAuthHandshakeSize
+	}
+	return &authHandshake{client: client, sessionID: sessionID, hs1: hs1}, nil
+}
+
+func (h *authHandshake) createMsg() *p2p.TunnelCreate {
+	return &p2p.TunnelCreate{
+		Version:   p2p.HandshakeVersionAuth,
+		Handshake: h.hs1,
+	}
+}
+
+func (h *authHandshake) finish(createdMsg *p2p.TunnelCreated) (s *session, err error) {
+	if len(createdMsg.Handshake) == 0 {
+		h.abort()
+		return nil, ErrMisbehavingPeer
+	}
+
+	err = h.client.SessionIncomingHS2(h.sessionID, createdMsg.Handshake)
+	if err != nil {
+		h.abort()
+		return nil, err
+	}
+
+	return &session{
+		key:    handshakeKey(h.hs1, createdMsg.Handshake),
+		cipher: &authCipher{client: h.client, sessionID: h.sessionID},
+	}, nil
+}
+
+func (h *authHandshake) abort() {
+	_ = h.client.SessionClose(h.sessionID)
+}
+
+// handshakeKey derives the key seeding the running digests of a session established by the Onion Auth modules from the
+// exchanged handshake messages. Unlike the Diffie-Hellman key it is not secret, since the previous hop relays the
+// handshake. Thus, the digests only detect dropped, reordered and replayed messages, while authenticating the messages is
+// up to the module's cipher.
+func handshakeKey(hs1, hs2 []byte) (key [32]byte) {
+	h := sha256.New()
+	_, _ = h.Write(hs1)
+	_, _ = h.Write(hs2)
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// handleTunnelCreate answers an incoming p2p.TunnelCreate with the handshake of the requested version, returning the
+// session with the tunnel initiator and the p2p.TunnelCreated response. Handshakes by the Onion Auth module are only
+// answered if a client for it is given. The keys of the built-in handshake are generated from random.
+// If the requested version is not supported, the highest supported version offered by the initiator is picked and the
+// response asks to retry the handshake with it. In this case, the returned session is nil.
+// If tickets are given, sessions of the built-in handshake are remembered in them and the initiator may resume them
+// later on. Resumptions of sessions not remembered are asked to retry with a full handshake.
+func handleTunnelCreate(random io.Reader, msg *p2p.TunnelCreate, cfg *config.Config, authClient auth.Client,
+	tickets *ticketCache) (s *session, response *p2p.TunnelCreated, err error) {
+	var secret *[32]byte
+	if msg.Version == p2p.HandshakeVersionResume && tickets != nil {
+		secret = tickets.redeem(&msg.Ticket)
+		if secret != nil {
+			defer wipe(secret[:])
+		}
+	}
+	supported := supportedVersions(cfg, authClient)
+	if !supported.Contains(msg.Version) && secret == nil {
+		version := supported.Highest(msg.Versions)
+		if version == 0 {
+			return nil, nil, ErrInvalidProtocolVersion
+		}
+		return nil, &p2p.TunnelCreated{Retry: true, Version: version, Capabilities: capabilities(cfg)}, nil
+	}
+
+	suite := p2p.CipherSuiteAESCTR
+	if msg.Version == p2p.HandshakeVersionAuth {
+		s, response, err = handleAuthTunnelCreate(msg, authClient)
+	} else {
+		suite, err = selectCipherSuite(msg, cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		if secret != nil {
+			s, response, err = handleResumeTunnelCreate(random, msg, secret, suite)
+		} else {
+			s, response, err = handleDHTunnelCreate(random, msg, cfg, suite)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// initiators not negotiating the version do not expect it in the response, nor the cipher suite if not offered
+	if msg.Versions != 0 {
+		response.Version = msg.Version
+		response.Capabilities = capabilities(cfg)
+		if msg.HasCipherSuites() {
+			response.CipherSuite = suite
+		} else {
+			response.Capabilities &^= p2p.CapabilityCipherSuites
+		}
+		if tickets != nil && msg.Version != p2p.HandshakeVersionAuth {
+			tickets.issue(&s.key)
+			response.Ticket = true
+		}
+	}
+	return s, response, nil
+}
+
+// handleAuthTunnelCreate passes the handshake message of the tunnel initiator to the Onion Auth module and returns its
+// reply as p2p.TunnelCreated response.
+func handleAuthTunnelCreate(msg *p2p.TunnelCreate, client auth.Client) (s *session, response *p2p.TunnelCreated,
+	err error) {
+	sessionID, hs2, err := client.SessionIncomingHS1(msg.Handshake)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(hs2) == 0 || len(hs2) > p2p.MaxHandshakeSize {
+		_ = client.SessionClose(sessionID)
+		return nil, nil, errAuthHandshakeSize
+	}
+
+	s = &session{
+		key:    handshakeKey(msg.Handshake, hs2),
+		cipher: &authCipher{client: client, sessionID: sessionID},
+	}
+	response = &p2p.TunnelCreated{
+		Handshake: hs2,
+	}
+	return s, response, nil
+}
@@ -0,0 +1,480 @@
+package onion
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+	"bawang/rps"
+)
+
+// mockAuth is an auth.Client in tests, encrypting by XORing the payload with the ID of the session.
+// Both ends of a session get the same ID, such that a single mockAuth plays the modules of all peers.
+type mockAuth struct {
+	lock          sync.Mutex
+	nextSessionID uint16
+	closed        []uint16
+	resize        bool // return payloads of a different size
+}
+
+func (m *mockAuth) newSessionID() uint16 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.nextSessionID++
+	return m.nextSessionID
+}
+
+func (m *mockAuth) SessionStart(peerHostKey *rsa.PublicKey) (sessionID uint16, hs1 []byte, err error) {
+	sessionID = m.newSessionID()
+	return sessionID, []byte{'h', 's', '1', byte(sessionID)}, nil
+}
+
+func (m *mockAuth) SessionIncomingHS1(hs1 []byte) (sessionID uint16, hs2 []byte, err error) {
+	sessionID = uint16(hs1[len(hs1)-1])
+	return sessionID, []byte{'h', 's', '2', byte(sessionID)}, nil
+}
+
+func (m *mockAuth) SessionIncomingHS2(sessionID uint16, hs2 []byte) (err error) {
+	return nil
+}
+
+func (m *mockAuth) SessionClose(sessionID uint16) (err error) {
+	m.lock.Lock()
+	m.closed = append(m.closed, sessionID)
+	m.lock.Unlock()
+	return nil
+}
+
+func (m *mockAuth) xor(sessionID uint16, payload []byte) []byte {
+	out := make([]byte, len(payload))
+	for i := range payload {
+		out[i] = payload[i] ^ byte(sessionID)
+	}
+	if m.resize {
+		out = append(out, 0)
+	}
+	return out
+}
+
+func (m *mockAuth) LayerEncrypt(sessionIDs []uint16, payload []byte) (encPayload []byte, err error) {
+	for _, sessionID := range sessionIDs {
+		payload = m.xor(sessionID, payload)
+	}
+	return payload, nil
+}
+
+func (m *mockAuth) LayerDecrypt(sessionIDs []uint16, encPayload []byte) (payload []byte, err error) {
+	return m.LayerEncrypt(sessionIDs, encPayload)
+}
+
+func (m *mockAuth) CipherEncrypt(sessionID uint16, payload []byte) (encPayload []byte, err error) {
+	return m.xor(sessionID, payload), nil
+}
+
+func (m *mockAuth) CipherDecrypt(sessionID uint16, encPayload []byte) (payload []byte, cleartext bool, err error) {
+	return m.xor(sessionID, encPayload), true, nil
+}
+
+func (m *mockAuth) Close() {}
+
+func TestAuthHandshake(t *testing.T) {
+	client := &mockAuth{}
+
+	h, err := startAuthHandshake(client, nil)
+	require.Nil(t, err)
+	createMsg := h.createMsg()
+	assert.Equal(t, uint8(p2p.HandshakeVersionAuth), createMsg.Version)
+
+	// the hop answers the handshake as if it was relayed in an extend message
+	extendMsg := relayTunnelExtendMsgFromTunnelCreateMsg(createMsg, nil, 0)
+	forwardedCreateMsg := tunnelCreateMsgFromRelayTunnelExtendMsg(&extendMsg)
+	hopSession, createdMsg, err := handleTunnelCreate(rand.Reader, &forwardedCreateMsg, &config.Config{}, client, nil)
+	require.Nil(t, err)
+
+	extendedMsg := relayTunnelExtendedMsgFromTunnelCreatedMsg(createdMsg)
+	forwardedCreatedMsg := tunnelCreatedMsgFromRelayTunnelExtendedMsg(&extendedMsg)
+	s, err := h.finish(&forwardedCreatedMsg)
+	require.Nil(t, err)
+	assert.Equal(t, hopSession.key, s.key)
+
+	// a relay message encrypted by the initiator is recognized by the hop
+	forward, _ := p2p.NewRelayDigests(&s.key)
+	hopForward, _ := p2p.NewRelayDigests(&hopSession.key)
+	buf := make([]byte, p2p.RelayMessageSize)
+	_, n, err := p2p.PackRelayMessage(buf, 41, &p2p.RelayTunnelData{Data: []byte("payload")}, forward)
+	require.Nil(t, err)
+	encMsg, err := s.cipher.encrypt(buf[:n])
+	require.Nil(t, err)
+	assert.Equal(t, buf[:p2p.RelayCounterSize], encMsg[:p2p.RelayCounterSize], "the counter must not be encrypted")
+	assert.NotEqual(t, buf[:n], encMsg)
+
+	ok, msg, err := decryptRelay(hopSession.cipher, encMsg, hopForward)
+	require.Nil(t, err)
+	require.True(t, ok)
+	assert.Equal(t, buf[:n], msg)
+
+	s.cipher.close()
+	hopSession.cipher.close()
+	assert.Len(t, client.closed, 2)
+}
+
+func TestAuthHandshakeNotConfigured(t *testing.T) {
+	h, err := startAuthHandshake(&mockAuth{}, nil)
+	require.Nil(t, err)
+
+	_, _, err = handleTunnelCreate(rand.Reader, h.createMsg(), &config.Config{}, nil, nil)
+	assert.Equal(t, ErrInvalidProtocolVersion, err)
+}
+
+func TestAuthHandshakeMisbehavingPeer(t *testing.T) {
+	client := &mockAuth{}
+	h, err := startAuthHandshake(client, nil)
+	require.Nil(t, err)
+
+	// the hop replies with a Diffie-Hellman handshake
+	_, err = h.finish(&p2p.TunnelCreated{})
+	assert.Equal(t, ErrMisbehavingPeer, err)
+	assert.Equal(t, []uint16{1}, client.closed)
+}
+
+func TestHandshakeNegotiation(t *testing.T) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	require.Nil(t, err)
+	hop := &rps.Peer{HostKey: &hostKey.PublicKey}
+	hopCfg := &config.Config{HostKey: hostKey, Exit: true}
+
+	t.Run("retry with another version", func(t *testing.T) {
+		client := &mockAuth{}
+		router := newRouter(&config.Config{}, WithRPS(&mockRPS{}), WithAuth(client))
+
+		// the hop does not support handshakes by the Onion Auth module
+		var versions []uint8
+		s, err := router.handshake(hop, 0, false, func(createMsg *p2p.TunnelCreate) (*p2p.TunnelCreated, error) {
+			versions = append(versions, createMsg.Version)
+			assert.Equal(t, p2p.NewVersionSet(p2p.HandshakeVersionDH, p2p.HandshakeVersionAuth,
+				p2p.HandshakeVersionDHOAEP), createMsg.Versions)
+
+			// the messages are relayed in extend messages
+			extendMsg := relayTunnelExtendMsgFromTunnelCreateMsg(createMsg, net.IPv4(1, 2, 3, 4), 1)
+			forwardedCreateMsg := tunnelCreateMsgFromRelayTunnelExtendMsg(&extendMsg)
+			_, createdMsg, err := handleTunnelCreate(rand.Reader, &forwardedCreateMsg, hopCfg, nil, nil)
+			require.Nil(t, err)
+			extendedMsg := relayTunnelExtendedMsgFromTunnelCreatedMsg(createdMsg)
+			forwardedCreatedMsg := tunnelCreatedMsgFromRelayTunnelExtendedMsg(&extendedMsg)
+			return &forwardedCreatedMsg, nil
+		})
+		require.Nil(t, err)
+		assert.Equal(t, []uint8{p2p.HandshakeVersionAuth, p2p.HandshakeVersionDHOAEP}, versions)
+		assert.Equal(t, p2p.CapabilityExit|p2p.CapabilityTimestamp|p2p.CapabilityCipherSuites|p2p.CapabilityOpened|
+			p2p.CapabilityMultipath|p2p.CapabilityBatch|p2p.CapabilitySizedKeys|p2p.CapabilityOAEP, s.capabilities)
+		assert.IsType(t, &keyCipher{}, s.cipher)
+		assert.Equal(t, []uint16{1}, client.closed, "the aborted session must be closed")
+	})
+
+	t.Run("sized key", func(t *testing.T) {
+		smallKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.Nil(t, err)
+		router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+
+		// hops not supporting RSA-OAEP ask to retry with the legacy version fitting the key, which prefixes the key
+		// encrypted for a 2048 bit host key by its size, also when relayed
+		var versions []uint8
+		s, err := router.handshake(&rps.Peer{HostKey: &smallKey.PublicKey}, 0, false,
+			func(createMsg *p2p.TunnelCreate) (*p2p.TunnelCreated, error) {
+				versions = append(versions, createMsg.Version)
+				assert.Equal(t, p2p.NewVersionSet(p2p.HandshakeVersionDHSized, p2p.HandshakeVersionDHOAEP),
+					createMsg.Versions)
+				if createMsg.Version == p2p.HandshakeVersionDHOAEP {
+					return &p2p.TunnelCreated{Retry: true, Version: p2p.HandshakeVersionDHSized}, nil
+				}
+				extendMsg := relayTunnelExtendMsgFromTunnelCreateMsg(createMsg, net.IPv4(1, 2, 3, 4), 1)
+				require.True(t, extendMsg.SizedKey())
+				forwardedCreateMsg := tunnelCreateMsgFromRelayTunnelExtendMsg(&extendMsg)
+				_, createdMsg, err := handleTunnelCreate(rand.Reader, &forwardedCreateMsg,
+					&config.Config{HostKey: smallKey}, nil, nil)
+				require.Nil(t, err)
+				return createdMsg, nil
+			})
+		require.Nil(t, err)
+		assert.Equal(t, []uint8{p2p.HandshakeVersionDHOAEP, p2p.HandshakeVersionDHSized}, versions)
+		assert.IsType(t, &keyCipher{}, s.cipher)
+
+		// the legacy version does not fit the key, thus it is not offered
+		_, err = router.handshake(&rps.Peer{HostKey: &smallKey.PublicKey}, 0, false,
+			func(createMsg *p2p.TunnelCreate) (*p2p.TunnelCreated, error) {
+				return &p2p.TunnelCreated{Retry: true, Version: p2p.HandshakeVersionDH}, nil
+			})
+		assert.Equal(t, ErrMisbehavingPeer, err)
+	})
+
+	t.Run("legacy hop", func(t *testing.T) {
+		router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+
+		s, err := router.handshake(hop, 0, false, func(createMsg *p2p.TunnelCreate) (*p2p.TunnelCreated, error) {
+			createMsg.Versions = 0
+			_, createdMsg, err := handleTunnelCreate(rand.Reader, createMsg, hopCfg, nil, nil)
+			require.Nil(t, err)
+			assert.Equal(t, uint8(0), createdMsg.Version)
+			return createdMsg, nil
+		})
+		require.Nil(t, err)
+		assert.Equal(t, legacyCapabilities, s.capabilities)
+	})
+
+	t.Run("oaep only", func(t *testing.T) {
+		router := newRouter(&config.Config{OAEPOnly: true}, WithRPS(&mockRPS{}))
+		oaepCfg := &config.Config{HostKey: hostKey, OAEPOnly: true}
+
+		// the key is encrypted with RSA-OAEP, also when relayed
+		s, err := router.handshake(hop, 0, false, func(createMsg *p2p.TunnelCreate) (*p2p.TunnelCreated, error) {
+			assert.Equal(t, uint8(p2p.HandshakeVersionDHOAEP), createMsg.Version)
+			assert.Equal(t, p2p.NewVersionSet(p2p.HandshakeVersionDHOAEP), createMsg.Versions)
+			extendMsg := relayTunnelExtendMsgFromTunnelCreateMsg(createMsg, net.IPv4(1, 2, 3, 4), 1)
+			require.True(t, extendMsg.OAEP)
+			forwardedCreateMsg := tunnelCreateMsgFromRelayTunnelExtendMsg(&extendMsg)
+			_, createdMsg, err := handleTunnelCreate(rand.Reader, &forwardedCreateMsg, oaepCfg, nil, nil)
+			require.Nil(t, err)
+			return createdMsg, nil
+		})
+		require.Nil(t, err)
+		assert.IsType(t, &keyCipher{}, s.cipher)
+
+		// initiators offering RSA-OAEP are asked to retry with it, others are refused
+		_, createMsg, err := tunnelCreateMsg(rand.Reader, &hostKey.PublicKey, p2p.HandshakeVersionDH, 0)
+		require.Nil(t, err)
+		createMsg.Versions = p2p.NewVersionSet(p2p.HandshakeVersionDH, p2p.HandshakeVersionDHOAEP)
+		_, createdMsg, err := handleTunnelCreate(rand.Reader, createMsg, oaepCfg, nil, nil)
+		require.Nil(t, err)
+		assert.Equal(t, &p2p.TunnelCreated{Retry: true, Version: p2p.HandshakeVersionDHOAEP,
+			Capabilities: capabilities(oaepCfg)}, createdMsg)
+
+		createMsg.Versions = p2p.NewVersionSet(p2p.HandshakeVersionDH)
+		_, _, err = handleTunnelCreate(rand.Reader, createMsg, oaepCfg, nil, nil)
+		assert.Equal(t, ErrInvalidProtocolVersion, err)
+	})
+
+	t.Run("no common version", func(t *testing.T) {
+		createMsg := &p2p.TunnelCreate{Version: 5, Versions: p2p.NewVersionSet(5)}
+		_, _, err := handleTunnelCreate(rand.Reader, createMsg, hopCfg, nil, nil)
+		assert.Equal(t, ErrInvalidProtocolVersion, err)
+	})
+
+	t.Run("misbehaving hop", func(t *testing.T) {
+		router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+
+		// the hop asks to retry with the version it was just offered
+		_, err := router.handshake(hop, 0, false, func(createMsg *p2p.TunnelCreate) (*p2p.TunnelCreated, error) {
+			return &p2p.TunnelCreated{Retry: true, Version: createMsg.Version}, nil
+		})
+		assert.Equal(t, ErrMisbehavingPeer, err)
+	})
+}
+
+func TestCipherSuiteNegotiation(t *testing.T) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	require.Nil(t, err)
+	hop := &rps.Peer{HostKey: &hostKey.PublicKey}
+
+	// handshake performs a handshake of the initiator with the given suites with a hop with the given suites, returning
+	// the sessions of both
+	handshake := func(suites, hopSuites []string, legacyHop bool) (s, hopSession *session, err error) {
+		router := newRouter(&config.Config{CipherSuites: suites}, WithRPS(&mockRPS{}))
+		hopCfg := &config.Config{HostKey: hostKey, CipherSuites: hopSuites}
+		s, err = router.handshake(hop, 0, false, func(createMsg *p2p.TunnelCreate) (*p2p.TunnelCreated, error) {
+			if legacyHop {
+				createMsg.Versions = 0
+			}
+
+			// the messages are relayed in extend messages
+			extendMsg := relayTunnelExtendMsgFromTunnelCreateMsg(createMsg, net.IPv4(1, 2, 3, 4), 1)
+			forwardedCreateMsg := tunnelCreateMsgFromRelayTunnelExtendMsg(&extendMsg)
+			var createdMsg *p2p.TunnelCreated
+			hopSession, createdMsg, err = handleTunnelCreate(rand.Reader, &forwardedCreateMsg, hopCfg, nil, nil)
+			if err != nil {
+				return nil, err
+			}
+			extendedMsg := relayTunnelExtendedMsgFromTunnelCreatedMsg(createdMsg)
+			forwardedCreatedMsg := tunnelCreatedMsgFromRelayTunnelExtendedMsg(&extendedMsg)
+			return &forwardedCreatedMsg, nil
+		})
+		return s, hopSession, err
+	}
+
+	suiteOf := func(s *session) p2p.CipherSuite {
+		return s.cipher.(*keyCipher).relay.Suite()
+	}
+
+	t.Run("preferred by the hop", func(t *testing.T) {
+		s, hopSession, err := handshake(nil, []string{config.CipherSuiteAESGCM, config.CipherSuiteChaCha20Poly1305}, false)
+		require.Nil(t, err)
+		assert.Equal(t, p2p.CipherSuiteAESGCM, suiteOf(s))
+		assert.Equal(t, p2p.CipherSuiteAESGCM, suiteOf(hopSession))
+
+		// messages are exchanged in both directions
+		forward, backward := p2p.NewRelayDigests(&s.key)
+		hopForward, hopBackward := p2p.NewRelayDigests(&hopSession.key)
+		buf := make([]byte, p2p.RelayMessageSize)
+		_, n, err := p2p.PackRelayMessage(buf, 1, &p2p.RelayTunnelData{Data: []byte("forward")}, forward)
+		require.Nil(t, err)
+		encMsg, err := s.cipher.seal(buf[:n])
+		require.Nil(t, err)
+		ok, msg, err := hopSession.cipher.open(encMsg, hopForward)
+		require.Nil(t, err)
+		require.True(t, ok)
+		assert.Equal(t, buf[:n], msg)
+
+		_, n, err = p2p.PackRelayMessage(buf, 1, &p2p.RelayTunnelData{Data: []byte("backward")}, hopBackward)
+		require.Nil(t, err)
+		encMsg, err = hopSession.cipher.seal(buf[:n])
+		require.Nil(t, err)
+		ok, msg, err = s.cipher.open(encMsg, backward)
+		require.Nil(t, err)
+		require.True(t, ok)
+		assert.Equal(t, buf[:n], msg)
+	})
+
+	t.Run("default", func(t *testing.T) {
+		s, hopSession, err := handshake(nil, nil, false)
+		require.Nil(t, err)
+		assert.Equal(t, p2p.CipherSuiteChaCha20Poly1305, suiteOf(s))
+		assert.Equal(t, p2p.CipherSuiteChaCha20Poly1305, suiteOf(hopSession))
+	})
+
+	t.Run("legacy hop", func(t *testing.T) {
+		s, hopSession, err := handshake(nil, nil, true)
+		require.Nil(t, err)
+		assert.Equal(t, p2p.CipherSuiteAESCTR, suiteOf(s))
+		assert.Equal(t, p2p.CipherSuiteAESCTR, suiteOf(hopSession))
+
+		// the legacy suite may be disabled by the initiator
+		_, _, err = handshake([]string{config.CipherSuiteAESGCM}, nil, true)
+		assert.Equal(t, ErrNoCipherSuite, err)
+	})
+
+	t.Run("no common suite", func(t *testing.T) {
+		_, _, err := handshake([]string{config.CipherSuiteAESGCM}, []string{config.CipherSuiteChaCha20Poly1305}, false)
+		assert.Equal(t, ErrNoCipherSuite, err)
+
+		// nor with initiators not negotiating
+		createMsg := &p2p.TunnelCreate{Version: p2p.HandshakeVersionDH}
+		_, err = selectCipherSuite(createMsg, &config.Config{CipherSuites: []string{config.CipherSuiteAESGCM}})
+		assert.Equal(t, ErrNoCipherSuite, err)
+	})
+
+	t.Run("misbehaving hop", func(t *testing.T) {
+		router := newRouter(&config.Config{CipherSuites: []string{config.CipherSuiteAESGCM}}, WithRPS(&mockRPS{}))
+		hopCfg := &config.Config{HostKey: hostKey}
+
+		// the hop picks a suite which was not offered
+		_, err := router.handshake(hop, 0, false, func(createMsg *p2p.TunnelCreate) (*p2p.TunnelCreated, error) {
+			createMsg.CipherSuites = p2p.NewCipherSuiteSet(p2p.CipherSuiteChaCha20Poly1305)
+			_, createdMsg, err := handleTunnelCreate(rand.Reader, createMsg, hopCfg, nil, nil)
+			require.Nil(t, err)
+			return createdMsg, nil
+		})
+		assert.Equal(t, ErrMisbehavingPeer, err)
+	})
+}
+
+func TestWipeKeys(t *testing.T) {
+	t.Run("key cipher", func(t *testing.T) {
+		key := [32]byte{1, 2, 3}
+		cipher := newKeyCipher(&key)
+		msg := make([]byte, p2p.RelayMessageSize)
+		_, err := cipher.encrypt(msg)
+		require.Nil(t, err)
+
+		cipher.close()
+		assert.Equal(t, [32]byte{}, key)
+		_, err = cipher.encrypt(msg)
+		assert.Equal(t, errSessionClosed, err)
+		_, err = cipher.decrypt(msg)
+		assert.Equal(t, errSessionClosed, err)
+	})
+
+	t.Run("tunnel", func(t *testing.T) {
+		tunnel := Tunnel{id: 1}
+		keys := make([][32]byte, 3)
+		for i := range keys {
+			keys[i] = [32]byte{byte(i + 1)}
+			tunnel.addHop(&rps.Peer{DHShared: keys[i]}, newKeyCipher(&keys[i]))
+		}
+
+		tunnel.closeSessions()
+		for i, hop := range tunnel.hops {
+			assert.Equal(t, [32]byte{}, hop.DHShared)
+			assert.Equal(t, [32]byte{}, keys[i])
+		}
+	})
+
+	t.Run("DH handshake", func(t *testing.T) {
+		hostKey, err := rsa.GenerateKey(rand.Reader, 4096)
+		require.Nil(t, err)
+		hopCfg := &config.Config{HostKey: hostKey}
+
+		h, err := startDHHandshake(rand.Reader, &hostKey.PublicKey, p2p.HandshakeVersionDH, 0)
+		require.Nil(t, err)
+		hopSession, createdMsg, err := handleTunnelCreate(rand.Reader, h.createMsg(), hopCfg, nil, nil)
+		require.Nil(t, err)
+		s, err := h.finish(createdMsg)
+		require.Nil(t, err)
+		assert.Equal(t, [32]byte{}, *h.privDH, "the private key must be wiped once the key is derived")
+		assert.NotEqual(t, [32]byte{}, s.key)
+
+		s.cipher.close()
+		hopSession.cipher.close()
+		assert.Equal(t, [32]byte{}, s.key)
+		assert.Equal(t, [32]byte{}, hopSession.key)
+
+		// the private key of an aborted handshake is wiped as well
+		h, err = startDHHandshake(rand.Reader, &hostKey.PublicKey, p2p.HandshakeVersionDH, 0)
+		require.Nil(t, err)
+		h.abort()
+		assert.Equal(t, [32]byte{}, *h.privDH)
+	})
+}
+
+func TestAuthCipherSize(t *testing.T) {
+	cipher := &authCipher{client: &mockAuth{resize: true}, sessionID: 1}
+
+	_, err := cipher.encrypt(make([]byte, p2p.RelayMessageSize))
+	assert.Equal(t, errAuthCipherSize, err)
+	_, err = cipher.decrypt(make([]byte, p2p.RelayMessageSize))
+	assert.Equal(t, errAuthCipherSize, err)
+}
+
+func TestEncryptDecryptRelayMsgAuth(t *testing.T) {
+	client := &mockAuth{}
+	tunnel := Tunnel{id: 1234}
+	for i := 1; i <= 3; i++ {
+		hop := &rps.Peer{DHShared: [32]byte{byte(i)}}
+		tunnel.addHop(hop, &authCipher{client: client, sessionID: uint16(i)})
+	}
+
+	// the last hop sends the message back to us
+	_, lastHopDigest := p2p.NewRelayDigests(&tunnel.hops[2].DHShared)
+	buf := make([]byte, p2p.RelayMessageSize)
+	_, n, err := p2p.PackRelayMessage(buf, 123, &p2p.RelayTunnelData{Data: []byte("asdf1234")}, lastHopDigest)
+	require.Nil(t, err)
+
+	encryptedMsg, err := tunnel.EncryptRelayMsg(buf[:n])
+	require.Nil(t, err)
+
+	_, decryptedMsg, ok, err := tunnel.DecryptRelayMessage(encryptedMsg)
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	decryptedDataMsg := p2p.RelayTunnelData{}
+	require.Nil(t, decryptedDataMsg.Parse(decryptedMsg))
+	assert.Equal(t, []byte("asdf1234"), decryptedDataMsg.Data)
+
+	tunnel.closeSessions()
+	assert.Equal(t, []uint16{1, 2, 3}, client.closed)
+}
@@ -0,0 +1,165 @@
+package onion
+
+import (
+	"sync"
+
+	"bawang/p2p"
+)
+
+// datagramQueueSize is the maximum number of datagrams queued per tunnel.
+// If more datagrams are queued, the oldest ones are dropped.
+const datagramQueueSize = 32
+
+// datagramQueue is a bounded queue of datagrams waiting to be sent on a tunnel.
+// When the queue is full, the oldest datagram is dropped to make room for the new one, since jitter-sensitive
+// applications prefer fresh datagrams over stale ones.
+// The zero value is an empty queue ready to use.
+type datagramQueue struct {
+	lock    sync.Mutex
+	queue   [][]byte
+	signal  chan struct{} // receives a value when datagrams were pushed, created lazily
+	dropped uint64
+}
+
+// signalChan returns the signal channel of the queue. q.lock must be held.
+func (q *datagramQueue) signalChan() chan struct{} {
+	if q.signal == nil {
+		q.signal = make(chan struct{}, 1)
+	}
+	return q.signal
+}
+
+// push appends a datagram to the queue, dropping the oldest queued datagram if the queue is full.
+func (q *datagramQueue) push(data []byte) (dropped bool) {
+	q.lock.Lock()
+	if len(q.queue) >= datagramQueueSize {
+		q.queue[0] = nil
+		q.queue = q.queue[1:]
+		q.dropped++
+		dropped = true
+	}
+	q.queue = append(q.queue, data)
+	signal := q.signalChan()
+	q.lock.Unlock()
+
+	select {
+	case signal <- struct{}{}:
+	default: // already signaled
+	}
+
+	return dropped
+}
+
+// pop removes and returns the oldest queued datagram. ok is false if the queue is empty.
+func (q *datagramQueue) pop() (data []byte, ok bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.queue) == 0 {
+		return nil, false
+	}
+	data = q.queue[0]
+	q.queue[0] = nil
+	q.queue = q.queue[1:]
+	return data, true
+}
+
+// ready returns a channel receiving a value whenever datagrams were pushed to the queue.
+func (q *datagramQueue) ready() <-chan struct{} {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.signalChan()
+}
+
+// numDropped returns the number of datagrams dropped so far because the queue was full.
+func (q *datagramQueue) numDropped() uint64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.dropped
+}
+
+// startDatagramSender starts a goroutine sending the datagrams pushed to the queue with the given send function.
+// Datagrams which can not be sent are dropped. The returned stop function must be called to stop the goroutine.
+func (r *Router) startDatagramSender(q *datagramQueue, send func(msg p2p.RelayMessage) error) (stop func()) {
+	quit := make(chan struct{})
+	ready := q.ready()
+
+	go func() {
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ready:
+			}
+
+			for {
+				data, ok := q.pop()
+				if !ok {
+					break
+				}
+				err := send(&p2p.RelayTunnelDatagram{Data: data})
+				if err != nil {
+					r.logger.Printf("Dropping datagram: %v\n", err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+	}
+}
+
+// SendDatagram sends a datagram through the tunnel with the given ID.
+// In contrast to SendData, the datagram is queued and sent asynchronously. If the tunnel can not keep up, the oldest
+// queued datagrams are dropped.
+func (r *Router) SendDatagram(tunnelID uint32, payload []byte) (err error) {
+	if len(payload) > p2p.MaxRelayDataSize {
+		return p2p.ErrInvalidMessage
+	}
+
+	// the payload is sent asynchronously, thus we must make a copy
+	data := make([]byte, len(payload))
+	copy(data, payload)
+
+	var q *datagramQueue
+	var sendClosed *halfClose
+	r.tunnelsLock.RLock()
+	if tunnel, ok := r.outgoingTunnels[tunnelID]; ok {
+		tunnel.activity.touch(r.clock.Now())
+		q, sendClosed = &tunnel.datagrams, &tunnel.sendClosed
+	} else if tunnelSegment, ok := r.incomingTunnels[tunnelID]; ok {
+		q, sendClosed = &tunnelSegment.datagrams, &tunnelSegment.sendClosed
+	} else if otherEnd, ok := r.loopbacks[tunnelID]; ok {
+		r.tunnelsLock.RUnlock()
+		return r.notifyClients(otherEnd, func(client Client) error {
+			if !subscribed(client, SubscribeData) {
+				return nil
+			}
+			return client.SendTunnelDatagram(otherEnd, data)
+		})
+	}
+	r.tunnelsLock.RUnlock()
+
+	if q == nil {
+		return ErrInvalidTunnel
+	}
+	if sendClosed.isClosed() {
+		return ErrSendClosed
+	}
+
+	if q.push(data) {
+		r.logger.Printf("Datagram queue of tunnel %v full, dropped oldest datagram\n", tunnelID)
+	}
+	return nil
+}
+
+// sendDatagramToClients passes a datagram received on a tunnel to all clients registered on it.
+func (r *Router) sendDatagramToClients(tunnelID uint32, data []byte) (err error) {
+	return r.notifyClients(tunnelID, func(client Client) error {
+		if !subscribed(client, SubscribeData) {
+			return nil
+		}
+		return client.SendTunnelDatagram(tunnelID, data)
+	})
+}
@@ -0,0 +1,112 @@
+package onion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+)
+
+func TestDatagramQueue(t *testing.T) {
+	t.Run("order", func(t *testing.T) {
+		q := datagramQueue{}
+		_, ok := q.pop()
+		require.False(t, ok)
+
+		require.False(t, q.push([]byte{1}))
+		require.False(t, q.push([]byte{2}))
+
+		select {
+		case <-q.ready():
+		default:
+			t.Fatal("queue was not signaled")
+		}
+
+		data, ok := q.pop()
+		require.True(t, ok)
+		assert.Equal(t, []byte{1}, data)
+		data, ok = q.pop()
+		require.True(t, ok)
+		assert.Equal(t, []byte{2}, data)
+		_, ok = q.pop()
+		require.False(t, ok)
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		q := datagramQueue{}
+		for i := 0; i < datagramQueueSize; i++ {
+			require.False(t, q.push([]byte{byte(i)}))
+		}
+		require.True(t, q.push([]byte{0xff}))
+		assert.Equal(t, uint64(1), q.numDropped())
+
+		data, ok := q.pop()
+		require.True(t, ok)
+		assert.Equal(t, []byte{1}, data)
+
+		for i := 2; i < datagramQueueSize; i++ {
+			_, ok = q.pop()
+			require.True(t, ok)
+		}
+		data, ok = q.pop()
+		require.True(t, ok)
+		assert.Equal(t, []byte{0xff}, data)
+	})
+}
+
+func TestRouterSendDatagram(t *testing.T) {
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+
+	t.Run("invalid tunnel", func(t *testing.T) {
+		err := router.SendDatagram(42, []byte{1, 2, 3})
+		require.Equal(t, ErrInvalidTunnel, err)
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		err := router.SendDatagram(42, make([]byte, p2p.MaxRelayDataSize+1))
+		require.Equal(t, p2p.ErrInvalidMessage, err)
+	})
+
+	t.Run("incoming tunnel", func(t *testing.T) {
+		link, connRemote := newPipeLink()
+		defer connRemote.Close()
+		tunnel := &tunnelSegment{
+			prevHopTunnelID: 42,
+			tunnelID:        42,
+			prevHopLink:     link,
+			dhShared:        &[32]byte{1, 2, 3},
+		}
+		initiator := newInitiatorEnd(connRemote, tunnel)
+		router.tunnelsLock.Lock()
+		router.incomingTunnels[tunnel.tunnelID] = tunnel
+		router.tunnelsLock.Unlock()
+
+		stop := router.startDatagramSender(&tunnel.datagrams, func(msg p2p.RelayMessage) error {
+			return tunnel.sendRelayToPrevHop(msg)
+		})
+		defer stop()
+
+		payload := []byte("datagram")
+		err := router.SendDatagram(tunnel.prevHopTunnelID, payload)
+		require.Nil(t, err)
+		payload[0] = 'D' // the datagram must have been copied
+
+		received := make(chan []byte)
+		go func() {
+			hdr, body := readRelayFromPrevHop(t, initiator)
+			assert.Equal(t, p2p.RelayTypeTunnelDatagram, hdr.RelayType)
+			received <- body
+		}()
+
+		select {
+		case body := <-received:
+			assert.Equal(t, []byte("datagram"), body)
+		case <-time.After(time.Second):
+			t.Fatal("datagram was not sent")
+		}
+	})
+}
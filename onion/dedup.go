@@ -0,0 +1,80 @@
+package onion
+
+import (
+	"time"
+)
+
+// identifyLink records the identity the adjacent peer announced on the given link along with the P2P port it accepts
+// links on, see p2p.LinkFeatureIdentity. Links accepted from the peer are indexed by that port from then on instead of
+// the port the peer connected from, such that GetLink reuses them for tunnels through the peer. Since the port is only
+// claimed by the peer, this requires the peer to have presented its host key on the link, which Router.verifyHop
+// checks before the link is used for a hop. Duplicate links opened by both peers at the same time are retired, see
+// retireDuplicateLinks.
+func (r *Router) identifyLink(link *Link, port uint16, identity uint64) {
+	if identity == 0 {
+		return
+	}
+
+	r.linksLock.Lock()
+	defer r.linksLock.Unlock()
+
+	// a removed link must not be indexed again
+	if link.isClosed() {
+		return
+	}
+
+	link.identity = identity
+	if link.incoming && link.hostKey == nil {
+		// the TLS handshake is complete once the peer's announcement was received
+		link.hostKey = peerHostKey(link.nc)
+	}
+	key := newLinkKey(link.address, port)
+	if link.incoming && link.hostKey != nil && port != 0 && key != link.key && r.unindexLink(link) {
+		link.key = key
+		r.links[key] = append(r.links[key], link)
+	}
+	r.retireDuplicateLinks(link.key, identity)
+}
+
+// retireDuplicateLinks retires the links to the peer with the given identity which were opened by the peer with the
+// higher identity, once links opened by both peers exist. Since both peers come to the same decision, they keep using
+// the same links. Retired links are not used for further tunnels and closed once their tunnels are gone, such that the
+// tunnels using them are not interrupted. Multiple links opened by the same peer are no duplicates, since further
+// links are opened once a link carries Config.MaxLinkTunnels.
+// Must be called with r.linksLock hold.
+func (r *Router) retireDuplicateLinks(key linkKey, identity uint64) {
+	// e.g. both ends of a link to ourselves
+	if identity == r.linkIdentity {
+		return
+	}
+
+	var outgoing, incoming []*Link
+	for _, link := range r.links[key] {
+		if link.identity != identity || link.retired || link.isClosed() {
+			continue
+		}
+		if link.incoming {
+			incoming = append(incoming, link)
+		} else {
+			outgoing = append(outgoing, link)
+		}
+	}
+	if len(outgoing) == 0 || len(incoming) == 0 {
+		return
+	}
+
+	// the links opened by the peer with the lower identity are kept
+	retired := incoming
+	if r.linkIdentity > identity {
+		retired = outgoing
+	}
+	for _, link := range retired {
+		r.logger.Printf("Retiring duplicate link to peer %v:%v\n", key.address, key.port)
+		link.retired = true
+		if link.isUnused() {
+			delete(r.idleLinks, link)
+			link.idleSince = time.Time{}
+			link.Close()
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package onion
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+)
+
+func TestRouterDedupLinks(t *testing.T) {
+	const peerIdentity = 100
+	peerHostKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+
+	newDedupRouter := func(identity uint64) *Router {
+		router := newRouter(&config.Config{DedupLinks: true}, WithRPS(&mockRPS{}))
+		router.linkIdentity = identity
+		return router
+	}
+	// the peer presented its host key on all links, see tlsTransport.clientCertificate
+	newDedupLink := func(router *Router, port uint16, incoming bool) *Link {
+		link := &Link{
+			address:  net.ParseIP("10.0.0.1"),
+			port:     port,
+			incoming: incoming,
+			hostKey:  &peerHostKey.PublicKey,
+			dataOut:  make(map[uint32]chan message),
+			Quit:     make(chan struct{}),
+		}
+		router.addLink(link)
+		return link
+	}
+
+	t.Run("incoming link reused", func(t *testing.T) {
+		router := newDedupRouter(1)
+		incoming := newDedupLink(router, 40000, true)
+		router.identifyLink(incoming, 4000, peerIdentity)
+
+		// the link is found by the port the peer accepts links on
+		link, ok := router.GetLink(incoming.address, 4000)
+		require.True(t, ok)
+		assert.Equal(t, incoming, link)
+		_, ok = router.GetLink(incoming.address, 40000)
+		assert.False(t, ok)
+
+		router.removeLink(incoming)
+		assert.Empty(t, router.links)
+		assert.Zero(t, router.numLinks)
+	})
+
+	t.Run("unverified incoming link", func(t *testing.T) {
+		router := newDedupRouter(1)
+		incoming := newDedupLink(router, 40000, true)
+		incoming.hostKey = nil
+		router.identifyLink(incoming, 4000, peerIdentity)
+
+		// the claimed port is not trusted without the peer's host key, which would bypass verifyHop
+		_, ok := router.GetLink(incoming.address, 4000)
+		assert.False(t, ok)
+		_, ok = router.GetLink(incoming.address, 40000)
+		assert.True(t, ok)
+	})
+
+	t.Run("incoming link retired", func(t *testing.T) {
+		router := newDedupRouter(peerIdentity - 1)
+		outgoing := newDedupLink(router, 4000, false)
+		incoming := newDedupLink(router, 40000, true)
+		router.identifyLink(outgoing, 4000, peerIdentity)
+		router.identifyLink(incoming, 4000, peerIdentity)
+
+		// the peer with the lower identity keeps the link it opened
+		assert.True(t, incoming.retired)
+		assert.True(t, incoming.isClosed())
+		assert.False(t, outgoing.retired)
+		assert.False(t, outgoing.isClosed())
+	})
+
+	t.Run("outgoing link retired", func(t *testing.T) {
+		router := newDedupRouter(peerIdentity + 1)
+		outgoing := newDedupLink(router, 4000, false)
+		require.Nil(t, router.registerCircuit(outgoing, 1, make(chan message, 1)))
+		incoming := newDedupLink(router, 40000, true)
+		router.identifyLink(incoming, 4000, peerIdentity)
+		router.identifyLink(outgoing, 4000, peerIdentity)
+
+		// retired links are not used for further tunnels
+		assert.True(t, outgoing.retired)
+		link, ok := router.GetLink(outgoing.address, 4000)
+		require.True(t, ok)
+		assert.Equal(t, incoming, link)
+
+		// but kept until their tunnels are gone
+		assert.False(t, outgoing.isClosed())
+		router.removeTunnelFromLinks(1)
+		assert.True(t, outgoing.isClosed())
+		assert.NotContains(t, router.idleLinks, outgoing)
+	})
+
+	t.Run("same direction", func(t *testing.T) {
+		router := newDedupRouter(peerIdentity + 1)
+		first := newDedupLink(router, 4000, false)
+		second := newDedupLink(router, 4000, false)
+		router.identifyLink(first, 4000, peerIdentity)
+		router.identifyLink(second, 4000, peerIdentity)
+
+		assert.False(t, first.retired)
+		assert.False(t, second.retired)
+	})
+
+	t.Run("other peer", func(t *testing.T) {
+		router := newDedupRouter(peerIdentity + 1)
+		outgoing := newDedupLink(router, 4000, false)
+		incoming := newDedupLink(router, 40000, true)
+		router.identifyLink(outgoing, 4000, peerIdentity)
+		router.identifyLink(incoming, 4000, peerIdentity+2)
+
+		assert.False(t, outgoing.retired)
+		assert.False(t, incoming.retired)
+	})
+
+	t.Run("no identity", func(t *testing.T) {
+		router := newDedupRouter(1)
+		incoming := newDedupLink(router, 40000, true)
+		router.identifyLink(incoming, 4000, 0)
+
+		assert.Zero(t, incoming.identity)
+		_, ok := router.GetLink(incoming.address, 40000)
+		assert.True(t, ok)
+	})
+
+	t.Run("closed link", func(t *testing.T) {
+		router := newDedupRouter(1)
+		incoming := newDedupLink(router, 40000, true)
+		incoming.Close()
+		router.removeLink(incoming)
+		router.identifyLink(incoming, 4000, peerIdentity)
+
+		assert.Empty(t, router.links)
+	})
+}
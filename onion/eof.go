@@ -0,0 +1,64 @@
+package onion
+
+import (
+	"sync/atomic"
+
+	"bawang/errcode"
+	"bawang/p2p"
+)
+
+var (
+	ErrSendClosed = errcode.New(errcode.ModuleOnion, errcode.NotAllowed, false,
+		"sending on the tunnel was already finished")
+)
+
+// halfClose tracks whether the local end of a tunnel finished sending. It is safe for concurrent use.
+type halfClose struct {
+	closed int32 // accessed atomically
+}
+
+// close marks the local end as finished sending. It returns false if it was already marked before.
+func (h *halfClose) close() bool {
+	return atomic.CompareAndSwapInt32(&h.closed, 0, 1)
+}
+
+// isClosed checks whether the local end finished sending.
+func (h *halfClose) isClosed() bool {
+	return atomic.LoadInt32(&h.closed) != 0
+}
+
+// SendEOF signals the remote end of the tunnel with the given ID that we finished sending, while we still receive
+// data on the tunnel. Afterwards no more data or datagrams may be sent on the tunnel.
+func (r *Router) SendEOF(tunnelID uint32) (err error) {
+	r.tunnelsLock.RLock()
+	tunnel, isOutgoing := r.outgoingTunnels[tunnelID]
+	tunnelSegment, isIncoming := r.incomingTunnels[tunnelID]
+	otherEnd, isLoopback := r.loopbacks[tunnelID]
+	r.tunnelsLock.RUnlock()
+
+	switch {
+	case isOutgoing:
+		if !tunnel.sendClosed.close() {
+			return ErrSendClosed
+		}
+		r.flushBatch(&tunnel.batch, tunnel.sendRelayToLastHop)
+		return tunnel.sendRelayToLastHop(&p2p.RelayTunnelEOF{})
+	case isIncoming:
+		if !tunnelSegment.sendClosed.close() {
+			return ErrSendClosed
+		}
+		r.flushBatch(&tunnelSegment.batch, tunnelSegment.sendRelayToPrevHop)
+		return tunnelSegment.sendRelayToPrevHop(&p2p.RelayTunnelEOF{})
+	case isLoopback:
+		return r.sendEOFToClients(otherEnd)
+	default:
+		return ErrInvalidTunnel
+	}
+}
+
+// sendEOFToClients announces to all clients registered on the tunnel that the remote end finished sending.
+func (r *Router) sendEOFToClients(tunnelID uint32) (err error) {
+	return r.notifyClients(tunnelID, func(client Client) error {
+		return client.SendTunnelEOF(tunnelID)
+	})
+}
@@ -0,0 +1,56 @@
+package onion
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+)
+
+func TestRouterSendEOF(t *testing.T) {
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+
+	link, connRemote := newPipeLink()
+	defer connRemote.Close()
+	tunnel := &tunnelSegment{
+		prevHopTunnelID: 42,
+		tunnelID:        42,
+		prevHopLink:     link,
+		dhShared:        &[32]byte{1, 2, 3},
+	}
+	initiator := newInitiatorEnd(connRemote, tunnel)
+	router.incomingTunnels[42] = tunnel
+
+	var eofTunnelID uint32
+	client := &ClientFuncs{EOF: func(tunnelID uint32) error {
+		eofTunnelID = tunnelID
+		return nil
+	}}
+	router.tunnels[42] = []Client{client}
+
+	t.Run("invalid tunnel", func(t *testing.T) {
+		assert.Equal(t, ErrInvalidTunnel, router.SendEOF(1))
+	})
+
+	t.Run("send EOF", func(t *testing.T) {
+		go func() {
+			_ = router.SendEOF(42)
+		}()
+		hdr, _ := readRelayFromPrevHop(t, initiator)
+		assert.Equal(t, p2p.RelayTypeTunnelEOF, hdr.RelayType)
+
+		// no more data may be sent afterwards
+		assert.Equal(t, ErrSendClosed, router.SendEOF(42))
+		assert.Equal(t, ErrSendClosed, router.SendData(42, []byte("data")))
+		assert.Equal(t, ErrSendClosed, router.SendDatagram(42, []byte("data")))
+	})
+
+	t.Run("notify clients", func(t *testing.T) {
+		require.Nil(t, router.sendEOFToClients(42))
+		assert.Equal(t, uint32(42), eofTunnelID)
+		assert.Equal(t, ErrInvalidTunnel, router.sendEOFToClients(1))
+	})
+}
@@ -0,0 +1,57 @@
+package onion
+
+import (
+	"fmt"
+	"sync"
+
+	"bawang/errcode"
+)
+
+// errorCounter counts the errors encountered by the Router by their code, see Stats.Errors.
+// It is safe for concurrent use.
+type errorCounter struct {
+	lock   sync.Mutex
+	counts map[errcode.Code]uint64
+}
+
+// add counts an error with the given code.
+func (c *errorCounter) add(code errcode.Code) {
+	c.lock.Lock()
+	if c.counts == nil {
+		c.counts = make(map[errcode.Code]uint64)
+	}
+	c.counts[code]++
+	c.lock.Unlock()
+}
+
+// snapshot returns a copy of the counts, nil if no errors were counted yet.
+func (c *errorCounter) snapshot() map[errcode.Code]uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.counts) == 0 {
+		return nil
+	}
+	counts := make(map[errcode.Code]uint64, len(c.counts))
+	for code, n := range c.counts {
+		counts[code] = n
+	}
+	return counts
+}
+
+// countError counts the given error by its code and returns the code, see errcode.Of.
+func (r *Router) countError(err error) errcode.Code {
+	code := errcode.Of(err)
+	r.errorCounts.add(code)
+	return code
+}
+
+// logError counts the given error and logs it along with its code, prefixed by the formatted context. Errors of
+// connections closed on purpose are expected and thus only counted.
+func (r *Router) logError(err error, format string, v ...interface{}) {
+	code := r.countError(err)
+	if code == errcode.ConnClosed {
+		return
+	}
+	r.logger.Printf("%s: %v [%v]\n", fmt.Sprintf(format, v...), err, code)
+}
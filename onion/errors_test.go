@@ -0,0 +1,140 @@
+package onion
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/errcode"
+	"bawang/p2p"
+)
+
+func TestRouterLogError(t *testing.T) {
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+	var logs bytes.Buffer
+	router.logger = log.New(&logs, "", 0)
+	assert.Nil(t, router.Stats().Errors)
+
+	router.logError(ErrTimedOut, "Error pinging tunnel %v", 1)
+	assert.Equal(t, "Error pinging tunnel 1: timed out [timeout]\n", logs.String())
+
+	// closed connections are expected and only counted
+	logs.Reset()
+	router.logError(ErrLinkClosed, "Error reading message")
+	router.logError(errors.New("other"), "Error")
+	assert.Equal(t, "Error: other [unknown]\n", logs.String())
+
+	assert.Equal(t, map[errcode.Code]uint64{
+		errcode.Timeout:    1,
+		errcode.ConnClosed: 1,
+		errcode.Unknown:    1,
+	}, router.Stats().Errors)
+}
+
+func TestLinkReadError(t *testing.T) {
+	t.Run("closed by us", func(t *testing.T) {
+		link, remote := newPipeLink()
+		defer remote.Close()
+		require.Nil(t, link.destroy())
+
+		_, err := link.readMsg()
+		assert.Equal(t, ErrLinkClosed, err)
+	})
+
+	t.Run("connection closed", func(t *testing.T) {
+		link, remote := newPipeLink()
+		defer remote.Close()
+		link.nc.Close() // without closing the link
+
+		_, err := link.readMsg()
+		require.NotNil(t, err)
+		assert.Equal(t, errcode.ConnClosed, errcode.Of(err))
+	})
+
+	t.Run("truncated header", func(t *testing.T) {
+		link, remote := newPipeLink()
+		go func() {
+			_, _ = remote.Write(make([]byte, p2p.HeaderSize-1))
+			remote.Close()
+		}()
+
+		_, err := link.readMsg()
+		assert.Equal(t, io.ErrUnexpectedEOF, err)
+	})
+
+	t.Run("truncated message", func(t *testing.T) {
+		link, remote := newPipeLink()
+		go func() {
+			hdr := make([]byte, p2p.HeaderSize)
+			(&p2p.Header{TunnelID: 42, Type: p2p.TypeTunnelRelay}).Pack(hdr)
+			_, _ = remote.Write(append(hdr, 0))
+			remote.Close()
+		}()
+
+		// the failure is attributed to the circuit
+		msg, err := link.readMsg()
+		var bodyErr *bodyReadError
+		assert.True(t, errors.As(err, &bodyErr))
+		assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+		assert.Equal(t, p2p.Header{TunnelID: 42, Type: p2p.TypeTunnelRelay}, msg.hdr)
+		assert.Nil(t, msg.body)
+	})
+}
+
+func TestRouterHandleReadError(t *testing.T) {
+	for name, write := range map[string]func(remote net.Conn){
+		"closed": func(remote net.Conn) {},
+		"truncated header": func(remote net.Conn) {
+			_, _ = remote.Write(make([]byte, p2p.HeaderSize-1))
+		},
+		"truncated message": func(remote net.Conn) {
+			hdr := make([]byte, p2p.HeaderSize)
+			(&p2p.Header{TunnelID: 42, Type: p2p.TypeTunnelRelay}).Pack(hdr)
+			_, _ = remote.Write(append(hdr, make([]byte, p2p.MaxBodySize/2)...))
+		},
+	} {
+		write := write
+		t.Run(name, func(t *testing.T) {
+			router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+			var logs bytes.Buffer
+			router.logger = log.New(&logs, "", 0)
+
+			link, remote := newPipeLink()
+			router.addLink(link)
+			dataOut := make(chan message, 1)
+			require.Nil(t, router.registerCircuit(link, 42, dataOut))
+
+			done := make(chan struct{})
+			go func() {
+				router.handleLink(link)
+				close(done)
+			}()
+			write(remote) // without link padding, no hello is sent
+			remote.Close()
+			<-done
+
+			// the link is torn down rather than reading on at an unknown position, the circuits are closed
+			assert.True(t, link.isClosed())
+			assert.Eventually(t, func() bool {
+				_, ok := router.GetLink(link.address, link.port)
+				return !ok
+			}, time.Second, time.Millisecond)
+			_, open := <-dataOut
+			assert.False(t, open)
+
+			if name == "closed" {
+				assert.NotContains(t, logs.String(), "closing link")
+			} else {
+				assert.Contains(t, logs.String(), "closing link")
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package onion
+
+import (
+	"net"
+	"sync"
+
+	"bawang/p2p"
+)
+
+// EventType identifies the kind of an Event published by the Router.
+type EventType uint8
+
+const (
+	EventTunnelBuilt     EventType = iota + 1 // an outgoing tunnel was built
+	EventTunnelIncoming                       // a new incoming tunnel terminates at this peer
+	EventTunnelDestroyed                      // a tunnel was torn down
+	EventLinkUp                               // a new Link to a peer was opened
+	EventLinkDown                             // a Link to a peer was closed
+	EventRoundStarted                         // a new round started
+	EventExitConnected                        // the exit of an outgoing tunnel opened the requested connection
+	EventExitClosed                           // the exit connection of an outgoing tunnel was closed or not opened
+	EventRoundRotation                        // the outgoing tunnels rebuilt in the current round were determined
+)
+
+// String returns a human readable name of the event type.
+func (et EventType) String() string {
+	switch et {
+	case EventTunnelBuilt:
+		return "tunnel built"
+	case EventTunnelIncoming:
+		return "tunnel incoming"
+	case EventTunnelDestroyed:
+		return "tunnel destroyed"
+	case EventLinkUp:
+		return "link up"
+	case EventLinkDown:
+		return "link down"
+	case EventRoundStarted:
+		return "round started"
+	case EventExitConnected:
+		return "exit connected"
+	case EventExitClosed:
+		return "exit closed"
+	case EventRoundRotation:
+		return "round rotation"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is published by the Router whenever the state of its tunnels, links or rounds changes.
+// Only the fields relevant for the respective EventType are set.
+type Event struct {
+	Type     EventType
+	TunnelID uint32 // tunnel events
+	Address  net.IP // link events
+	Port     uint16 // link events
+	Round    uint64 // round events
+
+	EndReason p2p.EndReason // exit closed events
+	Rotated   []uint32      // round rotation events: IDs of the outgoing tunnels rebuilt in the round
+}
+
+// EventHandler is a callback receiving events from the Router.
+// Handlers are called synchronously from the Router's goroutines and must not block.
+type EventHandler func(ev Event)
+
+// eventBus is a simple publish/subscribe mechanism decoupling the Router from the subsystems observing it.
+type eventBus struct {
+	lock        sync.RWMutex // guards fields below
+	nextID      int
+	subscribers map[int]EventHandler
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subscribers: make(map[int]EventHandler),
+	}
+}
+
+// subscribe registers an EventHandler and returns a function to unregister it again.
+func (bus *eventBus) subscribe(handler EventHandler) (unsubscribe func()) {
+	bus.lock.Lock()
+	id := bus.nextID
+	bus.nextID++
+	bus.subscribers[id] = handler
+	bus.lock.Unlock()
+
+	return func() {
+		bus.lock.Lock()
+		delete(bus.subscribers, id)
+		bus.lock.Unlock()
+	}
+}
+
+// publish passes the given event to all subscribed handlers.
+// Must not be called while holding any of the Router's locks, since handlers may call back into the Router.
+func (bus *eventBus) publish(ev Event) {
+	bus.lock.RLock()
+	handlers := make([]EventHandler, 0, len(bus.subscribers))
+	for _, handler := range bus.subscribers {
+		handlers = append(handlers, handler)
+	}
+	bus.lock.RUnlock()
+
+	for _, handler := range handlers {
+		handler(ev)
+	}
+}
@@ -0,0 +1,169 @@
+package onion
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := newEventBus()
+
+	var received1, received2 []Event
+	unsubscribe1 := bus.subscribe(func(ev Event) {
+		received1 = append(received1, ev)
+	})
+	bus.subscribe(func(ev Event) {
+		received2 = append(received2, ev)
+	})
+
+	ev := Event{Type: EventTunnelBuilt, TunnelID: 42}
+	bus.publish(ev)
+	require.Len(t, received1, 1)
+	require.Len(t, received2, 1)
+	assert.Equal(t, ev, received1[0])
+	assert.Equal(t, ev, received2[0])
+
+	// unsubscribed handlers must not receive any further events
+	unsubscribe1()
+	bus.publish(Event{Type: EventRoundStarted, Round: 2})
+	assert.Len(t, received1, 1)
+	require.Len(t, received2, 2)
+	assert.Equal(t, uint64(2), received2[1].Round)
+}
+
+func TestEventTypeString(t *testing.T) {
+	assert.Equal(t, "tunnel built", EventTunnelBuilt.String())
+	assert.Equal(t, "link down", EventLinkDown.String())
+	assert.Equal(t, "unknown", EventType(0).String())
+}
+
+func TestRouterRoundEvents(t *testing.T) {
+	router := newRouterWithRPS(nil, nil)
+
+	var rounds []uint64
+	unsubscribe := router.Subscribe(func(ev Event) {
+		if ev.Type == EventRoundStarted {
+			rounds = append(rounds, ev.Round)
+		}
+	})
+	defer unsubscribe()
+
+	router.startRound()
+	router.startRound()
+	assert.Equal(t, []uint64{1, 2}, rounds)
+}
+
+// roundClient is a RoundClient recording the announced rounds.
+type roundClient struct {
+	ClientFuncs
+	rounds  []uint64
+	rotated [][]uint32
+	err     error
+}
+
+func (client *roundClient) SendRound(round uint64, rotated []uint32) error {
+	client.rounds = append(client.rounds, round)
+	client.rotated = append(client.rotated, rotated)
+	return client.err
+}
+
+func TestRouterRoundRotation(t *testing.T) {
+	cfg := &config.Config{AnnounceRounds: true}
+	router := newRouterWithRPS(cfg, nil)
+
+	client1, client2, failing := &roundClient{}, &roundClient{}, &roundClient{err: errors.New("closed")}
+	plain := &ClientFuncs{}
+	for _, client := range []Client{client1, client2, failing, plain} {
+		router.RegisterClient(client)
+	}
+	router.tunnels[1] = []Client{client1}
+	router.tunnels[2] = []Client{client1, client2}
+	router.tunnels[3] = []Client{plain}
+
+	router.startRound()
+	router.announceRotation([]*Tunnel{{id: 3}, {id: 2}, {id: 1}, {id: 4}})
+
+	assert.Equal(t, []uint64{1}, client1.rounds)
+	assert.Equal(t, [][]uint32{{1, 2}}, client1.rotated)
+	assert.Equal(t, [][]uint32{{2}}, client2.rotated)
+
+	// clients which can not be notified are removed
+	assert.Equal(t, []uint64{1}, failing.rounds)
+	assert.NotContains(t, router.clients, failing)
+	assert.Contains(t, router.clients, plain)
+
+	t.Run("disabled", func(t *testing.T) {
+		cfg.AnnounceRounds = false
+		router.announceRotation([]*Tunnel{{id: 1}})
+		assert.Len(t, client1.rounds, 1)
+	})
+}
+
+// subscribingClient is a SubscribingClient counting the notifications it receives.
+type subscribingClient struct {
+	subs      Subscriptions
+	incoming  int
+	data      int
+	datagrams int
+}
+
+func (client *subscribingClient) Subscribed(subs Subscriptions) bool {
+	return client.subs&subs == subs
+}
+
+func (client *subscribingClient) SendTunnelIncoming(uint32) error {
+	client.incoming++
+	return nil
+}
+
+func (client *subscribingClient) SendTunnelData(uint32, []byte) error {
+	client.data++
+	return nil
+}
+
+func (client *subscribingClient) SendTunnelDatagram(uint32, []byte) error {
+	client.datagrams++
+	return nil
+}
+
+func (client *subscribingClient) SendTunnelEOF(uint32) error     { return nil }
+func (client *subscribingClient) SendTunnelDestroy(uint32) error { return nil }
+func (client *subscribingClient) Terminate() error               { return nil }
+
+func TestRouterSubscriptions(t *testing.T) {
+	router := newRouterWithRPS(nil, nil)
+
+	all := &subscribingClient{subs: SubscribeIncoming | SubscribeData}
+	noIncoming := &subscribingClient{subs: SubscribeData}
+	noData := &subscribingClient{subs: SubscribeIncoming}
+	plain := &ClientFuncs{}
+	for _, client := range []Client{all, noIncoming, noData, plain} {
+		router.RegisterClient(client)
+	}
+
+	// clients not subscribed to incoming tunnels are neither told about them nor registered on them
+	router.tunnels[42] = nil
+	require.Nil(t, router.RegisterIncomingConnection(&tunnelSegment{tunnelID: 42}))
+	assert.Equal(t, []Client{all, noData, plain}, router.tunnels[42])
+	assert.Equal(t, 1, all.incoming)
+	assert.Equal(t, 0, noIncoming.incoming)
+	assert.Equal(t, 1, noData.incoming)
+
+	// clients not subscribed to data are registered but do not receive it
+	require.Nil(t, router.sendDataToClients(42, []byte("data")))
+	require.Nil(t, router.sendDatagramToClients(42, []byte("datagram")))
+	assert.Equal(t, 1, all.data)
+	assert.Equal(t, 1, all.datagrams)
+	assert.Equal(t, 0, noData.data)
+	assert.Equal(t, 0, noData.datagrams)
+
+	// clients not subscribed to incoming tunnels still receive the data of their own ones
+	router.tunnels[43] = []Client{noIncoming}
+	require.Nil(t, router.sendDataToClients(43, []byte("data")))
+	assert.Equal(t, 1, noIncoming.data)
+}
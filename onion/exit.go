@@ -0,0 +1,209 @@
+package onion
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"bawang/errcode"
+	"bawang/p2p"
+)
+
+// ErrNoExit is returned if the last hop of a tunnel announced that it does not act as exit.
+var ErrNoExit = errcode.New(errcode.ModuleOnion, errcode.NotAllowed, false,
+	"last hop of the tunnel does not act as exit")
+
+// BeginExit instructs the last hop of an outgoing tunnel to open a TCP connection to the given destination.
+// The result is announced asynchronously via an EventExitConnected or EventExitClosed event.
+// Once connected, all data sent on the tunnel is passed to the destination and vice versa.
+func (r *Router) BeginExit(tunnelID uint32, address net.IP, port uint16) (err error) {
+	r.tunnelsLock.RLock()
+	tunnel, ok := r.outgoingTunnels[tunnelID]
+	r.tunnelsLock.RUnlock()
+	if !ok {
+		return ErrInvalidTunnel
+	}
+	if !tunnel.lastHopSupports(p2p.CapabilityExit) {
+		return ErrNoExit
+	}
+
+	beginMsg := &p2p.RelayTunnelBegin{
+		IPv6:    address.To4() == nil,
+		Port:    port,
+		Address: address,
+	}
+	return tunnel.sendRelayToLastHop(beginMsg)
+}
+
+// EndExit closes the exit connection of an outgoing tunnel.
+func (r *Router) EndExit(tunnelID uint32) (err error) {
+	return r.sendRelayOnOutgoingTunnel(tunnelID, &p2p.RelayTunnelEnd{Reason: p2p.EndReasonDone})
+}
+
+// sendRelayOnOutgoingTunnel packs, encrypts and sends a relay message to the last hop of an outgoing tunnel.
+func (r *Router) sendRelayOnOutgoingTunnel(tunnelID uint32, msg p2p.RelayMessage) (err error) {
+	r.tunnelsLock.RLock()
+	tunnel, ok := r.outgoingTunnels[tunnelID]
+	r.tunnelsLock.RUnlock()
+	if !ok {
+		return ErrInvalidTunnel
+	}
+
+	return tunnel.sendRelayToLastHop(msg)
+}
+
+// handleTunnelBegin opens the exit connection requested by the tunnel initiator, if this peer acts as an exit and
+// the exit policy allows the destination. The connection is opened in the background, see dialExit.
+func (r *Router) handleTunnelBegin(tunnel *tunnelSegment, msg *p2p.RelayTunnelBegin) (err error) {
+	// only the last hop of a tunnel may act as exit
+	if !r.cfg.Exit || tunnel.nextHopLink != nil || !r.cfg.ExitPolicy.Allows(msg.Address, msg.Port) {
+		r.logger.Printf("Rejecting exit connection to %v:%v on tunnel %v\n", msg.Address, msg.Port, tunnel.prevHopTunnelID)
+		return tunnel.sendRelayToPrevHop(&p2p.RelayTunnelEnd{Reason: p2p.EndReasonExitPolicy})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tunnel.exitLock.Lock()
+	alreadyOpen := tunnel.exitConn != nil || tunnel.exitPending != nil
+	if !alreadyOpen {
+		tunnel.exitPending = cancel
+	}
+	tunnel.exitLock.Unlock()
+	if alreadyOpen {
+		cancel()
+		return tunnel.sendRelayToPrevHop(&p2p.RelayTunnelEnd{Reason: p2p.EndReasonAlreadyOpen})
+	}
+
+	address := net.JoinHostPort(msg.Address.String(), strconv.Itoa(int(msg.Port)))
+	go r.dialExit(ctx, cancel, tunnel, address)
+
+	return nil
+}
+
+// dialExit is a goroutine opening an exit connection, such that the handler of the tunnel segment keeps relaying
+// meanwhile. The initiator is informed about the result, unless the exit was closed while opening it, which cancels
+// ctx, see closeExit. Once open, the data received on the connection is passed back through the tunnel.
+func (r *Router) dialExit(ctx context.Context, cancel context.CancelFunc, tunnel *tunnelSegment, address string) {
+	defer cancel()
+
+	dialer := net.Dialer{Timeout: time.Duration(r.cfg.BuildTimeout) * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+
+	tunnel = r.currentSegment(tunnel)
+	tunnel.exitLock.Lock()
+	if ctx.Err() != nil {
+		tunnel.exitLock.Unlock()
+		if conn != nil {
+			_ = conn.Close()
+		}
+		return
+	}
+	tunnel.exitPending = nil
+	if err == nil {
+		tunnel.exitConn = conn
+	}
+	tunnel.exitLock.Unlock()
+
+	if err != nil {
+		r.logger.Printf("Error opening exit connection to %v: %v\n", address, err)
+		err = tunnel.sendRelayToPrevHop(&p2p.RelayTunnelEnd{Reason: p2p.EndReasonConnectFailed})
+		if err != nil {
+			r.logger.Printf("Error sending exit end on tunnel %v: %v\n", tunnel.prevHopTunnelID, err)
+		}
+		return
+	}
+
+	err = tunnel.sendRelayToPrevHop(&p2p.RelayTunnelConnected{})
+	if err != nil {
+		r.logger.Printf("Error confirming exit connection on tunnel %v: %v\n", tunnel.prevHopTunnelID, err)
+		r.closeExit(tunnel)
+		return
+	}
+
+	r.handleExitConn(tunnel, conn)
+}
+
+// handleExitConn is a goroutine passing the data received on an exit connection back through the tunnel.
+// The data is sent on the tunnel segment currently carrying the tunnel, which changes when the initiator hands the
+// tunnel over to a rebuilt circuit.
+func (r *Router) handleExitConn(tunnel *tunnelSegment, conn net.Conn) {
+	buf := make([]byte, p2p.MaxRelayDataSize)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			tunnel = r.currentSegment(tunnel)
+			tunnel.activity.touch(r.clock.Now())
+			if sendErr := tunnel.sendRelayToPrevHop(&p2p.RelayTunnelData{Data: buf[:n]}); sendErr != nil {
+				r.logger.Printf("Error passing exit data on tunnel %v: %v\n", tunnel.prevHopTunnelID, sendErr)
+				r.closeExit(tunnel)
+				return
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// the destination closed the connection, unless it was closed by us on behalf of the initiator
+	tunnel = r.currentSegment(tunnel)
+	tunnel.exitLock.Lock()
+	current := tunnel.exitConn == conn
+	if current {
+		tunnel.exitConn = nil
+	}
+	tunnel.exitLock.Unlock()
+	_ = conn.Close()
+
+	if current {
+		err := tunnel.sendRelayToPrevHop(&p2p.RelayTunnelEnd{Reason: p2p.EndReasonDone})
+		if err != nil {
+			r.logger.Printf("Error sending exit end on tunnel %v: %v\n", tunnel.prevHopTunnelID, err)
+		}
+	}
+}
+
+// writeToExit passes data received on the tunnel to the exit connection.
+// Returns false if there is no exit connection open on the tunnel.
+func (r *Router) writeToExit(tunnel *tunnelSegment, data []byte) (ok bool, err error) {
+	tunnel.exitLock.Lock()
+	conn := tunnel.exitConn
+	tunnel.exitLock.Unlock()
+	if conn == nil {
+		return false, nil
+	}
+
+	_, err = conn.Write(data)
+	return true, err
+}
+
+// closeExitWrite shuts down the writing side of the exit connection after the initiator finished sending, such that
+// the destination receives EOF but can still send data back. Returns false if there is no exit connection open on the
+// tunnel.
+func (r *Router) closeExitWrite(tunnel *tunnelSegment) (ok bool, err error) {
+	tunnel.exitLock.Lock()
+	conn := tunnel.exitConn
+	tunnel.exitLock.Unlock()
+	if conn == nil {
+		return false, nil
+	}
+
+	if tcpConn, isTCP := conn.(*net.TCPConn); isTCP {
+		return true, tcpConn.CloseWrite()
+	}
+	return true, nil
+}
+
+// closeExit closes the exit connection of a tunnel, if one is open, or stops opening it.
+func (r *Router) closeExit(tunnel *tunnelSegment) {
+	tunnel.exitLock.Lock()
+	conn, pending := tunnel.exitConn, tunnel.exitPending
+	tunnel.exitConn, tunnel.exitPending = nil, nil
+	tunnel.exitLock.Unlock()
+
+	if pending != nil {
+		pending()
+	}
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
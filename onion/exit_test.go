@@ -0,0 +1,194 @@
+package onion
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+)
+
+// relayEnd is the remote end of a circuit in tests, decrypting the relay messages received on the connection with its
+// copy of the running digest.
+type relayEnd struct {
+	net.Conn
+	key    *[32]byte
+	digest *p2p.RelayDigest
+}
+
+// newInitiatorEnd derives the running digests and the cipher of a tunnel segment from its key like handleLink does and
+// returns the tunnel initiator's end of the segment's circuit on the given connection.
+func newInitiatorEnd(conn net.Conn, tunnel *tunnelSegment) *relayEnd {
+	tunnel.recvDigest, tunnel.sendDigest = p2p.NewRelayDigests(tunnel.dhShared)
+	tunnel.cipher = newKeyCipher(tunnel.dhShared)
+	_, backward := p2p.NewRelayDigests(tunnel.dhShared)
+	return &relayEnd{Conn: conn, key: tunnel.dhShared, digest: backward}
+}
+
+// newHopEnd returns the end of the first hop of an outgoing tunnel on the given connection.
+func newHopEnd(conn net.Conn, tunnel *Tunnel) *relayEnd {
+	forward, _ := p2p.NewRelayDigests(&tunnel.hops[0].DHShared)
+	return &relayEnd{Conn: conn, key: &tunnel.hops[0].DHShared, digest: forward}
+}
+
+// readRelayFromPrevHop reads the next relay message received by the remote end and decrypts it.
+func readRelayFromPrevHop(t *testing.T, conn *relayEnd) (hdr p2p.RelayHeader, body []byte) {
+	buf := make([]byte, p2p.MessageSize)
+	_, err := io.ReadFull(conn, buf)
+	require.Nil(t, err)
+
+	ok, msg, err := p2p.DecryptRelay(buf[p2p.HeaderSize:], conn.key, conn.digest)
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	err = hdr.Parse(msg)
+	require.Nil(t, err)
+	return hdr, msg[p2p.RelayHeaderSize:hdr.Size]
+}
+
+func TestRouterHandleTunnelBegin(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	lnAddr := ln.Addr().(*net.TCPAddr)
+
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	require.Nil(t, err)
+	cfg := &config.Config{
+		BuildTimeout: 5,
+		Exit:         true,
+		ExitPolicy: config.ExitPolicy{
+			Ports:    []config.PortRange{{From: uint16(lnAddr.Port), To: uint16(lnAddr.Port)}},
+			Networks: []*net.IPNet{loopback},
+		},
+	}
+	router := newRouter(cfg, WithRPS(&mockRPS{}))
+
+	newSegment := func() (tunnel *tunnelSegment, remote *relayEnd) {
+		link, connRemote := newPipeLink()
+		tunnel = &tunnelSegment{
+			prevHopTunnelID: 42,
+			prevHopLink:     link,
+			dhShared:        &[32]byte{1, 2, 3},
+		}
+		return tunnel, newInitiatorEnd(connRemote, tunnel)
+	}
+
+	expectEnd := func(t *testing.T, tunnel *tunnelSegment, remote *relayEnd, reason p2p.EndReason) {
+		hdr, body := readRelayFromPrevHop(t, remote)
+		require.Equal(t, p2p.RelayTypeTunnelEnd, hdr.RelayType)
+		endMsg := p2p.RelayTunnelEnd{}
+		require.Nil(t, endMsg.Parse(body))
+		assert.Equal(t, reason, endMsg.Reason)
+	}
+
+	beginMsg := &p2p.RelayTunnelBegin{Address: lnAddr.IP, Port: uint16(lnAddr.Port)}
+
+	t.Run("exit disabled", func(t *testing.T) {
+		cfg.Exit = false
+		defer func() { cfg.Exit = true }()
+
+		tunnel, remote := newSegment()
+		defer remote.Close()
+		go func() {
+			_ = router.handleTunnelBegin(tunnel, beginMsg)
+		}()
+		expectEnd(t, tunnel, remote, p2p.EndReasonExitPolicy)
+	})
+
+	t.Run("denied by policy", func(t *testing.T) {
+		tunnel, remote := newSegment()
+		defer remote.Close()
+		go func() {
+			_ = router.handleTunnelBegin(tunnel, &p2p.RelayTunnelBegin{Address: lnAddr.IP, Port: 1})
+		}()
+		expectEnd(t, tunnel, remote, p2p.EndReasonExitPolicy)
+	})
+
+	t.Run("not the last hop", func(t *testing.T) {
+		tunnel, remote := newSegment()
+		defer remote.Close()
+		tunnel.nextHopLink = &Link{}
+		go func() {
+			_ = router.handleTunnelBegin(tunnel, beginMsg)
+		}()
+		expectEnd(t, tunnel, remote, p2p.EndReasonExitPolicy)
+	})
+
+	t.Run("relay data", func(t *testing.T) {
+		tunnel, remote := newSegment()
+		defer remote.Close()
+		go func() {
+			_ = router.handleTunnelBegin(tunnel, beginMsg)
+		}()
+
+		destConn, err := ln.Accept()
+		require.Nil(t, err)
+
+		hdr, _ := readRelayFromPrevHop(t, remote)
+		require.Equal(t, p2p.RelayTypeTunnelConnected, hdr.RelayType)
+
+		// a second begin on the same tunnel is rejected
+		go func() {
+			_ = router.handleTunnelBegin(tunnel, beginMsg)
+		}()
+		expectEnd(t, tunnel, remote, p2p.EndReasonAlreadyOpen)
+
+		// data from the initiator is passed to the destination
+		ok, err := router.writeToExit(tunnel, []byte("ping"))
+		require.Nil(t, err)
+		require.True(t, ok)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(destConn, buf)
+		require.Nil(t, err)
+		assert.Equal(t, []byte("ping"), buf)
+
+		// data from the destination is passed back through the tunnel
+		_, err = destConn.Write([]byte("pong"))
+		require.Nil(t, err)
+		hdr, body := readRelayFromPrevHop(t, remote)
+		require.Equal(t, p2p.RelayTypeTunnelData, hdr.RelayType)
+		assert.Equal(t, []byte("pong"), body)
+
+		// the destination closing the connection ends the exit
+		require.Nil(t, destConn.Close())
+		expectEnd(t, tunnel, remote, p2p.EndReasonDone)
+
+		ok, err = router.writeToExit(tunnel, []byte("ping"))
+		require.Nil(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("closed while opening", func(t *testing.T) {
+		tunnel, remote := newSegment()
+		defer remote.Close()
+
+		// the initiator ends the exit before the connection is open, thus it is not used anymore
+		ctx, cancel := context.WithCancel(context.Background())
+		tunnel.exitPending = cancel
+		router.closeExit(tunnel)
+		assert.NotNil(t, ctx.Err())
+
+		router.dialExit(ctx, cancel, tunnel, lnAddr.String())
+		tunnel.exitLock.Lock()
+		assert.Nil(t, tunnel.exitConn)
+		assert.Nil(t, tunnel.exitPending)
+		tunnel.exitLock.Unlock()
+	})
+}
+
+func TestRouterBeginExit(t *testing.T) {
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+
+	assert.Equal(t, ErrInvalidTunnel, router.BeginExit(1, net.IPv4(127, 0, 0, 1), 80))
+
+	// the last hop announced that it does not act as exit
+	tunnel := &Tunnel{id: 1, caps: []p2p.Capabilities{p2p.CapabilityExit, 0}}
+	router.outgoingTunnels[tunnel.id] = tunnel
+	assert.Equal(t, ErrNoExit, router.BeginExit(1, net.IPv4(127, 0, 0, 1), 80))
+}
@@ -0,0 +1,41 @@
+package onion
+
+import (
+	"net"
+	"time"
+
+	"bawang/errcode"
+)
+
+// ErrFaultsDisabled is returned when injecting a fault into a Router built without the build tag chaos.
+var ErrFaultsDisabled = errcode.New(errcode.ModuleOnion, errcode.NotAllowed, false,
+	"fault injection requires the build tag chaos")
+
+// errInvalidFault is returned when injecting a fault of an unknown kind or with negative parameters.
+var errInvalidFault = errcode.New(errcode.ModuleOnion, errcode.InvalidMessage, false, "invalid fault")
+
+// FaultKind is the kind of a Fault.
+type FaultKind uint8
+
+const (
+	FaultDropCells     FaultKind = iota + 1 // the next cells sent on a link are dropped
+	FaultDelayCreated                       // the next TUNNEL CREATED responses are delayed
+	FaultCorruptDigest                      // the digest of the next relay messages sent is corrupted
+)
+
+// Fault is a fault injected into the Router to exercise the teardown paths and the error propagation in tests, see
+// Router.InjectFault.
+type Fault struct {
+	Kind    FaultKind
+	Count   int           // number of cells, responses or relay messages affected, 0 clears the fault
+	Address net.IP        // address of the peer at the other end of the link, only used with FaultDropCells
+	Port    uint16        // port of the peer at the other end of the link, only used with FaultDropCells
+	Delay   time.Duration // only used with FaultDelayCreated
+}
+
+// InjectFault injects a fault into the Router, replacing a pending fault of the same kind and for the same link.
+// Faults are only injected if the Router is built with the build tag chaos, otherwise ErrFaultsDisabled is returned
+// and the fault points compile to nothing.
+func (r *Router) InjectFault(fault Fault) error {
+	return r.faults.inject(fault)
+}
@@ -0,0 +1,113 @@
+//go:build chaos
+// +build chaos
+
+package onion
+
+import (
+	"sync"
+	"time"
+
+	"bawang/p2p"
+)
+
+// faults holds the pending faults injected into the Router, see Fault. The fault points are called on the data path of
+// all tunnels, thus a nil faults, e.g. of a Link not added to any Router, injects nothing.
+// It is safe for concurrent use.
+type faults struct {
+	lock        sync.Mutex
+	drops       map[linkKey]int // number of cells still to drop by the link
+	delays      int
+	delay       time.Duration
+	corruptions int
+}
+
+// inject replaces the pending fault of the same kind with the given one.
+func (f *faults) inject(fault Fault) error {
+	if fault.Count < 0 || fault.Delay < 0 {
+		return errInvalidFault
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch fault.Kind {
+	case FaultDropCells:
+		if f.drops == nil {
+			f.drops = make(map[linkKey]int)
+		}
+		key := newLinkKey(fault.Address, fault.Port)
+		if fault.Count == 0 {
+			delete(f.drops, key)
+		} else {
+			f.drops[key] = fault.Count
+		}
+	case FaultDelayCreated:
+		f.delays, f.delay = fault.Count, fault.Delay
+	case FaultCorruptDigest:
+		f.corruptions = fault.Count
+	default:
+		return errInvalidFault
+	}
+	return nil
+}
+
+// dropCell returns whether the next cell sent on the given link must be dropped.
+func (f *faults) dropCell(link *Link) bool {
+	if f == nil {
+		return false
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	key := newLinkKey(link.address, link.port)
+	n := f.drops[key]
+	if n == 0 {
+		return false
+	}
+	if n == 1 {
+		delete(f.drops, key)
+	} else {
+		f.drops[key] = n - 1
+	}
+	return true
+}
+
+// createdDelay returns the time the next TUNNEL CREATED response must be held back.
+func (f *faults) createdDelay() time.Duration {
+	if f == nil {
+		return 0
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.delays == 0 {
+		return 0
+	}
+	f.delays--
+	return f.delay
+}
+
+// corruptDigest flips the last byte of the digest of the given packed relay message if the digest of the next relay
+// message must be corrupted. The cell is still recognized by the hop, but fails the digest check.
+func (f *faults) corruptDigest(relayMsg []byte) {
+	if f == nil {
+		return
+	}
+
+	f.lock.Lock()
+	if f.corruptions == 0 {
+		f.lock.Unlock()
+		return
+	}
+	f.corruptions--
+	f.lock.Unlock()
+
+	hdr := p2p.RelayHeader{}
+	if hdr.Parse(relayMsg) != nil {
+		return
+	}
+	hdr.Digest[len(hdr.Digest)-1] ^= 0xff
+	_ = hdr.Pack(relayMsg)
+}
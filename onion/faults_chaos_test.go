@@ -0,0 +1,83 @@
+//go:build chaos
+// +build chaos
+
+package onion
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+)
+
+func TestRouterInjectFault(t *testing.T) {
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+
+	assert.Equal(t, errInvalidFault, router.InjectFault(Fault{Kind: FaultCorruptDigest, Count: -1}))
+	assert.Equal(t, errInvalidFault, router.InjectFault(Fault{Kind: FaultDelayCreated, Count: 1, Delay: -1}))
+	assert.Equal(t, errInvalidFault, router.InjectFault(Fault{Count: 1}))
+
+	t.Run("delay created", func(t *testing.T) {
+		require.Nil(t, router.InjectFault(Fault{Kind: FaultDelayCreated, Count: 1, Delay: time.Second}))
+		assert.Equal(t, time.Second, router.faults.createdDelay())
+		assert.Zero(t, router.faults.createdDelay())
+	})
+
+	t.Run("corrupt digest", func(t *testing.T) {
+		require.Nil(t, router.InjectFault(Fault{Kind: FaultCorruptDigest, Count: 1}))
+		key := [32]byte{1, 2, 3}
+
+		// pack packs a relay message and returns whether the hop recognizes it
+		pack := func() bool {
+			sendDigest, _ := p2p.NewRelayDigests(&key)
+			recvDigest, _ := p2p.NewRelayDigests(&key)
+			buf := make([]byte, p2p.RelayMessageSize)
+			_, n, err := p2p.PackRelayMessage(buf, 0, &p2p.RelayTunnelData{Data: []byte("data")}, sendDigest)
+			require.Nil(t, err)
+			router.faults.corruptDigest(buf[:n])
+			ok, err := p2p.RecognizeRelay(buf[:n], recvDigest)
+			require.Nil(t, err)
+			return ok
+		}
+		assert.False(t, pack())
+		assert.True(t, pack())
+	})
+
+	t.Run("drop cells", func(t *testing.T) {
+		link, remote := newPipeLink()
+		defer remote.Close()
+		link.address, link.port = net.IPv4(10, 0, 0, 1), 6602
+		link.faults = &router.faults
+		defer link.destroy()
+		require.Nil(t, router.InjectFault(Fault{Kind: FaultDropCells, Count: 2, Address: link.address, Port: link.port}))
+
+		// faults on other links do not interfere
+		other := &Link{address: link.address, port: 6603, faults: &router.faults}
+		assert.False(t, other.faults.dropCell(other))
+
+		go func() {
+			// link messages are never dropped
+			assert.Nil(t, link.sendMsg(p2p.LinkTunnelID, &p2p.LinkPadding{}))
+			assert.Nil(t, link.sendDestroyTunnel(42))
+			assert.Nil(t, link.sendRelay(42, []byte("relay"), PriorityBulk))
+			assert.Nil(t, link.sendDestroyTunnel(43))
+		}()
+
+		rd := bufio.NewReader(remote)
+		for _, tunnelID := range []uint32{p2p.LinkTunnelID, 43} {
+			buf := make([]byte, p2p.MessageSize)
+			_, err := io.ReadFull(rd, buf)
+			require.Nil(t, err)
+			hdr := p2p.Header{}
+			require.Nil(t, hdr.Parse(buf))
+			assert.Equal(t, tunnelID, hdr.TunnelID)
+		}
+	})
+}
@@ -0,0 +1,25 @@
+//go:build !chaos
+// +build !chaos
+
+package onion
+
+import (
+	"time"
+)
+
+// faults holds no state unless built with the build tag chaos, see Fault.
+type faults struct{}
+
+func (f *faults) inject(fault Fault) error {
+	return ErrFaultsDisabled
+}
+
+func (f *faults) dropCell(link *Link) bool {
+	return false
+}
+
+func (f *faults) createdDelay() time.Duration {
+	return 0
+}
+
+func (f *faults) corruptDigest(relayMsg []byte) {}
@@ -0,0 +1,17 @@
+//go:build !chaos
+// +build !chaos
+
+package onion
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"bawang/config"
+)
+
+func TestRouterInjectFaultDisabled(t *testing.T) {
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+	assert.Equal(t, ErrFaultsDisabled, router.InjectFault(Fault{Kind: FaultCorruptDigest, Count: 1}))
+}
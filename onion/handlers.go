@@ -0,0 +1,93 @@
+package onion
+
+import (
+	"sync"
+)
+
+// tunnelHandlers keeps track of the goroutines handling the outgoing circuits, such that every circuit is handled by
+// exactly one of them and the Router can stop them on shutdown, see Router.startTunnelHandler. It is safe for
+// concurrent use.
+type tunnelHandlers struct {
+	lock    sync.Mutex
+	running map[uint32]*Tunnel // by circuit ID
+	stopped bool
+	wg      sync.WaitGroup
+
+	quit chan struct{} // closed on shutdown
+}
+
+func newTunnelHandlers() *tunnelHandlers {
+	return &tunnelHandlers{
+		running: make(map[uint32]*Tunnel),
+		quit:    make(chan struct{}),
+	}
+}
+
+// add registers a handler for the circuit of the given tunnel. Returns false if the circuit is handled already or the
+// handlers were stopped, then the handler must not run.
+func (h *tunnelHandlers) add(tunnel *Tunnel) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if _, ok := h.running[tunnel.circuitID]; ok || h.stopped {
+		return false
+	}
+	h.running[tunnel.circuitID] = tunnel
+	h.wg.Add(1)
+	return true
+}
+
+// done unregisters the handler of the circuit of the given tunnel once it returned.
+func (h *tunnelHandlers) done(tunnel *Tunnel) {
+	h.lock.Lock()
+	if h.running[tunnel.circuitID] == tunnel {
+		delete(h.running, tunnel.circuitID)
+	}
+	h.lock.Unlock()
+	h.wg.Done()
+}
+
+// isRunning checks whether the circuit of the given tunnel is handled.
+func (h *tunnelHandlers) isRunning(tunnel *Tunnel) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.running[tunnel.circuitID] == tunnel
+}
+
+// stop signals all handlers to return and waits until they did. No handlers are added afterwards.
+func (h *tunnelHandlers) stop() {
+	h.lock.Lock()
+	if h.stopped {
+		h.lock.Unlock()
+		h.wg.Wait()
+		return
+	}
+	h.stopped = true
+	close(h.quit)
+	h.lock.Unlock()
+
+	h.wg.Wait()
+}
+
+// startTunnelHandler starts the goroutine handling the traffic of the given outgoing tunnel, unless its circuit is
+// handled already. The Router starts the handlers of all tunnels it builds, including rebuilt circuits, such that its
+// callers never need to. Loopback tunnels have no circuit to handle.
+func (r *Router) startTunnelHandler(tunnel *Tunnel) {
+	if tunnel.link == nil || !r.handlers.add(tunnel) {
+		return
+	}
+	go r.handleOutgoingTunnel(tunnel)
+}
+
+// Shutdown stops the handlers of all outgoing tunnels and waits until they returned. The tunnels are not torn down,
+// such that they are restored on the next start, see Config.StateFile. No further handlers are started afterwards.
+// The replay file is closed, handshakes received afterwards are no longer persisted, see Config.ReplayFile.
+func (r *Router) Shutdown() {
+	r.handlers.stop()
+
+	err := r.replays.close()
+	if err != nil {
+		r.logger.Printf("Error closing replay file: %v\n", err)
+	}
+}
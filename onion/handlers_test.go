@@ -0,0 +1,91 @@
+package onion
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+)
+
+func TestRouterTunnelHandlers(t *testing.T) {
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+
+	// each tunnel uses its own link, which is closed once the tunnel is torn down
+	newTunnel := func(t *testing.T, tunnelID, circuitID uint32) *Tunnel {
+		link, connRemote := newPipeLink()
+		t.Cleanup(func() {
+			_ = connRemote.Close()
+		})
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, connRemote)
+		}()
+		require.Nil(t, router.registerCircuit(link, circuitID, make(chan message, 5)))
+		router.circuits[circuitID] = struct{}{}
+		tunnel := &Tunnel{
+			id:        tunnelID,
+			circuitID: circuitID,
+			link:      link,
+			quit:      make(chan struct{}),
+		}
+		router.outgoingTunnels[tunnelID] = tunnel
+		router.tunnels[tunnelID] = []Client{}
+		return tunnel
+	}
+
+	t.Run("start", func(t *testing.T) {
+		tunnel := newTunnel(t, 1, 11)
+		router.startTunnelHandler(tunnel)
+		require.True(t, router.handlers.isRunning(tunnel))
+
+		// each circuit is handled only once
+		router.startTunnelHandler(tunnel)
+		assert.Len(t, router.handlers.running, 1)
+
+		// the handler is unregistered once the tunnel is torn down
+		_ = tunnel.Close()
+		require.Eventually(t, func() bool {
+			return !router.handlers.isRunning(tunnel)
+		}, time.Second, time.Millisecond)
+		router.tunnelsLock.RLock()
+		assert.NotContains(t, router.outgoingTunnels, uint32(1))
+		assert.NotContains(t, router.circuits, uint32(11))
+		router.tunnelsLock.RUnlock()
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		tunnel := newTunnel(t, 2, 12)
+		router.startTunnelHandler(tunnel)
+		require.True(t, router.handlers.isRunning(tunnel))
+
+		done := make(chan struct{})
+		go func() {
+			router.Shutdown()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("shutdown did not wait for the handlers to return")
+		}
+		assert.False(t, router.handlers.isRunning(tunnel))
+
+		// the tunnel is kept to be restored on the next start
+		router.tunnelsLock.RLock()
+		assert.Contains(t, router.outgoingTunnels, uint32(2))
+		assert.Contains(t, router.circuits, uint32(12))
+		router.tunnelsLock.RUnlock()
+
+		// no handlers are started anymore
+		other := newTunnel(t, 3, 13)
+		router.startTunnelHandler(other)
+		assert.False(t, router.handlers.isRunning(other))
+
+		// shutting down again is a no-op
+		router.Shutdown()
+	})
+}
@@ -0,0 +1,281 @@
+package onion
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"bawang/p2p"
+)
+
+const (
+	maxHandoverBuffer = 256 // max. number of relay messages buffered on a rebuilt circuit while the old one is drained
+)
+
+// handover tracks the switch of an outgoing tunnel from its old circuit to a rebuilt one.
+// Both circuits are kept until all data in flight on the old one was received: The initiator sends a
+// p2p.RelayTunnelMigrate as the first message on the new circuit and as the last message on the old one. The other end
+// pairs both circuits by the token, switches over once the old circuit is drained and confirms this with a
+// p2p.RelayTunnelMigrate as its last message on the old circuit. Until then, messages received on the new circuit are
+// buffered on both ends.
+type handover struct {
+	token   uint64
+	old     *Tunnel       // circuit the tunnel is handed over from
+	drained chan struct{} // closed once the old circuit is drained or the handover timed out
+	once    sync.Once
+}
+
+// finish marks the old circuit as drained.
+func (h *handover) finish() {
+	h.once.Do(func() {
+		close(h.drained)
+	})
+}
+
+// migration pairs the old and the new tunnel segment of an incoming tunnel the initiator hands over to a rebuilt
+// circuit, see handover.
+type migration struct {
+	token      uint64
+	oldSegment *tunnelSegment
+	newSegment *tunnelSegment
+	done       chan struct{} // closed once the migration completed or timed out
+}
+
+// newHandoverToken generates a random token pairing the old and the new circuit of a tunnel. Like stream IDs, tokens
+// must not be guessable, since the other end hands the tunnel over to any circuit presenting the token.
+func newHandoverToken(random io.Reader) (token uint64, err error) {
+	return newStreamID(random)
+}
+
+// handoverTimeout is the time the old circuit of a rebuilt tunnel is kept to drain.
+func (r *Router) handoverTimeout() time.Duration {
+	return time.Duration(r.cfg.BuildTimeout) * time.Second
+}
+
+// startHandover hands an outgoing tunnel over from its old circuit to the rebuilt one, which must already be
+// registered as the outgoing tunnel. Data sent from now on is sent on the new circuit, while data received on it is
+// buffered by the tunnel's handler until the old circuit is drained.
+// Must be called with r.tunnelsLock hold, such that no data is sent on the new circuit before the other end was told
+// about the handover.
+func (r *Router) startHandover(tunnel, newTunnel *Tunnel) (h *handover, err error) {
+	token, err := newHandoverToken(r.rand)
+	if err != nil {
+		return nil, err
+	}
+
+	err = newTunnel.sendRelayToLastHop(&p2p.RelayTunnelMigrate{Token: token, Step: p2p.MigrateNew})
+	if err != nil {
+		return nil, err
+	}
+
+	h = &handover{
+		token:   token,
+		old:     tunnel,
+		drained: make(chan struct{}),
+	}
+	tunnel.handover = h
+	newTunnel.handover = h
+	newTunnel.draining = h.drained
+	newTunnel.stream = tunnel.stream
+	newTunnel.priority.set(tunnel.priority.get())
+	if tunnel.sendClosed.isClosed() {
+		newTunnel.sendClosed.close()
+	}
+
+	// payloads held back for batching must arrive before the old circuit is drained
+	r.flushBatch(&tunnel.batch, tunnel.sendRelayToLastHop)
+	err = tunnel.sendRelayToLastHop(&p2p.RelayTunnelMigrate{Token: token, Step: p2p.MigrateOld})
+	if err != nil {
+		// the old circuit is broken, there is nothing left to drain
+		r.logger.Printf("Error draining old circuit of tunnel %v: %v\n", tunnel.id, err)
+		h.finish()
+	}
+
+	return h, nil
+}
+
+// drainCircuit waits until the old circuit of a rebuilt tunnel is drained. The old circuit is torn down by its
+// handler once the other end confirmed the handover. If the confirmation does not arrive in time, the handover is
+// finished anyway and the old circuit is closed.
+func (r *Router) drainCircuit(h *handover) {
+	select {
+	case <-h.drained:
+	case <-r.clock.After(r.handoverTimeout()):
+		r.logger.Printf("Old circuit of tunnel %v was not drained in time\n", h.old.id)
+		h.finish()
+		_ = h.old.Close()
+	}
+}
+
+// finishHandover processes the confirmation of the handover received on the old circuit of a rebuilt tunnel.
+// Returns false if the message does not belong to a handover of the tunnel.
+func (r *Router) finishHandover(tunnel *Tunnel, msg *p2p.RelayTunnelMigrate) (ok bool) {
+	r.tunnelsLock.RLock()
+	h := tunnel.handover
+	r.tunnelsLock.RUnlock()
+
+	if h == nil || h.old != tunnel || msg.Step != p2p.MigrateDone || msg.Token != h.token {
+		return false
+	}
+
+	r.logger.Printf("Handed outgoing tunnel %v over to rebuilt circuit\n", tunnel.id)
+	h.finish()
+	return true
+}
+
+// removeCircuit unregisters the circuit of a terminated outgoing tunnel. The tunnel itself is removed as well, unless
+// it was handed over to a rebuilt circuit or another circuit of the multipath tunnel carries it on.
+func (r *Router) removeCircuit(tunnel *Tunnel) {
+	var current bool
+	if tunnel.stream != nil && tunnel.stream.multipath != nil {
+		current = r.leaveMultipath(tunnel)
+	} else {
+		r.tunnelsLock.RLock()
+		current = r.outgoingTunnels[tunnel.id] == tunnel
+		r.tunnelsLock.RUnlock()
+	}
+
+	if current {
+		err := r.RemoveTunnel(tunnel.id)
+		if err != nil {
+			r.logger.Printf("Error removing tunnel with ID %v: %v\n", tunnel.id, err)
+		}
+	}
+
+	tunnel.closeSessions()
+	r.releaseCircuit(tunnel.circuitID)
+}
+
+// handleMigrate processes a p2p.RelayTunnelMigrate received on an incoming tunnel segment, see handover.
+// Once both the old and the new segment of a tunnel arrived, the new segment replaces the old one.
+func (r *Router) handleMigrate(tunnel *tunnelSegment, msg *p2p.RelayTunnelMigrate) (err error) {
+	r.tunnelsLock.Lock()
+	m, ok := r.migrations[msg.Token]
+	if !ok {
+		m = &migration{
+			token: msg.Token,
+			done:  make(chan struct{}),
+		}
+	}
+
+	switch msg.Step {
+	case p2p.MigrateNew:
+		// the new segment must not have carried any traffic before
+		_, announced := r.incomingTunnels[tunnel.tunnelID]
+		if m.newSegment != nil || announced || tunnel.remapped || tunnel.stream != nil {
+			r.tunnelsLock.Unlock()
+			return p2p.ErrInvalidMessage
+		}
+		m.newSegment = tunnel
+		tunnel.draining = m.done // the segment's handler buffers all further messages until the migration completed
+
+	case p2p.MigrateOld:
+		if m.oldSegment != nil || tunnel.replacedBy != nil {
+			r.tunnelsLock.Unlock()
+			return p2p.ErrInvalidMessage
+		}
+		m.oldSegment = tunnel
+
+	default:
+		r.tunnelsLock.Unlock()
+		return p2p.ErrInvalidMessage
+	}
+
+	if m.oldSegment == nil || m.newSegment == nil {
+		if !ok {
+			r.migrations[m.token] = m
+			go r.expireMigration(m)
+		}
+		r.tunnelsLock.Unlock()
+		return nil
+	}
+
+	// both segments arrived and all data in flight on the old one was received
+	delete(r.migrations, m.token)
+	r.replaceSegment(m.oldSegment, m.newSegment)
+	tunnelID := m.newSegment.tunnelID
+	stream := m.newSegment.stream
+	r.tunnelsLock.Unlock()
+
+	r.logger.Printf("Incoming tunnel %v migrated to rebuilt circuit\n", tunnelID)
+
+	// the confirmation is the last message on the old circuit, which the initiator tears down afterwards
+	r.flushBatch(&m.oldSegment.batch, m.oldSegment.sendRelayToPrevHop)
+	sendErr := m.oldSegment.sendRelayToPrevHop(&p2p.RelayTunnelMigrate{Token: m.token, Step: p2p.MigrateDone})
+	if sendErr != nil {
+		r.logger.Printf("Error confirming migration of incoming tunnel %v: %v\n", tunnelID, sendErr)
+	}
+	close(m.done)
+
+	if stream != nil {
+		sendErr = stream.resume(m.newSegment.sendRelayToPrevHop)
+		if sendErr != nil {
+			r.logger.Printf("Error resuming stream of incoming tunnel %v: %v\n", tunnelID, sendErr)
+		}
+	}
+
+	return nil
+}
+
+// expireMigration gives up on a migration if not both segments arrived in time. A new segment waiting for the old one
+// to be drained then carries the tunnel on its own.
+func (r *Router) expireMigration(m *migration) {
+	<-r.clock.After(r.handoverTimeout())
+
+	r.tunnelsLock.Lock()
+	pending := r.migrations[m.token] == m
+	if pending {
+		delete(r.migrations, m.token)
+	}
+	r.tunnelsLock.Unlock()
+
+	if pending {
+		close(m.done)
+	}
+}
+
+// replaceSegment makes the given tunnel segment carry the tunnel of the old one, such that the clients keep using
+// the tunnel ID known to them. The new segment was not announced yet, thus its own tunnel ID is dropped and the traffic
+// counted for it so far is added to the tunnel's. The stream and the exit connection of the old segment are moved to
+// the new one.
+// Must be called with r.tunnelsLock hold.
+func (r *Router) replaceSegment(old, tunnel *tunnelSegment) {
+	delete(r.tunnels, tunnel.tunnelID)
+	tunnelID := old.tunnelID
+	r.traffic.move(tunnel.tunnelID, tunnelID)
+	tunnel.tunnelID, tunnel.remapped = tunnelID, true
+	old.replacedBy = tunnel
+	tunnel.priority.set(old.priority.get())
+	if r.incomingTunnels[tunnelID] == old {
+		r.incomingTunnels[tunnelID] = tunnel
+	}
+
+	if old.stream != nil {
+		tunnel.stream = old.stream
+		tunnel.stream.segment = tunnel
+	}
+	if old.sendClosed.isClosed() {
+		tunnel.sendClosed.close()
+	}
+
+	old.exitLock.Lock()
+	conn, pending := old.exitConn, old.exitPending
+	old.exitConn, old.exitPending = nil, nil
+	old.exitLock.Unlock()
+	if conn != nil || pending != nil {
+		tunnel.exitLock.Lock()
+		tunnel.exitConn, tunnel.exitPending = conn, pending
+		tunnel.exitLock.Unlock()
+	}
+}
+
+// currentSegment returns the tunnel segment currently carrying the tunnel of the given one, following replacements.
+func (r *Router) currentSegment(tunnel *tunnelSegment) *tunnelSegment {
+	r.tunnelsLock.RLock()
+	defer r.tunnelsLock.RUnlock()
+
+	for tunnel.replacedBy != nil {
+		tunnel = tunnel.replacedBy
+	}
+	return tunnel
+}
@@ -0,0 +1,225 @@
+package onion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+	"bawang/rps"
+)
+
+func TestRouterHandover(t *testing.T) {
+	router := newRouter(&config.Config{BuildTimeout: 5}, WithRPS(&mockRPS{}))
+
+	received := make(chan string, 5)
+	router.RegisterClient(&ClientFuncs{Data: func(tunnelID uint32, data []byte) error {
+		assert.Equal(t, uint32(42), tunnelID)
+		received <- string(data)
+		return nil
+	}})
+
+	addCircuit := func(circuitID uint32) (tunnel *Tunnel, remote *relayEnd) {
+		link, connRemote := newPipeLink()
+		require.Nil(t, link.register(circuitID, make(chan message, 5)))
+		router.circuits[circuitID] = struct{}{}
+		tunnel = &Tunnel{
+			id:        42,
+			circuitID: circuitID,
+			link:      link,
+			quit:      make(chan struct{}),
+		}
+		hop := &rps.Peer{DHShared: [32]byte{byte(circuitID)}}
+		tunnel.addHop(hop, newKeyCipher(&hop.DHShared))
+		return tunnel, newHopEnd(connRemote, tunnel)
+	}
+	readMigrate := func(t *testing.T, conn *relayEnd) (msg p2p.RelayTunnelMigrate) {
+		hdr, body := readRelayFromPrevHop(t, conn)
+		require.Equal(t, p2p.RelayTypeTunnelMigrate, hdr.RelayType)
+		require.Nil(t, msg.Parse(body))
+		return msg
+	}
+
+	oldTunnel, oldRemote := addCircuit(1)
+	defer oldRemote.Close()
+	router.outgoingTunnels[42] = oldTunnel
+	router.tunnels[42] = []Client{router.clients[0]}
+
+	newTunnel, newRemote := addCircuit(2)
+	defer newRemote.Close()
+	router.outgoingTunnels[42] = newTunnel // registered by rebuildTunnel
+
+	// the other end is told about the handover on both circuits
+	handovers := make(chan *handover, 1)
+	go func() {
+		router.tunnelsLock.Lock()
+		h, err := router.startHandover(oldTunnel, newTunnel)
+		router.tunnelsLock.Unlock()
+		assert.Nil(t, err)
+		handovers <- h
+	}()
+	newMsg := readMigrate(t, newRemote)
+	assert.Equal(t, p2p.MigrateNew, newMsg.Step)
+	oldMsg := readMigrate(t, oldRemote)
+	assert.Equal(t, p2p.MigrateOld, oldMsg.Step)
+	assert.Equal(t, newMsg.Token, oldMsg.Token)
+	h := <-handovers
+
+	// data received on the new circuit is held back until the old one is drained
+	dataOut, ok := newTunnel.link.getDataOut(2)
+	require.True(t, ok)
+	require.True(t, router.handlers.add(newTunnel))
+	done := make(chan struct{})
+	go func() {
+		router.handleOutgoingTunnel(newTunnel)
+		close(done)
+	}()
+
+	buf := make([]byte, p2p.MessageSize)
+	_, hopDigest := p2p.NewRelayDigests(&newTunnel.hops[0].DHShared)
+	_, n, err := p2p.PackRelayMessage(buf, 1, &p2p.RelayTunnelData{Data: []byte("new")}, hopDigest)
+	require.Nil(t, err)
+	body, err := p2p.EncryptRelay(buf[:n], &newTunnel.hops[0].DHShared)
+	require.Nil(t, err)
+	dataOut <- message{hdr: p2p.Header{Type: p2p.TypeTunnelRelay, TunnelID: 2}, body: body}
+
+	select {
+	case <-received:
+		t.Fatal("data on the new circuit overtook the old one")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a confirmation with another token is rejected
+	assert.False(t, router.finishHandover(oldTunnel, &p2p.RelayTunnelMigrate{Token: h.token + 1, Step: p2p.MigrateDone}))
+	assert.False(t, router.finishHandover(newTunnel, &p2p.RelayTunnelMigrate{Token: h.token, Step: p2p.MigrateDone}))
+
+	assert.True(t, router.finishHandover(oldTunnel, &p2p.RelayTunnelMigrate{Token: h.token, Step: p2p.MigrateDone}))
+	select {
+	case data := <-received:
+		assert.Equal(t, "new", data)
+	case <-time.After(time.Second):
+		t.Fatal("data on the new circuit was not passed on")
+	}
+
+	// removing the old circuit does not affect the tunnel known to the clients
+	router.removeCircuit(oldTunnel)
+	assert.Contains(t, router.tunnels, uint32(42))
+	assert.Equal(t, newTunnel, router.outgoingTunnels[42])
+	assert.NotContains(t, router.circuits, uint32(1))
+
+	close(newTunnel.quit)
+	<-done
+	assert.NotContains(t, router.tunnels, uint32(42))
+	assert.NotContains(t, router.outgoingTunnels, uint32(42))
+	assert.Empty(t, router.circuits)
+}
+
+func TestRouterMigrate(t *testing.T) {
+	addSegment := func(router *Router, tunnelID uint32) (tunnel *tunnelSegment, remote *relayEnd) {
+		link, connRemote := newPipeLink()
+		router.tunnels[tunnelID] = []Client{}
+		tunnel = &tunnelSegment{
+			prevHopTunnelID: router.newCircuitID(),
+			tunnelID:        tunnelID,
+			prevHopLink:     link,
+			dhShared:        &[32]byte{byte(tunnelID)},
+		}
+		return tunnel, newInitiatorEnd(connRemote, tunnel)
+	}
+
+	t.Run("migrate", func(t *testing.T) {
+		router := newRouter(&config.Config{BuildTimeout: 5}, WithRPS(&mockRPS{}))
+		router.RegisterClient(&ClientFuncs{})
+
+		oldSegment, oldRemote := addSegment(router, 42)
+		defer oldRemote.Close()
+		require.Nil(t, router.RegisterIncomingConnection(oldSegment))
+
+		newSegment, newRemote := addSegment(router, 43)
+		defer newRemote.Close()
+
+		// the new segment waits for the old one to be drained
+		require.Nil(t, router.handleMigrate(newSegment, &p2p.RelayTunnelMigrate{Token: 7, Step: p2p.MigrateNew}))
+		require.NotNil(t, newSegment.draining)
+		assert.Equal(t, oldSegment, router.incomingTunnels[42])
+
+		// a segment can not be the new one of two migrations
+		assert.Equal(t, p2p.ErrInvalidMessage,
+			router.handleMigrate(newSegment, &p2p.RelayTunnelMigrate{Token: 7, Step: p2p.MigrateNew}))
+		// a segment already carrying traffic can not be the new one
+		assert.Equal(t, p2p.ErrInvalidMessage,
+			router.handleMigrate(oldSegment, &p2p.RelayTunnelMigrate{Token: 8, Step: p2p.MigrateNew}))
+
+		// the old segment is drained, the migration is confirmed on it
+		go func() {
+			assert.Nil(t, router.handleMigrate(oldSegment, &p2p.RelayTunnelMigrate{Token: 7, Step: p2p.MigrateOld}))
+		}()
+		hdr, body := readRelayFromPrevHop(t, oldRemote)
+		require.Equal(t, p2p.RelayTypeTunnelMigrate, hdr.RelayType)
+		migrateMsg := p2p.RelayTunnelMigrate{}
+		require.Nil(t, migrateMsg.Parse(body))
+		assert.Equal(t, p2p.RelayTunnelMigrate{Token: 7, Step: p2p.MigrateDone}, migrateMsg)
+
+		select {
+		case <-newSegment.draining:
+		case <-time.After(time.Second):
+			t.Fatal("migration was not completed")
+		}
+
+		router.tunnelsLock.Lock()
+		assert.Equal(t, newSegment, router.incomingTunnels[42])
+		assert.Equal(t, uint32(42), newSegment.tunnelID)
+		assert.Equal(t, newSegment, oldSegment.replacedBy)
+		assert.Empty(t, router.migrations)
+		router.tunnelsLock.Unlock()
+
+		// data sent by the clients is sent on the new segment
+		go func() {
+			assert.Nil(t, router.SendData(42, []byte("data")))
+		}()
+		hdr, body = readRelayFromPrevHop(t, newRemote)
+		require.Equal(t, p2p.RelayTypeTunnelData, hdr.RelayType)
+		assert.Equal(t, []byte("data"), body)
+
+		// tearing down the old segment does not affect the tunnel known to the clients
+		router.removeTunnelSegment(oldSegment)
+		assert.Contains(t, router.tunnels, uint32(42))
+
+		router.removeTunnelSegment(newSegment)
+		assert.NotContains(t, router.tunnels, uint32(42))
+		assert.NotContains(t, router.tunnels, uint32(43))
+		assert.NotContains(t, router.incomingTunnels, uint32(42))
+		assert.Empty(t, router.circuits)
+	})
+
+	t.Run("old segment not drained", func(t *testing.T) {
+		router := newRouter(&config.Config{}, WithRPS(&mockRPS{})) // the migration times out immediately
+
+		newSegment, newRemote := addSegment(router, 43)
+		defer newRemote.Close()
+		require.Nil(t, router.handleMigrate(newSegment, &p2p.RelayTunnelMigrate{Token: 7, Step: p2p.MigrateNew}))
+
+		// the new segment carries the tunnel on its own
+		select {
+		case <-newSegment.draining:
+		case <-time.After(time.Second):
+			t.Fatal("migration did not time out")
+		}
+		router.tunnelsLock.Lock()
+		assert.Empty(t, router.migrations)
+		assert.Equal(t, uint32(43), newSegment.tunnelID)
+		router.tunnelsLock.Unlock()
+	})
+
+	t.Run("invalid step", func(t *testing.T) {
+		router := newRouter(&config.Config{BuildTimeout: 5}, WithRPS(&mockRPS{}))
+		segment, remote := addSegment(router, 42)
+		defer remote.Close()
+		assert.Equal(t, p2p.ErrInvalidMessage,
+			router.handleMigrate(segment, &p2p.RelayTunnelMigrate{Token: 7, Step: p2p.MigrateDone}))
+		assert.Empty(t, router.migrations)
+	})
+}
@@ -0,0 +1,28 @@
+package onion
+
+import (
+	"bawang/errcode"
+)
+
+var (
+	ErrNotListening = errcode.New(errcode.ModuleOnion, errcode.Unavailable, false, "P2P listener is not up")
+	ErrNoRound      = errcode.New(errcode.ModuleOnion, errcode.Unavailable, true, "no round completed yet")
+)
+
+// CheckListener returns ErrNotListening unless the P2P listener of the Router accepts connections, see
+// ListenOnionSocket. It can be used as a health.Check.
+func (r *Router) CheckListener() error {
+	if r.listening.Check() != nil {
+		return ErrNotListening
+	}
+	return nil
+}
+
+// CheckRounds returns ErrNoRound until the Router completed its first round, i.e. built its initial tunnels, see
+// HandleRounds. It can be used as a health.Check.
+func (r *Router) CheckRounds() error {
+	if r.roundCompleted.Check() != nil {
+		return ErrNoRound
+	}
+	return nil
+}
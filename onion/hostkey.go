@@ -0,0 +1,58 @@
+package onion
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"net"
+
+	"bawang/errcode"
+	"bawang/rps"
+)
+
+var (
+	// ErrHostKeyMismatch is returned if a peer presented another host key than the one the RPS module announced.
+	ErrHostKeyMismatch = errcode.New(errcode.ModuleOnion, errcode.MisbehavingPeer, true,
+		"host key presented by peer does not match")
+)
+
+// connectionStater is implemented by connections secured with TLS, i.e. *tls.Conn and connections wrapping one.
+type connectionStater interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// peerHostKey returns the host key the peer presented in the TLS handshake of the given connection. nil is returned if
+// the connection is not secured with TLS, e.g. for custom transports, or the peer presented no RSA key.
+func peerHostKey(nc net.Conn) *rsa.PublicKey {
+	conn, ok := nc.(connectionStater)
+	if !ok {
+		return nil
+	}
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	hostKey, _ := certs[0].PublicKey.(*rsa.PublicKey)
+	return hostKey
+}
+
+// sameHostKey checks whether both keys are the same RSA public key.
+func sameHostKey(a, b *rsa.PublicKey) bool {
+	return a != nil && b != nil && a.E == b.E && a.N.Cmp(b.N) == 0
+}
+
+// verifyHop checks that the peer at the other end of the given link presented the host key the RPS module announced
+// for the hop. Otherwise some other node answers at the address of the hop, which is banned and the link is not used.
+// Links opened by custom transports not using TLS can not be verified, the hop then only proves its identity in the
+// handshake of the circuit.
+func (r *Router) verifyHop(link *Link, hop *rps.Peer) error {
+	if link.hostKey == nil || hop.HostKey == nil {
+		return nil
+	}
+
+	if !sameHostKey(link.hostKey, hop.HostKey) {
+		r.recordMisbehavior(hop, MisbehaviorHostKey)
+		return ErrHostKeyMismatch
+	}
+	return nil
+}
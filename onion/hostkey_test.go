@@ -0,0 +1,77 @@
+package onion
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/rps"
+)
+
+func TestRouterVerifyHop(t *testing.T) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+	otherHostKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+
+	ln, err := newTLSTransport(&config.Config{HostKey: hostKey}).Listen("127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				// the handshake is performed on the first read
+				_, _ = conn.Read(make([]byte, 1))
+				conn.Close()
+			}()
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+
+	router := newRouter(&config.Config{BanDuration: 60}, WithRPS(&mockRPS{}))
+	link, err := newLink(router.transport, addr.IP, uint16(addr.Port))
+	require.Nil(t, err)
+	defer link.Close()
+	require.NotNil(t, link.hostKey)
+
+	t.Run("matching host key", func(t *testing.T) {
+		hop := &rps.Peer{Address: addr.IP, Port: uint16(addr.Port), HostKey: &hostKey.PublicKey}
+		assert.Nil(t, router.verifyHop(link, hop))
+		assert.Empty(t, router.BannedPeers())
+	})
+
+	t.Run("unknown host key", func(t *testing.T) {
+		hop := &rps.Peer{Address: addr.IP, Port: uint16(addr.Port)}
+		assert.Nil(t, router.verifyHop(link, hop))
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		hop := &rps.Peer{Address: addr.IP, Port: uint16(addr.Port), HostKey: &otherHostKey.PublicKey}
+		assert.Equal(t, ErrHostKeyMismatch, router.verifyHop(link, hop))
+
+		banned := router.BannedPeers()
+		require.Len(t, banned, 1)
+		assert.Equal(t, MisbehaviorHostKey, banned[0].Reason)
+		assert.True(t, addr.IP.Equal(banned[0].Address))
+	})
+
+	t.Run("transport without TLS", func(t *testing.T) {
+		transport := &pipeTransport{}
+		link, err := newLink(transport, net.ParseIP("10.0.0.1"), 1)
+		require.Nil(t, err)
+		defer transport.remote[0].Close()
+		assert.Nil(t, link.hostKey)
+
+		hop := &rps.Peer{Address: net.ParseIP("10.0.0.1"), Port: 1, HostKey: &otherHostKey.PublicKey}
+		assert.Nil(t, router.verifyHop(link, hop))
+	})
+}
@@ -0,0 +1,64 @@
+package onion
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// keepaliveTicker returns a ticker channel for periodically checking whether an outgoing tunnel is idle for longer than
+// the configured keepalive, see checkAlive. If the keepalive is disabled, the returned channel is nil and thus never
+// delivers a tick. The returned stop function must be called to release the ticker.
+func (r *Router) keepaliveTicker() (c <-chan time.Time, stop func()) {
+	if r.cfg.TunnelKeepalive <= 0 {
+		return nil, func() {}
+	}
+
+	ticker := r.clock.NewTicker(r.keepalive())
+	return ticker.C(), ticker.Stop
+}
+
+// keepalive returns the configured tunnel keepalive as a time.Duration.
+func (r *Router) keepalive() time.Duration {
+	return time.Duration(r.cfg.TunnelKeepalive) * time.Second
+}
+
+// keepaliveClients returns the clients of the given tunnel which are told about it being alive.
+func (r *Router) keepaliveClients(tunnelID uint32) (clients []KeepaliveClient) {
+	r.tunnelsLock.RLock()
+	defer r.tunnelsLock.RUnlock()
+
+	for _, client := range r.tunnels[tunnelID] {
+		if keepaliveClient, ok := client.(KeepaliveClient); ok {
+			clients = append(clients, keepaliveClient)
+		}
+	}
+	return clients
+}
+
+// checkAlive pings the given idle outgoing tunnel through to its last hop in the background and announces it as alive
+// to its clients once the pong arrives. Tunnels not answering are not announced, such that the clients can tell them
+// from merely idle ones. Only a single check runs per tunnel at a time, tunnels without clients to tell, e.g. cover
+// tunnels, are not checked at all.
+func (r *Router) checkAlive(tunnel *Tunnel) {
+	if len(r.keepaliveClients(tunnel.id)) == 0 || !atomic.CompareAndSwapInt32(&tunnel.keepalive, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&tunnel.keepalive, 0)
+
+		// pongs are no traffic, thus the tunnel is still torn down once it exceeds the idle timeout
+		_, err := r.pingTunnel(tunnel)
+		if err != nil {
+			r.logger.Printf("Outgoing tunnel %v did not answer keepalive: %v\n", tunnel.id, err)
+			return
+		}
+
+		idle := tunnel.activity.idle(r.clock.Now())
+		for _, client := range r.keepaliveClients(tunnel.id) {
+			if notifyErr := client.SendTunnelAlive(tunnel.id, idle); notifyErr != nil {
+				r.terminateClient(client)
+			}
+		}
+	}()
+}
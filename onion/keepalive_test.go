@@ -0,0 +1,114 @@
+package onion
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+)
+
+// keepaliveClient is a KeepaliveClient passing on the tunnels announced as alive.
+type keepaliveClient struct {
+	ClientFuncs
+	alive chan time.Duration
+	err   error
+}
+
+func (client *keepaliveClient) SendTunnelAlive(tunnelID uint32, idle time.Duration) error {
+	client.alive <- idle
+	return client.err
+}
+
+func TestRouterKeepalive(t *testing.T) {
+	cfg := &config.Config{BuildTimeout: 1, TunnelKeepalive: 30}
+	// pings do not time out, see fakeClock.After
+	router := newRouter(cfg, WithRPS(&mockRPS{}), WithClock(&fakeClock{now: time.Now()}))
+
+	tunnel, remote := newPipeTunnel(t, 42)
+	hop := tunnel.hops[0]
+	tunnel.activity.touch(router.clock.Now().Add(-time.Minute))
+	router.outgoingTunnels[42] = tunnel
+
+	client := &keepaliveClient{alive: make(chan time.Duration, 1)}
+	failing := &keepaliveClient{alive: make(chan time.Duration, 1), err: errors.New("closed")}
+	plain := &ClientFuncs{}
+	for _, c := range []Client{client, failing, plain} {
+		router.RegisterClient(c)
+	}
+	router.tunnels[42] = []Client{client, failing, plain}
+
+	_, backward := p2p.NewRelayDigests(&hop.DHShared)
+	pong := func() message {
+		buf := make([]byte, p2p.MaxRelayDataSize+p2p.RelayHeaderSize)
+		_, n, err := p2p.PackRelayMessage(buf, 0, &p2p.RelayTunnelCover{}, backward)
+		require.Nil(t, err)
+		body, err := p2p.EncryptRelay(buf[:n], &hop.DHShared)
+		require.Nil(t, err)
+		return message{hdr: p2p.Header{Type: p2p.TypeTunnelRelay}, body: body}
+	}
+
+	t.Run("alive", func(t *testing.T) {
+		router.checkAlive(tunnel)
+		// a single check runs at a time
+		router.checkAlive(tunnel)
+
+		hdr, body := readRelayFromPrevHop(t, remote)
+		require.Equal(t, p2p.RelayTypeTunnelCover, hdr.RelayType)
+		coverMsg := p2p.RelayTunnelCover{}
+		require.Nil(t, coverMsg.Parse(body))
+		assert.True(t, coverMsg.Ping)
+		require.False(t, router.handleOutgoingTunnelMsg(tunnel, pong()))
+
+		assert.True(t, <-client.alive >= time.Minute)
+		<-failing.alive
+		assert.Eventually(t, func() bool {
+			router.clientsLock.Lock()
+			defer router.clientsLock.Unlock()
+			return len(router.clients) == 2
+		}, time.Second, 10*time.Millisecond, "clients which can not be notified are removed")
+		assert.Contains(t, router.clients, plain)
+	})
+
+	t.Run("no answer", func(t *testing.T) {
+		// the ping times out right away
+		router := newRouter(cfg, WithRPS(&mockRPS{}), WithClock(&instantClock{}))
+		router.RegisterClient(client)
+		router.outgoingTunnels[42] = tunnel
+		router.tunnels[42] = []Client{client}
+
+		require.Eventually(t, func() bool {
+			router.checkAlive(tunnel)
+			return atomic.LoadInt32(&tunnel.keepalive) != 0
+		}, time.Second, 10*time.Millisecond)
+		_, _ = readRelayFromPrevHop(t, remote)
+
+		// clients are notified before the check is finished
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&tunnel.keepalive) == 0
+		}, time.Second, 10*time.Millisecond)
+		select {
+		case <-client.alive:
+			t.Fatal("tunnel not answering announced as alive")
+		default:
+		}
+	})
+
+	t.Run("no clients", func(t *testing.T) {
+		router.tunnels[42] = []Client{plain}
+		router.checkAlive(tunnel)
+		assert.Equal(t, int32(0), atomic.LoadInt32(&tunnel.keepalive), "nobody to tell")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+		c, stop := router.keepaliveTicker()
+		defer stop()
+		assert.Nil(t, c)
+	})
+}
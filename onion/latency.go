@@ -0,0 +1,119 @@
+package onion
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"bawang/rps"
+)
+
+const (
+	// latencyWeight is the inverse weight of the latest step in the averages of the hop latencies, i.e. each step
+	// contributes 1/latencyWeight, such that consistently slow hops stand out from ones slow by chance.
+	latencyWeight = 8
+
+	// maxLatencyPeers limits the number of hops latencies are tracked for. The least recently used hop is forgotten
+	// first.
+	maxLatencyPeers = 1024
+)
+
+// HopLatency describes the time the hops took to complete the CREATE or EXTEND step of our tunnel builds, see
+// Router.HopLatencies.
+type HopLatency struct {
+	Address net.IP
+	Port    uint16
+	Steps   uint64        // number of completed steps
+	Average time.Duration // moving average of the steps, weighting recent ones more
+	Max     time.Duration // slowest step
+	Last    time.Time     // time the last step completed
+}
+
+// hopLatencyCounter records the duration of the CREATE and EXTEND steps of the tunnel builds, both by the position of
+// the hop and by the hop itself. The steps include the round trip to the hop and its handshake, but not opening the
+// link to the first hop. Steps which failed are not recorded, since they are counted as hop failures and timeouts ban
+// the hop anyway. It is safe for concurrent use.
+type hopLatencyCounter struct {
+	lock      sync.Mutex
+	positions map[int]time.Duration  // moving average by the position of the hop, 0 being the first hop
+	peers     map[string]*HopLatency // by reputationKey
+}
+
+// record records a step completed by the given hop at the given position.
+func (c *hopLatencyCounter) record(hop *rps.Peer, position int, latency time.Duration, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.positions == nil {
+		c.positions = make(map[int]time.Duration)
+		c.peers = make(map[string]*HopLatency)
+	}
+	if average, ok := c.positions[position]; ok {
+		c.positions[position] = average + (latency-average)/latencyWeight
+	} else {
+		c.positions[position] = latency
+	}
+
+	key := reputationKey(hop.Address, hop.Port)
+	peer, ok := c.peers[key]
+	if !ok {
+		if len(c.peers) >= maxLatencyPeers {
+			c.forgetLeastRecent()
+		}
+		peer = &HopLatency{Address: hop.Address, Port: hop.Port, Average: latency}
+		c.peers[key] = peer
+	}
+	peer.Steps++
+	peer.Average += (latency - peer.Average) / latencyWeight
+	if latency > peer.Max {
+		peer.Max = latency
+	}
+	peer.Last = now
+}
+
+// forgetLeastRecent forgets the hop which completed a step least recently.
+// Must be called with c.lock hold.
+func (c *hopLatencyCounter) forgetLeastRecent() {
+	var oldest string
+	for key, peer := range c.peers {
+		if oldest == "" || peer.Last.Before(c.peers[oldest].Last) {
+			oldest = key
+		}
+	}
+	delete(c.peers, oldest)
+}
+
+// byPosition returns a copy of the averages by position, nil if no steps were recorded yet.
+func (c *hopLatencyCounter) byPosition() (positions map[int]time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.positions) > 0 {
+		positions = make(map[int]time.Duration, len(c.positions))
+		for position, average := range c.positions {
+			positions[position] = average
+		}
+	}
+	return positions
+}
+
+// list returns a copy of the latencies of the hops, the slowest first.
+func (c *hopLatencyCounter) list() (peers []HopLatency) {
+	c.lock.Lock()
+	for _, peer := range c.peers {
+		peers = append(peers, *peer)
+	}
+	c.lock.Unlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Average > peers[j].Average
+	})
+	return peers
+}
+
+// HopLatencies returns the latencies of the hops our tunnels were built through, the slowest first, to identify
+// consistently slow hops.
+func (r *Router) HopLatencies() []HopLatency {
+	return r.latencies.list()
+}
@@ -0,0 +1,51 @@
+package onion
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/rps"
+)
+
+func TestHopLatencyCounter(t *testing.T) {
+	var c hopLatencyCounter
+	assert.Nil(t, c.byPosition())
+	assert.Empty(t, c.list())
+
+	now := time.Unix(1000000, 0)
+	fast := &rps.Peer{Address: net.IPv4(10, 0, 0, 1), Port: 1}
+	slow := &rps.Peer{Address: net.IPv4(10, 0, 0, 2), Port: 1}
+
+	c.record(fast, 0, 10*time.Millisecond, now)
+	c.record(slow, 1, 90*time.Millisecond, now)
+	c.record(fast, 1, 10*time.Millisecond, now.Add(time.Second))
+
+	// the averages start with the first step and move towards the later ones
+	assert.Equal(t, map[int]time.Duration{0: 10 * time.Millisecond, 1: 80 * time.Millisecond}, c.byPosition())
+
+	// the slowest hop is listed first
+	hops := c.list()
+	require.Len(t, hops, 2)
+	assert.Equal(t, HopLatency{Address: slow.Address, Port: 1, Steps: 1, Average: 90 * time.Millisecond,
+		Max: 90 * time.Millisecond, Last: now}, hops[0])
+	assert.Equal(t, HopLatency{Address: fast.Address, Port: 1, Steps: 2, Average: 10 * time.Millisecond,
+		Max: 10 * time.Millisecond, Last: now.Add(time.Second)}, hops[1])
+
+	// a single fast step barely changes the average of a slow hop
+	c.record(slow, 2, 10*time.Millisecond, now.Add(2*time.Second))
+	assert.Equal(t, 80*time.Millisecond, c.list()[0].Average)
+
+	t.Run("forget least recent", func(t *testing.T) {
+		for i := 0; i < maxLatencyPeers; i++ {
+			c.record(&rps.Peer{Address: net.IPv4(10, 1, byte(i>>8), byte(i)), Port: 1}, 0, time.Millisecond,
+				now.Add(time.Minute))
+		}
+		assert.Len(t, c.peers, maxLatencyPeers)
+		assert.NotContains(t, c.peers, reputationKey(fast.Address, fast.Port))
+		assert.NotContains(t, c.peers, reputationKey(slow.Address, slow.Port))
+	})
+}
@@ -2,21 +2,25 @@ package onion
 
 import (
 	"bufio"
-	"crypto/tls"
+	"crypto/rsa"
 	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net"
 	"strconv"
 	"sync"
+	"time"
 
+	"bawang/errcode"
 	"bawang/p2p"
 )
 
 var (
-	ErrInvalidTunnel     = errors.New("invalid tunnel")
-	ErrTimedOut          = errors.New("timed out")
-	ErrAlreadyRegistered = errors.New("a listener is already registered for this tunnel ID")
+	ErrInvalidTunnel     = errcode.New(errcode.ModuleOnion, errcode.InvalidTunnel, false, "invalid tunnel")
+	ErrTimedOut          = errcode.New(errcode.ModuleOnion, errcode.Timeout, true, "timed out")
+	ErrAlreadyRegistered = errcode.New(errcode.ModuleOnion, errcode.NotAllowed, false,
+		"a listener is already registered for this tunnel ID")
+	ErrLinkClosed = errcode.New(errcode.ModuleOnion, errcode.ConnClosed, true, "link is closed")
 )
 
 // message is a simple internal struct to combine a p2p.Header with the message body.
@@ -25,25 +29,60 @@ type message struct {
 	body []byte
 }
 
-// Link abstracts TLS level connections between peers which can be reused by multiple tunnels.
+// Link abstracts transport level connections between peers which can be reused by multiple tunnels.
 type Link struct {
 	address net.IP
 	port    uint16
 
-	nc net.Conn
-	rd *bufio.Reader
+	nc      net.Conn
+	rd      *bufio.Reader
+	hostKey *rsa.PublicKey // host key presented by the peer, nil if unknown, see Router.verifyHop and Router.identifyLink
 
-	msgLock sync.Mutex
-	msgBuf  [p2p.MessageSize]byte
+	incoming bool // whether the link was accepted from the peer, see Router.admitIncomingLink
+
+	writer writeScheduler // grants access to nc and msgBuf by priority
+	msgBuf [p2p.MessageSize]byte
+
+	// packs the messages sent on the link and the relay messages of the tunnels using it, see Router.rand
+	packer p2p.Packer
+
+	faults *faults // fault points injected for testing, nil if the link was not added to a Router, see Fault
 
 	// data channels for communication with other goroutines
 	dataLock sync.Mutex
 	dataOut  map[uint32]chan message // output data channels for received messages with corresponding tunnel IDs
 	Quit     chan struct{}
+	quitOnce sync.Once
+
+	padding sync.Once // starts the padding once both peers announced it, see Router.handleLinkMsg
+
+	reachChecking int32 // set while a reachability check of the peer is answered, accessed atomically
+
+	idleSince time.Time // time the last tunnel was removed from the link, zero while in use. Guarded by Router.linksLock
+
+	// identity of the adjacent peer, see Router.identifyLink. Guarded by Router.linksLock
+	key      linkKey // index of the link in Router.links
+	identity uint64  // announced by the peer in its p2p.LinkHello, 0 if unknown
+	retired  bool    // whether the link duplicates another one and is closed once unused
 }
 
-// newLink opens a new TLS connection to a peer given by address:port and returns a Link tracking that connection.
-func newLink(address net.IP, port uint16) (link *Link, err error) {
+// linkKey identifies the peer at the other end of a Link.
+type linkKey struct {
+	address string // IP address in its canonical form
+	port    uint16
+}
+
+// newLinkKey returns the linkKey of the peer given by address:port.
+func newLinkKey(address net.IP, port uint16) linkKey {
+	return linkKey{
+		address: address.String(),
+		port:    port,
+	}
+}
+
+// newLink opens a new connection to a peer given by address:port using the given Transport and returns a Link
+// tracking that connection.
+func newLink(transport Transport, address net.IP, port uint16) (link *Link, err error) {
 	link = &Link{
 		address: address,
 		port:    port,
@@ -51,7 +90,7 @@ func newLink(address net.IP, port uint16) (link *Link, err error) {
 		Quit:    make(chan struct{}),
 	}
 
-	err = link.connect()
+	err = link.connect(transport)
 	if err != nil {
 		return nil, err
 	}
@@ -61,69 +100,82 @@ func newLink(address net.IP, port uint16) (link *Link, err error) {
 
 // newLinkFromExistingConn creates a Link using an existing net.Conn,
 // e.g. when creating a new onion Link after receiving an incoming connection.
-func newLinkFromExistingConn(conn net.Conn) (link *Link) {
+func newLinkFromExistingConn(conn net.Conn) (link *Link, err error) {
 	ip, port, err := net.SplitHostPort(conn.RemoteAddr().String())
 	if err != nil {
-		log.Printf("Error parsing client remote ip: %v\n", err)
+		return nil, fmt.Errorf("error parsing client remote ip: %w", err)
 	}
 
-	portParsed, err := strconv.ParseUint(port, 10, 32)
+	portParsed, err := strconv.ParseUint(port, 10, 16)
 	if err != nil {
-		log.Printf("Error parsing client remote port: %v\n", err)
+		return nil, fmt.Errorf("error parsing client remote port: %w", err)
 	}
 	return &Link{
-		address: net.ParseIP(ip),
-		port:    uint16(portParsed),
-		nc:      conn,
-		rd:      bufio.NewReader(conn),
-		dataOut: make(map[uint32]chan message),
-		Quit:    make(chan struct{}),
-	}
+		address:  net.ParseIP(ip),
+		port:     uint16(portParsed),
+		nc:       conn,
+		rd:       bufio.NewReader(conn),
+		incoming: true,
+		dataOut:  make(map[uint32]chan message),
+		Quit:     make(chan struct{}),
+	}, nil
 }
 
-// connect initializes a TLS connection to the peer given by Link.address and Link.port
-func (link *Link) connect() (err error) {
-	tlsConfig := tls.Config{
-		InsecureSkipVerify: true, //nolint:gosec // peers do use self-signed certs
-	}
-
-	nc, err := tls.Dial("tcp", link.address.String()+":"+strconv.Itoa(int(link.port)), &tlsConfig)
+// connect initializes a connection to the peer given by Link.address and Link.port
+func (link *Link) connect(transport Transport) (err error) {
+	nc, err := transport.DialPeer(link.address, link.port)
 	if err != nil {
-		log.Printf("Error opening tls connection to peer: %v", err)
-		return
+		return fmt.Errorf("error opening connection to peer: %w", err)
 	}
 
 	link.nc = nc
 	link.rd = bufio.NewReader(nc)
+	link.hostKey = peerHostKey(nc)
 
 	return nil
 }
 
 // isUnused checks whether this Link is used by any tunnels
 func (link *Link) isUnused() (unused bool) {
+	return link.numTunnels() == 0
+}
+
+// numTunnels returns the number of tunnels registered with this Link
+func (link *Link) numTunnels() (n int) {
 	link.dataLock.Lock()
 	defer link.dataLock.Unlock()
 
-	return len(link.dataOut) == 0
+	return len(link.dataOut)
 }
 
 // register registers a message output channel for a tunnel with ID tunnelID with this link
-// after registering incoming messages for this tunnel ID will be queued into dataOut
-func (link *Link) register(tunnelID uint32, dataOut chan message, overwrite bool) (err error) {
+// after registering incoming messages for this tunnel ID will be queued into dataOut.
+// Registering a tunnel ID again fails with ErrAlreadyRegistered. Rebuilt tunnels never replace the registration of
+// their old circuit, since they are built on a new circuit ID, see Router.rebuildTunnel.
+func (link *Link) register(tunnelID uint32, dataOut chan message) (err error) {
 	link.dataLock.Lock()
 	defer link.dataLock.Unlock()
 
-	if !overwrite {
-		_, ok := link.dataOut[tunnelID]
-		if ok {
-			return ErrAlreadyRegistered
-		}
+	if _, ok := link.dataOut[tunnelID]; ok {
+		return ErrAlreadyRegistered
 	}
 
 	link.dataOut[tunnelID] = dataOut
 	return nil
 }
 
+// tunnelIDs returns the IDs of all tunnels registered with this Link
+func (link *Link) tunnelIDs() (tunnelIDs []uint32) {
+	link.dataLock.Lock()
+	defer link.dataLock.Unlock()
+
+	tunnelIDs = make([]uint32, 0, len(link.dataOut))
+	for tunnelID := range link.dataOut {
+		tunnelIDs = append(tunnelIDs, tunnelID)
+	}
+	return tunnelIDs
+}
+
 // hasTunnel returns true if there is a tunnel with ID tunnelID registered on this Link
 func (link *Link) hasTunnel(tunnelID uint32) (ok bool) {
 	link.dataLock.Lock()
@@ -149,10 +201,12 @@ func (link *Link) removeTunnel(tunnelID uint32) {
 	}
 	delete(link.dataOut, tunnelID)
 	link.dataLock.Unlock()
+	link.writer.forget(tunnelID)
 }
 
 // destroy terminates this Link connection by closing all data channels and closing the underlying net.Conn
 func (link *Link) destroy() (err error) {
+	link.Close() // reads failing from now on are expected, see readMsg
 	link.dataLock.Lock()
 	for _, dataChan := range link.dataOut {
 		close(dataChan)
@@ -162,54 +216,103 @@ func (link *Link) destroy() (err error) {
 	return
 }
 
-// Close stops the goroutine Link handler
+// Close stops the goroutine Link handler. Closing a Link multiple times is a no-op.
 func (link *Link) Close() {
-	close(link.Quit)
+	link.quitOnce.Do(func() {
+		close(link.Quit)
+	})
+}
+
+// isClosed checks whether the Link was closed
+func (link *Link) isClosed() (closed bool) {
+	select {
+	case <-link.Quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// bodyReadError is returned by Link.readMsg if the body of a message could not be read after its header.
+type bodyReadError struct {
+	err error
+}
+
+func (e *bodyReadError) Error() string {
+	return "error reading message body: " + e.err.Error()
+}
+
+func (e *bodyReadError) Unwrap() error {
+	return e.err
 }
 
 // readMsg reads a message from the underlying network connection and returns its type and message body.
+// If the header was read but not the body, the returned message holds the header and the error is a *bodyReadError.
+// Messages are not delimited on the connection, thus the link can not be used anymore after either failure, see
+// Router.handleReadError.
 func (link *Link) readMsg() (msg message, err error) {
-	// read the message header
+	// read the message header. io.EOF is returned if the connection was closed between two messages.
 	var hdr p2p.Header
 	if err = hdr.Read(link.rd); err != nil {
-		return msg, err
+		return msg, link.readError(err)
 	}
 
-	// ready message body
-	link.msgLock.Lock()
-	defer link.msgLock.Unlock()
-	body := link.msgBuf[:p2p.MaxBodySize]
+	// read message body. Every message needs its own buffer, since the tunnel handlers process it asynchronously
+	// while further messages are read.
+	body := make([]byte, p2p.MaxBodySize)
 	_, err = io.ReadFull(link.rd, body)
 	if err != nil {
 		if err == io.EOF {
 			err = io.ErrUnexpectedEOF
 		}
-		return msg, err
+		return message{hdr: hdr}, &bodyReadError{err: link.readError(err)}
 	}
 
 	return message{hdr, body}, nil
 }
 
-// sendRelay sends an onion p2p.Message of type p2p.TypeTunnelRelay on this Link.
+// readError annotates an error reading from the underlying connection. Apart from timeouts, network errors leave the
+// connection unusable, e.g. since it was closed by either side, and are thus reported with errcode.ConnClosed.
+func (link *Link) readError(err error) error {
+	if link.isClosed() {
+		return ErrLinkClosed
+	}
+
+	var netErr net.Error
+	if errors.Is(err, io.ErrClosedPipe) || errors.As(err, &netErr) && !netErr.Timeout() {
+		return &errcode.Error{
+			Code:   errcode.ConnClosed,
+			Module: errcode.ModuleOnion,
+			Err:    err,
+		}
+	}
+	return err
+}
+
+// sendRelay sends an onion p2p.Message of type p2p.TypeTunnelRelay on this Link with the given priority class.
 // The message body is passed as a packed, raw byte array. Will prepend a correct p2p.Header before the relay message
-func (link *Link) sendRelay(tunnelID uint32, msg []byte) (err error) {
+func (link *Link) sendRelay(tunnelID uint32, msg []byte, priority Priority) (err error) {
 	if len(msg) > p2p.MessageSize-p2p.HeaderSize {
 		return p2p.ErrInvalidMessage
 	}
 
+	if link.faults.dropCell(link) {
+		return nil
+	}
+
 	header := p2p.Header{
 		TunnelID: tunnelID,
 		Type:     p2p.TypeTunnelRelay,
 	}
 
-	link.msgLock.Lock()
+	link.writer.acquire(tunnelID, priority)
 
 	data := link.msgBuf[:]
 	header.Pack(data[:p2p.HeaderSize])
 	copy(data[p2p.HeaderSize:], msg)
 
 	_, err = link.nc.Write(data)
-	link.msgLock.Unlock()
+	link.writer.release()
 
 	return err
 }
@@ -222,12 +325,23 @@ func (link *Link) sendDestroyTunnel(tunnelID uint32) (err error) {
 }
 
 // sendMsg sends a p2p.Message for the given tunnelID on this link. Handles packing of p2p.Header and p2p.Message packing.
+// Such messages control the tunnels, thus they are sent with PriorityControl.
 func (link *Link) sendMsg(tunnelID uint32, msg p2p.Message) (err error) {
-	link.msgLock.Lock()
-	defer link.msgLock.Unlock()
+	return link.sendMsgWithPriority(tunnelID, msg, PriorityControl)
+}
+
+// sendMsgWithPriority sends a p2p.Message like sendMsg, but with the given priority class.
+func (link *Link) sendMsgWithPriority(tunnelID uint32, msg p2p.Message, priority Priority) (err error) {
+	// faults only concern the tunnels, the link itself is kept up
+	if tunnelID != p2p.LinkTunnelID && link.faults.dropCell(link) {
+		return nil
+	}
+
+	link.writer.acquire(tunnelID, priority)
+	defer link.writer.release()
 
 	data := link.msgBuf[:]
-	n, err := p2p.PackMessage(data, tunnelID, msg)
+	n, err := link.packer.PackMessage(data, tunnelID, msg)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,118 @@
+package onion
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+)
+
+func TestRouterLinkIndex(t *testing.T) {
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+	newIndexedLink := func(address string, port uint16) *Link {
+		link := &Link{
+			address: net.ParseIP(address),
+			port:    port,
+			dataOut: make(map[uint32]chan message),
+			Quit:    make(chan struct{}),
+		}
+		router.addLink(link)
+		return link
+	}
+
+	link1 := newIndexedLink("10.0.0.1", 1)
+	link2 := newIndexedLink("10.0.0.1", 2)
+	assert.Equal(t, 2, router.numLinks)
+
+	// IPv4 addresses are indexed in their canonical form
+	found, ok := router.GetLink(net.ParseIP("::ffff:10.0.0.1"), 1)
+	require.True(t, ok)
+	assert.Equal(t, link1, found)
+	found, ok = router.GetLink(net.ParseIP("10.0.0.1"), 2)
+	require.True(t, ok)
+	assert.Equal(t, link2, found)
+	_, ok = router.GetLink(net.ParseIP("10.0.0.2"), 1)
+	assert.False(t, ok)
+
+	require.Nil(t, router.registerCircuit(link1, 42, make(chan message, 1)))
+	assert.Equal(t, link1, router.circuitLinks[42])
+
+	// circuits of a removed link are dropped from the index
+	router.removeLink(link1)
+	assert.Equal(t, 1, router.numLinks)
+	assert.NotContains(t, router.circuitLinks, uint32(42))
+	_, ok = router.GetLink(net.ParseIP("10.0.0.1"), 1)
+	assert.False(t, ok)
+
+	// closed links do not accept circuits anymore
+	link2.Close()
+	assert.Equal(t, ErrLinkClosed, router.registerCircuit(link2, 43, make(chan message, 1)))
+	assert.NotContains(t, router.circuitLinks, uint32(43))
+}
+
+func TestLinkRegister(t *testing.T) {
+	link := &Link{dataOut: make(map[uint32]chan message)}
+	prev := make(chan message, 5)
+	require.Nil(t, link.register(42, prev))
+	assert.Equal(t, ErrAlreadyRegistered, link.register(42, make(chan message, 5)))
+	dataOut, ok := link.getDataOut(42)
+	require.True(t, ok)
+	assert.Equal(t, prev, dataOut)
+}
+
+// newBenchmarkRouter creates a Router with the given number of links, each carrying the given number of circuits.
+func newBenchmarkRouter(b *testing.B, numLinks, circuitsPerLink int) (router *Router, links []*Link) {
+	router = newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+	for i := 0; i < numLinks; i++ {
+		link := &Link{
+			address: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)),
+			port:    1,
+			dataOut: make(map[uint32]chan message),
+			Quit:    make(chan struct{}),
+		}
+		router.addLink(link)
+		for j := 0; j < circuitsPerLink; j++ {
+			err := router.registerCircuit(link, uint32(i*circuitsPerLink+j), make(chan message))
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		links = append(links, link)
+	}
+	return router, links
+}
+
+func BenchmarkRouterGetLink(b *testing.B) {
+	router, links := newBenchmarkRouter(b, 4096, 1)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		link := links[i%len(links)]
+		if _, ok := router.GetLink(link.address, link.port); !ok {
+			b.Fatal("link not found")
+		}
+	}
+}
+
+func BenchmarkRouterRemoveTunnelFromLinks(b *testing.B) {
+	const numLinks, circuitsPerLink = 1024, 8
+	router, links := newBenchmarkRouter(b, numLinks, circuitsPerLink)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// keep the links in use, such that they are not closed
+		circuitID := uint32(i % (numLinks * circuitsPerLink))
+		link := links[int(circuitID)/circuitsPerLink]
+		router.removeTunnelFromLinks(circuitID)
+
+		b.StopTimer()
+		err := router.registerCircuit(link, circuitID, make(chan message))
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+	}
+}
@@ -0,0 +1,52 @@
+package onion
+
+import (
+	"sort"
+	"time"
+)
+
+// linkIdleTimeout returns the configured time links without any tunnels are kept open for reuse.
+func (r *Router) linkIdleTimeout() time.Duration {
+	return time.Duration(r.cfg.LinkIdleTimeout) * time.Second
+}
+
+// closeIdleLinks closes the links which are not used by any tunnel anymore and exceeded the configured idle timeout.
+// If more idle links than configured remain, the ones idle for the longest time are closed as well. Idle links are
+// kept open to be reused by further tunnels to the same peer, saving the connection setup and TLS handshake.
+// Called whenever a link becomes idle and at the beginning of each round. Must be called with r.linksLock hold.
+func (r *Router) closeIdleLinks() {
+	now := r.clock.Now()
+
+	var idle []*Link
+	for link := range r.idleLinks {
+		if !link.isUnused() {
+			// the link is used again
+			delete(r.idleLinks, link)
+			link.idleSince = time.Time{}
+			continue
+		}
+		if now.Sub(link.idleSince) >= r.linkIdleTimeout() {
+			r.closeIdleLink(link)
+			continue
+		}
+		idle = append(idle, link)
+	}
+
+	if r.cfg.MaxIdleLinks <= 0 || len(idle) <= r.cfg.MaxIdleLinks {
+		return
+	}
+
+	sort.Slice(idle, func(i, j int) bool {
+		return idle[i].idleSince.Before(idle[j].idleSince)
+	})
+	for _, link := range idle[:len(idle)-r.cfg.MaxIdleLinks] {
+		r.closeIdleLink(link)
+	}
+}
+
+// closeIdleLink closes a link not used by any circuit anymore. Must be called with r.linksLock hold.
+func (r *Router) closeIdleLink(link *Link) {
+	delete(r.idleLinks, link)
+	link.idleSince = time.Time{}
+	link.Close()
+}
@@ -0,0 +1,115 @@
+package onion
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+)
+
+func TestRouterLinkPool(t *testing.T) {
+	newPoolLink := func(router *Router, address string) *Link {
+		link := &Link{
+			address: net.ParseIP(address),
+			port:    1,
+			dataOut: make(map[uint32]chan message),
+			Quit:    make(chan struct{}),
+		}
+		router.addLink(link)
+		return link
+	}
+
+	t.Run("idle timeout", func(t *testing.T) {
+		clock := &fakeClock{now: time.Now()}
+		router := newRouter(&config.Config{LinkIdleTimeout: 60}, WithRPS(&mockRPS{}), WithClock(clock))
+		link := newPoolLink(router, "10.0.0.1")
+		require.Nil(t, router.registerCircuit(link, 1, make(chan message, 1)))
+
+		// the idle link is kept open for reuse
+		router.removeTunnelFromLinks(1)
+		assert.False(t, link.isClosed())
+
+		reused, ok := router.GetLink(link.address, link.port)
+		require.True(t, ok)
+		assert.Equal(t, link, reused)
+		require.Nil(t, router.registerCircuit(link, 2, make(chan message, 1)))
+
+		// links in use do not expire
+		clock.advance(2 * time.Minute)
+		router.linksLock.Lock()
+		router.closeIdleLinks()
+		router.linksLock.Unlock()
+		assert.False(t, link.isClosed())
+
+		router.removeTunnelFromLinks(2)
+		clock.advance(59 * time.Second)
+		router.linksLock.Lock()
+		router.closeIdleLinks()
+		router.linksLock.Unlock()
+		assert.False(t, link.isClosed())
+
+		clock.advance(time.Second)
+		router.linksLock.Lock()
+		router.closeIdleLinks()
+		router.linksLock.Unlock()
+		assert.True(t, link.isClosed())
+
+		// closed links are not reused
+		_, ok = router.GetLink(link.address, link.port)
+		assert.False(t, ok)
+	})
+
+	t.Run("no idle timeout", func(t *testing.T) {
+		router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+		link := newPoolLink(router, "10.0.0.1")
+		require.Nil(t, router.registerCircuit(link, 1, make(chan message, 1)))
+
+		router.removeTunnelFromLinks(1)
+		assert.True(t, link.isClosed())
+	})
+
+	t.Run("max idle links", func(t *testing.T) {
+		clock := &fakeClock{now: time.Now()}
+		router := newRouter(&config.Config{LinkIdleTimeout: 60, MaxIdleLinks: 2}, WithRPS(&mockRPS{}), WithClock(clock))
+
+		var links []*Link
+		for i, address := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+			link := newPoolLink(router, address)
+			require.Nil(t, router.registerCircuit(link, uint32(i), make(chan message, 1)))
+			links = append(links, link)
+		}
+
+		for i := range links {
+			clock.advance(time.Second)
+			router.removeTunnelFromLinks(uint32(i))
+		}
+
+		// the link idle for the longest time is closed
+		assert.True(t, links[0].isClosed())
+		assert.False(t, links[1].isClosed())
+		assert.False(t, links[2].isClosed())
+	})
+
+	t.Run("max tunnels per link", func(t *testing.T) {
+		router := newRouter(&config.Config{MaxLinkTunnels: 2}, WithRPS(&mockRPS{}))
+		link := newPoolLink(router, "10.0.0.1")
+		require.Nil(t, router.registerCircuit(link, 1, make(chan message, 1)))
+
+		_, ok := router.GetLink(link.address, link.port)
+		require.True(t, ok)
+
+		// a full link is not used for further tunnels
+		require.Nil(t, router.registerCircuit(link, 2, make(chan message, 1)))
+		_, ok = router.GetLink(link.address, link.port)
+		require.False(t, ok)
+
+		other := newPoolLink(router, "10.0.0.1")
+		found, ok := router.GetLink(link.address, link.port)
+		require.True(t, ok)
+		assert.Equal(t, other, found)
+	})
+}
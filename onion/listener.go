@@ -1,137 +1,127 @@
 package onion
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/tls"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
-	"fmt"
-	"log"
-	"math/big"
 	"net"
 	"strconv"
+	"time"
 
 	"bawang/config"
 )
 
-// ListenOnionSocket opens a TLS listener on the host specified in cfg that handles incoming P2P onion traffic.
-func ListenOnionSocket(cfg *config.Config, router *Router, errOut chan error, quit chan struct{}) {
-	cert, err := tlsCertFromHostKey(cfg.HostKey)
-	if err != nil {
-		errOut <- err
-		return
-	}
+// Delays before accepting connections again after the listener failed to accept one, e.g. because we ran out of file
+// descriptors. The delay is doubled on every consecutive failure.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
 
-	tlsConfig := tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		InsecureSkipVerify: true, //nolint:gosec // peers do use self-signed certs
-	}
-	ln, err := tls.Listen("tcp", fmt.Sprintf("%s:%d", cfg.P2PHostname, cfg.P2PPort), &tlsConfig)
+// ListenOnionSocket opens a listener using the router's Transport on the host specified in cfg that handles incoming
+// P2P onion traffic until quit is closed.
+// Accepted connections are set up concurrently, at most ListenBacklog at a time. While the backlog is full, no further
+// connections are accepted and are left to the backlog of the OS, such that a flood of connections can not exhaust our
+// resources.
+func ListenOnionSocket(cfg *config.Config, router *Router, quit chan struct{}) error {
+	ln, err := router.transport.Listen(net.JoinHostPort(cfg.P2PHostname, strconv.Itoa(cfg.P2PPort)))
 	if err != nil {
-		errOut <- err
-		log.Printf("Failed to open TLS connection: %v\n", err)
-		return
+		router.logger.Printf("Failed to open onion listener: %v\n", err)
+		return err
 	}
 	defer ln.Close()
-	log.Printf("Onion Server Listening at %v:%v\n", cfg.P2PHostname, cfg.P2PPort)
+	router.logger.Printf("Onion Server Listening at %v:%v\n", cfg.P2PHostname, cfg.P2PPort)
+
+	router.listening.Set(true)
+	defer router.listening.Set(false)
 
 	// concurrently wait for a quit signal and close the listener if one is received to stop the loop below when blocking on ln.Accept()
-	shuttingDown := false
 	go func() {
 		<-quit
-		shuttingDown = true
 		ln.Close()
 	}()
 
+	var backlog chan struct{} // slots of the connections being set up, nil if unlimited
+	if cfg.ListenBacklog > 0 {
+		backlog = make(chan struct{}, cfg.ListenBacklog)
+	}
+	var delay time.Duration
 	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			if shuttingDown {
-				return
+		if backlog != nil {
+			select {
+			case backlog <- struct{}{}:
+			case <-quit:
+				return nil
 			}
-			log.Printf("Error accepting client connection: %v\n", err)
-			continue
 		}
-		defer conn.Close()
 
-		ip, port, err := net.SplitHostPort(conn.RemoteAddr().String())
-		if err != nil {
-			log.Printf("Error parsing client remote ip: %v\n", err)
-			continue
-		}
-
-		portParsed, err := strconv.ParseUint(port, 10, 32)
+		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("Error parsing client remote port: %v\n", err)
-			continue
-		}
+			if backlog != nil {
+				<-backlog
+			}
+			select {
+			case <-quit:
+				return nil
+			default:
+			}
 
-		tlsConn, ok := conn.(*tls.Conn)
-		if !ok {
-			log.Printf("Invalid TLS connection from peer %v:%v\n", ip, port)
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else {
+				delay *= 2
+			}
+			if delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			router.logger.Printf("Error accepting client connection, retrying in %v: %v\n", delay, err)
+			select {
+			case <-quit:
+				return nil
+			case <-router.clock.After(delay):
+			}
 			continue
 		}
+		delay = 0
 
-		log.Printf("Received new connection from peer %v:%v\n", ip, port)
-
-		_, err = router.CreateLinkFromExistingConn(tlsConn)
-		if err != nil {
-			log.Printf("Error creating link to %v:%v: %v\n", ip, portParsed, err)
-			continue
-		}
+		go func() {
+			router.acceptLink(conn, time.Duration(cfg.BuildTimeout)*time.Second)
+			if backlog != nil {
+				<-backlog
+			}
+		}()
 	}
 }
 
-// tlsCertFromHostKey creates a tls.Certificate from a given rsa.PrivateKey usable in tls.Listen or tls.Dial
-func tlsCertFromHostKey(hostKey *rsa.PrivateKey) (cert tls.Certificate, err error) {
-	// construct tls certificate from p2p hostkey
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
-	if err != nil {
-		log.Printf("Failed to generate serial number: %v\n", err)
-		return cert, err
-	}
-
-	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			Organization: []string{"Voidphone"},
-		},
-
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-		IsCA:                  true,
-	}
+// handshaker is implemented by connections performing a handshake of their own, like the ones of the TLS transport.
+type handshaker interface {
+	Handshake() error
+}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, hostKey.Public(), hostKey)
-	if err != nil {
-		log.Printf("Failed to create certificate: %v\n", err)
-		return cert, err
+// acceptLink sets up a Link on a connection accepted from another peer, closing the connection if that fails. The
+// handshake of the transport, if any, must be completed within the given timeout, such that stalled connections do not
+// hold a slot of the backlog.
+func (r *Router) acceptLink(conn net.Conn, timeout time.Duration) {
+	if !r.admitIncomingLink() {
+		_ = conn.Close()
+		r.logError(ErrTooManyLinks, "Rejected connection from peer %v", conn.RemoteAddr())
+		return
 	}
 
-	privBytes, err := x509.MarshalPKCS8PrivateKey(hostKey)
-	if err != nil {
-		log.Printf("Failed to create certificate: %v\n", err)
-		return cert, err
+	if hs, ok := conn.(handshaker); ok {
+		if timeout > 0 {
+			_ = conn.SetDeadline(time.Now().Add(timeout))
+		}
+		err := hs.Handshake()
+		if err != nil {
+			_ = conn.Close()
+			r.logError(err, "Error in handshake with peer %v", conn.RemoteAddr())
+			return
+		}
+		_ = conn.SetDeadline(time.Time{})
 	}
 
-	certPem := pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: derBytes,
-	})
-
-	privPem := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: privBytes,
-	})
+	r.logger.Printf("Received new connection from peer %v\n", conn.RemoteAddr())
 
-	cert, err = tls.X509KeyPair(certPem, privPem)
+	_, err := r.CreateLinkFromExistingConn(conn)
 	if err != nil {
-		log.Printf("Failed to create server key pair: %v\n", err)
-		return cert, err
+		r.logError(err, "Error creating link to %v", conn.RemoteAddr())
 	}
-	return cert, nil
 }
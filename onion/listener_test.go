@@ -4,7 +4,12 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -12,6 +17,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"bawang/config"
+	"bawang/errcode"
 	"bawang/p2p"
 )
 
@@ -32,11 +38,12 @@ func TestListenOnionSocket(t *testing.T) {
 	router := newRouterWithRPS(&cfg, nil)
 	require.NotNil(t, router)
 
-	errChan := make(chan error)
 	quitChan := make(chan struct{})
 
-	go ListenOnionSocket(&cfg, router, errChan, quitChan)
+	assert.Equal(t, ErrNotListening, router.CheckListener())
+	go ListenOnionSocket(&cfg, router, quitChan)
 	time.Sleep(1 * time.Second) // annoyingly wait for the socket to fully start
+	assert.Nil(t, router.CheckListener())
 
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: true, //nolint:gosec // no valid cert for this test
@@ -47,7 +54,7 @@ func TestListenOnionSocket(t *testing.T) {
 
 	createMsg := p2p.TunnelCreate{
 		Version:     1,
-		EncDHPubKey: [512]byte{},
+		EncDHPubKey: make([]byte, p2p.EncDHPubKeySize),
 	}
 	buf := make([]byte, p2p.MessageSize)
 	n, err := p2p.PackMessage(buf, 123, &createMsg)
@@ -61,3 +68,126 @@ func TestListenOnionSocket(t *testing.T) {
 	conn.Close()
 	close(quitChan)
 }
+
+// peerConn is a connection with the address of a remote peer, since pipes have none.
+type peerConn struct {
+	net.Conn
+}
+
+func (c peerConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6602}
+}
+
+// tlsPeerConn is a TLS connection with the address of a remote peer.
+type tlsPeerConn struct {
+	*tls.Conn
+}
+
+func (c tlsPeerConn) RemoteAddr() net.Addr {
+	return peerConn{}.RemoteAddr()
+}
+
+// chanListener is a net.Listener accepting the connections sent on its channel.
+type chanListener struct {
+	conns     chan net.Conn
+	accepted  int32 // number of accepted connections, accessed atomically
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (ln *chanListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		atomic.AddInt32(&ln.accepted, 1)
+		return conn, nil
+	case <-ln.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (ln *chanListener) Close() error {
+	ln.closeOnce.Do(func() {
+		close(ln.closed)
+	})
+	return nil
+}
+
+func (ln *chanListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}
+}
+
+// listenerTransport is a Transport listening on a given net.Listener.
+type listenerTransport struct {
+	pipeTransport
+	ln net.Listener
+}
+
+func (t *listenerTransport) Listen(address string) (net.Listener, error) {
+	return t.ln, nil
+}
+
+func TestListenOnionSocketBacklog(t *testing.T) {
+	ln := &chanListener{conns: make(chan net.Conn, 1), closed: make(chan struct{})}
+	cfg := &config.Config{BuildTimeout: 1, ListenBacklog: 1}
+	router := newRouter(cfg, WithRPS(&mockRPS{}), WithTransport(&listenerTransport{ln: ln}))
+
+	quit := make(chan struct{})
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- ListenOnionSocket(cfg, router, quit)
+	}()
+
+	// the TLS handshake stalls, since the peer never sends anything
+	stalledLocal, stalledRemote := net.Pipe()
+	defer stalledRemote.Close()
+	ln.conns <- tlsPeerConn{tls.Server(stalledLocal, &tls.Config{})}
+
+	connLocal, connRemote := net.Pipe()
+	defer connRemote.Close()
+	ln.conns <- peerConn{connLocal}
+
+	// no further connection is accepted while the backlog is full
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ln.accepted))
+
+	// the stalled handshake times out and frees the backlog
+	require.Eventually(t, func() bool {
+		router.linksLock.Lock()
+		defer router.linksLock.Unlock()
+		return router.numIncoming == 1
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&ln.accepted))
+	_, err := stalledRemote.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	close(quit)
+	select {
+	case err = <-errChan:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Error("listener did not stop on quit")
+	}
+}
+
+func TestRouterAcceptLink(t *testing.T) {
+	router := newRouter(&config.Config{MaxIncomingLinks: 1}, WithRPS(&mockRPS{}))
+
+	connLocal, connRemote := net.Pipe()
+	defer connRemote.Close()
+	router.acceptLink(peerConn{connLocal}, time.Second)
+	router.linksLock.Lock()
+	assert.Equal(t, 1, router.numLinks)
+	assert.Equal(t, 1, router.numIncoming)
+	router.linksLock.Unlock()
+
+	// further incoming links are rejected and counted as errors
+	rejectedLocal, rejectedRemote := net.Pipe()
+	router.acceptLink(peerConn{rejectedLocal}, time.Second)
+	_, err := rejectedRemote.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, uint64(1), router.Stats().Errors[errcode.Limit])
+
+	router.linksLock.Lock()
+	assert.Equal(t, 1, router.numIncoming)
+	router.linksLock.Unlock()
+}
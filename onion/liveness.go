@@ -0,0 +1,176 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/x509"
+	"net"
+	"sync"
+	"time"
+
+	"bawang/api"
+	"bawang/rps"
+)
+
+const (
+	// livenessTimeoutRounds is the number of rounds after which a peer which stopped announcing its descriptor is
+	// considered dead. Announcements are sent once per round, thus a few may be lost without consequences.
+	livenessTimeoutRounds = 3
+
+	// livenessForgetRounds is the number of rounds after which the last announcement of a peer is forgotten, such that
+	// peers which are dead for long or never announced anything are treated alike.
+	livenessForgetRounds = 30
+)
+
+// livenessDataType is the Gossip data type of the descriptors announced by onion peers.
+const livenessDataType = uint16(api.AppTypeOnion)
+
+// peerLiveness is the last announcement of a peer received via the Gossip module.
+type peerLiveness struct {
+	lastSeen    time.Time
+	hostKey     []byte // PKCS#1 encoded host key
+	hibernating bool   // whether the peer used up its relay quota, see Router.hibernating
+}
+
+// liveness tracks the descriptors announced by other peers via the Gossip module. It serves as a hint for path
+// selection only: peers not announcing anything are not considered dead, since not every peer uses the Gossip module.
+// Like in the reputation, peers are identified by their P2P address.
+type liveness struct {
+	lock  sync.Mutex
+	peers map[string]*peerLiveness
+}
+
+func newLiveness() *liveness {
+	return &liveness{
+		peers: make(map[string]*peerLiveness),
+	}
+}
+
+// seen records an announcement of the given peer.
+func (l *liveness) seen(address net.IP, port uint16, hostKey []byte, hibernating bool, now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.peers[reputationKey(address, port)] = &peerLiveness{
+		lastSeen:    now,
+		hostKey:     hostKey,
+		hibernating: hibernating,
+	}
+}
+
+// dead checks whether the given peer stopped announcing its descriptor before the deadline or announced a different
+// host key than the one we know it by, e.g. because the peer was replaced by another one.
+func (l *liveness) dead(peer *rps.Peer, deadline time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	p, ok := l.peers[reputationKey(peer.Address, peer.Port)]
+	if !ok {
+		return false
+	}
+	if p.lastSeen.Before(deadline) {
+		return true
+	}
+	return peer.HostKey != nil && !bytes.Equal(p.hostKey, x509.MarshalPKCS1PublicKey(peer.HostKey))
+}
+
+// hibernating checks whether the last announcement of the given peer said that it used up its relay quota.
+func (l *liveness) hibernating(peer *rps.Peer) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	p, ok := l.peers[reputationKey(peer.Address, peer.Port)]
+	return ok && p.hibernating
+}
+
+// prune forgets the announcements received before the given time.
+func (l *liveness) prune(before time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for key, p := range l.peers {
+		if p.lastSeen.Before(before) {
+			delete(l.peers, key)
+		}
+	}
+}
+
+// subscribeLiveness subscribes to the descriptors announced by other peers via the Gossip module.
+func (r *Router) subscribeLiveness() error {
+	return r.gossip.Notify(livenessDataType, r.handleDescriptor)
+}
+
+// handleDescriptor records the descriptor announced by another peer. Only well-formed descriptors are spread further.
+func (r *Router) handleDescriptor(data []byte) (valid bool) {
+	var desc api.OnionDescriptor
+	err := desc.Parse(data)
+	if err != nil || desc.OnionPort == 0 {
+		return false
+	}
+
+	_, err = desc.ParseHostKey()
+	if err != nil {
+		return false
+	}
+
+	r.liveness.seen(desc.Address, desc.OnionPort, desc.HostKey, desc.Hibernating, r.clock.Now())
+	return true
+}
+
+// announceLiveness announces our own descriptor via the Gossip module, if configured, and forgets the announcements
+// of other peers which are too old to be of any use.
+func (r *Router) announceLiveness() {
+	if r.gossip == nil {
+		return
+	}
+
+	roundDuration := time.Duration(r.cfg.RoundDuration) * time.Second
+	r.liveness.prune(r.clock.Now().Add(-livenessForgetRounds * roundDuration))
+
+	if r.cfg.ClientOnly || r.isUnreachable() {
+		r.logger.Printf("Not announcing liveness, other peers can not reach us\n")
+		return
+	}
+
+	address := net.ParseIP(r.cfg.P2PHostname)
+	if address == nil || r.cfg.HostKey == nil {
+		r.logger.Printf("Not announcing liveness, no P2P address or host key configured\n")
+		return
+	}
+
+	desc := api.OnionDescriptor{
+		Version:     api.DescriptorVersionSized,
+		IPv6:        address.To4() == nil,
+		Hibernating: r.hibernating(),
+		OnionPort:   uint16(r.cfg.P2PPort),
+		Address:     address,
+		HostKey:     x509.MarshalPKCS1PublicKey(&r.cfg.HostKey.PublicKey),
+	}
+	data := make([]byte, desc.PackedSize())
+	_, err := desc.Pack(data)
+	if err != nil {
+		r.logger.Printf("Error packing descriptor: %v\n", err)
+		return
+	}
+
+	err = r.gossip.Announce(0, livenessDataType, data)
+	if err != nil {
+		r.logger.Printf("Error announcing liveness: %v\n", err)
+	}
+}
+
+// containsDeadPeer checks whether any of the given peers is likely dead or hibernating according to the announcements
+// received via the Gossip module.
+func (r *Router) containsDeadPeer(peers []*rps.Peer) bool {
+	if r.gossip == nil {
+		return false
+	}
+
+	roundDuration := time.Duration(r.cfg.RoundDuration) * time.Second
+	deadline := r.clock.Now().Add(-livenessTimeoutRounds * roundDuration)
+	for _, peer := range peers {
+		if r.liveness.dead(peer, deadline) || r.liveness.hibernating(peer) {
+			return true
+		}
+	}
+	return false
+}
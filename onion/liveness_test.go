@@ -0,0 +1,199 @@
+package onion
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/api"
+	"bawang/config"
+	"bawang/gossip"
+	"bawang/rps"
+)
+
+// mockGossip is a gossip.Gossip recording the announced data and the subscribed handlers in tests.
+type mockGossip struct {
+	announced [][]byte
+	handlers  map[uint16]gossip.Handler
+}
+
+func (m *mockGossip) Announce(ttl uint8, dataType uint16, data []byte) (err error) {
+	m.announced = append(m.announced, data)
+	return nil
+}
+
+func (m *mockGossip) Notify(dataType uint16, handler gossip.Handler) (err error) {
+	if m.handlers == nil {
+		m.handlers = make(map[uint16]gossip.Handler)
+	}
+	m.handlers[dataType] = handler
+	return nil
+}
+
+func (m *mockGossip) Close() {}
+
+var _ gossip.Gossip = &mockGossip{}
+
+// descriptor packs the descriptor announced by the given peer.
+func descriptor(t *testing.T, peer *rps.Peer) []byte {
+	desc := api.OnionDescriptor{
+		OnionPort: peer.Port,
+		Address:   peer.Address,
+		HostKey:   x509.MarshalPKCS1PublicKey(peer.HostKey),
+	}
+	data := make([]byte, desc.PackedSize())
+	_, err := desc.Pack(data)
+	require.Nil(t, err)
+	return data
+}
+
+func TestRouterLiveness(t *testing.T) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+	otherHostKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+
+	peerA := &rps.Peer{Address: net.ParseIP("10.0.0.1").To4(), Port: 1, HostKey: &hostKey.PublicKey}
+	peerB := &rps.Peer{Address: net.ParseIP("10.0.0.2").To4(), Port: 1, HostKey: &hostKey.PublicKey}
+	peerC := &rps.Peer{Address: net.ParseIP("10.0.0.3").To4(), Port: 1, HostKey: &hostKey.PublicKey}
+	target := &rps.Peer{Address: net.ParseIP("10.0.0.4").To4(), Port: 1, HostKey: &hostKey.PublicKey}
+
+	cfg := &config.Config{
+		P2PHostname:   "10.0.0.5",
+		P2PPort:       1,
+		TunnelLength:  3,
+		RoundDuration: 60,
+		HostKey:       hostKey,
+	}
+
+	t.Run("announce", func(t *testing.T) {
+		g := &mockGossip{}
+		router := newRouter(cfg, WithRPS(&mockRPS{}), WithGossip(g))
+		router.startRound()
+		router.startRound()
+
+		require.Len(t, g.announced, 2)
+		desc := api.OnionDescriptor{}
+		require.Nil(t, desc.Parse(g.announced[0]))
+		assert.Equal(t, uint8(api.DescriptorVersionSized), desc.Version)
+		assert.Equal(t, "10.0.0.5", desc.Address.String())
+		assert.Equal(t, uint16(1), desc.OnionPort)
+		assert.Equal(t, x509.MarshalPKCS1PublicKey(&hostKey.PublicKey), desc.HostKey)
+	})
+
+	t.Run("client only", func(t *testing.T) {
+		cfg := *cfg
+		cfg.ClientOnly = true
+		g := &mockGossip{}
+		router := newRouter(&cfg, WithRPS(&mockRPS{}), WithGossip(g))
+		router.startRound()
+
+		assert.Empty(t, g.announced)
+	})
+
+	t.Run("descriptors", func(t *testing.T) {
+		g := &mockGossip{}
+		router := newRouter(cfg, WithRPS(&mockRPS{}), WithGossip(g))
+		require.Nil(t, router.subscribeLiveness())
+		handler := g.handlers[livenessDataType]
+		require.NotNil(t, handler)
+
+		assert.True(t, handler(descriptor(t, peerA)))
+		assert.False(t, handler([]byte{0, 0, 0, 1}))
+		assert.False(t, handler(descriptor(t, peerA)[:20]), "truncated host key")
+	})
+
+	t.Run("dead peers", func(t *testing.T) {
+		clock := &fakeClock{now: time.Now()}
+		g := &mockGossip{}
+		router := newRouter(cfg, WithRPS(&mockRPS{}), WithGossip(g), WithClock(clock))
+		require.Nil(t, router.subscribeLiveness())
+		handler := g.handlers[livenessDataType]
+
+		// peers which never announced anything are not considered dead
+		assert.False(t, router.containsDeadPeer([]*rps.Peer{peerA, peerB}))
+
+		handler(descriptor(t, peerA))
+		handler(descriptor(t, &rps.Peer{Address: peerB.Address, Port: peerB.Port, HostKey: &otherHostKey.PublicKey}))
+		assert.False(t, router.containsDeadPeer([]*rps.Peer{peerA}))
+		assert.True(t, router.containsDeadPeer([]*rps.Peer{peerB}), "host key changed")
+
+		clock.advance(livenessTimeoutRounds * time.Minute)
+		assert.False(t, router.containsDeadPeer([]*rps.Peer{peerA}))
+		clock.advance(time.Second)
+		assert.True(t, router.containsDeadPeer([]*rps.Peer{peerA}))
+
+		// old announcements are forgotten eventually
+		clock.advance(livenessForgetRounds * time.Minute)
+		router.startRound()
+		assert.False(t, router.containsDeadPeer([]*rps.Peer{peerA}))
+	})
+
+	t.Run("hibernating peers", func(t *testing.T) {
+		g := &mockGossip{}
+		router := newRouter(cfg, WithRPS(&mockRPS{}), WithGossip(g))
+		require.Nil(t, router.subscribeLiveness())
+		handler := g.handlers[livenessDataType]
+
+		desc := api.OnionDescriptor{
+			Hibernating: true,
+			OnionPort:   peerA.Port,
+			Address:     peerA.Address,
+			HostKey:     x509.MarshalPKCS1PublicKey(peerA.HostKey),
+		}
+		data := make([]byte, desc.PackedSize())
+		_, err := desc.Pack(data)
+		require.Nil(t, err)
+
+		assert.True(t, handler(data))
+		assert.True(t, router.containsDeadPeer([]*rps.Peer{peerA}))
+
+		// the peer woke up again
+		assert.True(t, handler(descriptor(t, peerA)))
+		assert.False(t, router.containsDeadPeer([]*rps.Peer{peerA}))
+	})
+
+	t.Run("announce hibernation", func(t *testing.T) {
+		quotaCfg := *cfg
+		quotaCfg.RelayQuota = 1
+		g := &mockGossip{}
+		router := newRouter(&quotaCfg, WithRPS(&mockRPS{}), WithGossip(g))
+		router.relay.reserve(1<<20, 0, router.clock.Now())
+		router.startRound()
+
+		require.Len(t, g.announced, 1)
+		desc := api.OnionDescriptor{}
+		require.Nil(t, desc.Parse(g.announced[0]))
+		assert.True(t, desc.Hibernating)
+	})
+
+	t.Run("path selection", func(t *testing.T) {
+		clock := &fakeClock{now: time.Now()}
+		g := &mockGossip{}
+		peers := &mockRPS{peers: []*rps.Peer{peerA, peerB, peerB, peerC}}
+		router := newRouter(cfg, WithRPS(peers), WithGossip(g), WithClock(clock))
+		require.Nil(t, router.subscribeLiveness())
+		handler := g.handlers[livenessDataType]
+
+		handler(descriptor(t, peerA))
+		clock.advance((livenessTimeoutRounds + 1) * time.Minute)
+		handler(descriptor(t, peerB))
+
+		// paths containing dead peers are sampled again
+		hops, err := router.samplePath(target, nil)
+		require.Nil(t, err)
+		assert.Equal(t, []*rps.Peer{peerB, peerC, target}, hops)
+
+		// but used if there is no other path
+		peers.peers = []*rps.Peer{peerA, peerB, peerA, peerC, peerA, peerB}
+		hops, err = router.samplePath(target, nil)
+		require.Nil(t, err)
+		assert.Equal(t, []*rps.Peer{peerA, peerB, target}, hops)
+	})
+}
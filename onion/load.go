@@ -0,0 +1,112 @@
+package onion
+
+import (
+	"sync"
+	"time"
+
+	"bawang/p2p"
+	"bawang/rps"
+)
+
+const (
+	// loadLifetime is the time the load announced by a hop is considered in path selection, after which it is too
+	// outdated to tell anything.
+	loadLifetime = 10 * time.Minute
+
+	// maxLoadPeers limits the number of hops loads are recorded for. Expired loads are forgotten first, further ones are
+	// not recorded until then.
+	maxLoadPeers = 1024
+)
+
+// recordedLoad is the load announced by a hop and the time it was announced at.
+type recordedLoad struct {
+	load p2p.Load
+	at   time.Time
+}
+
+// peerLoads records the loads announced by the hops of our tunnels in their p2p.TunnelCreated, see
+// Config.LoadAwarePaths. The zero value is ready to use and safe for concurrent use.
+type peerLoads struct {
+	lock  sync.Mutex
+	peers map[string]recordedLoad // by reputationKey
+}
+
+// record records the load announced by the given hop.
+func (l *peerLoads) record(hop *rps.Peer, load p2p.Load, now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.peers == nil {
+		l.peers = make(map[string]recordedLoad)
+	}
+	key := reputationKey(hop.Address, hop.Port)
+	if _, ok := l.peers[key]; !ok && len(l.peers) >= maxLoadPeers {
+		for key, recorded := range l.peers {
+			if now.Sub(recorded.at) >= loadLifetime {
+				delete(l.peers, key)
+			}
+		}
+		if len(l.peers) >= maxLoadPeers {
+			return
+		}
+	}
+	l.peers[key] = recordedLoad{load: load, at: now}
+}
+
+// level returns the load level of the given hop, see loadLevel, and whether it announced a load within the
+// loadLifetime.
+func (l *peerLoads) level(hop *rps.Peer, now time.Time) (level int, ok bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	recorded, ok := l.peers[reputationKey(hop.Address, hop.Port)]
+	if !ok || now.Sub(recorded.at) >= loadLifetime {
+		return 0, false
+	}
+	return loadLevel(recorded.load), true
+}
+
+// loadLevel condenses the given load into a single number to compare hops by, weighting the number of tunnels and
+// the queued messages the same.
+func loadLevel(load p2p.Load) int {
+	return int(load.Tunnels()) + int(load.Queue())
+}
+
+// pathLoad returns the sum of the load levels of the given hops. Hops which did not announce a load recently count as
+// idle, such that peers not announcing it are not avoided.
+func (r *Router) pathLoad(hops []*rps.Peer) (sum int) {
+	now := r.clock.Now()
+	for _, hop := range hops {
+		level, _ := r.loads.level(hop, now)
+		sum += level
+	}
+	return sum
+}
+
+// currentLoad returns our load as announced to the initiators of the tunnels we relay, see Config.AnnounceLoad.
+func (r *Router) currentLoad() p2p.Load {
+	r.tunnelsLock.RLock()
+	segments := r.numSegments
+	r.tunnelsLock.RUnlock()
+
+	queued := 0
+	r.linksLock.Lock()
+	for _, links := range r.links {
+		for _, link := range links {
+			queued += link.writer.queued()
+		}
+	}
+	r.linksLock.Unlock()
+
+	return p2p.NewLoad(segments, queued)
+}
+
+// announceLoad adds our load to the given response to a tunnel creation if configured. Initiators not negotiating the
+// handshake version do not get it.
+func (r *Router) announceLoad(createdMsg *p2p.TunnelCreated) {
+	if !r.cfg.AnnounceLoad || createdMsg.Retry || createdMsg.Version == 0 {
+		return
+	}
+	createdMsg.HasLoad = true
+	createdMsg.Load = r.currentLoad()
+}
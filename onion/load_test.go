@@ -0,0 +1,113 @@
+package onion
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+	"bawang/rps"
+)
+
+func TestPeerLoads(t *testing.T) {
+	var l peerLoads
+	now := time.Unix(1000000, 0)
+	hop := &rps.Peer{Address: net.IPv4(10, 0, 0, 1), Port: 1}
+
+	_, ok := l.level(hop, now)
+	assert.False(t, ok)
+
+	l.record(hop, p2p.NewLoad(4, 1), now)
+	level, ok := l.level(hop, now.Add(time.Minute))
+	require.True(t, ok)
+	assert.Equal(t, 3+1, level)
+
+	// outdated loads tell nothing
+	_, ok = l.level(hop, now.Add(loadLifetime))
+	assert.False(t, ok)
+
+	t.Run("full", func(t *testing.T) {
+		for i := 0; i < maxLoadPeers; i++ {
+			l.record(&rps.Peer{Address: net.IPv4(10, 1, byte(i>>8), byte(i)), Port: 1}, 0, now)
+		}
+		assert.Len(t, l.peers, maxLoadPeers)
+		assert.Contains(t, l.peers, reputationKey(hop.Address, hop.Port))
+
+		// further hops are only recorded once others expired
+		other := &rps.Peer{Address: net.IPv4(10, 0, 0, 2), Port: 1}
+		l.record(other, 0, now.Add(time.Minute))
+		_, ok := l.level(other, now.Add(time.Minute))
+		assert.False(t, ok)
+
+		l.record(other, 0, now.Add(loadLifetime))
+		_, ok = l.level(other, now.Add(loadLifetime))
+		assert.True(t, ok)
+		assert.Len(t, l.peers, 1)
+	})
+}
+
+func TestRouterLoad(t *testing.T) {
+	peerA := &rps.Peer{Address: net.IPv4(10, 0, 0, 1), Port: 1}
+	peerB := &rps.Peer{Address: net.IPv4(10, 0, 0, 2), Port: 1}
+	peerC := &rps.Peer{Address: net.IPv4(10, 0, 0, 3), Port: 1}
+	peerD := &rps.Peer{Address: net.IPv4(10, 0, 0, 4), Port: 1}
+	peerE := &rps.Peer{Address: net.IPv4(10, 0, 0, 5), Port: 1}
+	target := &rps.Peer{Address: net.IPv4(10, 0, 0, 6), Port: 1}
+
+	t.Run("announce", func(t *testing.T) {
+		router := newRouter(&config.Config{AnnounceLoad: true}, WithRPS(&mockRPS{}))
+		router.numSegments = 5
+
+		created := &p2p.TunnelCreated{Version: p2p.HandshakeVersionDHOAEP}
+		router.announceLoad(created)
+		assert.True(t, created.HasLoad)
+		assert.Equal(t, p2p.NewLoad(5, 0), created.Load)
+
+		// initiators not negotiating do not get it
+		created = &p2p.TunnelCreated{}
+		router.announceLoad(created)
+		assert.False(t, created.HasLoad)
+	})
+
+	t.Run("not announced", func(t *testing.T) {
+		router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+		created := &p2p.TunnelCreated{Version: p2p.HandshakeVersionDHOAEP}
+		router.announceLoad(created)
+		assert.False(t, created.HasLoad)
+	})
+
+	t.Run("path selection", func(t *testing.T) {
+		peers := &mockRPS{peers: []*rps.Peer{peerA, peerC, peerB, peerC, peerA, peerB}}
+		router := newRouter(&config.Config{TunnelLength: 3, LoadAwarePaths: true}, WithRPS(peers))
+		now := router.clock.Now()
+		router.loads.record(peerA, p2p.NewLoad(100, 20), now)
+		router.loads.record(peerB, p2p.NewLoad(2, 0), now)
+		router.loads.record(peerC, p2p.NewLoad(1, 1), now)
+
+		// the least loaded of the sampled paths is picked
+		hops, err := router.samplePath(target, nil)
+		require.Nil(t, err)
+		assert.Equal(t, []*rps.Peer{peerB, peerC, target}, hops)
+
+		// paths through hops without a recent load are taken right away
+		peers.peers = []*rps.Peer{peerA, peerC, peerD, peerE}
+		hops, err = router.samplePath(target, nil)
+		require.Nil(t, err)
+		assert.Equal(t, []*rps.Peer{peerD, peerE, target}, hops)
+		assert.Empty(t, peers.peers)
+	})
+
+	t.Run("path selection disabled", func(t *testing.T) {
+		peers := &mockRPS{peers: []*rps.Peer{peerA, peerC}}
+		router := newRouter(&config.Config{TunnelLength: 3}, WithRPS(peers))
+		router.loads.record(peerA, p2p.NewLoad(100, 20), router.clock.Now())
+
+		hops, err := router.samplePath(target, nil)
+		require.Nil(t, err)
+		assert.Equal(t, []*rps.Peer{peerA, peerC, target}, hops)
+	})
+}
@@ -0,0 +1,62 @@
+package onion
+
+import (
+	"fmt"
+	"net"
+
+	"bawang/errcode"
+	"bawang/p2p"
+)
+
+var (
+	// ErrExtendLoop is returned if another peer asked us to extend a tunnel to ourselves or back over the link it came
+	// from, which would let a malicious initiator route a tunnel through us over and over again to amplify its traffic.
+	ErrExtendLoop = errcode.New(errcode.ModuleOnion, errcode.NotAllowed, false, "extend would loop back")
+	// ErrExtendRefused is returned if a hop refused to extend an outgoing tunnel, see p2p.RelayTunnelError.
+	ErrExtendRefused = errcode.New(errcode.ModuleOnion, errcode.NotAllowed, true, "hop refused to extend the tunnel")
+)
+
+// isOwnAddress checks whether the given address and port are the ones of our own P2P endpoint, i.e. the port is our
+// P2P port and the address is one of the addresses of this host.
+func (r *Router) isOwnAddress(address net.IP, port uint16) bool {
+	if int(port) != r.cfg.P2PPort {
+		return false
+	}
+	if address.IsLoopback() || address.IsUnspecified() || address.Equal(net.ParseIP(r.cfg.P2PHostname)) {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// extendLoop checks whether extending the given tunnel segment over nextLink would loop back, either to ourselves,
+// i.e. the peer presented our own host key, or over the link the tunnel came from. Returns the reason the extend is
+// refused with in that case.
+func (r *Router) extendLoop(tunnel *tunnelSegment, nextLink *Link) (reason p2p.ErrorReason, loop bool) {
+	if r.cfg.HostKey != nil && sameHostKey(nextLink.hostKey, &r.cfg.HostKey.PublicKey) {
+		return p2p.ErrorReasonExtendToSelf, true
+	}
+	if nextLink == tunnel.prevHopLink {
+		return p2p.ErrorReasonExtendLoop, true
+	}
+	return 0, false
+}
+
+// refuseExtend tells the tunnel initiator that the extend was refused for the given reason. The returned error makes
+// the caller tear down the tunnel segment.
+func (r *Router) refuseExtend(tunnel *tunnelSegment, reason p2p.ErrorReason) error {
+	err := tunnel.sendRelayToPrevHop(&p2p.RelayTunnelError{Reason: reason})
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrExtendLoop, reason)
+}
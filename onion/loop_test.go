@@ -0,0 +1,88 @@
+package onion
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+)
+
+func TestRouterIsOwnAddress(t *testing.T) {
+	router := newRouter(&config.Config{P2PHostname: "192.0.2.7", P2PPort: 6602}, WithRPS(&mockRPS{}))
+
+	assert.True(t, router.isOwnAddress(net.ParseIP("127.0.0.1"), 6602))
+	assert.True(t, router.isOwnAddress(net.ParseIP("192.0.2.7"), 6602))
+	assert.True(t, router.isOwnAddress(net.IPv4zero, 6602))
+	assert.False(t, router.isOwnAddress(net.ParseIP("192.0.2.8"), 6602))
+
+	// other peers may run on the same host
+	assert.False(t, router.isOwnAddress(net.ParseIP("127.0.0.1"), 6603))
+}
+
+func TestRouterExtendLoop(t *testing.T) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+	router := newRouter(&config.Config{HostKey: hostKey}, WithRPS(&mockRPS{}))
+
+	prevHopLink := &Link{}
+	tunnel := &tunnelSegment{prevHopLink: prevHopLink}
+
+	reason, loop := router.extendLoop(tunnel, &Link{hostKey: &hostKey.PublicKey})
+	assert.True(t, loop)
+	assert.Equal(t, p2p.ErrorReasonExtendToSelf, reason)
+
+	reason, loop = router.extendLoop(tunnel, prevHopLink)
+	assert.True(t, loop)
+	assert.Equal(t, p2p.ErrorReasonExtendLoop, reason)
+
+	_, loop = router.extendLoop(tunnel, &Link{hostKey: &otherKey.PublicKey})
+	assert.False(t, loop)
+	_, loop = router.extendLoop(tunnel, &Link{})
+	assert.False(t, loop)
+}
+
+func TestRouterRefuseExtendToSelf(t *testing.T) {
+	router := newRouter(&config.Config{P2PPort: 6602, BuildTimeout: 1}, WithRPS(&mockRPS{}))
+
+	link, connRemote := newPipeLink()
+	tunnel := &tunnelSegment{
+		prevHopTunnelID: 42,
+		prevHopLink:     link,
+		dhShared:        &[32]byte{1, 2, 3},
+	}
+	remote := newInitiatorEnd(connRemote, tunnel)
+	defer remote.Close()
+
+	// the initiator asks us to extend the tunnel to our own P2P endpoint
+	forward, _ := p2p.NewRelayDigests(tunnel.dhShared)
+	buf := make([]byte, p2p.MaxRelayDataSize+p2p.RelayHeaderSize)
+	extendMsg := &p2p.RelayTunnelExtend{Address: net.ParseIP("127.0.0.1").To4(), Port: 6602,
+		EncDHPubKey: make([]byte, p2p.EncDHPubKeySize)}
+	_, n, err := p2p.PackRelayMessage(buf, 0, extendMsg, forward)
+	require.Nil(t, err)
+	body, err := p2p.EncryptRelay(buf[:n], tunnel.dhShared)
+	require.Nil(t, err)
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- router.handleIncomingTunnelRelayMsg(nil, nil, tunnel, &p2p.Header{}, body)
+	}()
+
+	hdr, msg := readRelayFromPrevHop(t, remote)
+	require.Equal(t, p2p.RelayTypeTunnelError, hdr.RelayType)
+	errorMsg := p2p.RelayTunnelError{}
+	require.Nil(t, errorMsg.Parse(msg))
+	assert.Equal(t, p2p.ErrorReasonExtendToSelf, errorMsg.Reason)
+
+	assert.True(t, errors.Is(<-errChan, ErrExtendLoop))
+	assert.Nil(t, tunnel.nextHopLink)
+}
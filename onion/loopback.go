@@ -0,0 +1,71 @@
+package onion
+
+import (
+	"net"
+
+	"bawang/rps"
+)
+
+// isLoopback checks whether the given destination is ourselves, i.e. its address and port match our P2P endpoint, and
+// tunnels to it are terminated locally, see Config.LoopbackTunnels. If we listen on all addresses, loopback addresses
+// match as well.
+func (r *Router) isLoopback(targetPeer *rps.Peer) bool {
+	if r.cfg == nil || !r.cfg.LoopbackTunnels || int(targetPeer.Port) != r.cfg.P2PPort {
+		return false
+	}
+
+	ip := net.ParseIP(r.cfg.P2PHostname)
+	if ip == nil {
+		return false
+	}
+	return ip.Equal(targetPeer.Address) || ip.IsUnspecified() && targetPeer.Address.IsLoopback()
+}
+
+// buildLoopbackTunnel builds a tunnel to ourselves without going through the network: Neither hops are sampled nor
+// links are opened, instead the other end of the tunnel is announced to all clients as an incoming tunnel right away
+// and the data sent on either end is passed to the clients of the other one, see Router.SendData. This makes local
+// development of API clients and load tests of the API cheap, while the tunnel offers no anonymity at all.
+// Loopback tunnels are not rebuilt and do not count towards Config.MaxTunnels. Once either end is torn down, the other
+// one is torn down as well.
+func (r *Router) buildLoopbackTunnel(targetPeer *rps.Peer, client Client) (tunnel *Tunnel) {
+	tunnel = &Tunnel{
+		id:     r.newTunnelID(),
+		target: targetPeer,
+		quit:   make(chan struct{}),
+	}
+	otherEnd := r.newTunnelID()
+
+	r.tunnelsLock.Lock()
+	if client != nil {
+		r.tunnels[tunnel.id] = append(r.tunnels[tunnel.id], client)
+	}
+	r.tunnels[otherEnd] = r.subscribedClients(SubscribeIncoming)
+	r.loopbacks[tunnel.id] = otherEnd
+	r.loopbacks[otherEnd] = tunnel.id
+	r.tunnelsLock.Unlock()
+
+	r.events.publish(Event{
+		Type:     EventTunnelBuilt,
+		TunnelID: tunnel.id,
+	})
+	r.events.publish(Event{
+		Type:     EventTunnelIncoming,
+		TunnelID: otherEnd,
+	})
+
+	return tunnel
+}
+
+// removeLoopback unpairs the ends of the loopback tunnel with the given ID and forgets the given end, returning the ID
+// of the other one, which the caller must close, see Router.CloseTunnel.
+// Must be called with r.tunnelsLock hold.
+func (r *Router) removeLoopback(tunnelID uint32) (otherEnd uint32, ok bool) {
+	otherEnd, ok = r.loopbacks[tunnelID]
+	if !ok {
+		return 0, false
+	}
+	delete(r.loopbacks, tunnelID)
+	delete(r.loopbacks, otherEnd)
+	delete(r.tunnels, tunnelID)
+	return otherEnd, true
+}
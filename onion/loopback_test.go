@@ -0,0 +1,123 @@
+package onion
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/rps"
+)
+
+func TestRouterIsLoopback(t *testing.T) {
+	cfg := &config.Config{P2PHostname: "10.0.0.1", P2PPort: 4242, LoopbackTunnels: true}
+	router := newRouter(cfg, WithRPS(&mockRPS{}))
+
+	assert.True(t, router.isLoopback(&rps.Peer{Address: net.IPv4(10, 0, 0, 1), Port: 4242}))
+	assert.False(t, router.isLoopback(&rps.Peer{Address: net.IPv4(10, 0, 0, 1), Port: 4243}))
+	assert.False(t, router.isLoopback(&rps.Peer{Address: net.IPv4(10, 0, 0, 2), Port: 4242}))
+	assert.False(t, router.isLoopback(&rps.Peer{Address: net.IPv4(127, 0, 0, 1), Port: 4242}))
+
+	// listening on all addresses
+	cfg.P2PHostname = "0.0.0.0"
+	assert.True(t, router.isLoopback(&rps.Peer{Address: net.IPv4(127, 0, 0, 1), Port: 4242}))
+
+	cfg.LoopbackTunnels = false
+	assert.False(t, router.isLoopback(&rps.Peer{Address: net.IPv4(127, 0, 0, 1), Port: 4242}))
+}
+
+func TestRouterLoopbackTunnel(t *testing.T) {
+	cfg := &config.Config{P2PHostname: "127.0.0.1", P2PPort: 4242, LoopbackTunnels: true, TunnelLength: 3}
+	router := newRouter(cfg, WithRPS(&mockRPS{}))
+
+	var incoming, eofs, destroyed []uint32
+	received := make(map[uint32][]string)
+	datagrams := make(map[uint32][]string)
+	client := &ClientFuncs{
+		Incoming: func(tunnelID uint32) error {
+			incoming = append(incoming, tunnelID)
+			return nil
+		},
+		Data: func(tunnelID uint32, data []byte) error {
+			received[tunnelID] = append(received[tunnelID], string(data))
+			return nil
+		},
+		Datagram: func(tunnelID uint32, data []byte) error {
+			datagrams[tunnelID] = append(datagrams[tunnelID], string(data))
+			return nil
+		},
+		EOF: func(tunnelID uint32) error {
+			eofs = append(eofs, tunnelID)
+			return nil
+		},
+		Destroy: func(tunnelID uint32) error {
+			destroyed = append(destroyed, tunnelID)
+			return nil
+		},
+	}
+	router.RegisterClient(client)
+
+	// the tunnel is built right away, without waiting for the next round or sampling any hops
+	reply := <-router.BuildTunnel(&rps.Peer{Address: net.IPv4(127, 0, 0, 1), Port: 4242}, client)
+	require.Nil(t, reply.Err)
+	tunnelID := reply.Tunnel.ID()
+	require.Len(t, incoming, 1)
+	otherEnd := incoming[0]
+	assert.NotEqual(t, tunnelID, otherEnd)
+	assert.Empty(t, router.outgoingTunnels)
+	assert.Empty(t, router.links)
+
+	// there is no circuit to handle
+	router.startTunnelHandler(reply.Tunnel)
+	assert.False(t, router.handlers.isRunning(reply.Tunnel))
+	assert.Nil(t, router.AnnounceTunnel(tunnelID))
+
+	// data sent on either end is received on the other one
+	require.Nil(t, router.SendData(tunnelID, []byte("ping")))
+	require.Nil(t, router.SendData(otherEnd, []byte("pong")))
+	require.Nil(t, router.SendDatagram(tunnelID, []byte("datagram")))
+	assert.Equal(t, map[uint32][]string{otherEnd: {"ping"}, tunnelID: {"pong"}}, received)
+	assert.Equal(t, map[uint32][]string{otherEnd: {"datagram"}}, datagrams)
+
+	// the end of data is passed on as well
+	require.Nil(t, router.SendEOF(tunnelID))
+	require.Nil(t, router.SendEOF(otherEnd))
+	assert.Equal(t, []uint32{otherEnd, tunnelID}, eofs)
+
+	t.Run("close", func(t *testing.T) {
+		// closing either end tears down the other one
+		destroyed = nil
+		require.Nil(t, router.CloseTunnel(otherEnd))
+		assert.ElementsMatch(t, []uint32{tunnelID, otherEnd}, destroyed)
+		assert.Empty(t, router.tunnels)
+		assert.Empty(t, router.loopbacks)
+		assert.Equal(t, ErrInvalidTunnel, router.SendData(tunnelID, []byte("ping")))
+	})
+
+	t.Run("unused", func(t *testing.T) {
+		reply := <-router.BuildTunnel(&rps.Peer{Address: net.IPv4(127, 0, 0, 1), Port: 4242}, client)
+		require.Nil(t, reply.Err)
+		tunnelID := reply.Tunnel.ID()
+		otherEnd := incoming[len(incoming)-1]
+
+		// the other end is torn down along with the end no client uses anymore
+		destroyed = nil
+		require.Nil(t, router.RemoveClientFromTunnel(tunnelID, client))
+		router.removeUnusedTunnels()
+		assert.Equal(t, []uint32{otherEnd}, destroyed)
+		assert.Empty(t, router.tunnels)
+		assert.Empty(t, router.loopbacks)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		cfg.LoopbackTunnels = false
+		defer func() { cfg.LoopbackTunnels = true }()
+
+		// the tunnel is built through the network in the next round like any other one
+		replyChan := router.BuildTunnel(&rps.Peer{Address: net.IPv4(127, 0, 0, 1), Port: 4242}, client)
+		assert.Empty(t, replyChan)
+		assert.Len(t, router.buildQueue, 1)
+	})
+}
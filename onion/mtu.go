@@ -0,0 +1,29 @@
+package onion
+
+import (
+	"bawang/p2p"
+)
+
+// TunnelMTU returns the max. size of the payload of data and of datagrams sent in a single cell of the tunnel with the
+// given ID, which may be an outgoing or an incoming tunnel. Larger payloads are rejected, except for the data of
+// reliable streams, which is split across several cells. Clients should size their packets accordingly instead of
+// assuming the cell size.
+func (r *Router) TunnelMTU(tunnelID uint32) (data, datagram int, err error) {
+	r.tunnelsLock.RLock()
+	defer r.tunnelsLock.RUnlock()
+
+	var stream *reliableStream
+	if tunnel, ok := r.outgoingTunnels[tunnelID]; ok {
+		stream = tunnel.stream
+	} else if segment, ok := r.incomingTunnels[tunnelID]; ok {
+		stream = segment.stream
+	} else {
+		return 0, 0, ErrInvalidTunnel
+	}
+
+	// data of reliable streams is numbered in each cell
+	if stream != nil {
+		return p2p.MaxRelaySeqDataSize, p2p.MaxRelayDataSize, nil
+	}
+	return p2p.MaxRelayDataSize, p2p.MaxRelayDataSize, nil
+}
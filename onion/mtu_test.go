@@ -0,0 +1,32 @@
+package onion
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+)
+
+func TestRouterTunnelMTU(t *testing.T) {
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+
+	_, _, err := router.TunnelMTU(1)
+	assert.Equal(t, ErrInvalidTunnel, err)
+
+	router.outgoingTunnels[1] = &Tunnel{id: 1}
+	data, datagram, err := router.TunnelMTU(1)
+	require.Nil(t, err)
+	assert.Equal(t, p2p.MaxRelayDataSize, data)
+	assert.Equal(t, p2p.MaxRelayDataSize, datagram)
+
+	// sequence numbers take up some space of the cells of reliable streams
+	router.incomingTunnels[2] = &tunnelSegment{tunnelID: 2, stream: &reliableStream{}}
+	data, datagram, err = router.TunnelMTU(2)
+	require.Nil(t, err)
+	assert.Equal(t, p2p.MaxRelaySeqDataSize, data)
+	assert.Equal(t, p2p.MaxRelayDataSize, datagram)
+	assert.Less(t, data, datagram)
+}
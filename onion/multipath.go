@@ -0,0 +1,396 @@
+package onion
+
+import (
+	"sync"
+
+	"bawang/errcode"
+	"bawang/p2p"
+	"bawang/rps"
+)
+
+var (
+	// ErrNoDisjointPath is returned if only paths sharing intermediate hops with the other circuit of a multipath
+	// tunnel could be sampled.
+	ErrNoDisjointPath = errcode.New(errcode.ModuleOnion, errcode.NoPeers, true,
+		"no path disjoint from the other circuit of the tunnel sampled")
+
+	errNoCircuit = errcode.New(errcode.ModuleOnion, errcode.InvalidTunnel, false, "no circuit left")
+)
+
+// streamPath is a circuit of a multipath tunnel.
+type streamPath struct {
+	circuit interface{} // *Tunnel at the initiator, *tunnelSegment at the other end
+	send    func(msg p2p.RelayMessage) error
+}
+
+// multipath stripes the data messages of a stream across the circuits of a multipath tunnel, which reach the same
+// destination through different intermediate hops. Other messages, e.g. acknowledgements, are sent on the first
+// circuit. The other end reassembles the data by the sequence numbers, see reliableStream.receive.
+type multipath struct {
+	lock  sync.Mutex // guards all fields below
+	paths []streamPath
+	next  int // index of the path the next data message is sent on
+}
+
+// newMultipathStream creates a stream striped across the circuits of a multipath tunnel, which are added via
+// multipath.add.
+func newMultipathStream(id uint64) *reliableStream {
+	m := &multipath{}
+	stream := newReliableStream(id, m.send)
+	stream.multipath = m
+	stream.pending = make(map[uint32][]byte)
+	return stream
+}
+
+// add adds a circuit sending via the given function.
+func (m *multipath) add(circuit interface{}, send func(msg p2p.RelayMessage) error) {
+	m.lock.Lock()
+	m.paths = append(m.paths, streamPath{circuit: circuit, send: send})
+	m.lock.Unlock()
+}
+
+// remove removes a terminated circuit and returns the number of remaining ones.
+func (m *multipath) remove(circuit interface{}) (remaining int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for i, path := range m.paths {
+		if path.circuit == circuit {
+			m.paths = append(m.paths[:i], m.paths[i+1:]...)
+			break
+		}
+	}
+	return len(m.paths)
+}
+
+// has checks whether the given circuit was added and not removed yet.
+func (m *multipath) has(circuit interface{}) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, path := range m.paths {
+		if path.circuit == circuit {
+			return true
+		}
+	}
+	return false
+}
+
+// count returns the number of circuits.
+func (m *multipath) count() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return len(m.paths)
+}
+
+// each calls the given function for each circuit.
+func (m *multipath) each(f func(circuit interface{})) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, path := range m.paths {
+		f(path.circuit)
+	}
+}
+
+// first returns the first circuit, nil if there is none.
+func (m *multipath) first() interface{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(m.paths) == 0 {
+		return nil
+	}
+	return m.paths[0].circuit
+}
+
+// send sends data messages on the circuits in turns and any other message on the first circuit. If sending fails,
+// the message is sent on the next circuit instead. Data messages lost on a broken circuit are sent again once the
+// circuit was removed.
+func (m *multipath) send(msg p2p.RelayMessage) (err error) {
+	m.lock.Lock()
+	paths := append([]streamPath(nil), m.paths...)
+	start := 0
+	if _, ok := msg.(*p2p.RelayTunnelSeqData); ok && len(paths) > 0 {
+		start = m.next % len(paths)
+		m.next++
+	}
+	m.lock.Unlock()
+
+	err = errNoCircuit
+	for i := range paths {
+		err = paths[(start+i)%len(paths)].send(msg)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// containsPeer checks whether any of the given peers is one of the peers to look for.
+func containsPeer(peers, lookFor []*rps.Peer) bool {
+	for _, peer := range peers {
+		for _, other := range lookFor {
+			if peer.Address.Equal(other.Address) && peer.Port == other.Port {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// BuildMultipathTunnel queues a job for a tunnel like BuildTunnel, but the tunnel consists of two circuits to the
+// target peer through disjoint intermediate hops. The data is striped across both circuits, increasing the throughput,
+// and sent again on the other circuit if one breaks. If the target peer does not support multipath tunnels or no
+// second circuit could be built, the tunnel consists of a single circuit.
+func (r *Router) BuildMultipathTunnel(targetPeer *rps.Peer, client Client) (replyChan chan BuildTunnelReply) {
+	replyChan = make(chan BuildTunnelReply, 1)
+	r.queueBuildJob(&buildTunnelJob{
+		targetPeer: targetPeer,
+		client:     client,
+		replyChan:  replyChan,
+		multipath:  true,
+	})
+	return replyChan
+}
+
+// makeMultipath turns a newly built tunnel into a multipath tunnel and adds the second circuit. Failures are only
+// logged, since the tunnel is still usable with a single circuit.
+func (r *Router) makeMultipath(tunnel *Tunnel) {
+	if !tunnel.lastHopSupports(p2p.CapabilityMultipath) {
+		r.logger.Printf("Target of tunnel %v does not support multipath tunnels\n", tunnel.id)
+		return
+	}
+
+	id, err := newStreamID(r.rand)
+	if err != nil {
+		r.logger.Printf("Error creating stream of multipath tunnel %v: %v\n", tunnel.id, err)
+		return
+	}
+	stream := newMultipathStream(id)
+
+	// nothing was sent on the tunnel yet, thus a stream for retransmissions is simply replaced
+	err = tunnel.sendRelayToLastHop(&p2p.RelayTunnelJoin{Stream: stream.id})
+	if err != nil {
+		r.logger.Printf("Error joining multipath tunnel %v: %v\n", tunnel.id, err)
+		return
+	}
+	stream.multipath.add(tunnel, r.pathSender(tunnel))
+	r.tunnelsLock.Lock()
+	tunnel.stream = stream
+	r.tunnelsLock.Unlock()
+
+	err = r.addPath(tunnel)
+	if err != nil {
+		r.logger.Printf("Error adding second circuit to multipath tunnel %v: %v\n", tunnel.id, err)
+	}
+}
+
+// pathSender returns the function sending on a circuit of a multipath tunnel. Data striped across the circuits counts
+// as activity of each circuit, such that none of them is torn down as idle.
+func (r *Router) pathSender(tunnel *Tunnel) func(msg p2p.RelayMessage) error {
+	return func(msg p2p.RelayMessage) error {
+		if _, ok := msg.(*p2p.RelayTunnelSeqData); ok {
+			tunnel.activity.touch(r.clock.Now())
+		}
+		return tunnel.sendRelayToLastHop(msg)
+	}
+}
+
+// addPath builds the second circuit of a multipath tunnel through other intermediate hops than the first one. The
+// circuit joins the stream of the tunnel and is torn down together with the first one, see leaveMultipath.
+func (r *Router) addPath(tunnel *Tunnel) (err error) {
+	circuitID := r.newCircuitID()
+	avoid := tunnel.hops[:len(tunnel.hops)-1]
+	path, err := r.buildTunnel(tunnel.hops[len(tunnel.hops)-1], nil, tunnel.id, circuitID, avoid)
+	if err != nil {
+		return err
+	}
+	path.activity.touch(tunnel.activity.last())
+	path.priority.set(tunnel.priority.get())
+	path.stream = tunnel.stream
+
+	err = path.sendRelayToLastHop(&p2p.RelayTunnelJoin{Stream: path.stream.id})
+	if err != nil {
+		_ = path.Close()
+		path.closeSessions()
+		r.releaseCircuit(path.circuitID)
+		return err
+	}
+	path.stream.multipath.add(path, r.pathSender(path))
+
+	r.tunnelsLock.Lock()
+	if r.outgoingTunnels[tunnel.id] != tunnel {
+		// the tunnel was torn down while the circuit was built
+		r.tunnelsLock.Unlock()
+		path.stream.multipath.remove(path)
+		_ = path.Close()
+		path.closeSessions()
+		r.releaseCircuit(path.circuitID)
+		return nil
+	}
+	tunnel.path = path
+	r.tunnelsLock.Unlock()
+
+	r.startTunnelHandler(path)
+	return nil
+}
+
+// rebuildMultipathTunnel rebuilds both circuits of a multipath tunnel with new intermediate hops. Instead of handing
+// the tunnel over, the new circuits join the stream before the old ones are torn down. Data in flight on the old
+// circuits is sent again on the new ones.
+func (r *Router) rebuildMultipathTunnel(tunnel *Tunnel) (err error) {
+	stream := tunnel.stream
+	circuitID := r.newCircuitID()
+	newTunnel, err := r.buildTunnel(tunnel.hops[len(tunnel.hops)-1], nil, tunnel.id, circuitID, nil)
+	if err != nil {
+		return err
+	}
+	// rebuilding the tunnel does not count as activity
+	newTunnel.activity.touch(tunnel.activity.last())
+	newTunnel.priority.set(tunnel.priority.get())
+	newTunnel.stream = stream
+	if tunnel.sendClosed.isClosed() {
+		newTunnel.sendClosed.close()
+	}
+
+	err = newTunnel.sendRelayToLastHop(&p2p.RelayTunnelJoin{Stream: stream.id})
+	if err != nil {
+		_ = newTunnel.Close()
+		newTunnel.closeSessions()
+		r.releaseCircuit(newTunnel.circuitID)
+		return err
+	}
+	stream.multipath.add(newTunnel, r.pathSender(newTunnel))
+
+	r.tunnelsLock.Lock()
+	if r.outgoingTunnels[tunnel.id] != tunnel {
+		// the tunnel was torn down while the new circuit was built
+		r.tunnelsLock.Unlock()
+		stream.multipath.remove(newTunnel)
+		_ = newTunnel.Close()
+		newTunnel.closeSessions()
+		r.releaseCircuit(newTunnel.circuitID)
+		return nil
+	}
+	r.outgoingTunnels[tunnel.id] = newTunnel
+	r.tunnelsLock.Unlock()
+
+	r.startTunnelHandler(newTunnel)
+
+	err = r.addPath(newTunnel)
+	if err != nil {
+		r.logger.Printf("Error adding second circuit to rebuilt multipath tunnel %v: %v\n", tunnel.id, err)
+	}
+
+	// the old circuit takes its second circuit down with it, see leaveMultipath
+	_ = tunnel.Close()
+	return nil
+}
+
+// leaveMultipath removes a terminated circuit of a multipath tunnel from its stream and returns whether it was the
+// current circuit of the tunnel, which is then removed by the caller. If the tunnel's second circuit is still up, it
+// carries the tunnel on its own from now on, otherwise the second circuit is torn down as well.
+func (r *Router) leaveMultipath(tunnel *Tunnel) (current bool) {
+	stream := tunnel.stream
+	remaining := stream.multipath.remove(tunnel)
+
+	r.tunnelsLock.Lock()
+	current = r.outgoingTunnels[tunnel.id] == tunnel
+	path := tunnel.path
+	if current && path != nil && stream.multipath.has(path) {
+		r.logger.Printf("Outgoing multipath tunnel %v continues on its second circuit\n", tunnel.id)
+		r.outgoingTunnels[tunnel.id] = path
+		current, path = false, nil
+	}
+	r.tunnelsLock.Unlock()
+
+	if path != nil {
+		_ = path.Close()
+	}
+
+	if !current && remaining > 0 {
+		// data in flight on the terminated circuit is lost
+		err := stream.retransmit()
+		if err != nil {
+			r.logger.Printf("Error retransmitting data of multipath tunnel %v: %v\n", tunnel.id, err)
+		}
+	}
+	return current
+}
+
+// joinStream processes a p2p.RelayTunnelJoin received on an incoming tunnel segment. The first segment joining the
+// stream carries the tunnel known to the clients, any further segment carries the same tunnel, i.e. its own tunnel ID
+// is dropped.
+func (r *Router) joinStream(tunnel *tunnelSegment, streamID uint64) (err error) {
+	r.tunnelsLock.Lock()
+	defer r.tunnelsLock.Unlock()
+
+	if tunnel.stream != nil || tunnel.remapped {
+		return p2p.ErrInvalidMessage
+	}
+
+	stream, ok := r.streams[streamID]
+	if !ok {
+		stream = newMultipathStream(streamID)
+		stream.segment = tunnel
+		r.streams[streamID] = stream
+	} else {
+		if stream.multipath == nil {
+			return p2p.ErrInvalidMessage
+		}
+		if _, announced := r.incomingTunnels[tunnel.tunnelID]; announced {
+			// the segment carries another tunnel already
+			return p2p.ErrInvalidMessage
+		}
+
+		delete(r.tunnels, tunnel.tunnelID)
+		r.traffic.move(tunnel.tunnelID, stream.segment.tunnelID)
+		tunnel.tunnelID, tunnel.remapped = stream.segment.tunnelID, true
+		tunnel.priority.set(stream.segment.priority.get())
+		if stream.multipath.count() == 0 {
+			// all other segments were torn down in the meantime
+			r.moveStream(stream, nil, tunnel)
+		}
+	}
+
+	tunnel.stream = stream
+	stream.multipath.add(tunnel, tunnel.sendRelayToPrevHop)
+	return nil
+}
+
+// leaveStream removes a terminated incoming tunnel segment from its multipath stream and returns whether other
+// segments carry the tunnel on.
+func (r *Router) leaveStream(stream *reliableStream, tunnel *tunnelSegment) (remaining bool) {
+	if stream.multipath.remove(tunnel) == 0 {
+		return false
+	}
+
+	r.tunnelsLock.Lock()
+	if next, ok := stream.multipath.first().(*tunnelSegment); ok {
+		r.moveStream(stream, tunnel, next)
+	}
+	r.tunnelsLock.Unlock()
+
+	// data in flight on the terminated segment is lost
+	err := stream.retransmit()
+	if err != nil {
+		r.logger.Printf("Error retransmitting data of multipath tunnel %v: %v\n", tunnel.tunnelID, err)
+	}
+	return true
+}
+
+// moveStream makes the given segment the one carrying the multipath stream and the tunnel known to the clients in place
+// of the terminated one, or of whichever segment did so far if none is given.
+// Must be called with r.tunnelsLock hold.
+func (r *Router) moveStream(stream *reliableStream, terminated, tunnel *tunnelSegment) {
+	if terminated == nil || stream.segment == terminated {
+		stream.segment = tunnel
+	}
+
+	tunnelID := tunnel.tunnelID
+	if segment, ok := r.incomingTunnels[tunnelID]; ok && (terminated == nil || segment == terminated) {
+		r.incomingTunnels[tunnelID] = tunnel
+	}
+}
@@ -0,0 +1,214 @@
+package onion
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+)
+
+func TestMultipath(t *testing.T) {
+	var sentA, sentB []p2p.RelayMessage
+	var brokenA bool
+	sendA := func(msg p2p.RelayMessage) error {
+		if brokenA {
+			return net.ErrWriteToConnected
+		}
+		sentA = append(sentA, msg)
+		return nil
+	}
+	sendB := func(msg p2p.RelayMessage) error {
+		sentB = append(sentB, msg)
+		return nil
+	}
+
+	stream := newMultipathStream(42)
+	m := stream.multipath
+	assert.Equal(t, errNoCircuit, m.send(&p2p.RelayTunnelAck{Stream: 42}))
+	assert.Nil(t, m.first())
+
+	m.add("a", sendA)
+	m.add("b", sendB)
+	assert.Equal(t, 2, m.count())
+	assert.True(t, m.has("b"))
+	assert.Equal(t, "a", m.first())
+
+	t.Run("striping", func(t *testing.T) {
+		for i := 0; i < 4; i++ {
+			require.Nil(t, stream.sendData([]byte{byte(i)}))
+		}
+		require.Len(t, sentA, 2)
+		require.Len(t, sentB, 2)
+		assert.Equal(t, uint32(0), sentA[0].(*p2p.RelayTunnelSeqData).Seq)
+		assert.Equal(t, uint32(1), sentB[0].(*p2p.RelayTunnelSeqData).Seq)
+		assert.Equal(t, uint32(2), sentA[1].(*p2p.RelayTunnelSeqData).Seq)
+		assert.Equal(t, uint32(3), sentB[1].(*p2p.RelayTunnelSeqData).Seq)
+
+		// other messages are sent on the first circuit
+		require.Nil(t, m.send(&p2p.RelayTunnelAck{Stream: 42}))
+		require.Len(t, sentA, 3)
+		assert.IsType(t, &p2p.RelayTunnelAck{}, sentA[2])
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		sentA, sentB = nil, nil
+		brokenA = true
+		require.Nil(t, m.send(&p2p.RelayTunnelAck{Stream: 42}))
+		require.Nil(t, stream.sendData([]byte("data")))
+		require.Nil(t, stream.sendData([]byte("data")))
+		assert.Empty(t, sentA)
+		assert.Len(t, sentB, 3)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		sentA, sentB = nil, nil
+		assert.Equal(t, 1, m.remove("b"))
+		assert.False(t, m.has("b"))
+		assert.Equal(t, net.ErrWriteToConnected, stream.sendData([]byte("lost")))
+
+		// data lost on a broken circuit is sent again on the remaining ones
+		brokenA = false
+		require.Nil(t, stream.retransmit())
+		require.Len(t, sentA, 8)
+		assert.IsType(t, &p2p.RelayTunnelAck{}, sentA[0])
+		assert.Equal(t, &p2p.RelayTunnelSeqData{Stream: 42, Seq: 6, Data: []byte("lost")}, sentA[7])
+
+		assert.Equal(t, 0, m.remove("a"))
+		assert.Equal(t, 0, m.remove("a"))
+	})
+}
+
+func TestMultipathReceive(t *testing.T) {
+	var sent []p2p.RelayMessage
+	stream := newMultipathStream(42)
+	stream.multipath.add("a", func(msg p2p.RelayMessage) error {
+		sent = append(sent, msg)
+		return nil
+	})
+
+	var received []byte
+	deliver := func(data []byte) error {
+		received = append(received, data...)
+		return nil
+	}
+
+	// data overtaking previous data on the other circuit is buffered
+	require.Nil(t, stream.receive(&p2p.RelayTunnelSeqData{Stream: 42, Seq: 2, Data: []byte{2}}, deliver))
+	require.Nil(t, stream.receive(&p2p.RelayTunnelSeqData{Stream: 42, Seq: 1, Data: []byte{1}}, deliver))
+	assert.Empty(t, received)
+	require.Nil(t, stream.receive(&p2p.RelayTunnelSeqData{Stream: 42, Seq: 0, Data: []byte{0}}, deliver))
+	assert.Equal(t, []byte{0, 1, 2}, received)
+	assert.Equal(t, uint32(3), stream.recvSeq)
+	assert.Empty(t, stream.pending)
+
+	// data beyond the window is dropped
+	require.Nil(t, stream.receive(&p2p.RelayTunnelSeqData{Stream: 42, Seq: 3 + maxUnackedData}, deliver))
+	assert.Empty(t, stream.pending)
+	assert.Empty(t, sent)
+}
+
+func TestRouterJoinStream(t *testing.T) {
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+
+	var received []string
+	client := &ClientFuncs{Data: func(tunnelID uint32, data []byte) error {
+		assert.Equal(t, uint32(42), tunnelID)
+		received = append(received, string(data))
+		return nil
+	}}
+	router.RegisterClient(client)
+
+	addSegment := func(tunnelID uint32) (tunnel *tunnelSegment, remote *relayEnd) {
+		link, connRemote := newPipeLink()
+		router.tunnels[tunnelID] = []Client{}
+		tunnel = &tunnelSegment{
+			prevHopTunnelID: router.newCircuitID(),
+			tunnelID:        tunnelID,
+			prevHopLink:     link,
+			dhShared:        &[32]byte{byte(tunnelID)},
+		}
+		return tunnel, newInitiatorEnd(connRemote, tunnel)
+	}
+	receive := func(tunnel *tunnelSegment, seq uint32, data string) error {
+		stream := tunnel.stream
+		return stream.receive(&p2p.RelayTunnelSeqData{Stream: 7, Seq: seq, Data: []byte(data)}, func(data []byte) error {
+			return router.receiveStreamData(tunnel, stream, data)
+		})
+	}
+
+	// the first circuit carries the tunnel announced to the clients
+	first, firstRemote := addSegment(42)
+	defer firstRemote.Close()
+	require.Nil(t, router.joinStream(first, 7))
+	require.Nil(t, receive(first, 0, "a"))
+	assert.Equal(t, first, router.incomingTunnels[42])
+
+	// a tunnel carries only one stream
+	assert.Equal(t, p2p.ErrInvalidMessage, router.joinStream(first, 8))
+
+	// the second circuit carries the same tunnel
+	second, secondRemote := addSegment(43)
+	defer secondRemote.Close()
+	require.Nil(t, router.joinStream(second, 7))
+	assert.Equal(t, uint32(42), second.tunnelID)
+	assert.True(t, second.remapped)
+	assert.NotContains(t, router.tunnels, uint32(43))
+	assert.Equal(t, 2, first.stream.multipath.count())
+	require.Nil(t, receive(second, 2, "c"))
+	require.Nil(t, receive(first, 1, "b"))
+	assert.Equal(t, []string{"a", "b", "c"}, received)
+
+	// multipath streams cannot be resumed by other circuits
+	third, thirdRemote := addSegment(44)
+	defer thirdRemote.Close()
+	_, err := router.bindStream(third, 7)
+	assert.Equal(t, p2p.ErrInvalidMessage, err)
+
+	// the tunnel lives on in the second circuit if the first one is torn down
+	go router.removeTunnelSegment(first)
+	hdr, body := readRelayFromPrevHop(t, secondRemote)
+	require.Equal(t, p2p.RelayTypeTunnelAck, hdr.RelayType)
+	ackMsg := p2p.RelayTunnelAck{}
+	require.Nil(t, ackMsg.Parse(body))
+	assert.Equal(t, p2p.RelayTunnelAck{Stream: 7, Seq: 3}, ackMsg)
+
+	require.Eventually(t, func() bool {
+		router.tunnelsLock.Lock()
+		defer router.tunnelsLock.Unlock()
+		return router.incomingTunnels[42] == second && second.stream.segment == second
+	}, time.Second, time.Millisecond)
+	assert.Contains(t, router.tunnels, uint32(42))
+	assert.Equal(t, 1, second.stream.multipath.count())
+}
+
+func TestRouterLeaveMultipath(t *testing.T) {
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+
+	var sent []p2p.RelayMessage
+	send := func(msg p2p.RelayMessage) error {
+		sent = append(sent, msg)
+		return nil
+	}
+
+	stream := newMultipathStream(7)
+	tunnel := &Tunnel{id: 42, stream: stream}
+	path := &Tunnel{id: 42, stream: stream}
+	tunnel.path = path
+	stream.multipath.add(tunnel, send)
+	stream.multipath.add(path, send)
+	router.outgoingTunnels[42] = tunnel
+
+	// the second circuit carries the tunnel on and the stream is resumed on it
+	assert.False(t, router.leaveMultipath(tunnel))
+	assert.Equal(t, path, router.outgoingTunnels[42])
+	assert.Equal(t, []p2p.RelayMessage{&p2p.RelayTunnelAck{Stream: 7}}, sent)
+
+	// the tunnel is removed with its last circuit
+	assert.True(t, router.leaveMultipath(path))
+	assert.Equal(t, 0, stream.multipath.count())
+}
@@ -0,0 +1,99 @@
+package onion
+
+import (
+	"math"
+
+	"bawang/nse"
+)
+
+const (
+	// peersPerCoverTunnel is the estimated number of peers per additional cover tunnel. Cover tunnels load the
+	// intermediate hops like regular tunnels, thus small networks get by with a single one.
+	peersPerCoverTunnel = 100
+
+	// maxCoverTunnels limits the number of cover tunnels regardless of the network size.
+	maxCoverTunnels = 4
+
+	// pathConfidence is the desired probability of sampling a path without banned peers within pathSamples.
+	pathConfidence = 0.99
+
+	// maxEstimatedPathSamples limits the number of samples derived from the network size estimate.
+	maxEstimatedPathSamples = 20
+)
+
+// updateEstimate queries the NSE module for the current network size estimate, if configured. The previous estimate
+// is kept if the query fails.
+func (r *Router) updateEstimate() {
+	if r.nse == nil {
+		return
+	}
+
+	estimate, err := r.nse.Estimate()
+	if err != nil {
+		r.logger.Printf("Error querying network size estimate: %v\n", err)
+		return
+	}
+
+	r.estimateLock.Lock()
+	r.estimate = &estimate
+	r.estimateLock.Unlock()
+}
+
+// networkSize returns the latest network size estimate. ok is false if no estimate is available.
+func (r *Router) networkSize() (estimate nse.Estimate, ok bool) {
+	r.estimateLock.Lock()
+	defer r.estimateLock.Unlock()
+
+	if r.estimate == nil {
+		return estimate, false
+	}
+	return *r.estimate, true
+}
+
+// numCoverTunnels returns the number of cover tunnels suiting the estimated network size. Without an estimate a
+// single cover tunnel is used. Relays without tunnels of their own have nothing to cover and build none.
+func (r *Router) numCoverTunnels() int {
+	if r.cfg.RelayOnly {
+		return 0
+	}
+
+	estimate, ok := r.networkSize()
+	if !ok {
+		return 1
+	}
+
+	n := 1 + int(estimate.Peers/peersPerCoverTunnel)
+	if n > maxCoverTunnels {
+		n = maxCoverTunnels
+	}
+	return n
+}
+
+// pathSamples returns the number of times the hops of a tunnel are sampled before giving up, if banned peers are
+// sampled. In small networks banned peers make up a larger share of the sampled peers, such that more samples are
+// required to find a path without them. Without an estimate maxPathSamples is used.
+func (r *Router) pathSamples() int {
+	estimate, ok := r.networkSize()
+	if !ok || estimate.Peers == 0 {
+		return maxPathSamples
+	}
+
+	bannedShare := float64(len(r.BannedPeers())) / float64(estimate.Peers)
+	if bannedShare >= 1 { // every path contains banned peers, retrying is pointless
+		return 1
+	}
+
+	// probability of sampling intermediate hops which are all not banned
+	pathOK := math.Pow(1-bannedShare, float64(r.cfg.TunnelLength-1))
+	if pathOK >= 1 {
+		return 1
+	}
+
+	samples := int(math.Ceil(math.Log(1-pathConfidence) / math.Log(1-pathOK)))
+	if samples < 1 {
+		samples = 1
+	} else if samples > maxEstimatedPathSamples {
+		samples = maxEstimatedPathSamples
+	}
+	return samples
+}
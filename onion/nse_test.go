@@ -0,0 +1,127 @@
+package onion
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/nse"
+	"bawang/rps"
+)
+
+// mockNSE is an nse.NSE returning a fixed estimate in tests, or an error if err is set.
+type mockNSE struct {
+	estimate nse.Estimate
+	err      error
+}
+
+func (m *mockNSE) Estimate() (estimate nse.Estimate, err error) {
+	return m.estimate, m.err
+}
+
+func (m *mockNSE) Close() {}
+
+var _ nse.NSE = &mockNSE{}
+
+func TestRouterNetworkSize(t *testing.T) {
+	t.Run("no estimate", func(t *testing.T) {
+		router := newRouter(&config.Config{TunnelLength: 3}, WithRPS(&mockRPS{}))
+		router.startRound()
+
+		_, ok := router.networkSize()
+		assert.False(t, ok)
+		assert.Equal(t, 1, router.numCoverTunnels())
+		assert.Equal(t, maxPathSamples, router.pathSamples())
+	})
+
+	t.Run("estimate", func(t *testing.T) {
+		estimator := &mockNSE{estimate: nse.Estimate{Peers: 250, StdDeviation: 20}}
+		router := newRouter(&config.Config{TunnelLength: 3}, WithRPS(&mockRPS{}), WithNSE(estimator))
+		router.startRound()
+
+		estimate, ok := router.networkSize()
+		require.True(t, ok)
+		assert.Equal(t, estimator.estimate, estimate)
+		assert.Equal(t, 3, router.numCoverTunnels())
+
+		// the previous estimate is kept if the NSE module fails
+		estimator.err = errors.New("nse failed")
+		estimator.estimate = nse.Estimate{}
+		router.startRound()
+		estimate, ok = router.networkSize()
+		require.True(t, ok)
+		assert.Equal(t, uint32(250), estimate.Peers)
+	})
+
+	t.Run("cover tunnels", func(t *testing.T) {
+		for peers, expected := range map[uint32]int{0: 1, 99: 1, 100: 2, 399: 4, 10000: maxCoverTunnels} {
+			router := newRouter(&config.Config{}, WithRPS(&mockRPS{}), WithNSE(&mockNSE{estimate: nse.Estimate{Peers: peers}}))
+			router.startRound()
+			assert.Equal(t, expected, router.numCoverTunnels(), "%d peers", peers)
+		}
+	})
+
+	t.Run("relay only", func(t *testing.T) {
+		cfg := &config.Config{RelayOnly: true}
+		router := newRouter(cfg, WithRPS(&mockRPS{}), WithNSE(&mockNSE{estimate: nse.Estimate{Peers: 250}}))
+		router.startRound()
+		assert.Equal(t, 0, router.numCoverTunnels())
+
+		// no peers are sampled for cover tunnels
+		require.Nil(t, router.buildCoverTunnels())
+		assert.Empty(t, router.coverTunnels)
+	})
+
+	t.Run("path samples", func(t *testing.T) {
+		estimator := &mockNSE{estimate: nse.Estimate{Peers: 10}}
+		router := newRouter(&config.Config{BanDuration: 60, TunnelLength: 3}, WithRPS(&mockRPS{}),
+			WithNSE(estimator))
+		router.startRound()
+
+		// without banned peers, the first sample succeeds
+		assert.Equal(t, 1, router.pathSamples())
+
+		router.recordMisbehavior(&rps.Peer{Address: net.ParseIP("10.0.0.1"), Port: 1}, MisbehaviorTimeout)
+		assert.Equal(t, 3, router.pathSamples())
+
+		// banned peers make up a larger share of smaller networks
+		router.recordMisbehavior(&rps.Peer{Address: net.ParseIP("10.0.0.2"), Port: 1}, MisbehaviorTimeout)
+		estimator.estimate.Peers = 4
+		router.startRound()
+		assert.Equal(t, 17, router.pathSamples())
+
+		estimator.estimate.Peers = 1000
+		router.startRound()
+		assert.Equal(t, 1, router.pathSamples())
+
+		// retrying is pointless if all peers are banned
+		estimator.estimate.Peers = 2
+		router.startRound()
+		assert.Equal(t, 1, router.pathSamples())
+	})
+}
+
+func TestRouterStats(t *testing.T) {
+	estimator := &mockNSE{estimate: nse.Estimate{Peers: 42, StdDeviation: 3}}
+	router := newRouter(&config.Config{BanDuration: 60}, WithRPS(&mockRPS{}), WithNSE(estimator))
+	router.startRound()
+
+	router.outgoingTunnels[1] = &Tunnel{id: 1}
+	router.outgoingTunnels[2] = &Tunnel{id: 2}
+	router.coverTunnels = []uint32{2, 3} // tunnel 3 was torn down already
+	router.incomingTunnels[4] = &tunnelSegment{tunnelID: 4}
+	router.recordMisbehavior(&rps.Peer{Address: net.ParseIP("10.0.0.1"), Port: 1}, MisbehaviorTimeout)
+
+	assert.Equal(t, Stats{
+		OutgoingTunnels:  2,
+		CoverTunnels:     1,
+		IncomingTunnels:  1,
+		BannedPeers:      1,
+		NetworkSize:      estimator.estimate,
+		NetworkSizeKnown: true,
+	}, router.Stats())
+}
@@ -0,0 +1,149 @@
+package onion
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"bawang/config"
+)
+
+const (
+	// ntpTimeout is the max. time to wait for the response of the NTP server.
+	ntpTimeout = 5 * time.Second
+	// ntpPort is the port of the NTP server if none is configured.
+	ntpPort = "123"
+	// ntpEpoch is the number of seconds between the NTP epoch (1900) and the Unix epoch (1970).
+	ntpEpoch = 2208988800
+	// ntpPacketSize is the size of an NTP packet without extensions.
+	ntpPacketSize = 48
+)
+
+var errInvalidNTPResponse = errors.New("invalid NTP response")
+
+// offsetClock is a Clock running ahead of another one by an offset, which is negative if it runs behind. The offset
+// may be set while the clock is in use, such that it can be handed out before the offset is measured.
+type offsetClock struct {
+	Clock
+	offset int64 // time.Duration, accessed atomically
+}
+
+func (c *offsetClock) Now() time.Time {
+	return c.Clock.Now().Add(time.Duration(atomic.LoadInt64(&c.offset)))
+}
+
+// setOffset sets the offset by which the clock runs ahead.
+func (c *offsetClock) setOffset(offset time.Duration) {
+	atomic.StoreInt64(&c.offset, int64(offset))
+}
+
+// correctedClock returns the clock of a Router using the given config, which is corrected by the offset from the NTP
+// server once checkClock measured it with config.TimeSourceNTP. Until then, the given clock is used as is. Other
+// clocks than the system clock, e.g. given via WithClock, are never corrected.
+func correctedClock(cfg *config.Config, clock Clock) Clock {
+	if _, system := clock.(systemClock); !system || cfg == nil || cfg.NTPServer == "" ||
+		cfg.TimeSource != config.TimeSourceNTP {
+		return clock
+	}
+	return &offsetClock{Clock: clock}
+}
+
+// toNTPTime converts t to the 64-bit fixed-point timestamp format of NTP.
+func toNTPTime(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpoch)
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return secs<<32 | frac
+}
+
+// fromNTPTime converts a 64-bit fixed-point timestamp of NTP to a time.Time.
+func fromNTPTime(ts uint64) time.Time {
+	secs := int64(ts>>32) - ntpEpoch
+	nanos := (ts & 0xffffffff) * uint64(time.Second) >> 32
+	return time.Unix(secs, int64(nanos))
+}
+
+// queryNTP measures the offset of the local clock from the given NTP server with a single SNTP request, see RFC 4330.
+// The offset is positive if the local clock runs behind.
+func queryNTP(server string, clock Clock) (offset time.Duration, err error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, ntpPort)
+	}
+
+	conn, err := net.DialTimeout("udp", server, ntpTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(ntpTimeout))
+	if err != nil {
+		return 0, err
+	}
+
+	// client request of version 4 without any leap indicator, carrying the transmit time
+	req := make([]byte, ntpPacketSize)
+	req[0] = 4<<3 | 3
+	sent := clock.Now()
+	transmit := toNTPTime(sent)
+	binary.BigEndian.PutUint64(req[40:], transmit)
+	_, err = conn.Write(req)
+	if err != nil {
+		return 0, err
+	}
+
+	resp := make([]byte, ntpPacketSize)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return 0, err
+	}
+	received := clock.Now()
+
+	// the response must be sent by a synchronized server and answer our request
+	mode, stratum := resp[0]&0x7, resp[1]
+	if n < ntpPacketSize || mode != 4 || stratum == 0 || resp[0]>>6 == 3 ||
+		binary.BigEndian.Uint64(resp[24:]) != transmit {
+		return 0, errInvalidNTPResponse
+	}
+
+	serverReceived := fromNTPTime(binary.BigEndian.Uint64(resp[32:]))
+	serverSent := fromNTPTime(binary.BigEndian.Uint64(resp[40:]))
+	return (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2, nil
+}
+
+// checkClock checks the local clock against the configured NTP server and warns if it deviates by more than
+// Config.MaxClockSkew, since rounds, timeouts and replay windows of peers assume synchronized clocks. With
+// config.TimeSourceNTP, the Router's clock is corrected by the measured offset from then on, see correctedClock.
+func (r *Router) checkClock() {
+	if r.cfg == nil || r.cfg.NTPServer == "" {
+		return
+	}
+
+	corrected, correct := r.clock.(*offsetClock)
+	local := r.clock
+	if correct {
+		local = corrected.Clock
+	}
+	offset, err := queryNTP(r.cfg.NTPServer, local)
+	if err != nil {
+		r.logger.Printf("Warning: could not check the clock against NTP server %v: %v\n", r.cfg.NTPServer, err)
+		return
+	}
+
+	if correct {
+		corrected.setOffset(offset)
+	}
+
+	tolerance := time.Duration(r.cfg.MaxClockSkew) * time.Second
+	offset = offset.Round(time.Millisecond)
+	switch {
+	case offset <= tolerance && offset >= -tolerance:
+	case correct:
+		r.logger.Printf("Local clock deviates by %v from NTP server %v, using the corrected time\n", offset,
+			r.cfg.NTPServer)
+	default:
+		r.logger.Printf("Warning: local clock deviates by %v from NTP server %v, more than the tolerated %v. Rounds "+
+			"and replay windows may not align with other peers, synchronize the clock or set time_source = %s\n",
+			offset, r.cfg.NTPServer, tolerance, config.TimeSourceNTP)
+	}
+}
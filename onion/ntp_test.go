@@ -0,0 +1,138 @@
+package onion
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+)
+
+// serveNTP answers SNTP requests on a local UDP socket with the time of a clock running ahead of the local one by the
+// given offset. The stratum is set to 0 if unsynchronized is set.
+func serveNTP(t *testing.T, offset time.Duration, unsynchronized bool) (address string, stop func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	go func() {
+		buf := make([]byte, ntpPacketSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < ntpPacketSize {
+				continue
+			}
+
+			now := toNTPTime(time.Now().Add(offset))
+			resp := make([]byte, ntpPacketSize)
+			resp[0] = 4<<3 | 4
+			resp[1] = 2
+			if unsynchronized {
+				resp[1] = 0
+			}
+			copy(resp[24:32], buf[40:48])
+			binary.BigEndian.PutUint64(resp[32:], now)
+			binary.BigEndian.PutUint64(resp[40:], now)
+			_, _ = conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+func TestNTPTime(t *testing.T) {
+	now := time.Date(2020, 7, 1, 12, 30, 15, 250000000, time.UTC)
+	assert.True(t, now.Equal(fromNTPTime(toNTPTime(now))))
+	assert.Equal(t, uint64(ntpEpoch)<<32, toNTPTime(time.Unix(0, 0)))
+}
+
+func TestQueryNTP(t *testing.T) {
+	address, stop := serveNTP(t, time.Hour, false)
+	defer stop()
+
+	offset, err := queryNTP(address, systemClock{})
+	require.Nil(t, err)
+	assert.InDelta(t, float64(time.Hour), float64(offset), float64(time.Second))
+
+	unsynchronized, stop := serveNTP(t, 0, true)
+	defer stop()
+	_, err = queryNTP(unsynchronized, systemClock{})
+	assert.Equal(t, errInvalidNTPResponse, err)
+}
+
+func TestRouterCheckClock(t *testing.T) {
+	address, stop := serveNTP(t, -time.Minute, false)
+	defer stop()
+
+	t.Run("system", func(t *testing.T) {
+		router := newRouter(&config.Config{NTPServer: address, MaxClockSkew: 5}, WithRPS(&mockRPS{}))
+		var logs bytes.Buffer
+		router.logger = log.New(&logs, "", 0)
+
+		router.checkClock()
+		assert.Contains(t, logs.String(), "Warning: local clock deviates by -1m0s")
+		assert.Equal(t, systemClock{}, router.clock)
+	})
+
+	t.Run("ntp", func(t *testing.T) {
+		cfg := &config.Config{NTPServer: address, MaxClockSkew: 5, TimeSource: config.TimeSourceNTP,
+			ResumeLifetime: 120}
+		router := newRouter(cfg, WithRPS(&mockRPS{}))
+		var logs bytes.Buffer
+		router.logger = log.New(&logs, "", 0)
+
+		router.checkClock()
+		assert.NotContains(t, logs.String(), "Warning")
+		assert.InDelta(t, float64(time.Now().Add(-time.Minute).UnixNano()), float64(router.clock.Now().UnixNano()),
+			float64(time.Second))
+
+		// components which captured the clock before the check are corrected as well
+		assert.InDelta(t, float64(time.Now().Add(-time.Minute).UnixNano()),
+			float64(router.tickets.clock.Now().UnixNano()), float64(time.Second))
+	})
+
+	t.Run("not blocking", func(t *testing.T) {
+		// the server never answers
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.Nil(t, err)
+		defer conn.Close()
+
+		cfg := &config.Config{NTPServer: conn.LocalAddr().String(), MaxClockSkew: 5, TimeSource: config.TimeSourceNTP}
+		start := time.Now()
+		router, err := NewRouter(cfg, WithRPS(&mockRPS{}), WithLogger(log.New(ioutil.Discard, "", 0)))
+		require.Nil(t, err)
+		assert.Less(t, int64(time.Since(start)), int64(ntpTimeout/2))
+
+		// the local clock is used until the server answers
+		assert.InDelta(t, float64(time.Now().UnixNano()), float64(router.clock.Now().UnixNano()), float64(time.Second))
+	})
+
+	t.Run("tolerated", func(t *testing.T) {
+		router := newRouter(&config.Config{NTPServer: address, MaxClockSkew: 120}, WithRPS(&mockRPS{}))
+		var logs bytes.Buffer
+		router.logger = log.New(&logs, "", 0)
+
+		router.checkClock()
+		assert.Empty(t, logs.String())
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		unreachable, stop := serveNTP(t, 0, false)
+		stop()
+
+		router := newRouter(&config.Config{NTPServer: unreachable, MaxClockSkew: 5}, WithRPS(&mockRPS{}))
+		var logs bytes.Buffer
+		router.logger = log.New(&logs, "", 0)
+
+		router.checkClock()
+		assert.Contains(t, logs.String(), "Warning: could not check the clock")
+	})
+}
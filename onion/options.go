@@ -0,0 +1,147 @@
+package onion
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"bawang/auth"
+	"bawang/gossip"
+	"bawang/nse"
+	"bawang/rps"
+	"bawang/trace"
+)
+
+// Option configures optional behavior of a Router when creating it with NewRouter.
+type Option func(r *Router)
+
+// WithRPS makes the Router sample peers from the given rps.RPS instead of connecting to the RPS module
+// configured in the config.Config.
+func WithRPS(rps rps.RPS) Option {
+	return func(r *Router) {
+		r.rps = rps
+	}
+}
+
+// WithAuth makes the Router delegate the handshakes with the hops and the layer encryption of the relay messages to the
+// given auth.Client instead of connecting to the Onion Auth module configured in the config.Config.
+func WithAuth(client auth.Client) Option {
+	return func(r *Router) {
+		r.auth = client
+	}
+}
+
+// WithNSE makes the Router tune cover traffic and path selection to the network size estimated by the given nse.NSE
+// instead of connecting to the NSE module configured in the config.Config.
+func WithNSE(estimator nse.NSE) Option {
+	return func(r *Router) {
+		r.nse = estimator
+	}
+}
+
+// WithGossip makes the Router announce its liveness and learn about the liveness of other peers via the given
+// gossip.Gossip instead of connecting to the Gossip module configured in the config.Config.
+func WithGossip(g gossip.Gossip) Option {
+	return func(r *Router) {
+		r.gossip = g
+	}
+}
+
+// WithTracer makes the Router record spans of the tunnel lifecycles with the given trace.Tracer instead of exporting
+// them to the OTLP endpoint configured in the config.Config.
+func WithTracer(tracer *trace.Tracer) Option {
+	return func(r *Router) {
+		r.tracer = tracer
+	}
+}
+
+// WithLogger makes the Router write its log output to the given log.Logger.
+func WithLogger(logger *log.Logger) Option {
+	return func(r *Router) {
+		r.logger = logger
+	}
+}
+
+// WithClock replaces the system clock used for rounds and timeouts, e.g. for testing.
+func WithClock(clock Clock) Option {
+	return func(r *Router) {
+		r.clock = clock
+	}
+}
+
+// WithTransport makes the Router use the given Transport for Links instead of the transport configured in the
+// config.Config.
+func WithTransport(transport Transport) Option {
+	return func(r *Router) {
+		r.transport = transport
+	}
+}
+
+// WithPolicy makes the Router consult the given Policy on incoming tunnels in addition to the rules of the
+// config.Config. The option may be given multiple times, the policies are consulted in order until one refuses.
+func WithPolicy(policy Policy) Option {
+	return func(r *Router) {
+		r.policies = append(r.policies, policy)
+	}
+}
+
+// WithRand replaces crypto/rand as the source of randomness of the Router, e.g. to run tests and simulations
+// deterministically together with WithClock. It is used for the tunnel and circuit IDs, the Diffie-Hellman keys of the
+// handshakes, the stream IDs and the padding and counters of the messages sent on Links, but neither by the Transport
+// nor for encrypting with host keys.
+// Reads are serialized, thus a math/rand.Rand can be passed as well.
+// Never use anything but a cryptographically secure source outside of tests, the anonymity of the tunnels relies on it.
+func WithRand(random io.Reader) Option {
+	return func(r *Router) {
+		r.rand = &lockedReader{rd: random}
+	}
+}
+
+// lockedReader serializes the reads from an io.Reader which is not safe for concurrent use.
+type lockedReader struct {
+	lock sync.Mutex
+	rd   io.Reader
+}
+
+func (lr *lockedReader) Read(p []byte) (n int, err error) {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+	return lr.rd.Read(p)
+}
+
+// Clock is the source of time used by the Router.
+type Clock interface {
+	Now() time.Time                         // Now returns the current time.
+	After(d time.Duration) <-chan time.Time // After waits for the duration to elapse and then sends the current time on the returned channel.
+	NewTicker(d time.Duration) Ticker       // NewTicker returns a new Ticker sending the current time after each tick.
+}
+
+// Ticker delivers ticks of a clock at intervals.
+type Ticker interface {
+	C() <-chan time.Time // C returns the channel on which the ticks are delivered.
+	Stop()               // Stop turns off the ticker.
+}
+
+// systemClock implements Clock using the functions of the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
@@ -0,0 +1,132 @@
+package onion
+
+import (
+	"sync/atomic"
+	"time"
+
+	"bawang/p2p"
+)
+
+// linkFeatures returns the optional link features we announce to adjacent peers, see p2p.LinkHello.
+func (r *Router) linkFeatures() (features p2p.LinkFeatures) {
+	if r.cfg.LinkPadding > 0 {
+		features |= p2p.LinkFeaturePadding
+	}
+	if r.cfg.DedupLinks {
+		features |= p2p.LinkFeatureIdentity
+	}
+	return features
+}
+
+// sendLinkHello announces our link features to the adjacent peer once the link is established. Nothing is sent if
+// there is nothing to announce, such that links of peers not using any link features look like before. Peers built
+// with another packet size than p2p.DefaultMessageSize always announce it, such that the adjacent peer can tell that
+// their packets do not fit.
+func (r *Router) sendLinkHello(link *Link) (err error) {
+	hello := &p2p.LinkHello{Features: r.linkFeatures()}
+	if hello.Features&p2p.LinkFeatureIdentity != 0 {
+		hello.Port = uint16(r.cfg.P2PPort)
+		hello.Identity = r.linkIdentity
+	}
+	if p2p.MessageSize != p2p.DefaultMessageSize {
+		hello.MessageSize = p2p.MessageSize
+	}
+	if hello.Features == 0 && hello.MessageSize == 0 {
+		return nil
+	}
+	return link.sendMsg(p2p.LinkTunnelID, hello)
+}
+
+// isLinkMsg checks whether messages of the given type are link messages, see handleLinkMsg.
+func isLinkMsg(msgType p2p.Type) bool {
+	switch msgType {
+	case p2p.TypeLinkHello, p2p.TypeLinkPadding, p2p.TypeLinkReachCheck, p2p.TypeLinkReachResult:
+		return true
+	}
+	return false
+}
+
+// handleLinkMsg processes a link message received from the adjacent peer. Padding is started once both peers
+// announced p2p.LinkFeaturePadding, received padding is dropped. The identity of the peer is recorded to detect
+// duplicate links, see identifyLink. The link is closed if the adjacent peer uses packets
+// of another size, see p2p.MessageSize. Reachability checks are answered one at a time per link, see
+// answerReachCheck.
+func (r *Router) handleLinkMsg(link *Link, msg message) {
+	switch msg.hdr.Type {
+	case p2p.TypeLinkHello:
+		helloMsg := p2p.LinkHello{}
+		err := helloMsg.Parse(msg.body)
+		if err != nil {
+			r.logger.Printf("Error parsing link hello: %v\n", err)
+			return
+		}
+
+		if !helloMsg.SameMessageSize() {
+			r.logger.Printf("Closing link to peer using packets of %d instead of %d bytes\n", helloMsg.MessageSize,
+				p2p.MessageSize)
+			link.Close()
+			return
+		}
+
+		if helloMsg.Features&p2p.LinkFeaturePadding != 0 && r.linkFeatures()&p2p.LinkFeaturePadding != 0 {
+			link.padding.Do(func() {
+				go r.padLink(link)
+			})
+		}
+
+		if helloMsg.Features&p2p.LinkFeatureIdentity != 0 && r.cfg.DedupLinks {
+			r.identifyLink(link, helloMsg.Port, helloMsg.Identity)
+		}
+
+	case p2p.TypeLinkPadding:
+		// nothing to do
+
+	case p2p.TypeLinkReachCheck:
+		checkMsg := p2p.LinkReachCheck{}
+		err := checkMsg.Parse(msg.body)
+		if err != nil {
+			r.logger.Printf("Error parsing reachability check: %v\n", err)
+			return
+		}
+		// without a port or the address of the link, there is nothing to connect back to
+		if checkMsg.Port != 0 && link.address != nil && atomic.CompareAndSwapInt32(&link.reachChecking, 0, 1) {
+			go r.answerReachCheck(link, checkMsg)
+		}
+
+	case p2p.TypeLinkReachResult:
+		resultMsg := p2p.LinkReachResult{}
+		err := resultMsg.Parse(msg.body)
+		if err != nil {
+			r.logger.Printf("Error parsing reachability result: %v\n", err)
+			return
+		}
+		r.reachChecks.resolve(resultMsg)
+	}
+}
+
+// padLink sends p2p.LinkPadding on the link at random intervals until the link is closed, independent of the
+// traffic of its tunnels. An observer of the connection thus cannot tell whether the tunnels carry data, even if the
+// peers keep no cover tunnels through each other.
+func (r *Router) padLink(link *Link) {
+	for {
+		select {
+		case <-link.Quit:
+			return
+		case <-r.clock.After(r.paddingInterval()):
+		}
+
+		// padding yields to all other messages on the link
+		err := link.sendMsgWithPriority(p2p.LinkTunnelID, &p2p.LinkPadding{}, PriorityBulk)
+		if err != nil {
+			r.logger.Printf("Error sending link padding: %v\n", err)
+			return
+		}
+	}
+}
+
+// paddingInterval returns the random time until the next p2p.LinkPadding, uniformly distributed between zero and
+// twice the configured mean.
+func (r *Router) paddingInterval() time.Duration {
+	max := 2*uint32(r.cfg.LinkPadding) + 1
+	return time.Duration(r.randomUint32()%max) * time.Millisecond
+}
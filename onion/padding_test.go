@@ -0,0 +1,84 @@
+package onion
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+)
+
+func TestRouterLinkPadding(t *testing.T) {
+	newLinkPair := func() (link *Link, remote *Link) {
+		connLocal, connRemote := net.Pipe()
+		return newConnLink(connLocal), newConnLink(connRemote)
+	}
+
+	t.Run("negotiated", func(t *testing.T) {
+		router := newRouter(&config.Config{LinkPadding: 1}, WithRPS(&mockRPS{}))
+		link, remote := newLinkPair()
+		defer link.Close()
+		go router.handleLink(link)
+
+		// our features are announced right away
+		msg, err := remote.readMsg()
+		require.Nil(t, err)
+		require.Equal(t, p2p.TypeLinkHello, msg.hdr.Type)
+		assert.Equal(t, uint32(p2p.LinkTunnelID), msg.hdr.TunnelID)
+		helloMsg := p2p.LinkHello{}
+		require.Nil(t, helloMsg.Parse(msg.body))
+		assert.Equal(t, p2p.LinkFeaturePadding, helloMsg.Features)
+
+		// padding starts once the adjacent peer announced it as well
+		require.Nil(t, remote.sendMsg(p2p.LinkTunnelID, &p2p.LinkHello{Features: p2p.LinkFeaturePadding}))
+		for i := 0; i < 3; i++ {
+			msg, err = remote.readMsg()
+			require.Nil(t, err)
+			assert.Equal(t, p2p.TypeLinkPadding, msg.hdr.Type)
+		}
+
+		// received padding is dropped without affecting the link
+		require.Nil(t, remote.sendMsg(p2p.LinkTunnelID, &p2p.LinkPadding{}))
+		assert.False(t, link.isClosed())
+	})
+
+	t.Run("not supported by adjacent peer", func(t *testing.T) {
+		router := newRouter(&config.Config{LinkPadding: 1}, WithRPS(&mockRPS{}))
+		link, _ := newLinkPair()
+
+		router.handleLinkMsg(link, message{hdr: p2p.Header{Type: p2p.TypeLinkHello}, body: make([]byte, 4)})
+		started := false
+		link.padding.Do(func() { started = true })
+		assert.True(t, started, "padding must not have been started")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+		link, _ := newLinkPair()
+		assert.Nil(t, router.sendLinkHello(link)) // would block on the pipe otherwise
+
+		body := []byte{byte(p2p.LinkFeaturePadding), 0, 0, 0}
+		router.handleLinkMsg(link, message{hdr: p2p.Header{Type: p2p.TypeLinkHello}, body: body})
+		started := false
+		link.padding.Do(func() { started = true })
+		assert.True(t, started, "padding must not have been started")
+	})
+
+	t.Run("other message size", func(t *testing.T) {
+		router := newRouter(&config.Config{LinkPadding: 1}, WithRPS(&mockRPS{}))
+		link, _ := newLinkPair()
+
+		hello := &p2p.LinkHello{Features: p2p.LinkFeaturePadding, MessageSize: 2 * p2p.MessageSize}
+		body := make([]byte, hello.PackedSize())
+		_, err := hello.Pack(body)
+		require.Nil(t, err)
+		router.handleLinkMsg(link, message{hdr: p2p.Header{Type: p2p.TypeLinkHello}, body: body})
+		assert.True(t, link.isClosed())
+		started := false
+		link.padding.Do(func() { started = true })
+		assert.True(t, started, "padding must not have been started")
+	})
+}
@@ -0,0 +1,59 @@
+package onion
+
+import (
+	"fmt"
+
+	"bawang/errcode"
+	"bawang/rps"
+)
+
+// ErrPathMismatch is returned if the hops a tunnel was built through differ from the ones requested for it.
+var ErrPathMismatch = errcode.New(errcode.ModuleOnion, errcode.Unknown, false, "hops do not match the requested path")
+
+// Path is the sequence of hops a tunnel is built through: the sampled or pinned intermediate hops followed by the
+// target peer. The hops of a Tunnel are copies of the ones of its path holding the keys shared with them, see
+// Path.reached.
+type Path []*rps.Peer
+
+// newPath returns the path through the given intermediate hops to the given target peer.
+func newPath(intermediate []*rps.Peer, targetPeer *rps.Peer) Path {
+	return append(append(make(Path, 0, len(intermediate)+1), intermediate...), targetPeer)
+}
+
+// reached returns the hop at the given position as stored in a Tunnel once it was reached, holding the given key
+// shared with it.
+func (p Path) reached(position int, key *[32]byte) *rps.Peer {
+	hop := p[position]
+	return &rps.Peer{
+		DHShared: *key,
+		Port:     hop.Port,
+		Address:  hop.Address,
+		HostKey:  hop.HostKey,
+	}
+}
+
+// verify checks that the given hops of a built tunnel are the ones of the path, i.e. each one has the address, port
+// and host key of the hop at its position.
+func (p Path) verify(hops []*rps.Peer) error {
+	if len(hops) != len(p) {
+		return fmt.Errorf("%w: %d hops instead of %d", ErrPathMismatch, len(hops), len(p))
+	}
+	for i, hop := range hops {
+		if !sameHop(hop, p[i]) {
+			return fmt.Errorf("%w: hop %d is %v:%v instead of %v:%v", ErrPathMismatch, i, hop.Address, hop.Port,
+				p[i].Address, p[i].Port)
+		}
+	}
+	return nil
+}
+
+// sameHop checks whether both peers have the same address, port and host key, if any.
+func sameHop(a, b *rps.Peer) bool {
+	if a.Port != b.Port || !a.Address.Equal(b.Address) {
+		return false
+	}
+	if a.HostKey == nil || b.HostKey == nil {
+		return a.HostKey == b.HostKey
+	}
+	return sameHostKey(a.HostKey, b.HostKey)
+}
@@ -0,0 +1,57 @@
+package onion
+
+import (
+	"crypto/rsa"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/rps"
+)
+
+func TestPath(t *testing.T) {
+	newPeer := func(i int) *rps.Peer {
+		return &rps.Peer{
+			Address: net.IPv4(10, 0, 0, byte(i)),
+			Port:    uint16(6600 + i),
+			HostKey: &rsa.PublicKey{N: big.NewInt(int64(1000 + i)), E: 65537},
+		}
+	}
+	target := newPeer(4)
+	path := newPath([]*rps.Peer{newPeer(1), newPeer(2), newPeer(3)}, target)
+	require.Len(t, path, 4)
+	assert.Equal(t, target, path[3])
+
+	// every reached hop is a copy of the hop at its own position
+	var hops []*rps.Peer
+	for i := range path {
+		key := [32]byte{byte(i)}
+		hop := path.reached(i, &key)
+		assert.Equal(t, key, hop.DHShared)
+		assert.True(t, sameHop(path[i], hop))
+		assert.NotSame(t, path[i], hop)
+		hops = append(hops, hop)
+	}
+	assert.Nil(t, path.verify(hops))
+
+	t.Run("mismatch", func(t *testing.T) {
+		// e.g. every extended hop recorded as the first one
+		wrong := append([]*rps.Peer{hops[0]}, hops[0], hops[0], hops[0])
+		err := path.verify(wrong)
+		assert.True(t, errors.Is(err, ErrPathMismatch))
+		assert.Contains(t, err.Error(), "hop 1 is 10.0.0.1:6601 instead of 10.0.0.2:6602")
+
+		assert.True(t, errors.Is(path.verify(hops[:3]), ErrPathMismatch))
+
+		// the host key must match as well
+		other := *hops[3]
+		other.HostKey = &rsa.PublicKey{N: big.NewInt(42), E: 65537}
+		assert.True(t, errors.Is(path.verify(append(hops[:3:3], &other)), ErrPathMismatch))
+		other.HostKey = nil
+		assert.True(t, errors.Is(path.verify(append(hops[:3:3], &other)), ErrPathMismatch))
+	})
+}
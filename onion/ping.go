@@ -0,0 +1,116 @@
+package onion
+
+import (
+	"crypto/rsa"
+	"net"
+	"time"
+
+	"bawang/config"
+	"bawang/errcode"
+	"bawang/p2p"
+)
+
+var ErrPingTimeout = errcode.New(errcode.ModuleOnion, errcode.Timeout, true, "timeout connecting to peer")
+
+// PingResult describes the Link level connection established by Ping.
+type PingResult struct {
+	RTT     time.Duration  // time it took to establish the connection, including the transport's handshake
+	HostKey *rsa.PublicKey // host key presented by the peer, nil if the transport does not expose it
+}
+
+// Ping opens a connection to the peer given by address:port with the transport configured in cfg, as it would for a
+// Link, and closes it right away. No tunnel is created, thus the peer merely sees a connection without any messages.
+func Ping(cfg *config.Config, address net.IP, port uint16, timeout time.Duration) (result PingResult, err error) {
+	name := DefaultTransport
+	if cfg.Transport != "" {
+		name = cfg.Transport
+	}
+	transport, err := newTransport(name, cfg)
+	if err != nil {
+		return result, err
+	}
+	return pingTransport(transport, address, port, timeout)
+}
+
+// pingTransport opens a connection to the peer given by address:port with the given transport and closes it right
+// away, see Ping.
+func pingTransport(transport Transport, address net.IP, port uint16, timeout time.Duration) (result PingResult,
+	err error) {
+	type dialResult struct {
+		nc  net.Conn
+		err error
+	}
+	// DialPeer has no timeout of its own, a connection established too late is closed once it is
+	dialed := make(chan dialResult, 1)
+	start := time.Now()
+	go func() {
+		nc, err := transport.DialPeer(address, port)
+		dialed <- dialResult{nc: nc, err: err}
+	}()
+
+	var res dialResult
+	select {
+	case res = <-dialed:
+	case <-time.After(timeout):
+		go func() {
+			if res := <-dialed; res.err == nil {
+				res.nc.Close()
+			}
+		}()
+		return result, ErrPingTimeout
+	}
+	if res.err != nil {
+		return result, res.err
+	}
+	defer res.nc.Close()
+
+	// the TLS handshake is completed by the transport already
+	result.RTT = time.Since(start)
+	result.HostKey = peerHostKey(res.nc)
+
+	return result, nil
+}
+
+// PingTunnel measures the round-trip time through the outgoing tunnel with the given ID. Like cover traffic, the ping
+// is echoed by the last hop of the tunnel. Unlike Ping, the time includes all hops of the tunnel, thus clients can pick
+// the fastest of several tunnels. An answer not received within the build timeout is reported as ErrTimedOut.
+func (r *Router) PingTunnel(tunnelID uint32) (rtt time.Duration, err error) {
+	r.tunnelsLock.RLock()
+	tunnel, ok := r.outgoingTunnels[tunnelID]
+	r.tunnelsLock.RUnlock()
+	if !ok {
+		return 0, ErrInvalidTunnel
+	}
+	return r.pingTunnel(tunnel)
+}
+
+// pingTunnel measures the round-trip time through the given outgoing tunnel, see PingTunnel.
+func (r *Router) pingTunnel(tunnel *Tunnel) (rtt time.Duration, err error) {
+	// the pongs can not be told apart, thus each ping has to wait for the previous one
+	tunnel.pingLock.Lock()
+	defer tunnel.pingLock.Unlock()
+
+	// drop the late pong of a timed out ping
+	select {
+	case <-tunnel.pongs:
+	default:
+	}
+
+	// data held back must not wait behind the ping, nor make it slower
+	r.flushBatch(&tunnel.batch, tunnel.sendRelayToLastHop)
+
+	start := r.clock.Now()
+	err = tunnel.sendRelayToLastHop(&p2p.RelayTunnelCover{Ping: true})
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case <-tunnel.pongs:
+		return r.clock.Now().Sub(start), nil
+	case <-tunnel.quit:
+		return 0, ErrInvalidTunnel
+	case <-r.clock.After(time.Duration(r.cfg.BuildTimeout) * time.Second):
+		return 0, ErrTimedOut
+	}
+}
@@ -0,0 +1,153 @@
+package onion
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+	"bawang/rps"
+)
+
+func TestPing(t *testing.T) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+
+	t.Run("tls", func(t *testing.T) {
+		ln, err := newTLSTransport(&config.Config{HostKey: hostKey}).Listen("127.0.0.1:0")
+		require.Nil(t, err)
+		defer ln.Close()
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					// the handshake is performed on the first read
+					_, _ = conn.Read(make([]byte, 1))
+					conn.Close()
+				}()
+			}
+		}()
+
+		addr := ln.Addr().(*net.TCPAddr)
+		result, err := Ping(&config.Config{}, addr.IP, uint16(addr.Port), 5*time.Second)
+		require.Nil(t, err)
+		assert.True(t, result.RTT > 0)
+		require.NotNil(t, result.HostKey)
+		assert.Equal(t, hostKey.PublicKey, *result.HostKey)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		// accepts connections but never answers the TLS handshake
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		defer ln.Close()
+		conns := make(chan net.Conn, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err == nil {
+				conns <- conn
+			}
+		}()
+
+		addr := ln.Addr().(*net.TCPAddr)
+		_, err = Ping(&config.Config{}, addr.IP, uint16(addr.Port), 100*time.Millisecond)
+		assert.Equal(t, ErrPingTimeout, err)
+		(<-conns).Close()
+	})
+
+	t.Run("unknown transport", func(t *testing.T) {
+		_, err := Ping(&config.Config{Transport: "carrier-pigeon"}, net.ParseIP("127.0.0.1"), 1, time.Second)
+		assert.True(t, errors.Is(err, ErrUnknownTransport))
+	})
+}
+
+// newPipeTunnel returns an outgoing tunnel with a single hop on a pipe link and the end of the first hop of it.
+func newPipeTunnel(t *testing.T, tunnelID uint32) (tunnel *Tunnel, remote *relayEnd) {
+	link, connRemote := newPipeLink()
+	t.Cleanup(func() {
+		_ = connRemote.Close()
+	})
+	tunnel = &Tunnel{
+		id:    tunnelID,
+		link:  link,
+		pongs: make(chan struct{}, 1),
+		quit:  make(chan struct{}),
+	}
+	hop := &rps.Peer{DHShared: [32]byte{1, 2, 3}}
+	tunnel.addHop(hop, newKeyCipher(&hop.DHShared))
+	return tunnel, newHopEnd(connRemote, tunnel)
+}
+
+func TestRouterPingTunnel(t *testing.T) {
+	router := newRouter(&config.Config{BuildTimeout: 1}, WithRPS(&mockRPS{}))
+
+	tunnel, remote := newPipeTunnel(t, 42)
+	hop := tunnel.hops[0]
+	router.outgoingTunnels[42] = tunnel
+
+	_, backward := p2p.NewRelayDigests(&hop.DHShared)
+	var counter uint32
+	newCover := func(ping bool) message {
+		buf := make([]byte, p2p.MaxRelayDataSize+p2p.RelayHeaderSize)
+		var n int
+		var err error
+		counter, n, err = p2p.PackRelayMessage(buf, counter, &p2p.RelayTunnelCover{Ping: ping}, backward)
+		require.Nil(t, err)
+		body, err := p2p.EncryptRelay(buf[:n], &hop.DHShared)
+		require.Nil(t, err)
+		return message{hdr: p2p.Header{Type: p2p.TypeTunnelRelay}, body: body}
+	}
+
+	t.Run("invalid tunnel", func(t *testing.T) {
+		_, err := router.PingTunnel(1)
+		assert.Equal(t, ErrInvalidTunnel, err)
+	})
+
+	t.Run("pong", func(t *testing.T) {
+		type pingResult struct {
+			rtt time.Duration
+			err error
+		}
+		result := make(chan pingResult, 1)
+		go func() {
+			rtt, err := router.PingTunnel(42)
+			result <- pingResult{rtt: rtt, err: err}
+		}()
+
+		hdr, body := readRelayFromPrevHop(t, remote)
+		require.Equal(t, p2p.RelayTypeTunnelCover, hdr.RelayType)
+		coverMsg := p2p.RelayTunnelCover{}
+		require.Nil(t, coverMsg.Parse(body))
+		assert.True(t, coverMsg.Ping)
+
+		time.Sleep(10 * time.Millisecond)
+		require.False(t, router.handleOutgoingTunnelMsg(tunnel, newCover(false)))
+
+		res := <-result
+		require.Nil(t, res.err)
+		assert.True(t, res.rtt >= 10*time.Millisecond)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		go func() {
+			_, _ = readRelayFromPrevHop(t, remote)
+		}()
+		_, err := router.PingTunnel(42)
+		assert.Equal(t, ErrTimedOut, err)
+	})
+
+	t.Run("ping from hop", func(t *testing.T) {
+		// only the initiator sends pings
+		assert.True(t, router.handleOutgoingTunnelMsg(tunnel, newCover(true)))
+	})
+}
@@ -0,0 +1,64 @@
+package onion
+
+import (
+	"bawang/errcode"
+	"bawang/rps"
+)
+
+var (
+	// ErrPinningNotAllowed is returned if a client requests a tunnel through pinned hops, but the config does not
+	// allow it.
+	ErrPinningNotAllowed = errcode.New(errcode.ModuleOnion, errcode.NotAllowed, false, "pinning hops is not allowed")
+
+	// ErrInvalidPinnedHops is returned if the pinned hops of a tunnel are not as many distinct peers as the configured
+	// tunnel length requires.
+	ErrInvalidPinnedHops = errcode.New(errcode.ModuleOnion, errcode.InvalidMessage, false, "invalid pinned hops")
+)
+
+// BuildPinnedTunnel queues a job for a tunnel like BuildTunnel, but the tunnel is built through the given intermediate
+// hops instead of sampled ones, e.g. for testing or for deployments with a curated set of relays. The tunnel is rebuilt
+// through the same hops in every round. Pinned hops are not checked against banned peers, but their host keys are
+// verified like the ones of sampled hops.
+func (r *Router) BuildPinnedTunnel(targetPeer *rps.Peer, hops []*rps.Peer, client Client) (
+	replyChan chan BuildTunnelReply) {
+	replyChan = make(chan BuildTunnelReply, 1)
+
+	err := r.checkPinnedHops(targetPeer, hops)
+	if err != nil {
+		replyChan <- BuildTunnelReply{Err: err}
+		return replyChan
+	}
+
+	r.queueBuildJob(&buildTunnelJob{
+		targetPeer: targetPeer,
+		pinned:     append([]*rps.Peer(nil), hops...),
+		client:     client,
+		replyChan:  replyChan,
+	})
+	return replyChan
+}
+
+// checkPinnedHops checks that pinning hops is allowed and that the given hops are as many as the configured tunnel
+// length requires. The hops and the target peer must be distinct peers, i.e. neither their addresses nor their host
+// keys may be the same.
+func (r *Router) checkPinnedHops(targetPeer *rps.Peer, hops []*rps.Peer) error {
+	if !r.cfg.AllowPinnedHops {
+		return ErrPinningNotAllowed
+	}
+	if len(hops) != r.cfg.TunnelLength-1 {
+		return ErrInvalidPinnedHops
+	}
+
+	peers := append(append(make([]*rps.Peer, 0, len(hops)+1), hops...), targetPeer)
+	for i, peer := range peers {
+		if peer == nil || peer.HostKey == nil {
+			return ErrInvalidPinnedHops
+		}
+		for _, other := range peers[:i] {
+			if containsPeer([]*rps.Peer{peer}, []*rps.Peer{other}) || sameHostKey(peer.HostKey, other.HostKey) {
+				return ErrInvalidPinnedHops
+			}
+		}
+	}
+	return nil
+}
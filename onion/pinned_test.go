@@ -0,0 +1,95 @@
+package onion
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/rps"
+)
+
+// discardTransport is a Transport whose peers never answer.
+type discardTransport struct {
+	lock   sync.Mutex
+	dialed []string
+}
+
+func (t *discardTransport) DialPeer(address net.IP, port uint16) (net.Conn, error) {
+	t.lock.Lock()
+	t.dialed = append(t.dialed, net.JoinHostPort(address.String(), strconv.Itoa(int(port))))
+	t.lock.Unlock()
+
+	local, remote := net.Pipe()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, remote)
+	}()
+	return local, nil
+}
+
+func (t *discardTransport) Listen(address string) (net.Listener, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestRouterPinnedHops(t *testing.T) {
+	peers := make([]*rps.Peer, 3)
+	for i := range peers {
+		// the handshake with the first hop requires a full-size key
+		bits := 1024
+		if i == 0 {
+			bits = 4096
+		}
+		hostKey, err := rsa.GenerateKey(rand.Reader, bits)
+		require.Nil(t, err)
+		peers[i] = &rps.Peer{Address: net.IPv4(10, 0, 0, byte(i+1)), Port: 6602, HostKey: &hostKey.PublicKey}
+	}
+	target, hops := peers[2], peers[:2]
+
+	cfg := &config.Config{TunnelLength: 3, BuildTimeout: 1, AllowPinnedHops: true}
+	transport := &discardTransport{}
+	router := newRouter(cfg, WithRPS(&mockRPS{}), WithTransport(transport))
+
+	t.Run("not allowed", func(t *testing.T) {
+		cfg.AllowPinnedHops = false
+		defer func() { cfg.AllowPinnedHops = true }()
+
+		reply := <-router.BuildPinnedTunnel(target, hops, &ClientFuncs{})
+		assert.Equal(t, ErrPinningNotAllowed, reply.Err)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		otherAddress := &rps.Peer{Address: net.IPv4(10, 0, 0, 4), Port: 6602, HostKey: hops[0].HostKey}
+		for name, hops := range map[string][]*rps.Peer{
+			"too few":          hops[:1],
+			"too many":         {hops[0], hops[1], hops[1]},
+			"duplicate":        {hops[0], hops[0]},
+			"target":           {hops[0], target},
+			"same host key":    {hops[0], otherAddress},
+			"missing host key": {hops[0], {Address: net.IPv4(10, 0, 0, 5), Port: 6602}},
+		} {
+			reply := <-router.BuildPinnedTunnel(target, hops, &ClientFuncs{})
+			assert.Equal(t, ErrInvalidPinnedHops, reply.Err, name)
+		}
+	})
+
+	t.Run("build", func(t *testing.T) {
+		replyChan := router.BuildPinnedTunnel(target, hops, &ClientFuncs{})
+		assert.Equal(t, 0, router.handleBuildTunnelJobs(nil))
+
+		// the RPS module has no peers, thus the build only reaches the first hop if the pinned hops are used
+		reply := <-replyChan
+		assert.Equal(t, ErrTimedOut, reply.Err)
+		transport.lock.Lock()
+		assert.Equal(t, []string{"10.0.0.1:6602"}, transport.dialed)
+		transport.lock.Unlock()
+	})
+}
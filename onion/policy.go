@@ -0,0 +1,127 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"bawang/errcode"
+)
+
+// ErrPolicyRejected is returned if an incoming tunnel creation or extension was refused by a Policy.
+var ErrPolicyRejected = errcode.New(errcode.ModuleOnion, errcode.NotAllowed, false,
+	"rejected by incoming tunnel policy")
+
+// extendWindow is the period extends are limited in by Config.MaxExtendsPerSource.
+const extendWindow = time.Minute
+
+// Load is the current load of the Router, passed to the Policy to decide on incoming tunnels.
+type Load struct {
+	Segments    int  // number of incoming tunnel segments, see Config.MaxSegments
+	Links       int  // number of links to other peers, see Config.MaxLinks
+	Hibernating bool // whether the relay quota is used up, see Config.RelayQuota
+}
+
+// PolicyRequest describes an incoming tunnel creation or extension a Policy decides on.
+type PolicyRequest struct {
+	Source     net.IP // address of the peer creating or extending the tunnel, i.e. the previous hop
+	SourcePort uint16
+	Extend     bool   // whether the previous hop asks us to extend its tunnel rather than to create a new one
+	Target     net.IP // address of the peer the tunnel is extended to, only set for extends
+	TargetPort uint16
+	Load       Load
+}
+
+// Policy decides whether an incoming tunnel is accepted. It is consulted on every p2p.TunnelCreate received from
+// another peer and on every p2p.RelayTunnelExtend asking us to extend a tunnel to the next hop, after the rules of the
+// config.Config. Returning an error refuses the tunnel, which is logged along with the error.
+// Implementations must be safe for concurrent use.
+type Policy interface {
+	Allow(req *PolicyRequest) error
+}
+
+// PolicyFunc is an adapter to allow the use of ordinary functions as Policy.
+type PolicyFunc func(req *PolicyRequest) error
+
+// Allow calls f(req).
+func (f PolicyFunc) Allow(req *PolicyRequest) error {
+	return f(req)
+}
+
+// extendCounter counts the extends requested by each previous hop within the current extendWindow. It is safe for
+// concurrent use.
+type extendCounter struct {
+	lock   sync.Mutex
+	window time.Time      // start of the current window
+	counts map[string]int // extends by the address of the previous hop
+}
+
+// add counts an extend requested by the given source at the given time and returns the number of extends requested
+// by it within the current window so far.
+func (c *extendCounter) add(source net.IP, now time.Time) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.counts == nil || now.Sub(c.window) >= extendWindow {
+		c.window = now
+		c.counts = make(map[string]int)
+	}
+	c.counts[source.String()]++
+	return c.counts[source.String()]
+}
+
+// load returns the current load of the Router.
+func (r *Router) load() (load Load) {
+	r.tunnelsLock.RLock()
+	load.Segments = r.numSegments
+	r.tunnelsLock.RUnlock()
+
+	r.linksLock.Lock()
+	load.Links = r.numLinks
+	r.linksLock.Unlock()
+
+	load.Hibernating = r.hibernating()
+	return load
+}
+
+// admitPolicy checks whether the incoming tunnel creation or extension described by req is allowed by the rules of the
+// config.Config and all policies given via WithPolicy. The load of the Router is filled in.
+func (r *Router) admitPolicy(req *PolicyRequest) error {
+	req.Load = r.load()
+
+	err := r.configPolicy(req)
+	for i := 0; err == nil && i < len(r.policies); i++ {
+		err = r.policies[i].Allow(req)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPolicyRejected, err)
+	}
+	return nil
+}
+
+// configPolicy applies the rules of the config.Config to incoming tunnels: all of them are refused with
+// Config.ClientOnly, extends to networks listed in Config.ExtendDenyNetworks are refused, as well as extends exceeding
+// Config.MaxExtendsPerSource.
+func (r *Router) configPolicy(req *PolicyRequest) error {
+	// other peers may still try to build tunnels through us over the links we opened
+	if r.cfg.ClientOnly {
+		return errors.New("not relaying tunnels of other peers as a client-only peer")
+	}
+
+	if !req.Extend {
+		return nil
+	}
+
+	for _, network := range r.cfg.ExtendDenyNetworks {
+		if network.Contains(req.Target) {
+			return fmt.Errorf("extending to %v is not allowed", req.Target)
+		}
+	}
+
+	if r.cfg.MaxExtendsPerSource > 0 && r.extends.add(req.Source, r.clock.Now()) > r.cfg.MaxExtendsPerSource {
+		return fmt.Errorf("too many extends requested by %v", req.Source)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package onion
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/rps"
+)
+
+func TestExtendCounter(t *testing.T) {
+	now := time.Now()
+	source, other := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+
+	var c extendCounter
+	assert.Equal(t, 1, c.add(source, now))
+	assert.Equal(t, 2, c.add(source, now.Add(time.Second)))
+	assert.Equal(t, 1, c.add(other, now.Add(time.Second)))
+
+	// the counts are reset once the window is over
+	assert.Equal(t, 1, c.add(source, now.Add(extendWindow)))
+}
+
+func TestRouterAdmitPolicy(t *testing.T) {
+	_, denied, err := net.ParseCIDR("10.1.0.0/16")
+	require.Nil(t, err)
+	source := net.ParseIP("10.0.0.1")
+
+	t.Run("config", func(t *testing.T) {
+		clock := &fakeClock{now: time.Now()}
+		cfg := &config.Config{ExtendDenyNetworks: []*net.IPNet{denied}, MaxExtendsPerSource: 2}
+		router := newRouter(cfg, WithRPS(&mockRPS{}), WithClock(clock))
+
+		// creations are not limited by the config
+		for i := 0; i < 3; i++ {
+			assert.Nil(t, router.admitPolicy(&PolicyRequest{Source: source}))
+		}
+
+		err := router.admitPolicy(&PolicyRequest{Source: source, Extend: true, Target: net.ParseIP("10.1.2.3")})
+		assert.True(t, errors.Is(err, ErrPolicyRejected))
+
+		for i := 0; i < 2; i++ {
+			assert.Nil(t, router.admitPolicy(&PolicyRequest{Source: source, Extend: true, Target: net.ParseIP("10.2.0.1")}))
+		}
+		err = router.admitPolicy(&PolicyRequest{Source: source, Extend: true, Target: net.ParseIP("10.2.0.1")})
+		assert.True(t, errors.Is(err, ErrPolicyRejected))
+
+		clock.advance(extendWindow)
+		assert.Nil(t, router.admitPolicy(&PolicyRequest{Source: source, Extend: true, Target: net.ParseIP("10.2.0.1")}))
+	})
+
+	t.Run("client only", func(t *testing.T) {
+		router := newRouter(&config.Config{ClientOnly: true}, WithRPS(&mockRPS{}))
+
+		err := router.admitPolicy(&PolicyRequest{Source: source})
+		assert.True(t, errors.Is(err, ErrPolicyRejected))
+	})
+
+	t.Run("custom", func(t *testing.T) {
+		var requests []PolicyRequest
+		refuseExtends := PolicyFunc(func(req *PolicyRequest) error {
+			requests = append(requests, *req)
+			if req.Extend {
+				return errors.New("no extends")
+			}
+			return nil
+		})
+		router := newRouter(&config.Config{}, WithRPS(&mockRPS{}), WithPolicy(refuseExtends))
+		router.numSegments = 3
+
+		assert.Nil(t, router.admitPolicy(&PolicyRequest{Source: source}))
+		err := router.admitPolicy(&PolicyRequest{Source: source, Extend: true, Target: net.ParseIP("10.2.0.1")})
+		assert.True(t, errors.Is(err, ErrPolicyRejected))
+		assert.Contains(t, err.Error(), "no extends")
+
+		require.Len(t, requests, 2)
+		assert.Equal(t, Load{Segments: 3}, requests[0].Load)
+		assert.True(t, requests[1].Extend)
+	})
+}
+
+func TestRouterPolicyRefusesCreate(t *testing.T) {
+	// the handshake with the first hop requires a full-size key
+	hostKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	require.Nil(t, err)
+	hop := &rps.Peer{Address: net.ParseIP("10.0.0.1"), Port: 6602, HostKey: &hostKey.PublicKey}
+
+	refuseAll := PolicyFunc(func(req *PolicyRequest) error {
+		return errors.New("closed for maintenance")
+	})
+	peer := newRouter(&config.Config{HostKey: hostKey, BuildTimeout: 1}, WithRPS(&mockRPS{}), WithPolicy(refuseAll))
+	transport := &peerTransport{peers: map[string]*Router{"10.0.0.1": peer}}
+	router := newRouter(&config.Config{BuildTimeout: 1}, WithRPS(&mockRPS{}), WithTransport(transport))
+
+	// the refusal is answered right away rather than timing out
+	first := router.createFirstHop(nil, hop, 0, router.newCircuitID())
+	require.NotNil(t, first.err)
+	assert.NotEqual(t, ErrTimedOut, first.err)
+
+	peer.tunnelsLock.RLock()
+	assert.Equal(t, 0, peer.numSegments)
+	assert.Empty(t, peer.circuits)
+	peer.tunnelsLock.RUnlock()
+}
@@ -0,0 +1,234 @@
+package onion
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"bawang/errcode"
+	"bawang/p2p"
+)
+
+var ErrInvalidPriority = errcode.New(errcode.ModuleOnion, errcode.InvalidMessage, false, "invalid priority")
+
+// Priority is the class of the data sent on a tunnel. Links serve the messages of the classes by weighted fair
+// queuing, see writeScheduler.
+type Priority uint8
+
+const (
+	PriorityInteractive Priority = iota // default of all tunnels, e.g. voice
+	PriorityBulk                        // e.g. file transfers, which must not delay interactive data
+	PriorityControl                     // messages keeping the tunnels running, e.g. handshakes and teardowns
+
+	numPriorities
+)
+
+// priorityWeights are the shares of a link the priority classes get while all of them have messages to send.
+var priorityWeights = [numPriorities]int{
+	PriorityInteractive: 4,
+	PriorityBulk:        1,
+	PriorityControl:     8,
+}
+
+// scheduleOrder is the order in which the priority classes take their turns on a link.
+var scheduleOrder = [numPriorities]Priority{PriorityControl, PriorityInteractive, PriorityBulk}
+
+// tunnelPriority holds the priority class of a tunnel. It is safe for concurrent use.
+type tunnelPriority struct {
+	priority uint32 // accessed atomically
+}
+
+// set sets the priority class.
+func (p *tunnelPriority) set(priority Priority) {
+	atomic.StoreUint32(&p.priority, uint32(priority))
+}
+
+// get returns the priority class.
+func (p *tunnelPriority) get() Priority {
+	return Priority(atomic.LoadUint32(&p.priority))
+}
+
+// relayPriority returns the priority class a relay message is sent with on a tunnel of the given class. Only the
+// payload of the clients is sent with the tunnel's class, while any other message keeps the tunnel running.
+func relayPriority(msg p2p.RelayMessage, priority Priority) Priority {
+	switch msg.(type) {
+	case *p2p.RelayTunnelData, *p2p.RelayTunnelBatch, *p2p.RelayTunnelSeqData, *p2p.RelayTunnelDatagram,
+		*p2p.RelayTunnelCover:
+		return priority
+	default:
+		return PriorityControl
+	}
+}
+
+// writeScheduler grants the goroutines sending on a Link access to the connection one at a time. While messages of
+// several priority classes wait, the classes take turns by weighted fair queuing: Each class may send as many messages
+// as its weight per round, such that bulk transfers do not starve interactive data and vice versa. Within a class, the
+// circuits with waiting messages take turns round-robin, such that a chatty tunnel does not delay the other tunnels
+// sharing the link. Since all messages on a link have the same size, this shares the bandwidth of the link in
+// proportion to the weights of the classes and evenly among the circuits of a class.
+type writeScheduler struct {
+	lock    sync.Mutex
+	busy    bool                         // whether a goroutine is sending
+	waiting [numPriorities]circuitQueues // goroutines waiting for their turn by class
+	credits [numPriorities]int           // messages each class may still send in the current round
+
+	// turns each circuit got while other circuits of its class waited as well, i.e. the turns the scheduler had to
+	// share between circuits, see Link.contendedTurns
+	contended map[uint32]uint64
+}
+
+// circuitQueues holds the goroutines of a priority class waiting for their turn by the circuit they send on.
+type circuitQueues struct {
+	queues map[uint32][]chan struct{} // closed on the goroutine's turn
+	order  []uint32                   // circuits with waiting goroutines in the order of their next turn
+	n      int                        // number of waiting goroutines
+}
+
+// push appends a goroutine waiting to send on the circuit with the given ID.
+func (q *circuitQueues) push(circuitID uint32, turn chan struct{}) {
+	if q.queues == nil {
+		q.queues = make(map[uint32][]chan struct{})
+	}
+	if len(q.queues[circuitID]) == 0 {
+		q.order = append(q.order, circuitID)
+	}
+	q.queues[circuitID] = append(q.queues[circuitID], turn)
+	q.n++
+}
+
+// pop removes the first goroutine of the circuit whose turn is next and moves the circuit to the back if more of its
+// goroutines wait. Returns whether other circuits waited as well.
+func (q *circuitQueues) pop() (turn chan struct{}, circuitID uint32, contended bool) {
+	circuitID, contended = q.order[0], len(q.order) > 1
+	copy(q.order, q.order[1:])
+	q.order = q.order[:len(q.order)-1]
+
+	queue := q.queues[circuitID]
+	turn = queue[0]
+	queue[0] = nil
+	if len(queue) > 1 {
+		q.queues[circuitID] = queue[1:]
+		q.order = append(q.order, circuitID)
+	} else {
+		delete(q.queues, circuitID)
+	}
+	q.n--
+	return turn, circuitID, contended
+}
+
+// acquire waits for the turn of a message of the given priority class on the circuit with the given ID. The caller
+// must call release once it sent the message.
+func (s *writeScheduler) acquire(circuitID uint32, priority Priority) {
+	s.lock.Lock()
+	if !s.busy {
+		s.busy = true
+		s.lock.Unlock()
+		return
+	}
+
+	turn := make(chan struct{})
+	s.waiting[priority].push(circuitID, turn)
+	s.lock.Unlock()
+	<-turn
+}
+
+// release passes the turn on to the next waiting goroutine.
+func (s *writeScheduler) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	next, ok := s.next()
+	if !ok {
+		s.busy = false
+		return
+	}
+
+	turn, circuitID, contended := s.waiting[next].pop()
+	if contended && circuitID != p2p.LinkTunnelID {
+		if s.contended == nil {
+			s.contended = make(map[uint32]uint64)
+		}
+		s.contended[circuitID]++
+	}
+	close(turn)
+}
+
+// forget drops the counter of the circuit with the given ID once it was removed from the link.
+func (s *writeScheduler) forget(circuitID uint32) {
+	s.lock.Lock()
+	delete(s.contended, circuitID)
+	s.lock.Unlock()
+}
+
+// contendedTurns returns a copy of the turns of the circuits which had to be shared with other circuits, nil if none.
+func (s *writeScheduler) contendedTurns() (turns map[uint32]uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.contended) > 0 {
+		turns = make(map[uint32]uint64, len(s.contended))
+		for circuitID, n := range s.contended {
+			turns[circuitID] = n
+		}
+	}
+	return turns
+}
+
+// queued returns the number of messages waiting for their turn.
+func (s *writeScheduler) queued() (n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, waiting := range s.waiting {
+		n += waiting.n
+	}
+	return n
+}
+
+// next returns the priority class whose turn is next. A new round starts once all classes with waiting messages used
+// up their credits. Returns false if no message waits.
+// Must be called with s.lock hold.
+func (s *writeScheduler) next() (priority Priority, ok bool) {
+	for round := 0; round < 2; round++ {
+		for _, priority = range scheduleOrder {
+			if s.waiting[priority].n > 0 && s.credits[priority] > 0 {
+				s.credits[priority]--
+				return priority, true
+			}
+		}
+
+		s.credits = priorityWeights
+	}
+	return 0, false
+}
+
+// SetTunnelPriority sets the priority class of the data sent on the tunnel with the given ID, see Priority. The class
+// is kept when the tunnel is rebuilt. Data held back to fill the cells of a bulk tunnel is sent right away, see
+// Config.CoalesceDelay.
+func (r *Router) SetTunnelPriority(tunnelID uint32, priority Priority) (err error) {
+	if priority >= numPriorities {
+		return ErrInvalidPriority
+	}
+
+	r.tunnelsLock.RLock()
+	defer r.tunnelsLock.RUnlock()
+
+	if tunnel, ok := r.outgoingTunnels[tunnelID]; ok {
+		tunnel.priority.set(priority)
+		if tunnel.path != nil {
+			tunnel.path.priority.set(priority)
+		}
+		r.flushBatch(&tunnel.batch, tunnel.sendRelayToLastHop)
+		return nil
+	}
+	if segment, ok := r.incomingTunnels[tunnelID]; ok {
+		segment.priority.set(priority)
+		r.flushBatch(&segment.batch, segment.sendRelayToPrevHop)
+		if stream := segment.stream; stream != nil && stream.multipath != nil {
+			stream.multipath.each(func(circuit interface{}) {
+				circuit.(*tunnelSegment).priority.set(priority)
+			})
+		}
+		return nil
+	}
+	return ErrInvalidTunnel
+}
@@ -0,0 +1,153 @@
+package onion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+)
+
+func TestRelayPriority(t *testing.T) {
+	assert.Equal(t, PriorityBulk, relayPriority(&p2p.RelayTunnelData{}, PriorityBulk))
+	assert.Equal(t, PriorityBulk, relayPriority(&p2p.RelayTunnelBatch{}, PriorityBulk))
+	assert.Equal(t, PriorityBulk, relayPriority(&p2p.RelayTunnelSeqData{}, PriorityBulk))
+	assert.Equal(t, PriorityBulk, relayPriority(&p2p.RelayTunnelDatagram{}, PriorityBulk))
+	assert.Equal(t, PriorityControl, relayPriority(&p2p.RelayTunnelAck{}, PriorityBulk))
+	assert.Equal(t, PriorityControl, relayPriority(&p2p.RelayTunnelDestroy{}, PriorityBulk))
+}
+
+func TestWriteScheduler(t *testing.T) {
+	var s writeScheduler
+	s.acquire(1, PriorityBulk) // the link is busy
+	defer s.release()
+
+	turns := make(chan Priority)
+	wait := func(priority Priority, n int) {
+		for i := 0; i < n; i++ {
+			go func() {
+				s.acquire(1, priority)
+				turns <- priority
+			}()
+		}
+	}
+	wait(PriorityControl, 10)
+	wait(PriorityInteractive, 6)
+	wait(PriorityBulk, 3)
+	require.Eventually(t, func() bool {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return s.waiting[PriorityControl].n == 10 && s.waiting[PriorityInteractive].n == 6 &&
+			s.waiting[PriorityBulk].n == 3
+	}, time.Second, time.Millisecond)
+
+	var order []Priority
+	for i := 0; i < 19; i++ {
+		s.release()
+		order = append(order, <-turns)
+	}
+
+	// each class gets turns in proportion to its weight, the bulk class is not starved
+	expected := []Priority{
+		PriorityControl, PriorityControl, PriorityControl, PriorityControl,
+		PriorityControl, PriorityControl, PriorityControl, PriorityControl,
+		PriorityInteractive, PriorityInteractive, PriorityInteractive, PriorityInteractive,
+		PriorityBulk,
+		PriorityControl, PriorityControl,
+		PriorityInteractive, PriorityInteractive,
+		PriorityBulk,
+		PriorityBulk,
+	}
+	assert.Equal(t, expected, order)
+
+	// the link is free once no message waits
+	s.release()
+	s.acquire(1, PriorityBulk)
+}
+
+func TestWriteSchedulerFairness(t *testing.T) {
+	var s writeScheduler
+	s.acquire(1, PriorityInteractive) // the link is busy
+
+	// a chatty circuit queues many more messages than the others of the same class
+	turns := make(chan uint32)
+	wait := func(circuitID uint32, n int) {
+		for i := 0; i < n; i++ {
+			go func() {
+				s.acquire(circuitID, PriorityInteractive)
+				turns <- circuitID
+			}()
+		}
+	}
+	wait(1, 30)
+	require.Eventually(t, func() bool {
+		return s.queued() == 30
+	}, time.Second, time.Millisecond)
+	wait(2, 3)
+	wait(3, 3)
+	require.Eventually(t, func() bool {
+		return s.queued() == 36
+	}, time.Second, time.Millisecond)
+
+	// the circuits take turns, even though the chatty one queued first
+	counts := make(map[uint32]int)
+	for i := 0; i < 9; i++ {
+		s.release()
+		counts[<-turns]++
+	}
+	assert.Equal(t, map[uint32]int{1: 3, 2: 3, 3: 3}, counts)
+	assert.Equal(t, map[uint32]uint64{1: 3, 2: 3, 3: 3}, s.contendedTurns())
+
+	// the chatty circuit gets the link to itself once the others are done, without contention
+	for i := 0; i < 27; i++ {
+		s.release()
+		assert.Equal(t, uint32(1), <-turns)
+	}
+	assert.Equal(t, map[uint32]uint64{1: 3, 2: 3, 3: 3}, s.contendedTurns())
+	s.release()
+
+	s.forget(2)
+	assert.Equal(t, map[uint32]uint64{1: 3, 3: 3}, s.contendedTurns())
+}
+
+func TestWriteSchedulerQueued(t *testing.T) {
+	var s writeScheduler
+	s.acquire(1, PriorityInteractive)
+	assert.Equal(t, 0, s.queued())
+
+	done := make(chan struct{})
+	go func() {
+		s.acquire(2, PriorityBulk)
+		s.release()
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		return s.queued() == 1
+	}, time.Second, time.Millisecond)
+
+	s.release()
+	<-done
+	assert.Equal(t, 0, s.queued())
+}
+
+func TestRouterSetTunnelPriority(t *testing.T) {
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+
+	tunnel := &Tunnel{id: 1}
+	tunnel.path = &Tunnel{id: 1}
+	router.outgoingTunnels[1] = tunnel
+	segment := &tunnelSegment{tunnelID: 2}
+	router.incomingTunnels[2] = segment
+
+	require.Nil(t, router.SetTunnelPriority(1, PriorityBulk))
+	assert.Equal(t, PriorityBulk, tunnel.priority.get())
+	assert.Equal(t, PriorityBulk, tunnel.path.priority.get())
+	require.Nil(t, router.SetTunnelPriority(2, PriorityControl))
+	assert.Equal(t, PriorityControl, segment.priority.get())
+
+	assert.Equal(t, ErrInvalidPriority, router.SetTunnelPriority(1, numPriorities))
+	assert.Equal(t, ErrInvalidTunnel, router.SetTunnelPriority(3, PriorityBulk))
+}
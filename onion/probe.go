@@ -0,0 +1,158 @@
+package onion
+
+import (
+	"time"
+
+	"bawang/p2p"
+	"bawang/rps"
+	"bawang/trace"
+)
+
+// firstHop is the circuit with the first hop of a tunnel being built, see createFirstHop.
+type firstHop struct {
+	hop       *rps.Peer
+	circuitID uint32
+	link      *Link
+	dataOut   chan message  // receives the messages of the circuit
+	session   *session      // nil unless the handshake succeeded
+	latency   time.Duration // duration of the handshake, see hopLatencyCounter
+	err       error
+}
+
+// createFirstHop opens or reuses a link to the given hop and performs the handshake of a new circuit with the given ID
+// on it for the tunnel with the given ID, traced as child of the given span. Failing circuits are released, see
+// releaseFirstHop.
+func (r *Router) createFirstHop(span *trace.Span, hop *rps.Peer, tunnelID, circuitID uint32) (first *firstHop) {
+	first = &firstHop{
+		hop:       hop,
+		circuitID: circuitID,
+	}
+	span = span.Child("tunnel.create")
+	span.Set("hop.address", hop.Address.String())
+	span.Set("hop.port", hop.Port)
+	span.Set("circuit.id", circuitID)
+	defer func() {
+		span.Finish(first.err)
+		if first.err != nil {
+			r.releaseFirstHop(first)
+		}
+	}()
+
+	// first we fetch a link connection to the first hop
+	r.logger.Printf("Starting to initialize onion circuit with first hop %v:%v\n", hop.Address, hop.Port)
+	linkSpan := span.Child("link")
+	first.link, first.err = r.GetOrCreateLink(hop.Address, hop.Port)
+	if first.err == nil {
+		first.err = r.verifyHop(first.link, hop)
+	}
+	linkSpan.Finish(first.err)
+	if first.err != nil {
+		return first
+	}
+
+	// now we register an output channel for this link
+	first.dataOut = make(chan message, 5)
+	first.err = r.registerCircuit(first.link, circuitID, first.dataOut)
+	if first.err != nil {
+		return first
+	}
+
+	// send a create message to the first hop and wait for the response, timing out when one does not come
+	exchange := func(createMsg *p2p.TunnelCreate) (*p2p.TunnelCreated, error) {
+		err := first.link.sendMsg(circuitID, createMsg)
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case created := <-first.dataOut:
+			if created.hdr.Type != p2p.TypeTunnelCreated {
+				return nil, p2p.ErrInvalidMessage
+			}
+
+			createdMsg := p2p.TunnelCreated{}
+			err = createdMsg.Parse(created.body)
+			if err != nil {
+				return nil, err
+			}
+			return &createdMsg, nil
+
+		case <-r.clock.After(time.Duration(r.cfg.BuildTimeout) * time.Second):
+			r.recordMisbehavior(hop, MisbehaviorTimeout)
+			return nil, ErrTimedOut
+		}
+	}
+	start := r.clock.Now()
+	first.session, first.err = r.handshake(hop, tunnelID, true, exchange)
+	if first.err == nil {
+		now := r.clock.Now()
+		first.latency = now.Sub(start)
+		r.latencies.record(hop, 0, first.latency, now)
+	}
+	return first
+}
+
+// releaseFirstHop tears down the circuit with a first hop which does not carry a tunnel, i.e. one which failed or lost
+// the race against another candidate, and releases its ID.
+func (r *Router) releaseFirstHop(first *firstHop) {
+	if first.session != nil {
+		_ = first.link.sendDestroyTunnel(first.circuitID)
+		first.session.cipher.close()
+		wipe(first.session.key[:])
+	}
+	r.releaseCircuit(first.circuitID)
+}
+
+// alternativeFirstHop samples another candidate for the first hop of the given path, which is raced against the
+// sampled one if Config.ProbeFirstHops is set, see raceFirstHops. Returns nil if probing is disabled or no other
+// candidate could be sampled.
+func (r *Router) alternativeFirstHop(hops []*rps.Peer, avoid []*rps.Peer) *rps.Peer {
+	if !r.cfg.ProbeFirstHops {
+		return nil
+	}
+
+	// the candidate must not be any other hop of the path
+	avoid = append(append([]*rps.Peer{}, avoid...), hops[:len(hops)-1]...)
+	candidates, err := r.samplePath(hops[len(hops)-1], avoid)
+	if err != nil {
+		return nil
+	}
+	return candidates[0]
+}
+
+// raceFirstHops creates circuits with both candidates for the first hop concurrently and returns the one completing
+// the handshake first, reducing the tail latency caused by slow or dead peers. Both circuits are created for the tunnel
+// with the given ID, the candidate given first uses the given circuit ID, the other one a new one. The losing circuit
+// is destroyed and released in the background once its handshake completed or failed. If both candidates fail, the
+// first one's error is returned. Both circuits are traced as children of the given span.
+func (r *Router) raceFirstHops(span *trace.Span, candidate, alternative *rps.Peer,
+	tunnelID, circuitID uint32) *firstHop {
+	results := make(chan *firstHop, 2)
+	go func() {
+		results <- r.createFirstHop(span, candidate, tunnelID, circuitID)
+	}()
+	go func() {
+		results <- r.createFirstHop(span, alternative, tunnelID, r.newCircuitID())
+	}()
+
+	var failed *firstHop
+	for i := 0; i < 2; i++ {
+		first := <-results
+		if first.err != nil {
+			if failed == nil || first.circuitID == circuitID {
+				failed = first
+			}
+			continue
+		}
+
+		if i == 0 {
+			go func() {
+				if loser := <-results; loser.err == nil {
+					r.releaseFirstHop(loser)
+				}
+			}()
+		}
+		return first
+	}
+	return failed
+}
@@ -0,0 +1,154 @@
+package onion
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/rps"
+)
+
+// peerTransport is a Transport connecting to in-memory routers for testing. Peers without a router never answer.
+type peerTransport struct {
+	discardTransport
+	peers map[string]*Router
+}
+
+func (t *peerTransport) DialPeer(address net.IP, port uint16) (net.Conn, error) {
+	peer, ok := t.peers[address.String()]
+	if !ok {
+		return t.discardTransport.DialPeer(address, port)
+	}
+
+	local, remote := net.Pipe()
+	go peer.acceptLink(peerConn{remote}, time.Second)
+	return local, nil
+}
+
+func TestRouterRaceFirstHops(t *testing.T) {
+	// the handshake with the first hop requires a full-size key
+	hostKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	require.Nil(t, err)
+
+	newPeer := func(address string) (*rps.Peer, *Router) {
+		peer := &rps.Peer{Address: net.ParseIP(address), Port: 6602, HostKey: &hostKey.PublicKey}
+		router := newRouter(&config.Config{HostKey: hostKey, BuildTimeout: 1}, WithRPS(&mockRPS{}))
+		return peer, router
+	}
+	segments := func(router *Router) int {
+		router.tunnelsLock.RLock()
+		defer router.tunnelsLock.RUnlock()
+		return router.numSegments
+	}
+	released := func(router *Router, circuitID uint32) func() bool {
+		return func() bool {
+			router.tunnelsLock.RLock()
+			defer router.tunnelsLock.RUnlock()
+			_, ok := router.circuits[circuitID]
+			return !ok
+		}
+	}
+
+	t.Run("dead candidate", func(t *testing.T) {
+		dead := &rps.Peer{Address: net.ParseIP("10.0.0.1"), Port: 6602, HostKey: &hostKey.PublicKey}
+		alive, aliveRouter := newPeer("10.0.0.2")
+		transport := &peerTransport{peers: map[string]*Router{"10.0.0.2": aliveRouter}}
+		router := newRouter(&config.Config{BuildTimeout: 1}, WithRPS(&mockRPS{}), WithTransport(transport))
+
+		circuitID := router.newCircuitID()
+		first := router.raceFirstHops(nil, dead, alive, 0, circuitID)
+		require.Nil(t, first.err)
+		assert.Same(t, alive, first.hop)
+		assert.NotEqual(t, circuitID, first.circuitID)
+		require.NotNil(t, first.session)
+		assert.Equal(t, 1, segments(aliveRouter))
+
+		// the dead candidate's circuit is released once it timed out
+		require.Eventually(t, released(router, circuitID), 3*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("loser destroyed", func(t *testing.T) {
+		peer1, router1 := newPeer("10.0.0.1")
+		peer2, router2 := newPeer("10.0.0.2")
+		transport := &peerTransport{peers: map[string]*Router{"10.0.0.1": router1, "10.0.0.2": router2}}
+		router := newRouter(&config.Config{BuildTimeout: 1}, WithRPS(&mockRPS{}), WithTransport(transport))
+
+		circuitID := router.newCircuitID()
+		first := router.raceFirstHops(nil, peer1, peer2, 0, circuitID)
+		require.Nil(t, first.err)
+
+		winner, loser := router1, router2
+		if first.hop == peer2 {
+			winner, loser = router2, router1
+		}
+		assert.Equal(t, 1, segments(winner))
+		require.Eventually(t, func() bool {
+			return segments(loser) == 0 && segments(winner) == 1
+		}, 3*time.Second, 10*time.Millisecond)
+
+		router.tunnelsLock.RLock()
+		assert.Len(t, router.circuits, 1)
+		assert.Contains(t, router.circuits, first.circuitID)
+		router.tunnelsLock.RUnlock()
+	})
+
+	t.Run("both dead", func(t *testing.T) {
+		transport := &peerTransport{}
+		router := newRouter(&config.Config{BuildTimeout: 1}, WithRPS(&mockRPS{}), WithTransport(transport))
+
+		candidate := &rps.Peer{Address: net.ParseIP("10.0.0.1"), Port: 6602, HostKey: &hostKey.PublicKey}
+		alternative := &rps.Peer{Address: net.ParseIP("10.0.0.2"), Port: 6602, HostKey: &hostKey.PublicKey}
+		circuitID := router.newCircuitID()
+		first := router.raceFirstHops(nil, candidate, alternative, 0, circuitID)
+		assert.Equal(t, ErrTimedOut, first.err)
+		assert.Same(t, candidate, first.hop)
+
+		router.tunnelsLock.RLock()
+		assert.Empty(t, router.circuits)
+		router.tunnelsLock.RUnlock()
+	})
+}
+
+func TestRouterAlternativeFirstHop(t *testing.T) {
+	peers := make([]*rps.Peer, 5)
+	for i := range peers {
+		peers[i] = &rps.Peer{Address: net.IPv4(10, 0, 0, byte(i+1)), Port: 6602}
+	}
+	target := &rps.Peer{Address: net.IPv4(10, 0, 1, 1), Port: 6602}
+	hops := []*rps.Peer{peers[0], peers[1], target}
+
+	cfg := &config.Config{TunnelLength: 3}
+	router := newRouter(cfg, WithRPS(&mockRPS{peers: []*rps.Peer{peers[0], peers[2], peers[3], peers[4]}}))
+	assert.Nil(t, router.alternativeFirstHop(hops, nil))
+
+	// the sampled paths must not contain any hop of the tunnel
+	cfg.ProbeFirstHops = true
+	assert.Same(t, peers[3], router.alternativeFirstHop(hops, nil))
+}
+
+func TestRouterBuildProbingFirstHops(t *testing.T) {
+	peers := make([]*rps.Peer, 4)
+	for i := range peers {
+		peers[i] = &rps.Peer{Address: net.IPv4(10, 0, 0, byte(i+1)), Port: 6602}
+	}
+	target := &rps.Peer{Address: net.IPv4(10, 0, 1, 1), Port: 6602}
+
+	transport := &refusingTransport{}
+	cfg := &config.Config{TunnelLength: 3, BuildTimeout: 1, ProbeFirstHops: true}
+	router := newRouter(cfg, WithRPS(&mockRPS{peers: peers}), WithTransport(transport))
+
+	_, err := router.buildNewTunnel(target, nil, &ClientFuncs{})
+	require.NotNil(t, err)
+	assert.ElementsMatch(t, []string{"10.0.0.1:6602", "10.0.0.3:6602"}, transport.dialed)
+	assert.Equal(t, map[int]uint64{0: 1}, router.Stats().HopFailures)
+
+	router.tunnelsLock.RLock()
+	assert.Empty(t, router.circuits)
+	router.tunnelsLock.RUnlock()
+}
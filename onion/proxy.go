@@ -0,0 +1,189 @@
+package onion
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"bawang/config"
+	"bawang/errcode"
+)
+
+// SOCKS5 client constants, see RFC 1928 and RFC 1929 for the username/password authentication.
+const (
+	socks5Version      = 0x05
+	socks5NoAuth       = 0x00
+	socks5UserPass     = 0x02
+	socks5UserPassAuth = 0x01 // version of the username/password sub negotiation
+	socks5Connect      = 0x01
+	socks5IPv4         = 0x01
+	socks5Domain       = 0x03
+	socks5IPv6         = 0x04
+	socks5Succeeded    = 0x00
+)
+
+var (
+	ErrProxyRefused = errcode.New(errcode.ModuleOnion, errcode.Unavailable, true, "proxy refused the connection")
+)
+
+// DialTCP opens a TCP connection to the peer given by address, which is host:port, as configured for outgoing links:
+// bound to Config.SourceAddress and through Config.Proxy, if set. The default transports open their connections with
+// it, a TLSDialFunc may use it to honor these settings as well.
+func DialTCP(cfg *config.Config, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	if cfg.SourceAddress != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(cfg.SourceAddress)}
+	}
+	if cfg.Proxy == "" {
+		return dialer.Dial("tcp", address)
+	}
+
+	proxy, err := url.Parse(cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	nc, err := dialer.Dial("tcp", proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	switch proxy.Scheme {
+	case config.ProxySOCKS5:
+		err = socks5Handshake(nc, address, proxy.User)
+	case config.ProxyHTTP:
+		err = httpConnect(nc, address, proxy.User)
+	default:
+		err = fmt.Errorf("unknown proxy scheme %q", proxy.Scheme)
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return nc, nil
+}
+
+// socks5Handshake asks the SOCKS5 proxy connected to via nc to connect to the given address, authenticating with the
+// given username and password if any.
+func socks5Handshake(nc net.Conn, address string, user *url.Userinfo) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+
+	method := byte(socks5NoAuth)
+	if user != nil {
+		method = socks5UserPass
+	}
+	if _, err = nc.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err = io.ReadFull(nc, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version || reply[1] != method {
+		return fmt.Errorf("%w: no acceptable authentication method", ErrProxyRefused)
+	}
+
+	if user != nil {
+		username := user.Username()
+		password, _ := user.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return fmt.Errorf("%w: username or password too long", ErrProxyRefused)
+		}
+		msg := append([]byte{socks5UserPassAuth, byte(len(username))}, username...)
+		msg = append(append(msg, byte(len(password))), password...)
+		if _, err = nc.Write(msg); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(nc, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != socks5Succeeded {
+			return fmt.Errorf("%w: authentication failed", ErrProxyRefused)
+		}
+	}
+
+	msg := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("%w: host name too long", ErrProxyRefused)
+		}
+		msg = append(append(msg, socks5Domain, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		msg = append(append(msg, socks5IPv4), ip4...)
+	} else {
+		msg = append(append(msg, socks5IPv6), ip.To16()...)
+	}
+	msg = append(msg, 0, 0)
+	binary.BigEndian.PutUint16(msg[len(msg)-2:], uint16(port))
+	if _, err = nc.Write(msg); err != nil {
+		return err
+	}
+
+	// the reply carries the address the proxy bound to, which is of no interest
+	var hdr [4]byte
+	if _, err = io.ReadFull(nc, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socks5Version || hdr[1] != socks5Succeeded {
+		return fmt.Errorf("%w: reply code %d", ErrProxyRefused, hdr[1])
+	}
+	var n int
+	switch hdr[3] {
+	case socks5IPv4:
+		n = net.IPv4len
+	case socks5IPv6:
+		n = net.IPv6len
+	case socks5Domain:
+		var size [1]byte
+		if _, err = io.ReadFull(nc, size[:]); err != nil {
+			return err
+		}
+		n = int(size[0])
+	default:
+		return fmt.Errorf("%w: unknown address type %d", ErrProxyRefused, hdr[3])
+	}
+	_, err = io.ReadFull(nc, make([]byte, n+2)) // address and port
+	return err
+}
+
+// httpConnect asks the HTTP proxy connected to via nc to connect to the given address with the CONNECT method, using
+// basic authentication with the given username and password if any.
+func httpConnect(nc net.Conn, address string, user *url.Userinfo) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(nc); err != nil {
+		return err
+	}
+
+	// the buffered reader can be discarded, since the peer does not send anything before our TLS client hello. The
+	// body of the response is the connection to the peer itself, thus it is not closed.
+	resp, err := http.ReadResponse(bufio.NewReader(nc), req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %q", ErrProxyRefused, resp.Status)
+	}
+	return nil
+}
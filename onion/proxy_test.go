@@ -0,0 +1,163 @@
+package onion
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+)
+
+// listenProxy accepts a single connection on a local listener and passes it to the given proxy handler, which returns
+// the address the client asked to connect to.
+func listenProxy(t *testing.T, handle func(conn net.Conn, rd *bufio.Reader) string) (address string,
+	requested chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		ln.Close()
+	})
+
+	requested = make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		requested <- handle(conn, bufio.NewReader(conn))
+		_, _ = io.Copy(conn, conn) // echo
+	}()
+	return ln.Addr().String(), requested
+}
+
+func TestDialTCP(t *testing.T) {
+	const peer = "10.0.0.1:4000"
+
+	exchange := func(t *testing.T, conn net.Conn) {
+		_, err := conn.Write([]byte("ping"))
+		require.Nil(t, err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		require.Nil(t, err)
+		assert.Equal(t, "ping", string(buf))
+	}
+
+	t.Run("source address", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		defer ln.Close()
+		accepted := make(chan net.Addr, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err == nil {
+				accepted <- conn.RemoteAddr()
+				conn.Close()
+			}
+		}()
+
+		conn, err := DialTCP(&config.Config{SourceAddress: "127.0.0.1"}, ln.Addr().String())
+		require.Nil(t, err)
+		defer conn.Close()
+		assert.Equal(t, "127.0.0.1", (<-accepted).(*net.TCPAddr).IP.String())
+	})
+
+	t.Run("socks5", func(t *testing.T) {
+		address, requested := listenProxy(t, func(conn net.Conn, rd *bufio.Reader) string {
+			greeting := make([]byte, 3)
+			_, _ = io.ReadFull(rd, greeting)
+			_, _ = conn.Write([]byte{socks5Version, socks5UserPass})
+
+			auth := make([]byte, 2)
+			_, _ = io.ReadFull(rd, auth)
+			username := make([]byte, auth[1])
+			_, _ = io.ReadFull(rd, username)
+			size, _ := rd.ReadByte()
+			password := make([]byte, size)
+			_, _ = io.ReadFull(rd, password)
+			_, _ = conn.Write([]byte{socks5UserPassAuth, socks5Succeeded})
+
+			req := make([]byte, 4+net.IPv4len+2)
+			_, _ = io.ReadFull(rd, req)
+			_, _ = conn.Write([]byte{socks5Version, socks5Succeeded, 0, socks5IPv4, 127, 0, 0, 1, 0, 1})
+			ip := net.IP(req[4 : 4+net.IPv4len])
+			return string(username) + ":" + string(password) + "@" +
+				net.JoinHostPort(ip.String(), strconv.Itoa(int(binary.BigEndian.Uint16(req[4+net.IPv4len:]))))
+		})
+
+		conn, err := DialTCP(&config.Config{Proxy: "socks5://user:secret@" + address}, peer)
+		require.Nil(t, err)
+		defer conn.Close()
+		assert.Equal(t, "user:secret@"+peer, <-requested)
+		exchange(t, conn)
+	})
+
+	t.Run("socks5 refused", func(t *testing.T) {
+		address, _ := listenProxy(t, func(conn net.Conn, rd *bufio.Reader) string {
+			greeting := make([]byte, 3)
+			_, _ = io.ReadFull(rd, greeting)
+			_, _ = conn.Write([]byte{socks5Version, socks5NoAuth})
+			_, _ = io.ReadFull(rd, make([]byte, 4+net.IPv6len+2))
+			_, _ = conn.Write([]byte{socks5Version, 0x05, 0, socks5IPv4, 0, 0, 0, 0, 0, 0}) // connection refused
+			return ""
+		})
+
+		_, err := DialTCP(&config.Config{Proxy: "socks5://" + address}, "[2001:db8::1]:4000")
+		assert.True(t, errors.Is(err, ErrProxyRefused))
+	})
+
+	t.Run("http", func(t *testing.T) {
+		address, requested := listenProxy(t, func(conn net.Conn, rd *bufio.Reader) string {
+			req, err := http.ReadRequest(rd)
+			if err != nil {
+				return ""
+			}
+			_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			req.Header.Set("Authorization", req.Header.Get("Proxy-Authorization"))
+			username, password, _ := req.BasicAuth()
+			return req.Method + " " + username + ":" + password + "@" + req.Host
+		})
+
+		conn, err := DialTCP(&config.Config{Proxy: "http://user:secret@" + address}, peer)
+		require.Nil(t, err)
+		defer conn.Close()
+		assert.Equal(t, "CONNECT user:secret@"+peer, <-requested)
+		exchange(t, conn)
+	})
+
+	t.Run("http refused", func(t *testing.T) {
+		address, _ := listenProxy(t, func(conn net.Conn, rd *bufio.Reader) string {
+			_, _ = http.ReadRequest(rd)
+			_, _ = conn.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"))
+			return ""
+		})
+
+		_, err := DialTCP(&config.Config{Proxy: "http://" + address}, peer)
+		assert.True(t, errors.Is(err, ErrProxyRefused))
+	})
+
+	t.Run("tls transport", func(t *testing.T) {
+		address, requested := listenProxy(t, func(conn net.Conn, rd *bufio.Reader) string {
+			req, err := http.ReadRequest(rd)
+			if err != nil {
+				return ""
+			}
+			_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+			return req.Host
+		})
+
+		// the echoed client hello is no valid server hello, but the connection went through the proxy
+		transport := newTLSTransport(&config.Config{Proxy: "http://" + address})
+		_, err := transport.DialPeer(net.ParseIP("10.0.0.1"), 4000)
+		assert.NotNil(t, err)
+		assert.Equal(t, peer, <-requested)
+	})
+}
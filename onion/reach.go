@@ -0,0 +1,206 @@
+package onion
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bawang/errcode"
+	"bawang/p2p"
+	"bawang/rps"
+)
+
+const (
+	// reachabilityAttempts is the number of helpers asked in turn by the startup check until one of them answers, e.g.
+	// since peers predating the check do not.
+	reachabilityAttempts = 3
+
+	// reachabilityPoll is the interval in which the startup check waits for the P2P listener to come up.
+	reachabilityPoll = 100 * time.Millisecond
+)
+
+var (
+	ErrNoReachAnswer = errcode.New(errcode.ModuleOnion, errcode.Timeout, true, "no answer to reachability check")
+)
+
+// Reachability is the outcome of a reachability check, see Router.CheckReachability.
+type Reachability struct {
+	Helper    string // address:port of the peer asked to connect back
+	Address   net.IP // our address as seen by the helper, which it connected back to
+	Reachable bool   // whether the helper reached us on our P2P port, presenting our host key if it could tell
+	NAT       bool   // whether the helper saw us at another address than the configured p2p_hostname
+}
+
+// reachChecks tracks the reachability checks waiting for their results by their nonce. The zero value is ready to
+// use and safe for concurrent use.
+type reachChecks struct {
+	lock    sync.Mutex
+	pending map[uint64]chan p2p.LinkReachResult
+}
+
+// add registers a check with the given nonce and returns the channel its result is delivered on.
+func (c *reachChecks) add(nonce uint64) chan p2p.LinkReachResult {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.pending == nil {
+		c.pending = make(map[uint64]chan p2p.LinkReachResult)
+	}
+	result := make(chan p2p.LinkReachResult, 1)
+	c.pending[nonce] = result
+	return result
+}
+
+// remove unregisters the check with the given nonce.
+func (c *reachChecks) remove(nonce uint64) {
+	c.lock.Lock()
+	delete(c.pending, nonce)
+	c.lock.Unlock()
+}
+
+// resolve delivers the given result to its check. Results of unknown checks are dropped.
+func (c *reachChecks) resolve(result p2p.LinkReachResult) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if ch, ok := c.pending[result.Nonce]; ok {
+		delete(c.pending, result.Nonce)
+		ch <- result
+	}
+}
+
+// CheckReachability asks the given peer to connect back to our P2P port, a random peer of the RPS module if nil, and
+// waits up to the build timeout for its answer. Peers predating the check do not answer, which is reported as
+// ErrNoReachAnswer.
+func (r *Router) CheckReachability(helper *rps.Peer) (result Reachability, err error) {
+	if helper == nil {
+		helper, err = r.rps.GetPeer()
+		if err != nil {
+			return result, err
+		}
+	}
+	result.Helper = net.JoinHostPort(helper.Address.String(), strconv.Itoa(int(helper.Port)))
+
+	link, err := r.GetOrCreateLink(helper.Address, helper.Port)
+	if err != nil {
+		return result, err
+	}
+	defer r.releaseLink(link)
+
+	nonce := uint64(r.randomUint32())<<32 | uint64(r.randomUint32())
+	answer := r.reachChecks.add(nonce)
+	defer r.reachChecks.remove(nonce)
+
+	err = link.sendMsg(p2p.LinkTunnelID, &p2p.LinkReachCheck{Port: uint16(r.cfg.P2PPort), Nonce: nonce})
+	if err != nil {
+		return result, err
+	}
+
+	var msg p2p.LinkReachResult
+	select {
+	case msg = <-answer:
+	case <-link.Quit:
+		return result, ErrLinkClosed
+	case <-r.clock.After(time.Duration(r.cfg.BuildTimeout) * time.Second):
+		return result, ErrNoReachAnswer
+	}
+
+	// another node answering at our address is no better than none
+	result.Address = msg.Address
+	result.Reachable = msg.Reachable
+	if msg.HostKeyHash != ([32]byte{}) && r.cfg.HostKey != nil {
+		result.Reachable = msg.HostKeyHash == sha256.Sum256(x509.MarshalPKCS1PublicKey(&r.cfg.HostKey.PublicKey))
+	}
+	result.NAT = !msg.Address.Equal(net.ParseIP(r.cfg.P2PHostname))
+	return result, nil
+}
+
+// CheckReachabilityOnStart runs the reachability check once the P2P listener is up and logs a warning if other peers
+// can not connect to us, e.g. because we are behind a NAT. Helpers not answering are replaced by others, up to
+// reachabilityAttempts in total. With Config.ReachabilityClientOnly, we stop announcing ourselves via the Gossip module
+// if we are unreachable, such that other peers do not try to extend their tunnels through us, see announceLiveness.
+// It returns once the check completed or quit is closed.
+func (r *Router) CheckReachabilityOnStart(quit chan struct{}) error {
+	for r.CheckListener() != nil {
+		select {
+		case <-quit:
+			return nil
+		case <-r.clock.After(reachabilityPoll):
+		}
+	}
+
+	for attempt := 0; attempt < reachabilityAttempts; attempt++ {
+		var helper *rps.Peer
+		if r.cfg.ReachabilityHelper != "" {
+			addr, err := net.ResolveTCPAddr("tcp", r.cfg.ReachabilityHelper)
+			if err != nil {
+				r.logger.Printf("Error resolving reachability helper: %v\n", err)
+				return nil
+			}
+			helper = &rps.Peer{Address: addr.IP, Port: uint16(addr.Port)}
+		}
+
+		result, err := r.CheckReachability(helper)
+		if err != nil {
+			r.logger.Printf("Reachability check inconclusive: %v\n", err)
+			select {
+			case <-quit:
+				return nil
+			default:
+			}
+			continue
+		}
+
+		if result.NAT {
+			r.logger.Printf("Warning: peer %v sees us at %v instead of p2p_hostname %v, we are likely behind a NAT\n",
+				result.Helper, result.Address, r.cfg.P2PHostname)
+		}
+		if result.Reachable {
+			r.logger.Printf("Reachability check via %v: reachable on port %v\n", result.Helper, r.cfg.P2PPort)
+			return nil
+		}
+
+		r.logger.Printf("Warning: peer %v could not connect back to port %v, other peers can not extend tunnels "+
+			"through us\n", result.Helper, r.cfg.P2PPort)
+		if r.cfg.ReachabilityClientOnly {
+			r.logger.Printf("Not announcing ourselves anymore, only building tunnels of our own\n")
+			atomic.StoreInt32(&r.unreachable, 1)
+		}
+		return nil
+	}
+	return nil
+}
+
+// isUnreachable checks whether the reachability check found us unreachable and we stopped announcing ourselves.
+func (r *Router) isUnreachable() bool {
+	return atomic.LoadInt32(&r.unreachable) != 0
+}
+
+// answerReachCheck connects back to the sender of the given check received on the given link, at the address the link
+// comes from, and sends the result on the link. Other addresses are never connected to, such that peers can not be
+// abused to connect to arbitrary hosts.
+func (r *Router) answerReachCheck(link *Link, check p2p.LinkReachCheck) {
+	defer atomic.StoreInt32(&link.reachChecking, 0)
+
+	result := &p2p.LinkReachResult{
+		Nonce:   check.Nonce,
+		IPv6:    link.address.To4() == nil,
+		Address: link.address,
+	}
+	ping, err := pingTransport(r.transport, link.address, check.Port, time.Duration(r.cfg.BuildTimeout)*time.Second)
+	if err == nil {
+		result.Reachable = true
+		if ping.HostKey != nil {
+			result.HostKeyHash = sha256.Sum256(x509.MarshalPKCS1PublicKey(ping.HostKey))
+		}
+	}
+
+	err = link.sendMsg(p2p.LinkTunnelID, result)
+	if err != nil {
+		r.logger.Printf("Error sending reachability result: %v\n", err)
+	}
+}
@@ -0,0 +1,208 @@
+package onion
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+	"bawang/rps"
+)
+
+func TestRouterReachability(t *testing.T) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+
+	// newReachLink returns a link to the peer at address:4000 and the remote end of it
+	newReachLink := func(address string) (link *Link, remote *Link) {
+		newLink := func(nc net.Conn) *Link {
+			link := newConnLink(nc)
+			link.address, link.port = net.ParseIP(address), 4000
+			return link
+		}
+		connLocal, connRemote := net.Pipe()
+		return newLink(connLocal), newLink(connRemote)
+	}
+
+	// answer lets the helper at the remote end of the link answer the next check with the given result
+	answer := func(router *Router, link, remote *Link, result p2p.LinkReachResult) (checks chan p2p.LinkReachCheck) {
+		checks = make(chan p2p.LinkReachCheck, 1)
+		go func() {
+			msg, err := remote.readMsg()
+			if err != nil {
+				return
+			}
+			check := p2p.LinkReachCheck{}
+			if check.Parse(msg.body) != nil {
+				return
+			}
+			checks <- check
+
+			result.Nonce = check.Nonce
+			body := make([]byte, result.PackedSize())
+			if _, err = result.Pack(body); err != nil {
+				return
+			}
+			router.handleLinkMsg(link, message{hdr: p2p.Header{Type: p2p.TypeLinkReachResult}, body: body})
+		}()
+		return checks
+	}
+
+	cfg := &config.Config{
+		P2PHostname:     "10.0.0.5",
+		P2PPort:         4001,
+		HostKey:         hostKey,
+		BuildTimeout:    5,
+		RoundDuration:   60,
+		LinkIdleTimeout: 60,
+	}
+	helper := &rps.Peer{Address: net.ParseIP("10.0.0.2"), Port: 4000}
+	hostKeyHash := sha256.Sum256(x509.MarshalPKCS1PublicKey(&hostKey.PublicKey))
+
+	t.Run("reachable", func(t *testing.T) {
+		router := newRouter(cfg, WithRPS(&mockRPS{}))
+		link, remote := newReachLink("10.0.0.2")
+		defer remote.Close()
+		router.addLink(link)
+
+		checks := answer(router, link, remote, p2p.LinkReachResult{
+			Reachable:   true,
+			Address:     net.ParseIP("10.0.0.5").To4(),
+			HostKeyHash: hostKeyHash,
+		})
+		result, err := router.CheckReachability(helper)
+		require.Nil(t, err)
+		assert.Equal(t, uint16(4001), (<-checks).Port)
+		assert.Equal(t, "10.0.0.2:4000", result.Helper)
+		assert.True(t, result.Reachable)
+		assert.False(t, result.NAT)
+
+		// the link is kept for tunnels until it is idle for too long
+		assert.Contains(t, router.idleLinks, link)
+		assert.False(t, link.isClosed())
+	})
+
+	t.Run("nat", func(t *testing.T) {
+		router := newRouter(cfg, WithRPS(&mockRPS{}))
+		link, remote := newReachLink("10.0.0.2")
+		defer remote.Close()
+		router.addLink(link)
+
+		answer(router, link, remote, p2p.LinkReachResult{Address: net.ParseIP("192.0.2.1").To4()})
+		result, err := router.CheckReachability(helper)
+		require.Nil(t, err)
+		assert.False(t, result.Reachable)
+		assert.True(t, result.NAT)
+		assert.Equal(t, "192.0.2.1", result.Address.String())
+	})
+
+	t.Run("other host key", func(t *testing.T) {
+		router := newRouter(cfg, WithRPS(&mockRPS{}))
+		link, remote := newReachLink("10.0.0.2")
+		defer remote.Close()
+		router.addLink(link)
+
+		answer(router, link, remote, p2p.LinkReachResult{
+			Reachable:   true,
+			Address:     net.ParseIP("10.0.0.5").To4(),
+			HostKeyHash: [32]byte{1},
+		})
+		result, err := router.CheckReachability(helper)
+		require.Nil(t, err)
+		assert.False(t, result.Reachable, "another node answered at our address")
+	})
+
+	t.Run("no answer", func(t *testing.T) {
+		router := newRouter(&config.Config{P2PPort: 4001}, WithRPS(&mockRPS{}))
+		link, remote := newReachLink("10.0.0.2")
+		defer remote.Close()
+		router.addLink(link)
+
+		go func() {
+			_, _ = remote.readMsg() // peers predating the check drop it
+		}()
+		_, err := router.CheckReachability(helper)
+		assert.Equal(t, ErrNoReachAnswer, err)
+	})
+
+	t.Run("client only", func(t *testing.T) {
+		cfg := *cfg
+		cfg.ReachabilityHelper = "10.0.0.2:4000"
+		cfg.ReachabilityClientOnly = true
+		g := &mockGossip{}
+		router := newRouter(&cfg, WithRPS(&mockRPS{}), WithGossip(g))
+		router.listening.Set(true)
+		link, remote := newReachLink("10.0.0.2")
+		defer remote.Close()
+		router.addLink(link)
+
+		answer(router, link, remote, p2p.LinkReachResult{Address: net.ParseIP("10.0.0.5").To4()})
+		require.Nil(t, router.CheckReachabilityOnStart(make(chan struct{})))
+		assert.True(t, router.isUnreachable())
+
+		// we stop announcing ourselves, such that no tunnels are extended through us
+		router.announceLiveness()
+		assert.Empty(t, g.announced)
+	})
+
+	t.Run("helper", func(t *testing.T) {
+		ln, err := newTLSTransport(cfg).Listen("127.0.0.1:0")
+		require.Nil(t, err)
+		defer ln.Close()
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					// the handshake is performed on the first read
+					_, _ = conn.Read(make([]byte, 1))
+					conn.Close()
+				}()
+			}
+		}()
+		closed, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		closed.Close()
+
+		check := func(t *testing.T, port int) p2p.LinkReachResult {
+			router := newRouter(&config.Config{BuildTimeout: 5}, WithRPS(&mockRPS{}))
+			link, remote := newReachLink("127.0.0.1")
+			defer remote.Close()
+
+			body := make([]byte, 12)
+			_, err := (&p2p.LinkReachCheck{Port: uint16(port), Nonce: 42}).Pack(body)
+			require.Nil(t, err)
+			router.handleLinkMsg(link, message{hdr: p2p.Header{Type: p2p.TypeLinkReachCheck}, body: body})
+
+			msg, err := remote.readMsg()
+			require.Nil(t, err)
+			require.Equal(t, p2p.TypeLinkReachResult, msg.hdr.Type)
+			result := p2p.LinkReachResult{}
+			require.Nil(t, result.Parse(msg.body))
+			assert.Equal(t, uint64(42), result.Nonce)
+			assert.Equal(t, "127.0.0.1", result.Address.String())
+			return result
+		}
+
+		t.Run("reachable", func(t *testing.T) {
+			result := check(t, ln.Addr().(*net.TCPAddr).Port)
+			assert.True(t, result.Reachable)
+			assert.Equal(t, hostKeyHash, result.HostKeyHash)
+		})
+
+		t.Run("unreachable", func(t *testing.T) {
+			result := check(t, closed.Addr().(*net.TCPAddr).Port)
+			assert.False(t, result.Reachable)
+			assert.Equal(t, [32]byte{}, result.HostKeyHash)
+		})
+	})
+}
@@ -0,0 +1,335 @@
+package onion
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"bawang/errcode"
+	"bawang/p2p"
+)
+
+const (
+	maxUnackedData = 256 // max. number of data messages buffered for retransmission per tunnel
+	ackInterval    = 8   // number of received data messages after which they are acknowledged
+)
+
+var (
+	ErrSendBufferFull = errcode.New(errcode.ModuleOnion, errcode.Limit, true,
+		"too many unacknowledged data messages on the tunnel")
+)
+
+// reliableStream adds end-to-end sequence numbers to the data sent on a tunnel. Sent data is buffered until the other
+// end acknowledges it, such that it can be sent again after the tunnel was rebuilt with new intermediate hops, while
+// the receiver drops the duplicates. Thus, rebuilding a tunnel mid-transfer is transparent to the clients on both ends.
+type reliableStream struct {
+	id        uint64     // random ID identifying the stream across rebuilt tunnels
+	multipath *multipath // circuits the data is striped across, nil unless carried by a multipath tunnel
+
+	// only used at the receiving end, guarded by Router.tunnelsLock
+	segment *tunnelSegment // tunnel segment currently carrying the stream
+
+	lock        sync.Mutex                       // guards all fields below
+	send        func(msg p2p.RelayMessage) error // sends a relay message on the current tunnel
+	sendSeq     uint32                           // sequence number of the next sent data message
+	unacked     []*p2p.RelayTunnelSeqData        // sent data messages not acknowledged yet, ordered by Seq
+	recvSeq     uint32                           // sequence number of the next expected data message
+	unackedRecv int                              // number of data messages received since the last acknowledgement
+	pending     map[uint32][]byte                // data received ahead of recvSeq, only buffered on multipath tunnels
+}
+
+// newReliableStream creates a stream sending on a tunnel via the given function.
+func newReliableStream(id uint64, send func(msg p2p.RelayMessage) error) *reliableStream {
+	return &reliableStream{
+		id:   id,
+		send: send,
+	}
+}
+
+// newStreamID generates a random stream ID from random. Stream IDs must not be guessable, since the receiver resumes a
+// stream on any tunnel presenting its ID.
+func newStreamID(random io.Reader) (id uint64, err error) {
+	var buf [8]byte
+	_, err = io.ReadFull(random, buf[:])
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+// seqBefore checks whether the sequence number a comes before b, taking wrap-arounds into account.
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// sendData splits the payload into data messages, which are sent on the current tunnel and buffered until they are
+// acknowledged. Data messages which could not be sent stay buffered and are sent again after the next rebuild.
+func (s *reliableStream) sendData(payload []byte) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	numMsgs := (len(payload) + p2p.MaxRelaySeqDataSize - 1) / p2p.MaxRelaySeqDataSize
+	if numMsgs == 0 {
+		numMsgs = 1 // empty payload is still passed on
+	}
+	if len(s.unacked)+numMsgs > maxUnackedData {
+		return ErrSendBufferFull
+	}
+
+	for i := 0; i < numMsgs; i++ {
+		chunk := payload[i*p2p.MaxRelaySeqDataSize:]
+		if len(chunk) > p2p.MaxRelaySeqDataSize {
+			chunk = chunk[:p2p.MaxRelaySeqDataSize]
+		}
+
+		msg := &p2p.RelayTunnelSeqData{
+			Stream: s.id,
+			Seq:    s.sendSeq,
+			Data:   append([]byte(nil), chunk...),
+		}
+		s.sendSeq++
+		s.unacked = append(s.unacked, msg)
+
+		err = s.send(msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ack drops the buffered data messages with a sequence number before seq, which the other end received.
+func (s *reliableStream) ack(seq uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n := 0
+	for n < len(s.unacked) && seqBefore(s.unacked[n].Seq, seq) {
+		s.unacked[n] = nil
+		n++
+	}
+	s.unacked = s.unacked[n:]
+}
+
+// receive passes the payload of the next expected data message to deliver and drops any other data message.
+// Received data messages are acknowledged every ackInterval messages. Duplicates are acknowledged immediately, since
+// they are sent again by the other end after a rebuild until acknowledged. On multipath tunnels, data messages received
+// ahead of the next expected one are buffered instead, since the circuits overtake each other.
+func (s *reliableStream) receive(msg *p2p.RelayTunnelSeqData, deliver func(data []byte) error) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if msg.Seq != s.recvSeq {
+		if seqBefore(msg.Seq, s.recvSeq) {
+			return s.sendAck()
+		}
+		if s.pending != nil && seqBefore(msg.Seq, s.recvSeq+maxUnackedData) {
+			s.pending[msg.Seq] = msg.Data
+		}
+		return nil // a previous data message was lost, both are sent again after the next rebuild
+	}
+
+	data := msg.Data
+	for {
+		s.recvSeq++
+		err = deliver(data)
+		if err != nil {
+			return err
+		}
+		s.unackedRecv++
+
+		var ok bool
+		data, ok = s.pending[s.recvSeq]
+		if !ok {
+			break
+		}
+		delete(s.pending, s.recvSeq)
+	}
+
+	if s.unackedRecv >= ackInterval {
+		return s.sendAck()
+	}
+	return nil
+}
+
+// sendAck acknowledges all data messages received so far. s.lock must be held.
+func (s *reliableStream) sendAck() (err error) {
+	s.unackedRecv = 0
+	return s.send(&p2p.RelayTunnelAck{
+		Stream: s.id,
+		Seq:    s.recvSeq,
+	})
+}
+
+// resume moves the stream to a rebuilt tunnel, sending via the given function from now on. The other end is told which
+// data messages were received so far, afterwards all unacknowledged data messages are sent again.
+func (s *reliableStream) resume(send func(msg p2p.RelayMessage) error) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.send = send
+	return s.sendUnacked()
+}
+
+// retransmit sends all unacknowledged data messages again, e.g. after a circuit of a multipath tunnel broke.
+func (s *reliableStream) retransmit() (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.sendUnacked()
+}
+
+// sendUnacked tells the other end which data messages were received so far and sends all unacknowledged data messages
+// again. s.lock must be held.
+func (s *reliableStream) sendUnacked() (err error) {
+	err = s.sendAck()
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range s.unacked {
+		err = s.send(msg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newStream creates a stream for an outgoing tunnel, if retransmissions are enabled.
+// Must be called with r.tunnelsLock hold.
+func (r *Router) newStream(tunnel *Tunnel) (err error) {
+	if r.cfg == nil || !r.cfg.ReliableData {
+		return nil
+	}
+
+	id, err := newStreamID(r.rand)
+	if err != nil {
+		return err
+	}
+	tunnel.stream = newReliableStream(id, tunnel.sendRelayToLastHop)
+	return nil
+}
+
+// bindStream returns the stream with the given ID carried by an incoming tunnel segment.
+// A stream not known yet is either a new one, or it was resumed on this segment after the initiator rebuilt the tunnel
+// and the old circuit broke before it was handed over. In the latter case, the segment replaces the previous one and
+// the clients keep using the tunnel ID known to them, see replaceSegment.
+func (r *Router) bindStream(tunnel *tunnelSegment, streamID uint64) (stream *reliableStream, err error) {
+	r.tunnelsLock.Lock()
+	if tunnel.stream != nil {
+		stream = tunnel.stream
+		r.tunnelsLock.Unlock()
+		if stream.id != streamID { // a tunnel carries only one stream
+			return nil, p2p.ErrInvalidMessage
+		}
+		return stream, nil
+	}
+
+	stream, ok := r.streams[streamID]
+	if ok && stream.multipath != nil {
+		// the circuits of a multipath tunnel must join it first, see joinStream
+		r.tunnelsLock.Unlock()
+		return nil, p2p.ErrInvalidMessage
+	}
+	if !ok {
+		stream = newReliableStream(streamID, tunnel.sendRelayToPrevHop)
+		stream.segment = tunnel
+		tunnel.stream = stream
+		r.streams[streamID] = stream
+		r.tunnelsLock.Unlock()
+		return stream, nil
+	}
+
+	if _, announced := r.incomingTunnels[tunnel.tunnelID]; announced {
+		// the segment carries another tunnel already
+		r.tunnelsLock.Unlock()
+		return nil, p2p.ErrInvalidMessage
+	}
+	r.replaceSegment(stream.segment, tunnel)
+	tunnelID := tunnel.tunnelID
+	r.tunnelsLock.Unlock()
+
+	r.logger.Printf("Resuming stream of incoming tunnel %v on rebuilt tunnel\n", tunnelID)
+	return stream, stream.resume(tunnel.sendRelayToPrevHop)
+}
+
+// receiveStreamData passes data received on a stream to the exit connection, if we act as exit for the tunnel, or to
+// the clients, announcing the tunnel first if necessary.
+func (r *Router) receiveStreamData(tunnel *tunnelSegment, stream *reliableStream, data []byte) (err error) {
+	isExit, err := r.writeToExit(tunnel, data)
+	if isExit {
+		if err != nil {
+			r.closeExit(tunnel)
+			return tunnel.sendRelayToPrevHop(&p2p.RelayTunnelEnd{Reason: p2p.EndReasonDone})
+		}
+		return nil
+	}
+
+	r.tunnelsLock.RLock()
+	segment := stream.segment
+	r.tunnelsLock.RUnlock()
+
+	tunnelID, err := r.announceSegment(segment)
+	if err != nil {
+		return err
+	}
+
+	return r.sendDataToClients(tunnelID, data)
+}
+
+// removeTunnelSegment unregisters a terminated incoming tunnel segment. The tunnel known to the clients is kept if
+// another segment replaced the terminated one. If the segment carries a stream, the tunnel is kept until
+// streamResumeTimeout passed, since the initiator may resume the stream on a rebuilt tunnel.
+func (r *Router) removeTunnelSegment(tunnel *tunnelSegment) {
+	r.tunnelsLock.RLock()
+	tunnelID := tunnel.tunnelID
+	replaced := tunnel.replacedBy != nil
+	stream := tunnel.stream
+	r.tunnelsLock.RUnlock()
+
+	tunnel.cipher.close()
+	r.releaseCircuit(tunnel.prevHopTunnelID)
+
+	switch {
+	case replaced: // the tunnel lives on in the replacing segment
+	case stream != nil && stream.multipath != nil && r.leaveStream(stream, tunnel):
+		// the tunnel lives on in its other circuits
+	case stream != nil:
+		go r.expireStream(stream, tunnel)
+	default:
+		err := r.RemoveTunnel(tunnelID)
+		if err != nil {
+			r.logger.Printf("Error removing tunnel with ID %v: %v\n", tunnelID, err)
+		}
+	}
+}
+
+// streamResumeTimeout is the time a stream waits to be resumed after its tunnel segment was torn down.
+func (r *Router) streamResumeTimeout() time.Duration {
+	return time.Duration(r.cfg.BuildTimeout) * time.Second
+}
+
+// expireStream removes a stream whose tunnel segment was torn down together with the tunnel known to the clients,
+// unless the stream was resumed on another tunnel segment in the meantime.
+func (r *Router) expireStream(stream *reliableStream, tunnel *tunnelSegment) {
+	<-r.clock.After(r.streamResumeTimeout())
+
+	r.tunnelsLock.Lock()
+	resumed := tunnel.replacedBy != nil || (stream.multipath != nil && stream.multipath.count() > 0)
+	if !resumed {
+		delete(r.streams, stream.id)
+	}
+	tunnelID := tunnel.tunnelID
+	r.tunnelsLock.Unlock()
+	if resumed {
+		return
+	}
+
+	err := r.RemoveTunnel(tunnelID)
+	if err != nil {
+		r.logger.Printf("Error removing tunnel with ID %v: %v\n", tunnelID, err)
+	}
+}
@@ -0,0 +1,195 @@
+package onion
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+)
+
+func TestSeqBefore(t *testing.T) {
+	assert.True(t, seqBefore(1, 2))
+	assert.False(t, seqBefore(2, 2))
+	assert.False(t, seqBefore(3, 2))
+	assert.True(t, seqBefore(0xffffffff, 0)) // wrap-around
+}
+
+func TestReliableStream(t *testing.T) {
+	var sent []p2p.RelayMessage
+	send := func(msg p2p.RelayMessage) error {
+		sent = append(sent, msg)
+		return nil
+	}
+
+	t.Run("send and ack", func(t *testing.T) {
+		sent = nil
+		stream := newReliableStream(42, send)
+
+		// payload exceeding a single message is split
+		payload := make([]byte, p2p.MaxRelaySeqDataSize+1)
+		require.Nil(t, stream.sendData(payload))
+		require.Nil(t, stream.sendData([]byte("data")))
+		require.Len(t, sent, 3)
+		for i, msg := range sent {
+			seqDataMsg := msg.(*p2p.RelayTunnelSeqData)
+			assert.Equal(t, uint64(42), seqDataMsg.Stream)
+			assert.Equal(t, uint32(i), seqDataMsg.Seq)
+		}
+		assert.Len(t, sent[0].(*p2p.RelayTunnelSeqData).Data, p2p.MaxRelaySeqDataSize)
+		assert.Len(t, sent[1].(*p2p.RelayTunnelSeqData).Data, 1)
+		require.Len(t, stream.unacked, 3)
+
+		stream.ack(2)
+		require.Len(t, stream.unacked, 1)
+		assert.Equal(t, uint32(2), stream.unacked[0].Seq)
+
+		// stale acknowledgements are ignored
+		stream.ack(1)
+		require.Len(t, stream.unacked, 1)
+	})
+
+	t.Run("send buffer full", func(t *testing.T) {
+		sent = nil
+		stream := newReliableStream(42, send)
+		for i := 0; i < maxUnackedData; i++ {
+			require.Nil(t, stream.sendData([]byte{byte(i)}))
+		}
+		assert.Equal(t, ErrSendBufferFull, stream.sendData([]byte("data")))
+
+		stream.ack(1)
+		assert.Nil(t, stream.sendData([]byte("data")))
+	})
+
+	t.Run("receive", func(t *testing.T) {
+		sent = nil
+		stream := newReliableStream(42, send)
+
+		var received [][]byte
+		deliver := func(data []byte) error {
+			received = append(received, data)
+			return nil
+		}
+
+		for i := 0; i < ackInterval; i++ {
+			require.Nil(t, stream.receive(&p2p.RelayTunnelSeqData{Stream: 42, Seq: uint32(i), Data: []byte{byte(i)}}, deliver))
+		}
+		require.Len(t, received, ackInterval)
+		require.Len(t, sent, 1)
+		assert.Equal(t, &p2p.RelayTunnelAck{Stream: 42, Seq: ackInterval}, sent[0])
+
+		// duplicates are dropped and acknowledged immediately
+		require.Nil(t, stream.receive(&p2p.RelayTunnelSeqData{Stream: 42, Seq: 3}, deliver))
+		require.Len(t, received, ackInterval)
+		require.Len(t, sent, 2)
+		assert.Equal(t, &p2p.RelayTunnelAck{Stream: 42, Seq: ackInterval}, sent[1])
+
+		// data after a gap is dropped
+		require.Nil(t, stream.receive(&p2p.RelayTunnelSeqData{Stream: 42, Seq: ackInterval + 1}, deliver))
+		require.Len(t, received, ackInterval)
+		require.Len(t, sent, 2)
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		sent = nil
+		stream := newReliableStream(42, func(msg p2p.RelayMessage) error {
+			return net.ErrWriteToConnected // the old tunnel is broken
+		})
+		stream.recvSeq = 5
+
+		require.NotNil(t, stream.sendData([]byte("lost")))
+		require.Len(t, stream.unacked, 1)
+
+		require.Nil(t, stream.resume(send))
+		require.Len(t, sent, 2)
+		assert.Equal(t, &p2p.RelayTunnelAck{Stream: 42, Seq: 5}, sent[0])
+		assert.Equal(t, &p2p.RelayTunnelSeqData{Stream: 42, Seq: 0, Data: []byte("lost")}, sent[1])
+	})
+}
+
+func TestRouterResumeStream(t *testing.T) {
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+
+	var received []string
+	client := &ClientFuncs{Data: func(tunnelID uint32, data []byte) error {
+		assert.Equal(t, uint32(42), tunnelID)
+		received = append(received, string(data))
+		return nil
+	}}
+	router.RegisterClient(client)
+
+	addSegment := func(tunnelID uint32) (tunnel *tunnelSegment, remote *relayEnd) {
+		link, connRemote := newPipeLink()
+		router.tunnels[tunnelID] = []Client{}
+		tunnel = &tunnelSegment{
+			prevHopTunnelID: router.newCircuitID(),
+			tunnelID:        tunnelID,
+			prevHopLink:     link,
+			dhShared:        &[32]byte{byte(tunnelID)},
+		}
+		return tunnel, newInitiatorEnd(connRemote, tunnel)
+	}
+	receive := func(tunnel *tunnelSegment, stream *reliableStream, seq uint32, data string) error {
+		return stream.receive(&p2p.RelayTunnelSeqData{Stream: 7, Seq: seq, Data: []byte(data)}, func(data []byte) error {
+			return router.receiveStreamData(tunnel, stream, data)
+		})
+	}
+
+	// the first data announces the tunnel to the clients
+	oldSegment, oldRemote := addSegment(42)
+	defer oldRemote.Close()
+	stream, err := router.bindStream(oldSegment, 7)
+	require.Nil(t, err)
+	require.Nil(t, receive(oldSegment, stream, 0, "a"))
+	assert.Equal(t, oldSegment, router.incomingTunnels[42])
+
+	// a tunnel carries only one stream
+	_, err = router.bindStream(oldSegment, 8)
+	assert.Equal(t, p2p.ErrInvalidMessage, err)
+
+	// the initiator rebuilt the tunnel and resumes the stream on a new segment
+	newSegment, newRemote := addSegment(43)
+	defer newRemote.Close()
+	go func() {
+		_, _ = router.bindStream(newSegment, 7)
+	}()
+	hdr, body := readRelayFromPrevHop(t, newRemote)
+	require.Equal(t, p2p.RelayTypeTunnelAck, hdr.RelayType)
+	ackMsg := p2p.RelayTunnelAck{}
+	require.Nil(t, ackMsg.Parse(body))
+	assert.Equal(t, p2p.RelayTunnelAck{Stream: 7, Seq: 1}, ackMsg)
+
+	require.Eventually(t, func() bool {
+		router.tunnelsLock.Lock()
+		defer router.tunnelsLock.Unlock()
+		return router.incomingTunnels[42] == newSegment
+	}, time.Second, time.Millisecond)
+
+	// data sent again on the new segment is only passed to the clients once
+	go func() {
+		_ = receive(newSegment, stream, 0, "a")
+	}()
+	hdr, _ = readRelayFromPrevHop(t, newRemote)
+	require.Equal(t, p2p.RelayTypeTunnelAck, hdr.RelayType)
+	require.Nil(t, receive(newSegment, stream, 1, "b"))
+	assert.Equal(t, []string{"a", "b"}, received)
+
+	// tearing down the old segment does not affect the tunnel known to the clients
+	router.removeTunnelSegment(oldSegment)
+	assert.Contains(t, router.tunnels, uint32(42))
+	assert.Contains(t, router.streams, uint64(7))
+	assert.NotContains(t, router.tunnels, uint32(43))
+
+	// the stream expires if it is not resumed after its segment was torn down
+	router.removeTunnelSegment(newSegment)
+	require.Eventually(t, func() bool {
+		router.tunnelsLock.Lock()
+		defer router.tunnelsLock.Unlock()
+		_, ok := router.tunnels[42]
+		return !ok && len(router.streams) == 0
+	}, time.Second, time.Millisecond)
+}
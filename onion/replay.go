@@ -0,0 +1,244 @@
+package onion
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"bawang/p2p"
+)
+
+// replayCache remembers the handshakes of recent tunnel creations, such that a captured p2p.TunnelCreate replayed by an
+// attacker is rejected before spending an RSA decryption or allocating a tunnel segment on it. Since the handshakes are
+// randomized, a legitimate initiator never sends the same one twice.
+// Timestamped creations outside of the replay window are rejected as well, thus remembering the handshakes until their
+// creation is outdated suffices. This relies on the timestamp being bound to the handshake, see handleDHTunnelCreate,
+// as a replay could be timestamped anew otherwise. Creations by peers not sending timestamps as well as handshakes
+// which can not be bound to it, i.e. those of the Onion Auth module and of p2p.HandshakeVersionDH expected by peers
+// predating the negotiation, are only rejected if replayed within the window. Resumptions are rejected by the
+// single-use tickets anyway, see ticketCache.
+// The remembered handshakes can be persisted in a file, such that creations captured before a restart can not be
+// replayed after it. It is safe for concurrent use.
+type replayCache struct {
+	lock      sync.Mutex
+	seen      map[[32]byte]time.Time // expiry by the digest of the handshake
+	nextPrune time.Time
+
+	// append-only log of the remembered handshakes, which is compacted whenever the cache is pruned. nil if the cache
+	// is not persisted.
+	file    *os.File
+	path    string
+	logger  *log.Logger
+	pending []byte // records of the handshakes not appended to the file yet, see flush
+
+	// serializes appending the pending records, which is done without holding lock. Taken before lock.
+	writeLock sync.Mutex
+}
+
+// replayRecordSize is the size of a handshake remembered in the replay file, consisting of the digest followed by its
+// expiry in nanoseconds since the epoch.
+const replayRecordSize = sha256.Size + 8
+
+func newReplayCache() *replayCache {
+	return &replayCache{
+		seen: make(map[[32]byte]time.Time),
+	}
+}
+
+// admit checks whether the given creation is neither outdated nor a replay at the given time and remembers its
+// handshake if so.
+func (c *replayCache) admit(msg *p2p.TunnelCreate, now time.Time, window time.Duration) bool {
+	expiry := now.Add(window)
+	if msg.HasTimestamp() {
+		created := time.Unix(int64(msg.Timestamp), 0)
+		if created.Before(now.Add(-window)) || created.After(now.Add(window)) {
+			return false
+		}
+		// creations dated in the future are accepted as well, thus they are remembered until outdated
+		if timestampBound(msg.Version) {
+			expiry = created.Add(window)
+		}
+	}
+
+	digest := handshakeDigest(msg)
+
+	c.lock.Lock()
+	c.prune(now, window)
+	if known, ok := c.seen[digest]; ok && now.Before(known) {
+		c.lock.Unlock()
+		return false
+	}
+	c.seen[digest] = expiry
+	if c.file != nil {
+		c.pending = appendReplayRecord(c.pending, digest, expiry)
+	}
+	c.lock.Unlock()
+
+	c.flush()
+	return true
+}
+
+// prune forgets the expired handshakes, sweeping the cache at most once per window.
+// Must be called with c.lock hold.
+func (c *replayCache) prune(now time.Time, window time.Duration) {
+	if now.Before(c.nextPrune) {
+		return
+	}
+	for digest, expiry := range c.seen {
+		if !now.Before(expiry) {
+			delete(c.seen, digest)
+		}
+	}
+	c.nextPrune = now.Add(window)
+
+	if c.path != "" {
+		err := c.compact()
+		if err != nil {
+			c.logger.Printf("Error compacting replay file: %v\n", err)
+		}
+	}
+}
+
+// open loads the handshakes remembered in the replay file at the given path, which is created if it does not exist
+// yet, and persists all further handshakes in it. Handshakes which expired at the given time are dropped.
+func (c *replayCache) open(path string, now time.Time, logger *log.Logger) (err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading replay file: %w", err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// a partially written record at the end is ignored
+	for ; len(data) >= replayRecordSize; data = data[replayRecordSize:] {
+		var digest [32]byte
+		copy(digest[:], data)
+		expiry := time.Unix(0, int64(binary.BigEndian.Uint64(data[sha256.Size:])))
+		if now.Before(expiry) {
+			c.seen[digest] = expiry
+		}
+	}
+
+	c.path = path
+	c.logger = logger
+	err = c.compact()
+	if err != nil {
+		return fmt.Errorf("error writing replay file: %w", err)
+	}
+	return nil
+}
+
+// compact rewrites the replay file with the currently remembered handshakes only and reopens it for appending.
+// Must be called with c.lock hold.
+func (c *replayCache) compact() (err error) {
+	if c.file != nil {
+		_ = c.file.Close()
+		c.file = nil
+	}
+
+	// the pending records are written along with all others
+	c.pending = nil
+	data := make([]byte, 0, len(c.seen)*replayRecordSize)
+	for digest, expiry := range c.seen {
+		data = appendReplayRecord(data, digest, expiry)
+	}
+	err = writeFileAtomic(c.path, data)
+	if err != nil {
+		return err
+	}
+
+	c.file, err = os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// flush appends the pending records to the replay file without holding c.lock, such that checking other creations is
+// not blocked by writing to the file. The records remembered by concurrent callers meanwhile are appended in a single
+// write by the next one. The file is not synced, since the operating system writes it out even if the process crashes.
+func (c *replayCache) flush() {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.lock.Lock()
+	file, pending := c.file, c.pending
+	c.pending = nil
+	c.lock.Unlock()
+	if file == nil || len(pending) == 0 {
+		return
+	}
+
+	// the file is closed if it was compacted meanwhile, which wrote the pending records already
+	_, err := file.Write(pending)
+	if err != nil && !errors.Is(err, os.ErrClosed) {
+		c.logger.Printf("Error persisting handshakes in replay file: %v\n", err)
+	}
+}
+
+// close appends the pending records to the replay file and closes it. Handshakes remembered afterwards are no longer
+// persisted.
+func (c *replayCache) close() (err error) {
+	c.flush()
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.path = ""
+	c.pending = nil
+	if c.file == nil {
+		return nil
+	}
+	err = c.file.Close()
+	c.file = nil
+	return err
+}
+
+// appendReplayRecord appends the record of a remembered handshake to buf, see replayRecordSize.
+func appendReplayRecord(buf []byte, digest [32]byte, expiry time.Time) []byte {
+	var nanos [8]byte
+	binary.BigEndian.PutUint64(nanos[:], uint64(expiry.UnixNano()))
+	buf = append(buf, digest[:]...)
+	return append(buf, nanos[:]...)
+}
+
+// timestampBound returns whether the timestamp of tunnel creations is bound to handshakes of the given version, see
+// generateDHKeys.
+func timestampBound(version uint8) bool {
+	return version == p2p.HandshakeVersionDHSized || version == p2p.HandshakeVersionDHOAEP
+}
+
+// handshakeDigest returns the digest identifying the handshake of a tunnel creation.
+func handshakeDigest(msg *p2p.TunnelCreate) [32]byte {
+	switch msg.Version {
+	case p2p.HandshakeVersionAuth:
+		return sha256.Sum256(msg.Handshake)
+	case p2p.HandshakeVersionResume:
+		return sha256.Sum256(msg.DHPubKey[:])
+	}
+	return sha256.Sum256(msg.EncDHPubKey[:])
+}
+
+// admitTunnelCreate checks an incoming p2p.TunnelCreate for replays, see replayCache. All creations are admitted if the
+// replay protection is disabled.
+func (r *Router) admitTunnelCreate(msg *p2p.TunnelCreate) bool {
+	if r.cfg == nil || r.cfg.ReplayWindow <= 0 {
+		return true
+	}
+	return r.replays.admit(msg, r.clock.Now(), time.Duration(r.cfg.ReplayWindow)*time.Second)
+}
+
+// loadReplays loads the handshakes remembered before the last shutdown from the configured replay file and persists
+// all further ones in it, see replayCache.
+func (r *Router) loadReplays() error {
+	if r.cfg == nil || r.cfg.ReplayWindow <= 0 || r.cfg.ReplayFile == "" {
+		return nil
+	}
+	return r.replays.open(r.cfg.ReplayFile, r.clock.Now(), r.logger)
+}
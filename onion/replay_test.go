@@ -0,0 +1,173 @@
+package onion
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+)
+
+func TestReplayCache(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	window := time.Minute
+
+	newCreate := func(b byte, timestamp time.Time) *p2p.TunnelCreate {
+		msg := &p2p.TunnelCreate{
+			Version:      p2p.HandshakeVersionDHOAEP,
+			Versions:     p2p.NewVersionSet(p2p.HandshakeVersionDHOAEP),
+			Capabilities: p2p.CapabilityTimestamp,
+			Timestamp:    uint32(timestamp.Unix()),
+			EncDHPubKey:  make([]byte, p2p.EncDHPubKeySize),
+		}
+		msg.EncDHPubKey[0] = b
+		return msg
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		c := newReplayCache()
+		assert.True(t, c.admit(newCreate(1, now), now, window))
+		assert.True(t, c.admit(newCreate(2, now), now, window))
+
+		// the handshake identifies the creation, altered timestamps are rejected when decrypting it
+		assert.False(t, c.admit(newCreate(1, now.Add(time.Second)), now.Add(time.Second), window))
+	})
+
+	t.Run("future", func(t *testing.T) {
+		c := newReplayCache()
+		created := now.Add(window / 2)
+		assert.True(t, c.admit(newCreate(1, created), now, window))
+
+		// remembered until the creation is outdated rather than for the window only
+		assert.False(t, c.admit(newCreate(1, created), now.Add(window+window/4), window))
+		assert.Equal(t, created.Add(window), c.seen[handshakeDigest(newCreate(1, created))])
+	})
+
+	t.Run("outdated", func(t *testing.T) {
+		c := newReplayCache()
+		assert.False(t, c.admit(newCreate(1, now.Add(-2*window)), now, window))
+		assert.False(t, c.admit(newCreate(1, now.Add(2*window)), now, window))
+		assert.True(t, c.admit(newCreate(1, now.Add(-window/2)), now, window))
+	})
+
+	t.Run("without timestamp", func(t *testing.T) {
+		c := newReplayCache()
+		msg := &p2p.TunnelCreate{Version: p2p.HandshakeVersionAuth, Handshake: []byte("hs1")}
+		assert.True(t, c.admit(msg, now, window))
+		assert.False(t, c.admit(msg, now.Add(window/2), window))
+
+		// forgotten after the window
+		later := now.Add(2 * window)
+		assert.True(t, c.admit(msg, later, window))
+		assert.Len(t, c.seen, 1)
+	})
+
+	t.Run("persisted", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "bawang-replay")
+		require.Nil(t, err)
+		defer os.RemoveAll(dir)
+		replayFile := filepath.Join(dir, "replay")
+		logger := log.New(ioutil.Discard, "", 0)
+
+		c := newReplayCache()
+		require.Nil(t, c.open(replayFile, now, logger))
+		assert.True(t, c.admit(newCreate(1, now), now, window))
+		assert.True(t, c.admit(newCreate(2, now), now, window))
+		require.Nil(t, c.close())
+
+		// a partially written record is ignored
+		f, err := os.OpenFile(replayFile, os.O_WRONLY|os.O_APPEND, 0600)
+		require.Nil(t, err)
+		_, err = f.Write([]byte{1, 2, 3})
+		require.Nil(t, err)
+		require.Nil(t, f.Close())
+
+		// the handshakes are remembered after a restart
+		c = newReplayCache()
+		require.Nil(t, c.open(replayFile, now.Add(time.Second), logger))
+		assert.False(t, c.admit(newCreate(1, now), now.Add(time.Second), window))
+		assert.False(t, c.admit(newCreate(2, now), now.Add(time.Second), window))
+		require.Nil(t, c.close())
+
+		// expired handshakes are dropped from the file
+		later := now.Add(2 * window)
+		c = newReplayCache()
+		require.Nil(t, c.open(replayFile, later, logger))
+		assert.Empty(t, c.seen)
+		info, err := os.Stat(replayFile)
+		require.Nil(t, err)
+		assert.Equal(t, int64(0), info.Size())
+
+		// the file is compacted when the cache is pruned
+		assert.True(t, c.admit(newCreate(3, later), later, window))
+		assert.True(t, c.admit(newCreate(4, later.Add(2*window)), later.Add(2*window), window))
+		info, err = os.Stat(replayFile)
+		require.Nil(t, err)
+		assert.Equal(t, int64(replayRecordSize), info.Size())
+		require.Nil(t, c.close())
+	})
+
+	t.Run("persisted concurrently", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "bawang-replay")
+		require.Nil(t, err)
+		defer os.RemoveAll(dir)
+		replayFile := filepath.Join(dir, "replay")
+		logger := log.New(ioutil.Discard, "", 0)
+
+		c := newReplayCache()
+		require.Nil(t, c.open(replayFile, now, logger))
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func(b byte) {
+				defer wg.Done()
+				assert.True(t, c.admit(newCreate(b, now), now, window))
+			}(byte(i))
+		}
+		wg.Wait()
+		require.Nil(t, c.close())
+
+		info, err := os.Stat(replayFile)
+		require.Nil(t, err)
+		assert.Equal(t, int64(100*replayRecordSize), info.Size())
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "bawang-replay")
+		require.Nil(t, err)
+		defer os.RemoveAll(dir)
+		replayFile := filepath.Join(dir, "replay")
+
+		cfg := &config.Config{ReplayWindow: 60, ReplayFile: replayFile}
+		router := newRouter(cfg, WithRPS(&mockRPS{}), WithClock(&fakeClock{now: now}))
+		require.Nil(t, router.loadReplays())
+		assert.True(t, router.admitTunnelCreate(newCreate(1, now)))
+
+		router.Shutdown()
+		router.replays.lock.Lock()
+		assert.Nil(t, router.replays.file)
+		router.replays.lock.Unlock()
+
+		// handshakes received after the shutdown are still checked, but no longer persisted
+		assert.False(t, router.admitTunnelCreate(newCreate(1, now)))
+		assert.True(t, router.admitTunnelCreate(newCreate(2, now)))
+		info, err := os.Stat(replayFile)
+		require.Nil(t, err)
+		assert.Equal(t, int64(replayRecordSize), info.Size())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+		msg := newCreate(1, time.Unix(0, 0))
+		assert.True(t, router.admitTunnelCreate(msg))
+		assert.True(t, router.admitTunnelCreate(msg))
+	})
+}
@@ -0,0 +1,119 @@
+package onion
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// RoundReport summarizes a round of the Router. It is logged at the end of each round and written to the configured
+// report file, see Config.ReportFile.
+type RoundReport struct {
+	Round   uint64    `json:"round"`
+	Started time.Time `json:"started"`
+	Ended   time.Time `json:"ended"`
+
+	// activity within the round
+	TunnelsBuilt   uint64 `json:"tunnels_built"`   // outgoing tunnels built, including the cover tunnels
+	TunnelsRebuilt uint64 `json:"tunnels_rebuilt"` // outgoing tunnels rebuilt at the round boundary
+	BuildFailures  uint64 `json:"build_failures"`  // failed tunnel builds, including the retried ones
+	CoverCells     uint64 `json:"cover_cells"`     // cover cells sent, see Router.SendCover
+	LinksOpened    uint64 `json:"links_opened"`
+	LinksClosed    uint64 `json:"links_closed"`
+
+	// state at the end of the round
+	OutgoingTunnels int `json:"outgoing_tunnels"`
+	IncomingTunnels int `json:"incoming_tunnels"`
+	Links           int `json:"links"`
+	BuildQueue      int `json:"build_queue"` // build jobs waiting for the next round
+	SendQueue       int `json:"send_queue"`  // messages waiting for their turn on the links
+}
+
+// roundCounter counts the activity of the current round. It is safe for concurrent use.
+type roundCounter struct {
+	lock   sync.Mutex
+	report RoundReport
+}
+
+// count updates the counts of the current round.
+func (c *roundCounter) count(update func(report *RoundReport)) {
+	c.lock.Lock()
+	update(&c.report)
+	c.lock.Unlock()
+}
+
+// finish returns the counts of the given round ending at the given time and starts counting the next one.
+func (c *roundCounter) finish(round uint64, now time.Time) (report RoundReport) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	report = c.report
+	report.Round = round
+	report.Ended = now
+	c.report = RoundReport{Started: now}
+	return report
+}
+
+// handleReportEvent counts the tunnels built and the links opened and closed in the current round.
+func (r *Router) handleReportEvent(ev Event) {
+	switch ev.Type {
+	case EventTunnelBuilt:
+		r.rounds.count(func(report *RoundReport) { report.TunnelsBuilt++ })
+	case EventLinkUp:
+		r.rounds.count(func(report *RoundReport) { report.LinksOpened++ })
+	case EventLinkDown:
+		r.rounds.count(func(report *RoundReport) { report.LinksClosed++ })
+	default: // other events are not reported
+	}
+}
+
+// finishRound returns the report of the round ending now, including the state of the Router at its end.
+func (r *Router) finishRound() (report RoundReport) {
+	report = r.rounds.finish(r.round, r.clock.Now())
+
+	r.tunnelsLock.RLock()
+	report.OutgoingTunnels = len(r.outgoingTunnels)
+	report.IncomingTunnels = len(r.incomingTunnels)
+	r.tunnelsLock.RUnlock()
+
+	r.linksLock.Lock()
+	report.Links = r.numLinks
+	for _, links := range r.links {
+		for _, link := range links {
+			report.SendQueue += link.writer.queued()
+		}
+	}
+	r.linksLock.Unlock()
+
+	r.buildQueueLock.Lock()
+	report.BuildQueue = len(r.buildQueue)
+	r.buildQueueLock.Unlock()
+
+	return report
+}
+
+// reportRound logs the report of the round ending now and writes it to the configured report file. Nothing is
+// reported before the first round.
+func (r *Router) reportRound() {
+	report := r.finishRound()
+	if report.Round == 0 {
+		return
+	}
+
+	r.logger.Printf("Round %d finished: built=%d rebuilt=%d failed=%d cover_cells=%d links_opened=%d links_closed=%d "+
+		"outgoing=%d incoming=%d links=%d build_queue=%d send_queue=%d\n",
+		report.Round, report.TunnelsBuilt, report.TunnelsRebuilt, report.BuildFailures, report.CoverCells,
+		report.LinksOpened, report.LinksClosed, report.OutgoingTunnels, report.IncomingTunnels, report.Links,
+		report.BuildQueue, report.SendQueue)
+
+	if r.cfg == nil || r.cfg.ReportFile == "" {
+		return
+	}
+	data, err := json.Marshal(&report)
+	if err == nil {
+		err = writeFileAtomic(r.cfg.ReportFile, data)
+	}
+	if err != nil {
+		r.logger.Printf("Error writing round report: %v\n", err)
+	}
+}
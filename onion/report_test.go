@@ -0,0 +1,66 @@
+package onion
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/rps"
+)
+
+func TestRouterReportRound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bawang-report")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	reportFile := filepath.Join(dir, "report.json")
+
+	clock := &fakeClock{now: time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)}
+	router := newRouter(&config.Config{ReportFile: reportFile}, WithRPS(&mockRPS{}), WithClock(clock))
+	var logs bytes.Buffer
+	router.logger = log.New(&logs, "", 0)
+
+	// nothing is reported before the first round
+	router.startRound()
+	assert.Empty(t, logs.String())
+	_, err = os.Stat(reportFile)
+	assert.True(t, os.IsNotExist(err))
+
+	router.events.publish(Event{Type: EventTunnelBuilt, TunnelID: 1})
+	router.events.publish(Event{Type: EventLinkUp, Address: net.ParseIP("10.0.0.1"), Port: 6602})
+	router.events.publish(Event{Type: EventLinkUp, Address: net.ParseIP("10.0.0.2"), Port: 6602})
+	router.events.publish(Event{Type: EventLinkDown, Address: net.ParseIP("10.0.0.1"), Port: 6602})
+	router.rounds.count(func(report *RoundReport) { report.BuildFailures++ })
+	router.queueBuildJob(&buildTunnelJob{targetPeer: &rps.Peer{}})
+	started := clock.now
+	clock.advance(time.Minute)
+
+	router.startRound()
+	assert.Equal(t, "Round 1 finished: built=1 rebuilt=0 failed=1 cover_cells=0 links_opened=2 links_closed=1 "+
+		"outgoing=0 incoming=0 links=0 build_queue=1 send_queue=0\n", logs.String())
+
+	data, err := ioutil.ReadFile(reportFile)
+	require.Nil(t, err)
+	report := RoundReport{}
+	require.Nil(t, json.Unmarshal(data, &report))
+	assert.Equal(t, uint64(1), report.Round)
+	assert.True(t, started.Equal(report.Started))
+	assert.True(t, clock.now.Equal(report.Ended))
+	assert.Equal(t, uint64(1), report.TunnelsBuilt)
+	assert.Equal(t, uint64(2), report.LinksOpened)
+	assert.Equal(t, 1, report.BuildQueue)
+
+	// the counts start over in each round
+	logs.Reset()
+	router.startRound()
+	assert.Contains(t, logs.String(), "Round 2 finished: built=0 rebuilt=0 failed=0")
+}
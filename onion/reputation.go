@@ -0,0 +1,222 @@
+package onion
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"bawang/errcode"
+	"bawang/rps"
+)
+
+// maxBanShift limits how often the ban duration is doubled for repeated offenses.
+const maxBanShift = 6
+
+// maxPathSamples is the number of times the hops of a tunnel are sampled before giving up, if banned peers are
+// sampled. If the network size is estimated, the number is derived from the share of banned peers, see pathSamples.
+const maxPathSamples = 3
+
+var (
+	// ErrBannedPeers is returned if only paths containing banned peers could be sampled for a tunnel.
+	ErrBannedPeers = errcode.New(errcode.ModuleOnion, errcode.NoPeers, true, "only banned peers sampled for the tunnel")
+)
+
+// Misbehavior is the kind of misbehavior a peer is banned for.
+type Misbehavior uint8
+
+const (
+	MisbehaviorProtocol Misbehavior = iota + 1 // the peer sent invalid messages or violated the protocol
+	MisbehaviorTimeout                         // the peer did not complete a handshake in time
+	MisbehaviorDigest                          // the peer sent a message with an invalid digest or key hash
+	MisbehaviorHostKey                         // the peer presented another host key than announced by the RPS module
+)
+
+func (m Misbehavior) String() string {
+	switch m {
+	case MisbehaviorProtocol:
+		return "protocol violation"
+	case MisbehaviorTimeout:
+		return "handshake timeout"
+	case MisbehaviorDigest:
+		return "digest failure"
+	case MisbehaviorHostKey:
+		return "host key mismatch"
+	default:
+		return "unknown misbehavior"
+	}
+}
+
+// BannedPeer is a peer which is temporarily excluded from path selection.
+type BannedPeer struct {
+	Address net.IP
+	Port    uint16
+	Reason  Misbehavior // last recorded misbehavior
+	Strikes int         // number of recorded misbehaviors
+	Until   time.Time   // time the ban expires
+}
+
+// reputation records misbehaving peers and bans them from path selection for some time.
+// Peers are identified by their P2P address, as a misbehaving peer could simply present another host key.
+// Repeated offenses double the ban duration. Peers are forgotten once their ban expired.
+type reputation struct {
+	lock  sync.Mutex
+	peers map[string]*BannedPeer
+}
+
+func newReputation() *reputation {
+	return &reputation{
+		peers: make(map[string]*BannedPeer),
+	}
+}
+
+// reputationKey returns the key a peer is tracked under.
+func reputationKey(address net.IP, port uint16) string {
+	return net.JoinHostPort(address.String(), strconv.Itoa(int(port)))
+}
+
+// record bans the given peer for the given misbehavior.
+func (rep *reputation) record(address net.IP, port uint16, reason Misbehavior, now time.Time,
+	duration time.Duration) (banned BannedPeer) {
+	rep.lock.Lock()
+	defer rep.lock.Unlock()
+
+	key := reputationKey(address, port)
+	peer, ok := rep.peers[key]
+	if !ok || !now.Before(peer.Until) {
+		peer = &BannedPeer{
+			Address: address,
+			Port:    port,
+		}
+		rep.peers[key] = peer
+	}
+
+	shift := peer.Strikes
+	if shift > maxBanShift {
+		shift = maxBanShift
+	}
+	peer.Strikes++
+	peer.Reason = reason
+	peer.Until = now.Add(duration << uint(shift))
+
+	return *peer
+}
+
+// banned checks whether the given peer is currently banned.
+func (rep *reputation) banned(address net.IP, port uint16, now time.Time) bool {
+	rep.lock.Lock()
+	defer rep.lock.Unlock()
+
+	peer, ok := rep.peers[reputationKey(address, port)]
+	return ok && now.Before(peer.Until)
+}
+
+// list returns all currently banned peers, the ones with the longest remaining ban first. Expired bans are removed.
+func (rep *reputation) list(now time.Time) (peers []BannedPeer) {
+	rep.lock.Lock()
+	defer rep.lock.Unlock()
+
+	peers = make([]BannedPeer, 0, len(rep.peers))
+	for key, peer := range rep.peers {
+		if !now.Before(peer.Until) {
+			delete(rep.peers, key)
+			continue
+		}
+		peers = append(peers, *peer)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Until.After(peers[j].Until)
+	})
+	return peers
+}
+
+// recordMisbehavior bans the given peer from path selection for the configured ban duration.
+func (r *Router) recordMisbehavior(peer *rps.Peer, reason Misbehavior) {
+	if r.cfg == nil || r.cfg.BanDuration == 0 {
+		return
+	}
+
+	banned := r.reputation.record(peer.Address, peer.Port, reason, r.clock.Now(),
+		time.Duration(r.cfg.BanDuration)*time.Second)
+	r.logger.Printf("Banning peer %v:%v until %v after %d strike(s): %v\n",
+		peer.Address, peer.Port, banned.Until.Format(time.RFC3339), banned.Strikes, reason)
+}
+
+// BannedPeers returns the peers which are currently excluded from path selection due to misbehavior.
+func (r *Router) BannedPeers() []BannedPeer {
+	return r.reputation.list(r.clock.Now())
+}
+
+// samplePath samples the hops of a new tunnel to the given target peer, such that no intermediate hop is banned or one
+// of the peers to avoid, e.g. the intermediate hops of the other circuit of a multipath tunnel.
+// Paths through peers which are likely dead are avoided as well, but used if no other path could be sampled, since the
+// liveness of the peers is only a hint.
+// With Config.LoadAwarePaths, the path whose intermediate hops announced the least load is picked among the sampled
+// ones, while a path of idle hops or hops without a recent load is taken right away.
+func (r *Router) samplePath(targetPeer *rps.Peer, avoid []*rps.Peer) (hops []*rps.Peer, err error) {
+	return r.samplePathOfLength(targetPeer, r.cfg.TunnelLength, avoid)
+}
+
+// samplePathOfLength is like samplePath, but samples a path of the given number of hops instead of the configured
+// tunnel length, e.g. for cover tunnels.
+func (r *Router) samplePathOfLength(targetPeer *rps.Peer, length int, avoid []*rps.Peer) (hops []*rps.Peer,
+	err error) {
+	var fallback, best []*rps.Peer
+	bestLoad := 0
+	overlapping := false
+	samples := r.pathSamples()
+	for i := 0; i < samples; i++ {
+		hops, err = r.rps.SampleIntermediatePeers(length, targetPeer)
+		if err != nil {
+			return nil, err
+		}
+
+		intermediateHops := hops[:len(hops)-1]
+		if r.containsBannedPeer(intermediateHops) {
+			continue
+		}
+		if containsPeer(intermediateHops, avoid) {
+			overlapping = true
+			continue
+		}
+		if r.containsDeadPeer(intermediateHops) {
+			if fallback == nil {
+				fallback = hops
+			}
+			continue
+		}
+		if !r.cfg.LoadAwarePaths {
+			return hops, nil
+		}
+		if load := r.pathLoad(intermediateHops); best == nil || load < bestLoad {
+			if load == 0 {
+				return hops, nil
+			}
+			best, bestLoad = hops, load
+		}
+	}
+
+	if best != nil {
+		return best, nil
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	if overlapping {
+		return nil, ErrNoDisjointPath
+	}
+	return nil, ErrBannedPeers
+}
+
+// containsBannedPeer checks whether any of the given peers is currently banned.
+func (r *Router) containsBannedPeer(peers []*rps.Peer) bool {
+	now := r.clock.Now()
+	for _, peer := range peers {
+		if r.reputation.banned(peer.Address, peer.Port, now) {
+			return true
+		}
+	}
+	return false
+}
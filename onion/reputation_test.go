@@ -0,0 +1,94 @@
+package onion
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/rps"
+)
+
+func TestRouterReputation(t *testing.T) {
+	peerA := &rps.Peer{Address: net.ParseIP("10.0.0.1"), Port: 1}
+	peerB := &rps.Peer{Address: net.ParseIP("10.0.0.2"), Port: 1}
+	peerC := &rps.Peer{Address: net.ParseIP("10.0.0.3"), Port: 1}
+	target := &rps.Peer{Address: net.ParseIP("10.0.0.4"), Port: 1}
+
+	t.Run("ban and expire", func(t *testing.T) {
+		clock := &fakeClock{now: time.Now()}
+		router := newRouter(&config.Config{BanDuration: 60}, WithRPS(&mockRPS{}), WithClock(clock))
+
+		router.recordMisbehavior(peerA, MisbehaviorTimeout)
+		banned := router.BannedPeers()
+		require.Len(t, banned, 1)
+		assert.Equal(t, MisbehaviorTimeout, banned[0].Reason)
+		assert.Equal(t, 1, banned[0].Strikes)
+		assert.Equal(t, clock.Now().Add(time.Minute), banned[0].Until)
+
+		// repeated offenses double the ban duration
+		router.recordMisbehavior(peerA, MisbehaviorDigest)
+		router.recordMisbehavior(peerB, MisbehaviorProtocol)
+		banned = router.BannedPeers()
+		require.Len(t, banned, 2)
+		assert.True(t, peerA.Address.Equal(banned[0].Address))
+		assert.Equal(t, MisbehaviorDigest, banned[0].Reason)
+		assert.Equal(t, 2, banned[0].Strikes)
+		assert.Equal(t, clock.Now().Add(2*time.Minute), banned[0].Until)
+
+		clock.advance(time.Minute)
+		banned = router.BannedPeers()
+		require.Len(t, banned, 1)
+		assert.True(t, peerA.Address.Equal(banned[0].Address))
+
+		// the strikes are forgotten once the ban expired
+		clock.advance(time.Minute)
+		assert.Empty(t, router.BannedPeers())
+		router.recordMisbehavior(peerA, MisbehaviorTimeout)
+		assert.Equal(t, 1, router.BannedPeers()[0].Strikes)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+		router.recordMisbehavior(peerA, MisbehaviorTimeout)
+		assert.Empty(t, router.BannedPeers())
+	})
+
+	t.Run("path selection", func(t *testing.T) {
+		peers := &mockRPS{peers: []*rps.Peer{peerA, peerB, peerB, peerC}}
+		router := newRouter(&config.Config{BanDuration: 60, TunnelLength: 3}, WithRPS(peers))
+		router.recordMisbehavior(peerA, MisbehaviorTimeout)
+
+		// paths containing banned peers are sampled again
+		hops, err := router.samplePath(target, nil)
+		require.Nil(t, err)
+		assert.Equal(t, []*rps.Peer{peerB, peerC, target}, hops)
+
+		// banned targets requested by clients are not rejected
+		router.recordMisbehavior(target, MisbehaviorTimeout)
+		peers.peers = []*rps.Peer{peerB, peerC}
+		_, err = router.samplePath(target, nil)
+		require.Nil(t, err)
+
+		peers.peers = []*rps.Peer{peerA, peerB, peerA, peerB, peerA, peerB}
+		_, err = router.samplePath(target, nil)
+		assert.Equal(t, ErrBannedPeers, err)
+	})
+
+	t.Run("disjoint path selection", func(t *testing.T) {
+		peers := &mockRPS{peers: []*rps.Peer{peerA, peerB, peerB, peerC}}
+		router := newRouter(&config.Config{TunnelLength: 3}, WithRPS(peers))
+
+		// paths sharing intermediate hops with the other circuit are sampled again
+		hops, err := router.samplePath(target, []*rps.Peer{peerA})
+		require.Nil(t, err)
+		assert.Equal(t, []*rps.Peer{peerB, peerC, target}, hops)
+
+		peers.peers = []*rps.Peer{peerA, peerB, peerC, peerA, peerA, peerC}
+		_, err = router.samplePath(target, []*rps.Peer{peerA})
+		assert.Equal(t, ErrNoDisjointPath, err)
+	})
+}
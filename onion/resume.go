@@ -0,0 +1,190 @@
+package onion
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"bawang/p2p"
+	"bawang/rps"
+)
+
+// resumption is the secret to resume a session established by the built-in handshake with a handshake of
+// p2p.HandshakeVersionResume, identified by its ticket. Both are derived from the session key by the tunnel initiator
+// and the hop, such that the ticket never needs to be sent before it is redeemed.
+type resumption struct {
+	ticket  [p2p.TicketSize]byte
+	secret  [32]byte
+	expiry  time.Time
+	hostKey *rsa.PublicKey // of the hop, only known to the initiator
+}
+
+// newResumption derives the resumption of the session with the given key, which expires at the given time. Both the
+// ticket and the secret are hashes of the key, thus neither reveals the key nor the traffic of the session.
+func newResumption(key *[32]byte, expiry time.Time) *resumption {
+	res := &resumption{
+		secret: labeledHash("bawang resumption secret", key[:]),
+		expiry: expiry,
+	}
+	ticket := labeledHash("bawang resumption ticket", key[:])
+	copy(res.ticket[:], ticket[:])
+	return res
+}
+
+// resumedKey derives the key of a resumed session from the secret of the resumed one and the Diffie-Hellman key shared
+// in the resumed handshake. Only the hop holding the secret can derive it, while the fresh key exchange keeps the
+// resumed session secret even if the secret leaks later on.
+func resumedKey(secret, shared *[32]byte) [32]byte {
+	return labeledHash("bawang resumed session", secret[:], shared[:])
+}
+
+// labeledHash returns the SHA-256 hash of the given label followed by the data, such that keys derived from the same
+// data for different purposes are independent.
+func labeledHash(label string, data ...[]byte) (sum [32]byte) {
+	h := sha256.New()
+	_, _ = h.Write([]byte(label))
+	for _, d := range data {
+		_, _ = h.Write(d)
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// ticketCache remembers the sessions of recent tunnel creations at the hop, such that their initiators can resume them
+// when rebuilding their tunnels without another RSA decryption, see handleTunnelCreate. Each ticket is only redeemed
+// once, thus replayed resumptions are asked to retry with a full handshake. It is safe for concurrent use.
+type ticketCache struct {
+	lock      sync.Mutex
+	clock     Clock
+	lifetime  time.Duration
+	secrets   map[[p2p.TicketSize]byte]*resumption
+	nextPrune time.Time
+}
+
+func newTicketCache(clock Clock, lifetime time.Duration) *ticketCache {
+	return &ticketCache{
+		clock:    clock,
+		lifetime: lifetime,
+		secrets:  make(map[[p2p.TicketSize]byte]*resumption),
+	}
+}
+
+// issue remembers the session with the given key for the lifetime of the cache.
+func (c *ticketCache) issue(key *[32]byte) {
+	now := c.clock.Now()
+	res := newResumption(key, now.Add(c.lifetime))
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.prune(now)
+	c.secrets[res.ticket] = res
+}
+
+// redeem returns the secret of the session with the given ticket and forgets it, or nil if the ticket is unknown or
+// expired. The secret must be wiped once the resumed session is established.
+func (c *ticketCache) redeem(ticket *[p2p.TicketSize]byte) (secret *[32]byte) {
+	now := c.clock.Now()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	res, ok := c.secrets[*ticket]
+	if !ok {
+		return nil
+	}
+	delete(c.secrets, *ticket)
+	if !now.Before(res.expiry) {
+		wipe(res.secret[:])
+		return nil
+	}
+	return &res.secret
+}
+
+// prune forgets the expired sessions, sweeping the cache at most once per lifetime.
+// Must be called with c.lock hold.
+func (c *ticketCache) prune(now time.Time) {
+	if now.Before(c.nextPrune) {
+		return
+	}
+	for ticket, res := range c.secrets {
+		if !now.Before(res.expiry) {
+			wipe(res.secret[:])
+			delete(c.secrets, ticket)
+		}
+	}
+	c.nextPrune = now.Add(c.lifetime)
+}
+
+// resumeKey identifies the session with a hop of a tunnel which may be resumed when the tunnel is rebuilt. Sessions
+// are never resumed for other tunnels, such that hops can not link the tunnels of the same initiator by their tickets.
+type resumeKey struct {
+	tunnelID uint32
+	hop      linkKey
+}
+
+// resumptionCache remembers the sessions with the hops of our tunnels which issued a ticket, see ticketCache. The zero
+// value is an empty cache ready to use. It is safe for concurrent use.
+type resumptionCache struct {
+	lock    sync.Mutex
+	entries map[resumeKey]*resumption
+}
+
+// store remembers the session with the given hop of a tunnel, replacing a previous one. Expired sessions are forgotten
+// at the given time.
+func (c *resumptionCache) store(key resumeKey, res *resumption, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[resumeKey]*resumption)
+	}
+	for k, old := range c.entries {
+		if k == key || !now.Before(old.expiry) {
+			wipe(old.secret[:])
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = res
+}
+
+// take returns the session with the given hop of a tunnel and forgets it, since the hop redeems each ticket only once.
+// nil is returned if there is none, it expired at the given time or the hop now holds another host key.
+func (c *resumptionCache) take(key resumeKey, hostKey *rsa.PublicKey, now time.Time) *resumption {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	res, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	delete(c.entries, key)
+	if !now.Before(res.expiry) || !sameHostKey(res.hostKey, hostKey) {
+		wipe(res.secret[:])
+		return nil
+	}
+	return res
+}
+
+// storeResumption remembers the session established with the given hop of the tunnel with the given ID, after the hop
+// issued a ticket for it. Nothing is remembered if resumption is disabled, see Config.ResumeLifetime.
+func (r *Router) storeResumption(tunnelID uint32, hop *rps.Peer, key *[32]byte) {
+	if r.cfg == nil || r.cfg.ResumeLifetime <= 0 {
+		return
+	}
+	now := r.clock.Now()
+	res := newResumption(key, now.Add(time.Duration(r.cfg.ResumeLifetime)*time.Second))
+	res.hostKey = hop.HostKey
+	r.resumptions.store(resumeKey{tunnelID: tunnelID, hop: newLinkKey(hop.Address, hop.Port)}, res, now)
+}
+
+// takeResumption returns the session with the given hop of the tunnel with the given ID to resume when rebuilding it,
+// or nil if there is none.
+func (r *Router) takeResumption(tunnelID uint32, hop *rps.Peer) *resumption {
+	if r.cfg == nil || r.cfg.ResumeLifetime <= 0 {
+		return nil
+	}
+	key := resumeKey{tunnelID: tunnelID, hop: newLinkKey(hop.Address, hop.Port)}
+	return r.resumptions.take(key, hop.HostKey, r.clock.Now())
+}
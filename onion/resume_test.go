@@ -0,0 +1,170 @@
+package onion
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+	"bawang/rps"
+)
+
+func TestTicketCache(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000000, 0)}
+	c := newTicketCache(clock, time.Minute)
+
+	key := [32]byte{1, 2, 3}
+	c.issue(&key)
+	res := newResumption(&key, time.Time{})
+
+	// the ticket is derived from the key, but does not reveal it
+	assert.NotEqual(t, key[:p2p.TicketSize], res.ticket[:])
+	assert.NotEqual(t, key, res.secret)
+
+	secret := c.redeem(&res.ticket)
+	require.NotNil(t, secret)
+	assert.Equal(t, res.secret, *secret)
+
+	// tickets are only redeemed once
+	assert.Nil(t, c.redeem(&res.ticket))
+
+	// and expire after the lifetime
+	c.issue(&key)
+	clock.advance(time.Minute)
+	assert.Nil(t, c.redeem(&res.ticket))
+
+	c.issue(&key)
+	clock.advance(2 * time.Minute)
+	c.issue(&[32]byte{4, 5, 6})
+	assert.Len(t, c.secrets, 1, "expired tickets must be pruned")
+}
+
+func TestResumptionCache(t *testing.T) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	hop := &rps.Peer{Address: net.IPv4(1, 2, 3, 4), Port: 1, HostKey: &hostKey.PublicKey}
+
+	clock := &fakeClock{now: time.Unix(1000000, 0)}
+	router := newRouter(&config.Config{ResumeLifetime: 60}, WithRPS(&mockRPS{}), WithClock(clock))
+
+	key := [32]byte{1, 2, 3}
+	router.storeResumption(42, hop, &key)
+	assert.Nil(t, router.takeResumption(43, hop), "sessions must not be resumed for other tunnels")
+	res := router.takeResumption(42, hop)
+	require.NotNil(t, res)
+	assert.Equal(t, newResumption(&key, time.Time{}).ticket, res.ticket)
+	assert.Nil(t, router.takeResumption(42, hop), "sessions must only be resumed once")
+
+	router.storeResumption(42, hop, &key)
+	assert.Nil(t, router.takeResumption(42, &rps.Peer{Address: hop.Address, Port: hop.Port,
+		HostKey: &otherKey.PublicKey}), "sessions must not be resumed with another host key")
+
+	router.storeResumption(42, hop, &key)
+	clock.advance(time.Minute)
+	assert.Nil(t, router.takeResumption(42, hop))
+
+	// nothing is remembered if resumption is disabled
+	router = newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+	router.storeResumption(42, hop, &key)
+	assert.Nil(t, router.takeResumption(42, hop))
+}
+
+func TestHandshakeResumption(t *testing.T) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	require.Nil(t, err)
+	hop := &rps.Peer{Address: net.IPv4(1, 2, 3, 4), Port: 1, HostKey: &hostKey.PublicKey}
+	hopCfg := &config.Config{HostKey: hostKey}
+
+	clock := &fakeClock{now: time.Unix(1000000, 0)}
+	router := newRouter(&config.Config{ResumeLifetime: 60}, WithRPS(&mockRPS{}), WithClock(clock))
+	tickets := newTicketCache(clock, time.Minute)
+
+	// handshake performs a handshake with the hop, relaying the messages in extend messages, and returns the sessions
+	// of both ends and the versions of the creations
+	handshake := func(cfg *config.Config, resume bool) (s, hopSession *session, versions []uint8, err error) {
+		s, err = router.handshake(hop, 42, resume, func(createMsg *p2p.TunnelCreate) (*p2p.TunnelCreated, error) {
+			versions = append(versions, createMsg.Version)
+			extendMsg := relayTunnelExtendMsgFromTunnelCreateMsg(createMsg, hop.Address, hop.Port)
+			forwardedCreateMsg := tunnelCreateMsgFromRelayTunnelExtendMsg(&extendMsg)
+			var createdMsg *p2p.TunnelCreated
+			hopSession, createdMsg, err = handleTunnelCreate(rand.Reader, &forwardedCreateMsg, cfg, nil, tickets)
+			if err != nil {
+				return nil, err
+			}
+			extendedMsg := relayTunnelExtendedMsgFromTunnelCreatedMsg(createdMsg)
+			forwardedCreatedMsg := tunnelCreatedMsgFromRelayTunnelExtendedMsg(&extendedMsg)
+			return &forwardedCreatedMsg, nil
+		})
+		return s, hopSession, versions, err
+	}
+
+	s, hopSession, versions, err := handshake(hopCfg, true)
+	require.Nil(t, err)
+	assert.Equal(t, []uint8{p2p.HandshakeVersionDHOAEP}, versions)
+	assert.True(t, s.resumable)
+
+	t.Run("resume", func(t *testing.T) {
+		// the hop does not decrypt anything with its host key
+		resumed, hopResumed, versions, err := handshake(&config.Config{}, true)
+		require.Nil(t, err)
+		assert.Equal(t, []uint8{p2p.HandshakeVersionResume}, versions)
+		assert.Equal(t, hopResumed.key, resumed.key)
+		assert.NotEqual(t, s.key, resumed.key)
+		assert.NotEqual(t, hopSession.key, hopResumed.key)
+		assert.True(t, resumed.resumable, "the resumed session must be resumable again")
+
+		// the layers of encryption match
+		encMsg, err := resumed.cipher.seal(make([]byte, p2p.MaxRelayDataSize))
+		require.Nil(t, err)
+		_, err = hopResumed.cipher.decrypt(encMsg)
+		assert.Nil(t, err)
+	})
+
+	t.Run("not resumed", func(t *testing.T) {
+		// through hops not extending resumed handshakes
+		_, _, versions, err := handshake(hopCfg, false)
+		require.Nil(t, err)
+		assert.Equal(t, []uint8{p2p.HandshakeVersionDHOAEP}, versions)
+	})
+
+	t.Run("forgotten ticket", func(t *testing.T) {
+		tickets = newTicketCache(clock, time.Minute)
+		_, _, versions, err := handshake(hopCfg, true)
+		require.Nil(t, err)
+		assert.Equal(t, []uint8{p2p.HandshakeVersionResume, p2p.HandshakeVersionDHOAEP}, versions)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		tickets = nil
+		_, _, versions, err := handshake(hopCfg, true)
+		require.Nil(t, err)
+		assert.Equal(t, []uint8{p2p.HandshakeVersionResume, p2p.HandshakeVersionDHOAEP}, versions)
+
+		// hops not issuing tickets are not resumed
+		s, _, versions, err := handshake(hopCfg, true)
+		require.Nil(t, err)
+		assert.Equal(t, []uint8{p2p.HandshakeVersionDHOAEP}, versions)
+		assert.False(t, s.resumable)
+	})
+
+	t.Run("wrong secret", func(t *testing.T) {
+		tickets = newTicketCache(clock, time.Minute)
+		_, _, _, err := handshake(hopCfg, true)
+		require.Nil(t, err)
+
+		// the hop can not derive the key without the secret of the resumed session
+		for _, res := range tickets.secrets {
+			res.secret[0] ^= 0xff
+		}
+		_, _, _, err = handshake(hopCfg, true)
+		assert.Equal(t, ErrMisbehavingPeer, err)
+	})
+}
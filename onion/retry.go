@@ -0,0 +1,90 @@
+package onion
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"bawang/errcode"
+)
+
+// hopFailureCounter counts the failed tunnel builds by the position of the hop which could not be reached, see
+// Stats.HopFailures. It is safe for concurrent use.
+type hopFailureCounter struct {
+	lock    sync.Mutex
+	counts  map[int]uint64
+	retries uint64 // builds retried through another path, see buildWithRetries
+}
+
+// add counts a build failing at the hop with the given position, 0 being the first hop.
+func (c *hopFailureCounter) add(position int) {
+	c.lock.Lock()
+	if c.counts == nil {
+		c.counts = make(map[int]uint64)
+	}
+	c.counts[position]++
+	c.lock.Unlock()
+}
+
+// retried counts a retried build.
+func (c *hopFailureCounter) retried() {
+	c.lock.Lock()
+	c.retries++
+	c.lock.Unlock()
+}
+
+// snapshot returns a copy of the counts, nil if no failures were counted yet, and the number of retried builds.
+func (c *hopFailureCounter) snapshot() (counts map[int]uint64, retries uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.counts) > 0 {
+		counts = make(map[int]uint64, len(c.counts))
+		for position, n := range c.counts {
+			counts[position] = n
+		}
+	}
+	return counts, c.retries
+}
+
+// retryableBuild checks whether a failed build may succeed through another path. Builds rejected by our own limits or
+// through hops pinned by the client would fail alike. Unlike errcode.IsRetryable, any network error is worth a retry,
+// e.g. a refused connection to a dead hop.
+func retryableBuild(buildJob *buildTunnelJob, err error) bool {
+	if buildJob.pinned != nil || err == ErrTooManyTunnels {
+		return false
+	}
+	var apiErr *errcode.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable
+	}
+	return true
+}
+
+// buildWithRetries builds the tunnel requested by the given job. If the build fails, it is retried up to
+// Config.BuildRetries times through newly sampled paths, waiting Config.BuildBackoff before the first retry and twice
+// as long before each further one. Retries which would start after the deadline, i.e. the end of the round, are not
+// attempted anymore. Returns the error of the last attempt if all of them failed.
+func (r *Router) buildWithRetries(buildJob *buildTunnelJob, deadline time.Time, quit chan struct{}) (tunnel *Tunnel,
+	err error) {
+	backoff := time.Duration(r.cfg.BuildBackoff) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		tunnel, err = r.buildNewTunnel(buildJob.targetPeer, buildJob.pinned, buildJob.client)
+		if err == nil || attempt >= r.cfg.BuildRetries || !retryableBuild(buildJob, err) {
+			return tunnel, err
+		}
+		if r.clock.Now().Add(backoff).After(deadline) {
+			return nil, err
+		}
+
+		r.logger.Printf("Retrying build of tunnel to %v:%v in %v after error: %v\n", buildJob.targetPeer.Address,
+			buildJob.targetPeer.Port, backoff, err)
+		r.hopFailures.retried()
+		select {
+		case <-quit:
+			return nil, err
+		case <-r.clock.After(backoff):
+		}
+		backoff *= 2
+	}
+}
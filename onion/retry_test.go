@@ -0,0 +1,102 @@
+package onion
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/rps"
+)
+
+// refusingTransport is a Transport whose peers refuse all connections.
+type refusingTransport struct {
+	lock   sync.Mutex
+	dialed []string
+}
+
+func (t *refusingTransport) DialPeer(address net.IP, port uint16) (net.Conn, error) {
+	t.lock.Lock()
+	t.dialed = append(t.dialed, net.JoinHostPort(address.String(), strconv.Itoa(int(port))))
+	t.lock.Unlock()
+	return nil, errors.New("connection refused")
+}
+
+func (t *refusingTransport) Listen(address string) (net.Listener, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestRetryableBuild(t *testing.T) {
+	job := &buildTunnelJob{}
+	assert.True(t, retryableBuild(job, errors.New("connection refused")))
+	assert.True(t, retryableBuild(job, ErrTimedOut))
+	assert.True(t, retryableBuild(job, ErrExtendRefused))
+	assert.False(t, retryableBuild(job, ErrNotEnoughHops))
+	assert.False(t, retryableBuild(job, ErrTooManyTunnels))
+
+	pinned := &buildTunnelJob{pinned: []*rps.Peer{{}, {}}}
+	assert.False(t, retryableBuild(pinned, ErrTimedOut))
+}
+
+func TestRouterBuildWithRetries(t *testing.T) {
+	newPeers := func(n int) []*rps.Peer {
+		peers := make([]*rps.Peer, n)
+		for i := range peers {
+			peers[i] = &rps.Peer{Address: net.IPv4(10, 0, 0, byte(i+1)), Port: 6602}
+		}
+		return peers
+	}
+	target := &rps.Peer{Address: net.IPv4(10, 0, 1, 1), Port: 6602}
+
+	t.Run("retries", func(t *testing.T) {
+		clock := &instantClock{fakeClock: fakeClock{now: time.Now()}}
+		transport := &refusingTransport{}
+		cfg := &config.Config{TunnelLength: 3, BuildTimeout: 1, RoundDuration: 60, BuildRetries: 2, BuildBackoff: 500}
+		router := newRouter(cfg, WithRPS(&mockRPS{peers: newPeers(6)}), WithClock(clock), WithTransport(transport))
+
+		replyChan := router.BuildTunnel(target, &ClientFuncs{})
+		assert.Equal(t, 0, router.handleBuildTunnelJobs(nil))
+		reply := <-replyChan
+		require.NotNil(t, reply.Err)
+
+		// each attempt went through another path
+		assert.Equal(t, []string{"10.0.0.1:6602", "10.0.0.3:6602", "10.0.0.5:6602"}, transport.dialed)
+		assert.Equal(t, []time.Duration{500 * time.Millisecond, time.Second}, clock.waited)
+
+		stats := router.Stats()
+		assert.Equal(t, uint64(2), stats.BuildRetries)
+		assert.Equal(t, map[int]uint64{0: 3}, stats.HopFailures)
+	})
+
+	t.Run("end of round", func(t *testing.T) {
+		clock := &instantClock{fakeClock: fakeClock{now: time.Now()}}
+		transport := &refusingTransport{}
+		cfg := &config.Config{TunnelLength: 3, BuildTimeout: 1, RoundDuration: 1, BuildRetries: 5, BuildBackoff: 600}
+		router := newRouter(cfg, WithRPS(&mockRPS{peers: newPeers(12)}), WithClock(clock), WithTransport(transport))
+
+		replyChan := router.BuildTunnel(target, &ClientFuncs{})
+		router.handleBuildTunnelJobs(nil)
+		require.NotNil(t, (<-replyChan).Err)
+
+		// the second retry would start after the round
+		assert.Len(t, transport.dialed, 2)
+		assert.Equal(t, []time.Duration{600 * time.Millisecond}, clock.waited)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		transport := &refusingTransport{}
+		cfg := &config.Config{TunnelLength: 3, BuildTimeout: 1, RoundDuration: 60}
+		router := newRouter(cfg, WithRPS(&mockRPS{peers: newPeers(6)}), WithTransport(transport))
+
+		replyChan := router.BuildTunnel(target, &ClientFuncs{})
+		router.handleBuildTunnelJobs(nil)
+		require.NotNil(t, (<-replyChan).Err)
+		assert.Len(t, transport.dialed, 1)
+	})
+}
@@ -2,147 +2,445 @@
 package onion
 
 import (
-	"bytes"
-	"crypto/sha256"
+	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	mathRand "math/rand"
 	"net"
-	"strings"
+	"os"
+	"sort"
 	"sync"
 	"time"
 
-	"golang.org/x/crypto/nacl/box"
-
-	"bawang/api"
+	"bawang/auth"
 	"bawang/config"
+	"bawang/errcode"
+	"bawang/gossip"
+	"bawang/health"
+	"bawang/nse"
 	"bawang/p2p"
 	"bawang/rps"
+	"bawang/supervisor"
+	"bawang/trace"
 )
 
 var (
-	ErrSendCoverNotAllowed = errors.New("manually created tunnels already exists, send cover is not allowed")
+	// errTunnelDestroyed is returned by handleIncomingTunnelRelayMsg if the tunnel initiator tore down the tunnel.
+	errTunnelDestroyed = errcode.New(errcode.ModuleOnion, errcode.InvalidTunnel, false, "tunnel destroyed by initiator")
+
+	ErrSendCoverNotAllowed = errcode.New(errcode.ModuleOnion, errcode.NotAllowed, false,
+		"manually created tunnels already exists, send cover is not allowed")
+	ErrTooManyTunnels = errcode.New(errcode.ModuleOnion, errcode.Limit, true,
+		"max. number of concurrent tunnels reached")
+	ErrTooManyLinks = errcode.New(errcode.ModuleOnion, errcode.Limit, true,
+		"max. number of concurrent links reached")
 )
 
 // Router is the central onion routing logic state tracking struct.
-// It tracks existing Link references, connected API clients with respective api.Connection objects
+// It tracks existing Link references, registered clients (e.g. connections on the API socket)
 // and all currently open outgoing and incoming tunnels.
 type Router struct {
-	cfg *config.Config
-	rps rps.RPS
-
-	linksLock sync.Mutex
-	links     []*Link
-
-	tunnelsLock sync.Mutex // guards tunnels, outgoingTunnels and incomingTunnels
-	// maps which API connections listen on which tunnels in addition to keeping track of existing tunnels
-	tunnels         map[uint32][]*api.Connection
+	cfg       *config.Config
+	rps       rps.RPS
+	logger    *log.Logger
+	clock     Clock
+	rand      io.Reader // source of all randomness except for the transport, see WithRand
+	transport Transport
+	auth      auth.Client   // performs the handshakes and layer encryption if the Onion Auth module is configured
+	nse       nse.NSE       // estimates the network size if the NSE module is configured
+	gossip    gossip.Gossip // announces our liveness and learns about other peers if the Gossip module is configured
+
+	linksLock    sync.Mutex          // guards links, numLinks, numIncoming, circuitLinks and idleLinks
+	links        map[linkKey][]*Link // open links by the peer at the other end, multiple ones if full, see GetLink
+	numLinks     int
+	numIncoming  int                // number of open links accepted from other peers, see admitIncomingLink
+	circuitLinks map[uint32]*Link   // links by the IDs of the circuits registered with them
+	idleLinks    map[*Link]struct{} // links not used by any circuit anymore, see closeIdleLinks
+	linkIdentity uint64             // announced to adjacent peers to detect duplicate links, see identifyLink
+
+	// guards tunnels, circuits, outgoingTunnels, incomingTunnels, loopbacks, streams, migrations, numSegments and
+	// numBuilding.
+	// The lock is only held for short lookups and updates, never while waiting for other peers, such that data on one
+	// tunnel is not blocked by building another one. Lookups on the data path only take the read lock.
+	tunnelsLock sync.RWMutex
+	// maps which clients listen on which tunnels in addition to keeping track of existing tunnels.
+	// Tunnels are known to the clients by IDs unrelated to the IDs of the circuits carrying them on the links, such that
+	// the clients neither learn anything about the topology nor notice when a tunnel is rebuilt.
+	tunnels         map[uint32][]Client
+	circuits        map[uint32]struct{} // IDs of the circuits registered on our links
 	outgoingTunnels map[uint32]*Tunnel
 	incomingTunnels map[uint32]*tunnelSegment
+	loopbacks       map[uint32]uint32          // other end of each loopback tunnel by the ID of either end
+	streams         map[uint64]*reliableStream // streams received on incoming tunnels by their ID
+	migrations      map[uint64]*migration      // handovers of incoming tunnels to rebuilt circuits by their token
+	numSegments     int                        // number of running tunnel segment handlers, used for admission control
+	numBuilding     int                        // number of outgoing tunnels being built, see admitTunnel
 
 	buildQueueLock sync.Mutex
 	buildQueue     []*buildTunnelJob
 
-	coverTunnel *Tunnel
+	coverTunnels []uint32 // IDs of the outgoing tunnels used for cover traffic, see buildCoverTunnels
+
+	// goroutines handling the outgoing circuits, see startTunnelHandler
+	handlers *tunnelHandlers
+
+	events *eventBus
+	round  uint64
+
+	// starts the next round before the round timer fires, see TriggerRound
+	roundTrigger chan struct{}
+
+	// health of the P2P listener and the round logic, see CheckListener and CheckRounds
+	listening      health.Flag
+	roundCompleted health.Flag
+
+	// reachability checks waiting for their results and whether the last one found us unreachable (accessed
+	// atomically), see CheckReachabilityOnStart
+	reachChecks reachChecks
+	unreachable int32
+
+	logLock   sync.Mutex // guards logOutput
+	logOutput io.Writer  // output of the logger while it is muted, nil if logging is enabled, see SetLogging
+
+	reputation *reputation  // misbehaving peers excluded from path selection
+	liveness   *liveness    // descriptors announced by other peers via the Gossip module, avoided in path selection if outdated
+	replays    *replayCache // handshakes of recent incoming tunnel creations, see admitTunnelCreate
+
+	tickets     *ticketCache    // sessions of incoming tunnels which may be resumed, nil if disabled
+	resumptions resumptionCache // sessions with the hops of our tunnels which may be resumed, see Router.handshake
+
+	errorCounts errorCounter      // errors encountered by their code, see logError
+	hopFailures hopFailureCounter // failed tunnel builds by hop position, see buildTunnel
+	latencies   hopLatencyCounter // duration of the CREATE and EXTEND steps by hop, see buildTunnel
+	loads       peerLoads         // loads announced by the hops of our tunnels, see samplePathOfLength
+	shares      tunnelShares      // tokens granting clients access to the tunnels of others, see ShareTunnel
+	traffic     trafficCounters   // traffic of the tunnels by their ID, see TunnelTraffic
+	relay       relayBudget       // bandwidth used to relay cells for other peers, see throttleRelay
+	extends     extendCounter     // extends requested by each previous hop, see configPolicy
+	rounds      roundCounter      // activity of the current round, see reportRound
+
+	policies []Policy // decide on incoming tunnels in addition to the config, see admitPolicy
+
+	tracer *trace.Tracer // records spans of the tunnel lifecycles, nil if tracing is disabled
+
+	faults faults // fault points injected for testing, see InjectFault
+
+	coverLock      sync.Mutex    // guards coverCells
+	coverCells     uint64        // cover cells sent since the start, see SendCover
+	coverSchedules chan struct{} // slots of the cover traffic being sent in the background, see SendCover
 
-	// keeps track of known API connections, which will then receive future api.OnionTunnelIncoming solicitations
+	estimateLock sync.Mutex
+	estimate     *nse.Estimate // latest network size estimate of the NSE module, nil if none is available
+
+	// keeps track of known clients, which will then receive future incoming tunnel solicitations
 	// and can instruct the onion module to build new tunnels
-	apiConnectionsLock sync.Mutex
-	apiConnections     []*api.Connection
+	clientsLock sync.Mutex
+	clients     []Client
+
+	// tunnels restored from the state file after a restart
+	stateLock      sync.Mutex
+	pendingRestore []*rps.Peer // destinations loaded from the state file, rebuilt in the first round
+	restored       []*Tunnel   // rebuilt tunnels waiting to be adopted by a client during the first round
 }
 
 // NewRouter creates a new Router using the given config.Config.
-func NewRouter(cfg *config.Config) (*Router, error) {
-	rps, err := rps.New(cfg)
+// Unless an rps.RPS is given via the WithRPS option, the Router connects to the RPS module given in the config.
+func NewRouter(cfg *config.Config, opts ...Option) (*Router, error) {
+	name := DefaultTransport
+	if cfg != nil && cfg.Transport != "" {
+		name = cfg.Transport
+	}
+	transport, err := newTransport(name, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing transport: %w", err)
+	}
+
+	// options passed by the caller take precedence over the configured transport
+	r := newRouter(cfg, append([]Option{WithTransport(transport)}, opts...)...)
+
+	if r.rps == nil {
+		r.rps, err = rps.New(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("error initializing RPS: %w", err)
+		}
+	}
+
+	if r.auth == nil && cfg != nil && cfg.Crypto == config.CryptoAuth {
+		r.auth, err = auth.New(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("error initializing Onion Auth: %w", err)
+		}
+	}
+
+	if r.nse == nil && cfg != nil && cfg.UseNSE {
+		r.nse, err = nse.New(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("error initializing NSE: %w", err)
+		}
+	}
+
+	if r.gossip == nil && cfg != nil && cfg.UseGossip {
+		r.gossip, err = gossip.New(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("error initializing Gossip: %w", err)
+		}
+	}
+	if r.tracer == nil && cfg != nil && cfg.TraceEndpoint != "" {
+		r.tracer, err = trace.New(cfg, r.logger)
+		if err != nil {
+			return nil, fmt.Errorf("error initializing tracing: %w", err)
+		}
+	}
+
+	if r.gossip != nil {
+		err = r.subscribeLiveness()
+		if err != nil {
+			return nil, fmt.Errorf("error subscribing to peer descriptors: %w", err)
+		}
+	}
+
+	// the NTP server is queried in the background, such that an unreachable one does not delay the start. The time is
+	// corrected once it answered, see correctedClock.
+	go r.checkClock()
+
+	err = r.loadState()
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.loadReplays()
 	if err != nil {
-		return nil, fmt.Errorf("error initializing RPS: %w", err)
+		return nil, err
 	}
 
-	return newRouterWithRPS(cfg, rps), nil
+	return r, nil
 }
 
-func newRouterWithRPS(cfg *config.Config, rps rps.RPS) *Router {
-	return &Router{
+func newRouter(cfg *config.Config, opts ...Option) *Router {
+	r := &Router{
 		cfg:             cfg,
-		rps:             rps,
-		tunnels:         make(map[uint32][]*api.Connection),
+		logger:          log.New(os.Stderr, "", log.LstdFlags),
+		clock:           systemClock{},
+		rand:            rand.Reader,
+		transport:       newTLSTransport(cfg),
+		links:           make(map[linkKey][]*Link),
+		circuitLinks:    make(map[uint32]*Link),
+		idleLinks:       make(map[*Link]struct{}),
+		tunnels:         make(map[uint32][]Client),
+		circuits:        make(map[uint32]struct{}),
 		outgoingTunnels: make(map[uint32]*Tunnel),
 		incomingTunnels: make(map[uint32]*tunnelSegment),
-		apiConnections:  []*api.Connection{},
+		loopbacks:       make(map[uint32]uint32),
+		streams:         make(map[uint64]*reliableStream),
+		migrations:      make(map[uint64]*migration),
+		events:          newEventBus(),
+		handlers:        newTunnelHandlers(),
+		roundTrigger:    make(chan struct{}, 1),
+		coverSchedules:  make(chan struct{}, maxCoverSchedules),
+		reputation:      newReputation(),
+		liveness:        newLiveness(),
+		replays:         newReplayCache(),
+		clients:         []Client{},
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+	// the components below capture the clock, thus it must be corrected in place, see checkClock
+	r.clock = correctedClock(cfg, r.clock)
+	for cfg != nil && cfg.DedupLinks && r.linkIdentity == 0 { // 0 announces no identity
+		r.linkIdentity = uint64(r.randomUint32())<<32 | uint64(r.randomUint32())
 	}
+
+	if cfg != nil && cfg.ResumeLifetime > 0 {
+		r.tickets = newTicketCache(r.clock, time.Duration(cfg.ResumeLifetime)*time.Second)
+	}
+
+	// the clients, the cover traffic, the state file and the round reports follow the Router via the event bus
+	r.Subscribe(r.handleClientEvent)
+	r.Subscribe(r.handleCoverEvent)
+	r.Subscribe(r.handleStateEvent)
+	r.Subscribe(r.handleReportEvent)
+
+	return r
+}
+
+func newRouterWithRPS(cfg *config.Config, rps rps.RPS) *Router {
+	return newRouter(cfg, WithRPS(rps))
+}
+
+// Subscribe registers an EventHandler which is called for all future events of the Router.
+// The returned function unregisters the handler again.
+func (r *Router) Subscribe(handler EventHandler) (unsubscribe func()) {
+	return r.events.subscribe(handler)
+}
+
+// startRound reports the previous round, updates the network size estimate, announces our liveness, advances the
+// round counter and announces the new round.
+func (r *Router) startRound() {
+	r.reportRound()
+	r.updateEstimate()
+	r.announceLiveness()
+	r.round++
+	r.events.publish(Event{
+		Type:  EventRoundStarted,
+		Round: r.round,
+	})
 }
 
-// HandleRounds implements the round logic, (re-)building tunnels at the beginning of each round.
-func (r *Router) HandleRounds(errOut chan error, quit chan struct{}) {
-	roundTimer := time.NewTicker(time.Duration(r.cfg.RoundDuration) * time.Second)
+// HandleRounds implements the round logic, (re-)building tunnels at the beginning of each round, until quit is closed.
+// Returns an error if a tunnel could not be (re-)built, the round logic may then be restarted.
+func (r *Router) HandleRounds(quit chan struct{}) error {
+	if r.cfg.RoundDuration <= 0 {
+		return fmt.Errorf("invalid round duration: %d", r.cfg.RoundDuration)
+	}
+
+	roundDuration := time.Duration(r.cfg.RoundDuration) * time.Second
+	roundTimer := r.clock.NewTicker(roundDuration)
 	defer roundTimer.Stop()
 
-	err := r.buildCoverTunnel()
+	r.startRound()
+	err := r.buildCoverTunnels()
 	if err != nil {
-		errOut <- fmt.Errorf("error building initial cover tunnel: %w", err)
-		return
+		return fmt.Errorf("error building initial cover tunnel: %w", err)
 	}
 
+	// rebuild the tunnels active before the last shutdown
+	r.restoreTunnels()
+	r.roundCompleted.Set(true)
+
 	for {
-		select {
-		case <-quit:
-			return
-		case <-roundTimer.C:
-			// build requested new tunnels
-			successfulBuilds := r.handleBuildTunnelJobs()
-
-			// if we have an actual tunnel now, but did not before, we can close the cover tunnel now.
-			if successfulBuilds > 0 {
-				r.tunnelsLock.Lock()
-				if r.coverTunnel != nil {
-					_ = r.coverTunnel.Close()
-					r.coverTunnel = nil
-				}
-				r.tunnelsLock.Unlock()
+		stop, err := r.awaitRound(roundDuration, roundTimer, quit)
+		if err != nil || stop {
+			return err
+		}
+
+		r.startRound()
+
+		// build requested new tunnels
+		successfulBuilds := r.handleBuildTunnelJobs(quit)
+
+		// if we have an actual tunnel now, but did not before, we can close the cover tunnels now.
+		if successfulBuilds > 0 {
+			r.closeCoverTunnels()
+		}
+
+		// check all tunnels if they still have associated clients. If not, they can be destructed.
+		r.forgetRestoredTunnels()
+		r.removeUnusedTunnels()
+		r.pruneTraffic()
+
+		r.linksLock.Lock()
+		r.closeIdleLinks()
+		r.linksLock.Unlock()
+
+		// renew all remaining outgoing tunnels, the cover tunnels are replaced by ones to other destinations instead
+		r.tunnelsLock.RLock()
+		cover := make(map[uint32]bool, len(r.coverTunnels))
+		for _, tunnelID := range r.coverTunnels {
+			cover[tunnelID] = true
+		}
+		tunnels := make([]*Tunnel, 0, len(r.outgoingTunnels))
+		for tunnelID, tunnel := range r.outgoingTunnels {
+			if !cover[tunnelID] {
+				tunnels = append(tunnels, tunnel)
 			}
+		}
+		r.tunnelsLock.RUnlock()
+		r.announceRotation(tunnels)
 
-			// check all tunnels if they still have associated API connections. If not, they can be destructed.
-			r.removeUnusedTunnels()
+		err = r.rotateCoverTunnels()
+		if err != nil {
+			return fmt.Errorf("error rotating cover tunnels: %w", err)
+		}
 
-			r.tunnelsLock.Lock()
-			// renew all remaining outgoing tunnels
-			if len(r.outgoingTunnels) > 0 {
-				for _, tunnel := range r.outgoingTunnels {
-					err = r.rebuildTunnel(tunnel)
-					if err != nil {
-						errOut <- fmt.Errorf("error rebuilding tunnel: %w", err)
-						r.tunnelsLock.Unlock()
-						return
-					}
-				}
-			} else {
-				// if we do not have any remaining outgoing tunnels, we create a cover tunnel
-				err := r.buildCoverTunnel()
-				if err != nil {
-					errOut <- fmt.Errorf("error building cover tunnel: %w", err)
-					r.tunnelsLock.Unlock()
-					return
-				}
+		for _, tunnel := range tunnels {
+			err = r.rebuildTunnel(tunnel)
+			if err != nil {
+				return fmt.Errorf("error rebuilding tunnel: %w", err)
+			}
+			r.rounds.count(func(report *RoundReport) { report.TunnelsRebuilt++ })
+		}
+
+		// if we do not have any other outgoing tunnels, we keep up the cover tunnels
+		if r.onlyCoverTunnels() {
+			err = r.buildCoverTunnels()
+			if err != nil {
+				return fmt.Errorf("error building cover tunnel: %w", err)
+			}
+		}
+	}
+}
+
+// awaitRound waits until the next round is due, either by the round timer or by TriggerRound. With CoverMidRound, the
+// cover tunnels are rotated once more at a random time within the round meanwhile. Returns stop once quit is closed.
+func (r *Router) awaitRound(roundDuration time.Duration, roundTimer Ticker, quit chan struct{}) (stop bool,
+	err error) {
+	var midRound <-chan time.Time
+	if r.cfg.CoverMidRound {
+		midRound = r.clock.After(r.randomDuration(roundDuration))
+	}
+
+	for {
+		select {
+		case <-quit:
+			return true, nil
+		case <-roundTimer.C():
+			return false, nil
+		case <-r.roundTrigger:
+			return false, nil
+		case <-midRound:
+			midRound = nil // only once per round
+			err = r.rotateCoverTunnels()
+			if err != nil {
+				return false, fmt.Errorf("error rotating cover tunnels: %w", err)
 			}
-			r.tunnelsLock.Unlock()
 		}
 	}
 }
 
-// RegisterAPIConnection adds an api.Connection to the onion router which will then receive future api.OnionTunnelIncoming
+// TriggerRound starts the next round right away instead of waiting for the round timer, e.g. to rebuild all tunnels
+// on demand. The round timer is not reset. Triggering a round while another one is already pending is a no-op.
+func (r *Router) TriggerRound() {
+	select {
+	case r.roundTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// SetLogging enables or disables the log output of the Router at runtime, e.g. to silence a busy relay.
+func (r *Router) SetLogging(enabled bool) {
+	r.logLock.Lock()
+	defer r.logLock.Unlock()
+
+	switch {
+	case enabled && r.logOutput != nil:
+		r.logger.SetOutput(r.logOutput)
+		r.logOutput = nil
+	case !enabled && r.logOutput == nil:
+		r.logOutput = r.logger.Writer()
+		r.logger.SetOutput(ioutil.Discard)
+	}
+}
+
+// RegisterClient adds a Client to the onion router which will then receive future incoming tunnel
 // solicitations and can instruct the onion module to build new tunnels.
-func (r *Router) RegisterAPIConnection(apiConn *api.Connection) {
-	r.apiConnectionsLock.Lock()
-	r.apiConnections = append(r.apiConnections, apiConn)
-	r.apiConnectionsLock.Unlock()
+func (r *Router) RegisterClient(client Client) {
+	r.clientsLock.Lock()
+	r.clients = append(r.clients, client)
+	r.clientsLock.Unlock()
 }
 
 type buildTunnelJob struct {
 	targetPeer *rps.Peer
-	apiConn    *api.Connection
+	pinned     []*rps.Peer // intermediate hops requested by the client, see BuildPinnedTunnel
+	client     Client
 	replyChan  chan BuildTunnelReply
+	multipath  bool // whether to add a second circuit, see BuildMultipathTunnel
 }
 
 // BuildTunnelReply is the reply sent via the replyChan when the tunnel is actually built at the beginning of the next round.
@@ -153,252 +451,601 @@ type BuildTunnelReply struct {
 
 // BuildTunnel queues a job for initialization of an onion tunnel with the tunnels destination being the given target peer
 // and random intermediate hops at the beginning of the next round.
-// The given api.Connection is registered with the created Tunnel and will receive
+// The given Client is registered with the created Tunnel and will receive
 // onion traffic for this tunnel.
-func (r *Router) BuildTunnel(targetPeer *rps.Peer, apiConn *api.Connection) (replyChan chan BuildTunnelReply) {
-	replyChan = make(chan BuildTunnelReply)
+// If a tunnel to the target peer was restored from the state file during the first round, it is handed over to the
+// Client immediately instead.
+func (r *Router) BuildTunnel(targetPeer *rps.Peer, client Client) (replyChan chan BuildTunnelReply) {
+	replyChan = make(chan BuildTunnelReply, 1)
+
+	// a tunnel to the same destination might have been restored after a restart
+	if tunnel, ok := r.adoptRestoredTunnel(targetPeer, client); ok {
+		replyChan <- BuildTunnelReply{Tunnel: tunnel}
+		return replyChan
+	}
+
+	// tunnels to ourselves do not wait for the next round, since they are not built through the network
+	if r.isLoopback(targetPeer) {
+		replyChan <- BuildTunnelReply{Tunnel: r.buildLoopbackTunnel(targetPeer, client)}
+		return replyChan
+	}
 
 	buildJob := buildTunnelJob{
 		targetPeer: targetPeer,
-		apiConn:    apiConn,
+		client:     client,
 		replyChan:  replyChan,
 	}
+	r.queueBuildJob(&buildJob)
+	return replyChan
+}
 
+// queueBuildJob queues a job handled at the beginning of the next round, see handleBuildTunnelJobs.
+func (r *Router) queueBuildJob(buildJob *buildTunnelJob) {
 	r.buildQueueLock.Lock()
-	r.buildQueue = append(r.buildQueue, &buildJob)
+	r.buildQueue = append(r.buildQueue, buildJob)
 	r.buildQueueLock.Unlock()
-
-	return replyChan
 }
 
 // handleBuildTunnelJobs handles all queued buildTunnelJobs, which is used to build tunnels at the beginning of each round.
-func (r *Router) handleBuildTunnelJobs() (successfulBuilds int) {
+// Failed builds are retried until the end of the round, see buildWithRetries. Jobs queued meanwhile are handled in the
+// next round.
+func (r *Router) handleBuildTunnelJobs(quit chan struct{}) (successfulBuilds int) {
 	r.buildQueueLock.Lock()
-	if len(r.buildQueue) > 0 {
-		for _, buildJob := range r.buildQueue {
-			var tunnel *Tunnel
-			tunnel, err := r.buildNewTunnel(buildJob.targetPeer, buildJob.apiConn)
-			buildJob.replyChan <- BuildTunnelReply{
-				Tunnel: tunnel,
-				Err:    err,
-			}
+	buildQueue := r.buildQueue
+	r.buildQueue = nil
+	r.buildQueueLock.Unlock()
 
-			if err == nil {
-				successfulBuilds++
-			}
+	deadline := r.clock.Now().Add(time.Duration(r.cfg.RoundDuration) * time.Second)
+	for _, buildJob := range buildQueue {
+		tunnel, err := r.buildWithRetries(buildJob, deadline, quit)
+		if err == nil && buildJob.multipath {
+			r.makeMultipath(tunnel)
+		}
+		buildJob.replyChan <- BuildTunnelReply{
+			Tunnel: tunnel,
+			Err:    err,
+		}
+
+		if err == nil {
+			successfulBuilds++
+		} else {
+			r.countError(err)
 		}
-		r.buildQueue = nil
 	}
-	r.buildQueueLock.Unlock()
 
 	return successfulBuilds
 }
 
-// buildNewTunnel is used to build a new tunnel with new random intermediate peers.
-func (r *Router) buildNewTunnel(targetPeer *rps.Peer, apiConn *api.Connection) (tunnel *Tunnel, err error) {
-	// generate a new, unique tunnel ID
-	tunnelID := r.newTunnelID()
+// buildNewTunnel is used to build a new tunnel with new random intermediate peers, unless the client pinned them.
+func (r *Router) buildNewTunnel(targetPeer *rps.Peer, pinned []*rps.Peer, client Client) (tunnel *Tunnel, err error) {
+	// the cover tunnel is exempt from admission control, it is closed as soon as there are other tunnels
+	if client != nil {
+		err = r.admitTunnel()
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	r.tunnelsLock.Lock()
-	defer r.tunnelsLock.Unlock()
+	// generate a new, unique tunnel ID and a separate ID for the circuit on the link to the first hop
+	tunnelID := r.newTunnelID()
+	circuitID := r.newCircuitID()
 
 	// actually build the tunnel
-	tunnel, err = r.buildTunnel(targetPeer, tunnelID, false)
+	tunnel, err = r.buildTunnel(targetPeer, pinned, tunnelID, circuitID, nil)
+	if err != nil {
+		r.tunnelsLock.Lock()
+		delete(r.tunnels, tunnelID)
+		if client != nil {
+			r.releaseTunnel()
+		}
+		r.tunnelsLock.Unlock()
+		return nil, err
+	}
+
+	r.tunnelsLock.Lock()
+	// the slot reserved for the tunnel is taken by the outgoing tunnel now, or released if it can not be used
+	if client != nil {
+		r.releaseTunnel()
+	}
+	err = r.newStream(tunnel)
 	if err != nil {
+		delete(r.tunnels, tunnelID)
+		r.tunnelsLock.Unlock()
+		_ = tunnel.Close()
+		tunnel.closeSessions()
+		r.releaseCircuit(tunnel.circuitID)
 		return nil, err
 	}
 
-	if apiConn != nil {
-		r.tunnels[tunnel.id] = append(r.tunnels[tunnel.id], apiConn)
+	r.outgoingTunnels[tunnel.id] = tunnel
+	if client != nil {
+		r.tunnels[tunnel.id] = append(r.tunnels[tunnel.id], client)
 	}
+	r.tunnelsLock.Unlock()
 
-	return tunnel, err
-}
+	r.startTunnelHandler(tunnel)
 
-// rebuildTunnel is used to rebuild a tunnel with new random intermediate peers.
-func (r *Router) rebuildTunnel(tunnel *Tunnel) (err error) {
-	oldTunnel := *tunnel
+	r.events.publish(Event{
+		Type:     EventTunnelBuilt,
+		TunnelID: tunnel.id,
+	})
 
-	targetPeer := tunnel.hops[len(tunnel.hops)-1]
+	return tunnel, nil
+}
 
+// admitTunnel reserves a slot for a new outgoing tunnel if the configured maximum is not reached yet, counting the
+// tunnels still being built as well, such that concurrent builds can not exceed it. The cover tunnels do not count.
+// Slots are released again via releaseTunnel once the tunnel is registered as outgoing tunnel or failed.
+func (r *Router) admitTunnel() error {
 	r.tunnelsLock.Lock()
-	_, err = r.buildTunnel(targetPeer, tunnel.id, false)
-	r.tunnelsLock.Unlock()
-	if err != nil {
-		return err
+	defer r.tunnelsLock.Unlock()
+
+	numTunnels := len(r.outgoingTunnels) - len(r.liveCoverTunnels()) + r.numBuilding
+	if r.cfg.MaxTunnels > 0 && numTunnels >= r.cfg.MaxTunnels {
+		return ErrTooManyTunnels
+	}
+	r.numBuilding++
+	return nil
+}
+
+// releaseTunnel releases a slot previously reserved with admitTunnel.
+// Must be called with r.tunnelsLock hold.
+func (r *Router) releaseTunnel() {
+	r.numBuilding--
+}
+
+// admitSegment reserves a slot for a new incoming tunnel segment if the configured maximum is not reached yet and we
+// are not hibernating. Slots are released again via releaseSegment.
+func (r *Router) admitSegment() error {
+	if r.hibernating() {
+		return ErrRelayQuotaExhausted
 	}
 
-	oldTunnel.Close()
+	r.tunnelsLock.Lock()
+	defer r.tunnelsLock.Unlock()
+
+	return r.reserveSegment()
+}
 
+// reserveSegment reserves a slot for a new incoming tunnel segment if the configured maximum is not reached yet.
+// Must be called with r.tunnelsLock hold.
+func (r *Router) reserveSegment() error {
+	if r.cfg.MaxSegments > 0 && r.numSegments >= r.cfg.MaxSegments {
+		return ErrTooManyTunnels
+	}
+	r.numSegments++
 	return nil
 }
 
-// buildCoverTunnel builds a tunnel used for cover traffic.
-func (r *Router) buildCoverTunnel() error {
-	targetPeer, err := r.rps.GetPeer()
-	if err != nil {
-		return err
+// registerIncomingCircuit registers the circuit with the given ID created by the previous hop and reserves a slot for
+// its tunnel segment, see admitSegment. Both happen while holding r.tunnelsLock, such that concurrent creates of the
+// same circuit on multiple links and the round logic building and tearing down circuits see a consistent state.
+// Returns ErrAlreadyRegistered if the circuit ID is taken. The circuit and the slot are released again via
+// releaseCircuit and releaseSegment.
+func (r *Router) registerIncomingCircuit(circuitID uint32) error {
+	if r.hibernating() {
+		return ErrRelayQuotaExhausted
 	}
-	tunnel, err := r.buildNewTunnel(targetPeer, nil)
-	if err != nil {
+
+	r.tunnelsLock.Lock()
+	defer r.tunnelsLock.Unlock()
+
+	if _, ok := r.circuits[circuitID]; ok {
+		return ErrAlreadyRegistered
+	}
+	if err := r.reserveSegment(); err != nil {
 		return err
 	}
-	r.coverTunnel = tunnel
+	r.circuits[circuitID] = struct{}{}
 	return nil
 }
 
-// buildTunnel is shared by Router.buildNewTunnel and Router.rebuildTunnel to actually perform the tunnel building.
-// Must be called with r.tunnelsLock hold.
-func (r *Router) buildTunnel(targetPeer *rps.Peer, tunnelID uint32, renewing bool) (tunnel *Tunnel, err error) {
-	if r.cfg.TunnelLength < 3 {
-		return nil, ErrNotEnoughHops
-	}
+// releaseSegment releases a slot previously reserved with admitSegment.
+func (r *Router) releaseSegment() {
+	r.tunnelsLock.Lock()
+	r.numSegments--
+	r.tunnelsLock.Unlock()
+}
 
-	// sample intermediate peers
-	hops, err := r.rps.SampleIntermediatePeers(r.cfg.TunnelLength, targetPeer)
-	if err != nil {
-		return nil, fmt.Errorf("error sampling peers: %w", err)
+// admitLink checks whether another Link may be opened without exceeding the configured maximum.
+func (r *Router) admitLink() bool {
+	if r.cfg.MaxLinks <= 0 {
+		return true
 	}
 
-	msgBuf := make([]byte, p2p.MessageSize)
+	r.linksLock.Lock()
+	defer r.linksLock.Unlock()
 
-	// first we fetch a link connection to the first hop
-	log.Printf("Starting to initialize onion circuit with first hop %v:%v\n", hops[0].Address, hops[0].Port)
-	link, err := r.GetOrCreateLink(hops[0].Address, hops[0].Port)
-	if err != nil {
-		return nil, err
+	return r.numLinks < r.cfg.MaxLinks
+}
+
+// admitIncomingLink checks whether another Link may be accepted from another peer without exceeding the configured
+// maximum of incoming links or of all links.
+func (r *Router) admitIncomingLink() bool {
+	r.linksLock.Lock()
+	defer r.linksLock.Unlock()
+
+	if r.cfg.MaxIncomingLinks > 0 && r.numIncoming >= r.cfg.MaxIncomingLinks {
+		return false
 	}
+	return r.cfg.MaxLinks <= 0 || r.numLinks < r.cfg.MaxLinks
+}
 
-	tunnel = &Tunnel{
-		id:   tunnelID,
-		link: link,
-		quit: make(chan struct{}),
+// rebuildTunnel is used to rebuild a tunnel with new random intermediate peers, unless the client pinned them.
+// The tunnel is handed over to the new circuit without losing data in flight, see startHandover. The clients keep
+// using the same tunnel ID.
+func (r *Router) rebuildTunnel(tunnel *Tunnel) (err error) {
+	if tunnel.stream != nil && tunnel.stream.multipath != nil {
+		return r.rebuildMultipathTunnel(tunnel)
 	}
 
-	// now we register an output channel for this link
-	dataOut := make(chan message, 5)
-	err = link.register(tunnelID, dataOut, renewing)
+	targetPeer := tunnel.hops[len(tunnel.hops)-1]
+
+	// both circuits coexist until the old one is drained, the clients only know the tunnel ID
+	circuitID := r.newCircuitID()
+
+	newTunnel, err := r.buildTunnel(targetPeer, tunnel.pinned, tunnel.id, circuitID, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	// rebuilding the tunnel does not count as activity
+	newTunnel.activity.touch(tunnel.activity.last())
 
-	// send a create message to the first hop
-	dhPriv, createMsg, err := tunnelCreateMsg(hops[0].HostKey)
-	if err != nil {
-		return nil, err
+	r.tunnelsLock.Lock()
+	if r.outgoingTunnels[tunnel.id] != tunnel {
+		// the tunnel was torn down while the new circuit was built
+		r.tunnelsLock.Unlock()
+		_ = newTunnel.Close()
+		newTunnel.closeSessions()
+		r.releaseCircuit(newTunnel.circuitID)
+		return nil
 	}
+	r.outgoingTunnels[tunnel.id] = newTunnel
 
-	err = link.sendMsg(tunnelID, createMsg)
+	h, err := r.startHandover(tunnel, newTunnel)
 	if err != nil {
-		return nil, err
+		// the new circuit is unusable, the tunnel stays on the old one
+		r.outgoingTunnels[tunnel.id] = tunnel
+		r.tunnelsLock.Unlock()
+		_ = newTunnel.Close()
+		newTunnel.closeSessions()
+		r.releaseCircuit(newTunnel.circuitID)
+		return err
 	}
+	r.tunnelsLock.Unlock()
 
-	// now we wait for the response, timing out when one does not come
-	select {
-	case created := <-dataOut:
-		if created.hdr.Type != p2p.TypeTunnelCreated {
-			return nil, p2p.ErrInvalidMessage
-		}
+	r.startTunnelHandler(newTunnel)
 
-		createdMsg := p2p.TunnelCreated{}
-		err = createdMsg.Parse(created.body)
+	// data lost on the old tunnel is sent again on the new one, in case the old one broke before it was drained
+	if newTunnel.stream != nil {
+		err = newTunnel.stream.resume(newTunnel.sendRelayToLastHop)
 		if err != nil {
-			return nil, err
+			r.logger.Printf("Error resuming stream on rebuilt tunnel %v: %v\n", tunnel.id, err)
 		}
+	}
 
-		var dhShared [32]byte
-		box.Precompute(&dhShared, &createdMsg.DHPubKey, dhPriv)
+	go r.drainCircuit(h)
 
-		// validate the shared key hash
-		sharedHash := sha256.Sum256(dhShared[:32])
-		if !bytes.Equal(sharedHash[:], createdMsg.SharedKeyHash[:]) {
-			return nil, ErrMisbehavingPeer
-		}
+	return nil
+}
 
-		tunnel.hops = []*rps.Peer{{
-			DHShared: dhShared,
-			Port:     hops[0].Port,
-			Address:  hops[0].Address,
-			HostKey:  hops[0].HostKey,
-		}}
+// buildCoverTunnels builds tunnels used for cover traffic until there are as many as suit the estimated network size,
+// see numCoverTunnels. Surplus cover tunnels are closed.
+func (r *Router) buildCoverTunnels() error {
+	n := r.numCoverTunnels()
 
-	case <-time.After(time.Duration(r.cfg.BuildTimeout) * time.Second):
-		return nil, ErrTimedOut
+	r.tunnelsLock.Lock()
+	coverTunnels := r.liveCoverTunnels()
+	var surplus []*Tunnel
+	if len(coverTunnels) > n {
+		coverTunnels, surplus = coverTunnels[:n], coverTunnels[n:]
+	}
+	r.coverTunnels = r.coverTunnels[:0]
+	for _, tunnel := range coverTunnels {
+		r.coverTunnels = append(r.coverTunnels, tunnel.id)
 	}
+	r.tunnelsLock.Unlock()
 
-	// handshake with first hop is done, do the remaining ones
-	for _, hop := range hops[1:] {
-		dhPriv, extendMsg, err := relayTunnelExtendMsg(hop.HostKey, hop.Address, hop.Port)
-		if err != nil {
-			return nil, err
-		}
+	// the tunnels are removed as well, otherwise they would be closed again as unused tunnels
+	for _, tunnel := range surplus {
+		_ = r.CloseTunnel(tunnel.id)
+	}
 
-		var n int
-		tunnel.sendCounter, n, err = p2p.PackRelayMessage(msgBuf, tunnel.sendCounter, extendMsg)
+	for i := len(coverTunnels); i < n; i++ {
+		err := r.buildCoverTunnel()
 		if err != nil {
-			return nil, err
-		}
-
-		// layer on encryption
-		packedMsg := msgBuf[:n]
-		for j := len(tunnel.hops) - 1; j >= 0; j-- {
-			packedMsg, err = p2p.EncryptRelay(packedMsg, &tunnel.hops[j].DHShared)
-			if err != nil {
-				return nil, err
-			}
+			return err
 		}
+	}
+	return nil
+}
 
-		err = link.sendRelay(tunnelID, packedMsg)
-		if err != nil {
-			return nil, err
-		}
+// buildCoverTunnel builds a tunnel used for cover traffic to a freshly sampled peer. The number of hops is drawn at
+// random, see coverTunnelLength, hence the intermediate hops are sampled here and passed on as if they were pinned.
+func (r *Router) buildCoverTunnel() error {
+	targetPeer, err := r.rps.GetPeer()
+	if err != nil {
+		return err
+	}
+	hops, err := r.samplePathOfLength(targetPeer, r.coverTunnelLength(), nil)
+	if err != nil {
+		return fmt.Errorf("error sampling peers: %w", err)
+	}
+	tunnel, err := r.buildNewTunnel(targetPeer, hops[:len(hops)-1], nil)
+	if err != nil {
+		return err
+	}
 
-		// wait for the extended message
-		select {
-		case extended := <-dataOut:
-			if extended.hdr.Type != p2p.TypeTunnelRelay {
-				return nil, p2p.ErrInvalidMessage
+	r.tunnelsLock.Lock()
+	r.coverTunnels = append(r.coverTunnels, tunnel.id)
+	r.tunnelsLock.Unlock()
+	return nil
+}
+
+// coverTunnelLength draws the number of hops of a new cover tunnel at random from the configured tunnel length up to
+// MaxCoverLength, such that the cover tunnels can not be recognized by their length.
+func (r *Router) coverTunnelLength() int {
+	if r.cfg.MaxCoverLength <= r.cfg.TunnelLength {
+		return r.cfg.TunnelLength
+	}
+	return r.cfg.TunnelLength + int(r.randomUint32()%uint32(r.cfg.MaxCoverLength-r.cfg.TunnelLength+1))
+}
+
+// rotateCoverTunnels replaces each cover tunnel by a new one to another randomly sampled destination, such that the
+// endpoints of the cover tunnels do not become a stable observable. The old tunnels are only closed once their
+// replacements are built, to not interrupt the cover traffic.
+func (r *Router) rotateCoverTunnels() error {
+	r.tunnelsLock.RLock()
+	coverTunnels := r.liveCoverTunnels()
+	r.tunnelsLock.RUnlock()
+
+	for _, tunnel := range coverTunnels {
+		err := r.buildCoverTunnel()
+		if err != nil {
+			return err
+		}
+
+		// the tunnel is dropped from the cover tunnels once destroyed, see handleCoverEvent
+		_ = r.CloseTunnel(tunnel.id)
+	}
+	return nil
+}
+
+// closeCoverTunnels closes all cover tunnels.
+func (r *Router) closeCoverTunnels() {
+	r.tunnelsLock.Lock()
+	coverTunnels := r.liveCoverTunnels()
+	r.coverTunnels = nil
+	r.tunnelsLock.Unlock()
+
+	for _, tunnel := range coverTunnels {
+		_ = r.CloseTunnel(tunnel.id)
+	}
+}
+
+// liveCoverTunnels returns the cover tunnels which were not torn down yet.
+// Must be called with r.tunnelsLock hold.
+func (r *Router) liveCoverTunnels() (tunnels []*Tunnel) {
+	for _, tunnelID := range r.coverTunnels {
+		if tunnel, ok := r.outgoingTunnels[tunnelID]; ok {
+			tunnels = append(tunnels, tunnel)
+		}
+	}
+	return tunnels
+}
+
+// onlyCoverTunnels checks whether all outgoing tunnels are cover tunnels, which is also the case without any outgoing
+// tunnels.
+func (r *Router) onlyCoverTunnels() bool {
+	r.tunnelsLock.RLock()
+	defer r.tunnelsLock.RUnlock()
+
+	return len(r.outgoingTunnels) == len(r.liveCoverTunnels())
+}
+
+// buildTunnel is shared by Router.buildNewTunnel and Router.rebuildTunnel to actually perform the tunnel building.
+// The tunnel is known to the clients by tunnelID, while circuitID identifies the new circuit on the link to the first
+// hop. The built tunnel is not registered as outgoing tunnel yet, which is up to the caller. The tunnel is built
+// through the pinned intermediate hops if given. Otherwise, they are sampled such that none of them is one of the
+// peers to avoid, see samplePath. If Config.ProbeFirstHops is set, another candidate for the first hop is raced against
+// the sampled one, in which case the built tunnel may use another circuit ID, see raceFirstHops. The circuits are
+// released if the tunnel can not be built.
+// Must not be called with r.tunnelsLock hold, since building the tunnel waits for the responses of all hops.
+func (r *Router) buildTunnel(targetPeer *rps.Peer, pinned []*rps.Peer, tunnelID, circuitID uint32, avoid []*rps.Peer) (
+	tunnel *Tunnel, err error) {
+	if r.cfg.TunnelLength < 3 {
+		r.releaseCircuit(circuitID)
+		return nil, ErrNotEnoughHops
+	}
+
+	var hops Path
+	if pinned != nil {
+		hops = newPath(pinned, targetPeer)
+	} else {
+		// sample intermediate peers
+		hops, err = r.samplePath(targetPeer, avoid)
+		if err != nil {
+			r.releaseCircuit(circuitID)
+			return nil, fmt.Errorf("error sampling peers: %w", err)
+		}
+	}
+
+	msgBuf := make([]byte, p2p.MessageSize)
+
+	// the circuit is traced from its build to its teardown, see handleOutgoingTunnel
+	span := r.tracer.Start("tunnel")
+	span.Set("tunnel.id", tunnelID)
+	span.Set("tunnel.hops", len(hops))
+	span.Set("target.address", targetPeer.Address.String())
+	span.Set("target.port", targetPeer.Port)
+	buildSpan := span.Child("tunnel.build")
+
+	// failures are counted by the position of the first hop not reached, see Stats.HopFailures
+	var building *Tunnel
+	defer func() {
+		buildSpan.Finish(err)
+		if err == nil {
+			return
+		}
+		span.Finish(err)
+		position := 0
+		if building != nil {
+			building.closeSessions()
+			r.releaseCircuit(building.circuitID)
+			position = len(building.hops)
+		}
+		r.hopFailures.add(position)
+		r.rounds.count(func(report *RoundReport) { report.BuildFailures++ })
+	}()
+
+	// establish the circuit with the first hop, failed circuits are released by createFirstHop
+	var alternative *rps.Peer
+	if pinned == nil {
+		alternative = r.alternativeFirstHop(hops, avoid)
+	}
+	var first *firstHop
+	if alternative != nil {
+		first = r.raceFirstHops(buildSpan, hops[0], alternative, tunnelID, circuitID)
+	} else {
+		first = r.createFirstHop(buildSpan, hops[0], tunnelID, circuitID)
+	}
+	if first.err != nil {
+		return nil, first.err
+	}
+	hops[0] = first.hop
+	link, dataOut, s := first.link, first.dataOut, first.session
+
+	tunnel = &Tunnel{
+		id:        tunnelID,
+		circuitID: first.circuitID,
+		target:    targetPeer,
+		link:      link,
+		pinned:    pinned,
+		latencies: []time.Duration{first.latency},
+		traffic:   r.traffic.get(tunnelID),
+		pongs:     make(chan struct{}, 1),
+		span:      span,
+		quit:      make(chan struct{}),
+	}
+	span.Set("circuit.id", first.circuitID)
+	tunnel.activity.touch(r.clock.Now())
+
+	// the sessions with the hops reached so far and the circuit are released if the tunnel can not be built.
+	// The named result is nil by then, hence the tunnel is captured separately.
+	building = tunnel
+
+	tunnel.addHop(hops.reached(0, &s.key), s.cipher)
+	tunnel.caps = append(tunnel.caps, s.capabilities)
+
+	// handshake with first hop is done, do the remaining ones. Sessions are only resumed through hops which issued a
+	// ticket themselves, since older hops do not extend resumed handshakes.
+	resumable := s.resumable
+	for i, hop := range hops[1:] {
+		prevHop := hops[i] // the hop extending the tunnel to hop
+
+		extendSpan := buildSpan.Child("tunnel.extend")
+		extendSpan.Set("hop", i+1)
+		extendSpan.Set("hop.address", hop.Address.String())
+		extendSpan.Set("hop.port", hop.Port)
+		start := r.clock.Now()
+		s, err := r.handshake(hop, tunnelID, resumable, func(createMsg *p2p.TunnelCreate) (*p2p.TunnelCreated, error) {
+			// hops not extending handshakes encrypted with RSA-OAEP are treated like a hop asking to retry with the
+			// legacy version, while older hops only extend tunnels with keys encrypted for 4096 bit host keys
+			if createMsg.Version == p2p.HandshakeVersionDHOAEP && !tunnel.lastHopSupports(p2p.CapabilityOAEP) {
+				legacy := dhVersion(hop.HostKey)
+				if !createMsg.Versions.Contains(legacy) {
+					return nil, ErrNoOAEP
+				}
+				return &p2p.TunnelCreated{Retry: true, Version: legacy}, nil
+			}
+			if createMsg.Version == p2p.HandshakeVersionDHSized && !tunnel.lastHopSupports(p2p.CapabilitySizedKeys) {
+				return nil, ErrHostKeySize
 			}
+			extendMsg := relayTunnelExtendMsgFromTunnelCreateMsg(createMsg, hop.Address, hop.Port)
+			extendMsg.WantLoad = r.cfg.LoadAwarePaths
 
-			// decrypt the message
-			relayHdr, decryptedRelayMsg, ok, err := tunnel.DecryptRelayMessage(extended.body)
+			var n int
+			var err error
+			tunnel.sendCounter, n, err = link.packer.PackRelayMessage(msgBuf, tunnel.sendCounter, &extendMsg,
+				tunnel.sendDigests[len(tunnel.hops)-1])
 			if err != nil {
 				return nil, err
 			}
-			if !ok || relayHdr.RelayType != p2p.RelayTypeTunnelExtended {
-				return nil, ErrMisbehavingPeer
+
+			// layer on encryption
+			packedMsg, err := tunnel.encryptRelayMsgToHop(msgBuf[:n], len(tunnel.hops)-1)
+			if err != nil {
+				return nil, err
 			}
 
-			extendedMsg := p2p.RelayTunnelExtended{}
-			err = extendedMsg.Parse(decryptedRelayMsg)
+			err = link.sendRelay(tunnel.circuitID, packedMsg, PriorityControl)
 			if err != nil {
 				return nil, err
 			}
 
-			var dhShared [32]byte
-			box.Precompute(&dhShared, &extendedMsg.DHPubKey, dhPriv)
+			// wait for the extended message
+			select {
+			case extended := <-dataOut:
+				if extended.hdr.Type != p2p.TypeTunnelRelay {
+					return nil, p2p.ErrInvalidMessage
+				}
 
-			// validate the shared key hash
-			sharedHash := sha256.Sum256(dhShared[:32])
-			if !bytes.Equal(sharedHash[:], extendedMsg.SharedKeyHash[:]) {
-				return nil, ErrMisbehavingPeer
-			}
+				// decrypt the message
+				relayHdr, decryptedRelayMsg, ok, err := tunnel.DecryptRelayMessage(extended.body)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					r.recordMisbehavior(prevHop, MisbehaviorDigest)
+					return nil, ErrMisbehavingPeer
+				}
+				if relayHdr.RelayType == p2p.RelayTypeTunnelError {
+					// prevHop refused to extend the tunnel, e.g. since the sampled path loops through it
+					errorMsg := p2p.RelayTunnelError{}
+					err = errorMsg.Parse(decryptedRelayMsg)
+					if err != nil {
+						return nil, err
+					}
+					return nil, fmt.Errorf("%w: %v", ErrExtendRefused, errorMsg.Reason)
+				}
+				if relayHdr.RelayType != p2p.RelayTypeTunnelExtended {
+					r.recordMisbehavior(prevHop, MisbehaviorProtocol)
+					return nil, ErrMisbehavingPeer
+				}
 
-			tunnel.hops = append(tunnel.hops, &rps.Peer{
-				DHShared: dhShared,
-				Port:     hops[0].Port,
-				Address:  hops[0].Address,
-				HostKey:  hops[0].HostKey,
-			})
+				extendedMsg := p2p.RelayTunnelExtended{}
+				err = extendedMsg.Parse(decryptedRelayMsg)
+				if err != nil {
+					return nil, err
+				}
 
-			break
-		case <-time.After(time.Duration(r.cfg.BuildTimeout) * time.Second):
-			return nil, ErrTimedOut
+				createdMsg := tunnelCreatedMsgFromRelayTunnelExtendedMsg(&extendedMsg)
+				return &createdMsg, nil
+
+			case <-r.clock.After(time.Duration(r.cfg.BuildTimeout) * time.Second):
+				// either hop did not respond or prevHop did not extend the tunnel, we can not tell
+				r.recordMisbehavior(hop, MisbehaviorTimeout)
+				return nil, ErrTimedOut
+			}
+		})
+		extendSpan.Finish(err)
+		if err != nil {
+			return nil, err
 		}
-	}
+		now := r.clock.Now()
+		r.latencies.record(hop, i+1, now.Sub(start), now)
+		tunnel.latencies = append(tunnel.latencies, now.Sub(start))
 
-	r.outgoingTunnels[tunnel.id] = tunnel
+		tunnel.addHop(hops.reached(i+1, &s.key), s.cipher)
+		tunnel.caps = append(tunnel.caps, s.capabilities)
+		resumable = s.resumable
+	}
 
+	// the tunnel is rebuilt to its last hop, which must be the target
+	err = hops.verify(tunnel.hops)
+	if err != nil {
+		return nil, err
+	}
 	return tunnel, nil
 }
 
@@ -409,197 +1056,267 @@ func (r *Router) SendData(tunnelID uint32, payload []byte) (err error) {
 		Data: payload,
 	}
 
-	buf := make([]byte, p2p.RelayMessageSize)
-
-	r.tunnelsLock.Lock()
+	r.tunnelsLock.RLock()
 	if tunnel, ok := r.outgoingTunnels[tunnelID]; ok {
-		r.tunnelsLock.Unlock()
-
-		var n int
-		tunnel.sendCounter, n, err = p2p.PackRelayMessage(buf, tunnel.sendCounter, &relayData)
-		if err != nil {
-			return err
+		stream := tunnel.stream
+		r.tunnelsLock.RUnlock()
+		if tunnel.sendClosed.isClosed() {
+			return ErrSendClosed
 		}
+		tunnel.activity.touch(r.clock.Now())
 
-		var encryptedMsg []byte
-		encryptedMsg, err = tunnel.EncryptRelayMsg(buf[:n])
-		if err != nil {
-			return err
+		if stream != nil {
+			return stream.sendData(payload)
 		}
-
-		return tunnel.link.sendRelay(tunnelID, encryptedMsg)
+		if policy := r.batchPolicy(tunnel.priority.get()); policy.delay > 0 &&
+			tunnel.lastHopSupports(p2p.CapabilityBatch) {
+			return r.sendBatched(&tunnel.batch, policy, payload, tunnel.sendRelayToLastHop, tunnel.quit)
+		}
+		return tunnel.sendRelayToLastHop(&relayData)
 	} else if tunnelSegment, ok := r.incomingTunnels[tunnelID]; ok {
-		r.tunnelsLock.Unlock()
-
-		var n int
-		tunnelSegment.sendCounter, n, err = p2p.PackRelayMessage(buf, tunnelSegment.sendCounter, &relayData)
-		if err != nil {
-			return err
+		stream := tunnelSegment.stream
+		r.tunnelsLock.RUnlock()
+		if tunnelSegment.sendClosed.isClosed() {
+			return ErrSendClosed
 		}
 
-		var encryptedMsg []byte
-		encryptedMsg, err = p2p.EncryptRelay(buf[:n], tunnelSegment.dhShared)
-		if err != nil {
-			return err
+		if stream != nil {
+			return stream.sendData(payload)
 		}
-
-		return tunnelSegment.prevHopLink.sendRelay(tunnelID, encryptedMsg)
+		if policy := r.batchPolicy(tunnelSegment.priority.get()); policy.delay > 0 &&
+			tunnelSegment.initiatorCaps&p2p.CapabilityBatch > 0 {
+			return r.sendBatched(&tunnelSegment.batch, policy, payload, tunnelSegment.sendRelayToPrevHop,
+				tunnelSegment.quit)
+		}
+		return tunnelSegment.sendRelayToPrevHop(&relayData)
+	} else if otherEnd, ok := r.loopbacks[tunnelID]; ok {
+		r.tunnelsLock.RUnlock()
+		return r.sendDataToClients(otherEnd, payload)
 	} else {
-		r.tunnelsLock.Unlock()
+		r.tunnelsLock.RUnlock()
 	}
 
 	return ErrInvalidTunnel
 }
 
-// SendCover sends cover traffic over the cover tunnel, if one exists.
-func (r *Router) SendCover(coverSize uint16) (err error) {
-	// first we check if there is a manually created tunnel, i.e. a tunnel on which api connections are listening
-	r.tunnelsLock.Lock()
-	for _, tunnel := range r.outgoingTunnels {
-		if apiConns, ok := r.tunnels[tunnel.ID()]; ok && len(apiConns) != 0 {
-			r.tunnelsLock.Unlock()
-			return ErrSendCoverNotAllowed
-		}
+// AnnounceTunnel makes the last hop of the outgoing tunnel with the given ID announce the tunnel to its clients right
+// away, such that they may send data before receiving any. Last hops lacking p2p.CapabilityOpened still announce the
+// tunnel along with the first data.
+func (r *Router) AnnounceTunnel(tunnelID uint32) (err error) {
+	r.tunnelsLock.RLock()
+	tunnel, ok := r.outgoingTunnels[tunnelID]
+	_, isLoopback := r.loopbacks[tunnelID]
+	r.tunnelsLock.RUnlock()
+	if isLoopback {
+		return nil // the other end is announced when building the tunnel
 	}
-	r.tunnelsLock.Unlock()
-
-	if r.coverTunnel == nil {
+	if !ok {
 		return ErrInvalidTunnel
 	}
 
-	for coverSize > 0 { // we send fixed size cover traffic until the desired cover size is reached
-		relayCover := &p2p.RelayTunnelCover{Ping: true}
+	if !tunnel.lastHopSupports(p2p.CapabilityOpened) {
+		return nil
+	}
+	return tunnel.sendRelayToLastHop(&p2p.RelayTunnelOpened{})
+}
 
-		var n int
-		buf := make([]byte, p2p.RelayMessageSize)
-		r.coverTunnel.sendCounter, n, err = p2p.PackRelayMessage(buf, r.coverTunnel.sendCounter, relayCover)
+// handleClientEvent notifies the clients about tunnel state changes published on the event bus.
+func (r *Router) handleClientEvent(ev Event) {
+	switch ev.Type {
+	case EventTunnelIncoming:
+		r.notifyAllClients(SubscribeIncoming, func(client Client) error {
+			return client.SendTunnelIncoming(ev.TunnelID)
+		})
+	case EventTunnelDestroyed:
+		err := r.notifyClients(ev.TunnelID, func(client Client) error {
+			return client.SendTunnelDestroy(ev.TunnelID)
+		})
 		if err != nil {
-			return err
+			r.logger.Printf("Error announcing destroyed tunnel ID %v to clients: %v\n", ev.TunnelID, err)
 		}
-
-		var encryptedMsg []byte
-		encryptedMsg, err = r.coverTunnel.EncryptRelayMsg(buf[:n])
-		if err != nil {
-			return err
+	case EventRoundRotation:
+		if r.cfg != nil && r.cfg.AnnounceRounds {
+			r.notifyRound(ev.Round, ev.Rotated)
 		}
+	default: // other events are not relevant for clients
+	}
+}
 
-		err = r.coverTunnel.link.sendRelay(r.coverTunnel.ID(), encryptedMsg)
-		if err != nil {
-			return err
+// announceRotation announces the outgoing tunnels rebuilt in the current round.
+func (r *Router) announceRotation(tunnels []*Tunnel) {
+	rotated := make([]uint32, 0, len(tunnels))
+	for _, tunnel := range tunnels {
+		rotated = append(rotated, tunnel.id)
+	}
+	sort.Slice(rotated, func(i, j int) bool {
+		return rotated[i] < rotated[j]
+	})
+
+	r.events.publish(Event{
+		Type:    EventRoundRotation,
+		Round:   r.round,
+		Rotated: rotated,
+	})
+}
+
+// notifyRound announces the given round to all clients implementing RoundClient, listing the rotated tunnels each of
+// them is registered on.
+func (r *Router) notifyRound(round uint64, rotated []uint32) {
+	r.clientsLock.Lock()
+	clients := append([]Client(nil), r.clients...)
+	r.clientsLock.Unlock()
+
+	clientTunnels := make(map[Client][]uint32, len(clients))
+	r.tunnelsLock.RLock()
+	for _, tunnelID := range rotated {
+		for _, client := range r.tunnels[tunnelID] {
+			clientTunnels[client] = append(clientTunnels[client], tunnelID)
 		}
-		coverSize -= p2p.MessageSize
 	}
+	r.tunnelsLock.RUnlock()
 
-	return nil
+	for _, client := range clients {
+		roundClient, ok := client.(RoundClient)
+		if !ok {
+			continue
+		}
+		if notifyErr := roundClient.SendRound(round, clientTunnels[client]); notifyErr != nil {
+			r.terminateClient(client)
+		}
+	}
 }
 
-// sendMsgToAPI sends a api.Message to all api.Connection that are registered for the given tunnel ID
-func (r *Router) sendMsgToAPI(tunnelID uint32, msg api.Message) (err error) {
-	r.tunnelsLock.Lock()
-	apiConns, ok := r.tunnels[tunnelID]
-	r.tunnelsLock.Unlock()
+// notifyClients calls notify for all clients that are registered for the given tunnel ID.
+// Clients for which notify fails are terminated and removed.
+func (r *Router) notifyClients(tunnelID uint32, notify func(client Client) error) (err error) {
+	r.tunnelsLock.RLock()
+	clients, ok := r.tunnels[tunnelID]
+	clients = append([]Client(nil), clients...)
+	r.tunnelsLock.RUnlock()
 	if !ok {
 		return ErrInvalidTunnel
 	}
-	for _, apiConn := range apiConns {
-		sendError := apiConn.Send(msg)
-		log.Printf("Sent message to API")
-		if sendError != nil {
-			sendError = apiConn.Terminate()
-			if sendError != nil {
-				log.Printf("Error terminating API conn: %v\n", sendError)
-			}
-			removeErr := r.RemoveAPIConnection(apiConn)
-			if removeErr != nil {
-				log.Printf("Error removing API conn: %v\n", removeErr)
-			}
+	for _, client := range clients {
+		if notifyErr := notify(client); notifyErr != nil {
+			r.terminateClient(client)
 		}
 	}
 
 	return nil
 }
 
-// sendMsgToAllAPI broadcasts an api.Message to all api.Connection which are known to the Router.
-// Useful for announcing incoming onion tunnels.
-func (r *Router) sendMsgToAllAPI(msg api.Message) (err error) {
-	r.apiConnectionsLock.Lock()
-	apiConns := r.apiConnections
-	r.apiConnectionsLock.Unlock()
+// notifyAllClients calls notify for all clients which are known to the Router and subscribed to the given
+// notifications, see SubscribingClient. Useful for announcing incoming onion tunnels.
+func (r *Router) notifyAllClients(subs Subscriptions, notify func(client Client) error) {
+	for _, client := range r.subscribedClients(subs) {
+		if notifyErr := notify(client); notifyErr != nil {
+			r.terminateClient(client)
+		}
+	}
+}
 
-	for _, apiConn := range apiConns {
-		sendError := apiConn.Send(msg)
-		if sendError != nil {
-			sendError = apiConn.Terminate()
-			if sendError != nil {
-				log.Printf("Error terminating API conn: %v\n", sendError)
-			}
-			removeErr := r.RemoveAPIConnection(apiConn)
-			if removeErr != nil {
-				log.Printf("Error removing API conn: %v\n", removeErr)
-			}
+// subscribedClients returns the clients which are known to the Router and subscribed to the given notifications.
+func (r *Router) subscribedClients(subs Subscriptions) (clients []Client) {
+	r.clientsLock.Lock()
+	defer r.clientsLock.Unlock()
+
+	for _, client := range r.clients {
+		if subscribed(client, subs) {
+			clients = append(clients, client)
 		}
 	}
+	return clients
+}
 
-	return nil
+// terminateClient terminates an unreachable client and unregisters it from the router.
+func (r *Router) terminateClient(client Client) {
+	err := client.Terminate()
+	if err != nil {
+		r.logger.Printf("Error terminating client: %v\n", err)
+	}
+	err = r.RemoveClient(client)
+	if err != nil {
+		r.logger.Printf("Error removing client: %v\n", err)
+	}
 }
 
-// sendDataToAPI is a convenience function to send application data received on a tunnel back to all API connections
+// sendDataToClients is a convenience function to send application data received on a tunnel to all clients
 // that are registered for this tunnel.
-func (r *Router) sendDataToAPI(tunnelID uint32, data []byte) (err error) {
-	apiMessage := api.OnionTunnelData{
-		TunnelID: tunnelID,
-		Data:     data,
+func (r *Router) sendDataToClients(tunnelID uint32, data []byte) (err error) {
+	// currently, we only only get an error if the tunnel ID is invalid
+	return r.notifyClients(tunnelID, func(client Client) error {
+		if !subscribed(client, SubscribeData) {
+			return nil
+		}
+		return client.SendTunnelData(tunnelID, data)
+	})
+}
+
+// announceSegment announces an incoming tunnel to all clients, unless it was announced before, and returns the ID of
+// the tunnel known to the clients.
+func (r *Router) announceSegment(tunnel *tunnelSegment) (tunnelID uint32, err error) {
+	r.tunnelsLock.RLock()
+	tunnelID = tunnel.tunnelID
+	_, announced := r.incomingTunnels[tunnelID]
+	r.tunnelsLock.RUnlock()
+	if announced {
+		return tunnelID, nil
 	}
 
-	// currently, we only only get an error if the tunnel ID is invalid
-	err = r.sendMsgToAPI(tunnelID, &apiMessage)
-	return err
+	return tunnelID, r.RegisterIncomingConnection(tunnel)
 }
 
-// RegisterIncomingConnection takes care of tracking the state of an incoming tunnel and announcing it to all API connections.
+// RegisterIncomingConnection takes care of tracking the state of an incoming tunnel and announcing it to all clients
+// subscribed to incoming tunnels.
 func (r *Router) RegisterIncomingConnection(tunnel *tunnelSegment) (err error) {
 	r.tunnelsLock.Lock()
 
-	if _, ok := r.tunnels[tunnel.prevHopTunnelID]; !ok {
+	tunnelID := tunnel.tunnelID
+	if _, ok := r.tunnels[tunnelID]; !ok {
 		r.tunnelsLock.Unlock()
 		return ErrInvalidTunnel
 	}
 
-	r.apiConnectionsLock.Lock()
-	r.tunnels[tunnel.prevHopTunnelID] = make([]*api.Connection, len(r.apiConnections))
-	copy(r.tunnels[tunnel.prevHopTunnelID], r.apiConnections)
-	r.apiConnectionsLock.Unlock()
-	r.incomingTunnels[tunnel.prevHopTunnelID] = tunnel
+	r.tunnels[tunnelID] = r.subscribedClients(SubscribeIncoming)
+	r.incomingTunnels[tunnelID] = tunnel
 
 	r.tunnelsLock.Unlock()
 
-	incomingMsg := api.OnionTunnelIncoming{
-		TunnelID: tunnel.prevHopTunnelID,
-	}
+	r.events.publish(Event{
+		Type:     EventTunnelIncoming,
+		TunnelID: tunnelID,
+	})
 
-	return r.sendMsgToAllAPI(&incomingMsg)
+	return nil
 }
 
-// RemoveAPIConnection unregisters an api.Connection from the router and all existing tunnels.
-func (r *Router) RemoveAPIConnection(apiConn *api.Connection) (err error) {
+// RemoveClient unregisters a Client from the router and all existing tunnels.
+func (r *Router) RemoveClient(client Client) (err error) {
+	r.tunnelsLock.RLock()
+	tunnelIDs := make([]uint32, 0, len(r.tunnels))
 	for tunnelID := range r.tunnels {
-		err = r.RemoveAPIConnectionFromTunnel(tunnelID, apiConn)
+		tunnelIDs = append(tunnelIDs, tunnelID)
 	}
+	r.tunnelsLock.RUnlock()
 
-	r.apiConnectionsLock.Lock()
-	for i, conn := range r.apiConnections {
-		if conn == apiConn {
-			r.apiConnections = append(r.apiConnections[:i], r.apiConnections[i+1:]...)
+	for _, tunnelID := range tunnelIDs {
+		err = r.RemoveClientFromTunnel(tunnelID, client)
+	}
+
+	r.clientsLock.Lock()
+	for i, c := range r.clients {
+		if c == client {
+			r.clients = append(r.clients[:i], r.clients[i+1:]...)
 			break
 		}
 	}
-	r.apiConnectionsLock.Unlock()
+	r.clientsLock.Unlock()
 
 	return err
 }
 
-// RemoveAPIConnectionFromTunnel unregisters an api.Connection as a listener on the given tunnel.
-func (r *Router) RemoveAPIConnectionFromTunnel(tunnelID uint32, apiConn *api.Connection) (err error) {
+// RemoveClientFromTunnel unregisters a Client as a listener on the given tunnel.
+func (r *Router) RemoveClientFromTunnel(tunnelID uint32, client Client) (err error) {
 	r.tunnelsLock.Lock()
 	defer r.tunnelsLock.Unlock()
 
@@ -607,41 +1324,82 @@ func (r *Router) RemoveAPIConnectionFromTunnel(tunnelID uint32, apiConn *api.Con
 		return
 	}
 
-	for i, conn := range r.tunnels[tunnelID] {
-		if conn == apiConn {
+	for i, c := range r.tunnels[tunnelID] {
+		if c == client {
 			r.tunnels[tunnelID] = append(r.tunnels[tunnelID][:i], r.tunnels[tunnelID][i+1:]...)
 			break
 		}
 	}
 
-	// If no api.Connection is registered for the tunnel anymore, it will be torn down at the beginning of the next round.
+	// If no Client is registered for the tunnel anymore, it will be torn down at the beginning of the next round.
 
 	return err
 }
 
-// removeUnusedTunnels checks all tunnels if they still have associated API connections. If not, they are destructed.
+// removeUnusedTunnels checks all tunnels if they still have associated clients. If not, they are destructed.
 func (r *Router) removeUnusedTunnels() {
-	r.tunnelsLock.Lock()
+	var unused []uint32
+	r.tunnelsLock.RLock()
 	for tunnelID, conns := range r.tunnels {
-		if len(conns) == 0 {
-			if outgoingTunnel, ok := r.outgoingTunnels[tunnelID]; ok {
-				_ = outgoingTunnel.Close()
-				delete(r.outgoingTunnels, tunnelID)
-				delete(r.tunnels, tunnelID)
-			} else if incomingTunnel, ok := r.incomingTunnels[tunnelID]; ok {
-				_ = incomingTunnel.Close()
-				delete(r.incomingTunnels, tunnelID)
-				delete(r.tunnels, tunnelID)
-			}
+		if len(conns) != 0 {
+			continue
+		}
+		_, isOutgoing := r.outgoingTunnels[tunnelID]
+		_, isIncoming := r.incomingTunnels[tunnelID]
+		_, isLoopback := r.loopbacks[tunnelID]
+		if isOutgoing || isIncoming || isLoopback {
+			unused = append(unused, tunnelID)
+		}
+	}
+	r.tunnelsLock.RUnlock()
+
+	// announce the teardown while the tunnel state is still available to subscribers, like RemoveTunnel does
+	for _, tunnelID := range unused {
+		r.events.publish(Event{
+			Type:     EventTunnelDestroyed,
+			TunnelID: tunnelID,
+		})
+	}
+
+	var orphaned []uint32 // other ends of removed loopback tunnels, which are closed for their clients
+	r.tunnelsLock.Lock()
+	for _, tunnelID := range unused {
+		if conns, ok := r.tunnels[tunnelID]; !ok || len(conns) != 0 {
+			continue // closed or adopted by a client meanwhile
+		}
+		if outgoingTunnel, ok := r.outgoingTunnels[tunnelID]; ok {
+			_ = outgoingTunnel.Close()
+			delete(r.outgoingTunnels, tunnelID)
+			delete(r.tunnels, tunnelID)
+		} else if incomingTunnel, ok := r.incomingTunnels[tunnelID]; ok {
+			_ = incomingTunnel.Close()
+			delete(r.incomingTunnels, tunnelID)
+			delete(r.tunnels, tunnelID)
+		} else if otherEnd, ok := r.removeLoopback(tunnelID); ok {
+			orphaned = append(orphaned, otherEnd)
 		}
 	}
 	r.tunnelsLock.Unlock()
+
+	for _, tunnelID := range orphaned {
+		_ = r.CloseTunnel(tunnelID)
+	}
+}
+
+// randomUint32 draws a random number from the Router's source of randomness, e.g. for IDs.
+func (r *Router) randomUint32() uint32 {
+	var buf [4]byte
+	_, err := io.ReadFull(r.rand, buf[:])
+	if err != nil {
+		// IDs merely need to be unique, which the callers ensure
+		return mathRand.Uint32() //nolint:gosec // pseudo-rand is good enough
+	}
+	return binary.BigEndian.Uint32(buf[:])
 }
 
-// newTunnelID generates a new, non-existing unique tunnel ID
+// newTunnelID generates a new, non-existing unique tunnel ID known to the clients
 func (r *Router) newTunnelID() (tunnelID uint32) {
-	random := mathRand.New(mathRand.NewSource(time.Now().UnixNano())) //nolint:gosec // pseudo-rand is good enough. We just need uniqueness.
-	tunnelID = random.Uint32()
+	tunnelID = r.randomUint32()
 
 	r.tunnelsLock.Lock()
 	defer r.tunnelsLock.Unlock()
@@ -649,215 +1407,687 @@ func (r *Router) newTunnelID() (tunnelID uint32) {
 	// ensure that tunnelID is unique
 	for {
 		if _, ok := r.tunnels[tunnelID]; ok {
-			tunnelID = random.Uint32() // non unique tunnel ID
+			tunnelID = r.randomUint32() // non unique tunnel ID
 			continue
 		}
 		break
 	}
 
-	r.tunnels[tunnelID] = make([]*api.Connection, 0)
+	r.tunnels[tunnelID] = make([]Client, 0)
 
 	return tunnelID
 }
 
+// newCircuitID generates a new, non-existing unique circuit ID used on the links, which is released again via
+// releaseCircuit.
+func (r *Router) newCircuitID() (circuitID uint32) {
+	circuitID = r.randomUint32()
+
+	r.tunnelsLock.Lock()
+	defer r.tunnelsLock.Unlock()
+
+	// ensure that circuitID is unique
+	for {
+		if _, ok := r.circuits[circuitID]; ok || circuitID == p2p.LinkTunnelID {
+			circuitID = r.randomUint32() // non unique circuit ID
+			continue
+		}
+		break
+	}
+
+	r.circuits[circuitID] = struct{}{}
+
+	return circuitID
+}
+
+// releaseCircuit unregisters a terminated circuit from all links and releases its ID.
+func (r *Router) releaseCircuit(circuitID uint32) {
+	r.removeTunnelFromLinks(circuitID)
+
+	r.tunnelsLock.Lock()
+	delete(r.circuits, circuitID)
+	r.tunnelsLock.Unlock()
+}
+
+// addLink adds a Link to the Router state.
+func (r *Router) addLink(link *Link) {
+	key := newLinkKey(link.address, link.port)
+
+	r.linksLock.Lock()
+	link.key = key
+	r.links[key] = append(r.links[key], link)
+	r.numLinks++
+	if link.incoming {
+		r.numIncoming++
+	}
+	r.linksLock.Unlock()
+}
+
 // removeLink removes a Link from the Router state
 func (r *Router) removeLink(link *Link) {
 	r.linksLock.Lock()
-	defer r.linksLock.Unlock()
+	found := r.unindexLink(link)
+	if found {
+		r.numLinks--
+		if link.incoming {
+			r.numIncoming--
+		}
+
+		// the circuits of the link are released by their handlers, which must not find the link anymore
+		for _, circuitID := range link.tunnelIDs() {
+			if r.circuitLinks[circuitID] == link {
+				delete(r.circuitLinks, circuitID)
+			}
+		}
+		delete(r.idleLinks, link)
+	}
+	r.linksLock.Unlock()
 
-	for i, ln := range r.links {
+	if found {
+		r.events.publish(Event{
+			Type:    EventLinkDown,
+			Address: link.address,
+			Port:    link.port,
+		})
+	}
+}
+
+// unindexLink removes a Link from r.links, returning false if it was not found, i.e. removed already.
+// Must be called with r.linksLock hold.
+func (r *Router) unindexLink(link *Link) (found bool) {
+	key := link.key // incoming links are moved once the peer identified itself, see identifyLink
+	links := r.links[key]
+	for i, ln := range links {
 		if ln == link {
-			r.links = append(r.links[:i], r.links[i+1:]...)
+			links = append(links[:i], links[i+1:]...)
+			found = true
 			break
 		}
 	}
+	if !found {
+		return false
+	}
+
+	if len(links) == 0 {
+		delete(r.links, key)
+	} else {
+		r.links[key] = links
+	}
+	return true
 }
 
-// RemoveTunnel completely unregisters a tunnel from the router closing associated links if no tunnel uses them anymore
-// and shutting down all tunnel handler routines.
+// RemoveTunnel completely unregisters a tunnel known to the clients from the router. The circuits carrying the tunnel
+// are released by their handlers, see releaseCircuit.
 func (r *Router) RemoveTunnel(tunnelID uint32) (err error) {
-	r.tunnelsLock.Lock()
+	r.tunnelsLock.RLock()
 	_, ok := r.tunnels[tunnelID]
-	r.tunnelsLock.Unlock()
+	_, isOutgoing := r.outgoingTunnels[tunnelID]
+	_, isIncoming := r.incomingTunnels[tunnelID]
+	_, isLoopback := r.loopbacks[tunnelID]
+	r.tunnelsLock.RUnlock()
 	if !ok {
 		return
 	}
 
-	r.linksLock.Lock()
-	for _, link := range r.links {
-		if link.hasTunnel(tunnelID) {
-			link.removeTunnel(tunnelID)
-			if link.isUnused() {
-				link.Close()
-			}
-		}
+	// announce the teardown while the tunnel state is still available to subscribers
+	if isOutgoing || isIncoming || isLoopback {
+		r.events.publish(Event{
+			Type:     EventTunnelDestroyed,
+			TunnelID: tunnelID,
+		})
 	}
-	r.linksLock.Unlock()
+	r.tunnelsLock.Lock()
+	delete(r.tunnels, tunnelID)
+	delete(r.outgoingTunnels, tunnelID)
+	delete(r.incomingTunnels, tunnelID)
+	otherEnd, isLoopback := r.removeLoopback(tunnelID)
+	r.tunnelsLock.Unlock()
+
+	if isLoopback {
+		err = r.CloseTunnel(otherEnd)
+	}
+	return err
+}
+
+// CloseTunnel tears down a tunnel known to the clients right away, regardless of whether any clients still use it.
+// The clients are notified about the teardown.
+func (r *Router) CloseTunnel(tunnelID uint32) (err error) {
+	r.tunnelsLock.RLock()
+	_, ok := r.tunnels[tunnelID]
+	r.tunnelsLock.RUnlock()
+	if !ok {
+		return ErrInvalidTunnel
+	}
+
+	// announce the teardown while the clients are still registered for the tunnel
+	r.events.publish(Event{
+		Type:     EventTunnelDestroyed,
+		TunnelID: tunnelID,
+	})
 
 	r.tunnelsLock.Lock()
+	outgoingTunnel, isOutgoing := r.outgoingTunnels[tunnelID]
+	incomingTunnel, isIncoming := r.incomingTunnels[tunnelID]
 	delete(r.tunnels, tunnelID)
 	delete(r.outgoingTunnels, tunnelID)
 	delete(r.incomingTunnels, tunnelID)
+	otherEnd, isLoopback := r.removeLoopback(tunnelID)
 	r.tunnelsLock.Unlock()
 
+	if isOutgoing {
+		err = outgoingTunnel.Close()
+	} else if isIncoming {
+		err = incomingTunnel.Close()
+	} else if isLoopback {
+		err = r.CloseTunnel(otherEnd)
+	}
 	return err
 }
 
+// registerCircuit registers the output data channel of a circuit with the given link, indexing the link by the
+// circuit ID, see removeTunnelFromLinks.
+func (r *Router) registerCircuit(link *Link, circuitID uint32, dataOut chan message) (err error) {
+	r.linksLock.Lock()
+	defer r.linksLock.Unlock()
+
+	// a closed link is about to be removed, which would miss the index entry of the circuit
+	if link.isClosed() {
+		return ErrLinkClosed
+	}
+
+	err = link.register(circuitID, dataOut)
+	if err != nil {
+		return err
+	}
+
+	r.circuitLinks[circuitID] = link
+	delete(r.idleLinks, link)
+	link.idleSince = time.Time{}
+
+	return nil
+}
+
+// removeTunnelFromLinks unregisters a circuit from its link. Links which are not used by any circuit anymore are kept
+// open for reuse according to the link pool policy, see closeIdleLinks.
+func (r *Router) removeTunnelFromLinks(circuitID uint32) {
+	r.linksLock.Lock()
+	defer r.linksLock.Unlock()
+
+	link, ok := r.circuitLinks[circuitID]
+	if !ok {
+		return
+	}
+	delete(r.circuitLinks, circuitID)
+
+	link.removeTunnel(circuitID)
+	r.idleLink(link)
+	r.closeIdleLinks()
+}
+
+// releaseLink keeps the given link open for reuse if no tunnel uses it, e.g. after it was only used for a link
+// message, like after the last tunnel of a link was removed.
+func (r *Router) releaseLink(link *Link) {
+	r.linksLock.Lock()
+	defer r.linksLock.Unlock()
+
+	if link.isClosed() {
+		return
+	}
+	r.idleLink(link)
+	r.closeIdleLinks()
+}
+
+// idleLink marks the given link as idle if no tunnel uses it, see closeIdleLinks. Unused retired links are closed
+// right away.
+// Must be called with r.linksLock hold.
+func (r *Router) idleLink(link *Link) {
+	if link.isUnused() && link.retired {
+		link.Close()
+	} else if link.isUnused() {
+		link.idleSince = r.clock.Now()
+		r.idleLinks[link] = struct{}{}
+	}
+}
+
 // CreateLink opens a new Link connection to the give peer and starts the Link handler routine.
 func (r *Router) CreateLink(address net.IP, port uint16) (link *Link, err error) {
-	link, err = newLink(address, port)
+	if !r.admitLink() {
+		return nil, ErrTooManyLinks
+	}
+
+	link, err = newLink(r.transport, address, port)
 	if err != nil {
 		return nil, err
 	}
+	link.packer.Rand = r.rand
+	link.faults = &r.faults
 
-	r.linksLock.Lock()
-	r.links = append(r.links, link)
-	r.linksLock.Unlock()
+	r.addLink(link)
+
+	r.events.publish(Event{
+		Type:    EventLinkUp,
+		Address: link.address,
+		Port:    link.port,
+	})
 
 	go r.handleLink(link)
 
 	return link, nil
 }
 
-// CreateLinkFromExistingConn adds an existing TLS connection to the Router state and starts the Link handler routine.
+// CreateLinkFromExistingConn adds an existing connection to the Router state and starts the Link handler routine.
+// The connection is closed if the maximum number of links is reached.
 func (r *Router) CreateLinkFromExistingConn(conn net.Conn) (link *Link, err error) {
-	link = newLinkFromExistingConn(conn)
+	if !r.admitIncomingLink() {
+		_ = conn.Close()
+		return nil, ErrTooManyLinks
+	}
+
+	link, err = newLinkFromExistingConn(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	link.packer.Rand = r.rand
+	link.faults = &r.faults
+
+	r.addLink(link)
 
+	r.events.publish(Event{
+		Type:    EventLinkUp,
+		Address: link.address,
+		Port:    link.port,
+	})
+
+	go r.handleLink(link)
+
+	return link, nil
+}
+
+// GetLink checks if a Link exists to the given peer which can carry another tunnel and returns it. Links already
+// carrying the configured max. number of tunnels are skipped. If none exists will return nil, false.
+func (r *Router) GetLink(address net.IP, port uint16) (link *Link, ok bool) {
 	r.linksLock.Lock()
-	r.links = append(r.links, link)
-	r.linksLock.Unlock()
+	defer r.linksLock.Unlock()
+
+	for _, link := range r.links[newLinkKey(address, port)] {
+		if link.isClosed() || link.retired {
+			continue
+		}
+		if r.cfg.MaxLinkTunnels > 0 && link.numTunnels() >= r.cfg.MaxLinkTunnels {
+			continue
+		}
+		delete(r.idleLinks, link)
+		link.idleSince = time.Time{}
+		return link, true
+	}
+
+	return nil, false
+}
+
+// GetOrCreateLink returns a Link to the given peer creating a new one if none exists or all existing ones are full.
+func (r *Router) GetOrCreateLink(address net.IP, port uint16) (link *Link, err error) {
+	link, ok := r.GetLink(address, port)
+	if ok {
+		return link, nil
+	}
+
+	return r.CreateLink(address, port)
+}
+
+// idleTicker returns a ticker channel for periodically checking whether a tunnel exceeded the configured idle timeout.
+// If the idle timeout is disabled, the returned channel is nil and thus never delivers a tick.
+// The returned stop function must be called to release the ticker.
+func (r *Router) idleTicker() (c <-chan time.Time, stop func()) {
+	if r.cfg.IdleTimeout <= 0 {
+		return nil, func() {}
+	}
+
+	// checking four times per period keeps the expiry reasonably close to the configured timeout
+	ticker := r.clock.NewTicker(r.idleTimeout() / 4)
+	return ticker.C(), ticker.Stop
+}
+
+// idleTimeout returns the configured idle timeout as a time.Duration.
+func (r *Router) idleTimeout() time.Duration {
+	return time.Duration(r.cfg.IdleTimeout) * time.Second
+}
+
+// handleOutgoingTunnel is a goroutine handling all traffic for a Tunnel that was initiated by this peer until it is
+// torn down or the Router shuts down. It is started via startTunnelHandler, which registered it with r.handlers.
+func (r *Router) handleOutgoingTunnel(tunnel *Tunnel) {
+	// It is assumed that the handshake with the peers is completed and the tunnel is fully initiated at this point!
+	// On shutdown the circuit is kept, such that the tunnel is restored on the next start, see Shutdown.
+	shutdown := false
+	defer func() {
+		if !shutdown {
+			r.removeCircuit(tunnel)
+		}
+	}()
+	defer r.handlers.done(tunnel)
+	defer tunnel.span.Finish(nil)
+
+	dataOut, ok := tunnel.link.getDataOut(tunnel.circuitID)
+	if !ok {
+		r.logger.Printf("Failed to get data channel for outgoing tunnel %v\n", tunnel.id)
+		return
+	}
+
+	stopDatagrams := r.startDatagramSender(&tunnel.datagrams, func(msg p2p.RelayMessage) error {
+		return tunnel.sendRelayToLastHop(msg)
+	})
+	defer stopDatagrams()
+
+	idleCheck, stopIdleCheck := r.idleTicker()
+	defer stopIdleCheck()
+	keepaliveCheck, stopKeepaliveCheck := r.keepaliveTicker()
+	defer stopKeepaliveCheck()
+
+	var buffered []message // relay messages received on a rebuilt circuit while the old one is drained
+	for {
+		select {
+		case msg, channelOpen := <-dataOut:
+			if !channelOpen {
+				return
+			}
+
+			// data received on the rebuilt circuit must not overtake data still in flight on the old one
+			if tunnel.draining != nil && msg.hdr.Type == p2p.TypeTunnelRelay {
+				if len(buffered) >= maxHandoverBuffer {
+					r.logger.Printf("Too many messages on rebuilt outgoing tunnel %v while draining\n", tunnel.id)
+					_ = tunnel.destroyHops(len(tunnel.hops))
+					return
+				}
+				buffered = append(buffered, msg)
+				continue
+			}
+
+			if r.handleOutgoingTunnelMsg(tunnel, msg) {
+				return
+			}
+
+		case <-tunnel.draining:
+			tunnel.draining = nil
+			for _, msg := range buffered {
+				if r.handleOutgoingTunnelMsg(tunnel, msg) {
+					return
+				}
+			}
+			buffered = nil
+
+		case <-idleCheck:
+			if tunnel.activity.idle(r.clock.Now()) >= r.idleTimeout() {
+				// the teardown is announced to the clients when removing the tunnel
+				r.logger.Printf("Tearing down idle outgoing tunnel %v\n", tunnel.id)
+				_ = tunnel.destroyHops(len(tunnel.hops))
+				return
+			}
+
+		case <-keepaliveCheck:
+			if tunnel.activity.idle(r.clock.Now()) >= r.keepalive() {
+				r.checkAlive(tunnel)
+			}
+
+		case <-tunnel.link.Quit:
+			return
+
+		case <-tunnel.quit:
+			return
+
+		case <-r.handlers.quit:
+			shutdown = true
+			return
+		}
+	}
+}
+
+// handleOutgoingTunnelMsg processes a message received on an outgoing tunnel.
+// Returns true if the tunnel handler must stop.
+func (r *Router) handleOutgoingTunnelMsg(tunnel *Tunnel, msg message) (stop bool) {
+	hdr := msg.hdr
+	switch hdr.Type {
+	case p2p.TypeTunnelRelay:
+		relayHdr, decryptedRelayMsg, hop, ok, err := tunnel.decryptRelayMessageFromHop(msg.body)
+		if err != nil {
+			r.logger.Printf("Error decrypting relay message on outgoing tunnel %v\n", tunnel.id)
+			return true
+		}
+		defer wipe(decryptedRelayMsg) // the parsed messages hold copies of the payload
+
+		// a hop tore down its tunnel segment, the hops in front of it must follow.
+		// The destroy may come from any hop, which do not share the counter checked below. Since the tunnel
+		// is torn down anyway, a replayed destroy can not do any harm.
+		if ok && relayHdr.RelayType == p2p.RelayTypeTunnelDestroy {
+			r.logger.Printf("Hop %d tore down outgoing tunnel %v\n", hop, tunnel.id)
+			_ = tunnel.destroyHops(hop)
+			return true
+		}
+
+		// a hop dropped the tunnel, e.g. since it exceeded the hop's quota. Like destroys, the error may come from any
+		// hop. The hop tears down its tunnel segment right after.
+		if ok && relayHdr.RelayType == p2p.RelayTypeTunnelError {
+			errorMsg := p2p.RelayTunnelError{}
+			if errorMsg.Parse(decryptedRelayMsg) == nil {
+				r.logger.Printf("Hop %d dropped outgoing tunnel %v: %v\n", hop, tunnel.id, errorMsg.Reason)
+			}
+			_ = tunnel.destroyHops(hop)
+			return true
+		}
+
+		if !ok {
+			// we received a non-decryptable relay message, tear down the tunnel
+			r.logger.Printf("Received un-decryptable relay message on outgoing tunnel %v\n", tunnel.id)
+			_ = tunnel.destroyHops(len(tunnel.hops))
+			// in case of an error here we cannot really do much apart from tearing down the tunnel anyway
+			return true
+		}
+
+		// message is meant for us from a hop
+		// replay protection
+		if relayHdr.GetCounter() <= tunnel.recvCounter {
+			r.logger.Printf("Received message with invalid counter. Terminating tunnel.")
+			return true
+		}
+
+		// update message counter
+		tunnel.recvCounter = relayHdr.GetCounter()
+		tunnel.traffic.receivedCell(relayHdr.RelayType)
+
+		switch relayHdr.RelayType {
+		case p2p.RelayTypeTunnelData:
+			tunnel.activity.touch(r.clock.Now())
+
+			dataMsg := p2p.RelayTunnelData{}
+			err = dataMsg.Parse(decryptedRelayMsg)
+			if err != nil {
+				r.logger.Printf("Error parsing relay data message on outgoing tunnel %v\n", tunnel.id)
+				return true
+			}
+			tunnel.traffic.receivedBytes(len(dataMsg.Data))
+
+			err = r.sendDataToClients(tunnel.id, dataMsg.Data)
+			if err != nil {
+				r.logger.Printf("Error sending incoming data to clients for outgoing tunnel %v\n", tunnel.id)
+				return true
+			}
+
+		case p2p.RelayTypeTunnelBatch:
+			tunnel.activity.touch(r.clock.Now())
+
+			batchMsg := p2p.RelayTunnelBatch{}
+			err = batchMsg.Parse(decryptedRelayMsg)
+			if err != nil {
+				r.logger.Printf("Error parsing relay batch message on outgoing tunnel %v\n", tunnel.id)
+				return true
+			}
+			for _, payload := range batchMsg.Payloads {
+				tunnel.traffic.receivedBytes(len(payload))
+			}
+
+			err = r.deliverBatch(tunnel.id, &batchMsg)
+			if err != nil {
+				r.logger.Printf("Error sending incoming data to clients for outgoing tunnel %v\n", tunnel.id)
+				return true
+			}
+
+		case p2p.RelayTypeTunnelDatagram:
+			tunnel.activity.touch(r.clock.Now())
+
+			datagramMsg := p2p.RelayTunnelDatagram{}
+			err = datagramMsg.Parse(decryptedRelayMsg)
+			if err != nil {
+				r.logger.Printf("Error parsing relay datagram message on outgoing tunnel %v\n", tunnel.id)
+				return true
+			}
+			tunnel.traffic.receivedBytes(len(datagramMsg.Data))
+
+			err = r.sendDatagramToClients(tunnel.id, datagramMsg.Data)
+			if err != nil {
+				r.logger.Printf("Error sending incoming datagram to clients for outgoing tunnel %v\n", tunnel.id)
+				return true
+			}
+
+		case p2p.RelayTypeTunnelSeqData:
+			tunnel.activity.touch(r.clock.Now())
+
+			seqDataMsg := p2p.RelayTunnelSeqData{}
+			err = seqDataMsg.Parse(decryptedRelayMsg)
+			if err != nil || tunnel.stream == nil || seqDataMsg.Stream != tunnel.stream.id {
+				r.logger.Printf("Received invalid sequenced data message on outgoing tunnel %v\n", tunnel.id)
+				return true
+			}
+			tunnel.traffic.receivedBytes(len(seqDataMsg.Data))
+
+			err = tunnel.stream.receive(&seqDataMsg, func(data []byte) error {
+				return r.sendDataToClients(tunnel.id, data)
+			})
+			if err != nil {
+				r.logger.Printf("Error sending incoming data to clients for outgoing tunnel %v\n", tunnel.id)
+				return true
+			}
+
+		case p2p.RelayTypeTunnelAck:
+			ackMsg := p2p.RelayTunnelAck{}
+			err = ackMsg.Parse(decryptedRelayMsg)
+			if err != nil || tunnel.stream == nil || ackMsg.Stream != tunnel.stream.id {
+				r.logger.Printf("Received invalid acknowledgement on outgoing tunnel %v\n", tunnel.id)
+				return true
+			}
+
+			tunnel.stream.ack(ackMsg.Seq)
+
+		case p2p.RelayTypeTunnelEOF:
+			err = r.sendEOFToClients(tunnel.id)
+			if err != nil {
+				r.logger.Printf("Error announcing EOF to clients for outgoing tunnel %v\n", tunnel.id)
+				return true
+			}
+
+		case p2p.RelayTypeTunnelMigrate:
+			migrateMsg := p2p.RelayTunnelMigrate{}
+			err = migrateMsg.Parse(decryptedRelayMsg)
+			if err != nil || !r.finishHandover(tunnel, &migrateMsg) {
+				r.logger.Printf("Received invalid migrate message on outgoing tunnel %v\n", tunnel.id)
+				return true
+			}
+
+			// the old circuit is drained, the tunnel lives on in the rebuilt circuit
+			_ = tunnel.destroyHops(len(tunnel.hops))
+			return true
+
+		case p2p.RelayTypeTunnelCover:
+			coverMsg := p2p.RelayTunnelCover{}
+			err = coverMsg.Parse(decryptedRelayMsg)
+			if err != nil || coverMsg.Ping || hop != len(tunnel.hops)-1 {
+				r.logger.Printf("Received invalid cover message on outgoing tunnel %v\n", tunnel.id)
+				return true
+			}
+
+			// pongs answering cover traffic are dropped if nobody waits for them
+			select {
+			case tunnel.pongs <- struct{}{}:
+			default:
+			}
 
-	go r.handleLink(link)
+		case p2p.RelayTypeTunnelConnected:
+			r.events.publish(Event{
+				Type:     EventExitConnected,
+				TunnelID: tunnel.id,
+			})
 
-	return link, nil
-}
+		case p2p.RelayTypeTunnelEnd:
+			endMsg := p2p.RelayTunnelEnd{}
+			err = endMsg.Parse(decryptedRelayMsg)
+			if err != nil {
+				r.logger.Printf("Error parsing relay end message on outgoing tunnel %v\n", tunnel.id)
+				return true
+			}
 
-// GetLink checks if a Link exists to the given peer and returns it. If none exists will return nil, false.
-func (r *Router) GetLink(address net.IP, port uint16) (link *Link, ok bool) {
-	r.linksLock.Lock()
-	defer r.linksLock.Unlock()
+			r.events.publish(Event{
+				Type:      EventExitClosed,
+				TunnelID:  tunnel.id,
+				EndReason: endMsg.Reason,
+			})
 
-	for _, link := range r.links {
-		if link.address.Equal(address) && link.port == port {
-			return link, true
+		default:
+			r.logger.Printf("Received invalid subtype of relay message on outgoing tunnel %v\n", tunnel.id)
+			return true
 		}
-	}
 
-	return nil, false
-}
+	case p2p.TypeTunnelDestroy:
+		// the first hop tore down its tunnel segment. Since we are the end of the tunnel we don't need to pass
+		// the destroy message along we just need to gracefully tear down our tunnel. The teardown is announced
+		// to the clients when removing the tunnel.
+		return true
 
-// GetOrCreateLink returns a Link to the given peer creating a new one if none exists.
-func (r *Router) GetOrCreateLink(address net.IP, port uint16) (link *Link, err error) {
-	link, ok := r.GetLink(address, port)
-	if ok {
-		return link, nil
+	default: // since we assume the circuit to be fully built we cannot accept any other message
+		r.logger.Printf("Received invalid message on outgoing tunnel %v\n", tunnel.id)
+		return true
 	}
 
-	return r.CreateLink(address, port)
+	return false
 }
 
-// HandleOutgoingTunnel is a goroutine handling all traffic for a Tunnel that was initiated by this peer.
-func (r *Router) HandleOutgoingTunnel(tunnel *Tunnel) {
-	// This is the handler go routine for outgoing tunnels that we initiated.
-	// It is assumed that the handshake with the peers is completed and the tunnel is fully initiated at this point!
-	defer func() {
-		err := r.RemoveTunnel(tunnel.id)
+// handleSegmentData passes data received on an incoming tunnel to the exit connection if we act as exit for the tunnel,
+// or to the clients otherwise.
+func (r *Router) handleSegmentData(tunnel *tunnelSegment, data []byte) (err error) {
+	tunnel.traffic.receivedBytes(len(data))
+
+	// if we act as exit for this tunnel, the data is meant for the exit connection
+	var isExit bool
+	isExit, err = r.writeToExit(tunnel, data)
+	if isExit {
 		if err != nil {
-			log.Printf("Error removing tunnel from link with ID %v: %v\n", tunnel.id, err)
+			r.closeExit(tunnel)
+			return tunnel.sendRelayToPrevHop(&p2p.RelayTunnelEnd{Reason: p2p.EndReasonDone})
 		}
-	}()
-
-	dataOut, ok := tunnel.link.getDataOut(tunnel.id)
-	if !ok {
-		log.Printf("Failed to get data channel for outgoing tunnel %v\n", tunnel.id)
-		return
+		return nil
 	}
 
-	for {
-		select {
-		case msg, channelOpen := <-dataOut:
-			if !channelOpen {
-				return
-			}
-
-			hdr := msg.hdr
-			switch hdr.Type {
-			case p2p.TypeTunnelRelay:
-				relayHdr, decryptedRelayMsg, ok, err := tunnel.DecryptRelayMessage(msg.body)
-				if err != nil {
-					log.Printf("Error decrypting relay message on outgoing tunnel %v\n", tunnel.id)
-					return
-				}
-
-				if ok { // message is meant for us from a hop
-					// replay protection
-					if relayHdr.GetCounter() <= tunnel.recvCounter {
-						log.Printf("Received message with invalid counter. Terminating tunnel.")
-						return
-					}
-
-					// update message counter
-					tunnel.recvCounter = relayHdr.GetCounter()
-
-					switch relayHdr.RelayType {
-					case p2p.RelayTypeTunnelData:
-						dataMsg := p2p.RelayTunnelData{}
-						err = dataMsg.Parse(decryptedRelayMsg)
-						if err != nil {
-							log.Printf("Error parsing relay data message on outgoing tunnel %v\n", tunnel.id)
-							return
-						}
-
-						err = r.sendDataToAPI(hdr.TunnelID, dataMsg.Data)
-						if err != nil {
-							log.Printf("Error sending incoming data to API for outgoing tunnel %v\n", tunnel.id)
-							return
-						}
-
-					default:
-						log.Printf("Received invalid subtype of relay message on outgoing tunnel %v\n", tunnel.id)
-						return
-					}
-				} else {
-					// we received a non-decryptable relay message, tear down the tunnel
-					log.Printf("Received un-decryptable relay message on outgoing tunnel %v\n", tunnel.id)
-					_ = tunnel.link.sendDestroyTunnel(tunnel.id)
-					// in case of an error here we cannot really do much apart from tearing down the tunnel anyway
-					return
-				}
-
-			case p2p.TypeTunnelDestroy:
-				// since we are the end of the tunnel we don't need to pass the destroy message along we just need
-				// to gracefully tear down our tunnel and announce it to the API
-				err := r.sendMsgToAPI(tunnel.ID(), &api.OnionTunnelDestroy{
-					TunnelID: tunnel.ID(),
-				})
-				if err != nil {
-					log.Printf("Error announcing tunnel destroy for ID %v to api %v\n", tunnel.ID(), err)
-				}
-				return
-
-			default: // since we assume the circuit to be fully built we cannot accept any other message
-				log.Printf("Received invalid message on outgoing tunnel %v\n", tunnel.id)
-				return
-			}
-
-		case <-tunnel.link.Quit:
-			return
-		}
+	// we received a valid data packed check if this was the first data message on this tunnel,
+	// if so announce it to the clients as tunnel incoming
+	tunnelID, err := r.announceSegment(tunnel)
+	if err != nil {
+		return err
 	}
+
+	// currently, we only only get an error if the tunnel ID is invalid
+	return r.sendDataToClients(tunnelID, data)
 }
 
 // handleIncomingTunnelRelayMsg processes an incoming p2p.Message of type p2p.TypeTunnelRelay on an incoming tunnel.
 // Handles p2p.RelayTypeTunnelExtend by extending the current tunnel.
-// Handles p2p.RelayTypeTunnelData by passing the received application payload to all registered API connections.
+// Handles p2p.RelayTypeTunnelData by passing the received application payload to all registered clients.
+// Handles p2p.RelayTypeTunnelOpened by announcing the tunnel to all registered clients.
+// Handles p2p.RelayTypeTunnelJoin by adding the tunnel segment to a multipath tunnel.
 func (r *Router) handleIncomingTunnelRelayMsg(buf []byte, dataChanNextHop chan message, tunnel *tunnelSegment, msgHdr *p2p.Header, msgData []byte) (err error) {
 	var ok bool
 	var decryptedRelayMsg []byte
-	ok, decryptedRelayMsg, err = p2p.DecryptRelay(msgData, tunnel.dhShared)
+	ok, decryptedRelayMsg, err = tunnel.cipher.open(msgData, tunnel.recvDigest)
 	if err != nil { // error when decrypting
 		return
 	}
+	defer wipe(decryptedRelayMsg) // the parsed messages hold copies of the payload, relayed messages are copied
 
 	if ok { // relay message is meant for us
 		relayHdr := p2p.RelayHeader{}
@@ -865,60 +2095,149 @@ func (r *Router) handleIncomingTunnelRelayMsg(buf []byte, dataChanNextHop chan m
 		if err != nil {
 			return
 		}
+		var body []byte
+		body, err = relayHdr.Body(decryptedRelayMsg)
+		if err != nil {
+			return
+		}
 
 		// replay protection
 		if relayHdr.GetCounter() <= tunnel.recvCounter {
-			log.Printf("Received message with invalid counter. Terminating tunnel.")
+			r.logger.Printf("Received message with invalid counter. Terminating tunnel.")
 			return
 		}
 
 		// update message counter
 		tunnel.recvCounter = relayHdr.GetCounter()
+		tunnel.traffic.receivedCell(relayHdr.RelayType)
 
 		switch relayHdr.RelayType {
 		case p2p.RelayTypeTunnelData:
 			dataMsg := p2p.RelayTunnelData{}
-			err = dataMsg.Parse(decryptedRelayMsg[p2p.RelayHeaderSize:relayHdr.Size])
+			err = dataMsg.Parse(body)
 			if err != nil {
 				return err
 			}
+			return r.handleSegmentData(tunnel, dataMsg.Data)
 
-			// we received a valid data packed check if this was the first data message on this tunnel,
-			// if so announce it to the API as tunnel incoming
-
-			if _, ok := r.tunnels[msgHdr.TunnelID]; !ok {
-				return ErrInvalidTunnel
+		case p2p.RelayTypeTunnelBatch:
+			batchMsg := p2p.RelayTunnelBatch{}
+			err = batchMsg.Parse(body)
+			if err != nil {
+				return err
 			}
-
-			if len(r.tunnels[msgHdr.TunnelID]) == 0 {
-				err = r.RegisterIncomingConnection(tunnel)
+			for _, payload := range batchMsg.Payloads {
+				err = r.handleSegmentData(tunnel, payload)
 				if err != nil {
 					return err
 				}
 			}
 
-			// currently, we only only get an error if the tunnel ID is invalid
-			err = r.sendDataToAPI(tunnel.prevHopTunnelID, dataMsg.Data)
+		case p2p.RelayTypeTunnelSeqData:
+			seqDataMsg := p2p.RelayTunnelSeqData{}
+			err = seqDataMsg.Parse(body)
+			if err != nil {
+				return err
+			}
+			tunnel.traffic.receivedBytes(len(seqDataMsg.Data))
+
+			var stream *reliableStream
+			stream, err = r.bindStream(tunnel, seqDataMsg.Stream)
+			if err != nil {
+				return err
+			}
+
+			err = stream.receive(&seqDataMsg, func(data []byte) error {
+				return r.receiveStreamData(tunnel, stream, data)
+			})
+			if err != nil {
+				return err
+			}
+
+		case p2p.RelayTypeTunnelAck:
+			ackMsg := p2p.RelayTunnelAck{}
+			err = ackMsg.Parse(body)
+			if err != nil {
+				return err
+			}
+
+			var stream *reliableStream
+			stream, err = r.bindStream(tunnel, ackMsg.Stream)
+			if err != nil {
+				return err
+			}
+			stream.ack(ackMsg.Seq)
+
+		case p2p.RelayTypeTunnelDatagram:
+			datagramMsg := p2p.RelayTunnelDatagram{}
+			err = datagramMsg.Parse(body)
+			if err != nil {
+				return err
+			}
+			tunnel.traffic.receivedBytes(len(datagramMsg.Data))
+
+			// exit connections are streams, datagrams can not be passed on
+			tunnel.exitLock.Lock()
+			isExit := tunnel.exitConn != nil
+			tunnel.exitLock.Unlock()
+			if isExit {
+				return nil
+			}
+
+			var tunnelID uint32
+			tunnelID, err = r.announceSegment(tunnel)
+			if err != nil {
+				return err
+			}
+
+			err = r.sendDatagramToClients(tunnelID, datagramMsg.Data)
 			if err != nil {
 				return err
 			}
 
 		case p2p.RelayTypeTunnelExtend: // this be quite interesting
 			extendMsg := p2p.RelayTunnelExtend{}
-			err = extendMsg.Parse(decryptedRelayMsg[p2p.RelayHeaderSize:relayHdr.Size])
+			err = extendMsg.Parse(body)
+			if err != nil {
+				return err
+			}
+
+			err = r.admitPolicy(&PolicyRequest{
+				Source:     tunnel.prevHopLink.address,
+				SourcePort: tunnel.prevHopLink.port,
+				Extend:     true,
+				Target:     extendMsg.Address,
+				TargetPort: extendMsg.Port,
+			})
 			if err != nil {
 				return err
 			}
 
+			extendSpan := tunnel.span.Child("tunnel.extend")
+			extendSpan.Set("next_hop.address", extendMsg.Address.String())
+			extendSpan.Set("next_hop.port", extendMsg.Port)
+			defer func() {
+				extendSpan.Finish(err)
+			}()
+
+			// loops are refused before connecting to the next hop if possible
+			if r.isOwnAddress(extendMsg.Address, extendMsg.Port) {
+				return r.refuseExtend(tunnel, p2p.ErrorReasonExtendToSelf)
+			}
+
 			var nextLink *Link
 			nextLink, err = r.GetOrCreateLink(extendMsg.Address, extendMsg.Port)
 			if err != nil {
 				return err
 			}
+			if reason, loop := r.extendLoop(tunnel, nextLink); loop {
+				return r.refuseExtend(tunnel, reason)
+			}
 
 			tunnel.nextHopLink = nextLink
-			tunnel.nextHopTunnelID = r.newTunnelID()
-			err = nextLink.register(tunnel.nextHopTunnelID, dataChanNextHop, false)
+			tunnel.nextHopTunnelID = r.newCircuitID()
+			extendSpan.Set("next_hop.circuit.id", tunnel.nextHopTunnelID)
+			err = r.registerCircuit(nextLink, tunnel.nextHopTunnelID, dataChanNextHop)
 			if err != nil {
 				return err
 			}
@@ -941,63 +2260,151 @@ func (r *Router) handleIncomingTunnelRelayMsg(buf []byte, dataChanNextHop chan m
 					return err
 				}
 
+				// the next hop did not create the circuit, the initiator sends another extend message on retry
+				if createdMsg.Retry {
+					r.releaseCircuit(tunnel.nextHopTunnelID)
+					tunnel.nextHopLink = nil
+					tunnel.nextHopTunnelID = 0
+				}
+
+				// the load of the next hop is only passed on if the initiator asked for it
 				extendedMsg := relayTunnelExtendedMsgFromTunnelCreatedMsg(&createdMsg)
+				extendedMsg.HasLoad = extendedMsg.HasLoad && extendMsg.WantLoad
 				var n int
-				tunnel.sendCounter, n, err = p2p.PackRelayMessage(buf, tunnel.sendCounter, &extendedMsg)
+				tunnel.sendCounter, n, err = tunnel.prevHopLink.packer.PackRelayMessage(buf, tunnel.sendCounter,
+					&extendedMsg, tunnel.sendDigest)
 				if err != nil {
 					return err
 				}
 
 				var encryptedExtended []byte
-				encryptedExtended, err = p2p.EncryptRelay(buf[:n], tunnel.dhShared)
+				encryptedExtended, err = tunnel.cipher.seal(buf[:n])
 				if err != nil {
 					return err
 				}
 
-				err = tunnel.prevHopLink.sendRelay(tunnel.prevHopTunnelID, encryptedExtended)
+				err = tunnel.prevHopLink.sendRelay(tunnel.prevHopTunnelID, encryptedExtended, PriorityControl)
 				if err != nil {
 					return err
 				}
 
-			case <-time.After(time.Duration(r.cfg.BuildTimeout) * time.Second): // timeout
+			case <-r.clock.After(time.Duration(r.cfg.BuildTimeout) * time.Second): // timeout
 				return ErrTimedOut
 			}
 		case p2p.RelayTypeTunnelCover:
 			coverMsg := p2p.RelayTunnelCover{}
-			err = coverMsg.Parse(decryptedRelayMsg)
+			err = coverMsg.Parse(body)
 			if err != nil {
 				return err
 			}
 
 			if coverMsg.Ping { // we received a ping message, echo it back as pong
-				coverReply := p2p.RelayTunnelCover{Ping: false}
-				var n int
-				tunnel.sendCounter, n, err = p2p.PackRelayMessage(buf, tunnel.sendCounter, &coverReply)
+				err = tunnel.sendRelayToPrevHop(&p2p.RelayTunnelCover{Ping: false})
 				if err != nil {
 					return err
 				}
+			}
 
-				var encryptedCoverReply []byte
-				encryptedCoverReply, err = p2p.EncryptRelay(buf[:n], tunnel.dhShared)
-				if err != nil {
-					return err
-				}
+		case p2p.RelayTypeTunnelBegin:
+			beginMsg := p2p.RelayTunnelBegin{}
+			err = beginMsg.Parse(body)
+			if err != nil {
+				return err
+			}
 
-				err = tunnel.prevHopLink.sendRelay(tunnel.prevHopTunnelID, encryptedCoverReply)
-				if err != nil {
-					return err
-				}
+			err = r.handleTunnelBegin(tunnel, &beginMsg)
+			if err != nil {
+				return err
+			}
+
+		case p2p.RelayTypeTunnelEnd:
+			// the initiator closed the exit connection
+			r.closeExit(tunnel)
+
+		case p2p.RelayTypeTunnelEOF:
+			// if we act as exit for this tunnel, the destination is told that the initiator finished sending
+			var isExit bool
+			isExit, err = r.closeExitWrite(tunnel)
+			if isExit {
+				return err
+			}
+
+			// the initiator might finish sending without sending any data, the tunnel must then be announced first
+			var tunnelID uint32
+			tunnelID, err = r.announceSegment(tunnel)
+			if err != nil {
+				return err
+			}
+
+			err = r.sendEOFToClients(tunnelID)
+			if err != nil {
+				return err
+			}
+
+		case p2p.RelayTypeTunnelMigrate:
+			migrateMsg := p2p.RelayTunnelMigrate{}
+			err = migrateMsg.Parse(body)
+			if err != nil {
+				return err
+			}
+
+			err = r.handleMigrate(tunnel, &migrateMsg)
+			if err != nil {
+				return err
+			}
+
+		case p2p.RelayTypeTunnelOpened:
+			// only the last hop announces the tunnel
+			if tunnel.nextHopLink != nil {
+				return p2p.ErrInvalidMessage
+			}
+
+			// the clients may speak first now, otherwise the tunnel is announced along with the first data
+			_, err = r.announceSegment(tunnel)
+			if err != nil {
+				return err
+			}
+
+		case p2p.RelayTypeTunnelJoin:
+			joinMsg := p2p.RelayTunnelJoin{}
+			err = joinMsg.Parse(body)
+			if err != nil {
+				return err
+			}
+
+			// only the last hop reassembles the data of a multipath tunnel
+			if tunnel.nextHopLink != nil {
+				return p2p.ErrInvalidMessage
+			}
+
+			err = r.joinStream(tunnel, joinMsg.Stream)
+			if err != nil {
+				return err
 			}
+
+		case p2p.RelayTypeTunnelDestroy:
+			// the initiator tears down the tunnel, the other hops receive their own destroy message
+			return errTunnelDestroyed
+
 		default:
 			return p2p.ErrInvalidMessage
 		}
 	} else {
 		// relay message is not meant for us
 		if tunnel.nextHopLink != nil { // simply pass it along with one layer of encryption removed
-			err = tunnel.nextHopLink.sendRelay(tunnel.nextHopTunnelID, decryptedRelayMsg)
+			err = r.chargeSegment(tunnel)
+			if err != nil {
+				return err
+			}
+			if !r.throttleRelay(tunnel.quit) {
+				return nil
+			}
+			// the class of relayed messages is unknown to intermediate hops
+			err = tunnel.nextHopLink.sendRelay(tunnel.nextHopTunnelID, decryptedRelayMsg, PriorityInteractive)
 			if err != nil {
 				return err
 			}
+			tunnel.cellsForward++
 		} else { // we received an invalid relay message
 			return p2p.ErrInvalidMessage
 		}
@@ -1008,149 +2415,224 @@ func (r *Router) handleIncomingTunnelRelayMsg(buf []byte, dataChanNextHop chan m
 
 // handleTunnelSegment is a goroutine handling all incoming traffic on an incoming tunnel where this peer is either the
 // last hop in the tunnel or an intermediate hop. Handles tunnel extensions and relay messages that should be passed
-// through the tunnel.
-func (r *Router) handleTunnelSegment(tunnel *tunnelSegment, errOut chan error) {
+// through the tunnel. Returns an error if the link to the previous hop must be torn down.
+func (r *Router) handleTunnelSegment(tunnel *tunnelSegment) (err error) {
 	// This is the handler go routine for incoming tunnels that either are terminated by us or where we are just
 	// an in-between hop. The handshake of the previous hop to us is assumed to be done we can, however, receive
 	// TunnelExtend commands.
 	dataChanPrevHop := make(chan message, 5)
 	dataChanNextHop := make(chan message, 5)
-	err := tunnel.prevHopLink.register(tunnel.prevHopTunnelID, dataChanPrevHop, false)
+	defer r.releaseSegment()
+
+	tunnel.span = r.tracer.Start("tunnel.segment")
+	tunnel.span.Set("prev_hop.address", tunnel.prevHopLink.address.String())
+	tunnel.span.Set("prev_hop.port", tunnel.prevHopLink.port)
+	tunnel.span.Set("prev_hop.circuit.id", tunnel.prevHopTunnelID)
+	defer func() {
+		tunnel.span.Set("cells.forward", tunnel.cellsForward)
+		tunnel.span.Set("cells.backward", tunnel.cellsBackward)
+		tunnel.span.Finish(err)
+	}()
+
+	err = r.registerCircuit(tunnel.prevHopLink, tunnel.prevHopTunnelID, dataChanPrevHop)
 	if err != nil {
-		errOut <- err
-		return
+		return err
 	}
 	defer func() {
-		removeErr := r.RemoveTunnel(tunnel.prevHopTunnelID)
-		if removeErr != nil {
-			log.Printf("Error removing tunnel from link with ID %v: %v\n", tunnel.prevHopTunnelID, removeErr)
-		}
+		r.closeExit(tunnel)
+		r.removeTunnelSegment(tunnel)
 		if tunnel.nextHopLink != nil {
-			removeErr = r.RemoveTunnel(tunnel.nextHopTunnelID)
-			if removeErr != nil {
-				log.Printf("Error removing tunnel from link with ID %v: %v\n", tunnel.nextHopTunnelID, removeErr)
-			}
+			r.releaseCircuit(tunnel.nextHopTunnelID)
 		}
 	}()
 
 	buf := make([]byte, p2p.MessageSize)
 
+	stopDatagrams := r.startDatagramSender(&tunnel.datagrams, func(msg p2p.RelayMessage) error {
+		return tunnel.sendRelayToPrevHop(msg)
+	})
+	defer stopDatagrams()
+
+	idleCheck, stopIdleCheck := r.idleTicker()
+	defer stopIdleCheck()
+
+	var buffered []message // relay messages received on a segment replacing another one while the latter is drained
 	for {
 		select {
 		case msg, channelOpen := <-dataChanPrevHop: // we receive a message from the previous hop
 			if !channelOpen {
-				return
+				return nil
 			}
-
-			hdr := msg.hdr
-			data := msg.body
-			switch hdr.Type {
-			case p2p.TypeTunnelRelay:
-				err = r.handleIncomingTunnelRelayMsg(buf, dataChanNextHop, tunnel, &hdr, data)
-				if err != nil {
-					log.Printf("Error handling incoming relay message: %v\n", err)
-					return
-				}
-			case p2p.TypeTunnelDestroy:
-				// we pass the destroy message along and tear down
-				if tunnel.nextHopLink != nil {
-					err = tunnel.nextHopLink.sendDestroyTunnel(tunnel.nextHopTunnelID)
-					if err != nil {
-						errOut <- err
-					}
+			tunnel.activity.touch(r.clock.Now())
+
+			// data received on the rebuilt circuit must not overtake data still in flight on the old one
+			if tunnel.draining != nil && msg.hdr.Type == p2p.TypeTunnelRelay {
+				if len(buffered) >= maxHandoverBuffer {
+					r.logger.Printf("Too many messages on incoming tunnel %v while draining\n", tunnel.prevHopTunnelID)
+					_ = tunnel.destroy()
+					return nil
 				}
-				err = r.sendMsgToAPI(tunnel.prevHopTunnelID, &api.OnionTunnelDestroy{
-					TunnelID: tunnel.prevHopTunnelID,
-				})
-				if err != nil {
-					errOut <- err
+				buffered = append(buffered, msg)
+				continue
+			}
+
+			if stop, err := r.handlePrevHopMsg(buf, dataChanNextHop, tunnel, msg); stop {
+				return err
+			}
+
+		case <-tunnel.draining:
+			tunnel.draining = nil
+			for _, msg := range buffered {
+				if stop, err := r.handlePrevHopMsg(buf, dataChanNextHop, tunnel, msg); stop {
+					return err
 				}
-				return
-			default: // any other message is illegal here
-				errOut <- p2p.ErrInvalidMessage
-				return
 			}
+			buffered = nil
+
 		case msg, channelOpen := <-dataChanNextHop: // we receive a message from the next hop
 			if !channelOpen {
-				return
+				return nil
 			}
+			tunnel.activity.touch(r.clock.Now())
 
 			hdr := msg.hdr
 			data := msg.body
 			switch hdr.Type {
 			case p2p.TypeTunnelRelay: // simply add one layer of encryption and pass it along
 				var encryptedMsg []byte
-				encryptedMsg, err = p2p.EncryptRelay(data, tunnel.dhShared)
+				encryptedMsg, err = tunnel.cipher.encrypt(data)
 				if err != nil {
-					errOut <- err
-					return
+					return err
 				}
 
-				err = tunnel.prevHopLink.sendRelay(tunnel.prevHopTunnelID, encryptedMsg)
-				if err != nil {
-					errOut <- err
-					return
+				if err = r.chargeSegment(tunnel); err != nil {
+					// only the tunnel is torn down, not the link to the next hop
+					r.logError(err, "Tearing down incoming tunnel %v", tunnel.prevHopTunnelID)
+					_ = tunnel.destroy()
+					return nil
 				}
-
-			case p2p.TypeTunnelDestroy:
-				err = tunnel.prevHopLink.sendDestroyTunnel(tunnel.prevHopTunnelID)
-				if err != nil {
-					errOut <- err
+				if !r.throttleRelay(tunnel.quit) {
+					return nil
 				}
-				err = r.sendMsgToAPI(tunnel.prevHopTunnelID, &api.OnionTunnelDestroy{
-					TunnelID: tunnel.prevHopTunnelID,
-				})
+				err = tunnel.prevHopLink.sendRelay(tunnel.prevHopTunnelID, encryptedMsg, PriorityInteractive)
 				if err != nil {
-					errOut <- err
+					return err
 				}
-				return
+				tunnel.cellsBackward++
+
+			case p2p.TypeTunnelDestroy:
+				// the next hop tore down its tunnel segment, which only the initiator may act upon. Thus, we announce
+				// our teardown to the initiator in an authenticated way instead of passing the destroy message along.
+				return tunnel.sendRelayToPrevHop(&p2p.RelayTunnelDestroy{})
 
 			default: // any other message is illegal here
-				errOut <- p2p.ErrInvalidMessage
-				return
+				return p2p.ErrInvalidMessage
+			}
+
+		case <-idleCheck:
+			if tunnel.activity.idle(r.clock.Now()) >= r.idleTimeout() {
+				// the tunnel went silent in both directions, tear it down towards both hops
+				r.logger.Printf("Tearing down idle incoming tunnel %v\n", tunnel.prevHopTunnelID)
+				_ = tunnel.destroy()
+				return nil
 			}
 
 		case <-tunnel.prevHopLink.Quit:
 			if tunnel.nextHopLink != nil {
 				tunnel.nextHopLink.Close()
 			}
-			return
+			return nil
 		case <-tunnel.quit:
-			return
+			return nil
+		}
+	}
+}
+
+// handlePrevHopMsg processes a message received from the previous hop on an incoming tunnel.
+// Returns true if the tunnel segment handler must stop, and the error it must return in this case.
+func (r *Router) handlePrevHopMsg(buf []byte, dataChanNextHop chan message, tunnel *tunnelSegment,
+	msg message) (stop bool, err error) {
+	hdr := msg.hdr
+	switch hdr.Type {
+	case p2p.TypeTunnelRelay:
+		err = r.handleIncomingTunnelRelayMsg(buf, dataChanNextHop, tunnel, &hdr, msg.body)
+		if errors.Is(err, errTunnelDestroyed) {
+			return true, nil
+		}
+		if err != nil {
+			r.logError(err, "Error handling incoming relay message on tunnel %v", tunnel.prevHopTunnelID)
+			_ = tunnel.destroy()
+			return true, nil
+		}
+	case p2p.TypeTunnelDestroy:
+		// the previous hop tore down its tunnel segment, thus the tunnel is unusable.
+		// We pass the destroy message along as the adjacent hop and tear down
+		if tunnel.nextHopLink != nil {
+			err = tunnel.nextHopLink.sendDestroyTunnel(tunnel.nextHopTunnelID)
 		}
+		return true, err
+	default: // any other message is illegal here
+		return true, p2p.ErrInvalidMessage
 	}
+
+	return false, nil
+}
+
+// handleReadError tears down a link after reading a message from it failed, see Link.readMsg. The messages on a link
+// are not delimited, thus the link can not be resynchronized once a message was read partially, nor can a failed read
+// be retried without knowing how much of the message was consumed. Tearing the link down closes the circuits carried
+// by it, whose handlers tear down their tunnels and notify the clients. Failures other than the connection being
+// closed between two messages are logged, attributed to the circuit if the header was read.
+func (r *Router) handleReadError(link *Link, msg message, err error) {
+	var bodyErr *bodyReadError
+	switch {
+	case errors.As(err, &bodyErr):
+		r.logError(err, "Error reading message of type %v on circuit %v, closing link", msg.hdr.Type,
+			msg.hdr.TunnelID)
+	case err == io.EOF || errcode.Of(err) == errcode.ConnClosed:
+		// the connection was closed between two messages, e.g. by the adjacent peer
+	default:
+		r.logError(err, "Error reading message header, closing link")
+	}
+	link.Close()
 }
 
 // handleLink is the goroutine handler for a Link that reads from the underlying tls.Conn and passes received p2p.Message
 // to the respective tunnel handler via the registered Link.dataOut channel.
+// The handlers of the tunnel segments using the link are supervised by a supervisor.Group, the link is torn down once
+// one of them fails.
 func (r *Router) handleLink(link *Link) {
-	const connClosed = "use of closed network connection"
-
-	goRoutineErr := make(chan error, 10)
-	shuttingDown := false
+	segments := supervisor.New(r.logger)
 	go func() {
 		select {
 		case <-link.Quit:
-			log.Printf("Terminating link")
-		case err := <-goRoutineErr:
-			log.Printf("Error in goroutine: %v\n", err)
+			r.logger.Printf("Terminating link")
+		case <-segments.Quit():
+			r.logError(segments.Err(), "Error in goroutine")
 		}
-		shuttingDown = true
+		segments.Stop()
 		r.removeLink(link)
 		_ = link.destroy()
 	}()
 
+	// the adjacent peer sends its hello at the same time, thus we must not wait for ours to be read
+	go func() {
+		err := r.sendLinkHello(link)
+		if err != nil {
+			r.logger.Printf("Error sending link hello: %v\n", err)
+		}
+	}()
+
 	for {
 		msg, err := link.readMsg()
 		if err != nil {
-			if shuttingDown || err == io.EOF || strings.Contains(err.Error(), connClosed) {
-				return // connection closed cleanly
-			}
-			log.Printf("Error reading message body: %v, ignoring message", err)
-			err = r.RemoveTunnel(msg.hdr.TunnelID)
-			if err != nil {
-				log.Printf("Error removing tunnel with ID: %v, %v\n", msg.hdr.TunnelID, err)
-			}
+			r.handleReadError(link, msg, err)
+			return
+		}
+
+		// link messages concern the link itself rather than any tunnel using it
+		if isLinkMsg(msg.hdr.Type) {
+			r.handleLinkMsg(link, msg)
 			continue
 		}
 
@@ -1164,50 +2646,96 @@ func (r *Router) handleLink(link *Link) {
 
 			// the first message for a new tunnel MUST be TUNNEL_CREATE
 			if hdr.Type != p2p.TypeTunnelCreate {
-				log.Printf("Error: received first message for new tunnel that is not tunnel create")
+				r.logger.Printf("Error: received first message for new tunnel that is not tunnel create")
 				continue
 			}
 			msg := p2p.TunnelCreate{}
 			err = msg.Parse(data)
 			if err != nil {
-				log.Printf("Error parsing tunnel create message: %v", err)
-				err = r.RemoveTunnel(hdr.TunnelID)
+				r.logError(err, "Error parsing tunnel create message")
+				continue
+			}
+
+			// replays are rejected before decrypting anything
+			if !r.admitTunnelCreate(&msg) {
+				r.logger.Printf("Rejecting replayed or outdated tunnel create for tunnel ID %v\n", hdr.TunnelID)
+				continue
+			}
+
+			err = r.admitPolicy(&PolicyRequest{Source: link.address, SourcePort: link.port})
+			if err != nil {
+				r.logger.Printf("Rejecting tunnel create for tunnel ID %v: %v\n", hdr.TunnelID, err)
+				err = link.sendDestroyTunnel(hdr.TunnelID)
 				if err != nil {
-					log.Printf("Error removing tunnel with ID: %v, %v\n", hdr.TunnelID, err)
+					r.logger.Printf("Error sending tunnel destroy message: %v", err)
 				}
 				continue
 			}
 
-			dhShared, tunnelCreated, err := handleTunnelCreate(&msg, r.cfg)
+			s, tunnelCreated, err := handleTunnelCreate(r.rand, &msg, r.cfg, r.auth, r.tickets)
 			if err != nil {
-				log.Printf("Error handling tunnel create message: %v", err)
-				err = r.RemoveTunnel(hdr.TunnelID)
+				r.logError(err, "Error handling tunnel create message")
+				continue
+			}
+
+			// the initiator retries the handshake with another version, the circuit is not created yet
+			if s == nil {
+				err = link.sendMsg(hdr.TunnelID, tunnelCreated)
 				if err != nil {
-					log.Printf("Error removing tunnel with ID: %v, %v\n", hdr.TunnelID, err)
+					r.logger.Printf("Error sending tunnel created message: %v", err)
 				}
 				continue
 			}
 
-			if _, ok := r.tunnels[hdr.TunnelID]; ok {
-				log.Printf("Received tunnel create for existing tunnel id")
+			err = r.registerIncomingCircuit(hdr.TunnelID)
+			if err == ErrAlreadyRegistered {
+				// the existing circuit must not be destroyed
+				r.logger.Printf("Received tunnel create for existing tunnel id")
+				s.cipher.close()
+				continue
+			} else if err != nil {
+				r.logger.Printf("Rejecting tunnel create for tunnel ID %v: %v\n", hdr.TunnelID, err)
+				s.cipher.close()
+				err = link.sendDestroyTunnel(hdr.TunnelID)
+				if err != nil {
+					r.logger.Printf("Error sending tunnel destroy message: %v", err)
+				}
 				continue
 			}
-			r.tunnels[hdr.TunnelID] = make([]*api.Connection, 0)
 
+			recvDigest, sendDigest := p2p.NewRelayDigests(&s.key)
 			receivingTunnel := tunnelSegment{
 				prevHopTunnelID: hdr.TunnelID,
 				prevHopLink:     link,
-				dhShared:        dhShared,
+				dhShared:        &s.key,
+				cipher:          s.cipher,
+				initiatorCaps:   initiatorCapabilities(&msg),
+				recvDigest:      recvDigest,
+				sendDigest:      sendDigest,
 				quit:            make(chan struct{}),
 			}
+			receivingTunnel.activity.touch(r.clock.Now())
+			if delay := r.faults.createdDelay(); delay > 0 {
+				<-r.clock.After(delay)
+			}
+			r.announceLoad(tunnelCreated)
 			err = link.sendMsg(hdr.TunnelID, tunnelCreated)
 			if err != nil {
-				log.Printf("Error sending tunnel created message: %v", err)
+				r.logger.Printf("Error sending tunnel created message: %v", err)
+				s.cipher.close()
+				r.releaseSegment()
+				r.releaseCircuit(hdr.TunnelID)
 				continue
 			}
 
+			// the tunnel is known to the clients by its own ID once it is announced
+			receivingTunnel.tunnelID = r.newTunnelID()
+			receivingTunnel.traffic = r.traffic.get(receivingTunnel.tunnelID)
+
 			// now we start the normal message handling for this tunnel
-			go r.handleTunnelSegment(&receivingTunnel, goRoutineErr)
+			segments.Go("tunnel segment handler", func(quit chan struct{}) error {
+				return r.handleTunnelSegment(&receivingTunnel)
+			})
 		}
 	}
 }
@@ -2,9 +2,17 @@ package onion
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/rand"
 	"crypto/rsa"
 	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	mathRand "math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -13,7 +21,9 @@ import (
 
 	"bawang/api"
 	"bawang/config"
+	"bawang/p2p"
 	"bawang/rps"
+	"bawang/trace"
 )
 
 type mockRPS struct {
@@ -46,9 +56,30 @@ func (r *mockRPS) Close() {}
 var _ rps.RPS = &mockRPS{}
 
 func TestOnionNewRouter(t *testing.T) {
-	router, err := NewRouter(nil)
-	require.NotNil(t, err)
-	require.Nil(t, router)
+	t.Run("no RPS", func(t *testing.T) {
+		router, err := NewRouter(nil)
+		require.NotNil(t, err)
+		require.Nil(t, router)
+	})
+
+	t.Run("with options", func(t *testing.T) {
+		var logBuf bytes.Buffer
+		logger := log.New(&logBuf, "", 0)
+		router, err := NewRouter(nil, WithRPS(&mockRPS{}), WithLogger(logger))
+		require.Nil(t, err)
+		require.NotNil(t, router)
+		require.Equal(t, logger, router.logger)
+
+		var incoming []uint32
+		router.RegisterClient(&ClientFuncs{
+			Incoming: func(tunnelID uint32) error {
+				incoming = append(incoming, tunnelID)
+				return nil
+			},
+		})
+		router.events.publish(Event{Type: EventTunnelIncoming, TunnelID: 42})
+		require.Equal(t, []uint32{42}, incoming)
+	})
 }
 
 func TestOnionRouterBuildTunnel(t *testing.T) {
@@ -69,6 +100,12 @@ func TestOnionRouterBuildTunnel(t *testing.T) {
 	err = cfgPeer4.FromFile("../.testing/peer-4.conf")
 	require.Nil(t, err)
 
+	// the hops announce their load to the initiator, see below
+	cfgPeer1.LoadAwarePaths = true
+	cfgPeer2.AnnounceLoad = true
+	cfgPeer3.AnnounceLoad = true
+	cfgPeer4.AnnounceLoad = true
+
 	// setup peers
 	intermediateHops := []*rps.Peer{
 		{Port: uint16(cfgPeer2.P2PPort), Address: net.ParseIP(cfgPeer2.P2PHostname), HostKey: &rsa.PublicKey{N: cfgPeer2.HostKey.N, E: cfgPeer2.HostKey.E}},
@@ -94,30 +131,26 @@ func TestOnionRouterBuildTunnel(t *testing.T) {
 	// register dummy API conns
 	apiServer1, apiClient1 := net.Pipe()
 	apiConn1 := api.NewConnection(apiServer1)
-	router1.RegisterAPIConnection(apiConn1)
-	require.Len(t, router1.apiConnections, 1)
+	router1.RegisterClient(apiConn1)
+	require.Len(t, router1.clients, 1)
 
 	apiServer4, apiClient4 := net.Pipe()
 	apiConn4 := api.NewConnection(apiServer4)
-	router4.RegisterAPIConnection(apiConn4)
-	require.Len(t, router4.apiConnections, 1)
+	router4.RegisterClient(apiConn4)
+	require.Len(t, router4.clients, 1)
 
 	// now start all listeners
 	quitChan := make(chan struct{})
-	errChanOnion1 := make(chan error)
-	errChanOnion2 := make(chan error)
-	errChanOnion3 := make(chan error)
-	errChanOnion4 := make(chan error)
-	go ListenOnionSocket(&cfgPeer1, router1, errChanOnion1, quitChan)
-	go ListenOnionSocket(&cfgPeer2, router2, errChanOnion2, quitChan)
-	go ListenOnionSocket(&cfgPeer3, router3, errChanOnion3, quitChan)
-	go ListenOnionSocket(&cfgPeer4, router4, errChanOnion4, quitChan)
+	go ListenOnionSocket(&cfgPeer1, router1, quitChan)
+	go ListenOnionSocket(&cfgPeer2, router2, quitChan)
+	go ListenOnionSocket(&cfgPeer3, router3, quitChan)
+	go ListenOnionSocket(&cfgPeer4, router4, quitChan)
 
 	time.Sleep(1 * time.Second) // annoyingly wait for the sockets to fully start
 	replyChan := router1.BuildTunnel(&targetPeer, apiConn1)
 
 	go func() {
-		successfulBuilds := router1.handleBuildTunnelJobs()
+		successfulBuilds := router1.handleBuildTunnelJobs(nil)
 		require.Equal(t, 1, successfulBuilds)
 	}()
 
@@ -131,7 +164,26 @@ func TestOnionRouterBuildTunnel(t *testing.T) {
 	assert.NotNil(t, tunnel.hops[1].DHShared)
 	assert.NotNil(t, tunnel.hops[2].DHShared)
 
-	go router1.HandleOutgoingTunnel(tunnel)
+	// each hop is stored as requested, the last one being the target the tunnel is rebuilt to
+	assert.Nil(t, newPath(intermediateHops, &targetPeer).verify(tunnel.hops))
+	assert.True(t, sameHop(&targetPeer, tunnel.hops[len(tunnel.hops)-1]))
+
+	// the duration of each step of the build is attributed to its hop
+	assert.Len(t, tunnel.latencies, len(tunnel.hops))
+	assert.Len(t, router1.HopLatencies(), 3)
+	assert.Len(t, router1.Stats().HopLatencies, 3)
+	assert.Equal(t, len(tunnel.hops), tunnel.Hops())
+	assert.Equal(t, tunnel.latencies[0]+tunnel.latencies[1]+tunnel.latencies[2], tunnel.BuildTime())
+
+	// the load of each hop is recorded, passed on by the intermediate hops before it
+	for _, hop := range append(intermediateHops, &targetPeer) {
+		_, ok := router1.loads.level(hop, router1.clock.Now())
+		assert.True(t, ok, "load of hop %v", hop.Port)
+	}
+
+	// the router handles the traffic of the tunnel on its own, starting another handler is a no-op
+	assert.True(t, router1.handlers.isRunning(tunnel))
+	router1.startTunnelHandler(tunnel)
 
 	// now test if we can properly send data through the tunnel and that it triggers an incoming connection on the other end
 	payload := []byte("asdf1234")
@@ -154,6 +206,14 @@ func TestOnionRouterBuildTunnel(t *testing.T) {
 	err = onionIncoming.Parse(msg[api.HeaderSize:])
 	require.Nil(t, err)
 
+	// the clients only know the tunnel ID, the circuit on the link has its own ID
+	router4.tunnelsLock.Lock()
+	incomingTunnel, ok := router4.incomingTunnels[onionIncoming.TunnelID]
+	require.True(t, ok)
+	assert.Equal(t, onionIncoming.TunnelID, incomingTunnel.tunnelID)
+	assert.Contains(t, router4.circuits, incomingTunnel.prevHopTunnelID)
+	router4.tunnelsLock.Unlock()
+
 	// check that our payload is coming through
 	n, err = rd.Read(apiBuf)
 	require.Nil(t, err)
@@ -193,7 +253,7 @@ func TestOnionRouterBuildTunnel(t *testing.T) {
 	assert.Equal(t, responsePayload, onionData.Data)
 
 	// now we tear down the tunnel from the receiving end
-	err = router4.RemoveAPIConnection(apiConn4)
+	err = router4.RemoveClient(apiConn4)
 	require.Nil(t, err)
 
 	// simulate cleaning at beginning of new round
@@ -202,25 +262,25 @@ func TestOnionRouterBuildTunnel(t *testing.T) {
 	// empty the pipe buffer of api conn 1 otherwise writes will block since pipes are not buffered
 	_, _ = rd.Read(apiBuf)
 
-	// wait for traffic to propagate
-	time.Sleep(2 * time.Second)
-
-	assert.Equal(t, 0, len(router1.outgoingTunnels))
-	assert.Equal(t, 0, len(router1.tunnels))
-
-	assert.Equal(t, 0, len(router2.incomingTunnels))
-	assert.Equal(t, 0, len(router2.tunnels))
-
-	assert.Equal(t, 0, len(router3.incomingTunnels))
-	assert.Equal(t, 0, len(router3.tunnels))
-
-	assert.Equal(t, 0, len(router4.incomingTunnels))
-	assert.Equal(t, 0, len(router4.tunnels))
+	// wait for the teardown to propagate
+	for i, router := range []*Router{router1, router2, router3, router4} {
+		router := router
+		require.Eventually(t, func() bool {
+			return tunnelsGone(router)
+		}, 5*time.Second, 10*time.Millisecond, "router %d", i+1)
+	}
 
 	close(quitChan)
 	time.Sleep(1 * time.Second)
 }
 
+// tunnelsGone reports whether the router forgot all of its tunnels and circuits.
+func tunnelsGone(r *Router) bool {
+	r.tunnelsLock.RLock()
+	defer r.tunnelsLock.RUnlock()
+	return len(r.tunnels) == 0 && len(r.outgoingTunnels) == 0 && len(r.incomingTunnels) == 0 && len(r.circuits) == 0
+}
+
 func TestRouterHandleRounds(t *testing.T) {
 	// load config files
 	cfgPeer1 := config.Config{}
@@ -246,9 +306,9 @@ func TestRouterHandleRounds(t *testing.T) {
 		{Port: uint16(cfgPeer4.P2PPort), Address: net.ParseIP(cfgPeer4.P2PHostname), HostKey: &rsa.PublicKey{N: cfgPeer4.HostKey.N, E: cfgPeer4.HostKey.E}},
 	}
 
-	// setup routers
+	// setup routers, the cover tunnel is rotated to another destination in the next round
 	router1 := newRouterWithRPS(&cfgPeer1, &mockRPS{
-		peers: intermediateHops,
+		peers: append(intermediateHops, intermediateHops[1], intermediateHops[2], intermediateHops[0]),
 	})
 	require.NotNil(t, router1)
 
@@ -262,29 +322,737 @@ func TestRouterHandleRounds(t *testing.T) {
 	require.NotNil(t, router4)
 
 	quitChan := make(chan struct{})
-	errChanRounds := make(chan error)
-	errChanOnion1 := make(chan error)
-	errChanOnion2 := make(chan error)
-	errChanOnion3 := make(chan error)
-	errChanOnion4 := make(chan error)
+	errChanRounds := make(chan error, 1)
 
-	go ListenOnionSocket(&cfgPeer1, router1, errChanOnion1, quitChan)
-	go ListenOnionSocket(&cfgPeer2, router2, errChanOnion2, quitChan)
-	go ListenOnionSocket(&cfgPeer3, router3, errChanOnion3, quitChan)
-	go ListenOnionSocket(&cfgPeer4, router4, errChanOnion4, quitChan)
+	go ListenOnionSocket(&cfgPeer1, router1, quitChan)
+	go ListenOnionSocket(&cfgPeer2, router2, quitChan)
+	go ListenOnionSocket(&cfgPeer3, router3, quitChan)
+	go ListenOnionSocket(&cfgPeer4, router4, quitChan)
 
 	time.Sleep(1 * time.Second)
 
-	go router1.HandleRounds(errChanRounds, quitChan)
+	assert.Equal(t, ErrNoRound, router1.CheckRounds())
+	go func() {
+		errChanRounds <- router1.HandleRounds(quitChan)
+	}()
 	time.Sleep(1 * time.Second)
+	assert.Nil(t, router1.CheckRounds())
 
-	assert.NotNil(t, router1.coverTunnel)
+	assert.Len(t, router1.coverTunnels, 1)
 	assert.Equal(t, 1, len(router1.outgoingTunnels))
 	assert.Equal(t, 1, len(router1.tunnels))
 
 	err = router1.SendCover(0)
 	assert.Nil(t, err)
 
+	router1.tunnelsLock.RLock()
+	coverTunnel := router1.outgoingTunnels[router1.coverTunnels[0]]
+	router1.tunnelsLock.RUnlock()
+
+	router1.TriggerRound()
+	require.Eventually(t, func() bool {
+		router1.tunnelsLock.RLock()
+		defer router1.tunnelsLock.RUnlock()
+		return len(router1.outgoingTunnels) == 1 && router1.coverTunnels[0] != coverTunnel.id
+	}, 5*time.Second, 10*time.Millisecond)
+	router1.tunnelsLock.RLock()
+	assert.Len(t, router1.coverTunnels, 1)
+	assert.NotEqual(t, coverTunnel.target, router1.outgoingTunnels[router1.coverTunnels[0]].target)
+	router1.tunnelsLock.RUnlock()
+
 	close(quitChan)
-	time.Sleep(1 * time.Second)
+	select {
+	case err = <-errChanRounds:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Error("round logic did not stop on quit")
+	}
+}
+
+func TestRouterAdmissionControl(t *testing.T) {
+	cfg := &config.Config{
+		MaxTunnels:  1,
+		MaxSegments: 1,
+		MaxLinks:    1,
+	}
+	router := newRouterWithRPS(cfg, &mockRPS{})
+
+	t.Run("tunnels", func(t *testing.T) {
+		release := func() {
+			router.tunnelsLock.Lock()
+			router.releaseTunnel()
+			router.tunnelsLock.Unlock()
+		}
+
+		// a tunnel being built takes its slot already
+		require.Nil(t, router.admitTunnel())
+		require.Equal(t, ErrTooManyTunnels, router.admitTunnel())
+		release()
+
+		// the cover tunnel does not count towards the limit
+		router.coverTunnels = []uint32{1}
+		router.outgoingTunnels[1] = &Tunnel{id: 1}
+		require.Nil(t, router.admitTunnel())
+		release()
+
+		router.outgoingTunnels[2] = &Tunnel{id: 2}
+		require.Equal(t, ErrTooManyTunnels, router.admitTunnel())
+
+		tunnel, err := router.buildNewTunnel(&rps.Peer{}, nil, &ClientFuncs{})
+		require.Equal(t, ErrTooManyTunnels, err)
+		require.Nil(t, tunnel)
+
+		// the slot of a failed build is released
+		delete(router.outgoingTunnels, 2)
+		tunnel, err = router.buildNewTunnel(&rps.Peer{}, nil, &ClientFuncs{})
+		require.Equal(t, ErrNotEnoughHops, err)
+		require.Nil(t, tunnel)
+		assert.Equal(t, 0, router.numBuilding)
+	})
+
+	t.Run("segments", func(t *testing.T) {
+		require.Nil(t, router.admitSegment())
+		require.Equal(t, ErrTooManyTunnels, router.admitSegment())
+		router.releaseSegment()
+		require.Nil(t, router.admitSegment())
+		router.releaseSegment()
+	})
+
+	t.Run("links", func(t *testing.T) {
+		require.True(t, router.admitLink())
+		router.addLink(&Link{})
+		require.False(t, router.admitLink())
+
+		link, err := router.CreateLink(net.ParseIP("127.0.0.1"), 1)
+		require.Equal(t, ErrTooManyLinks, err)
+		require.Nil(t, link)
+	})
+}
+
+func TestRouterRegisterIncomingCircuit(t *testing.T) {
+	t.Run("duplicate", func(t *testing.T) {
+		router := newRouterWithRPS(&config.Config{}, &mockRPS{})
+
+		require.Nil(t, router.registerIncomingCircuit(42))
+		assert.Equal(t, ErrAlreadyRegistered, router.registerIncomingCircuit(42))
+		assert.Equal(t, 1, router.numSegments)
+
+		router.releaseSegment()
+		router.releaseCircuit(42)
+		assert.Nil(t, router.registerIncomingCircuit(42))
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		router := newRouterWithRPS(&config.Config{MaxSegments: 1}, &mockRPS{})
+
+		require.Nil(t, router.registerIncomingCircuit(1))
+		assert.Equal(t, ErrTooManyTunnels, router.registerIncomingCircuit(2))
+		assert.NotContains(t, router.circuits, uint32(2))
+	})
+
+	// the creates arrive on multiple links concurrently while the round logic builds and tears down circuits
+	t.Run("concurrent", func(t *testing.T) {
+		const numCircuits, numCreates, maxSegments = 16, 8, 12
+		router := newRouterWithRPS(&config.Config{MaxSegments: maxSegments}, &mockRPS{})
+
+		quit := make(chan struct{})
+		rounds := make(chan struct{})
+		go func() {
+			defer close(rounds)
+			for {
+				select {
+				case <-quit:
+					return
+				default:
+				}
+				router.releaseCircuit(router.newCircuitID())
+				router.removeUnusedTunnels()
+			}
+		}()
+
+		var registered [numCircuits]int32
+		var wg sync.WaitGroup
+		for i := 0; i < numCircuits*numCreates; i++ {
+			wg.Add(1)
+			go func(circuitID uint32) {
+				defer wg.Done()
+				if router.registerIncomingCircuit(circuitID) == nil {
+					atomic.AddInt32(&registered[circuitID-1], 1)
+				}
+			}(uint32(i%numCircuits + 1))
+		}
+		wg.Wait()
+		close(quit)
+		<-rounds
+
+		// each circuit is registered at most once and the slots are not exceeded
+		var numRegistered int
+		for i, n := range registered {
+			require.LessOrEqual(t, n, int32(1))
+			if n == 1 {
+				numRegistered++
+				assert.Contains(t, router.circuits, uint32(i+1))
+			}
+		}
+		assert.Equal(t, maxSegments, numRegistered)
+		assert.Equal(t, maxSegments, router.numSegments)
+		assert.Len(t, router.circuits, maxSegments)
+	})
+}
+
+// fakeClock is a manually advanced Clock. Tickers only fire when ticked explicitly.
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	ticker *fakeTicker
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return make(chan time.Time) // never fires
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.ticker = &fakeTicker{c: make(chan time.Time)}
+	return c.ticker
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	c.lock.Unlock()
+}
+
+func (c *fakeClock) tick() {
+	c.lock.Lock()
+	ticker := c.ticker
+	now := c.now
+	c.lock.Unlock()
+	ticker.c <- now
+}
+
+type fakeTicker struct {
+	c chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {}
+
+var _ Clock = &fakeClock{}
+
+// newConnLink returns a link on the given connection.
+func newConnLink(nc net.Conn) *Link {
+	return &Link{
+		nc:      nc,
+		rd:      bufio.NewReader(nc),
+		dataOut: make(map[uint32]chan message),
+		Quit:    make(chan struct{}),
+	}
+}
+
+// newPipeLink returns a link on one end of a pipe and the other end of it.
+func newPipeLink() (link *Link, remote net.Conn) {
+	local, remote := net.Pipe()
+	return newConnLink(local), remote
+}
+
+func TestRouterIdleTimeout(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	cfg := &config.Config{IdleTimeout: 60}
+	router := newRouter(cfg, WithRPS(&mockRPS{}), WithClock(clock))
+
+	link, connRemote := newPipeLink()
+	defer connRemote.Close()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, connRemote)
+	}()
+
+	tunnelID := uint32(42)
+	err := link.register(tunnelID, make(chan message, 5))
+	require.Nil(t, err)
+	tunnel := &Tunnel{
+		id:        tunnelID,
+		circuitID: tunnelID,
+		link:      link,
+		quit:      make(chan struct{}),
+	}
+	tunnel.activity.touch(clock.Now())
+
+	destroyed := make(chan uint32, 1)
+	router.outgoingTunnels[tunnelID] = tunnel
+	router.tunnels[tunnelID] = []Client{&ClientFuncs{
+		Destroy: func(tunnelID uint32) error {
+			destroyed <- tunnelID
+			return nil
+		},
+	}}
+
+	require.True(t, router.handlers.add(tunnel))
+	done := make(chan struct{})
+	go func() {
+		router.handleOutgoingTunnel(tunnel)
+		close(done)
+	}()
+
+	// wait until the handler created its idle ticker
+	require.Eventually(t, func() bool {
+		clock.lock.Lock()
+		defer clock.lock.Unlock()
+		return clock.ticker != nil
+	}, time.Second, time.Millisecond)
+
+	// not idle for long enough yet
+	clock.advance(30 * time.Second)
+	tunnel.activity.touch(clock.Now())
+	clock.advance(45 * time.Second)
+	clock.tick()
+	select {
+	case <-done:
+		t.Fatal("tunnel was torn down before reaching the idle timeout")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clock.advance(15 * time.Second)
+	clock.tick()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("idle tunnel was not torn down")
+	}
+	assert.Equal(t, tunnelID, <-destroyed)
+
+	router.tunnelsLock.Lock()
+	assert.NotContains(t, router.outgoingTunnels, tunnelID)
+	router.tunnelsLock.Unlock()
+}
+
+// blockingTransport is a Transport whose dials block until released, simulating a slow first hop.
+type blockingTransport struct {
+	dialing chan struct{}
+	release chan struct{}
+}
+
+func (t *blockingTransport) DialPeer(address net.IP, port uint16) (net.Conn, error) {
+	t.dialing <- struct{}{}
+	<-t.release
+	return nil, errors.New("unreachable")
+}
+
+func (t *blockingTransport) Listen(address string) (net.Listener, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestRouterBuildDoesNotBlockData(t *testing.T) {
+	transport := &blockingTransport{
+		dialing: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	peers := []*rps.Peer{
+		{Address: net.ParseIP("10.0.0.1"), Port: 1},
+		{Address: net.ParseIP("10.0.0.2"), Port: 2},
+	}
+	router := newRouter(&config.Config{TunnelLength: 3, BuildTimeout: 5},
+		WithRPS(&mockRPS{peers: peers}), WithTransport(transport))
+	router.RegisterClient(&ClientFuncs{})
+
+	// an incoming tunnel carrying data
+	link, connRemote := newPipeLink()
+	defer connRemote.Close()
+	router.tunnels[42] = []Client{}
+	segment := &tunnelSegment{
+		prevHopTunnelID: router.newCircuitID(),
+		tunnelID:        42,
+		prevHopLink:     link,
+		dhShared:        &[32]byte{42},
+	}
+	initiator := newInitiatorEnd(connRemote, segment)
+	require.Nil(t, router.RegisterIncomingConnection(segment))
+
+	// a new tunnel is built while the first hop does not respond
+	built := make(chan error, 1)
+	go func() {
+		_, err := router.buildNewTunnel(&rps.Peer{Address: net.ParseIP("10.0.0.3"), Port: 3}, nil, &ClientFuncs{})
+		built <- err
+	}()
+	<-transport.dialing
+
+	// data on the existing tunnel is not held back by the build
+	go func() {
+		assert.Nil(t, router.SendData(42, []byte("data")))
+	}()
+	require.Nil(t, initiator.SetReadDeadline(time.Now().Add(time.Second)))
+	hdr, body := readRelayFromPrevHop(t, initiator)
+	require.Equal(t, p2p.RelayTypeTunnelData, hdr.RelayType)
+	assert.Equal(t, []byte("data"), body)
+
+	// the failed build leaves no state behind
+	close(transport.release)
+	require.NotNil(t, <-built)
+
+	router.tunnelsLock.RLock()
+	defer router.tunnelsLock.RUnlock()
+	assert.Len(t, router.tunnels, 1)
+	assert.Len(t, router.circuits, 1)
+	assert.Empty(t, router.outgoingTunnels)
+}
+
+func TestRouterConcurrentTunnels(t *testing.T) {
+	const (
+		numWorkers = 16
+		numRounds  = 50
+	)
+
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+	router.logger = log.New(ioutil.Discard, "", 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			client := &ClientFuncs{}
+			router.RegisterClient(client)
+			defer func() {
+				assert.Nil(t, router.RemoveClient(client))
+			}()
+
+			for j := 0; j < numRounds; j++ {
+				tunnelID := router.newTunnelID()
+				circuitID := router.newCircuitID()
+				tunnel := &Tunnel{
+					id:        tunnelID,
+					circuitID: circuitID,
+					quit:      make(chan struct{}),
+					stream: newReliableStream(uint64(tunnelID), func(msg p2p.RelayMessage) error {
+						return nil
+					}),
+				}
+
+				router.tunnelsLock.Lock()
+				router.outgoingTunnels[tunnelID] = tunnel
+				router.tunnels[tunnelID] = append(router.tunnels[tunnelID], client)
+				router.tunnelsLock.Unlock()
+
+				assert.Nil(t, router.SendData(tunnelID, []byte("data")))
+				assert.Nil(t, router.notifyClients(tunnelID, func(client Client) error {
+					return client.SendTunnelData(tunnelID, []byte("data"))
+				}))
+				if router.admitTunnel() == nil {
+					router.tunnelsLock.Lock()
+					router.releaseTunnel()
+					router.tunnelsLock.Unlock()
+				}
+				assert.Equal(t, ErrSendCoverNotAllowed, router.SendCover(p2p.MessageSize))
+
+				assert.Nil(t, router.RemoveClientFromTunnel(tunnelID, client))
+				assert.Nil(t, router.RemoveTunnel(tunnelID))
+				router.releaseCircuit(circuitID)
+				assert.Equal(t, ErrInvalidTunnel, router.SendData(tunnelID, []byte("data")))
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlock between concurrent tunnels")
+	}
+
+	assert.Empty(t, router.tunnels)
+	assert.Empty(t, router.circuits)
+	assert.Empty(t, router.outgoingTunnels)
+}
+
+func TestRouterCloseTunnel(t *testing.T) {
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+
+	link, connRemote := newPipeLink()
+	defer connRemote.Close()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, connRemote)
+	}()
+	tunnel := &Tunnel{
+		id:        42,
+		circuitID: 7,
+		link:      link,
+		quit:      make(chan struct{}),
+	}
+	router.outgoingTunnels[42] = tunnel
+
+	var destroyed []uint32
+	router.tunnels[42] = []Client{&ClientFuncs{Destroy: func(tunnelID uint32) error {
+		destroyed = append(destroyed, tunnelID)
+		return nil
+	}}}
+
+	require.Nil(t, router.CloseTunnel(42))
+	assert.Equal(t, []uint32{42}, destroyed)
+	assert.Len(t, router.tunnels, 0)
+	assert.Len(t, router.outgoingTunnels, 0)
+
+	select {
+	case <-tunnel.quit:
+	default:
+		t.Fatal("tunnel handler was not stopped")
+	}
+
+	assert.Equal(t, ErrInvalidTunnel, router.CloseTunnel(42))
+}
+
+func TestRouterRemoveUnusedTunnels(t *testing.T) {
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+
+	link, connRemote := newPipeLink()
+	defer connRemote.Close()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, connRemote)
+	}()
+	tunnel := &Tunnel{
+		id:        42,
+		circuitID: 7,
+		link:      link,
+		quit:      make(chan struct{}),
+	}
+	router.outgoingTunnels[42] = tunnel
+	router.tunnels[42] = []Client{}
+	router.coverTunnels = []uint32{42}
+
+	// the teardown is announced while the tunnel is still known, such that the clients are notified without errors
+	var known []bool
+	router.Subscribe(func(ev Event) {
+		if ev.Type == EventTunnelDestroyed && ev.TunnelID == 42 {
+			router.tunnelsLock.RLock()
+			_, ok := router.tunnels[42]
+			router.tunnelsLock.RUnlock()
+			known = append(known, ok)
+		}
+	})
+	var logBuf bytes.Buffer
+	router.logger = log.New(&logBuf, "", 0)
+
+	router.removeUnusedTunnels()
+	assert.Equal(t, []bool{true}, known)
+	assert.Empty(t, logBuf.String())
+	assert.Len(t, router.tunnels, 0)
+	assert.Len(t, router.outgoingTunnels, 0)
+	assert.Empty(t, router.coverTunnels)
+
+	select {
+	case <-tunnel.quit:
+	default:
+		t.Fatal("tunnel handler was not stopped")
+	}
+}
+
+func TestRouterTriggerRound(t *testing.T) {
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+
+	// pending triggers are coalesced
+	router.TriggerRound()
+	router.TriggerRound()
+	assert.Len(t, router.roundTrigger, 1)
+}
+
+func TestRouterSetLogging(t *testing.T) {
+	var buf bytes.Buffer
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}), WithLogger(log.New(&buf, "", 0)))
+
+	router.SetLogging(false)
+	router.SetLogging(false)
+	router.logger.Println("muted")
+	assert.Equal(t, "", buf.String())
+
+	router.SetLogging(true)
+	router.SetLogging(true)
+	router.logger.Println("logged")
+	assert.Equal(t, "logged\n", buf.String())
+}
+
+func TestRouterWithRand(t *testing.T) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	require.Nil(t, err)
+
+	// routers with the same seed draw the same IDs and Diffie-Hellman keys
+	newSeeded := func() *Router {
+		return newRouter(&config.Config{}, WithRPS(&mockRPS{}), WithRand(mathRand.New(mathRand.NewSource(1))))
+	}
+	router1, router2 := newSeeded(), newSeeded()
+
+	assert.Equal(t, router1.newTunnelID(), router2.newTunnelID())
+	assert.Equal(t, router1.newCircuitID(), router2.newCircuitID())
+
+	h1, err := router1.startHandshake(&hostKey.PublicKey, p2p.HandshakeVersionDH, 0)
+	require.Nil(t, err)
+	h2, err := router2.startHandshake(&hostKey.PublicKey, p2p.HandshakeVersionDH, 0)
+	require.Nil(t, err)
+	assert.Equal(t, h1.(*dhHandshake).privDH, h2.(*dhHandshake).privDH)
+
+	// the encryption of the handshake does not draw from the seeded source
+	assert.Equal(t, router1.newTunnelID(), router2.newTunnelID())
+}
+
+func TestRouterAnnounceTunnel(t *testing.T) {
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+
+	t.Run("invalid tunnel", func(t *testing.T) {
+		assert.Equal(t, ErrInvalidTunnel, router.AnnounceTunnel(1))
+	})
+
+	t.Run("send opened", func(t *testing.T) {
+		link, connRemote := newPipeLink()
+		defer connRemote.Close()
+		tunnel := &Tunnel{
+			id:   42,
+			link: link,
+			quit: make(chan struct{}),
+		}
+		hop := &rps.Peer{DHShared: [32]byte{1, 2, 3}}
+		tunnel.addHop(hop, newKeyCipher(&hop.DHShared))
+		remote := newHopEnd(connRemote, tunnel)
+		router.outgoingTunnels[42] = tunnel
+		defer delete(router.outgoingTunnels, 42)
+
+		go func() {
+			_ = router.AnnounceTunnel(42)
+		}()
+		hdr, _ := readRelayFromPrevHop(t, remote)
+		assert.Equal(t, p2p.RelayTypeTunnelOpened, hdr.RelayType)
+
+		// the last hop would not know the message
+		tunnel.caps = []p2p.Capabilities{p2p.CapabilityTimestamp}
+		assert.Nil(t, router.AnnounceTunnel(42))
+	})
+
+	t.Run("announce on opened", func(t *testing.T) {
+		var incoming []uint32
+		router.RegisterClient(&ClientFuncs{Incoming: func(tunnelID uint32) error {
+			incoming = append(incoming, tunnelID)
+			return nil
+		}})
+
+		newOpened := func(tunnel *tunnelSegment) []byte {
+			tunnel.recvDigest, tunnel.sendDigest = p2p.NewRelayDigests(tunnel.dhShared)
+			tunnel.cipher = newKeyCipher(tunnel.dhShared)
+			forward, _ := p2p.NewRelayDigests(tunnel.dhShared)
+
+			buf := make([]byte, p2p.MaxRelayDataSize+p2p.RelayHeaderSize)
+			_, n, err := p2p.PackRelayMessage(buf, 0, &p2p.RelayTunnelOpened{}, forward)
+			require.Nil(t, err)
+			body, err := p2p.EncryptRelay(buf[:n], tunnel.dhShared)
+			require.Nil(t, err)
+			return body
+		}
+
+		tunnel := &tunnelSegment{tunnelID: 43, dhShared: &[32]byte{4, 5, 6}}
+		router.tunnels[43] = nil
+		require.Nil(t, router.handleIncomingTunnelRelayMsg(nil, nil, tunnel, &p2p.Header{}, newOpened(tunnel)))
+		assert.Equal(t, []uint32{43}, incoming)
+		assert.Contains(t, router.incomingTunnels, uint32(43))
+
+		// only the last hop announces the tunnel
+		tunnel = &tunnelSegment{tunnelID: 44, dhShared: &[32]byte{7, 8, 9}, nextHopLink: &Link{}}
+		router.tunnels[44] = nil
+		assert.Equal(t, p2p.ErrInvalidMessage,
+			router.handleIncomingTunnelRelayMsg(nil, nil, tunnel, &p2p.Header{}, newOpened(tunnel)))
+		assert.Equal(t, []uint32{43}, incoming)
+	})
+}
+
+// spanRecorder is a trace.Exporter recording the exported spans by their name for testing.
+type spanRecorder struct {
+	lock  sync.Mutex
+	spans map[string][]*trace.Span
+}
+
+func (r *spanRecorder) Export(spans []*trace.Span) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.spans == nil {
+		r.spans = make(map[string][]*trace.Span)
+	}
+	for _, span := range spans {
+		r.spans[span.Name] = append(r.spans[span.Name], span)
+	}
+	return nil
+}
+
+func TestRouterTracing(t *testing.T) {
+	discard := log.New(ioutil.Discard, "", 0)
+
+	t.Run("failed build", func(t *testing.T) {
+		peers := []*rps.Peer{{Address: net.ParseIP("10.0.0.1"), Port: 6602}, {Address: net.ParseIP("10.0.0.2"), Port: 6602}}
+		target := &rps.Peer{Address: net.ParseIP("10.0.1.1"), Port: 6602}
+
+		exporter := &spanRecorder{}
+		tracer := trace.NewTracer(exporter, discard)
+		router := newRouter(&config.Config{TunnelLength: 3, BuildTimeout: 1}, WithRPS(&mockRPS{peers: peers}),
+			WithTransport(&refusingTransport{}), WithTracer(tracer))
+
+		_, err := router.buildTunnel(target, nil, 1, router.newCircuitID(), nil)
+		require.NotNil(t, err)
+		tracer.Close()
+
+		spans := exporter.spans
+		require.Len(t, spans["tunnel"], 1)
+		require.Len(t, spans["tunnel.build"], 1)
+		require.Len(t, spans["tunnel.create"], 1)
+		require.Len(t, spans["link"], 1)
+		assert.Empty(t, spans["tunnel.extend"])
+
+		// the spans form a single trace, all of them failed
+		root := spans["tunnel"][0]
+		assert.Equal(t, root.SpanID, spans["tunnel.build"][0].ParentID)
+		assert.Equal(t, spans["tunnel.build"][0].SpanID, spans["tunnel.create"][0].ParentID)
+		assert.Equal(t, spans["tunnel.create"][0].SpanID, spans["link"][0].ParentID)
+		for _, span := range []*trace.Span{root, spans["tunnel.build"][0], spans["tunnel.create"][0], spans["link"][0]} {
+			assert.Equal(t, root.TraceID, span.TraceID)
+			assert.NotNil(t, span.Err)
+		}
+		assert.Contains(t, spans["tunnel.create"][0].Attributes, trace.Attribute{Key: "hop.address", Value: "10.0.0.1"})
+	})
+
+	t.Run("segment", func(t *testing.T) {
+		// the handshake with the first hop requires a full-size key
+		hostKey, err := rsa.GenerateKey(rand.Reader, 4096)
+		require.Nil(t, err)
+		hop := &rps.Peer{Address: net.ParseIP("10.0.0.1"), Port: 6602, HostKey: &hostKey.PublicKey}
+
+		exporter := &spanRecorder{}
+		tracer := trace.NewTracer(exporter, discard)
+		peer := newRouter(&config.Config{HostKey: hostKey, BuildTimeout: 1}, WithRPS(&mockRPS{}), WithTracer(tracer))
+		transport := &peerTransport{peers: map[string]*Router{"10.0.0.1": peer}}
+		router := newRouter(&config.Config{BuildTimeout: 1}, WithRPS(&mockRPS{}), WithTransport(transport))
+
+		// the segment is traced until the initiator tears it down
+		first := router.createFirstHop(nil, hop, 0, router.newCircuitID())
+		require.Nil(t, first.err)
+		router.releaseFirstHop(first)
+		require.Eventually(t, func() bool {
+			peer.tunnelsLock.RLock()
+			defer peer.tunnelsLock.RUnlock()
+			return peer.numSegments == 0
+		}, 3*time.Second, 10*time.Millisecond)
+		tracer.Close()
+
+		require.Len(t, exporter.spans["tunnel.segment"], 1)
+		segment := exporter.spans["tunnel.segment"][0]
+		assert.Contains(t, segment.Attributes, trace.Attribute{Key: "prev_hop.circuit.id", Value: first.circuitID})
+		assert.Contains(t, segment.Attributes, trace.Attribute{Key: "cells.forward", Value: uint64(0)})
+	})
 }
@@ -0,0 +1,141 @@
+package onion
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"bawang/errcode"
+)
+
+const (
+	// shareLifetime is the time a token granting access to a tunnel can be redeemed in, see Router.ShareTunnel.
+	shareLifetime = 5 * time.Minute
+
+	// maxShares limits the number of tokens not redeemed yet. Expired tokens are forgotten first, no further ones are
+	// handed out until then.
+	maxShares = 1024
+)
+
+var (
+	ErrNotRegistered = errcode.New(errcode.ModuleOnion, errcode.NotAllowed, false,
+		"client is not registered on the tunnel")
+	ErrInvalidToken  = errcode.New(errcode.ModuleOnion, errcode.NotAllowed, false, "invalid or expired share token")
+	ErrTooManyShares = errcode.New(errcode.ModuleOnion, errcode.Limit, true, "too many share tokens not redeemed")
+)
+
+// shareToken is a token granting access to the tunnel with the given ID and the time it was handed out at.
+type shareToken struct {
+	tunnelID uint32
+	at       time.Time
+}
+
+// tunnelShares tracks the tokens granting clients access to the tunnels of others, see Router.ShareTunnel. The zero
+// value is ready to use and safe for concurrent use.
+type tunnelShares struct {
+	lock   sync.Mutex
+	tokens map[uint64]shareToken
+}
+
+// add registers the given token for the tunnel with the given ID. Returns false if there are too many tokens which
+// were neither redeemed nor expired.
+func (s *tunnelShares) add(token uint64, tunnelID uint32, now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.tokens == nil {
+		s.tokens = make(map[uint64]shareToken)
+	}
+	if len(s.tokens) >= maxShares {
+		for token, share := range s.tokens {
+			if now.Sub(share.at) >= shareLifetime {
+				delete(s.tokens, token)
+			}
+		}
+		if len(s.tokens) >= maxShares {
+			return false
+		}
+	}
+	s.tokens[token] = shareToken{tunnelID: tunnelID, at: now}
+	return true
+}
+
+// redeem checks whether the given token grants access to the tunnel with the given ID. Each token is redeemed once,
+// even if it was presented for another tunnel.
+func (s *tunnelShares) redeem(token uint64, tunnelID uint32, now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	share, ok := s.tokens[token]
+	if !ok {
+		return false
+	}
+	delete(s.tokens, token)
+	return share.tunnelID == tunnelID && now.Sub(share.at) < shareLifetime
+}
+
+// CheckClient checks whether the given client is registered on the tunnel with the given ID and may thus use it,
+// e.g. send data on it or destroy it. Unknown tunnels are reported as ErrInvalidTunnel, the tunnels of other clients
+// as ErrNotRegistered.
+func (r *Router) CheckClient(tunnelID uint32, client Client) error {
+	r.tunnelsLock.RLock()
+	defer r.tunnelsLock.RUnlock()
+
+	clients, ok := r.tunnels[tunnelID]
+	if !ok {
+		return ErrInvalidTunnel
+	}
+	for _, c := range clients {
+		if c == client {
+			return nil
+		}
+	}
+	return ErrNotRegistered
+}
+
+// ShareTunnel returns a token granting another client access to the tunnel with the given ID, which the given client
+// must be registered on. The token is passed on to the other client by other means and redeemed once within
+// shareLifetime, see JoinTunnel.
+func (r *Router) ShareTunnel(tunnelID uint32, client Client) (token uint64, err error) {
+	err = r.CheckClient(tunnelID, client)
+	if err != nil {
+		return 0, err
+	}
+
+	// unlike IDs, tokens must not be guessable
+	var buf [8]byte
+	_, err = io.ReadFull(r.rand, buf[:])
+	if err != nil {
+		return 0, err
+	}
+	token = binary.BigEndian.Uint64(buf[:])
+
+	if !r.shares.add(token, tunnelID, r.clock.Now()) {
+		return 0, ErrTooManyShares
+	}
+	return token, nil
+}
+
+// JoinTunnel registers the given client on the tunnel with the given ID, granted by the given token handed out by
+// ShareTunnel. The client then receives the data of the tunnel and may use it like the client sharing it.
+func (r *Router) JoinTunnel(tunnelID uint32, token uint64, client Client) error {
+	if !r.shares.redeem(token, tunnelID, r.clock.Now()) {
+		return ErrInvalidToken
+	}
+
+	r.tunnelsLock.Lock()
+	defer r.tunnelsLock.Unlock()
+
+	clients, ok := r.tunnels[tunnelID]
+	if !ok {
+		return ErrInvalidTunnel
+	}
+	for _, c := range clients {
+		if c == client {
+			return nil
+		}
+	}
+	r.tunnels[tunnelID] = append(clients, client)
+	return nil
+}
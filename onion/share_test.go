@@ -0,0 +1,91 @@
+package onion
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+)
+
+func TestTunnelShares(t *testing.T) {
+	var s tunnelShares
+	now := time.Unix(1000000, 0)
+
+	require.True(t, s.add(1, 42, now))
+	assert.False(t, s.redeem(2, 42, now), "unknown token")
+	assert.True(t, s.redeem(1, 42, now.Add(time.Minute)))
+	assert.False(t, s.redeem(1, 42, now), "tokens are only redeemed once")
+
+	// tokens presented for another tunnel are used up as well
+	require.True(t, s.add(1, 42, now))
+	assert.False(t, s.redeem(1, 43, now))
+	assert.False(t, s.redeem(1, 42, now))
+
+	require.True(t, s.add(1, 42, now))
+	assert.False(t, s.redeem(1, 42, now.Add(shareLifetime)), "expired")
+
+	t.Run("full", func(t *testing.T) {
+		for token := uint64(0); token < maxShares; token++ {
+			require.True(t, s.add(token, 42, now))
+		}
+		assert.False(t, s.add(maxShares, 42, now.Add(time.Minute)))
+
+		// further tokens are only handed out once others expired
+		assert.True(t, s.add(maxShares, 42, now.Add(shareLifetime)))
+		assert.Len(t, s.tokens, 1)
+	})
+}
+
+func TestRouterShareTunnel(t *testing.T) {
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+	owner, other := &ClientFuncs{}, &ClientFuncs{}
+	router.RegisterClient(owner)
+	router.RegisterClient(other)
+	router.tunnels[42] = []Client{owner}
+
+	assert.Nil(t, router.CheckClient(42, owner))
+	assert.Equal(t, ErrNotRegistered, router.CheckClient(42, other))
+	assert.Equal(t, ErrInvalidTunnel, router.CheckClient(1, owner))
+
+	// only clients registered on the tunnel may share it
+	_, err := router.ShareTunnel(42, other)
+	assert.Equal(t, ErrNotRegistered, err)
+	assert.Equal(t, ErrInvalidToken, router.JoinTunnel(42, 0, other))
+
+	token, err := router.ShareTunnel(42, owner)
+	require.Nil(t, err)
+	require.Nil(t, router.JoinTunnel(42, token, other))
+	assert.Nil(t, router.CheckClient(42, other))
+	assert.Equal(t, []Client{owner, other}, router.tunnels[42])
+
+	// the other client may share it in turn, joining twice does not register it twice
+	token, err = router.ShareTunnel(42, other)
+	require.Nil(t, err)
+	require.Nil(t, router.JoinTunnel(42, token, owner))
+	assert.Len(t, router.tunnels[42], 2)
+
+	t.Run("torn down", func(t *testing.T) {
+		token, err := router.ShareTunnel(42, owner)
+		require.Nil(t, err)
+		delete(router.tunnels, 42)
+		assert.Equal(t, ErrInvalidTunnel, router.JoinTunnel(42, token, other))
+	})
+
+	t.Run("no randomness", func(t *testing.T) {
+		router := newRouter(&config.Config{}, WithRPS(&mockRPS{}), WithRand(failingReader{}))
+		router.tunnels[42] = []Client{owner}
+		_, err := router.ShareTunnel(42, owner)
+		assert.NotNil(t, err)
+	})
+}
+
+// failingReader is a source of randomness which is exhausted.
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("exhausted")
+}
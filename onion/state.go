@@ -0,0 +1,240 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"bawang/rps"
+)
+
+// stateVersion is the version of the state file format.
+const stateVersion = 1
+
+// routerState is persisted in the state file to rebuild the tunnels requested by clients after a restart.
+type routerState struct {
+	Version      int                `json:"version"`
+	Destinations []stateDestination `json:"destinations"`
+}
+
+// stateDestination is the target peer of a tunnel requested by a client.
+type stateDestination struct {
+	Address net.IP `json:"address"`
+	Port    uint16 `json:"port"`
+	HostKey []byte `json:"hostkey"` // PKCS #1 DER encoded public key
+}
+
+// loadState reads the destinations of the tunnels active before the last shutdown from the configured state file.
+// The tunnels are rebuilt in the first round. A missing state file is not an error.
+func (r *Router) loadState() (err error) {
+	if r.cfg == nil || r.cfg.StateFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(r.cfg.StateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error reading state file: %w", err)
+	}
+
+	state := routerState{}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return fmt.Errorf("error parsing state file: %w", err)
+	}
+	if state.Version != stateVersion {
+		return fmt.Errorf("unsupported state file version %d", state.Version)
+	}
+
+	peers := make([]*rps.Peer, 0, len(state.Destinations))
+	for _, dest := range state.Destinations {
+		hostKey, err := x509.ParsePKCS1PublicKey(dest.HostKey)
+		if err != nil {
+			return fmt.Errorf("error parsing host key in state file: %w", err)
+		}
+		peers = append(peers, &rps.Peer{
+			Address: dest.Address,
+			Port:    dest.Port,
+			HostKey: hostKey,
+		})
+	}
+
+	r.stateLock.Lock()
+	r.pendingRestore = peers
+	r.stateLock.Unlock()
+
+	return nil
+}
+
+// saveState atomically writes the destinations of all outgoing tunnels requested by clients to the configured state
+// file.
+func (r *Router) saveState() (err error) {
+	if r.cfg == nil || r.cfg.StateFile == "" {
+		return nil
+	}
+
+	state := routerState{
+		Version:      stateVersion,
+		Destinations: []stateDestination{},
+	}
+
+	r.tunnelsLock.RLock()
+	for tunnelID := range r.tunnels {
+		tunnel, ok := r.outgoingTunnels[tunnelID]
+		if !ok || tunnel.target == nil || tunnel.target.HostKey == nil {
+			continue
+		}
+		state.Destinations = append(state.Destinations, stateDestination{
+			Address: tunnel.target.Address,
+			Port:    tunnel.target.Port,
+			HostKey: x509.MarshalPKCS1PublicKey(tunnel.target.HostKey),
+		})
+	}
+	r.tunnelsLock.RUnlock()
+
+	// tunnels which were not rebuilt yet must not be forgotten
+	r.stateLock.Lock()
+	for _, peer := range r.pendingRestore {
+		state.Destinations = append(state.Destinations, stateDestination{
+			Address: peer.Address,
+			Port:    peer.Port,
+			HostKey: x509.MarshalPKCS1PublicKey(peer.HostKey),
+		})
+	}
+	r.stateLock.Unlock()
+
+	data, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(r.cfg.StateFile, data)
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory first and then renames it, so that the file
+// at path is never left partially written.
+func writeFileAtomic(path string, data []byte) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// handleStateEvent persists the state whenever the set of tunnels changes.
+func (r *Router) handleStateEvent(ev Event) {
+	switch ev.Type {
+	case EventTunnelBuilt, EventTunnelDestroyed:
+		err := r.saveState()
+		if err != nil {
+			r.logger.Printf("Error saving state: %v\n", err)
+		}
+	default: // other events do not change the state
+	}
+}
+
+// restoreTunnels rebuilds the tunnels loaded from the state file. The restored tunnels are kept for one round without
+// any clients, waiting for a client to request a tunnel to the same destination again, see adoptRestoredTunnel.
+func (r *Router) restoreTunnels() {
+	r.stateLock.Lock()
+	peers := r.pendingRestore
+	r.pendingRestore = nil
+	r.stateLock.Unlock()
+
+	for _, peer := range peers {
+		err := r.admitTunnel()
+		if err != nil {
+			r.logger.Printf("Not restoring tunnel to %v:%v: %v\n", peer.Address, peer.Port, err)
+			continue
+		}
+
+		// restored tunnels have no client yet, thus they are built like the cover tunnel
+		tunnel, err := r.buildNewTunnel(peer, nil, nil)
+		r.tunnelsLock.Lock()
+		r.releaseTunnel()
+		r.tunnelsLock.Unlock()
+		if err != nil {
+			r.logger.Printf("Error restoring tunnel to %v:%v: %v\n", peer.Address, peer.Port, err)
+			continue
+		}
+
+		// registering the tunnel without any clients makes sure it is torn down in the next round if not adopted
+		r.tunnelsLock.Lock()
+		r.tunnels[tunnel.id] = []Client{}
+		r.tunnelsLock.Unlock()
+
+		r.stateLock.Lock()
+		r.restored = append(r.restored, tunnel)
+		r.stateLock.Unlock()
+	}
+
+	err := r.saveState()
+	if err != nil {
+		r.logger.Printf("Error saving state: %v\n", err)
+	}
+}
+
+// adoptRestoredTunnel hands a restored tunnel to the given target peer over to the client, if one exists.
+func (r *Router) adoptRestoredTunnel(targetPeer *rps.Peer, client Client) (tunnel *Tunnel, ok bool) {
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+
+	for i, restored := range r.restored {
+		if !sameDestination(restored.target, targetPeer) {
+			continue
+		}
+		r.restored = append(r.restored[:i], r.restored[i+1:]...)
+
+		r.tunnelsLock.Lock()
+		defer r.tunnelsLock.Unlock()
+		if _, ok := r.outgoingTunnels[restored.id]; !ok { // already torn down
+			return nil, false
+		}
+		r.tunnels[restored.id] = append(r.tunnels[restored.id], client)
+		return restored, true
+	}
+
+	return nil, false
+}
+
+// sameDestination checks whether two peers are the same destination.
+func sameDestination(a, b *rps.Peer) bool {
+	if a == nil || b == nil || a.HostKey == nil || b.HostKey == nil {
+		return false
+	}
+	return a.Address.Equal(b.Address) && a.Port == b.Port &&
+		bytes.Equal(x509.MarshalPKCS1PublicKey(a.HostKey), x509.MarshalPKCS1PublicKey(b.HostKey))
+}
+
+// forgetRestoredTunnels stops offering the restored tunnels for adoption.
+// Restored tunnels which were not adopted are torn down as unused tunnels.
+func (r *Router) forgetRestoredTunnels() {
+	r.stateLock.Lock()
+	r.restored = nil
+	r.stateLock.Unlock()
+}
@@ -0,0 +1,100 @@
+package onion
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/rps"
+)
+
+func TestRouterState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bawang-state")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	hostKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+	target := &rps.Peer{
+		Address: net.ParseIP("10.0.0.1"),
+		Port:    6303,
+		HostKey: &hostKey.PublicKey,
+	}
+
+	t.Run("missing state file", func(t *testing.T) {
+		router, err := NewRouter(&config.Config{StateFile: stateFile}, WithRPS(&mockRPS{}))
+		require.Nil(t, err)
+		assert.Empty(t, router.pendingRestore)
+	})
+
+	t.Run("save and load", func(t *testing.T) {
+		router, err := NewRouter(&config.Config{StateFile: stateFile}, WithRPS(&mockRPS{}))
+		require.Nil(t, err)
+
+		// only tunnels requested by clients are persisted, not e.g. the cover tunnel
+		router.outgoingTunnels[1] = &Tunnel{id: 1, target: target}
+		router.tunnels[1] = []Client{&ClientFuncs{}}
+		router.outgoingTunnels[2] = &Tunnel{id: 2, target: &rps.Peer{Address: net.ParseIP("10.0.0.2")}}
+		router.events.publish(Event{Type: EventTunnelBuilt, TunnelID: 1})
+
+		restarted, err := NewRouter(&config.Config{StateFile: stateFile}, WithRPS(&mockRPS{}))
+		require.Nil(t, err)
+		require.Len(t, restarted.pendingRestore, 1)
+		assert.True(t, sameDestination(target, restarted.pendingRestore[0]))
+
+		// the state is rewritten when tunnels are destroyed
+		delete(router.tunnels, 1)
+		delete(router.outgoingTunnels, 1)
+		router.events.publish(Event{Type: EventTunnelDestroyed, TunnelID: 1})
+
+		restarted, err = NewRouter(&config.Config{StateFile: stateFile}, WithRPS(&mockRPS{}))
+		require.Nil(t, err)
+		assert.Empty(t, restarted.pendingRestore)
+	})
+
+	t.Run("invalid state file", func(t *testing.T) {
+		err := ioutil.WriteFile(stateFile, []byte("{"), 0600)
+		require.Nil(t, err)
+		_, err = NewRouter(&config.Config{StateFile: stateFile}, WithRPS(&mockRPS{}))
+		require.NotNil(t, err)
+
+		err = ioutil.WriteFile(stateFile, []byte(`{"version":42}`), 0600)
+		require.Nil(t, err)
+		_, err = NewRouter(&config.Config{StateFile: stateFile}, WithRPS(&mockRPS{}))
+		require.NotNil(t, err)
+	})
+
+	t.Run("adopt restored tunnel", func(t *testing.T) {
+		router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+		restored := &Tunnel{id: 1, target: target}
+		router.outgoingTunnels[1] = restored
+		router.tunnels[1] = []Client{}
+		router.restored = []*Tunnel{restored}
+
+		// a different destination is built in the next round as usual
+		client := &ClientFuncs{}
+		other := &rps.Peer{Address: net.ParseIP("10.0.0.1"), Port: 6304, HostKey: &hostKey.PublicKey}
+		replyChan := router.BuildTunnel(other, client)
+		select {
+		case <-replyChan:
+			t.Fatal("tunnel to a different destination was adopted")
+		default:
+		}
+		require.Len(t, router.buildQueue, 1)
+
+		reply := <-router.BuildTunnel(target, client)
+		require.Nil(t, reply.Err)
+		assert.Equal(t, restored, reply.Tunnel)
+		assert.Equal(t, []Client{client}, router.tunnels[1])
+		assert.Empty(t, router.restored)
+	})
+}
@@ -0,0 +1,148 @@
+package onion
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"time"
+
+	"bawang/errcode"
+	"bawang/nse"
+)
+
+// Stats is a snapshot of the state of the Router, e.g. for monitoring.
+type Stats struct {
+	OutgoingTunnels int // number of outgoing tunnels, including the cover tunnels
+	CoverTunnels    int // number of outgoing tunnels used for cover traffic
+	IncomingTunnels int // number of incoming tunnel segments, including the ones we are an intermediate hop of
+	Links           int // number of open links to other peers
+	BannedPeers     int // number of peers currently excluded from path selection
+
+	CoverCells   uint64 // number of cover cells sent since the start, see Router.SendCover
+	BuildRetries uint64 // number of tunnel builds retried through another path since the start
+
+	// number of failed tunnel builds since the start by the position of the first hop not reached, 0 being the first
+	// hop. The destination is the last position.
+	HopFailures map[int]uint64
+
+	// moving average of the duration of the CREATE and EXTEND steps of the tunnel builds by the position of the hop,
+	// see Router.HopLatencies for the hops themselves
+	HopLatencies map[int]time.Duration
+
+	Errors map[errcode.Code]uint64 // number of errors encountered since the start by their code
+
+	NetworkSize      nse.Estimate // latest network size estimate of the NSE module
+	NetworkSizeKnown bool         // whether NetworkSize holds an estimate
+}
+
+// Stats returns a snapshot of the state of the Router.
+func (r *Router) Stats() (stats Stats) {
+	r.tunnelsLock.RLock()
+	stats.OutgoingTunnels = len(r.outgoingTunnels)
+	stats.CoverTunnels = len(r.liveCoverTunnels())
+	stats.IncomingTunnels = len(r.incomingTunnels)
+	r.tunnelsLock.RUnlock()
+
+	r.linksLock.Lock()
+	stats.Links = r.numLinks
+	r.linksLock.Unlock()
+
+	r.coverLock.Lock()
+	stats.CoverCells = r.coverCells
+	r.coverLock.Unlock()
+
+	stats.BannedPeers = len(r.BannedPeers())
+	stats.Errors = r.errorCounts.snapshot()
+	stats.HopFailures, stats.BuildRetries = r.hopFailures.snapshot()
+	stats.HopLatencies = r.latencies.byPosition()
+	stats.NetworkSize, stats.NetworkSizeKnown = r.networkSize()
+	return stats
+}
+
+// TunnelInfo describes a tunnel known to the clients, see Router.Tunnels.
+type TunnelInfo struct {
+	ID        uint32
+	Outgoing  bool            // whether we initiated the tunnel, otherwise it terminates at this peer
+	Cover     bool            // whether the outgoing tunnel is used for cover traffic
+	Hops      int             // number of hops of the outgoing tunnel
+	Latencies []time.Duration // duration of the CREATE or EXTEND step of each hop of the outgoing tunnel
+	Clients   int             // number of clients using the tunnel
+	Idle      time.Duration   // time since the last traffic on the tunnel
+}
+
+// Tunnels returns a snapshot of the tunnels known to the clients, i.e. the outgoing tunnels and the incoming tunnels
+// terminating at this peer, sorted by their ID. Tunnels which are still being built are not included.
+func (r *Router) Tunnels() (tunnels []TunnelInfo) {
+	now := r.clock.Now()
+
+	r.tunnelsLock.RLock()
+	cover := make(map[uint32]bool, len(r.coverTunnels))
+	for _, tunnelID := range r.coverTunnels {
+		cover[tunnelID] = true
+	}
+	for tunnelID, tunnel := range r.outgoingTunnels {
+		tunnels = append(tunnels, TunnelInfo{
+			ID:        tunnelID,
+			Outgoing:  true,
+			Cover:     cover[tunnelID],
+			Hops:      len(tunnel.hops),
+			Latencies: append([]time.Duration(nil), tunnel.latencies...),
+			Clients:   len(r.tunnels[tunnelID]),
+			Idle:      tunnel.activity.idle(now),
+		})
+	}
+	for tunnelID, tunnel := range r.incomingTunnels {
+		tunnels = append(tunnels, TunnelInfo{
+			ID:      tunnelID,
+			Clients: len(r.tunnels[tunnelID]),
+			Idle:    tunnel.activity.idle(now),
+		})
+	}
+	r.tunnelsLock.RUnlock()
+
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].ID < tunnels[j].ID
+	})
+	return tunnels
+}
+
+// LinkInfo describes an open link to another peer, see Router.Links.
+type LinkInfo struct {
+	Address  net.IP
+	Port     uint16
+	Circuits int  // number of circuits carried by the link
+	Idle     bool // whether the link is only kept open for reuse
+	Queued   int  // number of messages waiting for their turn to be sent
+
+	// turns each circuit got while sharing the link with other circuits of its priority class, by the ID of the
+	// circuit. They are about even among the busy circuits, see writeScheduler.
+	ContendedTurns map[uint32]uint64
+}
+
+// Links returns a snapshot of the open links to other peers, sorted by the address and port of the peers.
+func (r *Router) Links() (links []LinkInfo) {
+	r.linksLock.Lock()
+	for _, peerLinks := range r.links {
+		for _, link := range peerLinks {
+			_, idle := r.idleLinks[link]
+			links = append(links, LinkInfo{
+				Address:  link.address,
+				Port:     link.port,
+				Circuits: link.numTunnels(),
+				Idle:     idle,
+				Queued:   link.writer.queued(),
+
+				ContendedTurns: link.writer.contendedTurns(),
+			})
+		}
+	}
+	r.linksLock.Unlock()
+
+	sort.Slice(links, func(i, j int) bool {
+		if c := bytes.Compare(links[i].Address.To16(), links[j].Address.To16()); c != 0 {
+			return c < 0
+		}
+		return links[i].Port < links[j].Port
+	})
+	return links
+}
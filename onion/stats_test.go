@@ -0,0 +1,61 @@
+package onion
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"bawang/config"
+	"bawang/rps"
+)
+
+func TestRouterTunnels(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}), WithClock(clock))
+
+	outgoing := &Tunnel{id: 3, hops: make([]*rps.Peer, 3)}
+	outgoing.activity.touch(clock.Now().Add(-time.Minute))
+	router.outgoingTunnels[3] = outgoing
+	router.outgoingTunnels[1] = &Tunnel{id: 1, hops: make([]*rps.Peer, 2)}
+	router.coverTunnels = []uint32{1}
+	router.incomingTunnels[2] = &tunnelSegment{tunnelID: 2}
+	router.tunnels[2] = []Client{&ClientFuncs{}, &ClientFuncs{}}
+	router.tunnels[3] = []Client{&ClientFuncs{}}
+
+	tunnels := router.Tunnels()
+	assert.Equal(t, []uint32{1, 2, 3}, []uint32{tunnels[0].ID, tunnels[1].ID, tunnels[2].ID})
+	assert.Equal(t, TunnelInfo{ID: 3, Outgoing: true, Hops: 3, Clients: 1, Idle: time.Minute}, tunnels[2])
+	assert.True(t, tunnels[0].Outgoing)
+	assert.True(t, tunnels[0].Cover)
+	assert.False(t, tunnels[1].Outgoing)
+	assert.Equal(t, 2, tunnels[1].Clients)
+}
+
+func TestRouterLinks(t *testing.T) {
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+
+	newTestLink := func(address string, port uint16, circuits ...uint32) *Link {
+		link := &Link{
+			address: net.ParseIP(address),
+			port:    port,
+			dataOut: make(map[uint32]chan message),
+		}
+		for _, circuitID := range circuits {
+			link.dataOut[circuitID] = make(chan message)
+		}
+		router.addLink(link)
+		return link
+	}
+	newTestLink("10.0.0.2", 1, 5)
+	idle := newTestLink("10.0.0.1", 2)
+	newTestLink("10.0.0.1", 1, 1, 2)
+	router.idleLinks[idle] = struct{}{}
+
+	assert.Equal(t, []LinkInfo{
+		{Address: net.ParseIP("10.0.0.1"), Port: 1, Circuits: 2},
+		{Address: net.ParseIP("10.0.0.1"), Port: 2, Idle: true},
+		{Address: net.ParseIP("10.0.0.2"), Port: 1, Circuits: 1},
+	}, router.Links())
+}
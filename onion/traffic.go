@@ -0,0 +1,181 @@
+package onion
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"bawang/p2p"
+)
+
+// TunnelTraffic counts the traffic of a tunnel since it was built, see Router.TunnelTraffic. Sent and received are
+// seen from this peer, i.e. received cells of an outgoing tunnel come from its hops and received cells of an incoming
+// tunnel from the initiator. Relayed cells of tunnels we are an intermediate hop of are not counted.
+type TunnelTraffic struct {
+	BytesSent     uint64 // application payload of the data and datagram cells sent on the tunnel
+	BytesReceived uint64 // application payload of the data and datagram cells received on the tunnel
+	CellsSent     uint64 // relay cells sent on the tunnel, including cover cells
+	CellsReceived uint64 // relay cells received on the tunnel, including cover cells
+	CoverSent     uint64 // cover cells sent on the tunnel, including pings
+	CoverReceived uint64 // cover cells received on the tunnel, including pongs
+}
+
+// trafficCounter counts the traffic of a single tunnel. The counts are accessed atomically, a nil counter counts
+// nothing.
+type trafficCounter struct {
+	counts TunnelTraffic // must be the first field to guarantee 64-bit alignment for atomic access
+}
+
+// sent counts a relay message sent on the tunnel.
+func (c *trafficCounter) sent(msg p2p.RelayMessage) {
+	if c == nil {
+		return
+	}
+	atomic.AddUint64(&c.counts.CellsSent, 1)
+
+	var data []byte
+	switch msg := msg.(type) {
+	case *p2p.RelayTunnelData:
+		data = msg.Data
+	case *p2p.RelayTunnelSeqData:
+		data = msg.Data
+	case *p2p.RelayTunnelDatagram:
+		data = msg.Data
+	case *p2p.RelayTunnelBatch:
+		for _, payload := range msg.Payloads {
+			atomic.AddUint64(&c.counts.BytesSent, uint64(len(payload)))
+		}
+	case *p2p.RelayTunnelCover:
+		atomic.AddUint64(&c.counts.CoverSent, 1)
+	}
+	if len(data) > 0 {
+		atomic.AddUint64(&c.counts.BytesSent, uint64(len(data)))
+	}
+}
+
+// receivedCell counts a relay cell of the given type received on the tunnel.
+func (c *trafficCounter) receivedCell(relayType p2p.RelayType) {
+	if c == nil {
+		return
+	}
+	atomic.AddUint64(&c.counts.CellsReceived, 1)
+	if relayType == p2p.RelayTypeTunnelCover {
+		atomic.AddUint64(&c.counts.CoverReceived, 1)
+	}
+}
+
+// receivedBytes counts n bytes of application payload received on the tunnel.
+func (c *trafficCounter) receivedBytes(n int) {
+	if c == nil {
+		return
+	}
+	atomic.AddUint64(&c.counts.BytesReceived, uint64(n))
+}
+
+// snapshot returns a copy of the counts.
+func (c *trafficCounter) snapshot() (t TunnelTraffic) {
+	if c == nil {
+		return t
+	}
+	t.BytesSent = atomic.LoadUint64(&c.counts.BytesSent)
+	t.BytesReceived = atomic.LoadUint64(&c.counts.BytesReceived)
+	t.CellsSent = atomic.LoadUint64(&c.counts.CellsSent)
+	t.CellsReceived = atomic.LoadUint64(&c.counts.CellsReceived)
+	t.CoverSent = atomic.LoadUint64(&c.counts.CoverSent)
+	t.CoverReceived = atomic.LoadUint64(&c.counts.CoverReceived)
+	return t
+}
+
+// add adds the counts of t to the total counts.
+func (t *TunnelTraffic) add(other TunnelTraffic) {
+	t.BytesSent += other.BytesSent
+	t.BytesReceived += other.BytesReceived
+	t.CellsSent += other.CellsSent
+	t.CellsReceived += other.CellsReceived
+	t.CoverSent += other.CoverSent
+	t.CoverReceived += other.CoverReceived
+}
+
+// trafficCounters keeps the traffic counters of the tunnels by their ID known to the clients. A tunnel may have
+// several counters, e.g. once a rebuilt incoming tunnel segment replaced the old one, see replaceSegment.
+// It is safe for concurrent use.
+type trafficCounters struct {
+	lock    sync.Mutex
+	tunnels map[uint32][]*trafficCounter
+}
+
+// get returns the counter of the tunnel with the given ID, which is created if the tunnel has none yet. Thus a
+// rebuilt outgoing tunnel keeps counting where the old circuit stopped.
+func (c *trafficCounters) get(tunnelID uint32) *trafficCounter {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if counters := c.tunnels[tunnelID]; len(counters) > 0 {
+		return counters[0]
+	}
+	if c.tunnels == nil {
+		c.tunnels = make(map[uint32][]*trafficCounter)
+	}
+	counter := new(trafficCounter)
+	c.tunnels[tunnelID] = []*trafficCounter{counter}
+	return counter
+}
+
+// move adds the counters of the tunnel with the ID from to the ones of the tunnel with the ID to.
+func (c *trafficCounters) move(from, to uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if counters, ok := c.tunnels[from]; ok {
+		if c.tunnels == nil {
+			c.tunnels = make(map[uint32][]*trafficCounter)
+		}
+		c.tunnels[to] = append(c.tunnels[to], counters...)
+		delete(c.tunnels, from)
+	}
+}
+
+// total returns the sum of the counts of the tunnel with the given ID.
+func (c *trafficCounters) total(tunnelID uint32) (t TunnelTraffic) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, counter := range c.tunnels[tunnelID] {
+		t.add(counter.snapshot())
+	}
+	return t
+}
+
+// prune drops the counters of all tunnels for which keep returns false.
+func (c *trafficCounters) prune(keep func(tunnelID uint32) bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for tunnelID := range c.tunnels {
+		if !keep(tunnelID) {
+			delete(c.tunnels, tunnelID)
+		}
+	}
+}
+
+// TunnelTraffic returns the traffic counted on the tunnel with the given ID, which may be an outgoing or an incoming
+// tunnel. The counts survive rebuilds of the tunnel and are dropped once the tunnel is gone.
+func (r *Router) TunnelTraffic(tunnelID uint32) (traffic TunnelTraffic, err error) {
+	r.tunnelsLock.RLock()
+	_, ok := r.tunnels[tunnelID]
+	r.tunnelsLock.RUnlock()
+	if !ok {
+		return traffic, ErrInvalidTunnel
+	}
+	return r.traffic.total(tunnelID), nil
+}
+
+// pruneTraffic drops the traffic counters of tunnels which are gone.
+func (r *Router) pruneTraffic() {
+	r.tunnelsLock.RLock()
+	defer r.tunnelsLock.RUnlock()
+
+	r.traffic.prune(func(tunnelID uint32) bool {
+		_, ok := r.tunnels[tunnelID]
+		return ok
+	})
+}
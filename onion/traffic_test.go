@@ -0,0 +1,103 @@
+package onion
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/p2p"
+)
+
+func TestTrafficCounter(t *testing.T) {
+	c := new(trafficCounter)
+	c.sent(&p2p.RelayTunnelData{Data: []byte("data")})
+	c.sent(&p2p.RelayTunnelSeqData{Stream: 1, Seq: 1, Data: []byte("seq")})
+	c.sent(&p2p.RelayTunnelDatagram{Data: []byte("datagram")})
+	c.sent(&p2p.RelayTunnelBatch{Payloads: [][]byte{[]byte("voice"), []byte("frame")}})
+	c.sent(&p2p.RelayTunnelCover{})
+	c.sent(&p2p.RelayTunnelEOF{})
+	c.receivedCell(p2p.RelayTypeTunnelData)
+	c.receivedBytes(5)
+	c.receivedCell(p2p.RelayTypeTunnelCover)
+
+	assert.Equal(t, TunnelTraffic{
+		BytesSent:     25,
+		BytesReceived: 5,
+		CellsSent:     6,
+		CellsReceived: 2,
+		CoverSent:     1,
+		CoverReceived: 1,
+	}, c.snapshot())
+
+	// tunnels created without a counter count nothing
+	var none *trafficCounter
+	none.sent(&p2p.RelayTunnelData{Data: []byte("data")})
+	none.receivedCell(p2p.RelayTypeTunnelData)
+	none.receivedBytes(4)
+	assert.Equal(t, TunnelTraffic{}, none.snapshot())
+}
+
+func TestTrafficCounters(t *testing.T) {
+	var counters trafficCounters
+	assert.Equal(t, TunnelTraffic{}, counters.total(1))
+
+	// a rebuilt tunnel keeps its counter
+	first := counters.get(1)
+	assert.Same(t, first, counters.get(1))
+	first.receivedBytes(3)
+
+	// a replacing segment adds its counts to the ones of the tunnel
+	replacing := counters.get(2)
+	replacing.receivedBytes(4)
+	counters.move(2, 1)
+	assert.Equal(t, TunnelTraffic{BytesReceived: 7}, counters.total(1))
+	assert.Equal(t, TunnelTraffic{}, counters.total(2))
+	assert.Same(t, first, counters.get(1))
+
+	// counting goes on in both counters
+	replacing.receivedBytes(1)
+	assert.Equal(t, TunnelTraffic{BytesReceived: 8}, counters.total(1))
+
+	counters.get(3)
+	counters.prune(func(tunnelID uint32) bool {
+		return tunnelID == 3
+	})
+	assert.Equal(t, TunnelTraffic{}, counters.total(1))
+	assert.Len(t, counters.tunnels, 1)
+}
+
+func TestRouterTunnelTraffic(t *testing.T) {
+	router := newRouter(&config.Config{}, WithRPS(&mockRPS{}))
+
+	_, err := router.TunnelTraffic(1)
+	assert.Equal(t, ErrInvalidTunnel, err)
+
+	link, connRemote := newPipeLink()
+	defer connRemote.Close()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, connRemote)
+	}()
+
+	tunnel, _, _ := newBenchmarkTunnel(3)
+	tunnel.link = link
+	tunnel.traffic = router.traffic.get(tunnel.id)
+	router.outgoingTunnels[tunnel.id] = tunnel
+	router.tunnels[tunnel.id] = []Client{}
+
+	require.Nil(t, tunnel.sendRelayToLastHop(&p2p.RelayTunnelData{Data: []byte("data")}))
+	require.Nil(t, tunnel.sendRelayToLastHop(&p2p.RelayTunnelCover{}))
+
+	traffic, err := router.TunnelTraffic(tunnel.id)
+	require.Nil(t, err)
+	assert.Equal(t, TunnelTraffic{BytesSent: 4, CellsSent: 2, CoverSent: 1}, traffic)
+
+	// the counters of gone tunnels are dropped each round
+	router.traffic.get(42).receivedBytes(1)
+	router.pruneTraffic()
+	assert.Equal(t, TunnelTraffic{}, router.traffic.total(42))
+	assert.Equal(t, traffic, router.traffic.total(tunnel.id))
+}
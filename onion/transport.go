@@ -0,0 +1,186 @@
+package onion
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	"bawang/config"
+	"bawang/errcode"
+)
+
+// DefaultTransport is the name of the transport used for Links if none is configured.
+const DefaultTransport = "tls"
+
+// tlsSessionCacheSize is the max. number of peers TLS sessions are cached for to be resumed by later connections.
+const tlsSessionCacheSize = 256
+
+var (
+	ErrUnknownTransport = errcode.New(errcode.ModuleOnion, errcode.NotAllowed, false, "unknown transport")
+)
+
+// Transport abstracts how the connections underlying Links between peers are established.
+// All peers of a network must use the same transport.
+type Transport interface {
+	DialPeer(address net.IP, port uint16) (net.Conn, error) // DialPeer opens a connection to the peer given by address:port.
+	Listen(address string) (net.Listener, error)            // Listen accepts connections from other peers on the given address.
+}
+
+// TransportFactory creates a Transport for the given config.
+type TransportFactory func(cfg *config.Config) (Transport, error)
+
+var (
+	transportsLock sync.RWMutex
+	transports     = map[string]TransportFactory{
+		DefaultTransport: func(cfg *config.Config) (Transport, error) {
+			return newTLSTransport(cfg), nil
+		},
+		WebSocketTransport: newWebSocketTransport,
+	}
+)
+
+// RegisterTransport makes a Transport available under the given name, which can then be selected with the transport
+// config entry. Registering a transport with an already registered name replaces the previous one.
+func RegisterTransport(name string, factory TransportFactory) {
+	transportsLock.Lock()
+	transports[name] = factory
+	transportsLock.Unlock()
+}
+
+// Transports returns the sorted names of all registered transports.
+func Transports() (names []string) {
+	transportsLock.RLock()
+	defer transportsLock.RUnlock()
+
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newTransport creates the registered Transport with the given name.
+func newTransport(name string, cfg *config.Config) (Transport, error) {
+	transportsLock.RLock()
+	factory, ok := transports[name]
+	transportsLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownTransport, name)
+	}
+
+	return factory(cfg)
+}
+
+// tlsTransport is the default Transport using TLS over TCP with self-signed certificates created from the host key.
+// Sessions are resumed with TLS 1.3 session tickets, such that repeated connections to the same peer skip the full
+// handshake.
+type tlsTransport struct {
+	cfg      *config.Config
+	sessions tls.ClientSessionCache
+	dial     TLSDialFunc // opens the connections to other peers, DialTCP and a TLS handshake if nil
+
+	clientCertOnce sync.Once
+	clientCert     *tls.Certificate // presented to the peers we connect to, see clientCertificate
+}
+
+// TLSDialFunc opens a TLS connection to the given address:port with the given config, e.g. with a client hello
+// resembling the one of a web browser. The host key of the peer can only be verified if the returned connection has a
+// ConnectionState method like tls.Conn. The source address and proxy of the config are only used if the function
+// opens its connections with DialTCP.
+type TLSDialFunc func(address string, tlsConfig *tls.Config) (net.Conn, error)
+
+// newTLSTransport creates a tlsTransport with an empty session cache.
+func newTLSTransport(cfg *config.Config) *tlsTransport {
+	return &tlsTransport{
+		cfg:      cfg,
+		sessions: tls.NewLRUClientSessionCache(tlsSessionCacheSize),
+	}
+}
+
+// NewTLSTransport creates a Transport like the default one, which opens the connections to other peers with the given
+// dial function though, e.g. to disguise the client hello of the TLS library. The transport can then be made available
+// with RegisterTransport.
+func NewTLSTransport(cfg *config.Config, dial TLSDialFunc) Transport {
+	transport := newTLSTransport(cfg)
+	transport.dial = dial
+	return transport
+}
+
+// DialPeer opens a TLS connection to the peer given by address:port, resuming a previous session if possible.
+func (t *tlsTransport) DialPeer(address net.IP, port uint16) (net.Conn, error) {
+	peer := net.JoinHostPort(address.String(), strconv.Itoa(int(port)))
+	tlsConfig := t.cfg.TLSConfig()
+	tlsConfig.InsecureSkipVerify = true //nolint:gosec // peers do use self-signed certs, verified by Router.verifyHop
+	tlsConfig.GetClientCertificate = t.clientCertificate
+	if t.sessions != nil {
+		tlsConfig.ClientSessionCache = peerSessionCache{cache: t.sessions, peer: peer}
+	}
+
+	if t.dial != nil {
+		return t.dial(peer, tlsConfig)
+	}
+
+	nc, err := DialTCP(t.cfg, peer)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(nc, tlsConfig)
+	if err = conn.Handshake(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Listen opens a TLS listener on the given address using a certificate created from the host key.
+func (t *tlsTransport) Listen(address string) (net.Listener, error) {
+	cert, err := tlsCertFromHostKey(t.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := t.cfg.TLSConfig()
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	tlsConfig.InsecureSkipVerify = true //nolint:gosec // peers do use self-signed certs
+	// the host key presented by the peer is verified before its link is reused, see Router.identifyLink
+	tlsConfig.ClientAuth = tls.RequestClientCert
+	return tls.Listen("tcp", address, tlsConfig)
+}
+
+// clientCertificate returns the certificate created from the host key, which is presented to the peers we connect to,
+// such that they can verify our host key before reusing the link, see Router.identifyLink. The certificate is created
+// once per transport. No certificate is presented without a host key.
+func (t *tlsTransport) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	t.clientCertOnce.Do(func() {
+		t.clientCert = &tls.Certificate{}
+		if t.cfg.HostKey == nil {
+			return
+		}
+		cert, err := tlsCertFromHostKey(t.cfg)
+		if err == nil {
+			t.clientCert = &cert
+		}
+	})
+	return t.clientCert, nil
+}
+
+// peerSessionCache stores the TLS session of a single peer in a shared cache.
+// By default, sessions are cached by the server name, which is the IP address only. Multiple peers may however run on
+// the same host with different ports, which would overwrite each other's sessions.
+type peerSessionCache struct {
+	cache tls.ClientSessionCache
+	peer  string // address:port of the peer
+}
+
+// Get returns the cached session of the peer.
+func (c peerSessionCache) Get(sessionKey string) (session *tls.ClientSessionState, ok bool) {
+	return c.cache.Get(c.peer)
+}
+
+// Put caches the session of the peer, a nil session removes it from the cache.
+func (c peerSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.cache.Put(c.peer, cs)
+}
@@ -0,0 +1,255 @@
+package onion
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+)
+
+// pipeTransport is a Transport connecting to in-memory pipes for testing.
+type pipeTransport struct {
+	dialed []string
+	remote []net.Conn
+}
+
+func (t *pipeTransport) DialPeer(address net.IP, port uint16) (net.Conn, error) {
+	t.dialed = append(t.dialed, net.JoinHostPort(address.String(), strconv.Itoa(int(port))))
+	local, remote := net.Pipe()
+	t.remote = append(t.remote, remote)
+	return local, nil
+}
+
+func (t *pipeTransport) Listen(address string) (net.Listener, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestTransports(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		require.Contains(t, Transports(), DefaultTransport)
+
+		transport, err := newTransport(DefaultTransport, &config.Config{})
+		require.Nil(t, err)
+		assert.IsType(t, &tlsTransport{}, transport)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := newTransport("carrier-pigeon", &config.Config{})
+		require.True(t, errors.Is(err, ErrUnknownTransport))
+
+		_, err = NewRouter(&config.Config{Transport: "carrier-pigeon"}, WithRPS(&mockRPS{}))
+		require.True(t, errors.Is(err, ErrUnknownTransport))
+	})
+
+	t.Run("registered", func(t *testing.T) {
+		transport := &pipeTransport{}
+		RegisterTransport("pipe", func(cfg *config.Config) (Transport, error) {
+			return transport, nil
+		})
+		require.Contains(t, Transports(), "pipe")
+
+		router, err := NewRouter(&config.Config{Transport: "pipe"}, WithRPS(&mockRPS{}))
+		require.Nil(t, err)
+
+		link, err := router.CreateLink(net.ParseIP("10.0.0.1"), 1234)
+		require.Nil(t, err)
+		defer func() {
+			for _, conn := range transport.remote {
+				conn.Close()
+			}
+		}()
+		assert.Equal(t, []string{"10.0.0.1:1234"}, transport.dialed)
+		assert.True(t, link.address.Equal(net.ParseIP("10.0.0.1")))
+	})
+}
+
+func TestTLSTransportResumption(t *testing.T) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+	transport := newTLSTransport(&config.Config{HostKey: hostKey})
+
+	ln, err := transport.Listen("127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// the session ticket is sent along with the first data after the handshake
+			_, _ = conn.Write([]byte{1})
+			conn.Close()
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	dial := func() tls.ConnectionState {
+		conn, err := transport.DialPeer(addr.IP, uint16(addr.Port))
+		require.Nil(t, err)
+		defer conn.Close()
+
+		_, err = conn.Read(make([]byte, 1))
+		require.Nil(t, err)
+		return conn.(*tls.Conn).ConnectionState()
+	}
+
+	assert.False(t, dial().DidResume)
+	assert.True(t, dial().DidResume)
+
+	// sessions are cached per peer, not per host
+	_, ok := transport.sessions.Get(addr.String())
+	assert.True(t, ok)
+	_, ok = transport.sessions.Get(addr.IP.String())
+	assert.False(t, ok)
+}
+
+func TestTLSTransportClientCert(t *testing.T) {
+	serverKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+	clientKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+
+	ln, err := newTLSTransport(&config.Config{HostKey: serverKey}).Listen("127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	hostKeys := make(chan *rsa.PublicKey, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// the handshake is performed on the first read, the session ticket is sent along with the first write
+			_, _ = conn.Read(make([]byte, 1))
+			_, _ = conn.Write([]byte{1})
+			hostKeys <- peerHostKey(conn)
+			conn.Close()
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+
+	dial := func(transport *tlsTransport) tls.ConnectionState {
+		conn, err := transport.DialPeer(addr.IP, uint16(addr.Port))
+		require.Nil(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte{1})
+		require.Nil(t, err)
+		_, err = conn.Read(make([]byte, 1))
+		require.Nil(t, err)
+		return conn.(*tls.Conn).ConnectionState()
+	}
+
+	t.Run("host key presented", func(t *testing.T) {
+		transport := newTLSTransport(&config.Config{HostKey: clientKey})
+		assert.False(t, dial(transport).DidResume)
+		assert.True(t, sameHostKey(&clientKey.PublicKey, <-hostKeys))
+
+		// resumed sessions keep the host key presented in the full handshake
+		assert.True(t, dial(transport).DidResume)
+		assert.True(t, sameHostKey(&clientKey.PublicKey, <-hostKeys))
+	})
+
+	t.Run("no host key", func(t *testing.T) {
+		dial(newTLSTransport(&config.Config{}))
+		assert.Nil(t, <-hostKeys)
+	})
+}
+
+func TestTLSTransportVersions(t *testing.T) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+
+	// listen returns the address of a listener of a transport with the given config
+	listen := func(cfg *config.Config) *net.TCPAddr {
+		cfg.HostKey = hostKey
+		ln, err := newTLSTransport(cfg).Listen("127.0.0.1:0")
+		require.Nil(t, err)
+		t.Cleanup(func() {
+			ln.Close()
+		})
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				_ = conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}
+		}()
+		return ln.Addr().(*net.TCPAddr)
+	}
+	dial := func(addr *net.TCPAddr, maxVersion uint16) (tls.ConnectionState, error) {
+		conn, err := tls.Dial("tcp", addr.String(), &tls.Config{
+			InsecureSkipVerify: true, //nolint:gosec // no valid cert for this test
+			MaxVersion:         maxVersion,
+		})
+		if err != nil {
+			return tls.ConnectionState{}, err
+		}
+		defer conn.Close()
+		return conn.ConnectionState(), nil
+	}
+
+	t.Run("default", func(t *testing.T) {
+		addr := listen(&config.Config{})
+		_, err := dial(addr, tls.VersionTLS12)
+		assert.NotNil(t, err)
+
+		state, err := dial(addr, tls.VersionTLS13)
+		require.Nil(t, err)
+		assert.Equal(t, uint16(tls.VersionTLS13), state.Version)
+	})
+
+	t.Run("TLS 1.2", func(t *testing.T) {
+		addr := listen(&config.Config{
+			TLSMinVersion:   config.TLSVersion12,
+			TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+			TLSCurves:       []string{config.TLSCurveP256},
+		})
+		state, err := dial(addr, tls.VersionTLS12)
+		require.Nil(t, err)
+		assert.Equal(t, uint16(tls.VersionTLS12), state.Version)
+		assert.Equal(t, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, state.CipherSuite)
+	})
+}
+
+func TestTLSTransportDial(t *testing.T) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+	cfg := &config.Config{HostKey: hostKey}
+
+	ln, err := newTLSTransport(cfg).Listen("127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	var dialed string
+	transport := NewTLSTransport(cfg, func(address string, tlsConfig *tls.Config) (net.Conn, error) {
+		dialed = address
+		return tls.Dial("tcp", address, tlsConfig)
+	})
+	addr := ln.Addr().(*net.TCPAddr)
+	conn, err := transport.DialPeer(addr.IP, uint16(addr.Port))
+	require.Nil(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, addr.String(), dialed)
+	assert.True(t, sameHostKey(&hostKey.PublicKey, peerHostKey(conn)))
+}
@@ -1,33 +1,94 @@
 package onion
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
-	"errors"
+	"encoding/binary"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/nacl/box"
 
 	"bawang/config"
+	"bawang/errcode"
 	"bawang/p2p"
 	"bawang/rps"
+	"bawang/trace"
 )
 
 var (
-	ErrInvalidProtocolVersion = errors.New("invalid protocol version")
-	ErrInvalidDHPublicKey     = errors.New("invalid DH public key")
-	ErrNotEnoughHops          = errors.New("tunnel does contain fewer than 3 hops")
-	ErrMisbehavingPeer        = errors.New("a peer is sending invalid messages or violating protocol")
+	ErrInvalidProtocolVersion = errcode.New(errcode.ModuleOnion, errcode.InvalidMessage, false,
+		"invalid protocol version")
+	ErrInvalidDHPublicKey = errcode.New(errcode.ModuleOnion, errcode.MisbehavingPeer, true, "invalid DH public key")
+	ErrTimestampMismatch  = errcode.New(errcode.ModuleOnion, errcode.MisbehavingPeer, false,
+		"timestamp of the tunnel creation does not match its handshake")
+	ErrNotEnoughHops = errcode.New(errcode.ModuleOnion, errcode.NotAllowed, false,
+		"tunnel does contain fewer than 3 hops")
+	ErrMisbehavingPeer = errcode.New(errcode.ModuleOnion, errcode.MisbehavingPeer, true,
+		"a peer is sending invalid messages or violating protocol")
+	ErrNoCipherSuite = errcode.New(errcode.ModuleOnion, errcode.NotAllowed, true, "no common cipher suite")
+	ErrHostKeySize   = errcode.New(errcode.ModuleOnion, errcode.NotAllowed, true,
+		"the host key of the hop is of a size the handshake does not support")
+	ErrNoOAEP = errcode.New(errcode.ModuleOnion, errcode.NotAllowed, true,
+		"the tunnel can not be extended with a handshake encrypted with RSA-OAEP")
 )
 
+// activity tracks the time of the last traffic on a tunnel, used to expire idle tunnels.
+// It is safe for concurrent use.
+type activity struct {
+	lastActive int64 // unix time in nanoseconds, accessed atomically
+}
+
+// touch records traffic at the given time.
+func (a *activity) touch(now time.Time) {
+	atomic.StoreInt64(&a.lastActive, now.UnixNano())
+}
+
+// last returns the time of the last recorded traffic.
+func (a *activity) last() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&a.lastActive))
+}
+
+// idle returns for how long there was no traffic at the given time.
+func (a *activity) idle(now time.Time) time.Duration {
+	return now.Sub(a.last())
+}
+
 // Tunnel keeps track of the state of an onion tunnel initiated by the current peer.
 type Tunnel struct {
-	id          uint32
+	activity    activity   // must be the first field to guarantee 64-bit alignment for atomic access
+	id          uint32     // ID of the tunnel known to the clients, stays the same when the tunnel is rebuilt
+	circuitID   uint32     // ID of the circuit on the link to the first hop, never exposed to the clients
+	sendLock    sync.Mutex // guards sendCounter and sendDigests when sending relay messages along the tunnel
 	sendCounter uint32
 	recvCounter uint32
+	sendDigests []*p2p.RelayDigest // running digests of the messages sent to each hop
+	ciphers     []layerCipher      // add and remove the layer of encryption of each hop
+	caps        []p2p.Capabilities // announced by each hop, see Tunnel.lastHopSupports
+	latencies   []time.Duration    // duration of the CREATE or EXTEND step of each hop, see hopLatencyCounter
+	recvDigests []*p2p.RelayDigest // running digests of the messages received from each hop, only used by the handler
+	sendClosed  halfClose          // whether we finished sending on the tunnel
+	priority    tunnelPriority     // class of the data sent on the tunnel, see Router.SetTunnelPriority
+	stream      *reliableStream    // retransmits data after rebuilds, nil if disabled
+	traffic     *trafficCounter    // shared by all circuits of the tunnel, see Router.TunnelTraffic
 	hops        []*rps.Peer
+	target      *rps.Peer // destination peer the tunnel was requested for
 	link        *Link
+	pinned      []*rps.Peer // intermediate hops requested by the client or of a cover tunnel, nil if sampled on each build
+	datagrams   datagramQueue
+	batch       dataBatch     // small payloads waiting to be packed into a single cell, see Router.sendBatched
+	handover    *handover     // handover from the old to the rebuilt circuit, guarded by Router.tunnelsLock
+	draining    chan struct{} // closed once the old circuit is drained, only used by the tunnel's handler
+	pingLock    sync.Mutex    // allows a single ping at a time, see Router.PingTunnel
+	pongs       chan struct{} // pongs of the last hop, passed on by the tunnel's handler
+	keepalive   int32         // whether a keepalive check is running, accessed atomically, see Router.checkAlive
+	path        *Tunnel       // second circuit of a multipath tunnel, guarded by Router.tunnelsLock
+	span        *trace.Span   // traces the circuit from its build to its teardown, nil if tracing is disabled
 	quit        chan struct{}
 }
 
@@ -36,19 +97,131 @@ func (tunnel *Tunnel) ID() uint32 {
 	return tunnel.id
 }
 
-// Close terminates the outgoing tunnel, sending p2p.TypeTunnelDestroy through the tunnel.
+// Hops returns the number of hops of the tunnel, including the destination. Tunnels to ourselves terminated locally,
+// see Config.LoopbackTunnels, have none.
+func (tunnel *Tunnel) Hops() int {
+	return len(tunnel.hops)
+}
+
+// BuildTime returns the time it took to establish the circuit, i.e. the CREATE and EXTEND steps of all hops. Sampling
+// the path and failed attempts are not included.
+func (tunnel *Tunnel) BuildTime() (total time.Duration) {
+	for _, latency := range tunnel.latencies {
+		total += latency
+	}
+	return total
+}
+
+// addHop appends a hop the tunnel was extended to, deriving the running digests from the session key shared with it.
+// The given cipher adds and removes the hop's layer of encryption.
+func (tunnel *Tunnel) addHop(hop *rps.Peer, cipher layerCipher) {
+	forward, backward := p2p.NewRelayDigests(&hop.DHShared)
+	tunnel.hops = append(tunnel.hops, hop)
+	tunnel.ciphers = append(tunnel.ciphers, cipher)
+	tunnel.sendDigests = append(tunnel.sendDigests, forward)
+	tunnel.recvDigests = append(tunnel.recvDigests, backward)
+}
+
+// closeSessions releases the sessions with all hops once the tunnel is torn down, wiping the keys shared with them.
+func (tunnel *Tunnel) closeSessions() {
+	for _, cipher := range tunnel.ciphers {
+		cipher.close()
+	}
+	for _, hop := range tunnel.hops {
+		wipe(hop.DHShared[:])
+	}
+}
+
+// lastHopSupports returns whether the last hop announced the given capability during the handshake. Hops not
+// negotiating the handshake version are assumed to support it, see legacyCapabilities.
+func (tunnel *Tunnel) lastHopSupports(capability p2p.Capabilities) bool {
+	if len(tunnel.caps) == 0 {
+		return true
+	}
+	return tunnel.caps[len(tunnel.caps)-1]&capability == capability
+}
+
+// Close terminates the outgoing tunnel, see destroyHops.
 func (tunnel *Tunnel) Close() (err error) {
 	close(tunnel.quit)
-	err = tunnel.link.sendDestroyTunnel(tunnel.ID())
-	return err
+	return tunnel.destroyHops(len(tunnel.hops))
+}
+
+// destroyHops instructs the first n hops of the tunnel to tear down their tunnel segments by sending each of them an
+// authenticated p2p.RelayTunnelDestroy, starting with the farthest one. Since the messages are passed on in order,
+// every hop has forwarded the messages for the hops behind it before tearing down its own segment.
+// If the tunnel has no hops yet or sending fails, an unauthenticated p2p.TypeTunnelDestroy is sent to the first hop.
+func (tunnel *Tunnel) destroyHops(n int) (err error) {
+	span := tunnel.span.Child("tunnel.destroy")
+	span.Set("hops", n)
+	defer func() {
+		span.Finish(err)
+	}()
+
+	if n == 0 {
+		return tunnel.link.sendDestroyTunnel(tunnel.circuitID)
+	}
+
+	for hop := n - 1; hop >= 0; hop-- {
+		err = tunnel.sendRelayToHop(hop, &p2p.RelayTunnelDestroy{})
+		if err != nil {
+			_ = tunnel.link.sendDestroyTunnel(tunnel.circuitID)
+			return err
+		}
+	}
+	return nil
+}
+
+// sendRelayToLastHop packs, encrypts and sends a relay message to the last hop of the tunnel.
+// It is safe to call from multiple goroutines.
+func (tunnel *Tunnel) sendRelayToLastHop(msg p2p.RelayMessage) (err error) {
+	return tunnel.sendRelayToHop(len(tunnel.hops)-1, msg)
+}
+
+// sendRelayToHop packs, encrypts and sends a relay message to the hop with the given index.
+// It is safe to call from multiple goroutines.
+func (tunnel *Tunnel) sendRelayToHop(hop int, msg p2p.RelayMessage) (err error) {
+	tunnel.sendLock.Lock()
+	defer tunnel.sendLock.Unlock()
+
+	buf := make([]byte, p2p.RelayMessageSize)
+	var n int
+	tunnel.sendCounter, n, err = tunnel.link.packer.PackRelayMessage(buf, tunnel.sendCounter, msg,
+		tunnel.sendDigests[hop])
+	if err != nil {
+		return err
+	}
+	tunnel.link.faults.corruptDigest(buf[:n])
+
+	encryptedMsg, err := tunnel.encryptRelayMsgToHop(buf[:n], hop)
+	if err != nil {
+		return err
+	}
+
+	err = tunnel.link.sendRelay(tunnel.circuitID, encryptedMsg, relayPriority(msg, tunnel.priority.get()))
+	if err != nil {
+		return err
+	}
+	tunnel.traffic.sent(msg)
+	return nil
 }
 
 // EncryptRelayMsg encrypts a packed relay message with the intermediate hops keys.
 func (tunnel *Tunnel) EncryptRelayMsg(relayMsg []byte) (encryptedMsg []byte, err error) {
+	return tunnel.encryptRelayMsgToHop(relayMsg, len(tunnel.hops)-1)
+}
+
+// encryptRelayMsgToHop encrypts a packed relay message with the keys of all hops up to the hop with the given index,
+// such that the message is meant for that hop. The layer of the first hop is added last.
+func (tunnel *Tunnel) encryptRelayMsgToHop(relayMsg []byte, hopIndex int) (encryptedMsg []byte, err error) {
 	encryptedMsg = relayMsg
-	for _, hop := range tunnel.hops {
-		encryptedMsg, err = p2p.EncryptRelay(encryptedMsg, &hop.DHShared)
-		if err != nil { // error when decrypting
+	encryptedMsg, err = tunnel.ciphers[hopIndex].seal(relayMsg)
+	if err != nil { // error when encrypting
+		return
+	}
+	for i := hopIndex - 1; i >= 0; i-- {
+		encryptedMsg, err = tunnel.ciphers[i].encrypt(encryptedMsg)
+		if err != nil { // error when encrypting
 			return
 		}
 	}
@@ -58,9 +231,17 @@ func (tunnel *Tunnel) EncryptRelayMsg(relayMsg []byte) (encryptedMsg []byte, err
 // DecryptRelayMessage removes the layered encryption from a received relay message.
 // If the checksum does not match will return ok=false.
 func (tunnel *Tunnel) DecryptRelayMessage(data []byte) (relayHdr p2p.RelayHeader, decryptedRelayMsg []byte, ok bool, err error) {
+	relayHdr, decryptedRelayMsg, _, ok, err = tunnel.decryptRelayMessageFromHop(data)
+	return
+}
+
+// decryptRelayMessageFromHop removes the layered encryption from a received relay message like DecryptRelayMessage
+// and additionally returns the index of the hop which sent the message.
+func (tunnel *Tunnel) decryptRelayMessageFromHop(data []byte) (relayHdr p2p.RelayHeader, decryptedRelayMsg []byte,
+	hop int, ok bool, err error) {
 	decryptedRelayMsg = data
-	for _, hop := range tunnel.hops {
-		ok, decryptedRelayMsg, err = p2p.DecryptRelay(decryptedRelayMsg, &hop.DHShared)
+	for i := range tunnel.hops {
+		ok, decryptedRelayMsg, err = tunnel.ciphers[i].open(decryptedRelayMsg, tunnel.recvDigests[i])
 		if err != nil { // error when decrypting
 			return
 		}
@@ -72,131 +253,299 @@ func (tunnel *Tunnel) DecryptRelayMessage(data []byte) (relayHdr p2p.RelayHeader
 				return
 			}
 
-			decryptedRelayMsg = decryptedRelayMsg[p2p.RelayHeaderSize:relayHdr.Size]
-			return
+			decryptedRelayMsg, err = relayHdr.Body(decryptedRelayMsg)
+			if err != nil {
+				return
+			}
+			return relayHdr, decryptedRelayMsg, i, true, nil
 		}
 	}
 
 	// we could not decrypt the message and have removed all layers of encryption
-	return relayHdr, nil, false, p2p.ErrInvalidMessage
+	return relayHdr, nil, -1, false, p2p.ErrInvalidMessage
 }
 
 // tunnelSegment is used to keep track of an incoming tunnels state.
 type tunnelSegment struct {
-	prevHopTunnelID uint32
-	nextHopTunnelID uint32
+	activity        activity // traffic from the previous hop, must be the first field for 64-bit alignment
+	prevHopTunnelID uint32   // ID of the circuit on the link to the previous hop
+	nextHopTunnelID uint32   // ID of the circuit on the link to the next hop, if any
 	prevHopLink     *Link
 	nextHopLink     *Link     // can be nil if the tunnel terminates at the current hop
-	dhShared        *[32]byte // Diffie-Hellman key shared with the previous hop
+	dhShared        *[32]byte // key shared with the tunnel initiator, seeds the running digests
+	cipher          layerCipher
+	initiatorCaps   p2p.Capabilities // announced by the tunnel initiator, see initiatorCapabilities
+	sendLock        sync.Mutex       // guards sendCounter and sendDigest when sending relay messages to the previous hop
 	sendCounter     uint32
 	recvCounter     uint32
+	sendDigest      *p2p.RelayDigest // running digest of the messages sent to the tunnel initiator
+	recvDigest      *p2p.RelayDigest // running digest of the messages received from the initiator, only used by the handler
+	sendClosed      halfClose        // whether we finished sending on the tunnel
+	priority        tunnelPriority   // class of the data sent back to the initiator, see Router.SetTunnelPriority
+	stream          *reliableStream  // stream carried by the tunnel if the initiator retransmits data, see bindStream
+	traffic         *trafficCounter  // counted for the tunnel ID known to the clients, see Router.TunnelTraffic
+	quota           segmentQuota     // cells relayed for the initiator, only used by the handler, see Router.chargeSegment
+	span            *trace.Span      // traces the segment while it is handled, nil if tracing is disabled
+	cellsForward    uint64           // cells relayed to the next hop, only used by the handler
+	cellsBackward   uint64           // cells relayed to the previous hop, only used by the handler
+
+	// the tunnel segment may replace another one after the initiator rebuilt the tunnel, see replaceSegment.
+	// Guarded by Router.tunnelsLock.
+	tunnelID   uint32         // ID of the tunnel known to the clients, unrelated to the circuit IDs
+	remapped   bool           // whether the segment replaced another one
+	replacedBy *tunnelSegment // segment carrying the tunnel from now on, nil if the segment is still current
+
+	draining chan struct{} // closed once the replaced segment is drained, only used by the segment's handler
+
+	exitLock    sync.Mutex         // guards exitConn and exitPending
+	exitConn    net.Conn           // TCP connection opened on behalf of the tunnel initiator if this peer acts as exit
+	exitPending context.CancelFunc // cancels opening the exit connection, nil if not opening one, see Router.dialExit
+
+	datagrams datagramQueue
+	batch     dataBatch // small payloads waiting to be packed into a single cell, see Router.sendBatched
 
 	quit chan struct{}
 }
 
-// Close terminates a tunnelSegment by sending p2p.TypeTunnelDestroy messages to the previous and next hop.
+// Close terminates a tunnelSegment, see destroy.
 func (tunnel *tunnelSegment) Close() (err error) {
 	close(tunnel.quit)
-	err = tunnel.prevHopLink.sendDestroyTunnel(tunnel.prevHopTunnelID)
-	if err != nil && tunnel.nextHopLink != nil {
-		_ = tunnel.prevHopLink.sendDestroyTunnel(tunnel.prevHopTunnelID)
-	} else if tunnel.nextHopLink != nil {
-		err = tunnel.prevHopLink.sendDestroyTunnel(tunnel.prevHopTunnelID)
-	}
+	return tunnel.destroy()
+}
 
+// destroy announces the teardown of the tunnel segment to its neighbors. The tunnel initiator is informed with an
+// authenticated p2p.RelayTunnelDestroy, the next hop, if any, with p2p.TypeTunnelDestroy as the adjacent hop.
+func (tunnel *tunnelSegment) destroy() (err error) {
+	err = tunnel.sendRelayToPrevHop(&p2p.RelayTunnelDestroy{})
+	if tunnel.nextHopLink != nil {
+		nextErr := tunnel.nextHopLink.sendDestroyTunnel(tunnel.nextHopTunnelID)
+		if err == nil {
+			err = nextErr
+		}
+	}
 	return err
 }
 
-// handleTunnelCreate returns the shared Diffie-Hellman key and a p2p.TunnelCreated response for an incoming p2p.TunnelCreate command.
-func handleTunnelCreate(msg *p2p.TunnelCreate, cfg *config.Config) (dhShared *[32]byte, response *p2p.TunnelCreated, err error) {
-	if msg.Version != 1 {
-		return nil, nil, ErrInvalidProtocolVersion
+// sendRelayToPrevHop packs, encrypts and sends a relay message back to the tunnel initiator.
+// It is safe to call from multiple goroutines.
+func (tunnel *tunnelSegment) sendRelayToPrevHop(msg p2p.RelayMessage) (err error) {
+	tunnel.sendLock.Lock()
+	defer tunnel.sendLock.Unlock()
+
+	buf := make([]byte, p2p.RelayMessageSize)
+	var n int
+	tunnel.sendCounter, n, err = tunnel.prevHopLink.packer.PackRelayMessage(buf, tunnel.sendCounter, msg,
+		tunnel.sendDigest)
+	if err != nil {
+		return err
+	}
+	tunnel.prevHopLink.faults.corruptDigest(buf[:n])
+
+	encryptedMsg, err := tunnel.cipher.seal(buf[:n])
+	if err != nil {
+		return err
+	}
+
+	err = tunnel.prevHopLink.sendRelay(tunnel.prevHopTunnelID, encryptedMsg, relayPriority(msg, tunnel.priority.get()))
+	if err != nil {
+		return err
 	}
+	tunnel.traffic.sent(msg)
+	return nil
+}
 
+// handleDHTunnelCreate returns the session with the shared Diffie-Hellman key, encrypting with the given cipher suite,
+// and a p2p.TunnelCreated response for an incoming p2p.TunnelCreate command, see handleTunnelCreate.
+func handleDHTunnelCreate(random io.Reader, msg *p2p.TunnelCreate, cfg *config.Config, suite p2p.CipherSuite) (
+	s *session, response *p2p.TunnelCreated, err error) {
 	// decrypt the received dh pub key
-	decDHKey, err := rsa.DecryptPKCS1v15(rand.Reader, cfg.HostKey, msg.EncDHPubKey[:])
+	var decDHKey []byte
+	if msg.Version == p2p.HandshakeVersionDHOAEP {
+		decDHKey, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, cfg.HostKey, msg.EncDHPubKey, nil)
+	} else {
+		decDHKey, err = rsa.DecryptPKCS1v15(rand.Reader, cfg.HostKey, msg.EncDHPubKey)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
+	defer wipe(decDHKey)
 
-	if len(decDHKey) != 32 {
+	// the timestamp checked for replays is encrypted along with the key, such that it can not be altered to replay the
+	// creation once the handshake is forgotten, see replayCache. It is ignored if the creation is not timestamped.
+	bound := msg.HasTimestamp() && timestampBound(msg.Version)
+	switch {
+	case len(decDHKey) != 32 && len(decDHKey) != 32+4, bound && len(decDHKey) != 32+4:
 		return nil, nil, ErrInvalidDHPublicKey
+	case bound && binary.BigEndian.Uint32(decDHKey[32:]) != msg.Timestamp:
+		return nil, nil, ErrTimestampMismatch
 	}
 
 	peerDHPub := new([32]byte)
 	copy(peerDHPub[:], decDHKey[:32])
 
-	pubDH, privDH, err := box.GenerateKey(rand.Reader)
+	pubDH, privDH, err := box.GenerateKey(random)
 	if err != nil {
 		return nil, nil, err
 	}
-	dhShared = new([32]byte)
-	box.Precompute(dhShared, peerDHPub, privDH)
+	s = &session{}
+	box.Precompute(&s.key, peerDHPub, privDH)
+	wipe(privDH[:])
+	wipe(peerDHPub[:])
+	s.cipher, err = newSuiteCipher(suite, &s.key, false)
+	if err != nil {
+		wipe(s.key[:])
+		return nil, nil, err
+	}
 
 	response = &p2p.TunnelCreated{
 		DHPubKey:      *pubDH,
-		SharedKeyHash: sha256.Sum256(dhShared[:32]),
+		SharedKeyHash: sha256.Sum256(s.key[:32]),
 	}
-	return dhShared, response, nil
+	return s, response, nil
 }
 
-// generateDHKeys generates new Diffie-Hellman keys, encrypting the public part with the given peers host identifier key.
-func generateDHKeys(peerHostKey *rsa.PublicKey) (privDH *[32]byte, encDHPubKey *[512]byte, err error) {
-	pubDH, privDH, err := box.GenerateKey(rand.Reader)
+// handleResumeTunnelCreate returns the resumed session with the key derived from the secret of the resumed one and a
+// fresh Diffie-Hellman key, encrypting with the given cipher suite, and a p2p.TunnelCreated response for an incoming
+// p2p.TunnelCreate of p2p.HandshakeVersionResume, see handleTunnelCreate.
+func handleResumeTunnelCreate(random io.Reader, msg *p2p.TunnelCreate, secret *[32]byte, suite p2p.CipherSuite) (
+	s *session, response *p2p.TunnelCreated, err error) {
+	pubDH, privDH, err := box.GenerateKey(random)
 	if err != nil {
 		return nil, nil, err
 	}
+	var shared [32]byte
+	box.Precompute(&shared, &msg.DHPubKey, privDH)
+	wipe(privDH[:])
 
-	encDHKey, err := rsa.EncryptPKCS1v15(rand.Reader, peerHostKey, pubDH[:])
+	s = &session{key: resumedKey(secret, &shared)}
+	wipe(shared[:])
+	s.cipher, err = newSuiteCipher(suite, &s.key, false)
 	if err != nil {
+		wipe(s.key[:])
 		return nil, nil, err
 	}
 
-	if len(encDHKey) != 512 {
-		return nil, nil, ErrInvalidDHPublicKey
+	response = &p2p.TunnelCreated{
+		DHPubKey:      *pubDH,
+		SharedKeyHash: sha256.Sum256(s.key[:32]),
 	}
-	encDHPubKey = new([512]byte)
-	copy(encDHPubKey[:], encDHKey[:512])
-
-	return privDH, encDHPubKey, nil
+	return s, response, nil
 }
 
-// tunnelCreateMsg generates new Diffie-Hellman keys and a p2p.TunnelCreate to initiate a new onion connection
-// to a new peer.
-func tunnelCreateMsg(peerHostKey *rsa.PublicKey) (privDH *[32]byte, msg *p2p.TunnelCreate, err error) {
-	privDH, encDHPubKey, err := generateDHKeys(peerHostKey)
+// generateDHKeys generates new Diffie-Hellman keys from random, encrypting the public part with the given peers host
+// identifier key. The encryption always draws from crypto/rand, since crypto/rsa deliberately consumes the randomness
+// nondeterministically, which would make all later draws from random unpredictable.
+// The public key is encrypted with RSA-OAEP for p2p.HandshakeVersionDHOAEP and with PKCS #1 v1.5 for the other
+// versions. The encrypted key is as large as the host key, ErrHostKeySize is returned if it does not fit into a
+// handshake.
+// Unless zero, the given timestamp of the creation is encrypted along with the public key, binding it to the handshake,
+// see handleDHTunnelCreate. Handshakes of p2p.HandshakeVersionDH are left unbound, since peers predating the
+// negotiation expect the key only.
+func generateDHKeys(random io.Reader, peerHostKey *rsa.PublicKey, version uint8, timestamp uint32) (privDH *[32]byte,
+	encDHPubKey []byte, err error) {
+	if peerHostKey.Size() > p2p.MaxHandshakeSize {
+		return nil, nil, ErrHostKeySize
+	}
+
+	pubDH, privDH, err := box.GenerateKey(random)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	msg = &p2p.TunnelCreate{
-		Version:     1,
-		EncDHPubKey: *encDHPubKey,
+	plain := pubDH[:]
+	if timestamp != 0 && timestampBound(version) {
+		plain = make([]byte, 32+4)
+		copy(plain, pubDH[:])
+		binary.BigEndian.PutUint32(plain[32:], timestamp)
 	}
-	return privDH, msg, nil
+	if version == p2p.HandshakeVersionDHOAEP {
+		encDHPubKey, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, peerHostKey, plain, nil)
+	} else {
+		encDHPubKey, err = rsa.EncryptPKCS1v15(rand.Reader, peerHostKey, plain)
+	}
+	if err != nil {
+		wipe(privDH[:])
+		return nil, nil, err
+	}
+
+	return privDH, encDHPubKey, nil
+}
+
+// dhVersion returns the version of the legacy Diffie-Hellman handshake with a hop holding the given host key, for hops
+// not supporting p2p.HandshakeVersionDHOAEP. Only the encrypted keys of 4096 bit host keys fit into handshakes of
+// p2p.HandshakeVersionDH, which older peers expect.
+func dhVersion(peerHostKey *rsa.PublicKey) uint8 {
+	if peerHostKey.Size() == p2p.EncDHPubKeySize {
+		return p2p.HandshakeVersionDH
+	}
+	return p2p.HandshakeVersionDHSized
 }
 
-// relayTunnelExtendMsg generates new Diffie-Hellman keys and a p2p.RelayTunnelExtend to extend an existing onion tunnel
-// to the given peer.
-func relayTunnelExtendMsg(peerHostKey *rsa.PublicKey, address net.IP, port uint16) (privDH *[32]byte, msg *p2p.RelayTunnelExtend, err error) {
-	privDH, encDHPubKey, err := generateDHKeys(peerHostKey)
+// tunnelCreateMsg generates new Diffie-Hellman keys and a p2p.TunnelCreate of the given version to initiate a new onion
+// connection to a new peer. ErrHostKeySize is returned if the version does not fit the size of the host key.
+// The timestamp of the creation is bound to the handshake unless zero, see generateDHKeys. It is only sent if the
+// capabilities announced in the message contain p2p.CapabilityTimestamp.
+func tunnelCreateMsg(random io.Reader, peerHostKey *rsa.PublicKey, version uint8, timestamp uint32) (privDH *[32]byte,
+	msg *p2p.TunnelCreate, err error) {
+	if version == p2p.HandshakeVersionDH && peerHostKey.Size() != p2p.EncDHPubKeySize {
+		return nil, nil, ErrHostKeySize
+	}
+
+	privDH, encDHPubKey, err := generateDHKeys(random, peerHostKey, version, timestamp)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	msg = &p2p.RelayTunnelExtend{
-		IPv6:        address.To16() != nil,
-		Address:     address,
-		Port:        port,
-		EncDHPubKey: *encDHPubKey,
+	msg = &p2p.TunnelCreate{
+		Version:     version,
+		Timestamp:   timestamp,
+		EncDHPubKey: encDHPubKey,
 	}
 	return privDH, msg, nil
 }
 
+// relayTunnelExtendMsgFromTunnelCreateMsg creates a p2p.RelayTunnelExtend from the given p2p.TunnelCreate to extend an
+// existing onion tunnel to the given peer.
+func relayTunnelExtendMsgFromTunnelCreateMsg(msg *p2p.TunnelCreate, address net.IP, port uint16) (extendMsg p2p.RelayTunnelExtend) {
+	extendMsg.IPv6 = address.To16() != nil
+	extendMsg.Address = address
+	extendMsg.Port = port
+	extendMsg.EncDHPubKey = msg.EncDHPubKey
+	extendMsg.OAEP = msg.Version == p2p.HandshakeVersionDHOAEP
+	extendMsg.Handshake = msg.Handshake
+	extendMsg.Resume = msg.Version == p2p.HandshakeVersionResume
+	extendMsg.Ticket = msg.Ticket
+	extendMsg.DHPubKey = msg.DHPubKey
+	extendMsg.Versions = msg.Versions
+	extendMsg.Capabilities = msg.Capabilities
+	extendMsg.Timestamp = msg.Timestamp
+	extendMsg.CipherSuites = msg.CipherSuites
+	return
+}
+
 // tunnelCreateMsgFromRelayTunnelExtendMsg creates a p2p.TunnelCreate from the given p2p.RelayTunnelExtend
 func tunnelCreateMsgFromRelayTunnelExtendMsg(msg *p2p.RelayTunnelExtend) (createMsg p2p.TunnelCreate) {
 	createMsg.EncDHPubKey = msg.EncDHPubKey
-	createMsg.Version = 1 // implement other versions of the handshake protocol here
+	createMsg.Version = p2p.HandshakeVersionDH
+	if msg.SizedKey() {
+		createMsg.Version = p2p.HandshakeVersionDHSized
+	}
+	if msg.OAEP {
+		createMsg.Version = p2p.HandshakeVersionDHOAEP
+	}
+	if len(msg.Handshake) > 0 {
+		createMsg.Version = p2p.HandshakeVersionAuth
+		createMsg.Handshake = msg.Handshake
+	}
+	if msg.Resume {
+		createMsg.Version = p2p.HandshakeVersionResume
+		createMsg.Ticket = msg.Ticket
+		createMsg.DHPubKey = msg.DHPubKey
+	}
+	createMsg.Versions = msg.Versions
+	createMsg.Capabilities = msg.Capabilities
+	createMsg.Timestamp = msg.Timestamp
+	createMsg.CipherSuites = msg.CipherSuites
 	return
 }
 
@@ -204,5 +553,29 @@ func tunnelCreateMsgFromRelayTunnelExtendMsg(msg *p2p.RelayTunnelExtend) (create
 func relayTunnelExtendedMsgFromTunnelCreatedMsg(msg *p2p.TunnelCreated) (extendedMsg p2p.RelayTunnelExtended) {
 	extendedMsg.DHPubKey = msg.DHPubKey
 	extendedMsg.SharedKeyHash = msg.SharedKeyHash
+	extendedMsg.Handshake = msg.Handshake
+	extendedMsg.Retry = msg.Retry
+	extendedMsg.Ticket = msg.Ticket
+	extendedMsg.Version = msg.Version
+	extendedMsg.Capabilities = msg.Capabilities
+	extendedMsg.CipherSuite = msg.CipherSuite
+	extendedMsg.HasLoad = msg.HasLoad
+	extendedMsg.Load = msg.Load
+	return
+}
+
+// tunnelCreatedMsgFromRelayTunnelExtendedMsg returns a p2p.TunnelCreated from the given p2p.RelayTunnelExtended, such
+// that the reply of a hop is handled the same whether it was relayed or not.
+func tunnelCreatedMsgFromRelayTunnelExtendedMsg(msg *p2p.RelayTunnelExtended) (createdMsg p2p.TunnelCreated) {
+	createdMsg.DHPubKey = msg.DHPubKey
+	createdMsg.SharedKeyHash = msg.SharedKeyHash
+	createdMsg.Handshake = msg.Handshake
+	createdMsg.Retry = msg.Retry
+	createdMsg.Ticket = msg.Ticket
+	createdMsg.Version = msg.Version
+	createdMsg.Capabilities = msg.Capabilities
+	createdMsg.CipherSuite = msg.CipherSuite
+	createdMsg.HasLoad = msg.HasLoad
+	createdMsg.Load = msg.Load
 	return
 }
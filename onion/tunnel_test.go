@@ -5,7 +5,13 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -23,15 +29,12 @@ func TestEncryptDecryptRelayMsg(t *testing.T) {
 	require.Nil(t, err)
 	_, err = rand.Read(dhShared3[:])
 	require.Nil(t, err)
-	peers := []*rps.Peer{
-		{DHShared: dhShared1},
-		{DHShared: dhShared2},
-		{DHShared: dhShared3},
-	}
 	tunnel := Tunnel{
-		hops: peers,
-		id:   1234,
+		id: 1234,
 	}
+	tunnel.addHop(&rps.Peer{DHShared: dhShared1}, newKeyCipher(&dhShared1))
+	tunnel.addHop(&rps.Peer{DHShared: dhShared2}, newKeyCipher(&dhShared2))
+	tunnel.addHop(&rps.Peer{DHShared: dhShared3}, newKeyCipher(&dhShared3))
 
 	payload := []byte("asdf1234")
 
@@ -40,7 +43,9 @@ func TestEncryptDecryptRelayMsg(t *testing.T) {
 	}
 	prevCounter := uint32(123)
 	buf := make([]byte, p2p.MessageSize)
-	_, n, err := p2p.PackRelayMessage(buf, prevCounter, &relayData)
+	// the last hop sends the message back to us
+	_, lastHopDigest := p2p.NewRelayDigests(&dhShared3)
+	_, n, err := p2p.PackRelayMessage(buf, prevCounter, &relayData, lastHopDigest)
 	require.Nil(t, err)
 
 	encryptedMsg, err := tunnel.EncryptRelayMsg(buf[:n])
@@ -61,7 +66,8 @@ func TestGenerateDHKeys(t *testing.T) {
 	peerKey, err := rsa.GenerateKey(rand.Reader, 4096)
 	require.Nil(t, err)
 
-	privDH, encDHPubKey, err := generateDHKeys(&rsa.PublicKey{N: peerKey.N, E: peerKey.E})
+	privDH, encDHPubKey, err := generateDHKeys(rand.Reader, &rsa.PublicKey{N: peerKey.N, E: peerKey.E},
+		p2p.HandshakeVersionDH, 0)
 	require.Nil(t, err)
 	require.NotNil(t, privDH)
 	require.NotNil(t, encDHPubKey)
@@ -70,13 +76,24 @@ func TestGenerateDHKeys(t *testing.T) {
 	require.Nil(t, err)
 	require.NotNil(t, decDHKey)
 	assert.Equal(t, 32, len(decDHKey))
+
+	// the key is encrypted with RSA-OAEP for the version using it
+	privDH, encDHPubKey, err = generateDHKeys(rand.Reader, &peerKey.PublicKey, p2p.HandshakeVersionDHOAEP, 0)
+	require.Nil(t, err)
+	require.NotNil(t, privDH)
+	decDHKey, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, peerKey, encDHPubKey, nil)
+	require.Nil(t, err)
+	assert.Equal(t, 32, len(decDHKey))
+	_, err = rsa.DecryptPKCS1v15(rand.Reader, peerKey, encDHPubKey)
+	assert.NotNil(t, err)
 }
 
 func TestHandleTunnelCreate(t *testing.T) {
 	peerKey, err := rsa.GenerateKey(rand.Reader, 4096)
 	require.Nil(t, err)
 
-	privDH, msgCreate, err := tunnelCreateMsg(&rsa.PublicKey{N: peerKey.N, E: peerKey.E})
+	privDH, msgCreate, err := tunnelCreateMsg(rand.Reader, &rsa.PublicKey{N: peerKey.N, E: peerKey.E},
+		p2p.HandshakeVersionDH, 0)
 	require.Nil(t, err)
 	require.NotNil(t, privDH)
 
@@ -84,11 +101,277 @@ func TestHandleTunnelCreate(t *testing.T) {
 		HostKey: peerKey,
 	}
 
-	dhShared, response, err := handleTunnelCreate(msgCreate, cfg)
+	s, response, err := handleTunnelCreate(rand.Reader, msgCreate, cfg, nil, nil)
 	require.Nil(t, err)
-	require.NotNil(t, dhShared)
+	require.NotNil(t, s)
 	require.NotNil(t, response)
 
-	sharedHash := sha256.Sum256(dhShared[:32])
+	sharedHash := sha256.Sum256(s.key[:32])
 	assert.True(t, bytes.Equal(sharedHash[:], response.SharedKeyHash[:]))
 }
+
+func TestHandleTunnelCreateSizedKey(t *testing.T) {
+	peerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	version := dhVersion(&peerKey.PublicKey)
+	require.Equal(t, uint8(p2p.HandshakeVersionDHSized), version)
+
+	privDH, msgCreate, err := tunnelCreateMsg(rand.Reader, &peerKey.PublicKey, version, 0)
+	require.Nil(t, err)
+	require.NotNil(t, privDH)
+	assert.Len(t, msgCreate.EncDHPubKey, 256)
+
+	// the message survives the wire
+	buf := make([]byte, msgCreate.PackedSize())
+	_, err = msgCreate.Pack(buf)
+	require.Nil(t, err)
+	parsed := p2p.TunnelCreate{}
+	require.Nil(t, parsed.Parse(buf))
+
+	s, response, err := handleTunnelCreate(rand.Reader, &parsed, &config.Config{HostKey: peerKey}, nil, nil)
+	require.Nil(t, err)
+	require.NotNil(t, s)
+	sharedHash := sha256.Sum256(s.key[:32])
+	assert.Equal(t, sharedHash, response.SharedKeyHash)
+
+	// the keys of such host keys do not fit into handshakes of the legacy version
+	_, _, err = tunnelCreateMsg(rand.Reader, &peerKey.PublicKey, p2p.HandshakeVersionDH, 0)
+	assert.Equal(t, ErrHostKeySize, err)
+
+	// nor do the keys of host keys larger than a cell
+	largeKey := &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 8*p2p.MaxHandshakeSize+7), E: 65537}
+	_, _, err = tunnelCreateMsg(rand.Reader, largeKey, dhVersion(largeKey), 0)
+	assert.Equal(t, ErrHostKeySize, err)
+}
+
+func TestHandleTunnelCreateTimestamp(t *testing.T) {
+	peerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	cfg := &config.Config{HostKey: peerKey}
+	const timestamp = 1000000
+
+	newCreate := func(bound uint32) *p2p.TunnelCreate {
+		_, msg, err := tunnelCreateMsg(rand.Reader, &peerKey.PublicKey, p2p.HandshakeVersionDHOAEP, bound)
+		require.Nil(t, err)
+		msg.Versions = p2p.NewVersionSet(p2p.HandshakeVersionDHOAEP)
+		msg.Capabilities = p2p.CapabilityTimestamp
+		msg.Timestamp = timestamp
+		return msg
+	}
+
+	t.Run("bound", func(t *testing.T) {
+		s, _, err := handleTunnelCreate(rand.Reader, newCreate(timestamp), cfg, nil, nil)
+		require.Nil(t, err)
+		require.NotNil(t, s)
+	})
+
+	t.Run("altered", func(t *testing.T) {
+		// a creation replayed with a fresh timestamp once its handshake is forgotten
+		_, _, err := handleTunnelCreate(rand.Reader, newCreate(timestamp-3600), cfg, nil, nil)
+		assert.Equal(t, ErrTimestampMismatch, err)
+	})
+
+	t.Run("not bound", func(t *testing.T) {
+		_, _, err := handleTunnelCreate(rand.Reader, newCreate(0), cfg, nil, nil)
+		assert.Equal(t, ErrInvalidDHPublicKey, err)
+	})
+}
+
+func TestActivity(t *testing.T) {
+	var a activity
+	now := time.Now()
+	a.touch(now)
+	assert.Equal(t, now.UnixNano(), a.last().UnixNano())
+	assert.Equal(t, time.Duration(0), a.idle(now))
+	assert.Equal(t, 5*time.Second, a.idle(now.Add(5*time.Second)))
+}
+
+func TestTunnelDestroy(t *testing.T) {
+	readMsg := func(t *testing.T, conn net.Conn) (hdr p2p.Header, body []byte) {
+		buf := make([]byte, p2p.MessageSize)
+		_, err := io.ReadFull(conn, buf)
+		require.Nil(t, err)
+		require.Nil(t, hdr.Parse(buf))
+		return hdr, buf[p2p.HeaderSize:]
+	}
+
+	t.Run("outgoing tunnel", func(t *testing.T) {
+		link, remote := newPipeLink()
+		defer remote.Close()
+		tunnel := &Tunnel{
+			id:        1234,
+			circuitID: 1234,
+			link:      link,
+			quit:      make(chan struct{}),
+		}
+		var digests []*p2p.RelayDigest // the hops' copies of the running digests
+		for i := byte(1); i <= 3; i++ {
+			hop := &rps.Peer{DHShared: [32]byte{i}}
+			tunnel.addHop(hop, newKeyCipher(&hop.DHShared))
+			forward, _ := p2p.NewRelayDigests(&hop.DHShared)
+			digests = append(digests, forward)
+		}
+		go func() {
+			_ = tunnel.Close()
+		}()
+
+		// every hop receives its own destroy message, starting with the last hop
+		for hop := len(tunnel.hops) - 1; hop >= 0; hop-- {
+			hdr, body := readMsg(t, remote)
+			require.Equal(t, p2p.TypeTunnelRelay, hdr.Type)
+			require.Equal(t, tunnel.circuitID, hdr.TunnelID)
+
+			for i := 0; i <= hop; i++ {
+				var ok bool
+				var err error
+				ok, body, err = p2p.DecryptRelay(body, &tunnel.hops[i].DHShared, digests[i])
+				require.Nil(t, err)
+				require.Equal(t, i == hop, ok, "hop %d", i)
+			}
+			relayHdr := p2p.RelayHeader{}
+			require.Nil(t, relayHdr.Parse(body))
+			assert.Equal(t, p2p.RelayTypeTunnelDestroy, relayHdr.RelayType)
+		}
+	})
+
+	t.Run("outgoing tunnel without hops", func(t *testing.T) {
+		link, remote := newPipeLink()
+		defer remote.Close()
+		tunnel := &Tunnel{id: 1234, circuitID: 1234, link: link, quit: make(chan struct{})}
+		go func() {
+			_ = tunnel.Close()
+		}()
+
+		hdr, _ := readMsg(t, remote)
+		assert.Equal(t, p2p.TypeTunnelDestroy, hdr.Type)
+	})
+
+	t.Run("tunnel segment", func(t *testing.T) {
+		prevLink, prevRemote := newPipeLink()
+		defer prevRemote.Close()
+		nextLink, nextRemote := newPipeLink()
+		defer nextRemote.Close()
+		tunnel := &tunnelSegment{
+			prevHopTunnelID: 1,
+			prevHopLink:     prevLink,
+			nextHopTunnelID: 2,
+			nextHopLink:     nextLink,
+			dhShared:        &[32]byte{1, 2, 3},
+			quit:            make(chan struct{}),
+		}
+		initiator := newInitiatorEnd(prevRemote, tunnel)
+		go func() {
+			_ = tunnel.Close()
+		}()
+
+		// the initiator is informed with an authenticated destroy
+		relayHdr, _ := readRelayFromPrevHop(t, initiator)
+		assert.Equal(t, p2p.RelayTypeTunnelDestroy, relayHdr.RelayType)
+
+		// the next hop with a plain destroy
+		hdr, _ := readMsg(t, nextRemote)
+		assert.Equal(t, p2p.TypeTunnelDestroy, hdr.Type)
+		assert.Equal(t, uint32(2), hdr.TunnelID)
+	})
+}
+
+// newBenchmarkTunnel creates an outgoing tunnel with the given number of hops, returning the hops' copies of the
+// running digests of both directions.
+func newBenchmarkTunnel(numHops int) (tunnel *Tunnel, forward, backward []*p2p.RelayDigest) {
+	tunnel = &Tunnel{id: 1234, circuitID: 1234, quit: make(chan struct{})}
+	for i := 0; i < numHops; i++ {
+		hop := &rps.Peer{DHShared: [32]byte{byte(i + 1)}}
+		tunnel.addHop(hop, newKeyCipher(&hop.DHShared))
+		hopForward, hopBackward := p2p.NewRelayDigests(&hop.DHShared)
+		forward = append(forward, hopForward)
+		backward = append(backward, hopBackward)
+	}
+	return tunnel, forward, backward
+}
+
+func BenchmarkTunnelRelay(b *testing.B) {
+	msg := &p2p.RelayTunnelData{Data: make([]byte, p2p.MaxRelayDataSize-1)}
+
+	for _, numHops := range []int{3, 5} {
+		// the initiator packs and encrypts a cell for the last hop and sends it on the link to the first hop
+		b.Run(fmt.Sprintf("send/hops=%d", numHops), func(b *testing.B) {
+			tunnel, _, _ := newBenchmarkTunnel(numHops)
+			link, connRemote := newPipeLink()
+			defer connRemote.Close()
+			go func() {
+				_, _ = io.Copy(ioutil.Discard, connRemote)
+			}()
+			tunnel.link = link
+
+			b.SetBytes(p2p.MessageSize)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := tunnel.sendRelayToLastHop(msg)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		// every hop removes its layer of encryption, only the last one recognizes the cell
+		b.Run(fmt.Sprintf("forward/hops=%d", numHops), func(b *testing.B) {
+			tunnel, forward, _ := newBenchmarkTunnel(numHops)
+			buf := make([]byte, p2p.RelayMessageSize)
+
+			b.SetBytes(p2p.MessageSize)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				var n int
+				var err error
+				tunnel.sendCounter, n, err = p2p.PackRelayMessage(buf, tunnel.sendCounter, msg,
+					tunnel.sendDigests[numHops-1])
+				require.Nil(b, err)
+				cell, err := tunnel.EncryptRelayMsg(buf[:n])
+				require.Nil(b, err)
+				b.StartTimer()
+
+				for hop := 0; hop < numHops; hop++ {
+					var ok bool
+					ok, cell, err = p2p.DecryptRelay(cell, &tunnel.hops[hop].DHShared, forward[hop])
+					if err != nil || ok != (hop == numHops-1) {
+						b.Fatal("cell recognized by the wrong hop", err)
+					}
+				}
+			}
+		})
+
+		// the last hop sends a cell back, every hop adds its layer of encryption and the initiator removes all of them
+		b.Run(fmt.Sprintf("receive/hops=%d", numHops), func(b *testing.B) {
+			tunnel, _, backward := newBenchmarkTunnel(numHops)
+			buf := make([]byte, p2p.RelayMessageSize)
+			var sendCounter uint32
+
+			b.SetBytes(p2p.MessageSize)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				var n int
+				var err error
+				sendCounter, n, err = p2p.PackRelayMessage(buf, sendCounter, msg, backward[numHops-1])
+				require.Nil(b, err)
+				b.StartTimer()
+
+				cell := buf[:n]
+				for hop := numHops - 1; hop >= 0; hop-- {
+					cell, err = p2p.EncryptRelay(cell, &tunnel.hops[hop].DHShared)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				_, _, ok, err := tunnel.DecryptRelayMessage(cell)
+				if err != nil || !ok {
+					b.Fatal("cell not recognized", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,396 @@
+package onion
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // required by the WebSocket handshake, not used for security
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bawang/config"
+	"bawang/errcode"
+)
+
+// WebSocketTransport is the name of the transport tunneling links over WebSocket connections.
+const WebSocketTransport = "websocket"
+
+// webSocketGUID is used to compute the Sec-WebSocket-Accept header, see RFC 6455 section 1.3.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// webSocketHandshakeTimeout is the max. time the opening handshake of a WebSocket connection may take.
+const webSocketHandshakeTimeout = 10 * time.Second
+
+// webSocketUserAgent is sent in the opening handshake to look like a regular browser.
+const webSocketUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:81.0) Gecko/20100101 Firefox/81.0"
+
+// WebSocket frame opcodes, see RFC 6455 section 5.2.
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+var (
+	errWebSocketHandshake = errcode.New(errcode.ModuleOnion, errcode.InvalidMessage, false, "invalid WebSocket handshake")
+	errWebSocketFrame     = errcode.New(errcode.ModuleOnion, errcode.InvalidMessage, false, "invalid WebSocket frame")
+)
+
+// webSocketTransport tunnels links over WebSocket connections on top of TLS, so that P2P traffic looks like regular
+// HTTPS traffic of a web application, e.g. when run on port 443.
+// Connections not requesting a WebSocket upgrade on the configured path are answered with a 404 page.
+type webSocketTransport struct {
+	tls  *tlsTransport
+	path string
+}
+
+// newWebSocketTransport is the TransportFactory of the WebSocket transport.
+func newWebSocketTransport(cfg *config.Config) (Transport, error) {
+	path := cfg.WebSocketPath
+	if path == "" {
+		path = "/"
+	}
+	return &webSocketTransport{
+		tls:  newTLSTransport(cfg),
+		path: path,
+	}, nil
+}
+
+// DialPeer opens a TLS connection to the peer given by address:port and performs the WebSocket opening handshake.
+func (t *webSocketTransport) DialPeer(address net.IP, port uint16) (net.Conn, error) {
+	nc, err := t.tls.DialPeer(address, port)
+	if err != nil {
+		return nil, err
+	}
+
+	err = nc.SetDeadline(time.Now().Add(webSocketHandshakeTimeout))
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	var nonce [16]byte
+	if _, err = rand.Read(nonce[:]); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	host := net.JoinHostPort(address.String(), strconv.Itoa(int(port)))
+	if port == 443 {
+		host = address.String()
+	}
+	req, err := http.NewRequest(http.MethodGet, "https://"+host+t.path, nil)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	req.Header.Set("User-Agent", webSocketUserAgent)
+	req.Header.Set("Accept", "*/*")
+	req.Header.Set("Accept-Language", "en-US,en;q=0.5")
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	req.Header.Set("Origin", "https://"+host)
+	req.Header.Set("Cache-Control", "no-cache")
+	req.Header.Set("Pragma", "no-cache")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+
+	if err = req.Write(nc); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	rd := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(rd, req)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		nc.Close()
+		return nil, fmt.Errorf("%w: unexpected response %q", errWebSocketHandshake, resp.Status)
+	}
+
+	if err = nc.SetDeadline(time.Time{}); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	return newWebSocketConn(nc, rd, true), nil
+}
+
+// Listen opens a TLS listener on the given address accepting WebSocket connections.
+func (t *webSocketTransport) Listen(address string) (net.Listener, error) {
+	ln, err := t.tls.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	return &webSocketListener{Listener: ln, path: t.path}, nil
+}
+
+// webSocketListener performs the server side of the WebSocket opening handshake on accepted connections.
+type webSocketListener struct {
+	net.Listener
+	path string
+}
+
+// Accept waits for the next connection and completes the WebSocket opening handshake.
+// Connections failing the handshake are closed and skipped.
+func (ln *webSocketListener) Accept() (net.Conn, error) {
+	for {
+		nc, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := ln.handshake(nc)
+		if err != nil {
+			nc.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// handshake reads the HTTP upgrade request from a new connection and responds to it.
+func (ln *webSocketListener) handshake(nc net.Conn) (net.Conn, error) {
+	err := nc.SetDeadline(time.Now().Add(webSocketHandshakeTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	rd := bufio.NewReader(nc)
+	req, err := http.ReadRequest(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != http.MethodGet || req.URL.Path != ln.path || key == "" ||
+		!strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		// look like any other web server to clients not knowing the path
+		resp := "HTTP/1.1 404 Not Found\r\n" +
+			"Content-Type: text/html; charset=utf-8\r\n" +
+			"Content-Length: 9\r\n" +
+			"Connection: close\r\n" +
+			"\r\n" +
+			"Not Found"
+		_, _ = io.WriteString(nc, resp)
+		return nil, errWebSocketHandshake
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n" +
+		"\r\n"
+	if _, err = io.WriteString(nc, resp); err != nil {
+		return nil, err
+	}
+
+	if err = nc.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	return newWebSocketConn(nc, rd, false), nil
+}
+
+// webSocketAccept computes the Sec-WebSocket-Accept header value for a given Sec-WebSocket-Key.
+func webSocketAccept(key string) string {
+	h := sha1.New() //nolint:gosec // required by the WebSocket handshake
+	_, _ = io.WriteString(h, key+webSocketGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// webSocketConn is a net.Conn sending and receiving the data in binary WebSocket frames.
+type webSocketConn struct {
+	net.Conn
+	rd     *bufio.Reader
+	client bool // clients must mask all frames they send
+
+	readLock   sync.Mutex
+	remaining  uint64 // remaining payload bytes of the current frame
+	masked     bool
+	maskKey    [4]byte
+	maskOffset int
+
+	writeLock sync.Mutex
+}
+
+// newWebSocketConn wraps a connection which completed the WebSocket opening handshake.
+func newWebSocketConn(nc net.Conn, rd *bufio.Reader, client bool) *webSocketConn {
+	return &webSocketConn{
+		Conn:   nc,
+		rd:     rd,
+		client: client,
+	}
+}
+
+// ConnectionState returns the state of the underlying TLS connection, see connectionStater.
+func (c *webSocketConn) ConnectionState() tls.ConnectionState {
+	if conn, ok := c.Conn.(connectionStater); ok {
+		return conn.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// Read reads the payload of received data frames. Control frames are handled transparently.
+func (c *webSocketConn) Read(p []byte) (n int, err error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	for c.remaining == 0 {
+		if err = c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err = c.rd.Read(p)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= c.maskKey[(c.maskOffset+i)%4]
+		}
+		c.maskOffset += n
+	}
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame reads the next frame header. Control frames are consumed and handled completely.
+// c.readLock must be held.
+func (c *webSocketConn) nextFrame() (err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(c.rd, hdr[:]); err != nil {
+		return err
+	}
+	opcode := hdr[0] & 0x0f
+	masked := hdr[1]&0x80 != 0
+	length := uint64(hdr[1] & 0x7f)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.rd, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.rd, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	c.masked = masked
+	c.maskOffset = 0
+	if masked {
+		if _, err = io.ReadFull(c.rd, c.maskKey[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case wsOpBinary, wsOpText, wsOpContinuation:
+		c.remaining = length
+		return nil
+
+	case wsOpPing, wsOpPong, wsOpClose:
+		if length > 125 {
+			return errWebSocketFrame
+		}
+		payload := make([]byte, length)
+		if _, err = io.ReadFull(c.rd, payload); err != nil {
+			return err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= c.maskKey[i%4]
+			}
+		}
+
+		switch opcode {
+		case wsOpPing:
+			return c.writeFrame(wsOpPong, payload)
+		case wsOpClose:
+			_ = c.writeFrame(wsOpClose, payload)
+			return io.EOF
+		default: // pong
+			return nil
+		}
+
+	default:
+		return errWebSocketFrame
+	}
+}
+
+// Write sends p in a single binary frame.
+func (c *webSocketConn) Write(p []byte) (n int, err error) {
+	err = c.writeFrame(wsOpBinary, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame sends a single final frame with the given opcode and payload.
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) (err error) {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+
+	switch length := len(payload); {
+	case length <= 125:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+
+	if c.client {
+		var maskKey [4]byte
+		if _, err = rand.Read(maskKey[:]); err != nil {
+			return err
+		}
+		frame = append(frame, maskKey[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= maskKey[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.writeLock.Lock()
+	_, err = c.Conn.Write(frame)
+	c.writeLock.Unlock()
+	return err
+}
@@ -0,0 +1,105 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+)
+
+func TestWebSocketAccept(t *testing.T) {
+	// example from RFC 6455 section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", webSocketAccept("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	transport, err := newTransport(WebSocketTransport, &config.Config{HostKey: hostKey, WebSocketPath: "/chat"})
+	require.Nil(t, err)
+
+	ln, err := transport.Listen("127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	addr := ln.Addr().(*net.TCPAddr)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	t.Run("not found", func(t *testing.T) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // self-signed cert
+		}}
+		resp, err := client.Get("https://" + addr.String() + "/chat")
+		require.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("exchange data", func(t *testing.T) {
+		clientConn, err := transport.DialPeer(addr.IP, uint16(addr.Port))
+		require.Nil(t, err)
+		defer clientConn.Close()
+		serverConn := <-accepted
+		defer serverConn.Close()
+
+		// the host key presented in the TLS handshake is exposed through the WebSocket connection
+		clientHostKey := peerHostKey(clientConn)
+		require.NotNil(t, clientHostKey)
+		assert.True(t, sameHostKey(&hostKey.PublicKey, clientHostKey))
+
+		for _, size := range []int{1, 125, 1024, 70000} {
+			data := make([]byte, size)
+			_, _ = rand.Read(data)
+
+			// client to server
+			go func() {
+				_, _ = clientConn.Write(data)
+			}()
+			received := make([]byte, size)
+			_, err = io.ReadFull(serverConn, received)
+			require.Nil(t, err)
+			require.True(t, bytes.Equal(data, received), "size %d", size)
+
+			// server to client
+			go func() {
+				_, _ = serverConn.Write(data)
+			}()
+			_, err = io.ReadFull(clientConn, received)
+			require.Nil(t, err)
+			require.True(t, bytes.Equal(data, received), "size %d", size)
+		}
+
+		// ping frames are answered transparently
+		ws := serverConn.(*webSocketConn)
+		go func() {
+			_ = ws.writeFrame(wsOpPing, []byte("ping"))
+			_, _ = serverConn.Write([]byte("data"))
+		}()
+		received := make([]byte, 4)
+		_, err = io.ReadFull(clientConn, received)
+		require.Nil(t, err)
+		assert.Equal(t, []byte("data"), received)
+
+		// closing the connection ends the stream
+		go func() {
+			_ = ws.writeFrame(wsOpClose, nil)
+		}()
+		_, err = clientConn.Read(received)
+		assert.Equal(t, io.EOF, err)
+	})
+}
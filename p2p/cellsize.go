@@ -0,0 +1,8 @@
+//go:build !cell512 && !cell2048
+// +build !cell512,!cell2048
+
+package p2p
+
+// MessageSize is the size of a P2P packet, which is the same for all messages and all peers of a network. Other sizes
+// may be chosen at build time with the build tags cell512 and cell2048 for experiments, see LinkHello.
+const MessageSize = DefaultMessageSize
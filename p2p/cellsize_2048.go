@@ -0,0 +1,7 @@
+//go:build cell2048
+// +build cell2048
+
+package p2p
+
+// MessageSize is the size of a P2P packet, chosen by the build tag cell2048.
+const MessageSize = 2048
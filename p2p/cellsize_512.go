@@ -0,0 +1,8 @@
+//go:build cell512
+// +build cell512
+
+package p2p
+
+// MessageSize is the size of a P2P packet, chosen by the build tag cell512. The handshakes only fit host keys of up to
+// 3760 bits, e.g. of 2048 or 3072 bits, see HandshakeVersionDHSized.
+const MessageSize = 512
@@ -0,0 +1,62 @@
+package p2p
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding"
+	"hash"
+)
+
+const (
+	digestSeedForward  = "bawang relay digest forward"  // label of the seed for messages sent by the tunnel initiator
+	digestSeedBackward = "bawang relay digest backward" // label of the seed for messages sent to the tunnel initiator
+)
+
+// RelayDigest is a running digest over all relay messages sent in one direction between the tunnel initiator and a
+// single hop. Each message's digest covers all previous messages, such that dropped, reordered or replayed messages
+// are detected. Both ends keep a copy of the digest, seeded from their shared session key, and advance it with every
+// message they send or recognize.
+// A RelayDigest is not safe for concurrent use, senders must serialize the packing and sending of their messages.
+type RelayDigest struct {
+	h hash.Hash
+}
+
+// NewRelayDigests derives the running digests of both directions from the session key shared by the tunnel initiator
+// and a hop. The forward digest covers the messages sent by the initiator, the backward digest the ones sent to it.
+func NewRelayDigests(key *[32]byte) (forward, backward *RelayDigest) {
+	return newRelayDigest(key, digestSeedForward), newRelayDigest(key, digestSeedBackward)
+}
+
+// newRelayDigest creates a running digest seeded with a key derived from the session key and the given label.
+func newRelayDigest(key *[32]byte, label string) *RelayDigest {
+	kdf := hmac.New(sha256.New, key[:])
+	_, _ = kdf.Write([]byte(label))
+
+	h := sha256.New()
+	_, _ = h.Write(kdf.Sum(nil))
+	return &RelayDigest{h: h}
+}
+
+// next returns the digest of the given packed relay message, with its digest field set to zero, following all
+// previous messages. The running digest is only advanced by commit.
+func (d *RelayDigest) next(msg ...[]byte) (next hash.Hash, sum []byte) {
+	state, err := d.h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		panic(err) // sha256 always supports this
+	}
+	next = sha256.New()
+	err = next.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, m := range msg {
+		_, _ = next.Write(m)
+	}
+	return next, next.Sum(nil)
+}
+
+// commit advances the running digest to the state returned by next.
+func (d *RelayDigest) commit(next hash.Hash) {
+	d.h = next
+}
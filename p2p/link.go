@@ -0,0 +1,253 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"net"
+
+	"bawang/api"
+)
+
+// LinkTunnelID is the tunnel ID of link messages, which concern the link between two adjacent peers rather than any
+// tunnel using it. Link messages are told apart by their type, but peers supporting them do not use it as circuit ID.
+const LinkTunnelID = 0
+
+// LinkFeatures is a bitmask of optional link features supported by a peer, announced to the adjacent peer with a
+// LinkHello.
+type LinkFeatures uint8
+
+const (
+	// the peer sends LinkPadding at random intervals if the adjacent peer supports it as well
+	LinkFeaturePadding LinkFeatures = 1 << iota
+	// the hello carries the identity of the peer, such that duplicate links between the same peers can be detected
+	LinkFeatureIdentity
+)
+
+// LinkHello is sent by both peers once a link is established to announce their link features and the size of their
+// packets. Peers predating link messages ignore it.
+type LinkHello struct {
+	Features    LinkFeatures
+	MessageSize uint16 // size of the packets of the peer, 0 for DefaultMessageSize
+
+	// only with LinkFeatureIdentity, zero if left out
+	Port     uint16 // P2P port the peer accepts links on
+	Identity uint64 // chosen at random by the peer on each start, the same on all of its links
+}
+
+// SameMessageSize returns whether the peer uses packets of the same size as we do, see MessageSize. Peers of different
+// sizes can not read each other's packets.
+func (msg *LinkHello) SameMessageSize() bool {
+	size := int(msg.MessageSize)
+	if size == 0 {
+		size = DefaultMessageSize
+	}
+	return size == MessageSize
+}
+
+// Type returns the type of the message.
+func (msg *LinkHello) Type() Type {
+	return TypeLinkHello
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *LinkHello) Parse(data []byte) (err error) {
+	const size = 4
+	const identitySize = 10
+	if len(data) < size {
+		return ErrInvalidMessage
+	}
+
+	msg.Features = LinkFeatures(data[0])
+	msg.MessageSize = binary.BigEndian.Uint16(data[1:3])
+	msg.Port, msg.Identity = 0, 0
+	if msg.Features&LinkFeatureIdentity != 0 && len(data) >= size+identitySize {
+		msg.Port = binary.BigEndian.Uint16(data[4:6])
+		msg.Identity = binary.BigEndian.Uint64(data[6:14])
+	}
+	return
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *LinkHello) PackedSize() (n int) {
+	if msg.Features&LinkFeatureIdentity != 0 {
+		return 14
+	}
+	return 4
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *LinkHello) Pack(buf []byte) (n int, err error) {
+	n = msg.PackedSize()
+	if cap(buf) < n {
+		return -1, ErrBufferTooSmall
+	}
+	buf = buf[:n]
+
+	buf[0] = byte(msg.Features)
+	binary.BigEndian.PutUint16(buf[1:3], msg.MessageSize)
+	buf[3] = 0x00 // reserved
+	if msg.Features&LinkFeatureIdentity != 0 {
+		binary.BigEndian.PutUint16(buf[4:6], msg.Port)
+		binary.BigEndian.PutUint64(buf[6:14], msg.Identity)
+	}
+
+	return n, nil
+}
+
+// LinkPadding is sent at random intervals between adjacent peers which both announced LinkFeaturePadding, such that
+// the traffic of a link does not reveal when its tunnels are used. Like all messages, it fills a full packet, which is
+// dropped by the receiver.
+type LinkPadding struct {
+}
+
+// Type returns the type of the message.
+func (msg *LinkPadding) Type() Type {
+	return TypeLinkPadding
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *LinkPadding) Parse(data []byte) (err error) {
+	return
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *LinkPadding) PackedSize() (n int) {
+	return 0
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *LinkPadding) Pack(buf []byte) (n int, err error) {
+	return 0, nil
+}
+
+// LinkReachCheck asks the adjacent peer to connect back to the sender on the given P2P port, at the address the link
+// comes from, such that the sender learns whether other peers can reach it, e.g. behind a NAT. The peer answers with a
+// LinkReachResult.
+type LinkReachCheck struct {
+	Port  uint16 // P2P port the sender accepts links on
+	Nonce uint64 // chosen at random by the sender, echoed in the result
+}
+
+// Type returns the type of the message.
+func (msg *LinkReachCheck) Type() Type {
+	return TypeLinkReachCheck
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *LinkReachCheck) Parse(data []byte) (err error) {
+	const size = 12
+	if len(data) < size {
+		return ErrInvalidMessage
+	}
+
+	msg.Port = binary.BigEndian.Uint16(data[0:2])
+	msg.Nonce = binary.BigEndian.Uint64(data[4:12])
+	return
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *LinkReachCheck) PackedSize() (n int) {
+	return 12
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *LinkReachCheck) Pack(buf []byte) (n int, err error) {
+	n = msg.PackedSize()
+	if cap(buf) < n {
+		return -1, ErrBufferTooSmall
+	}
+	buf = buf[:n]
+
+	binary.BigEndian.PutUint16(buf[0:2], msg.Port)
+	buf[2] = 0x00 // reserved
+	buf[3] = 0x00 // reserved
+	binary.BigEndian.PutUint64(buf[4:12], msg.Nonce)
+
+	return n, nil
+}
+
+const (
+	flagReachable = 1 << iota
+	flagReachIPv6
+)
+
+// LinkReachResult answers a LinkReachCheck with the outcome of the connection back to the sender of the check.
+type LinkReachResult struct {
+	Nonce     uint64 // of the answered check
+	Reachable bool   // whether the connection back was established, including the handshake of the transport
+	IPv6      bool
+	Address   net.IP // address of the sender of the check as seen by the peer, which it connected back to
+
+	// SHA-256 of the PKCS #1 encoded host key presented on the connection back, zero if not reachable or unknown, e.g.
+	// with transports not using TLS
+	HostKeyHash [32]byte
+}
+
+// Type returns the type of the message.
+func (msg *LinkReachResult) Type() Type {
+	return TypeLinkReachResult
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *LinkReachResult) Parse(data []byte) (err error) {
+	const size = 4 + 8 + 32
+	if len(data) < size+net.IPv4len {
+		return ErrInvalidMessage
+	}
+
+	flags := data[0]
+	msg.Reachable = flags&flagReachable != 0
+	msg.IPv6 = flags&flagReachIPv6 != 0
+	msg.Nonce = binary.BigEndian.Uint64(data[4:12])
+	copy(msg.HostKeyHash[:], data[12:size])
+	if msg.IPv6 {
+		if len(data) < size+net.IPv6len {
+			return ErrInvalidMessage
+		}
+		msg.Address = api.ReadIP(true, data[size:size+net.IPv6len])
+	} else {
+		msg.Address = api.ReadIP(false, data[size:size+net.IPv4len])
+	}
+	return
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *LinkReachResult) PackedSize() (n int) {
+	if msg.IPv6 {
+		return 4 + 8 + 32 + net.IPv6len
+	}
+	return 4 + 8 + 32 + net.IPv4len
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *LinkReachResult) Pack(buf []byte) (n int, err error) {
+	n = msg.PackedSize()
+	if cap(buf) < n {
+		return -1, ErrBufferTooSmall
+	}
+	buf = buf[:n]
+
+	flags := byte(0x00)
+	if msg.Reachable {
+		flags |= flagReachable
+	}
+	if msg.IPv6 {
+		flags |= flagReachIPv6
+	}
+	buf[0] = flags
+	buf[1] = 0x00 // reserved
+	buf[2] = 0x00 // reserved
+	buf[3] = 0x00 // reserved
+	binary.BigEndian.PutUint64(buf[4:12], msg.Nonce)
+	copy(buf[12:44], msg.HostKeyHash[:])
+
+	// like all addresses, it is sent in reverse byte order, see api.ReadIP
+	addr := msg.Address.To4()
+	if msg.IPv6 {
+		addr = msg.Address.To16()
+	}
+	for i := range addr {
+		buf[n-1-i] = addr[i]
+	}
+
+	return n, nil
+}
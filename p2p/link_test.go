@@ -0,0 +1,152 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	_ Message = &LinkHello{}
+	_ Message = &LinkPadding{}
+	_ Message = &LinkReachCheck{}
+	_ Message = &LinkReachResult{}
+)
+
+func TestLinkHello(t *testing.T) {
+	msg := new(LinkHello)
+
+	// check message type
+	require.Equal(t, TypeLinkHello, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	data := []byte{byte(LinkFeaturePadding), 0, 0, 0}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, LinkHello{Features: LinkFeaturePadding}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+
+	// unknown features are passed on to the caller, which ignores them
+	require.Nil(t, msg.Parse([]byte{0xff, 0, 0, 0}))
+	assert.Equal(t, LinkFeatures(0xff), msg.Features)
+
+	// peers of the default packet size may leave it out
+	assert.Equal(t, MessageSize == DefaultMessageSize, msg.SameMessageSize())
+
+	data = []byte{0, 0x08, 0x00, 0}
+	require.Nil(t, msg.Parse(data))
+	require.Equal(t, LinkHello{MessageSize: 2048}, *msg)
+	assert.Equal(t, MessageSize == 2048, msg.SameMessageSize())
+	n, err = msg.Pack(buf)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf[:n])
+
+	// the identity follows the reserved byte
+	data = []byte{byte(LinkFeatureIdentity | LinkFeaturePadding), 0, 0, 0, 0x19, 0xca, 1, 2, 3, 4, 5, 6, 7, 8}
+	require.Nil(t, msg.Parse(data))
+	require.Equal(t, LinkHello{
+		Features: LinkFeatureIdentity | LinkFeaturePadding,
+		Port:     6602,
+		Identity: 0x0102030405060708,
+	}, *msg)
+	n, err = msg.Pack(buf)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf[:n])
+	require.Nil(t, msg.Parse(data[:13]))
+	assert.Equal(t, uint64(0), msg.Identity)
+
+	// without the feature any further bytes are ignored
+	require.Nil(t, msg.Parse([]byte{0, 0, 0, 0, 0x19, 0xca}))
+	assert.Equal(t, LinkHello{}, *msg)
+}
+
+func TestLinkPadding(t *testing.T) {
+	msg := new(LinkPadding)
+
+	// check message type
+	require.Equal(t, TypeLinkPadding, msg.Type())
+
+	// the content is random and ignored
+	require.Nil(t, msg.Parse([]byte{1, 2, 3}))
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestLinkReachCheck(t *testing.T) {
+	msg := new(LinkReachCheck)
+
+	// check message type
+	require.Equal(t, TypeLinkReachCheck, msg.Type())
+
+	// too short
+	assert.Equal(t, ErrInvalidMessage, msg.Parse(make([]byte, 11)))
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	data := []byte{0x19, 0xca, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8}
+	require.Nil(t, msg.Parse(data))
+	require.Equal(t, LinkReachCheck{Port: 6602, Nonce: 0x0102030405060708}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestLinkReachResult(t *testing.T) {
+	msg := new(LinkReachResult)
+
+	// check message type
+	require.Equal(t, TypeLinkReachResult, msg.Type())
+
+	// too short
+	assert.Equal(t, ErrInvalidMessage, msg.Parse(make([]byte, 47)))
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	data := make([]byte, 48)
+	data[0] = flagReachable
+	copy(data[4:12], []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	data[12] = 0xff
+	copy(data[44:], []byte{1, 2, 0, 192})
+	require.Nil(t, msg.Parse(data))
+	expected := LinkReachResult{Nonce: 0x0102030405060708, Reachable: true, Address: net.IPv4(192, 0, 2, 1).To4()}
+	expected.HostKeyHash[0] = 0xff
+	require.Equal(t, expected, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf[:n])
+
+	// IPv6 addresses are longer
+	msg = &LinkReachResult{IPv6: true, Address: net.ParseIP("2001:db8::1")}
+	n, err = msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, 60, n)
+	assert.Equal(t, ErrInvalidMessage, new(LinkReachResult).Parse(buf[:n-1]))
+	parsed := new(LinkReachResult)
+	require.Nil(t, parsed.Parse(buf[:n]))
+	assert.Equal(t, msg.Address, parsed.Address)
+	assert.False(t, parsed.Reachable)
+}
@@ -3,19 +3,20 @@ package p2p
 import (
 	"crypto/rand"
 	"encoding/binary"
-	"errors"
 	"io"
+
+	"bawang/errcode"
 )
 
 const (
-	HeaderSize  = 4 + 1                    // Size of a P2P header
-	MessageSize = 1024                     // Size of a P2P packet (static and padded if content is smaller)
-	MaxBodySize = MessageSize - HeaderSize // Max size of payload
+	HeaderSize         = 4 + 1                    // Size of a P2P header
+	DefaultMessageSize = 1024                     // Size of a P2P packet unless chosen otherwise, see MessageSize
+	MaxBodySize        = MessageSize - HeaderSize // Max size of payload
 )
 
 var (
-	ErrInvalidMessage = errors.New("invalid message")
-	ErrBufferTooSmall = errors.New("buffer is too small for message")
+	ErrInvalidMessage = errcode.New(errcode.ModuleP2P, errcode.InvalidMessage, false, "invalid message")
+	ErrBufferTooSmall = errcode.New(errcode.ModuleP2P, errcode.InvalidMessage, false, "buffer is too small for message")
 )
 
 // Message abstracts a P2p message.
@@ -63,8 +64,27 @@ func (hdr *Header) Pack(buf []byte) {
 	buf[4] = uint8(hdr.Type)
 }
 
-// PackMessage serializes a given message into the given bytes buffer.
+// Packer packs messages, drawing the padding and the counters of relay messages from Rand, such that tests and
+// simulations can pack messages deterministically. The zero value draws from crypto/rand.
+type Packer struct {
+	Rand io.Reader // must be safe for concurrent use if the Packer is
+}
+
+// reader returns the source of randomness of the Packer.
+func (p Packer) reader() io.Reader {
+	if p.Rand == nil {
+		return rand.Reader
+	}
+	return p.Rand
+}
+
+// PackMessage serializes a given message into the given bytes buffer, see Packer.PackMessage.
 func PackMessage(buf []byte, tunnelID uint32, msg Message) (n int, err error) {
+	return Packer{}.PackMessage(buf, tunnelID, msg)
+}
+
+// PackMessage serializes a given message into the given bytes buffer.
+func (p Packer) PackMessage(buf []byte, tunnelID uint32, msg Message) (n int, err error) {
 	if msg == nil {
 		return -1, ErrInvalidMessage
 	}
@@ -80,6 +100,6 @@ func PackMessage(buf []byte, tunnelID uint32, msg Message) (n int, err error) {
 		return -1, ErrInvalidMessage
 	}
 
-	_, err = rand.Read(buf[HeaderSize+n2 : n]) // initialize remaining bytes of the packet with randomness
+	_, err = io.ReadFull(p.reader(), buf[HeaderSize+n2:n]) // initialize remaining bytes of the packet with randomness
 	return n, err
 }
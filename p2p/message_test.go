@@ -3,6 +3,7 @@ package p2p
 import (
 	"bytes"
 	"errors"
+	"math/rand"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -130,4 +131,15 @@ func TestPackMessage(t *testing.T) {
 		_, err = PackMessage(buf[:], tunnelID, nil)
 		require.Equal(t, ErrInvalidMessage, err)
 	})
+
+	t.Run("deterministic", func(t *testing.T) {
+		var buf1, buf2 [MessageSize]byte
+		msg := new(TunnelDestroy)
+
+		_, err := Packer{Rand: rand.New(rand.NewSource(1))}.PackMessage(buf1[:], tunnelID, msg)
+		require.Nil(t, err)
+		_, err = Packer{Rand: rand.New(rand.NewSource(1))}.PackMessage(buf2[:], tunnelID, msg)
+		require.Nil(t, err)
+		assert.Equal(t, buf1, buf2)
+	})
 }
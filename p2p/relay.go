@@ -3,21 +3,35 @@ package p2p
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/binary"
-	mathRand "math/rand"
+	"io"
 	"net"
 
 	"bawang/api"
+	"bawang/errcode"
 )
 
+//go:generate go run bawang/internal/wiregen
+
 const (
 	RelayHeaderSize  = 3 + 1 + 2 + 1 + 8                  // Relay sub-header size
+	RelayCounterSize = 3                                  // Size of the counter at the start of the header, never encrypted
 	RelayMessageSize = MaxBodySize                        // Size of a relay (sub-)message
 	MaxRelayDataSize = RelayMessageSize - RelayHeaderSize // Max size of relay payload
+
+	seqHeaderSize       = 8 + 4                            // Stream ID and sequence number
+	MaxRelaySeqDataSize = MaxRelayDataSize - seqHeaderSize // Max size of sequenced relay payload
+
+	recognizedSize = 2 // Size of the zero marker at the start of the digest
+
+	MaxRelayCounter = 1<<(8*RelayCounterSize) - 1 // Max counter of a relay message, see PackRelayMessage
 )
 
+var ErrCounterExhausted = errcode.New(errcode.ModuleP2P, errcode.Limit, false,
+	"relay counter is exhausted, the tunnel must be rebuilt")
+
 // RelayMessage abstracts a relay sub protocol protocol message (not containing the outer header).
 type RelayMessage interface {
 	Type() RelayType                    // Type returns the relay type of the message.
@@ -27,9 +41,15 @@ type RelayMessage interface {
 }
 
 const flagIPv6 = 1
+const flagNegotiate = 4
+const flagSizedKey = 8
+const flagOAEP = 16
+const flagResume = 32
 const flagCoverPing = 1
 
 // RelayHeader is the header of a relay sub protocol protocol cell.
+// The Digest starts with a zero marker recognizing cells meant for the hop, followed by the running digest of all
+// messages exchanged with the hop, see ComputeDigest.
 type RelayHeader struct {
 	Counter   [3]byte
 	RelayType RelayType
@@ -37,6 +57,15 @@ type RelayHeader struct {
 	Digest    [8]byte
 }
 
+// Body returns the body of the given relay message according to the size in the header, which must cover at least the
+// header and at most the whole message. The size is only meaningful once the message was recognized.
+func (hdr *RelayHeader) Body(msg []byte) (body []byte, err error) {
+	if int(hdr.Size) < RelayHeaderSize || int(hdr.Size) > len(msg) {
+		return nil, ErrInvalidMessage
+	}
+	return msg[RelayHeaderSize:hdr.Size], nil
+}
+
 // GetCounter returns the counter value as uint32
 func (hdr *RelayHeader) GetCounter() (ctr uint32) {
 	counterBytes := make([]byte, 4)
@@ -77,56 +106,72 @@ func (hdr *RelayHeader) Pack(buf []byte) (err error) {
 	return nil
 }
 
-// ComputeDigest computes the digest for a given message body and saves it into the header.
-func (hdr *RelayHeader) ComputeDigest(body []byte) (err error) {
-	copy(hdr.Digest[:], []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}) // initialize digest to zero
-	packedHdr := make([]byte, RelayHeaderSize)
-	err = hdr.Pack(packedHdr)
+// ComputeDigest computes the digest for a given message body, saves it into the header and advances the running
+// digest of the hop the message is meant for. The digest consists of a zero marker followed by the truncated running
+// digest over the header, with the digest set to zero, and the body of this and all previous messages.
+func (hdr *RelayHeader) ComputeDigest(body []byte, digest *RelayDigest) (err error) {
+	packedHdr, err := hdr.packZeroDigest()
 	if err != nil {
 		return err
 	}
-	fullMsg := append(packedHdr, body...)
 
-	digest := sha256.Sum256(fullMsg)
-	// TODO: figure out how we can reintroduce this quick check
-	// for digest[0] != 0x00 && digest[1] != 0x00 {
-	// 	digest = sha256.Sum256(fullMsg)
-	// }
+	next, sum := digest.next(packedHdr, body)
+	hdr.Digest = [8]byte{}
+	copy(hdr.Digest[recognizedSize:], sum)
+	digest.commit(next)
 
-	copy(hdr.Digest[:], digest[:8])
+	return nil
+}
 
-	return err
+// Recognized is a quick check whether the message may be meant for the hop which decrypted it. For all other hops, the
+// zero marker of the digest is still encrypted and thus only zero by chance, such that cells forwarded along the
+// tunnel are rarely digested.
+func (hdr *RelayHeader) Recognized() bool {
+	return hdr.Digest[0] == 0x00 && hdr.Digest[1] == 0x00
 }
 
-// CheckDigest verifies that the digest within the header is valid for a given message body.
-func (hdr *RelayHeader) CheckDigest(body []byte) (ok bool) {
-	// TODO: figure out how we can reintroduce this quick check
-	// if hdr.Digest[0] != 0x00 || hdr.Digest[1] != 0x00 {
-	// 	return false
-	// }
+// CheckDigest verifies that the digest within the header is valid for a given message body, following all messages
+// previously received from the same end. The running digest is only advanced if the digest is valid.
+func (hdr *RelayHeader) CheckDigest(body []byte, digest *RelayDigest) (ok bool) {
+	if !hdr.Recognized() {
+		return false
+	}
 
-	digest := make([]byte, 8)
-	copy(digest, hdr.Digest[:])
-	err := hdr.ComputeDigest(body)
+	packedHdr, err := hdr.packZeroDigest()
 	if err != nil {
-		copy(hdr.Digest[:], digest)
 		return false
 	}
 
-	ok = true
-	for i, v := range digest {
-		if v != hdr.Digest[i] {
-			ok = false
-			break
-		}
+	next, sum := digest.next(packedHdr, body)
+	if !hmac.Equal(hdr.Digest[recognizedSize:], sum[:len(hdr.Digest)-recognizedSize]) {
+		return false
 	}
-	copy(hdr.Digest[:], digest)
+	digest.commit(next)
 
-	return ok
+	return true
+}
+
+// packZeroDigest serializes the header with the digest set to zero, as covered by the digest.
+func (hdr *RelayHeader) packZeroDigest() (packedHdr []byte, err error) {
+	zeroed := *hdr
+	zeroed.Digest = [8]byte{}
+	packedHdr = make([]byte, RelayHeaderSize)
+	err = zeroed.Pack(packedHdr)
+	return packedHdr, err
+}
+
+// PackRelayMessage serializes a given relay message into the given bytes buffer (without outer P2P message header),
+// see Packer.PackRelayMessage.
+func PackRelayMessage(buf []byte, oldCounter uint32, msg RelayMessage, digest *RelayDigest) (newCounter uint32, n int, err error) {
+	return Packer{}.PackRelayMessage(buf, oldCounter, msg, digest)
 }
 
 // PackRelayMessage serializes a given relay message into the given bytes buffer (without outer P2P message header).
-func PackRelayMessage(buf []byte, oldCounter uint32, msg RelayMessage) (newCounter uint32, n int, err error) {
+// The running digest of the hop the message is meant for is advanced, thus the message must be sent.
+// The counter is used as nonce, thus it must not wrap around. ErrCounterExhausted is returned instead once it would
+// exceed MaxRelayCounter, after roughly half a million messages, such that the tunnel must be rebuilt.
+func (p Packer) PackRelayMessage(buf []byte, oldCounter uint32, msg RelayMessage, digest *RelayDigest) (
+	newCounter uint32, n int, err error) {
 	// sanity checks
 	n = MaxRelayDataSize + RelayHeaderSize
 	if len(buf) < n {
@@ -136,8 +181,16 @@ func PackRelayMessage(buf []byte, oldCounter uint32, msg RelayMessage) (newCount
 		return oldCounter, -1, ErrInvalidMessage
 	}
 
-	// generate random  counter, greater than the previous one
-	newCounter = oldCounter + uint32(mathRand.Int31n(64)) //nolint:gosec // pseudo-rand is good enough here
+	// generate random counter, greater than the previous one, such that it is not reused as nonce until it wraps
+	// around, see RelayCipher
+	var step [1]byte
+	if _, err = io.ReadFull(p.reader(), step[:]); err != nil {
+		return oldCounter, -1, err
+	}
+	newCounter = oldCounter + 1 + uint32(step[0]%63)
+	if newCounter > MaxRelayCounter {
+		return oldCounter, -1, ErrCounterExhausted
+	}
 	counterBytes := make([]byte, 4)
 	binary.BigEndian.PutUint32(counterBytes, newCounter)
 	hdr := RelayHeader{
@@ -155,12 +208,12 @@ func PackRelayMessage(buf []byte, oldCounter uint32, msg RelayMessage) (newCount
 	}
 
 	// initialize remaining bytes of the packet with pseudo randomness
-	_, err = rand.Read(buf[RelayHeaderSize+n2 : n])
+	_, err = io.ReadFull(p.reader(), buf[RelayHeaderSize+n2:n])
 	if err != nil {
 		return
 	}
 
-	err = hdr.ComputeDigest(buf[RelayHeaderSize:n])
+	err = hdr.ComputeDigest(buf[RelayHeaderSize:n], digest)
 	if err != nil {
 		return newCounter, -1, err
 	}
@@ -171,9 +224,38 @@ func PackRelayMessage(buf []byte, oldCounter uint32, msg RelayMessage) (newCount
 }
 
 // DecryptRelay attempts to decrypt an encrypted message given as a bytes slice with a given key.
-func DecryptRelay(encRelayMsg []byte, key *[32]byte) (ok bool, msg []byte, err error) {
+// ok reports whether the message is meant for the holder of the key, which is only digested if it is recognized. The
+// running digest of the messages received from the other end is advanced for these messages only.
+func DecryptRelay(encRelayMsg []byte, key *[32]byte, digest *RelayDigest) (ok bool, msg []byte, err error) {
+	msg, err = DecryptRelayLayer(encRelayMsg, key)
+	if err != nil {
+		return false, nil, err
+	}
+
+	ok, err = RecognizeRelay(msg, digest)
+	if err != nil {
+		return false, nil, err
+	}
+	return ok, msg, nil
+}
+
+// RecognizeRelay checks whether a relay message, from which a layer of encryption was removed, is meant for the hop
+// which removed it, see DecryptRelay.
+func RecognizeRelay(msg []byte, digest *RelayDigest) (ok bool, err error) {
+	hdr := RelayHeader{}
+	err = hdr.Parse(msg)
+	if err != nil {
+		return false, err
+	}
+
+	return hdr.CheckDigest(msg[RelayHeaderSize:], digest), nil
+}
+
+// DecryptRelayLayer removes the layer of encryption with the given key from a relay message given as a bytes slice,
+// without checking whether the message is meant for the holder of the key.
+func DecryptRelayLayer(encRelayMsg []byte, key *[32]byte) (msg []byte, err error) {
 	if len(encRelayMsg) > MaxRelayDataSize+RelayHeaderSize {
-		return false, nil, ErrInvalidMessage
+		return nil, ErrInvalidMessage
 	}
 
 	// message starts with the relay message header, we get the counter from the first 3 bytes
@@ -184,7 +266,7 @@ func DecryptRelay(encRelayMsg []byte, key *[32]byte) (ok bool, msg []byte, err e
 
 	block, err := aes.NewCipher(key[:])
 	if err != nil {
-		return false, nil, err
+		return nil, err
 	}
 
 	msg = make([]byte, len(encRelayMsg))
@@ -192,15 +274,7 @@ func DecryptRelay(encRelayMsg []byte, key *[32]byte) (ok bool, msg []byte, err e
 	stream := cipher.NewCTR(block, iv)
 	stream.XORKeyStream(msg[3:], encRelayMsg[3:])
 
-	hdr := RelayHeader{}
-	err = hdr.Parse(msg)
-	if err != nil {
-		return false, nil, err
-	}
-
-	ok = hdr.CheckDigest(msg[RelayHeaderSize:])
-
-	return ok, msg, nil
+	return msg, nil
 }
 
 // DecryptRelay encrypts a message given as a bytes slice with the given key.
@@ -225,11 +299,36 @@ func EncryptRelay(packedMsg []byte, key *[32]byte) (encMsg []byte, err error) {
 }
 
 // RelayTunnelExtend commands the addressed tunnel hop to extend the tunnel by another hop.
+// Encrypted keys of other sizes than EncDHPubKeySize are prefixed by their size, such that the hop creates a
+// TunnelCreate of HandshakeVersionDHSized from it. Only hops announcing CapabilitySizedKeys understand them.
+// Keys encrypted with RSA-OAEP are always prefixed by their size and only understood by hops announcing CapabilityOAEP,
+// which create a TunnelCreate of HandshakeVersionDHOAEP from them.
+// Resumed handshakes carry the ticket and public key of a TunnelCreate of HandshakeVersionResume instead of the
+// encrypted key. Only hops having issued a ticket themselves understand them, see TunnelCreated.
+// With WantLoad, the initiator asks the hop to pass the load announced by the next hop on in its RelayTunnelExtended.
+// Hops predating it ignore the flag.
 type RelayTunnelExtend struct {
 	IPv6        bool
 	Port        uint16
 	Address     net.IP
-	EncDHPubKey [512]byte //  encrypted DH key -> next hop creates TunnelCreate message from it
+	EncDHPubKey []byte //  encrypted DH key -> next hop creates TunnelCreate message from it
+	OAEP        bool   // whether EncDHPubKey is encrypted with RSA-OAEP, see HandshakeVersionDHOAEP
+	Handshake   []byte // handshake payload of the Onion Auth module, used instead of EncDHPubKey if set
+
+	// ticket and pub key of a resumed handshake, used instead of EncDHPubKey if Resume is set
+	Resume   bool
+	Ticket   [TicketSize]byte
+	DHPubKey [32]byte
+
+	// offered handshake versions and capabilities of the initiator, see TunnelCreate. Appended to the message only if
+	// Versions is not empty, followed by the timestamp if the capabilities contain CapabilityTimestamp and the offered
+	// cipher suites if they contain CapabilityCipherSuites.
+	Versions     VersionSet
+	Capabilities Capabilities
+	Timestamp    uint32
+	CipherSuites CipherSuiteSet
+
+	WantLoad bool // whether the initiator asks for the load of the next hop, see TunnelCreated
 }
 
 // Type returns the relay type of the message.
@@ -239,19 +338,21 @@ func (msg *RelayTunnelExtend) Type() RelayType {
 
 // Parse fills the struct with values parsed from the given bytes slice.
 func (msg *RelayTunnelExtend) Parse(data []byte) (err error) {
-	const minSize = len(msg.EncDHPubKey) + 2 + 2 + 4
+	const minSize = 2 + 2 + 4
 	if len(data) < minSize {
 		return ErrInvalidMessage
 	}
 
-	msg.IPv6 = data[1]&flagIPv6 > 0
+	flags := data[1]
+	msg.IPv6 = flags&flagIPv6 > 0
+	msg.WantLoad = flags&flagLoad > 0
 	msg.Port = binary.BigEndian.Uint16(data[2:4])
 
 	// read IP address (either 4 bytes if IPv4 or 16 bytes if IPv6)
 	keyOffset := 8
 	if msg.IPv6 {
 		keyOffset = 20
-		if len(data) < keyOffset+len(msg.EncDHPubKey) {
+		if len(data) < keyOffset {
 			return ErrInvalidMessage
 		}
 		msg.Address = api.ReadIP(true, data[4:20])
@@ -259,18 +360,95 @@ func (msg *RelayTunnelExtend) Parse(data []byte) (err error) {
 		msg.Address = api.ReadIP(false, data[4:8])
 	}
 
-	// must make a copy!
-	copy(msg.EncDHPubKey[:], data[keyOffset:keyOffset+len(msg.EncDHPubKey)])
+	end := keyOffset + EncDHPubKeySize
+	switch {
+	case flags&flagAuthHandshake > 0:
+		msg.Handshake, err = parseHandshake(data[keyOffset:])
+		if err != nil {
+			return err
+		}
+		end = keyOffset + 2 + len(msg.Handshake)
+	case flags&flagResume > 0:
+		msg.Resume = true
+		end = keyOffset + TicketSize + 32
+		if len(data) < end {
+			return ErrInvalidMessage
+		}
+		copy(msg.Ticket[:], data[keyOffset:keyOffset+TicketSize])
+		copy(msg.DHPubKey[:], data[keyOffset+TicketSize:end])
+	case flags&(flagSizedKey|flagOAEP) > 0:
+		msg.OAEP = flags&flagOAEP > 0
+		msg.EncDHPubKey, err = parseHandshake(data[keyOffset:])
+		if err != nil {
+			return err
+		}
+		end = keyOffset + 2 + len(msg.EncDHPubKey)
+	default:
+		if len(data) < end {
+			return ErrInvalidMessage
+		}
+
+		// must make a copy!
+		msg.EncDHPubKey = make([]byte, EncDHPubKeySize)
+		copy(msg.EncDHPubKey, data[keyOffset:end])
+	}
+
+	if flags&flagNegotiate > 0 {
+		if len(data) < end+2 {
+			return ErrInvalidMessage
+		}
+		msg.Versions = VersionSet(data[end])
+		msg.Capabilities = Capabilities(data[end+1])
+		end += 2
+
+		if msg.Capabilities&CapabilityTimestamp > 0 {
+			if len(data) < end+4 {
+				return ErrInvalidMessage
+			}
+			msg.Timestamp = binary.BigEndian.Uint32(data[end : end+4])
+			end += 4
+		}
 
+		if msg.Capabilities&CapabilityCipherSuites > 0 {
+			if len(data) < end+1 {
+				return ErrInvalidMessage
+			}
+			msg.CipherSuites = CipherSuiteSet(data[end])
+			end++
+		}
+	}
+
+	// relay messages have an exact size, thus any further bytes are garbage
+	if len(data) != end {
+		return ErrInvalidMessage
+	}
 	return nil
 }
 
 // PackedSize returns the number of bytes required if serialized to bytes.
 func (msg *RelayTunnelExtend) PackedSize() (n int) {
-	n = 2 + 2 + 4 + len(msg.EncDHPubKey)
+	switch {
+	case len(msg.Handshake) > 0:
+		n = 2 + 2 + 4 + 2 + len(msg.Handshake)
+	case msg.Resume:
+		n = 2 + 2 + 4 + TicketSize + 32
+	case msg.SizedKey():
+		n = 2 + 2 + 4 + 2 + len(msg.EncDHPubKey)
+	default:
+		n = 2 + 2 + 4 + EncDHPubKeySize
+	}
 	if msg.IPv6 {
 		n += 12
 	}
+	if msg.Versions != 0 {
+		n += 2
+		if msg.Capabilities&CapabilityTimestamp > 0 {
+			n += 4
+		}
+		if msg.Capabilities&CapabilityCipherSuites > 0 {
+			n++
+		}
+	}
 	return n
 }
 
@@ -287,6 +465,9 @@ func (msg *RelayTunnelExtend) Pack(buf []byte) (n int, err error) {
 	binary.BigEndian.PutUint16(buf[2:4], msg.Port)
 
 	flags := byte(0x00)
+	if msg.WantLoad {
+		flags |= flagLoad
+	}
 	addr := msg.Address
 	keyOffset := 8
 	if msg.IPv6 {
@@ -301,17 +482,74 @@ func (msg *RelayTunnelExtend) Pack(buf []byte) (n int, err error) {
 		buf[6] = addr[1]
 		buf[7] = addr[0]
 	}
-	buf[1] = flags
 
-	copy(buf[keyOffset:], msg.EncDHPubKey[:])
+	if msg.Versions != 0 {
+		flags |= flagNegotiate
+		end := n
+		if msg.Capabilities&CapabilityCipherSuites > 0 {
+			end--
+			buf[end] = byte(msg.CipherSuites)
+		}
+		if msg.Capabilities&CapabilityTimestamp > 0 {
+			end -= 4
+			binary.BigEndian.PutUint32(buf[end:end+4], msg.Timestamp)
+		}
+		buf[end-2] = byte(msg.Versions)
+		buf[end-1] = byte(msg.Capabilities)
+	}
+
+	if len(msg.Handshake) > 0 {
+		buf[1] = flags | flagAuthHandshake
+		err = packHandshake(buf[keyOffset:], msg.Handshake)
+		return n, err
+	}
+
+	if msg.Resume {
+		buf[1] = flags | flagResume
+		copy(buf[keyOffset:keyOffset+TicketSize], msg.Ticket[:])
+		copy(buf[keyOffset+TicketSize:keyOffset+TicketSize+32], msg.DHPubKey[:])
+		return n, nil
+	}
+
+	if msg.SizedKey() {
+		buf[1] = flags | flagSizedKey
+		if msg.OAEP {
+			buf[1] = flags | flagOAEP
+		}
+		err = packHandshake(buf[keyOffset:], msg.EncDHPubKey)
+		return n, err
+	}
+
+	buf[1] = flags
+	copy(buf[keyOffset:keyOffset+EncDHPubKeySize], msg.EncDHPubKey)
 
 	return n, nil
 }
 
+// SizedKey returns whether the encrypted key is prefixed by its size, i.e. whether it is encrypted with RSA-OAEP or
+// not of EncDHPubKeySize.
+func (msg *RelayTunnelExtend) SizedKey() bool {
+	return len(msg.Handshake) == 0 && !msg.Resume && (msg.OAEP || len(msg.EncDHPubKey) != EncDHPubKeySize)
+}
+
 // RelayTunnelExtended is used to relay the created message from the next hop back to the original sender of the TUNNEL EXTEND message.
+// The handshake payload of the Onion Auth module, if any, follows the then unused Diffie-Hellman fields.
+// If the next hop negotiated the version, the handshake size is always present and the flags, version and capabilities of
+// the TunnelCreated follow the handshake, as well as the picked cipher suite if any and the load of the next hop if
+// the initiator asked for it, see RelayTunnelExtend. Since relay messages have an exact size, both layouts are
+// distinguished by it.
 type RelayTunnelExtended struct {
 	DHPubKey      [32]byte // encrypted pub key of next peer
 	SharedKeyHash [32]byte
+	Handshake     []byte // handshake payload of the Onion Auth module
+
+	Retry        bool
+	Ticket       bool  // whether the session may be resumed, see TunnelCreated
+	Version      uint8 // 0 if the initiator did not negotiate
+	Capabilities Capabilities
+	CipherSuite  CipherSuite // only valid if HasCipherSuite
+	HasLoad      bool        // whether the next hop announced its load, only valid if Version is set
+	Load         Load        // only valid if HasLoad
 }
 
 // Type returns the relay type of the message.
@@ -329,12 +567,77 @@ func (msg *RelayTunnelExtended) Parse(data []byte) (err error) {
 	copy(msg.DHPubKey[:], data[:32])
 	copy(msg.SharedKeyHash[:], data[32:64])
 
-	return
+	if len(data) == size {
+		return nil
+	}
+	if len(data) < size+2 {
+		return ErrInvalidMessage
+	}
+
+	handshakeSize := int(binary.BigEndian.Uint16(data[size : size+2]))
+	end := size + 2 + handshakeSize
+	if trailer := len(data) - end; trailer >= 3 && trailer <= 5 {
+		// negotiated version
+		if handshakeSize > 0 {
+			msg.Handshake, err = parseHandshake(data[size:end])
+			if err != nil {
+				return err
+			}
+		}
+		msg.Retry = data[end]&flagRetry > 0
+		msg.Ticket = data[end]&flagTicket > 0
+		msg.Version = data[end+1]
+		msg.Capabilities = Capabilities(data[end+2])
+		msg.HasLoad = !msg.Retry && data[end]&flagLoad > 0
+		expected := 3
+		if msg.HasCipherSuite() {
+			expected++
+		}
+		if msg.HasLoad {
+			expected++
+		}
+		if trailer != expected {
+			return ErrInvalidMessage
+		}
+		if msg.HasCipherSuite() {
+			msg.CipherSuite = CipherSuite(data[end+3])
+		}
+		if msg.HasLoad {
+			msg.Load = Load(data[len(data)-1])
+		}
+		return nil
+	}
+
+	msg.Handshake, err = parseHandshake(data[size:])
+	if err != nil {
+		return err
+	}
+	if len(data) != size+2+len(msg.Handshake) {
+		return ErrInvalidMessage
+	}
+	return nil
+}
+
+// HasCipherSuite returns whether the message contains the cipher suite picked by the next hop, see TunnelCreated.
+func (msg *RelayTunnelExtended) HasCipherSuite() bool {
+	return !msg.Retry && msg.Version != 0 && msg.Capabilities&CapabilityCipherSuites > 0
 }
 
 // PackedSize returns the number of bytes required if serialized to bytes.
 func (msg *RelayTunnelExtended) PackedSize() (n int) {
 	n = 32 + 32
+	if len(msg.Handshake) > 0 || msg.Version != 0 {
+		n += 2 + len(msg.Handshake)
+	}
+	if msg.Version != 0 {
+		n += 3
+	}
+	if msg.HasCipherSuite() {
+		n++
+	}
+	if msg.Version != 0 && msg.HasLoad && !msg.Retry {
+		n++
+	}
 	return
 }
 
@@ -347,14 +650,44 @@ func (msg *RelayTunnelExtended) Pack(buf []byte) (n int, err error) {
 	buf = buf[:n]
 
 	copy(buf[:32], msg.DHPubKey[:])
-	copy(buf[32:], msg.SharedKeyHash[:])
+	copy(buf[32:64], msg.SharedKeyHash[:])
 
-	return n, nil
+	if len(msg.Handshake) > 0 {
+		err = packHandshake(buf[64:], msg.Handshake)
+	} else if msg.Version != 0 {
+		binary.BigEndian.PutUint16(buf[64:66], 0)
+	}
+
+	if msg.Version != 0 {
+		end := n
+		hasLoad := msg.HasLoad && !msg.Retry
+		if hasLoad {
+			end--
+			buf[end] = byte(msg.Load)
+		}
+		if msg.HasCipherSuite() {
+			end--
+			buf[end] = byte(msg.CipherSuite)
+		}
+		buf[end-3] = 0x00 // flags
+		if msg.Retry {
+			buf[end-3] = flagRetry
+		}
+		if msg.Ticket {
+			buf[end-3] |= flagTicket
+		}
+		if hasLoad {
+			buf[end-3] |= flagLoad
+		}
+		buf[end-2] = msg.Version
+		buf[end-1] = byte(msg.Capabilities)
+	}
+	return n, err
 }
 
 // RelayTunnelData is application payload we receive.
 type RelayTunnelData struct {
-	Data []byte
+	Data []byte `wire:"bytes"`
 }
 
 // Type returns the relay type of the message.
@@ -362,31 +695,6 @@ func (msg *RelayTunnelData) Type() RelayType {
 	return RelayTypeTunnelData
 }
 
-// Parse fills the struct with values parsed from the given bytes slice.
-func (msg *RelayTunnelData) Parse(data []byte) (err error) {
-	msg.Data = make([]byte, len(data))
-	copy(msg.Data, data)
-	return
-}
-
-// PackedSize returns the number of bytes required if serialized to bytes.
-func (msg *RelayTunnelData) PackedSize() (n int) {
-	n = len(msg.Data)
-	return
-}
-
-// Pack serializes the values into a bytes slice.
-func (msg *RelayTunnelData) Pack(buf []byte) (n int, err error) {
-	if len(buf) < len(msg.Data) {
-		err = ErrBufferTooSmall
-		return
-	}
-
-	copy(buf[:len(msg.Data)], msg.Data)
-	n = len(msg.Data)
-	return
-}
-
 type RelayTunnelCover struct {
 	Ping bool
 }
@@ -398,6 +706,9 @@ func (msg *RelayTunnelCover) Type() RelayType {
 
 // Parse fills the struct with values parsed from the given bytes slice.
 func (msg *RelayTunnelCover) Parse(data []byte) (err error) {
+	if len(data) != 1 {
+		return ErrInvalidMessage
+	}
 	msg.Ping = data[0]&flagCoverPing > 0
 	return
 }
@@ -420,3 +731,372 @@ func (msg *RelayTunnelCover) Pack(buf []byte) (n int, err error) {
 	}
 	return 1, nil
 }
+
+// RelayTunnelBegin instructs the last hop of a tunnel to open a TCP connection to the given address and port
+// on behalf of the tunnel initiator, if it acts as an exit.
+type RelayTunnelBegin struct {
+	IPv6    bool
+	Port    uint16
+	Address net.IP
+}
+
+// Type returns the relay type of the message.
+func (msg *RelayTunnelBegin) Type() RelayType {
+	return RelayTypeTunnelBegin
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *RelayTunnelBegin) Parse(data []byte) (err error) {
+	const minSize = 2 + 2 + 4
+	if len(data) < minSize {
+		return ErrInvalidMessage
+	}
+
+	msg.IPv6 = data[1]&flagIPv6 > 0
+	msg.Port = binary.BigEndian.Uint16(data[2:4])
+
+	// read IP address (either 4 bytes if IPv4 or 16 bytes if IPv6)
+	if msg.IPv6 {
+		if len(data) != 20 {
+			return ErrInvalidMessage
+		}
+		msg.Address = api.ReadIP(true, data[4:20])
+	} else {
+		if len(data) != minSize {
+			return ErrInvalidMessage
+		}
+		msg.Address = api.ReadIP(false, data[4:8])
+	}
+
+	return nil
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *RelayTunnelBegin) PackedSize() (n int) {
+	n = 2 + 2 + 4
+	if msg.IPv6 {
+		n += 12
+	}
+	return n
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *RelayTunnelBegin) Pack(buf []byte) (n int, err error) {
+	n = msg.PackedSize()
+	if cap(buf) < n {
+		return -1, ErrBufferTooSmall
+	}
+	buf = buf[0:n]
+
+	buf[0] = 0x00 // reserved
+	binary.BigEndian.PutUint16(buf[2:4], msg.Port)
+
+	flags := byte(0x00)
+	addr := msg.Address
+	if msg.IPv6 {
+		flags |= flagIPv6
+		for i := 0; i < 16; i++ {
+			buf[4+i] = addr[15-i]
+		}
+	} else {
+		addr = addr.To4()
+		buf[4] = addr[3]
+		buf[5] = addr[2]
+		buf[6] = addr[1]
+		buf[7] = addr[0]
+	}
+	buf[1] = flags
+
+	return n, nil
+}
+
+// EndReason specifies why an exit connection was closed or could not be opened.
+type EndReason uint8
+
+const (
+	EndReasonDone          EndReason = 0 // the connection was closed regularly
+	EndReasonExitPolicy    EndReason = 1 // the destination is not allowed by the exit policy or the hop is no exit
+	EndReasonConnectFailed EndReason = 2 // the connection to the destination could not be opened
+	EndReasonAlreadyOpen   EndReason = 3 // there already is an open exit connection on this tunnel
+)
+
+// RelayTunnelEnd closes the exit connection of a tunnel or reports that it could not be opened.
+// It can be sent by both the tunnel initiator and the exit.
+type RelayTunnelEnd struct {
+	Reason EndReason `wire:"uint8"`
+}
+
+// Type returns the relay type of the message.
+func (msg *RelayTunnelEnd) Type() RelayType {
+	return RelayTypeTunnelEnd
+}
+
+// RelayTunnelConnected is sent by the exit after successfully opening the connection requested by RelayTunnelBegin.
+// Afterwards, RelayTunnelData messages are passed from and to this connection.
+type RelayTunnelConnected struct{}
+
+// Type returns the relay type of the message.
+func (msg *RelayTunnelConnected) Type() RelayType {
+	return RelayTypeTunnelConnected
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *RelayTunnelConnected) Parse(data []byte) (err error) {
+	if len(data) != 0 {
+		return ErrInvalidMessage
+	}
+	return nil
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *RelayTunnelConnected) PackedSize() (n int) {
+	return 0
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *RelayTunnelConnected) Pack(buf []byte) (n int, err error) {
+	return 0, nil
+}
+
+// RelayTunnelDatagram is application payload with datagram semantics.
+// In contrast to RelayTunnelData, datagrams may be dropped if the sender can not keep up, instead of delaying
+// subsequent payload.
+type RelayTunnelDatagram struct {
+	Data []byte `wire:"bytes"`
+}
+
+// Type returns the relay type of the message.
+func (msg *RelayTunnelDatagram) Type() RelayType {
+	return RelayTypeTunnelDatagram
+}
+
+// RelayTunnelDestroy tears down a tunnel. In contrast to TunnelDestroy, which is only accepted from adjacent hops,
+// it is authenticated end-to-end: The tunnel initiator sends it to every hop of the tunnel and a hop tearing down its
+// tunnel segment sends it to the initiator.
+type RelayTunnelDestroy struct{}
+
+// Type returns the relay type of the message.
+func (msg *RelayTunnelDestroy) Type() RelayType {
+	return RelayTypeTunnelDestroy
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *RelayTunnelDestroy) Parse(data []byte) (err error) {
+	if len(data) != 0 {
+		return ErrInvalidMessage
+	}
+	return nil
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *RelayTunnelDestroy) PackedSize() (n int) {
+	return 0
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *RelayTunnelDestroy) Pack(buf []byte) (n int, err error) {
+	return 0, nil
+}
+
+// RelayTunnelEOF signals that the sender finished sending data through the tunnel. The tunnel stays open for data in
+// the other direction until it is destroyed.
+type RelayTunnelEOF struct{}
+
+// Type returns the relay type of the message.
+func (msg *RelayTunnelEOF) Type() RelayType {
+	return RelayTypeTunnelEOF
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *RelayTunnelEOF) Parse(data []byte) (err error) {
+	if len(data) != 0 {
+		return ErrInvalidMessage
+	}
+	return nil
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *RelayTunnelEOF) PackedSize() (n int) {
+	return 0
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *RelayTunnelEOF) Pack(buf []byte) (n int, err error) {
+	return 0, nil
+}
+
+// RelayTunnelSeqData is application payload with an end-to-end sequence number, which allows the receiver to detect
+// duplicates when unacknowledged payload is sent again after the tunnel was rebuilt with new intermediate hops.
+// The stream ID identifies the data stream across rebuilt tunnels.
+type RelayTunnelSeqData struct {
+	Stream uint64 `wire:"uint64"`
+	Seq    uint32 `wire:"uint32"`
+	Data   []byte `wire:"bytes"`
+}
+
+// Type returns the relay type of the message.
+func (msg *RelayTunnelSeqData) Type() RelayType {
+	return RelayTypeTunnelSeqData
+}
+
+// RelayTunnelAck acknowledges all RelayTunnelSeqData of a stream with a sequence number lower than Seq, which the
+// sender can then stop buffering for retransmission.
+type RelayTunnelAck struct {
+	Stream uint64 `wire:"uint64"`
+	Seq    uint32 `wire:"uint32"`
+}
+
+// Type returns the relay type of the message.
+func (msg *RelayTunnelAck) Type() RelayType {
+	return RelayTypeTunnelAck
+}
+
+// MigrateStep specifies the step of a tunnel handover a RelayTunnelMigrate belongs to.
+type MigrateStep uint8
+
+const (
+	MigrateNew  MigrateStep = 1 // first message of the initiator on the rebuilt circuit
+	MigrateOld  MigrateStep = 2 // last message of the initiator on the old circuit
+	MigrateDone MigrateStep = 3 // last message of the receiver on the old circuit, which can be torn down now
+)
+
+// RelayTunnelMigrate is exchanged by both ends of a tunnel when the initiator hands the tunnel over from its old
+// circuit to a rebuilt one. The token pairs the old and the new circuit.
+type RelayTunnelMigrate struct {
+	Token uint64      `wire:"uint64"`
+	Step  MigrateStep `wire:"uint8"`
+}
+
+// Type returns the relay type of the message.
+func (msg *RelayTunnelMigrate) Type() RelayType {
+	return RelayTypeTunnelMigrate
+}
+
+// RelayTunnelOpened is sent by the initiator to the last hop once the tunnel is built, such that the last hop
+// announces the tunnel right away instead of along with the first data. Either end may then speak first.
+type RelayTunnelOpened struct{}
+
+// Type returns the relay type of the message.
+func (msg *RelayTunnelOpened) Type() RelayType {
+	return RelayTypeTunnelOpened
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *RelayTunnelOpened) Parse(data []byte) (err error) {
+	if len(data) != 0 {
+		return ErrInvalidMessage
+	}
+	return nil
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *RelayTunnelOpened) PackedSize() (n int) {
+	return 0
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *RelayTunnelOpened) Pack(buf []byte) (n int, err error) {
+	return 0, nil
+}
+
+// RelayTunnelJoin is sent by the initiator as the first message on each circuit of a multipath tunnel. The last hop
+// joins all circuits presenting the same stream ID into a single tunnel, across which the RelayTunnelSeqData of the
+// stream are striped and reassembled by their sequence numbers.
+type RelayTunnelJoin struct {
+	Stream uint64 `wire:"uint64"`
+}
+
+// Type returns the relay type of the message.
+func (msg *RelayTunnelJoin) Type() RelayType {
+	return RelayTypeTunnelJoin
+}
+
+// RelayTunnelBatch is application payload of several small messages packed into a single relay message, which are
+// delivered separately. Each payload is prefixed by its length as 16-bit integer.
+type RelayTunnelBatch struct {
+	Payloads [][]byte
+}
+
+// Type returns the relay type of the message.
+func (msg *RelayTunnelBatch) Type() RelayType {
+	return RelayTypeTunnelBatch
+}
+
+// Parse fills the struct with values parsed from the given bytes slice.
+func (msg *RelayTunnelBatch) Parse(data []byte) (err error) {
+	if len(data) == 0 {
+		return ErrInvalidMessage
+	}
+
+	msg.Payloads = msg.Payloads[:0]
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return ErrInvalidMessage
+		}
+		size := int(binary.BigEndian.Uint16(data[0:2]))
+		if len(data) < 2+size {
+			return ErrInvalidMessage
+		}
+		payload := make([]byte, size)
+		copy(payload, data[2:2+size])
+		msg.Payloads = append(msg.Payloads, payload)
+		data = data[2+size:]
+	}
+	return nil
+}
+
+// PackedSize returns the number of bytes required if serialized to bytes.
+func (msg *RelayTunnelBatch) PackedSize() (n int) {
+	for _, payload := range msg.Payloads {
+		n += 2 + len(payload)
+	}
+	return n
+}
+
+// Pack serializes the values into a bytes slice.
+func (msg *RelayTunnelBatch) Pack(buf []byte) (n int, err error) {
+	if len(buf) < msg.PackedSize() {
+		return -1, ErrBufferTooSmall
+	}
+
+	for _, payload := range msg.Payloads {
+		binary.BigEndian.PutUint16(buf[n:n+2], uint16(len(payload)))
+		n += 2
+		n += copy(buf[n:], payload)
+	}
+	return n, nil
+}
+
+// ErrorReason specifies why a hop refused a request of the tunnel initiator.
+type ErrorReason uint8
+
+const (
+	ErrorReasonExtendToSelf ErrorReason = 1 // the hop was asked to extend the tunnel to itself
+	ErrorReasonExtendLoop   ErrorReason = 2 // the hop was asked to extend the tunnel back over the link it came from
+	ErrorReasonQuota        ErrorReason = 3 // the tunnel exceeded the cell rate or the bytes the hop relays per tunnel
+)
+
+// String returns a description of the reason.
+func (reason ErrorReason) String() string {
+	switch reason {
+	case ErrorReasonExtendToSelf:
+		return "extend to self"
+	case ErrorReasonExtendLoop:
+		return "extend loop"
+	case ErrorReasonQuota:
+		return "quota exceeded"
+	default:
+		return "unknown"
+	}
+}
+
+// RelayTunnelError is sent by a hop to the tunnel initiator instead of the expected reply if it refuses a request,
+// e.g. a RelayTunnelExtend creating a loop, or drops the tunnel. The hop tears down its tunnel segment afterwards.
+type RelayTunnelError struct {
+	Reason ErrorReason `wire:"uint8"`
+}
+
+// Type returns the relay type of the message.
+func (msg *RelayTunnelError) Type() RelayType {
+	return RelayTypeTunnelError
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"log"
+	mathRand "math/rand"
 	"net"
 	"testing"
 
@@ -16,6 +17,18 @@ var (
 	_ RelayMessage = &RelayTunnelExtend{}
 	_ RelayMessage = &RelayTunnelExtended{}
 	_ RelayMessage = &RelayTunnelData{}
+	_ RelayMessage = &RelayTunnelBegin{}
+	_ RelayMessage = &RelayTunnelEnd{}
+	_ RelayMessage = &RelayTunnelConnected{}
+	_ RelayMessage = &RelayTunnelDestroy{}
+	_ RelayMessage = &RelayTunnelEOF{}
+	_ RelayMessage = &RelayTunnelSeqData{}
+	_ RelayMessage = &RelayTunnelAck{}
+	_ RelayMessage = &RelayTunnelMigrate{}
+	_ RelayMessage = &RelayTunnelOpened{}
+	_ RelayMessage = &RelayTunnelJoin{}
+	_ RelayMessage = &RelayTunnelError{}
+	_ RelayMessage = &RelayTunnelBatch{}
 	// TODO: _ RelayMessage = &RelayTunnelCover{}
 )
 
@@ -98,6 +111,31 @@ func TestRelayHeaderPack(t *testing.T) {
 	assert.Equal(t, in, out)
 }
 
+func TestRelayHeaderBody(t *testing.T) {
+	msg := make([]byte, RelayMessageSize)
+	for _, tc := range []struct {
+		size  uint16
+		valid bool
+	}{
+		{RelayHeaderSize, true},
+		{RelayHeaderSize + 8, true},
+		{RelayMessageSize, true},
+		{0, false},
+		{RelayHeaderSize - 1, false},
+		{RelayMessageSize + 1, false},
+		{0xffff, false},
+	} {
+		hdr := RelayHeader{Size: tc.size}
+		body, err := hdr.Body(msg)
+		if !tc.valid {
+			assert.Equal(t, ErrInvalidMessage, err, "size %d", tc.size)
+			continue
+		}
+		require.Nil(t, err, "size %d", tc.size)
+		assert.Len(t, body, int(tc.size)-RelayHeaderSize)
+	}
+}
+
 func TestRelayHeaderComputeDigest(t *testing.T) {
 	payload := []byte("asdf1234")
 	relayHdr := RelayHeader{
@@ -106,20 +144,72 @@ func TestRelayHeaderComputeDigest(t *testing.T) {
 		Counter:   [3]byte{0x00, 0x00, 0x01},
 	}
 
-	err := relayHdr.ComputeDigest(payload)
+	key := [32]byte{1, 2, 3}
+	sendDigest, _ := NewRelayDigests(&key)
+	recvDigest, _ := NewRelayDigests(&key) // the other end's copy
+
+	err := relayHdr.ComputeDigest(payload, sendDigest)
+	require.Nil(t, err)
+	assert.True(t, relayHdr.Recognized())
+	assert.NotEqual(t, [8]byte{}, relayHdr.Digest)
+	first := relayHdr
+
+	// the same message has another digest after the first one
+	err = relayHdr.ComputeDigest(payload, sendDigest)
 	require.Nil(t, err)
+	second := relayHdr
+	assert.NotEqual(t, first.Digest, second.Digest)
+
+	// the digest is keyed with the session key of the hop
+	otherDigest, _ := NewRelayDigests(&[32]byte{4, 5, 6})
+	assert.False(t, first.CheckDigest(payload, otherDigest))
+
+	// the digest covers the header and the body
+	assert.False(t, first.CheckDigest([]byte("asdf1235"), recvDigest))
+	tampered := first
+	tampered.RelayType = RelayTypeTunnelCover
+	assert.False(t, tampered.CheckDigest(payload, recvDigest))
+
+	// messages without the zero marker are not digested at all
+	unrecognized := first
+	unrecognized.Digest[1] = 0x01
+	assert.False(t, unrecognized.Recognized())
+	assert.False(t, unrecognized.CheckDigest(payload, recvDigest))
+
+	// the digest binds the order of the messages, failed checks do not advance the running digest
+	assert.False(t, second.CheckDigest(payload, recvDigest))
+	assert.True(t, first.CheckDigest(payload, recvDigest))
+	assert.False(t, first.CheckDigest(payload, recvDigest)) // replayed
+	assert.True(t, second.CheckDigest(payload, recvDigest))
+}
+
+func TestNewRelayDigests(t *testing.T) {
+	payload := []byte("asdf1234")
+	relayHdr := RelayHeader{
+		Size:      RelayHeaderSize + uint16(len(payload)),
+		RelayType: RelayTypeTunnelData,
+	}
+	key := [32]byte{1, 2, 3}
 
-	// TODO: how to do proper testing here
+	// both directions are seeded differently
+	forward, backward := NewRelayDigests(&key)
+	require.Nil(t, relayHdr.ComputeDigest(payload, forward))
+	assert.False(t, relayHdr.CheckDigest(payload, backward))
+
+	// the seeds only depend on the key
+	forward, _ = NewRelayDigests(&key)
+	assert.True(t, relayHdr.CheckDigest(payload, forward))
 }
 
 func TestPackRelayMessage(t *testing.T) {
 	const oldCounter = 42
+	digest, _ := NewRelayDigests(&[32]byte{1, 2, 3})
 
 	t.Run("valid", func(t *testing.T) {
 		var buf [RelayMessageSize]byte
 		msg := new(RelayTunnelData)
 
-		ctr, n, err := PackRelayMessage(buf[:], oldCounter, msg)
+		ctr, n, err := PackRelayMessage(buf[:], oldCounter, msg, digest)
 		require.Nil(t, err)
 		require.Equal(t, RelayMessageSize, n)
 		require.Greater(t, ctr, uint32(oldCounter))
@@ -140,20 +230,64 @@ func TestPackRelayMessage(t *testing.T) {
 			PackErr:            packErr,
 		}
 
-		_, _, err := PackRelayMessage(buf[:42], oldCounter, msg)
+		_, _, err := PackRelayMessage(buf[:42], oldCounter, msg, digest)
 		require.Equal(t, ErrBufferTooSmall, err)
 
-		_, _, err = PackRelayMessage(buf[:], oldCounter, msg)
+		_, _, err = PackRelayMessage(buf[:], oldCounter, msg, digest)
 		require.Equal(t, packErr, err)
 
 		msg.PackErr = nil
 
-		_, _, err = PackRelayMessage(buf[:], oldCounter, msg)
+		_, _, err = PackRelayMessage(buf[:], oldCounter, msg, digest)
 		require.Equal(t, ErrInvalidMessage, err)
 
-		_, _, err = PackRelayMessage(buf[:], oldCounter, nil)
+		_, _, err = PackRelayMessage(buf[:], oldCounter, nil, digest)
 		require.Equal(t, ErrInvalidMessage, err)
 	})
+
+	t.Run("deterministic", func(t *testing.T) {
+		var buf1, buf2 [RelayMessageSize]byte
+		msg := &RelayTunnelData{Data: []byte("asdf")}
+		digest1, _ := NewRelayDigests(&[32]byte{1, 2, 3})
+		digest2, _ := NewRelayDigests(&[32]byte{1, 2, 3})
+
+		ctr1, _, err := Packer{Rand: mathRand.New(mathRand.NewSource(1))}.PackRelayMessage(buf1[:], oldCounter, msg,
+			digest1)
+		require.Nil(t, err)
+		ctr2, _, err := Packer{Rand: mathRand.New(mathRand.NewSource(1))}.PackRelayMessage(buf2[:], oldCounter, msg,
+			digest2)
+		require.Nil(t, err)
+		assert.Equal(t, ctr1, ctr2)
+		assert.Equal(t, buf1, buf2)
+		assert.True(t, ctr1 > oldCounter && ctr1 < oldCounter+64)
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		var buf1, buf2 [RelayMessageSize]byte
+		msg := new(RelayTunnelData)
+
+		// the counter never wraps around
+		ctr := uint32(MaxRelayCounter - 63)
+		var err error
+		for err == nil {
+			ctr, _, err = PackRelayMessage(buf1[:], ctr, msg, digest)
+			require.LessOrEqual(t, ctr, uint32(MaxRelayCounter))
+		}
+		assert.Equal(t, ErrCounterExhausted, err)
+
+		// nor is the digest advanced
+		digest1, _ := NewRelayDigests(&[32]byte{1, 2, 3})
+		digest2, _ := NewRelayDigests(&[32]byte{1, 2, 3})
+		ctr, _, err = PackRelayMessage(buf1[:], MaxRelayCounter, msg, digest1)
+		assert.Equal(t, ErrCounterExhausted, err)
+		assert.Equal(t, uint32(MaxRelayCounter), ctr)
+
+		_, _, err = Packer{Rand: mathRand.New(mathRand.NewSource(1))}.PackRelayMessage(buf1[:], 0, msg, digest1)
+		require.Nil(t, err)
+		_, _, err = Packer{Rand: mathRand.New(mathRand.NewSource(1))}.PackRelayMessage(buf2[:], 0, msg, digest2)
+		require.Nil(t, err)
+		assert.Equal(t, buf1, buf2)
+	})
 }
 
 func TestRelayEncryptDecrypt(t *testing.T) {
@@ -172,7 +306,9 @@ func TestRelayEncryptDecrypt(t *testing.T) {
 	require.Nil(t, err)
 	copy(aesKey[:], k[:32])
 
-	newCounter, n, err := PackRelayMessage(buf, prevCounter, &relayData)
+	sendDigest, _ := NewRelayDigests(&aesKey)
+	recvDigest, _ := NewRelayDigests(&aesKey)
+	newCounter, n, err := PackRelayMessage(buf, prevCounter, &relayData, sendDigest)
 	require.Nil(t, err)
 	assert.Greater(t, newCounter, prevCounter)
 	assert.Equal(t, MaxRelayDataSize+RelayHeaderSize, n)
@@ -181,7 +317,7 @@ func TestRelayEncryptDecrypt(t *testing.T) {
 	encMsg, err := EncryptRelay(buf[:n], &aesKey)
 	require.Nil(t, err)
 
-	ok, decMsg, err := DecryptRelay(encMsg, &aesKey)
+	ok, decMsg, err := DecryptRelay(encMsg, &aesKey, recvDigest)
 	require.Nil(t, err)
 	require.True(t, ok)
 
@@ -197,6 +333,14 @@ func TestRelayEncryptDecrypt(t *testing.T) {
 	err = decRelayData.Parse(decMsg[RelayHeaderSize:int(relayHdr.Size)])
 	require.Nil(t, err)
 	assert.Equal(t, payload, decRelayData.Data)
+
+	// a hop the message is not meant for does not recognize it
+	otherKey := aesKey
+	otherKey[0]++
+	otherDigest, _ := NewRelayDigests(&otherKey)
+	ok, _, err = DecryptRelay(encMsg, &otherKey, otherDigest)
+	require.Nil(t, err)
+	assert.False(t, ok)
 }
 
 func TestRelayTunnelExtend(t *testing.T) {
@@ -212,7 +356,7 @@ func TestRelayTunnelExtend(t *testing.T) {
 	_, packErr := msg.Pack([]byte{})
 	assert.Equal(t, ErrBufferTooSmall, packErr)
 
-	var encKey [512]byte
+	encKey := make([]byte, EncDHPubKeySize)
 	encKey[0] = 0x11
 	encKey[511] = 0xff
 
@@ -288,6 +432,194 @@ func TestRelayTunnelExtend(t *testing.T) {
 		require.Equal(t, len(data), n)
 		assert.Equal(t, data, buf[:n])
 	})
+
+	t.Run("auth handshake", func(t *testing.T) {
+		msg := new(RelayTunnelExtend)
+
+		data := []byte{0, flagAuthHandshake, 0, 42, 1, 2, 3, 4, 0, 3, 5, 6, 7}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, RelayTunnelExtend{
+			Port:      42,
+			Address:   net.IP{4, 3, 2, 1},
+			Handshake: []byte{5, 6, 7},
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(data[:12]))
+	})
+
+	t.Run("sized key", func(t *testing.T) {
+		msg := new(RelayTunnelExtend)
+
+		data := []byte{0, flagSizedKey, 0, 42, 1, 2, 3, 4, 0, 3, 5, 6, 7}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, RelayTunnelExtend{
+			Port:        42,
+			Address:     net.IP{4, 3, 2, 1},
+			EncDHPubKey: []byte{5, 6, 7},
+		}, *msg)
+		assert.True(t, msg.SizedKey())
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(data[:12]))
+	})
+
+	t.Run("oaep", func(t *testing.T) {
+		msg := new(RelayTunnelExtend)
+
+		// keys encrypted with RSA-OAEP are prefixed by their size regardless of it
+		data := append([]byte{0, flagOAEP, 0, 42, 1, 2, 3, 4, 0x02, 0x00}, encKey...)
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, RelayTunnelExtend{
+			Port:        42,
+			Address:     net.IP{4, 3, 2, 1},
+			EncDHPubKey: encKey,
+			OAEP:        true,
+		}, *msg)
+		assert.True(t, msg.SizedKey())
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		msg := new(RelayTunnelExtend)
+
+		data := make([]byte, 8+TicketSize+32)
+		copy(data, []byte{0, flagResume, 0, 42, 1, 2, 3, 4})
+		data[8] = 0x11            // ticket start
+		data[8+TicketSize] = 0x22 // pub key start
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		expected := RelayTunnelExtend{Port: 42, Address: net.IP{4, 3, 2, 1}, Resume: true}
+		expected.Ticket[0] = 0x11
+		expected.DHPubKey[0] = 0x22
+		require.Equal(t, expected, *msg)
+		assert.False(t, msg.SizedKey())
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(data[:len(data)-1]))
+	})
+
+	t.Run("negotiation", func(t *testing.T) {
+		msg := new(RelayTunnelExtend)
+
+		data := []byte{0, flagAuthHandshake | flagNegotiate, 0, 42, 1, 2, 3, 4, 0, 1, 5, 0x03, byte(CapabilityExit)}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, RelayTunnelExtend{
+			Port:         42,
+			Address:      net.IP{4, 3, 2, 1},
+			Handshake:    []byte{5},
+			Versions:     NewVersionSet(HandshakeVersionDH, HandshakeVersionAuth),
+			Capabilities: CapabilityExit,
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+
+		// missing versions and capabilities
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(data[:12]))
+	})
+
+	t.Run("timestamp", func(t *testing.T) {
+		msg := new(RelayTunnelExtend)
+
+		data := []byte{0, flagAuthHandshake | flagNegotiate, 0, 42, 1, 2, 3, 4, 0, 1, 5, 0x01, byte(CapabilityTimestamp),
+			1, 2, 3, 4}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, RelayTunnelExtend{
+			Port:         42,
+			Address:      net.IP{4, 3, 2, 1},
+			Handshake:    []byte{5},
+			Versions:     NewVersionSet(HandshakeVersionDH),
+			Capabilities: CapabilityTimestamp,
+			Timestamp:    0x01020304,
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+
+		// missing timestamp
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(data[:13]))
+	})
+
+	t.Run("cipher suites", func(t *testing.T) {
+		msg := new(RelayTunnelExtend)
+
+		caps := CapabilityTimestamp | CapabilityCipherSuites
+		suites := NewCipherSuiteSet(CipherSuiteAESCTR, CipherSuiteAESGCM)
+		data := []byte{0, flagAuthHandshake | flagNegotiate, 0, 42, 1, 2, 3, 4, 0, 1, 5, 0x01, byte(caps),
+			1, 2, 3, 4, byte(suites)}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, RelayTunnelExtend{
+			Port:         42,
+			Address:      net.IP{4, 3, 2, 1},
+			Handshake:    []byte{5},
+			Versions:     NewVersionSet(HandshakeVersionDH),
+			Capabilities: caps,
+			Timestamp:    0x01020304,
+			CipherSuites: suites,
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+
+		// missing cipher suites
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(data[:17]))
+	})
+
+	t.Run("want load", func(t *testing.T) {
+		msg := new(RelayTunnelExtend)
+
+		data := []byte{0, flagAuthHandshake | flagLoad, 0, 42, 1, 2, 3, 4, 0, 1, 5}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, RelayTunnelExtend{
+			Port:      42,
+			Address:   net.IP{4, 3, 2, 1},
+			Handshake: []byte{5},
+			WantLoad:  true,
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+	})
 }
 
 func TestRelayTunnelExtended(t *testing.T) {
@@ -329,6 +661,176 @@ func TestRelayTunnelExtended(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, len(data), n)
 	assert.Equal(t, data, buf[:n])
+
+	t.Run("auth handshake", func(t *testing.T) {
+		msg := new(RelayTunnelExtended)
+
+		data := make([]byte, 64+2+2)
+		data[65] = 2 // handshake size
+		data[66] = 1
+		data[67] = 2
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, RelayTunnelExtended{Handshake: []byte{1, 2}}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(data[:67]))
+	})
+
+	t.Run("negotiated", func(t *testing.T) {
+		msg := new(RelayTunnelExtended)
+
+		data := make([]byte, 64+2+3)
+		data[0] = pubKey[0]
+		data[67] = HandshakeVersionDH
+		data[68] = byte(CapabilityExit)
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, RelayTunnelExtended{
+			DHPubKey:     [32]byte{0x11},
+			Version:      HandshakeVersionDH,
+			Capabilities: CapabilityExit,
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+	})
+
+	t.Run("cipher suite", func(t *testing.T) {
+		msg := new(RelayTunnelExtended)
+
+		data := make([]byte, 64+2+3+1)
+		data[0] = pubKey[0]
+		data[67] = HandshakeVersionDH
+		data[68] = byte(CapabilityCipherSuites)
+		data[69] = byte(CipherSuiteAESGCM)
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, RelayTunnelExtended{
+			DHPubKey:     [32]byte{0x11},
+			Version:      HandshakeVersionDH,
+			Capabilities: CapabilityCipherSuites,
+			CipherSuite:  CipherSuiteAESGCM,
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+
+		// the size must match the capabilities
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(data[:69]))
+	})
+
+	t.Run("load", func(t *testing.T) {
+		msg := new(RelayTunnelExtended)
+
+		data := make([]byte, 64+2+3+2)
+		data[0] = pubKey[0]
+		data[66] = flagLoad
+		data[67] = HandshakeVersionDH
+		data[68] = byte(CapabilityCipherSuites)
+		data[69] = byte(CipherSuiteAESGCM)
+		data[70] = 0x21
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, RelayTunnelExtended{
+			DHPubKey:     [32]byte{0x11},
+			Version:      HandshakeVersionDH,
+			Capabilities: CapabilityCipherSuites,
+			CipherSuite:  CipherSuiteAESGCM,
+			HasLoad:      true,
+			Load:         NewLoad(2, 1),
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+
+		// the size must match the flags
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(data[:70]))
+		data[66] = 0
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(data))
+
+		// retries do not contain the load
+		msg = &RelayTunnelExtended{Retry: true, Version: HandshakeVersionDH, HasLoad: true, Load: 0x21}
+		n, err = msg.Pack(buf)
+		require.Nil(t, err)
+		assert.Equal(t, 64+2+3, n)
+	})
+
+	t.Run("negotiated auth handshake", func(t *testing.T) {
+		msg := new(RelayTunnelExtended)
+
+		data := make([]byte, 64+2+1+3)
+		data[65] = 1 // handshake size
+		data[66] = 7
+		data[67] = flagRetry
+		data[68] = HandshakeVersionAuth
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, RelayTunnelExtended{
+			Handshake: []byte{7},
+			Retry:     true,
+			Version:   HandshakeVersionAuth,
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+	})
+}
+
+func TestRelayTrailingBytes(t *testing.T) {
+	// relay messages have an exact size, thus any bytes following their fields are rejected
+	for _, msg := range []RelayMessage{
+		&RelayTunnelExtend{Address: net.IPv4(1, 2, 3, 4), EncDHPubKey: make([]byte, EncDHPubKeySize)},
+		&RelayTunnelExtend{Address: net.IPv4(1, 2, 3, 4), EncDHPubKey: []byte{1, 2}},
+		&RelayTunnelExtend{Address: net.IPv4(1, 2, 3, 4), Handshake: []byte{1, 2}},
+		&RelayTunnelExtend{Address: net.IPv4(1, 2, 3, 4), EncDHPubKey: make([]byte, EncDHPubKeySize),
+			Versions:     NewVersionSet(HandshakeVersionDH),
+			Capabilities: CapabilityTimestamp | CapabilityCipherSuites, CipherSuites: 1},
+		&RelayTunnelExtended{},
+		&RelayTunnelExtended{Handshake: []byte{1, 2}},
+		&RelayTunnelExtended{Version: HandshakeVersionDH, Capabilities: CapabilityCipherSuites},
+		&RelayTunnelExtended{Version: HandshakeVersionDH, HasLoad: true, Load: 0x21},
+		&RelayTunnelCover{Ping: true},
+		&RelayTunnelBegin{Port: 80, Address: net.IPv4(1, 2, 3, 4)},
+		&RelayTunnelBegin{IPv6: true, Port: 80, Address: net.IPv6loopback},
+		&RelayTunnelEnd{},
+		&RelayTunnelConnected{},
+		&RelayTunnelDestroy{},
+		&RelayTunnelEOF{},
+		&RelayTunnelAck{},
+		&RelayTunnelMigrate{},
+		&RelayTunnelOpened{},
+		&RelayTunnelJoin{},
+		&RelayTunnelBatch{Payloads: [][]byte{{1}, {2}}},
+		&RelayTunnelError{},
+	} {
+		buf := make([]byte, msg.PackedSize()+1)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, msg.PackedSize(), n)
+		require.Nil(t, msg.Parse(buf[:n]), "%T", msg)
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(buf), "%T", msg)
+	}
+
+	// a legacy extended message is either exactly the Diffie-Hellman fields or followed by a complete handshake
+	assert.Equal(t, ErrInvalidMessage, new(RelayTunnelExtended).Parse(make([]byte, 32+32+1)))
 }
 
 func TestRelayTunnelData(t *testing.T) {
@@ -366,6 +868,9 @@ func TestRelayTunnelCover(t *testing.T) {
 	// check message type
 	require.Equal(t, RelayTypeTunnelCover, msg.Type())
 
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
 	data := make([]byte, 1)
 	data[0] = 0x01
 	msg.Ping = true
@@ -387,3 +892,410 @@ func TestRelayTunnelCover(t *testing.T) {
 	assert.Equal(t, data, buf[:n])
 	assert.Equal(t, len(data), msg.PackedSize())
 }
+
+func TestRelayTunnelBegin(t *testing.T) {
+	msg := new(RelayTunnelBegin)
+
+	// check message type
+	require.Equal(t, RelayTypeTunnelBegin, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	t.Run("IPv4", func(t *testing.T) {
+		data := []byte{0x00, 0x00, 0x01, 0xbb, 4, 3, 2, 1}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.False(t, msg.IPv6)
+		require.Equal(t, uint16(443), msg.Port)
+		require.True(t, net.IPv4(1, 2, 3, 4).Equal(msg.Address))
+
+		// too small buf for packing
+		_, packErr := msg.Pack([]byte{})
+		assert.Equal(t, ErrBufferTooSmall, packErr)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		require.Equal(t, n, msg.PackedSize())
+		assert.Equal(t, data, buf[:n])
+	})
+
+	t.Run("IPv6", func(t *testing.T) {
+		data := []byte{0x00, flagIPv6, 0x00, 0x50, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.True(t, msg.IPv6)
+		require.Equal(t, uint16(80), msg.Port)
+		require.True(t, net.IPv6loopback.Equal(msg.Address))
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+
+		// IPv6 flag set, but address too short
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(data[:8]))
+	})
+}
+
+func TestRelayTunnelEnd(t *testing.T) {
+	msg := new(RelayTunnelEnd)
+
+	// check message type
+	require.Equal(t, RelayTypeTunnelEnd, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	data := []byte{byte(EndReasonConnectFailed)}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, EndReasonConnectFailed, msg.Reason)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, msg.PackedSize(), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestRelayTunnelConnected(t *testing.T) {
+	msg := new(RelayTunnelConnected)
+
+	// check message type
+	require.Equal(t, RelayTypeTunnelConnected, msg.Type())
+	require.Nil(t, msg.Parse([]byte{}))
+
+	n, err := msg.Pack([]byte{})
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+	require.Equal(t, 0, msg.PackedSize())
+}
+
+func TestRelayTunnelDestroy(t *testing.T) {
+	msg := new(RelayTunnelDestroy)
+
+	// check message type
+	require.Equal(t, RelayTypeTunnelDestroy, msg.Type())
+	require.Nil(t, msg.Parse([]byte{}))
+
+	n, err := msg.Pack([]byte{})
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+	require.Equal(t, 0, msg.PackedSize())
+}
+
+func TestRelayTunnelEOF(t *testing.T) {
+	msg := new(RelayTunnelEOF)
+
+	// check message type
+	require.Equal(t, RelayTypeTunnelEOF, msg.Type())
+	require.Nil(t, msg.Parse([]byte{}))
+
+	n, err := msg.Pack([]byte{})
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+	require.Equal(t, 0, msg.PackedSize())
+}
+
+func TestRelayTunnelOpened(t *testing.T) {
+	msg := new(RelayTunnelOpened)
+
+	// check message type
+	require.Equal(t, RelayTypeTunnelOpened, msg.Type())
+	require.Nil(t, msg.Parse([]byte{}))
+
+	n, err := msg.Pack([]byte{})
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+	require.Equal(t, 0, msg.PackedSize())
+}
+
+func TestRelayTunnelJoin(t *testing.T) {
+	msg := new(RelayTunnelJoin)
+
+	// check message type
+	require.Equal(t, RelayTypeTunnelJoin, msg.Type())
+
+	// too short data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse(make([]byte, 7)))
+
+	data := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, RelayTunnelJoin{Stream: 0x0102030405060708}, *msg)
+
+	// too small buf for packing
+	_, packErr := msg.Pack(make([]byte, 7))
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, msg.PackedSize(), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestRelayTunnelDatagram(t *testing.T) {
+	msg := new(RelayTunnelDatagram)
+
+	// check message type
+	require.Equal(t, RelayTypeTunnelDatagram, msg.Type())
+
+	data := make([]byte, 42)
+	data[0] = 0x11
+	data[41] = 0xff
+
+	msg.Data = data
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, RelayTunnelDatagram{
+		Data: data,
+	}, *msg)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, len(data), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestRelayTunnelSeqData(t *testing.T) {
+	msg := new(RelayTunnelSeqData)
+
+	// check message type
+	require.Equal(t, RelayTypeTunnelSeqData, msg.Type())
+
+	// too short data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse(make([]byte, 11)))
+
+	data := []byte{
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, // stream
+		0x00, 0x00, 0x01, 0x00, // seq
+		0x11, 0x22, 0x33, // data
+	}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, RelayTunnelSeqData{
+		Stream: 0x0102030405060708,
+		Seq:    256,
+		Data:   []byte{0x11, 0x22, 0x33},
+	}, *msg)
+
+	// too small buf for packing
+	_, packErr := msg.Pack(make([]byte, 14))
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, msg.PackedSize(), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestRelayTunnelAck(t *testing.T) {
+	msg := new(RelayTunnelAck)
+
+	// check message type
+	require.Equal(t, RelayTypeTunnelAck, msg.Type())
+
+	// too short data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse(make([]byte, 11)))
+
+	data := []byte{
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, // stream
+		0x00, 0x00, 0x01, 0x00, // seq
+	}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, RelayTunnelAck{Stream: 0x0102030405060708, Seq: 256}, *msg)
+
+	// too small buf for packing
+	_, packErr := msg.Pack(make([]byte, 11))
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, msg.PackedSize(), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestRelayTunnelMigrate(t *testing.T) {
+	msg := new(RelayTunnelMigrate)
+
+	// check message type
+	require.Equal(t, RelayTypeTunnelMigrate, msg.Type())
+
+	// too short data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse(make([]byte, 8)))
+
+	data := []byte{
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, // token
+		0x02, // step
+	}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, RelayTunnelMigrate{Token: 0x0102030405060708, Step: MigrateOld}, *msg)
+
+	// too small buf for packing
+	_, packErr := msg.Pack(make([]byte, 8))
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, msg.PackedSize(), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func BenchmarkPackRelayMessage(b *testing.B) {
+	buf := make([]byte, RelayMessageSize)
+	msg := &RelayTunnelData{Data: make([]byte, MaxRelayDataSize-1)}
+	digest, _ := NewRelayDigests(&[32]byte{1, 2, 3})
+
+	b.SetBytes(RelayMessageSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, err := PackRelayMessage(buf, 0, msg, digest)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncryptRelay(b *testing.B) {
+	buf := make([]byte, RelayMessageSize)
+	key := [32]byte{1, 2, 3}
+
+	b.SetBytes(RelayMessageSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := EncryptRelay(buf, &key)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecryptRelay(b *testing.B) {
+	key := [32]byte{1, 2, 3}
+	msg := &RelayTunnelData{Data: make([]byte, MaxRelayDataSize-1)}
+
+	// cells meant for another hop are not recognized and thus not digested
+	b.Run("forwarded", func(b *testing.B) {
+		buf := make([]byte, RelayMessageSize)
+		sendDigest, _ := NewRelayDigests(&[32]byte{4, 5, 6})
+		_, n, err := PackRelayMessage(buf, 0, msg, sendDigest)
+		require.Nil(b, err)
+		encMsg, err := EncryptRelay(buf[:n], &key)
+		require.Nil(b, err)
+		recvDigest, _ := NewRelayDigests(&key)
+
+		b.SetBytes(RelayMessageSize)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, _, err = DecryptRelay(encMsg, &key, recvDigest)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// every recognized cell advances the running digest, thus the sender packs a new one each time
+	b.Run("recognized", func(b *testing.B) {
+		buf := make([]byte, RelayMessageSize)
+		sendDigest, _ := NewRelayDigests(&key)
+		recvDigest, _ := NewRelayDigests(&key)
+
+		b.SetBytes(RelayMessageSize)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			_, n, err := PackRelayMessage(buf, 0, msg, sendDigest)
+			require.Nil(b, err)
+			encMsg, err := EncryptRelay(buf[:n], &key)
+			require.Nil(b, err)
+			b.StartTimer()
+
+			ok, _, err := DecryptRelay(encMsg, &key, recvDigest)
+			if err != nil || !ok {
+				b.Fatal("message not recognized", err)
+			}
+		}
+	})
+}
+
+func TestRelayTunnelError(t *testing.T) {
+	msg := new(RelayTunnelError)
+
+	// check message type
+	require.Equal(t, RelayTypeTunnelError, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	// too small buf for packing
+	_, packErr := msg.Pack([]byte{})
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	data := []byte{byte(ErrorReasonExtendToSelf)}
+	err := msg.Parse(data)
+	require.Nil(t, err)
+	require.Equal(t, ErrorReasonExtendToSelf, msg.Reason)
+	assert.Equal(t, "extend to self", msg.Reason.String())
+
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, msg.PackedSize(), n)
+	assert.Equal(t, data, buf[:n])
+}
+
+func TestRelayTunnelBatch(t *testing.T) {
+	msg := new(RelayTunnelBatch)
+
+	// check message type
+	require.Equal(t, RelayTypeTunnelBatch, msg.Type())
+
+	// empty data
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{}))
+
+	// truncated length and payload
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{0x00}))
+	assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{0x00, 0x03, 0x11, 0x22}))
+
+	msg.Payloads = [][]byte{{0x11, 0x22, 0x33}, {}, {0xff}}
+
+	// too small buf for packing
+	_, packErr := msg.Pack(make([]byte, 7))
+	assert.Equal(t, ErrBufferTooSmall, packErr)
+
+	data := []byte{0x00, 0x03, 0x11, 0x22, 0x33, 0x00, 0x00, 0x00, 0x01, 0xff}
+	buf := make([]byte, 4096)
+	n, err := msg.Pack(buf)
+	require.Nil(t, err)
+	require.Equal(t, msg.PackedSize(), n)
+	assert.Equal(t, data, buf[:n])
+
+	msg = new(RelayTunnelBatch)
+	err = msg.Parse(data)
+	require.Nil(t, err)
+	assert.Equal(t, RelayTunnelBatch{Payloads: [][]byte{{0x11, 0x22, 0x33}, {}, {0xff}}}, *msg)
+}
@@ -0,0 +1,281 @@
+package p2p
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"bawang/errcode"
+)
+
+var ErrUnknownCipherSuite = errcode.New(errcode.ModuleP2P, errcode.InvalidMessage, false, "unknown cipher suite")
+
+// CipherSuite identifies the primitives protecting the layer of encryption of a single hop, negotiated during the
+// handshake, see TunnelCreate. New suites can thus be rolled out without all peers switching at once.
+type CipherSuite uint8
+
+const (
+	// AES-256-CTR keyed with the session key in both directions, the messages are recognized by the running digest.
+	// Used with all hops not negotiating the suite.
+	CipherSuiteAESCTR CipherSuite = iota
+	// AES-256-GCM and ChaCha20-Poly1305 with keys derived per direction, the running digest is replaced by a truncated
+	// authentication tag covering it, see RelayCipher.
+	CipherSuiteAESGCM
+	CipherSuiteChaCha20Poly1305
+)
+
+// String returns the name of the suite.
+func (suite CipherSuite) String() string {
+	switch suite {
+	case CipherSuiteAESCTR:
+		return "aes-ctr"
+	case CipherSuiteAESGCM:
+		return "aes-gcm"
+	case CipherSuiteChaCha20Poly1305:
+		return "chacha20-poly1305"
+	default:
+		return "unknown"
+	}
+}
+
+// labels of the keys derived from the session key, see deriveRelayKey
+var relayKeyLabels = map[CipherSuite][2]string{
+	CipherSuiteAESGCM:           {"bawang relay aes-gcm forward", "bawang relay aes-gcm backward"},
+	CipherSuiteChaCha20Poly1305: {"bawang relay chacha20-poly1305 forward", "bawang relay chacha20-poly1305 backward"},
+}
+
+const (
+	digestOffset = RelayCounterSize + 1 + 2 + 1 // offset of the digest within the relay header
+	tagSize      = 8                            // size of the truncated authentication tag replacing the digest
+	aeadTagSize  = 16                           // size of the full tags of both AEAD suites
+
+	nonceSealed  = 1 // first nonce byte when sealing a message for or from the hop itself
+	nonceRelayed = 0 // first nonce byte when adding or removing the layer of a message for or from another hop
+)
+
+// CipherSuiteSet is a set of cipher suites offered by the tunnel initiator, suite s is contained if bit s is set.
+type CipherSuiteSet uint8
+
+// NewCipherSuiteSet returns the set of the given cipher suites.
+func NewCipherSuiteSet(suites ...CipherSuite) (set CipherSuiteSet) {
+	for _, suite := range suites {
+		if suite < 8 {
+			set |= 1 << suite
+		}
+	}
+	return set
+}
+
+// Contains returns whether the given cipher suite is contained in the set.
+func (set CipherSuiteSet) Contains(suite CipherSuite) bool {
+	return suite < 8 && set&(1<<suite) > 0
+}
+
+// RelayCipher adds and removes the layer of encryption of the relay messages exchanged by the tunnel initiator and a
+// single hop with the negotiated cipher suite.
+// With CipherSuiteAESCTR, see EncryptRelay and DecryptRelay. With the AEAD suites, the message is sealed by the end
+// sending it, with the counter and its running digest as additional data. The tag truncated to 8 bytes is stored in
+// place of the digest, such that the size of the messages is the same for all suites. All other layers are added and
+// removed with the key stream of the suite alone. Both are distinguished by the nonce, consisting of the counter
+// prefixed with nonceSealed or nonceRelayed.
+// The keys are copied, see Wipe.
+type RelayCipher struct {
+	suite   CipherSuite
+	sendKey [32]byte
+	recvKey [32]byte
+}
+
+// NewRelayCipher returns the cipher of the given suite for the session key shared by the tunnel initiator and a hop,
+// for the initiator's or the hop's end.
+func NewRelayCipher(suite CipherSuite, key *[32]byte, initiator bool) (c *RelayCipher, err error) {
+	c = &RelayCipher{suite: suite}
+	if suite == CipherSuiteAESCTR {
+		c.sendKey = *key
+		c.recvKey = *key
+		return c, nil
+	}
+
+	labels, ok := relayKeyLabels[suite]
+	if !ok {
+		return nil, ErrUnknownCipherSuite
+	}
+	forward, backward := deriveRelayKey(key, labels[0]), deriveRelayKey(key, labels[1])
+	if initiator {
+		c.sendKey, c.recvKey = forward, backward
+	} else {
+		c.sendKey, c.recvKey = backward, forward
+	}
+	return c, nil
+}
+
+// deriveRelayKey derives a key from the session key and the given label.
+func deriveRelayKey(key *[32]byte, label string) (derived [32]byte) {
+	kdf := hmac.New(sha256.New, key[:])
+	_, _ = kdf.Write([]byte(label))
+	copy(derived[:], kdf.Sum(nil))
+	return derived
+}
+
+// Suite returns the cipher suite of the cipher.
+func (c *RelayCipher) Suite() CipherSuite {
+	return c.suite
+}
+
+// Wipe overwrites the keys with zeros, the cipher must not be used afterwards.
+func (c *RelayCipher) Wipe() {
+	c.sendKey = [32]byte{}
+	c.recvKey = [32]byte{}
+}
+
+// Encrypt adds our layer of encryption to a relay message sent by the other end to or via another hop.
+func (c *RelayCipher) Encrypt(packedMsg []byte) (encMsg []byte, err error) {
+	if c.suite == CipherSuiteAESCTR {
+		return EncryptRelay(packedMsg, &c.sendKey)
+	}
+	return c.stream(packedMsg, &c.sendKey)
+}
+
+// Decrypt removes the layer of encryption from a relay message sent to or via another hop, without checking whether
+// the message is meant for us.
+func (c *RelayCipher) Decrypt(encMsg []byte) (msg []byte, err error) {
+	if c.suite == CipherSuiteAESCTR {
+		return DecryptRelayLayer(encMsg, &c.recvKey)
+	}
+	return c.stream(encMsg, &c.recvKey)
+}
+
+// Seal encrypts a relay message packed by us for the other end, see PackRelayMessage.
+func (c *RelayCipher) Seal(packedMsg []byte) (encMsg []byte, err error) {
+	if c.suite == CipherSuiteAESCTR {
+		return EncryptRelay(packedMsg, &c.sendKey)
+	}
+	if len(packedMsg) < RelayHeaderSize || len(packedMsg) > RelayMessageSize {
+		return nil, ErrInvalidMessage
+	}
+
+	aead, err := newRelayAEAD(c.suite, &c.sendKey)
+	if err != nil {
+		return nil, err
+	}
+
+	data := sealedData(packedMsg)
+	sealed := aead.Seal(data[:0], relayNonce(packedMsg, nonceSealed), data, relayAdditionalData(packedMsg))
+
+	encMsg = make([]byte, len(packedMsg))
+	copy(encMsg[:RelayCounterSize], packedMsg[:RelayCounterSize])
+	copy(encMsg[digestOffset:RelayHeaderSize], sealed[len(data):len(data)+tagSize])
+	setSealedData(encMsg, sealed[:len(data)])
+	return encMsg, nil
+}
+
+// Open removes the layer of encryption from a relay message like DecryptRelay. ok reports whether the message was
+// sealed by the other end, in which case the running digest is advanced and set in the returned message. Otherwise,
+// the message is returned as by Decrypt.
+func (c *RelayCipher) Open(encMsg []byte, digest *RelayDigest) (ok bool, msg []byte, err error) {
+	if c.suite == CipherSuiteAESCTR {
+		return DecryptRelay(encMsg, &c.recvKey, digest)
+	}
+	if len(encMsg) < RelayHeaderSize || len(encMsg) > RelayMessageSize {
+		return false, nil, ErrInvalidMessage
+	}
+
+	aead, err := newRelayAEAD(c.suite, &c.recvKey)
+	if err != nil {
+		return false, nil, err
+	}
+
+	// the key stream is independent of the additional data, thus sealing the ciphertext again yields the plaintext
+	nonce := relayNonce(encMsg, nonceSealed)
+	data := sealedData(encMsg)
+	plaintext := aead.Seal(nil, nonce, data, nil)[:len(data)]
+
+	msg = make([]byte, len(encMsg))
+	copy(msg[:RelayCounterSize], encMsg[:RelayCounterSize])
+	setSealedData(msg, plaintext)
+
+	hdr := RelayHeader{}
+	_ = hdr.Parse(msg)
+	packedHdr, err := hdr.packZeroDigest()
+	if err != nil {
+		return false, nil, err
+	}
+	next, sum := digest.next(packedHdr, msg[RelayHeaderSize:])
+	copy(msg[digestOffset+recognizedSize:RelayHeaderSize], sum)
+
+	// sealing the plaintext again yields the tag of the message, if the digest is the expected one
+	tag := aead.Seal(plaintext[:0], nonce, plaintext, relayAdditionalData(msg))[len(data):]
+	if !hmac.Equal(tag[:tagSize], encMsg[digestOffset:RelayHeaderSize]) {
+		msg, err = c.Decrypt(encMsg)
+		return false, msg, err
+	}
+	digest.commit(next)
+
+	return true, msg, nil
+}
+
+// stream adds or removes a layer of encryption with the key stream of the suite.
+func (c *RelayCipher) stream(relayMsg []byte, key *[32]byte) (msg []byte, err error) {
+	if len(relayMsg) < RelayCounterSize || len(relayMsg) > RelayMessageSize {
+		return nil, ErrInvalidMessage
+	}
+
+	aead, err := newRelayAEAD(c.suite, key)
+	if err != nil {
+		return nil, err
+	}
+
+	msg = make([]byte, len(relayMsg))
+	copy(msg[:RelayCounterSize], relayMsg[:RelayCounterSize])
+	sealed := aead.Seal(nil, relayNonce(relayMsg, nonceRelayed), relayMsg[RelayCounterSize:], nil)
+	copy(msg[RelayCounterSize:], sealed)
+	return msg, nil
+}
+
+// newRelayAEAD returns the AEAD of the given suite.
+func newRelayAEAD(suite CipherSuite, key *[32]byte) (aead cipher.AEAD, err error) {
+	switch suite {
+	case CipherSuiteAESGCM:
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherSuiteChaCha20Poly1305:
+		return chacha20poly1305.New(key[:])
+	default:
+		return nil, ErrUnknownCipherSuite
+	}
+}
+
+// relayNonce returns the nonce for the given relay message, consisting of the given prefix and the counter.
+func relayNonce(relayMsg []byte, prefix byte) (nonce []byte) {
+	nonce = make([]byte, chacha20poly1305.NonceSize) // same as for GCM
+	nonce[0] = prefix
+	copy(nonce[len(nonce)-RelayCounterSize:], relayMsg[:RelayCounterSize])
+	return nonce
+}
+
+// relayAdditionalData returns the counter and the digest of a packed relay message, which are authenticated but not
+// encrypted by sealing it.
+func relayAdditionalData(packedMsg []byte) (ad []byte) {
+	ad = make([]byte, 0, RelayCounterSize+tagSize)
+	ad = append(ad, packedMsg[:RelayCounterSize]...)
+	return append(ad, packedMsg[digestOffset:RelayHeaderSize]...)
+}
+
+// sealedData returns a copy of the part of a relay message which is encrypted by sealing it, namely everything but
+// the counter and the digest.
+func sealedData(relayMsg []byte) (data []byte) {
+	data = make([]byte, 0, len(relayMsg)-RelayCounterSize-tagSize+aeadTagSize)
+	data = append(data, relayMsg[RelayCounterSize:digestOffset]...)
+	return append(data, relayMsg[RelayHeaderSize:]...)
+}
+
+// setSealedData copies data as returned by sealedData back into a relay message.
+func setSealedData(relayMsg []byte, data []byte) {
+	n := copy(relayMsg[RelayCounterSize:digestOffset], data)
+	copy(relayMsg[RelayHeaderSize:], data[n:])
+}
@@ -0,0 +1,175 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCipherSuiteSet(t *testing.T) {
+	set := NewCipherSuiteSet(CipherSuiteAESCTR, CipherSuiteChaCha20Poly1305, 8)
+	assert.Equal(t, CipherSuiteSet(0x05), set)
+	assert.True(t, set.Contains(CipherSuiteAESCTR))
+	assert.False(t, set.Contains(CipherSuiteAESGCM))
+	assert.True(t, set.Contains(CipherSuiteChaCha20Poly1305))
+	assert.False(t, set.Contains(8))
+}
+
+// packTestRelayMessage packs a RelayTunnelData with the given payload.
+func packTestRelayMessage(t *testing.T, counter uint32, data string, digest *RelayDigest) (packedMsg []byte) {
+	buf := make([]byte, RelayMessageSize)
+	_, n, err := PackRelayMessage(buf, counter, &RelayTunnelData{Data: []byte(data)}, digest)
+	require.Nil(t, err)
+	return buf[:n]
+}
+
+func TestRelayCipher(t *testing.T) {
+	for _, suite := range []CipherSuite{CipherSuiteAESCTR, CipherSuiteAESGCM, CipherSuiteChaCha20Poly1305} {
+		suite := suite
+
+		// the tunnel initiator and the ends of three hops
+		var initiator, hops [3]*RelayCipher
+		var sendDigests, recvDigests, hopSendDigests, hopRecvDigests [3]*RelayDigest
+		for i := range hops {
+			key := [32]byte{byte(i + 1)}
+			var err error
+			initiator[i], err = NewRelayCipher(suite, &key, true)
+			require.Nil(t, err)
+			hops[i], err = NewRelayCipher(suite, &key, false)
+			require.Nil(t, err)
+			assert.Equal(t, suite, hops[i].Suite())
+
+			sendDigests[i], recvDigests[i] = NewRelayDigests(&key)
+			hopRecvDigests[i], hopSendDigests[i] = NewRelayDigests(&key)
+		}
+
+		t.Run(suite.String()+"/forward", func(t *testing.T) {
+			packedMsg := packTestRelayMessage(t, 100, "forward", sendDigests[2])
+
+			// the initiator seals the message for the last hop and adds the layers of the hops in front of it
+			encMsg, err := initiator[2].Seal(packedMsg)
+			require.Nil(t, err)
+			for i := 1; i >= 0; i-- {
+				encMsg, err = initiator[i].Encrypt(encMsg)
+				require.Nil(t, err)
+			}
+			assert.NotEqual(t, packedMsg, encMsg)
+
+			// each hop removes its layer, only the last one recognizes the message
+			for i := 0; i < 2; i++ {
+				var ok bool
+				ok, encMsg, err = hops[i].Open(encMsg, hopRecvDigests[i])
+				require.Nil(t, err)
+				require.False(t, ok)
+			}
+			ok, msg, err := hops[2].Open(encMsg, hopRecvDigests[2])
+			require.Nil(t, err)
+			require.True(t, ok)
+			assert.Equal(t, packedMsg, msg)
+
+			// a replayed message is not recognized, since the running digest advanced
+			ok, _, err = hops[2].Open(encMsg, hopRecvDigests[2])
+			require.Nil(t, err)
+			assert.False(t, ok)
+		})
+
+		t.Run(suite.String()+"/backward", func(t *testing.T) {
+			packedMsg := packTestRelayMessage(t, 200, "backward", hopSendDigests[1])
+
+			// the middle hop seals the message, the first hop adds its layer
+			encMsg, err := hops[1].Seal(packedMsg)
+			require.Nil(t, err)
+			encMsg, err = hops[0].Encrypt(encMsg)
+			require.Nil(t, err)
+
+			ok, encMsg, err := initiator[0].Open(encMsg, recvDigests[0])
+			require.Nil(t, err)
+			require.False(t, ok)
+			ok, msg, err := initiator[1].Open(encMsg, recvDigests[1])
+			require.Nil(t, err)
+			require.True(t, ok)
+			assert.Equal(t, packedMsg, msg)
+		})
+
+		t.Run(suite.String()+"/dropped", func(t *testing.T) {
+			// the first message never arrives
+			packTestRelayMessage(t, 300, "dropped", sendDigests[0])
+			encMsg, err := initiator[0].Seal(packTestRelayMessage(t, 400, "second", sendDigests[0]))
+			require.Nil(t, err)
+
+			ok, _, err := hops[0].Open(encMsg, hopRecvDigests[0])
+			require.Nil(t, err)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestRelayCipherAEAD(t *testing.T) {
+	key := [32]byte{1}
+	initiator, err := NewRelayCipher(CipherSuiteAESGCM, &key, true)
+	require.Nil(t, err)
+	hop, err := NewRelayCipher(CipherSuiteAESGCM, &key, false)
+	require.Nil(t, err)
+
+	t.Run("keys per direction", func(t *testing.T) {
+		assert.NotEqual(t, initiator.sendKey, initiator.recvKey)
+		assert.Equal(t, initiator.sendKey, hop.recvKey)
+		assert.Equal(t, initiator.recvKey, hop.sendKey)
+		assert.NotEqual(t, key, initiator.sendKey)
+
+		// the keys of the suites differ
+		chacha, err := NewRelayCipher(CipherSuiteChaCha20Poly1305, &key, true)
+		require.Nil(t, err)
+		assert.NotEqual(t, initiator.sendKey, chacha.sendKey)
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		send, _ := NewRelayDigests(&key)
+		recv, _ := NewRelayDigests(&key)
+		encMsg, err := initiator.Seal(packTestRelayMessage(t, 1, "tampered", send))
+		require.Nil(t, err)
+
+		encMsg[RelayHeaderSize+1] ^= 0x01
+		ok, _, err := hop.Open(encMsg, recv)
+		require.Nil(t, err)
+		assert.False(t, ok)
+
+		// the running digest is not advanced
+		encMsg[RelayHeaderSize+1] ^= 0x01
+		ok, _, err = hop.Open(encMsg, recv)
+		require.Nil(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("sealing differs from relaying", func(t *testing.T) {
+		digest, _ := NewRelayDigests(&key)
+		packedMsg := packTestRelayMessage(t, 1, "nonce", digest)
+		sealed, err := initiator.Seal(packedMsg)
+		require.Nil(t, err)
+		relayed, err := initiator.Encrypt(packedMsg)
+		require.Nil(t, err)
+		assert.NotEqual(t, sealed[RelayHeaderSize:], relayed[RelayHeaderSize:])
+
+		decrypted, err := hop.Decrypt(relayed)
+		require.Nil(t, err)
+		assert.Equal(t, packedMsg, decrypted)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := initiator.Seal(make([]byte, RelayHeaderSize-1))
+		assert.Equal(t, ErrInvalidMessage, err)
+		_, _, err = hop.Open(make([]byte, RelayMessageSize+1), &RelayDigest{})
+		assert.Equal(t, ErrInvalidMessage, err)
+
+		_, err = NewRelayCipher(CipherSuite(7), &key, true)
+		assert.Equal(t, ErrUnknownCipherSuite, err)
+	})
+
+	t.Run("wipe", func(t *testing.T) {
+		initiator.Wipe()
+		assert.Equal(t, [32]byte{}, initiator.sendKey)
+		assert.Equal(t, [32]byte{}, initiator.recvKey)
+		assert.Equal(t, [32]byte{1}, key, "the session key is copied")
+	})
+}
@@ -1,13 +1,150 @@
 package p2p
 
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	HandshakeVersionDH   = 1 // Diffie-Hellman handshake with the public key encrypted for the next hop's host key
+	HandshakeVersionAuth = 2 // handshake performed by the Onion Auth modules of both peers
+	// like HandshakeVersionDH, but the encrypted public key is prefixed by its size, such that host keys of other
+	// sizes than 4096 bits can be used
+	HandshakeVersionDHSized = 3
+	// like HandshakeVersionDHSized, but the public key is encrypted with RSA-OAEP and SHA-256 instead of PKCS #1 v1.5
+	HandshakeVersionDHOAEP = 4
+	// resumes a session of an earlier built-in handshake with the hop by its ticket, without any RSA operations. The
+	// session key is derived from the secret of the resumed session and a fresh Diffie-Hellman key exchange.
+	HandshakeVersionResume = 5
+
+	// Size of the encrypted public key of HandshakeVersionDH, as encrypted with a 4096 bit host key
+	EncDHPubKeySize = 512
+
+	// Size of the ticket identifying a resumed session, see HandshakeVersionResume
+	TicketSize = 16
+
+	// Max size of the handshake payload of the Onion Auth module and of the size-prefixed encrypted public keys, such
+	// that it fits into a RelayTunnelExtend
+	MaxHandshakeSize = MaxRelayDataSize - 2 - 2 - 16 - 2
+)
+
+const (
+	flagAuthHandshake = 2
+	flagRetry         = 4
+	flagTicket        = 8
+	flagLoad          = 64
+)
+
+// VersionSet is a set of handshake versions offered by the tunnel initiator, version v is contained if bit v-1 is set.
+// Peers not supporting the negotiation leave it empty, only offering the version of their handshake.
+type VersionSet uint8
+
+// NewVersionSet returns the set of the given handshake versions.
+func NewVersionSet(versions ...uint8) (set VersionSet) {
+	for _, version := range versions {
+		if version > 0 && version <= 8 {
+			set |= 1 << (version - 1)
+		}
+	}
+	return set
+}
+
+// Contains returns whether the given handshake version is contained in the set.
+func (set VersionSet) Contains(version uint8) bool {
+	return version > 0 && version <= 8 && set&(1<<(version-1)) > 0
+}
+
+// Highest returns the highest handshake version contained in both sets, or 0 if there is none.
+func (set VersionSet) Highest(other VersionSet) (version uint8) {
+	common := set & other
+	for version = 8; version > 0; version-- {
+		if common.Contains(version) {
+			return version
+		}
+	}
+	return 0
+}
+
+// Capabilities is a bitmask of optional protocol features supported by a peer, exchanged during the handshake such that
+// changes of the protocol can be rolled out incrementally. Unknown bits must be ignored.
+type Capabilities uint8
+
+const (
+	CapabilityExit      Capabilities = 1 << iota // the peer opens connections to external services as exit, see RelayExitBegin
+	CapabilityTimestamp                          // the peer timestamps its tunnel creations, see TunnelCreate
+
+	// the peer negotiates the cipher suite of the layered encryption, see TunnelCreate
+	CapabilityCipherSuites
+	// the peer announces tunnels terminating at it as soon as the initiator opens them, see RelayTunnelOpened
+	CapabilityOpened
+	// the peer reassembles the data of a tunnel striped across several circuits, see RelayTunnelJoin
+	CapabilityMultipath
+	// the peer unpacks several payloads packed into a single relay message, see RelayTunnelBatch
+	CapabilityBatch
+	// the peer extends tunnels with handshakes of HandshakeVersionDHSized, see RelayTunnelExtend
+	CapabilitySizedKeys
+	// the peer extends tunnels with handshakes of HandshakeVersionDHOAEP, see RelayTunnelExtend
+	CapabilityOAEP
+)
+
+// Load is a compact indicator of the load of a relay, announced in its TunnelCreated such that initiators can prefer
+// lightly loaded relays. The upper 4 bits are the bucket of the number of tunnels it currently relays, the lower 4 bits
+// the bucket of the number of messages queued on its links. Bucket b holds the numbers from 2^(b-1) to 2^b-1, the
+// bucket 0 only holds zero and the bucket 15 all numbers from 2^14 on.
+type Load uint8
+
+// NewLoad returns the Load of a relay with the given number of tunnels and queued messages.
+func NewLoad(tunnels, queued int) Load {
+	return Load(loadBucket(tunnels)<<4 | loadBucket(queued))
+}
+
+// loadBucket returns the bucket of the given number, see Load.
+func loadBucket(n int) uint8 {
+	if n <= 0 {
+		return 0
+	}
+	if b := bits.Len(uint(n)); b < 15 {
+		return uint8(b)
+	}
+	return 15
+}
+
+// Tunnels returns the bucket of the number of tunnels the relay currently relays.
+func (load Load) Tunnels() uint8 {
+	return uint8(load) >> 4
+}
+
+// Queue returns the bucket of the number of messages queued on the links of the relay.
+func (load Load) Queue() uint8 {
+	return uint8(load) & 0x0f
+}
+
 // TunnelCreate commands a peer to create a tunnel to a given peer.
+// Besides the version of the handshake, the initiator may offer a set of versions and announce its capabilities.
+// The peer then either answers the handshake or asks to retry it with one of the offered versions, see TunnelCreated.
+// With CapabilityTimestamp, the time of the creation follows the handshake, such that the peer can reject replays.
+// With CapabilityCipherSuites, the set of offered cipher suites follows last, of which the peer picks one.
+// The encrypted public key has a fixed size of EncDHPubKeySize bytes, unless it is prefixed by its size with
+// HandshakeVersionDHSized and HandshakeVersionDHOAEP. Handshakes of HandshakeVersionResume carry the ticket of the
+// resumed session and the plain public key instead.
 type TunnelCreate struct {
-	Version  uint8
-	Reserved uint16
+	Version      uint8
+	Versions     VersionSet     // handshake versions supported by the initiator, empty if it does not negotiate
+	Capabilities Capabilities   // only valid if Versions is not empty
+	Timestamp    uint32         // unix time in seconds, only valid if HasTimestamp
+	CipherSuites CipherSuiteSet // only valid if HasCipherSuites
 
 	// encrypted next hop Diffie-Hellman pub key used to derive the shared Diffie-Hellman session key
 	// encrypted with the next hops identifier public key for implicit authentication
-	EncDHPubKey [512]byte
+	EncDHPubKey []byte
+
+	// handshake payload of the Onion Auth module, only used with HandshakeVersionAuth instead of EncDHPubKey
+	Handshake []byte
+
+	// ticket of the resumed session and fresh Diffie-Hellman pub key, only used with HandshakeVersionResume instead of
+	// EncDHPubKey
+	Ticket   [TicketSize]byte
+	DHPubKey [32]byte
 }
 
 // Type returns the type of the message.
@@ -17,23 +154,92 @@ func (msg *TunnelCreate) Type() Type {
 
 // Parse fills the struct with values parsed from the given bytes slice.
 func (msg *TunnelCreate) Parse(data []byte) (err error) {
-	const size = 1 + 2 + len(msg.EncDHPubKey)
-	if len(data) < size {
+	if len(data) < 1+2 {
 		return ErrInvalidMessage
 	}
 
 	msg.Version = data[0]
+	msg.Versions = VersionSet(data[1])
+	msg.Capabilities = Capabilities(data[2])
+
+	end := 1 + 2 + EncDHPubKeySize
+	switch msg.Version {
+	case HandshakeVersionAuth:
+		msg.Handshake, err = parseHandshake(data[3:])
+		if err != nil {
+			return err
+		}
+		end = 1 + 2 + 2 + len(msg.Handshake)
+	case HandshakeVersionDHSized, HandshakeVersionDHOAEP:
+		msg.EncDHPubKey, err = parseHandshake(data[3:])
+		if err != nil {
+			return err
+		}
+		end = 1 + 2 + 2 + len(msg.EncDHPubKey)
+	case HandshakeVersionResume:
+		end = 1 + 2 + TicketSize + 32
+		if len(data) < end {
+			return ErrInvalidMessage
+		}
+		copy(msg.Ticket[:], data[3:3+TicketSize])
+		copy(msg.DHPubKey[:], data[3+TicketSize:end])
+	default:
+		if len(data) < end {
+			return ErrInvalidMessage
+		}
+
+		// must make a copy!
+		msg.EncDHPubKey = make([]byte, EncDHPubKeySize)
+		copy(msg.EncDHPubKey, data[3:end])
+	}
 
-	// 2 bytes reserved
+	if msg.HasTimestamp() {
+		if len(data) < end+4 {
+			return ErrInvalidMessage
+		}
+		msg.Timestamp = binary.BigEndian.Uint32(data[end : end+4])
+		end += 4
+	}
 
-	copy(msg.EncDHPubKey[:], data[3:3+len(msg.EncDHPubKey)])
+	if msg.HasCipherSuites() {
+		if len(data) < end+1 {
+			return ErrInvalidMessage
+		}
+		msg.CipherSuites = CipherSuiteSet(data[end])
+	}
 
 	return nil
 }
 
+// HasTimestamp returns whether the message contains the time of the creation.
+func (msg *TunnelCreate) HasTimestamp() bool {
+	return msg.Versions != 0 && msg.Capabilities&CapabilityTimestamp > 0
+}
+
+// HasCipherSuites returns whether the message contains the offered cipher suites.
+func (msg *TunnelCreate) HasCipherSuites() bool {
+	return msg.Versions != 0 && msg.Capabilities&CapabilityCipherSuites > 0
+}
+
 // PackedSize returns the number of bytes required if serialized to bytes.
 func (msg *TunnelCreate) PackedSize() (n int) {
-	return 1 + 2 + len(msg.EncDHPubKey)
+	switch msg.Version {
+	case HandshakeVersionAuth:
+		n = 1 + 2 + 2 + len(msg.Handshake)
+	case HandshakeVersionDHSized, HandshakeVersionDHOAEP:
+		n = 1 + 2 + 2 + len(msg.EncDHPubKey)
+	case HandshakeVersionResume:
+		n = 1 + 2 + TicketSize + 32
+	default:
+		n = 1 + 2 + EncDHPubKeySize
+	}
+	if msg.HasTimestamp() {
+		n += 4
+	}
+	if msg.HasCipherSuites() {
+		n++
+	}
+	return n
 }
 
 // Pack serializes the values into a bytes slice.
@@ -45,20 +251,62 @@ func (msg *TunnelCreate) Pack(buf []byte) (n int, err error) {
 	buf = buf[0:n]
 
 	buf[0] = msg.Version
-	buf[1] = 0x00 // reserved
-	buf[2] = 0x00 // reserved
+	buf[1] = byte(msg.Versions)
+	buf[2] = byte(msg.Capabilities)
 
-	copy(buf[3:3+len(msg.EncDHPubKey)], msg.EncDHPubKey[:])
+	end := n
+	if msg.HasCipherSuites() {
+		end--
+		buf[end] = byte(msg.CipherSuites)
+	}
+	if msg.HasTimestamp() {
+		binary.BigEndian.PutUint32(buf[end-4:end], msg.Timestamp)
+	}
+
+	switch msg.Version {
+	case HandshakeVersionAuth:
+		err = packHandshake(buf[3:], msg.Handshake)
+		return n, err
+	case HandshakeVersionDHSized, HandshakeVersionDHOAEP:
+		err = packHandshake(buf[3:], msg.EncDHPubKey)
+		return n, err
+	case HandshakeVersionResume:
+		copy(buf[3:3+TicketSize], msg.Ticket[:])
+		copy(buf[3+TicketSize:3+TicketSize+32], msg.DHPubKey[:])
+		return n, nil
+	}
+
+	if len(msg.EncDHPubKey) != EncDHPubKeySize {
+		return -1, ErrInvalidMessage
+	}
+	copy(buf[3:3+EncDHPubKeySize], msg.EncDHPubKey)
 
 	return n, nil
 }
 
 // TunnelCreated is sent as a response to TUNNEL CREATE message.
 // It contains the next hops Diffie-Hellman public key for ephemeral key derivation as well as a hash of the derived key proving ownership of the private identifier key.
-
+// If the handshake is performed by the Onion Auth modules, it contains the reply of the next hop's module instead.
+// If the initiator offered a set of versions, the next hop returns the version of the handshake and its capabilities.
+// If it does not support the version of the handshake, it sets Retry and the version to retry with instead, omitting the
+// handshake fields.
+// If the initiator offered cipher suites, the next hop announces CapabilityCipherSuites and the picked suite follows
+// the handshake fields.
+// If the next hop remembers the session such that the initiator may resume it later, it sets Ticket, see
+// HandshakeVersionResume.
+// If the next hop announces its Load, it sets HasLoad and the load follows last. Peers predating it ignore the flag
+// and the trailing byte.
 type TunnelCreated struct {
+	Retry         bool
+	Ticket        bool         // whether the session may be resumed, only valid if Version is set
+	Version       uint8        // 0 if the initiator did not negotiate
+	Capabilities  Capabilities // only valid if Version is set
+	CipherSuite   CipherSuite  // only valid if HasCipherSuite
+	HasLoad       bool         // whether the next hop announces its load, never set with Retry
+	Load          Load         // only valid if HasLoad
 	DHPubKey      [32]byte
 	SharedKeyHash [32]byte
+	Handshake     []byte // handshake payload of the Onion Auth module, the Diffie-Hellman fields are unused if set
 }
 
 // Type returns the type of the message.
@@ -68,20 +316,74 @@ func (msg *TunnelCreated) Type() Type {
 
 // Parse fills the struct with values parsed from the given bytes slice.
 func (msg *TunnelCreated) Parse(data []byte) (err error) {
-	const size = 3 + 32 + 32
-	if len(data) < size {
+	if len(data) < 3 {
 		return ErrInvalidMessage
 	}
 
-	copy(msg.DHPubKey[0:32], data[3:35])
-	copy(msg.SharedKeyHash[0:32], data[35:67])
+	msg.Retry = data[0]&flagRetry > 0
+	msg.Ticket = data[0]&flagTicket > 0
+	msg.Version = data[1]
+	msg.Capabilities = Capabilities(data[2])
+	if msg.Retry {
+		return nil
+	}
 
-	return
+	end := 3 + 32 + 32
+	if data[0]&flagAuthHandshake > 0 {
+		msg.Handshake, err = parseHandshake(data[3:])
+		if err != nil {
+			return err
+		}
+		end = 3 + 2 + len(msg.Handshake)
+	} else {
+		if len(data) < end {
+			return ErrInvalidMessage
+		}
+
+		copy(msg.DHPubKey[0:32], data[3:35])
+		copy(msg.SharedKeyHash[0:32], data[35:67])
+	}
+
+	if msg.HasCipherSuite() {
+		if len(data) < end+1 {
+			return ErrInvalidMessage
+		}
+		msg.CipherSuite = CipherSuite(data[end])
+		end++
+	}
+
+	if data[0]&flagLoad > 0 {
+		if len(data) < end+1 {
+			return ErrInvalidMessage
+		}
+		msg.HasLoad = true
+		msg.Load = Load(data[end])
+	}
+
+	return nil
+}
+
+// HasCipherSuite returns whether the message contains the cipher suite picked by the next hop.
+func (msg *TunnelCreated) HasCipherSuite() bool {
+	return !msg.Retry && msg.Version != 0 && msg.Capabilities&CapabilityCipherSuites > 0
 }
 
 // PackedSize returns the number of bytes required if serialized to bytes.
 func (msg *TunnelCreated) PackedSize() (n int) {
-	return 3 + 32 + 32
+	if msg.Retry {
+		return 3
+	}
+	n = 3 + 32 + 32
+	if len(msg.Handshake) > 0 {
+		n = 3 + 2 + len(msg.Handshake)
+	}
+	if msg.HasCipherSuite() {
+		n++
+	}
+	if msg.HasLoad {
+		n++
+	}
+	return n
 }
 
 // Pack serializes the values into a bytes slice.
@@ -92,6 +394,37 @@ func (msg *TunnelCreated) Pack(buf []byte) (n int, err error) {
 	}
 	buf = buf[0:n]
 
+	buf[0] = 0x00 // flags (set later)
+	buf[1] = msg.Version
+	buf[2] = byte(msg.Capabilities)
+
+	if msg.Retry {
+		buf[0] = flagRetry
+		return n, nil
+	}
+
+	end := n
+	if msg.HasLoad {
+		end--
+		buf[end] = byte(msg.Load)
+	}
+	if msg.HasCipherSuite() {
+		buf[end-1] = byte(msg.CipherSuite)
+	}
+
+	if msg.Ticket {
+		buf[0] = flagTicket
+	}
+	if msg.HasLoad {
+		buf[0] |= flagLoad
+	}
+
+	if len(msg.Handshake) > 0 {
+		buf[0] |= flagAuthHandshake
+		err = packHandshake(buf[3:], msg.Handshake)
+		return n, err
+	}
+
 	copy(buf[3:35], msg.DHPubKey[0:32])
 	copy(buf[35:67], msg.SharedKeyHash[0:32])
 
@@ -163,3 +496,33 @@ func (msg *TunnelRelay) PackedSize() (n int) {
 func (msg *TunnelRelay) Pack(buf []byte) (n int, err error) {
 	panic("must use PackRelayMessage instead")
 }
+
+// parseHandshake reads a handshake payload of the Onion Auth module prefixed by its size, or the encrypted public key
+// of HandshakeVersionDHSized and HandshakeVersionDHOAEP.
+func parseHandshake(data []byte) (handshake []byte, err error) {
+	if len(data) < 2 {
+		return nil, ErrInvalidMessage
+	}
+
+	size := int(binary.BigEndian.Uint16(data[:2]))
+	if size == 0 || size > MaxHandshakeSize || len(data) < 2+size {
+		return nil, ErrInvalidMessage
+	}
+
+	// must make a copy!
+	handshake = make([]byte, size)
+	copy(handshake, data[2:2+size])
+	return handshake, nil
+}
+
+// packHandshake serializes a handshake payload of the Onion Auth module or the encrypted public key of
+// HandshakeVersionDHSized and HandshakeVersionDHOAEP prefixed by its size into the given buffer.
+func packHandshake(buf []byte, handshake []byte) (err error) {
+	if len(handshake) == 0 || len(handshake) > MaxHandshakeSize {
+		return ErrInvalidMessage
+	}
+
+	binary.BigEndian.PutUint16(buf[:2], uint16(len(handshake)))
+	copy(buf[2:], handshake)
+	return nil
+}
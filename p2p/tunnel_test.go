@@ -28,7 +28,7 @@ func TestTunnelCreate(t *testing.T) {
 	_, packErr := msg.Pack([]byte{})
 	assert.Equal(t, ErrBufferTooSmall, packErr)
 
-	var encKey [512]byte
+	encKey := make([]byte, EncDHPubKeySize)
 	encKey[0] = 0x11
 	encKey[511] = 0xff
 
@@ -48,6 +48,183 @@ func TestTunnelCreate(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, len(data), n)
 	assert.Equal(t, data, buf[:n])
+
+	t.Run("auth handshake", func(t *testing.T) {
+		msg := new(TunnelCreate)
+
+		data := []byte{HandshakeVersionAuth, 0, 0, 0, 3, 1, 2, 3}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, TunnelCreate{
+			Version:   HandshakeVersionAuth,
+			Handshake: []byte{1, 2, 3},
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+
+		// truncated or empty handshake
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(data[:7]))
+		assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{HandshakeVersionAuth, 0, 0, 0, 0}))
+	})
+
+	t.Run("sized key", func(t *testing.T) {
+		msg := new(TunnelCreate)
+
+		data := []byte{HandshakeVersionDHSized, 0, 0, 0, 3, 1, 2, 3}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, TunnelCreate{
+			Version:     HandshakeVersionDHSized,
+			EncDHPubKey: []byte{1, 2, 3},
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+
+		// truncated or empty key
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(data[:7]))
+		assert.Equal(t, ErrInvalidMessage, msg.Parse([]byte{HandshakeVersionDHSized, 0, 0, 0, 0}))
+
+		// keys of other sizes do not fit into the legacy version
+		msg.Version = HandshakeVersionDH
+		_, err = msg.Pack(buf)
+		assert.Equal(t, ErrInvalidMessage, err)
+
+		// keys encrypted with RSA-OAEP are prefixed by their size as well
+		data[0] = HandshakeVersionDHOAEP
+		require.Nil(t, msg.Parse(data))
+		assert.Equal(t, TunnelCreate{Version: HandshakeVersionDHOAEP, EncDHPubKey: []byte{1, 2, 3}}, *msg)
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		msg := new(TunnelCreate)
+
+		data := make([]byte, 3+TicketSize+32)
+		data[0] = HandshakeVersionResume
+		data[3] = 0x11               // ticket start
+		data[3+TicketSize] = 0x22    // pub key start
+		data[3+TicketSize+31] = 0x33 // pub key end
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		expected := TunnelCreate{Version: HandshakeVersionResume}
+		expected.Ticket[0] = 0x11
+		expected.DHPubKey[0] = 0x22
+		expected.DHPubKey[31] = 0x33
+		require.Equal(t, expected, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(data[:len(data)-1]))
+	})
+
+	t.Run("negotiation", func(t *testing.T) {
+		msg := new(TunnelCreate)
+
+		data := []byte{HandshakeVersionAuth, 0x03, byte(CapabilityExit), 0, 1, 1}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, TunnelCreate{
+			Version:      HandshakeVersionAuth,
+			Versions:     NewVersionSet(HandshakeVersionDH, HandshakeVersionAuth),
+			Capabilities: CapabilityExit,
+			Handshake:    []byte{1},
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+	})
+
+	t.Run("timestamp", func(t *testing.T) {
+		msg := new(TunnelCreate)
+
+		data := make([]byte, 515+4)
+		data[0] = HandshakeVersionDH
+		data[1] = byte(NewVersionSet(HandshakeVersionDH))
+		data[2] = byte(CapabilityTimestamp)
+		data[3] = encKey[0]
+		copy(data[515:], []byte{1, 2, 3, 4})
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.True(t, msg.HasTimestamp())
+		require.Equal(t, TunnelCreate{
+			Version:      HandshakeVersionDH,
+			Versions:     NewVersionSet(HandshakeVersionDH),
+			Capabilities: CapabilityTimestamp,
+			Timestamp:    0x01020304,
+			EncDHPubKey:  append([]byte{0x11}, make([]byte, 511)...),
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+
+		// missing timestamp
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(data[:515]))
+	})
+
+	t.Run("cipher suites", func(t *testing.T) {
+		msg := new(TunnelCreate)
+
+		data := make([]byte, 1+2+2+3+4+1)
+		data[0] = HandshakeVersionAuth
+		data[1] = byte(NewVersionSet(HandshakeVersionAuth))
+		data[2] = byte(CapabilityTimestamp | CapabilityCipherSuites)
+		data[4] = 3 // handshake size
+		copy(data[5:], "hs1")
+		copy(data[8:], []byte{1, 2, 3, 4})
+		data[12] = byte(NewCipherSuiteSet(CipherSuiteAESGCM, CipherSuiteChaCha20Poly1305))
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.True(t, msg.HasCipherSuites())
+		require.Equal(t, TunnelCreate{
+			Version:      HandshakeVersionAuth,
+			Versions:     NewVersionSet(HandshakeVersionAuth),
+			Capabilities: CapabilityTimestamp | CapabilityCipherSuites,
+			Timestamp:    0x01020304,
+			CipherSuites: NewCipherSuiteSet(CipherSuiteAESGCM, CipherSuiteChaCha20Poly1305),
+			Handshake:    []byte("hs1"),
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+
+		// missing cipher suites
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(data[:12]))
+	})
+}
+
+func TestVersionSet(t *testing.T) {
+	set := NewVersionSet(HandshakeVersionDH, HandshakeVersionAuth, 0, 9)
+	assert.Equal(t, VersionSet(0x03), set)
+	assert.True(t, set.Contains(HandshakeVersionDH))
+	assert.True(t, set.Contains(HandshakeVersionAuth))
+	assert.False(t, set.Contains(0))
+	assert.False(t, set.Contains(3))
+	assert.False(t, set.Contains(9))
+
+	assert.Equal(t, uint8(HandshakeVersionAuth), set.Highest(set))
+	assert.Equal(t, uint8(HandshakeVersionDH), set.Highest(NewVersionSet(HandshakeVersionDH, 3)))
+	assert.Equal(t, uint8(0), set.Highest(NewVersionSet(3)))
+	assert.Equal(t, uint8(0), set.Highest(0))
 }
 
 func TestTunnelCreated(t *testing.T) {
@@ -88,6 +265,152 @@ func TestTunnelCreated(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, len(data), n)
 	assert.Equal(t, data, buf[:n])
+
+	t.Run("auth handshake", func(t *testing.T) {
+		msg := new(TunnelCreated)
+
+		data := []byte{flagAuthHandshake, 0, 0, 0, 2, 1, 2}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, TunnelCreated{Handshake: []byte{1, 2}}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(data[:6]))
+	})
+
+	t.Run("negotiated", func(t *testing.T) {
+		msg := new(TunnelCreated)
+
+		data := make([]byte, 67)
+		data[1] = HandshakeVersionDH
+		data[2] = byte(CapabilityExit)
+		data[3] = pubKey[0]
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, TunnelCreated{
+			Version:      HandshakeVersionDH,
+			Capabilities: CapabilityExit,
+			DHPubKey:     [32]byte{0x11},
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+	})
+
+	t.Run("cipher suite", func(t *testing.T) {
+		msg := new(TunnelCreated)
+
+		data := make([]byte, 67+1)
+		data[1] = HandshakeVersionDH
+		data[2] = byte(CapabilityCipherSuites)
+		data[3] = pubKey[0]
+		data[67] = byte(CipherSuiteChaCha20Poly1305)
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.True(t, msg.HasCipherSuite())
+		require.Equal(t, TunnelCreated{
+			Version:      HandshakeVersionDH,
+			Capabilities: CapabilityCipherSuites,
+			CipherSuite:  CipherSuiteChaCha20Poly1305,
+			DHPubKey:     [32]byte{0x11},
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+
+		// missing cipher suite
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(data[:67]))
+
+		// retries do not contain the suite
+		data = []byte{flagRetry, HandshakeVersionDH, byte(CapabilityCipherSuites)}
+		require.Nil(t, msg.Parse(data))
+		assert.False(t, msg.HasCipherSuite())
+		n, err = msg.Pack(buf)
+		require.Nil(t, err)
+		assert.Equal(t, data, buf[:n])
+	})
+
+	t.Run("load", func(t *testing.T) {
+		msg := new(TunnelCreated)
+
+		data := make([]byte, 67+2)
+		data[0] = flagLoad
+		data[1] = HandshakeVersionDH
+		data[2] = byte(CapabilityCipherSuites)
+		data[3] = pubKey[0]
+		data[67] = byte(CipherSuiteAESGCM)
+		data[68] = 0x31
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, TunnelCreated{
+			Version:      HandshakeVersionDH,
+			Capabilities: CapabilityCipherSuites,
+			CipherSuite:  CipherSuiteAESGCM,
+			HasLoad:      true,
+			Load:         NewLoad(4, 1),
+			DHPubKey:     [32]byte{0x11},
+		}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+
+		// missing load
+		assert.Equal(t, ErrInvalidMessage, msg.Parse(data[:68]))
+
+		// peers predating the load ignore it
+		msg = new(TunnelCreated)
+		data[0] = 0
+		require.Nil(t, msg.Parse(data))
+		assert.False(t, msg.HasLoad)
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		msg := new(TunnelCreated)
+
+		data := []byte{flagRetry, HandshakeVersionDH, 0}
+		err := msg.Parse(data)
+		require.Nil(t, err)
+		require.Equal(t, TunnelCreated{Retry: true, Version: HandshakeVersionDH}, *msg)
+
+		buf := make([]byte, 4096)
+		n, err := msg.Pack(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(data), n)
+		assert.Equal(t, data, buf[:n])
+	})
+}
+
+func TestLoad(t *testing.T) {
+	for _, tc := range []struct {
+		tunnels, queued int
+		load            Load
+	}{
+		{0, 0, 0x00},
+		{1, 0, 0x10},
+		{2, 3, 0x22},
+		{4, 7, 0x33},
+		{1000, 1, 0xa1},
+		{-1, 1 << 20, 0x0f},
+	} {
+		load := NewLoad(tc.tunnels, tc.queued)
+		assert.Equal(t, tc.load, load, "%d tunnels, %d queued", tc.tunnels, tc.queued)
+		assert.Equal(t, uint8(tc.load>>4), load.Tunnels())
+		assert.Equal(t, uint8(tc.load&0x0f), load.Queue())
+	}
 }
 
 func TestTunnelDestroy(t *testing.T) {
@@ -9,15 +9,33 @@ const (
 	TypeTunnelDestroy Type = 3
 	TypeTunnelRelay   Type = 4
 	// Tunnel reserved until 20
+
+	TypeLinkHello       Type = 21
+	TypeLinkPadding     Type = 22
+	TypeLinkReachCheck  Type = 23
+	TypeLinkReachResult Type = 24
 )
 
 // Relay sub protocol
 type RelayType uint8
 
 const (
-	RelayTypeTunnelExtend   RelayType = 1
-	RelayTypeTunnelExtended RelayType = 2
-	RelayTypeTunnelData     RelayType = 3
-	RelayTypeTunnelCover    RelayType = 4
-	// Tunnel reserved until 10
+	RelayTypeTunnelExtend    RelayType = 1
+	RelayTypeTunnelExtended  RelayType = 2
+	RelayTypeTunnelData      RelayType = 3
+	RelayTypeTunnelCover     RelayType = 4
+	RelayTypeTunnelBegin     RelayType = 5
+	RelayTypeTunnelEnd       RelayType = 6
+	RelayTypeTunnelConnected RelayType = 7
+	RelayTypeTunnelDatagram  RelayType = 8
+	RelayTypeTunnelDestroy   RelayType = 9
+	RelayTypeTunnelEOF       RelayType = 10
+	RelayTypeTunnelSeqData   RelayType = 11
+	RelayTypeTunnelAck       RelayType = 12
+	RelayTypeTunnelMigrate   RelayType = 13
+	RelayTypeTunnelOpened    RelayType = 14
+	RelayTypeTunnelJoin      RelayType = 15
+	RelayTypeTunnelError     RelayType = 16
+	RelayTypeTunnelBatch     RelayType = 17
+	// Tunnel reserved until 20
 )
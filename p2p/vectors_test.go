@@ -0,0 +1,347 @@
+package p2p
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// updateVectors rewrites the test vectors from the messages below instead of verifying them.
+var updateVectors = flag.Bool("update", false, "update the test vectors in testdata")
+
+// vectorsFile holds the test vectors other implementations can interop-test against. Each line consists of the name of
+// the vector and its hex encoding. P2P messages are encoded with the P2P header, but without the random padding up to
+// MessageSize. Relay messages are encoded without the relay header, see the relay cell vectors for a complete one,
+// which also make up the TunnelRelay vector.
+var vectorsFile = filepath.Join("testdata", "vectors.txt")
+
+// vectorKey is the session key of the relay cell vectors.
+var vectorKey = [32]byte{
+	0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f,
+	0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f,
+}
+
+func vectorBytes(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+// vectorMessages are the P2P messages the test vectors are generated from.
+func vectorMessages() map[string]Message {
+	create := &TunnelCreate{Version: HandshakeVersionDH, EncDHPubKey: vectorBytes(512)}
+	created := &TunnelCreated{}
+	copy(created.DHPubKey[:], vectorBytes(32))
+	copy(created.SharedKeyHash[:], vectorBytes(64)[32:])
+	versions := NewVersionSet(HandshakeVersionDH, HandshakeVersionAuth)
+	resume := &TunnelCreate{Version: HandshakeVersionResume}
+	copy(resume.Ticket[:], vectorBytes(TicketSize))
+	copy(resume.DHPubKey[:], vectorBytes(32))
+	ticket := &TunnelCreated{Ticket: true, Version: HandshakeVersionDHOAEP, Capabilities: CapabilityOAEP}
+	copy(ticket.DHPubKey[:], vectorBytes(32))
+	copy(ticket.SharedKeyHash[:], vectorBytes(64)[32:])
+	reach := &LinkReachResult{Nonce: 0x0102030405060708, Reachable: true, Address: net.IPv4(192, 0, 2, 1).To4()}
+	copy(reach.HostKeyHash[:], vectorBytes(32))
+
+	return map[string]Message{
+		"TunnelCreate/dh":      create,
+		"TunnelCreate/auth":    &TunnelCreate{Version: HandshakeVersionAuth, Handshake: []byte("hs1")},
+		"TunnelCreate/sized":   &TunnelCreate{Version: HandshakeVersionDHSized, EncDHPubKey: vectorBytes(256)},
+		"TunnelCreate/oaep":    &TunnelCreate{Version: HandshakeVersionDHOAEP, EncDHPubKey: vectorBytes(512)},
+		"TunnelCreate/resume":  resume,
+		"TunnelCreated/dh":     created,
+		"TunnelCreated/ticket": ticket,
+		"TunnelCreated/auth":   &TunnelCreated{Handshake: []byte("hs2")},
+		"TunnelCreate/negotiate": &TunnelCreate{Version: HandshakeVersionAuth, Versions: versions,
+			Capabilities: CapabilityExit, Handshake: []byte("hs1")},
+		"TunnelCreated/negotiated": &TunnelCreated{Version: HandshakeVersionAuth, Capabilities: CapabilityExit,
+			Handshake: []byte("hs2")},
+		"TunnelCreated/retry": &TunnelCreated{Retry: true, Version: HandshakeVersionDH, Capabilities: CapabilityExit},
+		"TunnelCreate/timestamp": &TunnelCreate{Version: HandshakeVersionAuth, Versions: versions,
+			Capabilities: CapabilityTimestamp, Timestamp: 0x5f5e1000, Handshake: []byte("hs1")},
+		"TunnelCreate/suites": &TunnelCreate{Version: HandshakeVersionAuth, Versions: versions,
+			Capabilities: CapabilityTimestamp | CapabilityCipherSuites, Timestamp: 0x5f5e1000, Handshake: []byte("hs1"),
+			CipherSuites: NewCipherSuiteSet(CipherSuiteAESCTR, CipherSuiteAESGCM, CipherSuiteChaCha20Poly1305)},
+		"TunnelCreated/suite": &TunnelCreated{Version: HandshakeVersionAuth, Capabilities: CapabilityCipherSuites,
+			CipherSuite: CipherSuiteAESGCM, Handshake: []byte("hs2")},
+		"TunnelCreated/load": &TunnelCreated{Version: HandshakeVersionAuth, Capabilities: CapabilityCipherSuites,
+			CipherSuite: CipherSuiteAESGCM, HasLoad: true, Load: NewLoad(5, 1), Handshake: []byte("hs2")},
+		"TunnelDestroy": &TunnelDestroy{},
+		"LinkHello":     &LinkHello{Features: LinkFeaturePadding},
+		"LinkPadding":   &LinkPadding{},
+		"LinkHello/identity": &LinkHello{Features: LinkFeaturePadding | LinkFeatureIdentity, Port: 6602,
+			Identity: 0x0102030405060708},
+		"LinkReachCheck":  &LinkReachCheck{Port: 6602, Nonce: 0x0102030405060708},
+		"LinkReachResult": reach,
+	}
+}
+
+// vectorRelayMessages are the relay messages the test vectors are generated from.
+func vectorRelayMessages() map[string]RelayMessage {
+	extend := &RelayTunnelExtend{Port: 6602, Address: net.IPv4(192, 0, 2, 1).To4(), EncDHPubKey: vectorBytes(512)}
+	extended := &RelayTunnelExtended{}
+	copy(extended.DHPubKey[:], vectorBytes(32))
+	copy(extended.SharedKeyHash[:], vectorBytes(64)[32:])
+	resume := &RelayTunnelExtend{Port: 6602, Address: net.IPv4(192, 0, 2, 1).To4(), Resume: true}
+	copy(resume.Ticket[:], vectorBytes(TicketSize))
+	copy(resume.DHPubKey[:], vectorBytes(32))
+	ticket := &RelayTunnelExtended{Ticket: true, Version: HandshakeVersionResume, Capabilities: CapabilityOAEP}
+	copy(ticket.DHPubKey[:], vectorBytes(32))
+	copy(ticket.SharedKeyHash[:], vectorBytes(64)[32:])
+
+	return map[string]RelayMessage{
+		"RelayTunnelExtend/dh": extend,
+		"RelayTunnelExtend/sized": &RelayTunnelExtend{Port: 6602, Address: net.IPv4(192, 0, 2, 1).To4(),
+			EncDHPubKey: vectorBytes(256), Versions: NewVersionSet(HandshakeVersionDH, HandshakeVersionDHSized),
+			Capabilities: CapabilitySizedKeys},
+		"RelayTunnelExtend/oaep": &RelayTunnelExtend{Port: 6602, Address: net.IPv4(192, 0, 2, 1).To4(),
+			EncDHPubKey: vectorBytes(512), OAEP: true},
+		"RelayTunnelExtend/resume":   resume,
+		"RelayTunnelExtended/ticket": ticket,
+		"RelayTunnelExtend/auth": &RelayTunnelExtend{IPv6: true, Port: 6602, Address: net.ParseIP("2001:db8::1"),
+			Handshake: []byte("hs1")},
+		"RelayTunnelExtended/dh":   extended,
+		"RelayTunnelExtended/auth": &RelayTunnelExtended{Handshake: []byte("hs2")},
+		"RelayTunnelExtend/negotiate": &RelayTunnelExtend{Port: 6602, Address: net.IPv4(192, 0, 2, 1).To4(),
+			Handshake: []byte("hs1"), Versions: NewVersionSet(HandshakeVersionDH, HandshakeVersionAuth),
+			Capabilities: CapabilityExit},
+		"RelayTunnelExtend/timestamp": &RelayTunnelExtend{Port: 6602, Address: net.IPv4(192, 0, 2, 1).To4(),
+			Handshake: []byte("hs1"), Versions: NewVersionSet(HandshakeVersionDH, HandshakeVersionAuth),
+			Capabilities: CapabilityTimestamp, Timestamp: 0x5f5e1000},
+		"RelayTunnelExtend/suites": &RelayTunnelExtend{Port: 6602, Address: net.IPv4(192, 0, 2, 1).To4(),
+			Handshake: []byte("hs1"), Versions: NewVersionSet(HandshakeVersionDH, HandshakeVersionAuth),
+			Capabilities: CapabilityTimestamp | CapabilityCipherSuites, Timestamp: 0x5f5e1000,
+			CipherSuites: NewCipherSuiteSet(CipherSuiteAESCTR, CipherSuiteAESGCM, CipherSuiteChaCha20Poly1305)},
+		"RelayTunnelExtended/suite": &RelayTunnelExtended{Handshake: []byte("hs2"), Version: HandshakeVersionAuth,
+			Capabilities: CapabilityCipherSuites, CipherSuite: CipherSuiteChaCha20Poly1305},
+		"RelayTunnelExtend/load": &RelayTunnelExtend{Port: 6602, Address: net.IPv4(192, 0, 2, 1).To4(),
+			Handshake: []byte("hs1"), Versions: NewVersionSet(HandshakeVersionDH, HandshakeVersionAuth),
+			Capabilities: CapabilityExit, WantLoad: true},
+		"RelayTunnelExtended/load": &RelayTunnelExtended{Handshake: []byte("hs2"), Version: HandshakeVersionAuth,
+			Capabilities: CapabilityCipherSuites, CipherSuite: CipherSuiteChaCha20Poly1305, HasLoad: true,
+			Load: NewLoad(5, 1)},
+		"RelayTunnelExtended/negotiated": &RelayTunnelExtended{Handshake: []byte("hs2"), Version: HandshakeVersionAuth,
+			Capabilities: CapabilityExit},
+		"RelayTunnelExtended/retry": &RelayTunnelExtended{Retry: true, Version: HandshakeVersionDH,
+			Capabilities: CapabilityExit},
+		"RelayTunnelData":       &RelayTunnelData{Data: []byte("data")},
+		"RelayTunnelCover/ping": &RelayTunnelCover{Ping: true},
+		"RelayTunnelBegin":      &RelayTunnelBegin{Port: 80, Address: net.IPv4(192, 0, 2, 1)},
+		"RelayTunnelEnd":        &RelayTunnelEnd{Reason: EndReasonConnectFailed},
+		"RelayTunnelConnected":  &RelayTunnelConnected{},
+		"RelayTunnelDatagram":   &RelayTunnelDatagram{Data: []byte("datagram")},
+		"RelayTunnelDestroy":    &RelayTunnelDestroy{},
+		"RelayTunnelEOF":        &RelayTunnelEOF{},
+		"RelayTunnelSeqData":    &RelayTunnelSeqData{Stream: 0x0102030405060708, Seq: 9, Data: []byte("data")},
+		"RelayTunnelAck":        &RelayTunnelAck{Stream: 0x0102030405060708, Seq: 9},
+		"RelayTunnelMigrate":    &RelayTunnelMigrate{Token: 0x0102030405060708, Step: MigrateNew},
+		"RelayTunnelError":      &RelayTunnelError{Reason: ErrorReasonExtendLoop},
+		"RelayTunnelBatch":      &RelayTunnelBatch{Payloads: [][]byte{[]byte("voice"), []byte("data")}},
+	}
+}
+
+// vectorRelayCell returns a relay cell carrying a RelayTunnelData message for the hop holding vectorKey, both as
+// plaintext and encrypted with the key. Unlike PackRelayMessage, the counter is fixed and the padding is zeroed.
+func vectorRelayCell(t *testing.T) (plain, enc []byte) {
+	msg := &RelayTunnelData{Data: []byte("data")}
+	hdr := RelayHeader{
+		Counter:   [3]byte{0x00, 0x01, 0x02},
+		RelayType: msg.Type(),
+		Size:      uint16(RelayHeaderSize + msg.PackedSize()),
+	}
+
+	plain = make([]byte, RelayMessageSize)
+	_, err := msg.Pack(plain[RelayHeaderSize:])
+	require.Nil(t, err)
+	forward, _ := NewRelayDigests(&vectorKey)
+	require.Nil(t, hdr.ComputeDigest(plain[RelayHeaderSize:], forward))
+	require.Nil(t, hdr.Pack(plain[:RelayHeaderSize]))
+
+	enc, err = EncryptRelay(plain, &vectorKey)
+	require.Nil(t, err)
+	return plain, enc
+}
+
+// vectorSuites are the AEAD cipher suites the relay cell is sealed with by the tunnel initiator in the test vectors.
+var vectorSuites = []CipherSuite{CipherSuiteAESGCM, CipherSuiteChaCha20Poly1305}
+
+// vectorSealedRelayCell returns the relay cell of vectorRelayCell sealed with the given suite.
+func vectorSealedRelayCell(t *testing.T, plain []byte, suite CipherSuite) (enc []byte) {
+	c, err := NewRelayCipher(suite, &vectorKey, true)
+	require.Nil(t, err)
+	enc, err = c.Seal(plain)
+	require.Nil(t, err)
+	return enc
+}
+
+// encodeVectors returns the hex encodings of all test vectors by name.
+func encodeVectors(t *testing.T) map[string]string {
+	vectors := make(map[string]string)
+	buf := make([]byte, MessageSize)
+	for name, msg := range vectorMessages() {
+		hdr := Header{TunnelID: 0x01020304, Type: msg.Type()}
+		hdr.Pack(buf)
+		n, err := msg.Pack(buf[HeaderSize:])
+		require.Nil(t, err, name)
+		vectors[name] = hex.EncodeToString(buf[:HeaderSize+n])
+	}
+	for name, msg := range vectorRelayMessages() {
+		n, err := msg.Pack(buf)
+		require.Nil(t, err, name)
+		vectors[name] = hex.EncodeToString(buf[:n])
+	}
+
+	plain, enc := vectorRelayCell(t)
+	vectors["RelayCell/key"] = hex.EncodeToString(vectorKey[:])
+	vectors["RelayCell/plain"] = hex.EncodeToString(plain)
+	vectors["RelayCell/encrypted"] = hex.EncodeToString(enc)
+	for _, suite := range vectorSuites {
+		vectors["RelayCell/"+suite.String()] = hex.EncodeToString(vectorSealedRelayCell(t, plain, suite))
+	}
+
+	// the encrypted relay cell is sent as the body of a TunnelRelay message
+	hdr := Header{TunnelID: 0x01020304, Type: TypeTunnelRelay}
+	hdr.Pack(buf)
+	copy(buf[HeaderSize:], enc)
+	vectors["TunnelRelay"] = hex.EncodeToString(buf[:HeaderSize+len(enc)])
+	return vectors
+}
+
+func readVectors(t *testing.T) map[string][]byte {
+	f, err := os.Open(vectorsFile)
+	require.Nil(t, err)
+	defer f.Close()
+
+	vectors := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 4*MessageSize), 4*MessageSize)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// messages without a payload have an empty encoding
+		fields := append(strings.Fields(line), "")
+		data, err := hex.DecodeString(fields[1])
+		require.Nil(t, err, fields[0])
+		vectors[fields[0]] = data
+	}
+	require.Nil(t, scanner.Err())
+	return vectors
+}
+
+func writeVectors(t *testing.T, vectors map[string]string) {
+	var sb strings.Builder
+	sb.WriteString("# bawang P2P test vectors: <name> <hex>\n")
+	sb.WriteString("# P2P messages include the header with tunnel ID 0x01020304, but not the random padding.\n")
+	sb.WriteString("# Relay messages exclude the relay header. RelayCell is a complete relay message encrypted with key.\n")
+	sb.WriteString("# RelayCell/<suite> is the same message sealed with the cipher suite by the tunnel initiator.\n")
+	for _, name := range sortedNames(vectors) {
+		fmt.Fprintln(&sb, strings.TrimSpace(name+" "+vectors[name]))
+	}
+	require.Nil(t, ioutil.WriteFile(vectorsFile, []byte(sb.String()), 0644))
+}
+
+func sortedNames(vectors map[string]string) []string {
+	names := make([]string, 0, len(vectors))
+	for name := range vectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestVectors(t *testing.T) {
+	encoded := encodeVectors(t)
+	if *updateVectors {
+		writeVectors(t, encoded)
+	}
+	vectors := readVectors(t)
+	require.Len(t, vectors, len(encoded), "test vectors are outdated, run the tests with -update")
+
+	t.Run("messages", func(t *testing.T) {
+		for name, msg := range vectorMessages() {
+			data := vectors[name]
+			require.NotNil(t, data, name)
+			assert.Equal(t, encoded[name], hex.EncodeToString(data), name)
+
+			// the vectors are parsed into the same encoding
+			hdr := Header{}
+			require.Nil(t, hdr.Parse(data), name)
+			assert.Equal(t, msg.Type(), hdr.Type, name)
+			parsed := reflect.New(reflect.TypeOf(msg).Elem()).Interface().(Message)
+			require.Nil(t, parsed.Parse(data[HeaderSize:]), name)
+			buf := make([]byte, MessageSize)
+			n, err := parsed.Pack(buf)
+			require.Nil(t, err, name)
+			assert.Equal(t, data[HeaderSize:], buf[:n], name)
+		}
+	})
+
+	t.Run("relay messages", func(t *testing.T) {
+		for name, msg := range vectorRelayMessages() {
+			data := vectors[name]
+			require.NotNil(t, data, name)
+			assert.Equal(t, encoded[name], hex.EncodeToString(data), name)
+
+			parsed := reflect.New(reflect.TypeOf(msg).Elem()).Interface().(RelayMessage)
+			require.Nil(t, parsed.Parse(data), name)
+			buf := make([]byte, MessageSize)
+			n, err := parsed.Pack(buf)
+			require.Nil(t, err, name)
+			assert.Equal(t, data, buf[:n], name)
+		}
+	})
+
+	t.Run("relay cell", func(t *testing.T) {
+		var key [32]byte
+		copy(key[:], vectors["RelayCell/key"])
+		forward, _ := NewRelayDigests(&key)
+
+		ok, msg, err := DecryptRelay(vectors["RelayCell/encrypted"], &key, forward)
+		require.Nil(t, err)
+		require.True(t, ok)
+		assert.Equal(t, vectors["RelayCell/plain"], msg)
+
+		enc, err := EncryptRelay(vectors["RelayCell/plain"], &key)
+		require.Nil(t, err)
+		assert.Equal(t, vectors["RelayCell/encrypted"], enc)
+
+		hdr := Header{}
+		require.Nil(t, hdr.Parse(vectors["TunnelRelay"]))
+		assert.Equal(t, TypeTunnelRelay, hdr.Type)
+		assert.Equal(t, enc, vectors["TunnelRelay"][HeaderSize:])
+	})
+
+	t.Run("sealed relay cells", func(t *testing.T) {
+		var key [32]byte
+		copy(key[:], vectors["RelayCell/key"])
+
+		for _, suite := range vectorSuites {
+			enc := vectors["RelayCell/"+suite.String()]
+			require.NotNil(t, enc, suite.String())
+
+			hop, err := NewRelayCipher(suite, &key, false)
+			require.Nil(t, err)
+			forward, _ := NewRelayDigests(&key)
+			ok, msg, err := hop.Open(enc, forward)
+			require.Nil(t, err)
+			require.True(t, ok, suite.String())
+			assert.Equal(t, vectors["RelayCell/plain"], msg, suite.String())
+		}
+	})
+}
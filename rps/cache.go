@@ -0,0 +1,204 @@
+package rps
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// prefetchRetryInterval is the time the prefetcher waits before querying the RPS module again after an error.
+const prefetchRetryInterval = time.Second
+
+// pipelinedSource is implemented by RPS clients which can query several peers at once, see rps.getPeers.
+type pipelinedSource interface {
+	getPeers(n int) (peers []*Peer, err error)
+}
+
+// cachedPeer is a prefetched peer together with the time it expires.
+type cachedPeer struct {
+	peer    *Peer
+	expires time.Time
+}
+
+// cache is an RPS asynchronously prefetching peers from another RPS into a bounded pool, so that peers can be
+// served instantly when building tunnels. Every peer is handed out at most once and prefetched peers expire after
+// the TTL, since the peers the RPS module knows about change over time.
+type cache struct {
+	source RPS
+	size   int
+	ttl    time.Duration
+	now    func() time.Time
+
+	l      sync.Mutex // guards pool
+	pool   []cachedPeer
+	wakeup chan struct{} // signals the prefetcher that peers were taken from the pool
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+// NewCache wraps the given RPS with a pool of up to size peers, which are prefetched asynchronously and expire after
+// the given TTL. If the pool is empty, peers are queried from the source synchronously.
+// Closing the returned RPS also closes the source.
+func NewCache(source RPS, size int, ttl time.Duration) RPS {
+	c := newCache(source, size, ttl, time.Now)
+	go c.prefetch()
+	return c
+}
+
+// newCache creates a cache without starting the prefetcher.
+func newCache(source RPS, size int, ttl time.Duration, now func() time.Time) *cache {
+	return &cache{
+		source: source,
+		size:   size,
+		ttl:    ttl,
+		now:    now,
+		wakeup: make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// prefetch is the goroutine keeping the pool filled.
+func (c *cache) prefetch() {
+	defer close(c.done)
+
+	for {
+		select {
+		case <-c.quit:
+			return
+		default:
+		}
+
+		if missing := c.missing(); missing > 0 {
+			peers, err := c.fetch(missing)
+			if err != nil {
+				if errors.Is(err, errInvalidPeer) {
+					continue // the RPS module just sampled a peer not running the onion module
+				}
+				log.Printf("Error prefetching peer: %v\n", err)
+				select {
+				case <-c.quit:
+					return
+				case <-time.After(prefetchRetryInterval):
+				}
+				continue
+			}
+			for _, peer := range peers {
+				c.put(peer)
+			}
+			continue
+		}
+
+		select {
+		case <-c.quit:
+			return
+		case <-c.wakeup:
+		case <-time.After(c.ttl): // check for expired peers
+		}
+	}
+}
+
+// fetch queries up to n peers from the source. Sources supporting pipelined queries are queried for all peers at once.
+func (c *cache) fetch(n int) (peers []*Peer, err error) {
+	if source, ok := c.source.(pipelinedSource); ok {
+		return source.getPeers(n)
+	}
+
+	peer, err := c.source.GetPeer()
+	if err != nil {
+		return nil, err
+	}
+	return []*Peer{peer}, nil
+}
+
+// full removes expired peers from the pool and checks whether it is full afterwards.
+func (c *cache) full() bool {
+	return c.missing() == 0
+}
+
+// missing removes expired peers from the pool and returns the number of peers required to fill it.
+func (c *cache) missing() int {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	c.expire()
+	if len(c.pool) >= c.size {
+		return 0
+	}
+	return c.size - len(c.pool)
+}
+
+// expire removes expired peers from the pool. c.l must be held.
+func (c *cache) expire() {
+	now := c.now()
+	valid := c.pool[:0]
+	for _, cp := range c.pool {
+		if now.Before(cp.expires) {
+			valid = append(valid, cp)
+		}
+	}
+	for i := len(valid); i < len(c.pool); i++ {
+		c.pool[i] = cachedPeer{}
+	}
+	c.pool = valid
+}
+
+// put adds a peer to the pool.
+func (c *cache) put(peer *Peer) {
+	c.l.Lock()
+	c.pool = append(c.pool, cachedPeer{
+		peer:    peer,
+		expires: c.now().Add(c.ttl),
+	})
+	c.l.Unlock()
+}
+
+// take removes the oldest valid peer from the pool. ok is false if the pool is empty.
+func (c *cache) take() (peer *Peer, ok bool) {
+	c.l.Lock()
+	c.expire()
+	if len(c.pool) > 0 {
+		peer = c.pool[0].peer
+		c.pool[0] = cachedPeer{}
+		c.pool = c.pool[1:]
+		ok = true
+	}
+	c.l.Unlock()
+
+	select {
+	case c.wakeup <- struct{}{}:
+	default: // prefetcher was already woken up
+	}
+
+	return peer, ok
+}
+
+// GetPeer returns a peer from the pool, or queries the source if the pool is empty.
+func (c *cache) GetPeer() (peer *Peer, err error) {
+	if peer, ok := c.take(); ok {
+		return peer, nil
+	}
+	return c.source.GetPeer()
+}
+
+// SampleIntermediatePeers samples n-1 distinct random peers, which are served from the pool if possible, followed by
+// target.
+func (c *cache) SampleIntermediatePeers(n int, target *Peer) (peers []*Peer, err error) {
+	return samplePeers(c.GetPeer, n, target)
+}
+
+// Check reports the health of the source, see Checker. Sources which do not report it are assumed to be healthy.
+func (c *cache) Check() error {
+	if checker, ok := c.source.(Checker); ok {
+		return checker.Check()
+	}
+	return nil
+}
+
+// Close stops prefetching and closes the source.
+func (c *cache) Close() {
+	close(c.quit)
+	c.source.Close()
+	<-c.done
+}
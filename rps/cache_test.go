@@ -0,0 +1,101 @@
+package rps
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingRPS hands out peers with increasing ports.
+type countingRPS struct {
+	l      sync.Mutex
+	next   uint16
+	fail   bool
+	closed bool
+}
+
+func (r *countingRPS) GetPeer() (peer *Peer, err error) {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if r.fail {
+		return nil, errors.New("rps unavailable")
+	}
+	r.next++
+	return &Peer{Address: net.IPv4(10, 0, 0, 1), Port: r.next}, nil
+}
+
+func (r *countingRPS) SampleIntermediatePeers(n int, target *Peer) (peers []*Peer, err error) {
+	return nil, errors.New("not implemented")
+}
+
+func (r *countingRPS) Close() {
+	r.l.Lock()
+	r.closed = true
+	r.l.Unlock()
+}
+
+func TestCache(t *testing.T) {
+	t.Run("take and expire", func(t *testing.T) {
+		source := &countingRPS{}
+		now := time.Now()
+		c := newCache(source, 2, time.Minute, func() time.Time { return now })
+
+		peer, _ := source.GetPeer()
+		c.put(peer)
+		peer, _ = source.GetPeer()
+		c.put(peer)
+		require.True(t, c.full())
+
+		// peers are served from the pool in order and only once
+		peer, err := c.GetPeer()
+		require.Nil(t, err)
+		assert.Equal(t, uint16(1), peer.Port)
+		require.False(t, c.full())
+
+		// expired peers are not served, the source is queried instead
+		now = now.Add(2 * time.Minute)
+		peer, err = c.GetPeer()
+		require.Nil(t, err)
+		assert.Equal(t, uint16(3), peer.Port)
+		assert.Empty(t, c.pool)
+	})
+
+	t.Run("prefetch", func(t *testing.T) {
+		source := &countingRPS{}
+		c := NewCache(source, 3, time.Minute).(*cache)
+
+		require.Eventually(t, c.full, time.Second, time.Millisecond)
+
+		target := &Peer{Port: 42}
+		peers, err := c.SampleIntermediatePeers(3, target)
+		require.Nil(t, err)
+		require.Len(t, peers, 3)
+		assert.Equal(t, uint16(1), peers[0].Port)
+		assert.Equal(t, uint16(2), peers[1].Port)
+		assert.Equal(t, target, peers[2])
+
+		// the pool is refilled
+		require.Eventually(t, c.full, time.Second, time.Millisecond)
+
+		c.Close()
+		assert.True(t, source.closed)
+	})
+
+	t.Run("source errors", func(t *testing.T) {
+		source := &countingRPS{fail: true}
+		c := NewCache(source, 3, time.Minute)
+		defer c.Close()
+
+		_, err := c.GetPeer()
+		require.NotNil(t, err)
+
+		_, err = c.SampleIntermediatePeers(1, nil)
+		require.NotNil(t, err)
+	})
+}
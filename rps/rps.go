@@ -13,10 +13,18 @@ import (
 
 	"bawang/api"
 	"bawang/config"
+	"bawang/errcode"
 )
 
+// maxPipelinedQueries is the max. number of queries sent to the RPS module before reading the replies, bounded by
+// the size of the message buffer.
+const maxPipelinedQueries = api.MaxSize / api.HeaderSize
+
 var (
-	errInvalidPeer = errors.New("invalid peer")
+	errInvalidPeer = errcode.New(errcode.ModuleRPS, errcode.NoPeers, true, "invalid peer")
+
+	// ErrNotEnoughPeers is returned if not enough distinct peers could be sampled for a tunnel.
+	ErrNotEnoughPeers = errcode.New(errcode.ModuleRPS, errcode.NoPeers, true, "not enough distinct peers available")
 )
 
 type Peer struct {
@@ -32,13 +40,23 @@ type RPS interface {
 	Close()
 }
 
+// Checker is implemented by RPS clients which report the health of their connection to the RPS module.
+type Checker interface {
+	Check() error // Check returns the error the connection failed with, nil if it is healthy.
+}
+
 type rps struct {
-	cfg *config.Config
+	cfg   *config.Config
+	local []*Peer // our own onion identities, which must not be sampled
 
 	l      sync.Mutex // guards fields below
 	msgBuf [api.MaxSize]byte
 	nc     net.Conn
 	rd     *bufio.Reader
+
+	// error of the last query of the RPS module, guarded by a lock of its own to not block on pending queries
+	errLock sync.Mutex
+	connErr error
 }
 
 func New(cfg *config.Config) (RPS, error) {
@@ -47,11 +65,22 @@ func New(cfg *config.Config) (RPS, error) {
 	}
 
 	r := &rps{
-		cfg: cfg,
+		cfg:   cfg,
+		local: localPeers(cfg),
 	}
 	if err := r.connect(); err != nil {
 		return nil, err
 	}
+
+	// relays only sample peers for the occasional check, e.g. of their reachability, which needs no prefetching
+	sampling := !cfg.RelayOnly
+	for _, identity := range cfg.Identities {
+		sampling = sampling || !identity.RelayOnly
+	}
+
+	if cfg.RPSCacheSize > 0 && sampling {
+		return NewCache(r, cfg.RPSCacheSize, time.Duration(cfg.RPSCacheTTL)*time.Second), nil
+	}
 	return r, nil
 }
 
@@ -71,6 +100,20 @@ func (r *rps) Close() {
 	}
 }
 
+// Check returns the error the last query of the RPS module failed with, e.g. because the connection was closed.
+func (r *rps) Check() error {
+	r.errLock.Lock()
+	defer r.errLock.Unlock()
+	return r.connErr
+}
+
+// setConnErr records the result of a query of the RPS module, see Check.
+func (r *rps) setConnErr(err error) {
+	r.errLock.Lock()
+	r.connErr = err
+	r.errLock.Unlock()
+}
+
 func (r *rps) GetPeer() (peer *Peer, err error) {
 	// concurrent IO not such a great idea
 	r.l.Lock()
@@ -86,11 +129,70 @@ func (r *rps) GetPeer() (peer *Peer, err error) {
 
 	data = data[:n]
 	_, err = r.nc.Write(data)
+	if err != nil {
+		r.setConnErr(err)
+		return nil, err
+	}
+
+	reply, err := r.readReply()
 	if err != nil {
 		return nil, err
 	}
+	return r.parsePeer(reply)
+}
 
-	// read reply
+// getPeers queries up to n peers in a pipelined fashion: All queries are sent at once before the replies are read,
+// such that only a single round trip to the RPS module is paid instead of n. The RPS API has no bulk query.
+// Invalid peers are skipped, thus fewer than n peers may be returned.
+func (r *rps) getPeers(n int) (peers []*Peer, err error) {
+	if n > maxPipelinedQueries {
+		n = maxPipelinedQueries
+	}
+	if n < 1 {
+		return nil, nil
+	}
+
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	// send queries
+	var query api.RPSQuery
+	data := r.msgBuf[:]
+	size := 0
+	for i := 0; i < n; i++ {
+		written, err := api.PackMessage(data[size:], &query)
+		if err != nil {
+			return nil, err
+		}
+		size += written
+	}
+
+	_, err = r.nc.Write(data[:size])
+	if err != nil {
+		r.setConnErr(err)
+		return nil, err
+	}
+
+	// read replies, which must all be consumed to keep the connection in sync
+	peers = make([]*Peer, 0, n)
+	for i := 0; i < n; i++ {
+		reply, err := r.readReply()
+		if err != nil {
+			return nil, err
+		}
+
+		peer, err := r.parsePeer(reply)
+		if err != nil {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+
+	return peers, nil
+}
+
+// readReply reads the reply to a query from the RPS module. r.l must be held.
+func (r *rps) readReply() (reply *api.RPSPeer, err error) {
 	replyDeadline := time.Now().Add(time.Duration(r.cfg.APITimeout) * time.Second)
 	err = r.nc.SetReadDeadline(replyDeadline)
 	if err != nil {
@@ -99,14 +201,18 @@ func (r *rps) GetPeer() (peer *Peer, err error) {
 
 	var hdr api.Header
 	err = hdr.Read(r.rd)
-	if err != nil || hdr.Type != api.TypeRPSPeer {
+	if err != nil {
+		r.setConnErr(err)
+	}
+	if err != nil || hdr.Type != api.TypeRPSPeer || hdr.Size < api.HeaderSize {
 		log.Print("invalid or no message received from rps module")
 		return nil, api.ErrInvalidMessage
 	}
 
-	var reply api.RPSPeer
-	data = r.msgBuf[:hdr.Size]
+	reply = new(api.RPSPeer)
+	data := r.msgBuf[:hdr.Size-api.HeaderSize]
 	_, err = io.ReadFull(r.rd, data)
+	r.setConnErr(err)
 	if err != nil {
 		log.Printf("Error reading message body: %v", err)
 		return nil, err
@@ -117,7 +223,12 @@ func (r *rps) GetPeer() (peer *Peer, err error) {
 		log.Printf("Error parsing message body: %v", err)
 		return nil, err
 	}
+	return reply, nil
+}
 
+// parsePeer converts a reply of the RPS module to a peer. errInvalidPeer is returned if the peer does not run the
+// onion module or is one of our own onion identities.
+func (r *rps) parsePeer(reply *api.RPSPeer) (peer *Peer, err error) {
 	port := reply.PortMap.Get(api.AppTypeOnion)
 	if port == 0 { // no Onion port
 		return nil, errInvalidPeer
@@ -132,22 +243,56 @@ func (r *rps) GetPeer() (peer *Peer, err error) {
 		log.Printf("Received peer with invalid host key from rps module: %v", err)
 		return nil, err
 	}
+	if peer.HostKey.N.BitLen() < r.cfg.MinHostKeyBits {
+		log.Printf("Received peer with %d bit host key from rps module, at least %d bits are required",
+			peer.HostKey.N.BitLen(), r.cfg.MinHostKeyBits)
+		return nil, errInvalidPeer
+	}
+	if r.cfg.MaxHostKeyBits > 0 && peer.HostKey.N.BitLen() > r.cfg.MaxHostKeyBits {
+		log.Printf("Received peer with %d bit host key from rps module, at most %d bits are allowed",
+			peer.HostKey.N.BitLen(), r.cfg.MaxHostKeyBits)
+		return nil, errInvalidPeer
+	}
+
+	// the RPS module might sample ourselves
+	if r.isLocal(peer) {
+		return nil, errInvalidPeer
+	}
 
 	return peer, nil
 }
 
+// SampleIntermediatePeers samples n-1 distinct random peers followed by target. The peers are queried in a single
+// pipelined batch, only replacements for invalid or duplicate peers are queried one by one.
 func (r *rps) SampleIntermediatePeers(n int, target *Peer) (peers []*Peer, err error) {
-	if n < 2 {
-		return nil, errors.New("invalid number of hops")
+	batch, err := r.getPeers(n - 1)
+	if err != nil {
+		return nil, err
+	}
+	return samplePeers(prefetched(batch, r.GetPeer), n, target)
+}
+
+// isLocal checks whether the given peer is one of our own onion identities.
+func (r *rps) isLocal(peer *Peer) bool {
+	for _, local := range r.local {
+		if samePeer(local, peer) {
+			return true
+		}
 	}
+	return false
+}
 
-	peers = make([]*Peer, n)
-	for i := 0; i < n-1; i++ {
-		peers[i], err = r.GetPeer()
-		if err != nil {
-			return nil, err
+// localPeers returns the peers of all onion identities configured in cfg.
+func localPeers(cfg *config.Config) (peers []*Peer) {
+	for _, identity := range append([]*config.Config{cfg}, cfg.Identities...) {
+		peer := &Peer{
+			Address: net.ParseIP(identity.P2PHostname),
+			Port:    uint16(identity.P2PPort),
 		}
+		if identity.HostKey != nil {
+			peer.HostKey = &identity.HostKey.PublicKey
+		}
+		peers = append(peers, peer)
 	}
-	peers[n-1] = target
-	return peers, nil
+	return peers
 }
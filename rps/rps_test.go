@@ -0,0 +1,201 @@
+package rps
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/api"
+	"bawang/config"
+)
+
+func TestRPSCheck(t *testing.T) {
+	connLocal, connRemote := net.Pipe()
+	r := &rps{
+		cfg: &config.Config{APITimeout: 1},
+		nc:  connLocal,
+		rd:  bufio.NewReader(connLocal),
+	}
+	assert.Nil(t, r.Check())
+
+	// the RPS module closed the connection
+	connRemote.Close()
+	_, err := r.GetPeer()
+	require.NotNil(t, err)
+	assert.NotNil(t, r.Check())
+
+	// the cache reports the health of its source
+	c := newCache(r, 1, 0, nil)
+	assert.Equal(t, r.Check(), c.Check())
+	assert.Nil(t, newCache(&countingRPS{}, 1, 0, nil).Check())
+}
+
+func TestRPSNew(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	newRPS := func(t *testing.T, cfg *config.Config) RPS {
+		cfg.RPSAPIAddress = ln.Addr().String()
+		cfg.RPSCacheSize = 10
+		cfg.RPSCacheTTL = 60
+		r, err := New(cfg)
+		require.Nil(t, err)
+		t.Cleanup(r.Close)
+		return r
+	}
+
+	t.Run("cache", func(t *testing.T) {
+		assert.IsType(t, &cache{}, newRPS(t, &config.Config{APITimeout: 1}))
+	})
+
+	t.Run("relay only", func(t *testing.T) {
+		// relays do not sample paths and thus need no prefetched peers
+		assert.IsType(t, &rps{}, newRPS(t, &config.Config{APITimeout: 1, RelayOnly: true}))
+	})
+
+	t.Run("relay only with other identity", func(t *testing.T) {
+		cfg := &config.Config{APITimeout: 1, RelayOnly: true, Identities: []*config.Config{{}}}
+		assert.IsType(t, &cache{}, newRPS(t, cfg))
+	})
+}
+
+// rpsPeerReply packs an RPS PEER message announcing the given onion port, 0 = no onion port.
+func rpsPeerReply(t *testing.T, onionPort uint16, hostKey *rsa.PublicKey) []byte {
+	body := []byte{0x00, 0x01, 0x00, 0x00, 10, 0, 0, 1}
+	if onionPort != 0 {
+		var mapping [4]byte
+		binary.BigEndian.PutUint16(mapping[:], uint16(api.AppTypeOnion))
+		binary.BigEndian.PutUint16(mapping[2:], onionPort)
+		body = append(append(body[:4:4], mapping[:]...), body[4:]...)
+		body[2] = 1
+	}
+	body = append(body, x509.MarshalPKCS1PublicKey(hostKey)...)
+
+	var msg api.RPSPeer
+	require.Nil(t, msg.Parse(body))
+	buf := make([]byte, api.MaxSize)
+	n, err := api.PackMessage(buf, &msg)
+	require.Nil(t, err)
+	return buf[:n]
+}
+
+// serveRPS answers each query received on conn with the next of the given replies. Queries and replies are handled
+// independently, such that pipelined queries do not block.
+func serveRPS(conn net.Conn, replies [][]byte) (queries chan struct{}) {
+	queries = make(chan struct{}, len(replies))
+	go func() {
+		rd := bufio.NewReader(conn)
+		for {
+			var hdr api.Header
+			if hdr.Read(rd) != nil {
+				close(queries)
+				return
+			}
+			queries <- struct{}{}
+		}
+	}()
+	go func() {
+		for _, reply := range replies {
+			if _, ok := <-queries; !ok {
+				return
+			}
+			if _, err := conn.Write(reply); err != nil {
+				return
+			}
+		}
+	}()
+	return queries
+}
+
+func TestRPSPipelinedQueries(t *testing.T) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+
+	newRPS := func(replies ...[]byte) *rps {
+		connLocal, connRemote := net.Pipe()
+		t.Cleanup(func() { connRemote.Close() })
+		serveRPS(connRemote, replies)
+		return &rps{
+			cfg: &config.Config{APITimeout: 1},
+			nc:  connLocal,
+			rd:  bufio.NewReader(connLocal),
+		}
+	}
+
+	t.Run("invalid peers are skipped", func(t *testing.T) {
+		r := newRPS(
+			rpsPeerReply(t, 1, &hostKey.PublicKey),
+			rpsPeerReply(t, 0, &hostKey.PublicKey),
+			rpsPeerReply(t, 3, &otherKey.PublicKey),
+		)
+		peers, err := r.getPeers(3)
+		require.Nil(t, err)
+		require.Len(t, peers, 2)
+		assert.Equal(t, uint16(1), peers[0].Port)
+		assert.Equal(t, uint16(3), peers[1].Port)
+
+		// the connection is still in sync
+		peers, err = r.getPeers(0)
+		require.Nil(t, err)
+		assert.Empty(t, peers)
+	})
+
+	t.Run("weak host keys", func(t *testing.T) {
+		r := newRPS(
+			rpsPeerReply(t, 1, &hostKey.PublicKey),
+		)
+		r.cfg.MinHostKeyBits = 2048
+		peers, err := r.getPeers(1)
+		require.Nil(t, err)
+		assert.Empty(t, peers)
+	})
+
+	t.Run("large host keys", func(t *testing.T) {
+		r := newRPS(
+			rpsPeerReply(t, 1, &hostKey.PublicKey),
+		)
+		r.cfg.MaxHostKeyBits = 768
+		peers, err := r.getPeers(1)
+		require.Nil(t, err)
+		assert.Empty(t, peers)
+	})
+
+	t.Run("sample intermediate peers", func(t *testing.T) {
+		target := &Peer{Address: net.IPv4(10, 0, 0, 2), Port: 1}
+		thirdKey, err := rsa.GenerateKey(rand.Reader, 1024)
+		require.Nil(t, err)
+
+		// the duplicate peer of the batch is replaced by a single query
+		r := newRPS(
+			rpsPeerReply(t, 1, &hostKey.PublicKey),
+			rpsPeerReply(t, 1, &hostKey.PublicKey),
+			rpsPeerReply(t, 2, &otherKey.PublicKey),
+			rpsPeerReply(t, 3, &thirdKey.PublicKey),
+		)
+		peers, err := r.SampleIntermediatePeers(4, target)
+		require.Nil(t, err)
+		require.Len(t, peers, 4)
+		assert.Equal(t, uint16(1), peers[0].Port)
+		assert.Equal(t, uint16(2), peers[1].Port)
+		assert.Equal(t, uint16(3), peers[2].Port)
+		assert.Equal(t, target, peers[3])
+	})
+
+	t.Run("connection closed", func(t *testing.T) {
+		r := newRPS()
+		r.nc.Close()
+		_, err := r.getPeers(2)
+		require.NotNil(t, err)
+		assert.NotNil(t, r.Check())
+	})
+}
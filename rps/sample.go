@@ -0,0 +1,72 @@
+package rps
+
+import (
+	"errors"
+)
+
+// maxSampleRetries is the number of additional peers which may be queried when sampling the intermediate peers of a
+// tunnel, if a sampled peer is invalid or was sampled before.
+const maxSampleRetries = 10
+
+// samplePeers samples n-1 distinct random peers using getPeer, followed by the target peer.
+// Peers equal to the target or to a previously sampled peer are discarded and replaced by querying another one.
+// If no n-1 distinct peers are found within the retry budget, ErrNotEnoughPeers is returned.
+func samplePeers(getPeer func() (*Peer, error), n int, target *Peer) (peers []*Peer, err error) {
+	if n < 2 {
+		return nil, errors.New("invalid number of hops")
+	}
+
+	peers = make([]*Peer, 0, n)
+	retries := 0
+	for len(peers) < n-1 {
+		peer, err := getPeer()
+		if err == nil && !samePeer(peer, target) && !containsPeer(peers, peer) {
+			peers = append(peers, peer)
+			continue
+		}
+		if err != nil && !errors.Is(err, errInvalidPeer) {
+			return nil, err
+		}
+
+		retries++
+		if retries > maxSampleRetries {
+			return nil, ErrNotEnoughPeers
+		}
+	}
+
+	peers = append(peers, target)
+	return peers, nil
+}
+
+// prefetched returns a getPeer func handing out the given peers first, before falling back to getPeer.
+func prefetched(peers []*Peer, getPeer func() (*Peer, error)) func() (*Peer, error) {
+	return func() (*Peer, error) {
+		if len(peers) == 0 {
+			return getPeer()
+		}
+		peer := peers[0]
+		peers = peers[1:]
+		return peer, nil
+	}
+}
+
+// containsPeer checks whether peers contains a peer equal to peer.
+func containsPeer(peers []*Peer, peer *Peer) bool {
+	for _, p := range peers {
+		if samePeer(p, peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// samePeer checks whether two peers are the same node, i.e. whether they have the same host key or P2P address.
+func samePeer(a, b *Peer) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	if a.HostKey != nil && b.HostKey != nil && a.HostKey.E == b.HostKey.E && a.HostKey.N.Cmp(b.HostKey.N) == 0 {
+		return true
+	}
+	return a.Address != nil && a.Address.Equal(b.Address) && a.Port == b.Port
+}
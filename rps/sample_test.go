@@ -0,0 +1,83 @@
+package rps
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+)
+
+// sequence returns a getPeer func handing out the given peers in order.
+func sequence(peers ...*Peer) func() (*Peer, error) {
+	return func() (*Peer, error) {
+		if len(peers) == 0 {
+			return nil, errInvalidPeer
+		}
+		peer := peers[0]
+		peers = peers[1:]
+		return peer, nil
+	}
+}
+
+func TestSamplePeers(t *testing.T) {
+	peerA := &Peer{Address: net.IPv4(10, 0, 0, 1), Port: 1}
+	peerB := &Peer{Address: net.IPv4(10, 0, 0, 1), Port: 2}
+	target := &Peer{Address: net.IPv4(10, 0, 0, 2), Port: 1}
+
+	t.Run("duplicates are re-queried", func(t *testing.T) {
+		peers, err := samplePeers(sequence(peerA, peerA, target, peerB), 3, target)
+		require.Nil(t, err)
+		assert.Equal(t, []*Peer{peerA, peerB, target}, peers)
+	})
+
+	t.Run("same host key", func(t *testing.T) {
+		hostKey, err := rsa.GenerateKey(rand.Reader, 1024)
+		require.Nil(t, err)
+		a := &Peer{Address: net.IPv4(10, 0, 0, 3), Port: 1, HostKey: &hostKey.PublicKey}
+		b := &Peer{Address: net.IPv4(10, 0, 0, 4), Port: 1, HostKey: &hostKey.PublicKey}
+
+		peers, err := samplePeers(sequence(a, b, peerA), 3, target)
+		require.Nil(t, err)
+		assert.Equal(t, []*Peer{a, peerA, target}, peers)
+	})
+
+	t.Run("retry budget", func(t *testing.T) {
+		_, err := samplePeers(sequence(peerA), 3, target)
+		assert.True(t, errors.Is(err, ErrNotEnoughPeers))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		errRPS := errors.New("rps unavailable")
+		_, err := samplePeers(func() (*Peer, error) { return nil, errRPS }, 3, target)
+		assert.Equal(t, errRPS, err)
+
+		_, err = samplePeers(sequence(peerA), 1, target)
+		assert.NotNil(t, err)
+	})
+}
+
+func TestRPSIsLocal(t *testing.T) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+	identityKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+	r := &rps{local: localPeers(&config.Config{
+		P2PHostname: "10.0.0.1",
+		P2PPort:     6303,
+		HostKey:     hostKey,
+		Identities: []*config.Config{
+			{P2PHostname: "10.0.0.1", P2PPort: 6304, HostKey: identityKey},
+		},
+	})}
+
+	assert.True(t, r.isLocal(&Peer{Address: net.IPv4(10, 0, 0, 1), Port: 6303}))
+	assert.True(t, r.isLocal(&Peer{Address: net.IPv4(10, 0, 0, 9), Port: 1, HostKey: &hostKey.PublicKey}))
+	assert.True(t, r.isLocal(&Peer{Address: net.IPv4(10, 0, 0, 1), Port: 6304}))
+	assert.False(t, r.isLocal(&Peer{Address: net.IPv4(10, 0, 0, 1), Port: 6305}))
+}
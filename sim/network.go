@@ -0,0 +1,446 @@
+// Package sim simulates a network of onion peers, whose Links are backed by in-memory connections with configurable
+// latency, jitter, reordering and loss, to study how tunnel builds and rounds behave under adverse network conditions
+// without a lab network, see Network and Scenario.
+package sim
+
+import (
+	"container/heap"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"bawang/onion"
+)
+
+var (
+	ErrConnRefused   = errors.New("connection refused")
+	ErrAddressInUse  = errors.New("address already in use")
+	ErrNetworkClosed = errors.New("network closed")
+)
+
+// readyBufferSize is the number of delivered messages buffered per direction of a connection until they are read.
+const readyBufferSize = 64
+
+// firstEphemeralPort is the first local port assigned to dialed connections, like an operating system would.
+const firstEphemeralPort = 40000
+
+// Conditions of the simulated network between two peers, applied to every message in either direction. Each message
+// is a single write on the connection, which for Links is always a whole P2P message.
+type Conditions struct {
+	Latency time.Duration // one-way delay of every message, connecting takes a round trip
+	Jitter  time.Duration // max. additional random delay of every message
+	Loss    float64       // probability of a message being dropped
+	Reorder float64       // probability of a message being held back by another Latency, such that later ones overtake it
+}
+
+// Network is a simulated network connecting the Transports of its peers. Messages are delivered in the order they
+// were sent unless the Conditions say otherwise.
+type Network struct {
+	lock       sync.Mutex
+	rand       *rand.Rand // decides the fate of each message, seeded for reproducible runs
+	conditions Conditions // between all peers without conditions of their own
+	links      map[[2]string]Conditions
+	listeners  map[string]*listener // by address host:port
+	conns      []*conn
+	nextPort   int
+	closed     bool
+}
+
+// NewNetwork creates a simulated network with the given conditions between all peers. The randomness deciding the
+// fate of each message is seeded with seed.
+func NewNetwork(conditions Conditions, seed int64) *Network {
+	return &Network{
+		rand:       rand.New(rand.NewSource(seed)), //nolint:gosec // simulations must be reproducible
+		conditions: conditions,
+		links:      make(map[[2]string]Conditions),
+		listeners:  make(map[string]*listener),
+		nextPort:   firstEphemeralPort,
+	}
+}
+
+// SetConditions overrides the conditions between the peers with the given IP addresses in both directions.
+func (n *Network) SetConditions(a, b net.IP, conditions Conditions) {
+	n.lock.Lock()
+	n.links[linkKey(a, b)] = conditions
+	n.lock.Unlock()
+}
+
+// linkKey returns the key of the conditions between two peers, which is the same for both directions.
+func linkKey(a, b net.IP) [2]string {
+	if a.String() > b.String() {
+		a, b = b, a
+	}
+	return [2]string{a.String(), b.String()}
+}
+
+// linkConditions returns the conditions between the peers with the given IP addresses.
+func (n *Network) linkConditions(a, b net.IP) Conditions {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if conditions, ok := n.links[linkKey(a, b)]; ok {
+		return conditions
+	}
+	return n.conditions
+}
+
+// delay decides the fate of a message sent under the given conditions, returning false if it is lost.
+func (n *Network) delay(conditions Conditions) (delay time.Duration, ok bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if conditions.Loss > 0 && n.rand.Float64() < conditions.Loss {
+		return 0, false
+	}
+	delay = conditions.Latency
+	if conditions.Jitter > 0 {
+		delay += time.Duration(n.rand.Int63n(int64(conditions.Jitter) + 1))
+	}
+	if conditions.Reorder > 0 && n.rand.Float64() < conditions.Reorder {
+		delay += conditions.Latency
+	}
+	return delay, true
+}
+
+// Transport returns the onion.Transport of the peer with the given IP address.
+func (n *Network) Transport(address net.IP) onion.Transport {
+	return &transport{network: n, address: address}
+}
+
+// Close closes all listeners and connections of the network.
+func (n *Network) Close() {
+	n.lock.Lock()
+	n.closed = true
+	listeners := n.listeners
+	conns := n.conns
+	n.listeners = make(map[string]*listener)
+	n.conns = nil
+	n.lock.Unlock()
+
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// transport is the onion.Transport of a single peer of a Network.
+type transport struct {
+	network *Network
+	address net.IP
+}
+
+// DialPeer connects to the listener of the peer given by address:port, which takes a round trip.
+func (t *transport) DialPeer(address net.IP, port uint16) (net.Conn, error) {
+	n := t.network
+	remote := net.JoinHostPort(address.String(), strconv.Itoa(int(port)))
+	conditions := n.linkConditions(t.address, address)
+
+	n.lock.Lock()
+	if n.closed {
+		n.lock.Unlock()
+		return nil, ErrNetworkClosed
+	}
+	ln, ok := n.listeners[remote]
+	localPort := n.nextPort
+	n.nextPort++
+	n.lock.Unlock()
+	if !ok {
+		return nil, ErrConnRefused
+	}
+
+	time.Sleep(2 * conditions.Latency)
+
+	local := &net.TCPAddr{IP: t.address, Port: localPort}
+	dialed, accepted := newConnPair(n, conditions, local, &net.TCPAddr{IP: address, Port: int(port)})
+	select {
+	case ln.conns <- accepted:
+	case <-ln.closed:
+		return nil, ErrConnRefused
+	}
+
+	n.lock.Lock()
+	n.conns = append(n.conns, dialed, accepted)
+	n.lock.Unlock()
+	return dialed, nil
+}
+
+// Listen accepts connections dialed to the given address, which must be of the form host:port.
+func (t *transport) Listen(address string) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	portParsed, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	ln := &listener{
+		network: t.network,
+		addr:    &net.TCPAddr{IP: net.ParseIP(host), Port: int(portParsed)},
+		conns:   make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+
+	n := t.network
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closed {
+		return nil, ErrNetworkClosed
+	}
+	if _, ok := n.listeners[ln.addr.String()]; ok {
+		return nil, ErrAddressInUse
+	}
+	n.listeners[ln.addr.String()] = ln
+	return ln, nil
+}
+
+// listener is a net.Listener of a Network.
+type listener struct {
+	network   *Network
+	addr      *net.TCPAddr
+	conns     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Accept waits for the next dialed connection.
+func (ln *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ln.conns:
+		return c, nil
+	case <-ln.closed:
+		return nil, ErrNetworkClosed
+	}
+}
+
+// Close stops accepting connections and frees the address.
+func (ln *listener) Close() error {
+	ln.closeOnce.Do(func() {
+		close(ln.closed)
+
+		n := ln.network
+		n.lock.Lock()
+		if n.listeners[ln.addr.String()] == ln {
+			delete(n.listeners, ln.addr.String())
+		}
+		n.lock.Unlock()
+	})
+	return nil
+}
+
+// Addr returns the address the listener accepts connections on.
+func (ln *listener) Addr() net.Addr {
+	return ln.addr
+}
+
+// message is a write on a connection scheduled for delivery.
+type message struct {
+	data []byte
+	at   time.Time // time of delivery
+	seq  uint64    // order of sending, breaks ties between messages delivered at the same time
+}
+
+// schedule is a priority queue of messages by the time of their delivery, see container/heap.
+type schedule []*message
+
+func (s schedule) Len() int { return len(s) }
+func (s schedule) Less(i, j int) bool {
+	return s[i].at.Before(s[j].at) || (s[i].at.Equal(s[j].at) && s[i].seq < s[j].seq)
+}
+func (s schedule) Swap(i, j int)       { s[i], s[j] = s[j], s[i] }
+func (s *schedule) Push(x interface{}) { *s = append(*s, x.(*message)) }
+func (s *schedule) Pop() interface{} {
+	old := *s
+	msg := old[len(old)-1]
+	*s = old[:len(old)-1]
+	return msg
+}
+
+// pipe is a single direction of a connection, delivering the messages written to it according to the conditions.
+type pipe struct {
+	network    *Network
+	conditions Conditions
+
+	lock    sync.Mutex // guards pending and seq
+	pending schedule
+	seq     uint64
+
+	wake      chan struct{} // signals the delivering goroutine that a message was scheduled
+	ready     chan []byte   // delivered messages in the order they are read
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// newPipe creates a pipe and starts delivering the messages written to it.
+func newPipe(network *Network, conditions Conditions) *pipe {
+	p := &pipe{
+		network:    network,
+		conditions: conditions,
+		wake:       make(chan struct{}, 1),
+		ready:      make(chan []byte, readyBufferSize),
+		closed:     make(chan struct{}),
+	}
+	go p.deliver()
+	return p
+}
+
+// write schedules a copy of data for delivery, unless it is lost.
+func (p *pipe) write(data []byte) {
+	delay, ok := p.network.delay(p.conditions)
+	if !ok {
+		return
+	}
+
+	p.lock.Lock()
+	p.seq++
+	heap.Push(&p.pending, &message{
+		data: append([]byte(nil), data...),
+		at:   time.Now().Add(delay),
+		seq:  p.seq,
+	})
+	p.lock.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver is the goroutine passing the scheduled messages to the reader once they are due.
+func (p *pipe) deliver() {
+	for {
+		var due <-chan time.Time
+		p.lock.Lock()
+		if len(p.pending) > 0 {
+			if wait := time.Until(p.pending[0].at); wait > 0 {
+				timer := time.NewTimer(wait)
+				defer timer.Stop()
+				due = timer.C
+			} else {
+				msg := heap.Pop(&p.pending).(*message)
+				p.lock.Unlock()
+				select {
+				case p.ready <- msg.data:
+				case <-p.closed:
+					return
+				}
+				continue
+			}
+		}
+		p.lock.Unlock()
+
+		select {
+		case <-due:
+		case <-p.wake:
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+// close stops the delivery, messages not delivered yet are lost.
+func (p *pipe) close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+}
+
+// conn is one end of a connection of a Network.
+type conn struct {
+	local, remote net.Addr
+	in, out       *pipe
+
+	readLock     sync.Mutex // guards buf and readDeadline
+	buf          []byte     // rest of the message read partially
+	readDeadline time.Time
+}
+
+// newConnPair creates both ends of a connection between the given addresses.
+func newConnPair(network *Network, conditions Conditions, local, remote net.Addr) (dialed, accepted *conn) {
+	forward, backward := newPipe(network, conditions), newPipe(network, conditions)
+	dialed = &conn{local: local, remote: remote, in: backward, out: forward}
+	accepted = &conn{local: remote, remote: local, in: forward, out: backward}
+	return dialed, accepted
+}
+
+// Read reads the messages delivered to this end of the connection. Like with TCP, the boundaries of the messages are
+// not preserved.
+func (c *conn) Read(b []byte) (n int, err error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	if len(c.buf) == 0 {
+		var timeout <-chan time.Time
+		if !c.readDeadline.IsZero() {
+			timer := time.NewTimer(time.Until(c.readDeadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case c.buf = <-c.in.ready:
+		case <-c.in.closed:
+			return 0, io.EOF
+		case <-timeout:
+			return 0, timeoutError{}
+		}
+	}
+
+	n = copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// Write sends b as a single message to the other end of the connection.
+func (c *conn) Write(b []byte) (n int, err error) {
+	select {
+	case <-c.out.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	c.out.write(b)
+	return len(b), nil
+}
+
+// Close closes both directions of the connection.
+func (c *conn) Close() error {
+	c.in.close()
+	c.out.close()
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+// SetDeadline sets the read deadline, writes never block.
+func (c *conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for pending and future reads, the zero value disables it.
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.readLock.Lock()
+	c.readDeadline = t
+	c.readLock.Unlock()
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes never block.
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// timeoutError is returned by reads exceeding the deadline, see net.Error.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
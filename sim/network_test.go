@@ -0,0 +1,150 @@
+package sim
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connect returns both ends of a connection between two peers of the network.
+func connect(t *testing.T, network *Network) (dialed, accepted net.Conn) {
+	ln, err := network.Transport(PeerAddress(1)).Listen("10.0.0.1:4000")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	accepted1 := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted1 <- conn
+		}
+	}()
+
+	dialed, err = network.Transport(PeerAddress(0)).DialPeer(PeerAddress(1), 4000)
+	require.Nil(t, err)
+	return dialed, <-accepted1
+}
+
+// readMessages reads n one byte messages or until the read deadline passes.
+func readMessages(conn net.Conn, n int, timeout time.Duration) (msgs []byte) {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1)
+	for len(msgs) < n {
+		if _, err := conn.Read(buf); err != nil {
+			break
+		}
+		msgs = append(msgs, buf[0])
+	}
+	return msgs
+}
+
+func TestNetwork(t *testing.T) {
+	t.Run("dial", func(t *testing.T) {
+		network := NewNetwork(Conditions{}, 1)
+		defer network.Close()
+
+		_, err := network.Transport(PeerAddress(0)).DialPeer(PeerAddress(1), 4000)
+		assert.Equal(t, ErrConnRefused, err)
+
+		dialed, accepted := connect(t, network)
+		assert.Equal(t, &net.TCPAddr{IP: PeerAddress(1), Port: 4000}, dialed.RemoteAddr())
+		assert.Equal(t, dialed.LocalAddr(), accepted.RemoteAddr())
+		assert.Equal(t, PeerAddress(0), accepted.RemoteAddr().(*net.TCPAddr).IP)
+
+		_, err = network.Transport(PeerAddress(1)).Listen("10.0.0.1:4000")
+		require.Nil(t, err)
+		_, err = network.Transport(PeerAddress(1)).Listen("10.0.0.1:4000")
+		assert.Equal(t, ErrAddressInUse, err)
+	})
+
+	t.Run("order", func(t *testing.T) {
+		network := NewNetwork(Conditions{}, 1)
+		defer network.Close()
+		dialed, accepted := connect(t, network)
+
+		_, err := dialed.Write([]byte("hello"))
+		require.Nil(t, err)
+		_, err = dialed.Write([]byte(" world"))
+		require.Nil(t, err)
+
+		buf := make([]byte, 11)
+		_, err = io.ReadFull(accepted, buf)
+		require.Nil(t, err)
+		assert.Equal(t, "hello world", string(buf))
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		network := NewNetwork(Conditions{Latency: 20 * time.Millisecond, Jitter: 10 * time.Millisecond}, 1)
+		defer network.Close()
+		dialed, accepted := connect(t, network)
+
+		start := time.Now()
+		_, err := accepted.Write([]byte{1})
+		require.Nil(t, err)
+		assert.Equal(t, []byte{1}, readMessages(dialed, 1, time.Second))
+		assert.True(t, time.Since(start) >= 20*time.Millisecond)
+	})
+
+	t.Run("loss", func(t *testing.T) {
+		network := NewNetwork(Conditions{Loss: 1}, 1)
+		defer network.Close()
+		dialed, accepted := connect(t, network)
+
+		_, err := dialed.Write([]byte{1})
+		require.Nil(t, err)
+		_ = accepted.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		_, err = accepted.Read(make([]byte, 1))
+		require.NotNil(t, err)
+		netErr, ok := err.(net.Error)
+		require.True(t, ok)
+		assert.True(t, netErr.Timeout())
+	})
+
+	t.Run("reorder", func(t *testing.T) {
+		network := NewNetwork(Conditions{Latency: 10 * time.Millisecond, Reorder: 0.5}, 1)
+		defer network.Close()
+		dialed, accepted := connect(t, network)
+
+		sent := make([]byte, 20)
+		for i := range sent {
+			sent[i] = byte(i)
+			_, err := dialed.Write(sent[i : i+1])
+			require.Nil(t, err)
+		}
+
+		received := readMessages(accepted, len(sent), time.Second)
+		assert.ElementsMatch(t, sent, received)
+		assert.NotEqual(t, sent, received)
+	})
+
+	t.Run("conditions", func(t *testing.T) {
+		network := NewNetwork(Conditions{}, 1)
+		defer network.Close()
+		network.SetConditions(PeerAddress(1), PeerAddress(0), Conditions{Loss: 1})
+		dialed, accepted := connect(t, network)
+
+		_, err := accepted.Write([]byte{1})
+		require.Nil(t, err)
+		assert.Empty(t, readMessages(dialed, 1, 20*time.Millisecond))
+	})
+
+	t.Run("close", func(t *testing.T) {
+		network := NewNetwork(Conditions{}, 1)
+		defer network.Close()
+		dialed, accepted := connect(t, network)
+
+		require.Nil(t, accepted.Close())
+		_, err := dialed.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+		_, err = dialed.Write([]byte{1})
+		assert.Equal(t, io.ErrClosedPipe, err)
+
+		network.Close()
+		_, err = network.Transport(PeerAddress(0)).Listen("10.0.0.0:4000")
+		assert.Equal(t, ErrNetworkClosed, err)
+	})
+}
@@ -0,0 +1,78 @@
+package sim
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+
+	"bawang/rps"
+)
+
+// peerSampler is the rps.RPS of a simulated peer, sampling uniformly from all other peers of the scenario.
+type peerSampler struct {
+	lock  sync.Mutex // guards rand
+	rand  *rand.Rand
+	peers []*rps.Peer // all other peers
+}
+
+// newPeerSampler creates the rps.RPS of the peer with the given index.
+func newPeerSampler(peers []*rps.Peer, self int, seed int64) *peerSampler {
+	others := make([]*rps.Peer, 0, len(peers)-1)
+	for i, peer := range peers {
+		if i != self {
+			others = append(others, peer)
+		}
+	}
+	return &peerSampler{
+		rand:  rand.New(rand.NewSource(seed)), //nolint:gosec // simulations must be reproducible
+		peers: others,
+	}
+}
+
+// copyPeer returns a copy of peer, since the Router stores the shared DH secret of each hop in the sampled peer.
+func copyPeer(peer *rps.Peer) *rps.Peer {
+	return &rps.Peer{
+		Port:    peer.Port,
+		Address: peer.Address,
+		HostKey: peer.HostKey,
+	}
+}
+
+// GetPeer returns a random other peer.
+func (s *peerSampler) GetPeer() (peer *rps.Peer, err error) {
+	if len(s.peers) == 0 {
+		return nil, rps.ErrNotEnoughPeers
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return copyPeer(s.peers[s.rand.Intn(len(s.peers))]), nil
+}
+
+// SampleIntermediatePeers returns n-1 distinct random other peers except the target, followed by the target.
+func (s *peerSampler) SampleIntermediatePeers(n int, target *rps.Peer) (peers []*rps.Peer, err error) {
+	if n < 2 {
+		return nil, errors.New("invalid number of hops")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, i := range s.rand.Perm(len(s.peers)) {
+		if len(peers) == n-1 {
+			break
+		}
+		peer := s.peers[i]
+		if peer.Address.Equal(target.Address) && peer.Port == target.Port {
+			continue
+		}
+		peers = append(peers, copyPeer(peer))
+	}
+	if len(peers) < n-1 {
+		return nil, rps.ErrNotEnoughPeers
+	}
+	return append(peers, target), nil
+}
+
+// Close does nothing, there is no connection to an RPS module.
+func (s *peerSampler) Close() {}
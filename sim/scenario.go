@@ -0,0 +1,238 @@
+package sim
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	mathRand "math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"bawang/config"
+	"bawang/onion"
+	"bawang/rps"
+)
+
+const (
+	hostKeyBits   = 4096                   // size of the host keys, the one supported by all peers
+	simulatedPort = 4000                   // P2P port of all simulated peers, which are told apart by their IP addresses
+	restartDelay  = 100 * time.Millisecond // time to wait before restarting the round logic after an error
+
+	// roundDuration is the configured round duration of the simulated peers, long enough to never elapse, since the
+	// scenario runner starts the rounds itself.
+	roundDuration = 24 * 60 * 60
+)
+
+var ErrInvalidScenario = errors.New("invalid scenario")
+
+// Scenario describes a simulation run, in which the first peer builds tunnels through the other peers.
+type Scenario struct {
+	Peers        int        // number of simulated peers, at least TunnelLength + 1
+	TunnelLength int        // number of hops of each tunnel, see config.Config
+	Rounds       int        // number of rounds to simulate
+	Tunnels      int        // number of tunnels the first peer builds per round
+	BuildTimeout int        // time in seconds to wait for each hop to respond, see config.Config
+	Conditions   Conditions // between all peers, see Network.SetConditions to override them between specific peers
+	Seed         int64      // seeds the randomness of the network and the peers, for reproducible runs
+	Logger       *log.Logger
+
+	// Host keys of the peers by index, reused across runs since generating them takes a while.
+	// Keys are generated for the remaining peers.
+	HostKeys []*rsa.PrivateKey
+
+	// Setup is called with the network before any peer is started, e.g. to set the conditions between specific peers.
+	// The simulated peer with index i has the IP address returned by PeerAddress(i).
+	Setup func(network *Network)
+}
+
+// Result of a simulation run.
+type Result struct {
+	Builds      int             // number of tunnels built successfully
+	Failed      int             // number of tunnels which failed or were not built within the time limit of the round
+	BuildTimes  []time.Duration // time each successful build took, tunnels of a round are built one after another
+	RoundErrors []error         // errors of the round logic of the first peer, e.g. failed cover tunnel builds
+}
+
+// PeerAddress returns the IP address of the simulated peer with the given index.
+func PeerAddress(i int) net.IP {
+	return net.IPv4(10, 0, byte(i/256), byte(i%256))
+}
+
+// simPeer is a simulated peer.
+type simPeer struct {
+	cfg    *config.Config
+	router *onion.Router
+}
+
+// Run simulates the given Scenario on a new Network. The first peer requests Tunnels new tunnels per round, each to a
+// random other peer, and tears them down right after they were built. Only the first peer runs the round logic.
+// An error is returned if the simulation could not be set up. Failed builds are merely counted in the Result.
+func Run(s Scenario) (result Result, err error) {
+	if s.Peers < s.TunnelLength+1 || s.Rounds < 1 || s.BuildTimeout < 1 {
+		return result, fmt.Errorf("%w: %d peers, %d rounds, build timeout %d", ErrInvalidScenario, s.Peers, s.Rounds,
+			s.BuildTimeout)
+	}
+	if s.Logger == nil {
+		s.Logger = log.New(ioutil.Discard, "", 0)
+	}
+
+	network := NewNetwork(s.Conditions, s.Seed)
+	if s.Setup != nil {
+		s.Setup(network)
+	}
+
+	peers, rpsPeers, err := newPeers(s)
+	if err != nil {
+		return result, err
+	}
+
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(quit)
+		network.Close()
+		wg.Wait()
+	}()
+
+	random := mathRand.New(mathRand.NewSource(s.Seed)) //nolint:gosec // simulations must be reproducible
+	listenErr := make(chan error, len(peers))
+	for i, peer := range peers {
+		peer.router, err = onion.NewRouter(peer.cfg,
+			onion.WithRPS(newPeerSampler(rpsPeers, i, random.Int63())),
+			onion.WithRand(mathRand.New(mathRand.NewSource(random.Int63()))), //nolint:gosec // simulations must be reproducible
+			onion.WithTransport(network.Transport(PeerAddress(i))),
+			onion.WithLogger(s.Logger),
+		)
+		if err != nil {
+			return result, err
+		}
+
+		wg.Add(1)
+		go func(peer *simPeer) {
+			defer wg.Done()
+			if err := onion.ListenOnionSocket(peer.cfg, peer.router, quit); err != nil {
+				listenErr <- err
+			}
+		}(peer)
+	}
+
+	// wait until all peers accept connections
+	for _, peer := range peers {
+		for peer.router.CheckListener() != nil {
+			select {
+			case err := <-listenErr:
+				return result, err
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+
+	var roundErrorsLock sync.Mutex // guards roundErrors
+	var roundErrors []error
+	initiator := peers[0].router
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// the round logic gives up on errors, e.g. if a cover tunnel can not be built, and is restarted like the
+		// supervisor of the peer would do
+		for {
+			err := initiator.HandleRounds(quit)
+			if err == nil {
+				return
+			}
+
+			roundErrorsLock.Lock()
+			roundErrors = append(roundErrors, err)
+			roundErrorsLock.Unlock()
+
+			select {
+			case <-quit:
+				return
+			case <-time.After(restartDelay):
+			}
+		}
+	}()
+
+	// give each build enough time for every hop to time out, and the round for a cover tunnel build
+	roundTimeout := time.Duration((s.Tunnels+1)*s.TunnelLength*s.BuildTimeout) * time.Second
+	client := &onion.ClientFuncs{}
+	for round := 0; round < s.Rounds; round++ {
+		replies := make([]chan onion.BuildTunnelReply, s.Tunnels)
+		for i := range replies {
+			target := rpsPeers[1+random.Intn(len(rpsPeers)-1)]
+			replies[i] = initiator.BuildTunnel(copyPeer(target), client)
+		}
+
+		start := time.Now()
+		deadline := time.NewTimer(roundTimeout)
+		timedOut := false
+		initiator.TriggerRound()
+		for _, replyChan := range replies {
+			if timedOut {
+				result.Failed++
+				continue
+			}
+
+			select {
+			case reply := <-replyChan:
+				if reply.Err != nil {
+					result.Failed++
+					continue
+				}
+				result.Builds++
+				result.BuildTimes = append(result.BuildTimes, time.Since(start))
+				start = time.Now()
+
+				// like a client closing the tunnel, it is torn down in the next round
+				_ = initiator.RemoveClientFromTunnel(reply.Tunnel.ID(), client)
+			case <-deadline.C:
+				timedOut = true
+				result.Failed++
+			}
+		}
+		deadline.Stop()
+	}
+
+	// errors caused by tearing down the simulation are not part of the result
+	roundErrorsLock.Lock()
+	result.RoundErrors = append(result.RoundErrors, roundErrors...)
+	roundErrorsLock.Unlock()
+	return result, nil
+}
+
+// newPeers creates the configs and the descriptors of the simulated peers.
+func newPeers(s Scenario) (peers []*simPeer, rpsPeers []*rps.Peer, err error) {
+	for i := 0; i < s.Peers; i++ {
+		var hostKey *rsa.PrivateKey
+		if i < len(s.HostKeys) {
+			hostKey = s.HostKeys[i]
+		} else {
+			hostKey, err = rsa.GenerateKey(rand.Reader, hostKeyBits)
+			if err != nil {
+				return nil, nil, fmt.Errorf("error generating host key: %w", err)
+			}
+		}
+
+		cfg := &config.Config{
+			P2PHostname:   PeerAddress(i).String(),
+			P2PPort:       simulatedPort,
+			TunnelLength:  s.TunnelLength,
+			RoundDuration: roundDuration,
+			BuildTimeout:  s.BuildTimeout,
+			HostKey:       hostKey,
+		}
+		// like the default config, keep idle links open for reuse instead of racing new tunnels to close them
+		cfg.LinkIdleTimeout = roundDuration
+		peers = append(peers, &simPeer{cfg: cfg})
+		rpsPeers = append(rpsPeers, &rps.Peer{
+			Address: PeerAddress(i),
+			Port:    simulatedPort,
+			HostKey: &hostKey.PublicKey,
+		})
+	}
+	return peers, rpsPeers, nil
+}
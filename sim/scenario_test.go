@@ -0,0 +1,62 @@
+package sim
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	hostKeys := make([]*rsa.PrivateKey, 5)
+	for i := range hostKeys {
+		var err error
+		hostKeys[i], err = rsa.GenerateKey(rand.Reader, 4096)
+		require.Nil(t, err)
+	}
+
+	scenario := Scenario{
+		Peers:        5,
+		TunnelLength: 3,
+		Rounds:       2,
+		Tunnels:      2,
+		BuildTimeout: 1,
+		Conditions:   Conditions{Latency: time.Millisecond, Jitter: time.Millisecond},
+		Seed:         1,
+		HostKeys:     hostKeys,
+	}
+
+	t.Run("reliable", func(t *testing.T) {
+		result, err := Run(scenario)
+		require.Nil(t, err)
+		assert.Equal(t, 4, result.Builds)
+		assert.Equal(t, 0, result.Failed)
+		assert.Len(t, result.BuildTimes, 4)
+		assert.Empty(t, result.RoundErrors)
+	})
+
+	t.Run("loss", func(t *testing.T) {
+		lossy := scenario
+		lossy.Rounds = 1
+		lossy.Tunnels = 1
+		lossy.Conditions.Loss = 1
+
+		result, err := Run(lossy)
+		require.Nil(t, err)
+		assert.Equal(t, 0, result.Builds)
+		assert.Equal(t, 1, result.Failed)
+		assert.NotEmpty(t, result.RoundErrors)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		invalid := scenario
+		invalid.Peers = 3
+
+		_, err := Run(invalid)
+		assert.True(t, errors.Is(err, ErrInvalidScenario))
+	})
+}
@@ -0,0 +1,200 @@
+package socks
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"bawang/config"
+	"bawang/onion"
+	"bawang/p2p"
+	"bawang/rps"
+)
+
+// ListenSOCKSSocket opens the SOCKS5 proxy endpoint and accepts incoming proxy connections,
+// which are handled concurrently in goroutines.
+// Each proxy connection is tunneled through a new onion tunnel to the onion peer the requested destination is mapped
+// to in the config. Returns once quit is closed.
+func ListenSOCKSSocket(cfg *config.Config, router *onion.Router, quit chan struct{}) error {
+	ln, err := net.Listen("tcp", cfg.SOCKSAddress)
+	if err != nil {
+		return err
+	}
+	log.Printf("SOCKS5 Proxy Listening at %v\n", cfg.SOCKSAddress)
+
+	// close the listener once a quit signal is received to stop the loop below when blocking on ln.Accept()
+	go func() {
+		<-quit
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-quit:
+				return nil
+			default:
+			}
+			log.Printf("Error accepting SOCKS connection: %v\n", err)
+			continue
+		}
+
+		// handle connections concurrently in goroutines
+		go handleConn(conn, cfg, router)
+	}
+}
+
+// proxyClient is the onion.Client of a single proxy connection, writing the data received on the tunnel to the
+// proxy connection.
+type proxyClient struct {
+	conn      net.Conn
+	closeOnce sync.Once
+	closed    chan struct{} // closed when the proxy connection was terminated
+
+	eofOnce   sync.Once
+	remoteEOF chan struct{} // closed when the destination finished sending
+}
+
+// newProxyClient creates the onion.Client for the given proxy connection.
+func newProxyClient(conn net.Conn) *proxyClient {
+	return &proxyClient{
+		conn:      conn,
+		closed:    make(chan struct{}),
+		remoteEOF: make(chan struct{}),
+	}
+}
+
+// SendTunnelIncoming ignores incoming tunnels, proxy connections only use the tunnel they built.
+func (client *proxyClient) SendTunnelIncoming(tunnelID uint32) error {
+	return nil
+}
+
+// SendTunnelData writes the data received on the tunnel to the proxy connection.
+func (client *proxyClient) SendTunnelData(tunnelID uint32, data []byte) error {
+	_, err := client.conn.Write(data)
+	return err
+}
+
+// SendTunnelDatagram ignores datagrams, a SOCKS5 CONNECT proxy connection is a stream.
+func (client *proxyClient) SendTunnelDatagram(tunnelID uint32, data []byte) error {
+	return nil
+}
+
+// SendTunnelEOF shuts down the writing side of the proxy connection, when the destination finished sending.
+func (client *proxyClient) SendTunnelEOF(tunnelID uint32) (err error) {
+	client.eofOnce.Do(func() {
+		if tcpConn, ok := client.conn.(*net.TCPConn); ok {
+			err = tcpConn.CloseWrite()
+		}
+		close(client.remoteEOF)
+	})
+	return err
+}
+
+// SendTunnelDestroy closes the proxy connection when the tunnel is destroyed.
+func (client *proxyClient) SendTunnelDestroy(tunnelID uint32) error {
+	return client.Terminate()
+}
+
+// Terminate closes the proxy connection. It is safe to call Terminate multiple times.
+func (client *proxyClient) Terminate() (err error) {
+	client.closeOnce.Do(func() {
+		err = client.conn.Close()
+		close(client.closed)
+	})
+	return err
+}
+
+// handleConn performs the SOCKS5 handshake on a proxy connection, builds an onion tunnel to the requested destination
+// and proxies the data until either side closes.
+func handleConn(conn net.Conn, cfg *config.Config, router *onion.Router) {
+	client := newProxyClient(conn)
+	defer client.Terminate()
+
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{bufio.NewReader(conn), conn}
+
+	err := negotiateMethod(rw)
+	if err != nil {
+		log.Printf("Error negotiating SOCKS method: %v\n", err)
+		return
+	}
+
+	req, code, err := readRequest(rw)
+	if err != nil {
+		log.Printf("Invalid SOCKS request: %v\n", err)
+		_ = writeReply(conn, code)
+		return
+	}
+
+	// destinations are mapped by host only, the requested port is ignored since the tunnel ends at the API clients of
+	// the mapped peer, which do not learn it either
+	destination, ok := cfg.SOCKSDestinations[strings.ToLower(req.host)]
+	if !ok {
+		log.Printf("Rejecting SOCKS request for unmapped destination %v\n", req.address())
+		_ = writeReply(conn, replyNotAllowed)
+		return
+	}
+
+	// the tunnel is built at the beginning of the next round
+	targetPeer := &rps.Peer{
+		Address: destination.Address,
+		Port:    destination.Port,
+		HostKey: destination.HostKey,
+	}
+	tunnelReply, ok := <-router.BuildTunnel(targetPeer, client)
+	if !ok { // chan was closed, meaning the router shut down
+		_ = writeReply(conn, replyGeneralFailure)
+		return
+	}
+	if tunnelReply.Err != nil {
+		log.Printf("Error building tunnel for SOCKS destination %v: %v\n", req.address(), tunnelReply.Err)
+		_ = writeReply(conn, replyHostUnreachable)
+		return
+	}
+	tunnel := tunnelReply.Tunnel
+	defer func() {
+		// the tunnel is torn down at the beginning of the next round if it has no clients anymore
+		_ = router.RemoveClientFromTunnel(tunnel.ID(), client)
+	}()
+
+	err = writeReply(conn, replySucceeded)
+	if err != nil {
+		return
+	}
+
+	// pass the data from the proxy connection through the tunnel
+	buf := make([]byte, p2p.MaxRelayDataSize)
+	for {
+		n, err := rw.Read(buf)
+		if n > 0 {
+			if sendErr := router.SendData(tunnel.ID(), buf[:n]); sendErr != nil {
+				log.Printf("Error sending SOCKS data on tunnel %v: %v\n", tunnel.ID(), sendErr)
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return // proxy connection closed
+		}
+	}
+
+	// the proxy client finished sending, but the destination might still send a response
+	err = router.SendEOF(tunnel.ID())
+	if err != nil {
+		log.Printf("Error sending SOCKS EOF on tunnel %v: %v\n", tunnel.ID(), err)
+		return
+	}
+	select {
+	case <-client.remoteEOF:
+	case <-client.closed:
+	}
+}
@@ -0,0 +1,168 @@
+package socks
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/config"
+	"bawang/onion"
+	"bawang/rps"
+)
+
+// stubRPS provides no peers, the loopback tunnels built in the tests below do not need any.
+type stubRPS struct{}
+
+func (stubRPS) GetPeer() (*rps.Peer, error) {
+	return nil, errors.New("no peers")
+}
+
+func (stubRPS) SampleIntermediatePeers(n int, target *rps.Peer) ([]*rps.Peer, error) {
+	return nil, errors.New("no peers")
+}
+
+func (stubRPS) Close() {}
+
+// destinationEvent is a message received by the destination at the other end of a loopback tunnel.
+type destinationEvent struct {
+	tunnelID uint32
+	data     []byte // nil for EOF
+}
+
+// newLoopbackProxy returns the config and router of a proxy whose destination example.com is the router itself,
+// such that proxy connections end in loopback tunnels. The messages received at the other end are passed to the
+// returned channel.
+func newLoopbackProxy(t *testing.T) (cfg *config.Config, router *onion.Router, destination chan destinationEvent) {
+	cfg = &config.Config{
+		P2PHostname:     "127.0.0.1",
+		P2PPort:         6304,
+		LoopbackTunnels: true,
+		SOCKSDestinations: map[string]*config.SOCKSDestination{
+			"example.com": {Address: net.ParseIP("127.0.0.1"), Port: 6304},
+		},
+	}
+	router, err := onion.NewRouter(cfg, onion.WithRPS(stubRPS{}))
+	require.Nil(t, err)
+
+	destination = make(chan destinationEvent, 10)
+	router.RegisterClient(&onion.ClientFuncs{
+		Data: func(tunnelID uint32, data []byte) error {
+			destination <- destinationEvent{tunnelID: tunnelID, data: append([]byte{}, data...)}
+			return nil
+		},
+		EOF: func(tunnelID uint32) error {
+			destination <- destinationEvent{tunnelID: tunnelID}
+			return nil
+		},
+	})
+	return cfg, router, destination
+}
+
+// dialProxy connects to a proxy handling its connections with handleConn and requests a connection to the given
+// host, returning the proxy connection and the code of the reply.
+func dialProxy(t *testing.T, cfg *config.Config, router *onion.Router, host string) (conn *net.TCPConn,
+	code replyCode, done chan struct{}) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		proxyConn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		handleConn(proxyConn, cfg, router)
+	}()
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+	conn = nc.(*net.TCPConn)
+	require.Nil(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = conn.Write([]byte{version5, 1, methodNoAuth})
+	require.Nil(t, err)
+	method := make([]byte, 2)
+	_, err = io.ReadFull(conn, method)
+	require.Nil(t, err)
+	require.Equal(t, []byte{version5, methodNoAuth}, method)
+
+	req := append([]byte{version5, cmdConnect, 0, atypDomain, byte(len(host))}, host...)
+	_, err = conn.Write(append(req, 0, 80))
+	require.Nil(t, err)
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(conn, reply)
+	require.Nil(t, err)
+	return conn, replyCode(reply[1]), done
+}
+
+func TestHandleConn(t *testing.T) {
+	t.Run("mapped", func(t *testing.T) {
+		cfg, router, destination := newLoopbackProxy(t)
+		conn, code, done := dialProxy(t, cfg, router, "Example.com")
+		defer conn.Close()
+		require.Equal(t, replySucceeded, code)
+
+		// the data is passed through the tunnel in both directions
+		_, err := conn.Write([]byte("request"))
+		require.Nil(t, err)
+		event := <-destination
+		assert.Equal(t, []byte("request"), event.data)
+
+		require.Nil(t, router.SendData(event.tunnelID, []byte("response")))
+		response := make([]byte, len("response"))
+		_, err = io.ReadFull(conn, response)
+		require.Nil(t, err)
+		assert.Equal(t, []byte("response"), response)
+
+		// the proxy connection is closed once the tunnel is torn down
+		require.Nil(t, router.CloseTunnel(event.tunnelID))
+		_, err = conn.Read(response)
+		assert.NotNil(t, err)
+		<-done
+	})
+
+	t.Run("unmapped", func(t *testing.T) {
+		cfg, router, destination := newLoopbackProxy(t)
+		conn, code, done := dialProxy(t, cfg, router, "example.org")
+		defer conn.Close()
+		assert.Equal(t, replyNotAllowed, code)
+
+		// no tunnel is built
+		<-done
+		_, err := conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+		assert.Empty(t, destination)
+	})
+
+	t.Run("eof", func(t *testing.T) {
+		cfg, router, destination := newLoopbackProxy(t)
+		conn, code, done := dialProxy(t, cfg, router, "example.com")
+		defer conn.Close()
+		require.Equal(t, replySucceeded, code)
+
+		_, err := conn.Write([]byte("request"))
+		require.Nil(t, err)
+		event := <-destination
+		assert.Equal(t, []byte("request"), event.data)
+
+		// the client finished sending, while the destination may still respond
+		require.Nil(t, conn.CloseWrite())
+		event = <-destination
+		assert.Nil(t, event.data)
+
+		require.Nil(t, router.SendData(event.tunnelID, []byte("response")))
+		require.Nil(t, router.SendEOF(event.tunnelID))
+		response, err := ioutil.ReadAll(conn)
+		require.Nil(t, err)
+		assert.Equal(t, []byte("response"), response)
+		<-done
+	})
+}
@@ -0,0 +1,143 @@
+// Package socks provides a SOCKS5 ingress proxy mapping proxy connections to onion tunnels.
+package socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 protocol constants, see RFC 1928.
+const (
+	version5 = 0x05
+
+	methodNoAuth       = 0x00
+	methodNoAcceptable = 0xff
+
+	cmdConnect = 0x01
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// replyCode is the status code of a SOCKS5 reply.
+type replyCode byte
+
+const (
+	replySucceeded           replyCode = 0x00
+	replyGeneralFailure      replyCode = 0x01
+	replyNotAllowed          replyCode = 0x02
+	replyHostUnreachable     replyCode = 0x04
+	replyCommandNotSupported replyCode = 0x07
+	replyAtypNotSupported    replyCode = 0x08
+)
+
+var (
+	errInvalidVersion     = errors.New("invalid SOCKS version")
+	errNoAcceptableMethod = errors.New("no acceptable SOCKS authentication method")
+	errUnsupportedCommand = errors.New("unsupported SOCKS command")
+	errUnsupportedAtyp    = errors.New("unsupported SOCKS address type")
+)
+
+// request is a parsed SOCKS5 request.
+type request struct {
+	cmd  byte
+	host string // domain name or textual IP address
+	port uint16
+}
+
+// address returns the requested destination in the form host:port.
+func (req *request) address() string {
+	return net.JoinHostPort(req.host, strconv.Itoa(int(req.port)))
+}
+
+// negotiateMethod reads the client's greeting and selects the "no authentication required" method,
+// which is the only method supported.
+func negotiateMethod(rw io.ReadWriter) (err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(rw, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != version5 {
+		return errInvalidVersion
+	}
+
+	methods := make([]byte, hdr[1])
+	if _, err = io.ReadFull(rw, methods); err != nil {
+		return err
+	}
+
+	for _, method := range methods {
+		if method == methodNoAuth {
+			_, err = rw.Write([]byte{version5, methodNoAuth})
+			return err
+		}
+	}
+
+	_, _ = rw.Write([]byte{version5, methodNoAcceptable})
+	return errNoAcceptableMethod
+}
+
+// readRequest reads and parses a SOCKS5 request.
+// If the request is invalid, the replyCode to respond with is returned together with the error.
+func readRequest(rd io.Reader) (req *request, code replyCode, err error) {
+	var hdr [4]byte
+	if _, err = io.ReadFull(rd, hdr[:]); err != nil {
+		return nil, replyGeneralFailure, err
+	}
+	if hdr[0] != version5 {
+		return nil, replyGeneralFailure, errInvalidVersion
+	}
+
+	req = &request{cmd: hdr[1]}
+
+	switch hdr[3] {
+	case atypIPv4:
+		var ip [net.IPv4len]byte
+		if _, err = io.ReadFull(rd, ip[:]); err != nil {
+			return nil, replyGeneralFailure, err
+		}
+		req.host = net.IP(ip[:]).String()
+	case atypIPv6:
+		var ip [net.IPv6len]byte
+		if _, err = io.ReadFull(rd, ip[:]); err != nil {
+			return nil, replyGeneralFailure, err
+		}
+		req.host = net.IP(ip[:]).String()
+	case atypDomain:
+		var length [1]byte
+		if _, err = io.ReadFull(rd, length[:]); err != nil {
+			return nil, replyGeneralFailure, err
+		}
+		domain := make([]byte, length[0])
+		if _, err = io.ReadFull(rd, domain); err != nil {
+			return nil, replyGeneralFailure, err
+		}
+		req.host = string(domain)
+	default:
+		return nil, replyAtypNotSupported, errUnsupportedAtyp
+	}
+
+	var port [2]byte
+	if _, err = io.ReadFull(rd, port[:]); err != nil {
+		return nil, replyGeneralFailure, err
+	}
+	req.port = binary.BigEndian.Uint16(port[:])
+
+	if req.cmd != cmdConnect {
+		return req, replyCommandNotSupported, errUnsupportedCommand
+	}
+
+	return req, replySucceeded, nil
+}
+
+// writeReply sends a SOCKS5 reply with the given code.
+// Since the proxied connection ends in an onion tunnel, the bound address is always reported as 0.0.0.0:0.
+func writeReply(w io.Writer, code replyCode) (err error) {
+	reply := []byte{version5, byte(code), 0x00, atypIPv4, 0, 0, 0, 0, 0, 0}
+	_, err = w.Write(reply)
+	return err
+}
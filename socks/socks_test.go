@@ -0,0 +1,108 @@
+package socks
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readWriter combines a reader with a recording writer for testing the handshake.
+type readWriter struct {
+	*bytes.Reader
+	written bytes.Buffer
+}
+
+func (rw *readWriter) Write(p []byte) (int, error) {
+	return rw.written.Write(p)
+}
+
+func TestNegotiateMethod(t *testing.T) {
+	t.Run("no auth", func(t *testing.T) {
+		rw := &readWriter{Reader: bytes.NewReader([]byte{version5, 2, 0x02, methodNoAuth})}
+		err := negotiateMethod(rw)
+		require.Nil(t, err)
+		assert.Equal(t, []byte{version5, methodNoAuth}, rw.written.Bytes())
+	})
+
+	t.Run("no acceptable method", func(t *testing.T) {
+		rw := &readWriter{Reader: bytes.NewReader([]byte{version5, 1, 0x02})}
+		err := negotiateMethod(rw)
+		require.Equal(t, errNoAcceptableMethod, err)
+		assert.Equal(t, []byte{version5, methodNoAcceptable}, rw.written.Bytes())
+	})
+
+	t.Run("invalid version", func(t *testing.T) {
+		rw := &readWriter{Reader: bytes.NewReader([]byte{0x04, 1, methodNoAuth})}
+		err := negotiateMethod(rw)
+		require.Equal(t, errInvalidVersion, err)
+	})
+
+	t.Run("short", func(t *testing.T) {
+		rw := &readWriter{Reader: bytes.NewReader([]byte{version5, 2, methodNoAuth})}
+		err := negotiateMethod(rw)
+		require.NotNil(t, err)
+	})
+}
+
+func TestReadRequest(t *testing.T) {
+	t.Run("domain", func(t *testing.T) {
+		data := []byte{version5, cmdConnect, 0x00, atypDomain, 11}
+		data = append(data, []byte("example.com")...)
+		data = append(data, 0x00, 0x50)
+
+		req, code, err := readRequest(bytes.NewReader(data))
+		require.Nil(t, err)
+		assert.Equal(t, replySucceeded, code)
+		assert.Equal(t, "example.com", req.host)
+		assert.Equal(t, uint16(80), req.port)
+		assert.Equal(t, "example.com:80", req.address())
+	})
+
+	t.Run("IPv4", func(t *testing.T) {
+		data := []byte{version5, cmdConnect, 0x00, atypIPv4, 10, 0, 0, 1, 0x01, 0xbb}
+		req, code, err := readRequest(bytes.NewReader(data))
+		require.Nil(t, err)
+		assert.Equal(t, replySucceeded, code)
+		assert.Equal(t, "10.0.0.1", req.host)
+		assert.Equal(t, uint16(443), req.port)
+	})
+
+	t.Run("IPv6", func(t *testing.T) {
+		data := []byte{version5, cmdConnect, 0x00, atypIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0xbb}
+		req, code, err := readRequest(bytes.NewReader(data))
+		require.Nil(t, err)
+		assert.Equal(t, replySucceeded, code)
+		assert.Equal(t, "::1", req.host)
+		assert.Equal(t, "[::1]:443", req.address())
+	})
+
+	t.Run("unsupported command", func(t *testing.T) {
+		data := []byte{version5, 0x02, 0x00, atypIPv4, 10, 0, 0, 1, 0x01, 0xbb}
+		_, code, err := readRequest(bytes.NewReader(data))
+		require.Equal(t, errUnsupportedCommand, err)
+		assert.Equal(t, replyCommandNotSupported, code)
+	})
+
+	t.Run("unsupported address type", func(t *testing.T) {
+		data := []byte{version5, cmdConnect, 0x00, 0x05}
+		_, code, err := readRequest(bytes.NewReader(data))
+		require.Equal(t, errUnsupportedAtyp, err)
+		assert.Equal(t, replyAtypNotSupported, code)
+	})
+
+	t.Run("short", func(t *testing.T) {
+		data := []byte{version5, cmdConnect, 0x00, atypDomain, 11, 'e'}
+		_, code, err := readRequest(bytes.NewReader(data))
+		require.NotNil(t, err)
+		assert.Equal(t, replyGeneralFailure, code)
+	})
+}
+
+func TestWriteReply(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeReply(&buf, replyNotAllowed)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{version5, byte(replyNotAllowed), 0x00, atypIPv4, 0, 0, 0, 0, 0, 0}, buf.Bytes())
+}
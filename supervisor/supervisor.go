@@ -0,0 +1,133 @@
+// Package supervisor manages long-lived goroutines. Like an errgroup, a Group waits for all of its goroutines and
+// stops the remaining ones once one of them failed, such that the error can be handled by the owner of the group.
+// Goroutines which can recover from errors are restarted instead.
+package supervisor
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"bawang/errcode"
+)
+
+const (
+	minRestartDelay = time.Second // delay before a failed goroutine is restarted for the first time
+	maxRestartDelay = time.Minute // max. delay between restarts, a goroutine running this long is considered recovered
+)
+
+// Func is a supervised goroutine. It must return once quit is closed, with a nil error if it stopped cleanly.
+type Func func(quit chan struct{}) error
+
+// Group supervises a set of goroutines. The first error of a goroutine which is not restarted stops the group.
+type Group struct {
+	logger *log.Logger
+
+	wg       sync.WaitGroup
+	quit     chan struct{} // closed once the group is stopped
+	stopOnce sync.Once
+
+	errLock sync.Mutex // guards err
+	err     error      // first error stopping the group
+
+	minDelay time.Duration
+	maxDelay time.Duration
+}
+
+// New creates a Group logging restarts to the given logger. If logger is nil, the standard logger is used.
+func New(logger *log.Logger) *Group {
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	return &Group{
+		logger:   logger,
+		quit:     make(chan struct{}),
+		minDelay: minRestartDelay,
+		maxDelay: maxRestartDelay,
+	}
+}
+
+// Go runs fn in a new goroutine. If it returns an error, the group is stopped.
+func (g *Group) Go(name string, fn Func) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := fn(g.quit); err != nil {
+			g.fail(name, err)
+		}
+	}()
+}
+
+// GoRestart runs fn in a new goroutine, which is restarted with an exponential backoff if it fails with a retryable
+// error, see errcode.IsRetryable. Any other error stops the group.
+func (g *Group) GoRestart(name string, fn Func) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+
+		delay := g.minDelay
+		for {
+			started := time.Now()
+			err := fn(g.quit)
+			if err == nil {
+				return
+			}
+			if !errcode.IsRetryable(err) {
+				g.fail(name, err)
+				return
+			}
+
+			if time.Since(started) >= g.maxDelay {
+				delay = g.minDelay
+			}
+			g.logger.Printf("Restarting %s in %v after error: %v\n", name, delay, err)
+			select {
+			case <-g.quit:
+				return
+			case <-time.After(delay):
+			}
+
+			delay *= 2
+			if delay > g.maxDelay {
+				delay = g.maxDelay
+			}
+		}
+	}()
+}
+
+// fail records the error of the named goroutine and stops the group.
+func (g *Group) fail(name string, err error) {
+	g.errLock.Lock()
+	if g.err == nil {
+		g.err = fmt.Errorf("%s: %w", name, err)
+	}
+	g.errLock.Unlock()
+	g.Stop()
+}
+
+// Quit returns the channel which is closed once the group is stopped. It must not be closed by the caller.
+func (g *Group) Quit() chan struct{} {
+	return g.quit
+}
+
+// Stop signals all goroutines of the group to return. Stopping a group more than once is a no-op.
+func (g *Group) Stop() {
+	g.stopOnce.Do(func() {
+		close(g.quit)
+	})
+}
+
+// Err returns the error which stopped the group, nil if it was not stopped by an error.
+func (g *Group) Err() error {
+	g.errLock.Lock()
+	defer g.errLock.Unlock()
+	return g.err
+}
+
+// Wait blocks until all goroutines of the group returned and returns the error which stopped the group, if any.
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	return g.Err()
+}
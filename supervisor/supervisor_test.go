@@ -0,0 +1,112 @@
+package supervisor
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bawang/errcode"
+)
+
+func newTestGroup() *Group {
+	g := New(log.New(ioutil.Discard, "", 0))
+	g.minDelay = time.Millisecond
+	g.maxDelay = 4 * time.Millisecond
+	return g
+}
+
+func TestGroup(t *testing.T) {
+	t.Run("stop", func(t *testing.T) {
+		g := newTestGroup()
+		var stopped int32
+		for i := 0; i < 3; i++ {
+			g.Go("worker", func(quit chan struct{}) error {
+				<-quit
+				atomic.AddInt32(&stopped, 1)
+				return nil
+			})
+		}
+
+		g.Stop()
+		g.Stop() // no-op
+		assert.Nil(t, g.Wait())
+		assert.Equal(t, int32(3), atomic.LoadInt32(&stopped))
+	})
+
+	t.Run("fatal error", func(t *testing.T) {
+		g := newTestGroup()
+		errTest := errors.New("test")
+		g.Go("worker", func(quit chan struct{}) error {
+			<-quit
+			return nil
+		})
+		g.Go("failing", func(quit chan struct{}) error {
+			return errTest
+		})
+
+		err := g.Wait()
+		require.NotNil(t, err)
+		assert.True(t, errors.Is(err, errTest))
+		assert.Equal(t, "failing: test", err.Error())
+		assert.Equal(t, err, g.Err())
+
+		select {
+		case <-g.Quit():
+		default:
+			t.Error("group not stopped")
+		}
+	})
+
+	t.Run("restart", func(t *testing.T) {
+		g := newTestGroup()
+		errRetryable := errcode.New(errcode.ModuleAPI, errcode.Timeout, true, "retryable")
+		var runs int32
+		g.GoRestart("worker", func(quit chan struct{}) error {
+			if atomic.AddInt32(&runs, 1) < 5 {
+				return errRetryable
+			}
+			<-quit
+			return nil
+		})
+
+		for atomic.LoadInt32(&runs) < 5 {
+			time.Sleep(time.Millisecond)
+		}
+		g.Stop()
+		assert.Nil(t, g.Wait())
+		assert.Equal(t, int32(5), atomic.LoadInt32(&runs))
+	})
+
+	t.Run("restart fatal error", func(t *testing.T) {
+		g := newTestGroup()
+		errFatal := errcode.New(errcode.ModuleAPI, errcode.NotAllowed, false, "fatal")
+		var runs int32
+		g.GoRestart("worker", func(quit chan struct{}) error {
+			atomic.AddInt32(&runs, 1)
+			return errFatal
+		})
+
+		assert.True(t, errors.Is(g.Wait(), errFatal))
+		assert.Equal(t, int32(1), atomic.LoadInt32(&runs))
+	})
+
+	t.Run("stop while restarting", func(t *testing.T) {
+		g := newTestGroup()
+		g.minDelay = time.Hour
+		started := make(chan struct{})
+		g.GoRestart("worker", func(quit chan struct{}) error {
+			close(started)
+			return errcode.New(errcode.ModuleAPI, errcode.Timeout, true, "retryable")
+		})
+
+		<-started
+		g.Stop()
+		assert.Nil(t, g.Wait())
+	})
+}
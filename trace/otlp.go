@@ -0,0 +1,187 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// exportTimeout is the max. time an export of a batch of spans may take.
+const exportTimeout = 10 * time.Second
+
+// OTLP span kind and status codes, see the OpenTelemetry protocol specification.
+const (
+	otlpKindInternal = 1
+	otlpStatusOk     = 1
+	otlpStatusError  = 2
+)
+
+// OTLPExporter exports spans to an OpenTelemetry collector via OTLP over HTTP with JSON encoding.
+type OTLPExporter struct {
+	endpoint string
+	resource []Attribute
+	client   *http.Client
+}
+
+// NewOTLPExporter creates an OTLPExporter posting the spans to the given URL, e.g. http://localhost:4318/v1/traces.
+// The resource attributes describe the process the spans are recorded by.
+func NewOTLPExporter(endpoint string, resource []Attribute) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint: endpoint,
+		resource: resource,
+		client:   &http.Client{Timeout: exportTimeout},
+	}
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"` // 64-bit integers are encoded as strings
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// Export posts the spans to the collector.
+func (e *OTLPExporter) Export(spans []*Span) error {
+	data, err := json.Marshal(e.encode(spans))
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// encode converts the spans to an OTLP export request.
+func (e *OTLPExporter) encode(spans []*Span) *otlpRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.SpanID[:]),
+			Name:              s.Name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        encodeAttributes(s.Attributes),
+			Status:            otlpStatus{Code: otlpStatusOk},
+		}
+		if s.ParentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.ParentID[:])
+		}
+		if s.Err != nil {
+			span.Status = otlpStatus{Code: otlpStatusError, Message: s.Err.Error()}
+		}
+		encoded = append(encoded, span)
+	}
+
+	return &otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: encodeAttributes(e.resource)},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "bawang"},
+				Spans: encoded,
+			}},
+		}},
+	}
+}
+
+// encodeAttributes converts attributes to their OTLP representation.
+func encodeAttributes(attributes []Attribute) []otlpAttribute {
+	encoded := make([]otlpAttribute, len(attributes))
+	for i, attr := range attributes {
+		encoded[i] = otlpAttribute{Key: attr.Key, Value: encodeValue(attr.Value)}
+	}
+	return encoded
+}
+
+// encodeValue converts an attribute value to its OTLP representation.
+func encodeValue(value interface{}) (v otlpValue) {
+	var i int64
+	switch value := value.(type) {
+	case string:
+		v.StringValue = &value
+		return v
+	case bool:
+		v.BoolValue = &value
+		return v
+	case float64:
+		v.DoubleValue = &value
+		return v
+	case int:
+		i = int64(value)
+	case int64:
+		i = value
+	case uint8:
+		i = int64(value)
+	case uint16:
+		i = int64(value)
+	case uint32:
+		i = int64(value)
+	case uint64:
+		i = int64(value)
+	default:
+		s := fmt.Sprint(value)
+		v.StringValue = &s
+		return v
+	}
+
+	s := strconv.FormatInt(i, 10)
+	v.IntValue = &s
+	return v
+}
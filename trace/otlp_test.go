@@ -0,0 +1,82 @@
+package trace
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	var received map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/v1/traces", req.URL.Path)
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(req.Body)
+		require.Nil(t, err)
+		require.Nil(t, json.Unmarshal(body, &received))
+	}))
+	defer server.Close()
+
+	start := time.Unix(1600000000, 0)
+	span := &Span{
+		TraceID:  [16]byte{1},
+		SpanID:   [8]byte{2},
+		ParentID: [8]byte{3},
+		Name:     "tunnel.extend",
+		Start:    start,
+		End:      start.Add(time.Second),
+		Attributes: []Attribute{
+			{Key: "hop.address", Value: "10.0.0.1"},
+			{Key: "hop.port", Value: uint16(6602)},
+			{Key: "retried", Value: false},
+		},
+		Err: errors.New("timed out"),
+	}
+
+	exporter := NewOTLPExporter(server.URL+"/v1/traces", []Attribute{{Key: "service.name", Value: "bawang"}})
+	require.Nil(t, exporter.Export([]*Span{span}))
+
+	expected := `{"resourceSpans": [{
+		"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "bawang"}}]},
+		"scopeSpans": [{
+			"scope": {"name": "bawang"},
+			"spans": [{
+				"traceId": "01000000000000000000000000000000",
+				"spanId": "0200000000000000",
+				"parentSpanId": "0300000000000000",
+				"name": "tunnel.extend",
+				"kind": 1,
+				"startTimeUnixNano": "1600000000000000000",
+				"endTimeUnixNano": "1600000001000000000",
+				"attributes": [
+					{"key": "hop.address", "value": {"stringValue": "10.0.0.1"}},
+					{"key": "hop.port", "value": {"intValue": "6602"}},
+					{"key": "retried", "value": {"boolValue": false}}
+				],
+				"status": {"code": 2, "message": "timed out"}
+			}]
+		}]
+	}]}`
+	data, err := json.Marshal(received)
+	require.Nil(t, err)
+	assert.JSONEq(t, expected, string(data))
+}
+
+func TestOTLPExporterError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	exporter := NewOTLPExporter(server.URL, nil)
+	err := exporter.Export([]*Span{{Name: "tunnel"}})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "503")
+}
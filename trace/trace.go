@@ -0,0 +1,224 @@
+// Package trace records spans of the tunnel lifecycles and exports them to an OpenTelemetry collector via OTLP, such
+// that latency issues can be traced in test deployments.
+package trace
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"bawang/config"
+)
+
+const (
+	// exportInterval is the max. time finished spans wait before they are exported.
+	exportInterval = 2 * time.Second
+	// maxBatch is the max. number of spans exported at once, further spans are exported in another batch.
+	maxBatch = 256
+	// maxQueued is the max. number of finished spans waiting to be exported. Spans finished meanwhile are dropped,
+	// such that a slow or dead collector does not slow down the tunnels.
+	maxQueued = 4 * maxBatch
+)
+
+// Attribute is a key-value pair describing a Span.
+type Attribute struct {
+	Key   string
+	Value interface{} // string, bool, an integer or a float64, any other value is exported as string
+}
+
+// Span is a timed operation, e.g. the build of a tunnel. Spans started as children of another span belong to the same
+// trace. All methods are no-ops on a nil Span, such that the callers need not check whether tracing is enabled.
+type Span struct {
+	tracer *Tracer
+
+	lock       sync.Mutex // guards the fields below while the span is running
+	TraceID    [16]byte
+	SpanID     [8]byte
+	ParentID   [8]byte // zero for the root span of a trace
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+	Err        error // reason the operation failed, nil if it succeeded
+}
+
+// Child starts a new span as child of s.
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+
+	child := s.tracer.newSpan(name)
+	child.TraceID = s.TraceID
+	child.ParentID = s.SpanID
+	return child
+}
+
+// Set adds an attribute to the span.
+func (s *Span) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	s.Attributes = append(s.Attributes, Attribute{Key: key, Value: value})
+	s.lock.Unlock()
+}
+
+// Finish ends the span, which failed with err unless it is nil, and queues it for the export. Only the first call of
+// Finish has an effect. The span must not be modified afterwards.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	if !s.End.IsZero() {
+		s.lock.Unlock()
+		return
+	}
+	s.End = time.Now()
+	s.Err = err
+	s.lock.Unlock()
+
+	s.tracer.queue(s)
+}
+
+// Exporter sends finished spans to a tracing backend, see OTLPExporter. The slice of spans must not be retained.
+type Exporter interface {
+	Export(spans []*Span) error
+}
+
+// Tracer starts spans and exports them in batches once they are finished. All methods are no-ops on a nil Tracer.
+type Tracer struct {
+	exporter Exporter
+	logger   *log.Logger
+
+	spans     chan *Span // finished spans waiting to be exported
+	quit      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New creates a Tracer exporting the spans to the OTLP endpoint configured in the config.Config. Errors of the export
+// are logged to logger.
+func New(cfg *config.Config, logger *log.Logger) (*Tracer, error) {
+	if cfg == nil {
+		return nil, errors.New("invalid config")
+	}
+
+	endpoint, err := url.Parse(cfg.TraceEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, errors.New("trace endpoint must be an HTTP or HTTPS URL")
+	}
+
+	exporter := NewOTLPExporter(endpoint.String(), []Attribute{
+		{Key: "service.name", Value: "bawang"},
+		{Key: "service.instance.id", Value: cfg.Name},
+		{Key: "peer.address", Value: cfg.P2PHostname},
+		{Key: "peer.port", Value: cfg.P2PPort},
+	})
+	return NewTracer(exporter, logger), nil
+}
+
+// NewTracer creates a Tracer exporting the spans with the given Exporter. Errors of the exporter are logged to logger.
+func NewTracer(exporter Exporter, logger *log.Logger) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		logger:   logger,
+		spans:    make(chan *Span, maxQueued),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Start starts the root span of a new trace.
+func (t *Tracer) Start(name string) *Span {
+	if t == nil {
+		return nil
+	}
+
+	s := t.newSpan(name)
+	_, _ = rand.Read(s.TraceID[:])
+	return s
+}
+
+// newSpan creates a span starting now with a random ID.
+func (t *Tracer) newSpan(name string) *Span {
+	s := &Span{
+		tracer: t,
+		Name:   name,
+		Start:  time.Now(),
+	}
+	_, _ = rand.Read(s.SpanID[:])
+	return s
+}
+
+// queue queues a finished span for the export. The span is dropped if too many spans wait already.
+func (t *Tracer) queue(s *Span) {
+	select {
+	case t.spans <- s:
+	default:
+	}
+}
+
+// Close exports the spans finished so far and stops the Tracer. Spans finished afterwards are dropped.
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+
+	t.closeOnce.Do(func() {
+		close(t.quit)
+	})
+	<-t.done
+}
+
+// run exports the finished spans in batches until the Tracer is closed.
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, maxBatch)
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < maxBatch {
+				continue
+			}
+		case <-ticker.C:
+		case <-t.quit:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+			t.export(batch)
+			return
+		}
+
+		t.export(batch)
+		batch = batch[:0]
+	}
+}
+
+// export passes the given spans to the exporter, logging any error.
+func (t *Tracer) export(spans []*Span) {
+	if len(spans) == 0 {
+		return
+	}
+
+	err := t.exporter.Export(spans)
+	if err != nil {
+		t.logger.Printf("Error exporting %d spans: %v\n", len(spans), err)
+	}
+}
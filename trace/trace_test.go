@@ -0,0 +1,70 @@
+package trace
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder is an Exporter recording the exported spans for testing.
+type recorder struct {
+	lock  sync.Mutex
+	spans []*Span
+	err   error
+}
+
+func (r *recorder) Export(spans []*Span) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.spans = append(r.spans, spans...)
+	return r.err
+}
+
+func TestTracer(t *testing.T) {
+	exporter := &recorder{}
+	tracer := NewTracer(exporter, log.New(ioutil.Discard, "", 0))
+
+	root := tracer.Start("tunnel")
+	root.Set("hops", 3)
+	child := root.Child("tunnel.build")
+	child.Finish(errors.New("timed out"))
+	root.Finish(nil)
+	root.Finish(errors.New("ignored"))
+
+	// the finished spans are exported once the tracer is closed at the latest
+	tracer.Close()
+	require.Len(t, exporter.spans, 2)
+	assert.Same(t, child, exporter.spans[0])
+	assert.Same(t, root, exporter.spans[1])
+
+	assert.Equal(t, root.TraceID, child.TraceID)
+	assert.Equal(t, root.SpanID, child.ParentID)
+	assert.NotEqual(t, [16]byte{}, root.TraceID)
+	assert.Equal(t, [8]byte{}, root.ParentID)
+	assert.Equal(t, []Attribute{{Key: "hops", Value: 3}}, root.Attributes)
+	assert.Nil(t, root.Err)
+	assert.EqualError(t, child.Err, "timed out")
+	assert.False(t, root.End.Before(root.Start))
+
+	// spans finished after closing the tracer are dropped
+	tracer.Start("late").Finish(nil)
+	tracer.Close()
+	assert.Len(t, exporter.spans, 2)
+}
+
+func TestTracerDisabled(t *testing.T) {
+	var tracer *Tracer
+	span := tracer.Start("tunnel")
+	assert.Nil(t, span)
+
+	// spans of a disabled tracer are nil, which must be safe to use
+	child := span.Child("tunnel.build")
+	child.Set("hops", 3)
+	child.Finish(nil)
+	tracer.Close()
+}